@@ -0,0 +1,45 @@
+package filemanager
+
+import (
+	"bytes"
+	"io"
+	"sync"
+)
+
+// MAX_POOLED_BUFFER_SIZE is the largest buffer capacity kept for reuse, so a single huge file does not pin its
+// memory in the pool.
+const MAX_POOLED_BUFFER_SIZE = 64 * 1024 * 1024
+
+// bufferPool holds the scratch buffers of encoders, PDF writers and content loading. Their content is copied out
+// (bytes.Clone) before a buffer is returned, the copy being a single allocation of the exact size instead of the
+// repeated growth of a fresh buffer.
+var bufferPool = sync.Pool{
+	New: func() any { return new(bytes.Buffer) },
+}
+
+// getBuffer returns an empty buffer from the pool, hand it back with putBuffer.
+func getBuffer() *bytes.Buffer {
+	buf := bufferPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	return buf
+}
+
+// putBuffer returns the buffer to the pool. Its content must not be used afterwards.
+func putBuffer(buf *bytes.Buffer) {
+	if buf.Cap() > MAX_POOLED_BUFFER_SIZE {
+		return
+	}
+	buf.Reset()
+	bufferPool.Put(buf)
+}
+
+// readAllPooled reads r to the end like io.ReadAll, growing a pooled buffer instead of a fresh slice.
+func readAllPooled(r io.Reader) ([]byte, error) {
+	buf := getBuffer()
+	defer putBuffer(buf)
+	_, err := buf.ReadFrom(r)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.Clone(buf.Bytes()), nil
+}
@@ -0,0 +1,311 @@
+package filemanager
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+var (
+	ErrInvalidBundle = errors.New("invalid bundle")
+)
+
+const (
+	BUNDLE_FORMAT_VERSION = 1
+	// BUNDLE_MANIFEST_NAME is the first entry of every bundle.
+	BUNDLE_MANIFEST_NAME = "manifest.json"
+	// BUNDLE_FILES_DIR holds the files of a bundle as files/<storage type>/<path relative to the storage base>.
+	BUNDLE_FILES_DIR = "files"
+)
+
+// BundleSelector selects the files of ExportBundle among the records of the metadata store. Zero values select all.
+type BundleSelector struct {
+	Owner string
+	// PathPrefix is matched against the path relative to the public or private base path, e.g. "users/42/".
+	PathPrefix string
+	// StorageType restricts the bundle to public or private files, both by default.
+	StorageType FileStorageType
+	// Match is an additional filter, e.g. on MetaData.
+	Match func(record *FileRecord) bool
+}
+
+// BundleManifest describes the files of a bundle. Paths in its records are bundle paths, independent of the base
+// paths of the exporting FileManager.
+type BundleManifest struct {
+	Version   int            `json:"version"`
+	CreatedAt time.Time      `json:"createdAt"`
+	Files     []*BundleEntry `json:"files"`
+}
+
+// BundleEntry is a file of a bundle with its metadata and processing history.
+type BundleEntry struct {
+	Path        string          `json:"path"` // files/<storage type>/<relative path>
+	StorageType FileStorageType `json:"storageType"`
+	Record      *FileRecord     `json:"record"`
+}
+
+// bundleFile is a selected file with its path relative to its storage base.
+type bundleFile struct {
+	storageType  FileStorageType
+	relativePath string
+	record       *FileRecord
+}
+
+// ExportBundle writes the selected files with their metadata, checksums and processing history as a tar archive: a
+// manifest followed by the files. Bundles serve as backups, to move files between environments (paths are stored
+// relative to the public and private base paths) and as a data export of a user's files (BundleSelector.Owner).
+// Files are selected among the records of the metadata store, which is required; records of missing files are
+// skipped.
+func (fm *FileManager) ExportBundle(selector BundleSelector, w io.Writer) (*BundleManifest, error) {
+	store := fm.getMetadataStore()
+	if store == nil {
+		return nil, ErrMetadataStoreMissing
+	}
+	records, err := store.ListRecords()
+	if err != nil {
+		return nil, err
+	}
+	var files []bundleFile
+	for _, record := range records {
+		storageType, relativePath, ok := fm.bundleRelativePath(record.LocalFilePath)
+		if !ok || !selector.matches(storageType, relativePath, record) {
+			continue
+		}
+		files = append(files, bundleFile{storageType: storageType, relativePath: relativePath, record: record})
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].record.LocalFilePath < files[j].record.LocalFilePath })
+
+	// the manifest comes first and carries the checksums of the contents as they are now, as the records may be
+	// older than the files, so every file is read twice
+	storage := fm.GetStorage()
+	manifest := &BundleManifest{Version: BUNDLE_FORMAT_VERSION, CreatedAt: time.Now(), Files: []*BundleEntry{}}
+	var selected []bundleFile
+	for _, file := range files {
+		content, err := storage.ReadFile(file.record.LocalFilePath)
+		if err != nil {
+			fm.LogTo("INFO", fmt.Sprintf("[FileManager.ExportBundle] Skipping file(%s): %v\n", file.record.LocalFilePath, err))
+			continue
+		}
+		record := *file.record
+		bundlePath := path.Join(BUNDLE_FILES_DIR, string(file.storageType), file.relativePath)
+		sum := sha256.Sum256(content)
+		record.LocalFilePath = bundlePath
+		record.URL = ""
+		record.Checksum = hex.EncodeToString(sum[:])
+		record.FileSize = int64(len(content))
+		manifest.Files = append(manifest.Files, &BundleEntry{Path: bundlePath, StorageType: file.storageType, Record: &record})
+		selected = append(selected, file)
+	}
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	tw := tar.NewWriter(w)
+	err = writeBundleEntry(tw, BUNDLE_MANIFEST_NAME, data, manifest.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	for i, file := range selected {
+		content, err := storage.ReadFile(file.record.LocalFilePath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read file(%s): %v", file.record.LocalFilePath, err)
+		}
+		entry := manifest.Files[i]
+		sum := sha256.Sum256(content)
+		if hex.EncodeToString(sum[:]) != entry.Record.Checksum {
+			return nil, fmt.Errorf("file(%s) changed during the export", file.record.LocalFilePath)
+		}
+		err = writeBundleEntry(tw, entry.Path, content, file.record.UpdatedAt)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = tw.Close()
+	if err != nil {
+		return nil, err
+	}
+	fm.LogTo("INFO", fmt.Sprintf("[FileManager.ExportBundle] Exported %d files\n", len(manifest.Files)))
+	return manifest, nil
+}
+
+func writeBundleEntry(tw *tar.Writer, name string, content []byte, modTime time.Time) error {
+	err := tw.WriteHeader(&tar.Header{
+		Name:    name,
+		Mode:    0644,
+		Size:    int64(len(content)),
+		ModTime: modTime,
+		Format:  tar.FormatPAX,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = tw.Write(content)
+	return err
+}
+
+func (selector BundleSelector) matches(storageType FileStorageType, relativePath string, record *FileRecord) bool {
+	if selector.StorageType != "" && selector.StorageType != storageType {
+		return false
+	}
+	if selector.Owner != "" && selector.Owner != record.Owner {
+		return false
+	}
+	if selector.PathPrefix != "" && !strings.HasPrefix(relativePath, selector.PathPrefix) {
+		return false
+	}
+	return selector.Match == nil || selector.Match(record)
+}
+
+// bundleRelativePath splits a local path into its storage type and the path relative to the storage base.
+func (fm *FileManager) bundleRelativePath(localFilePath string) (FileStorageType, string, bool) {
+	for _, base := range []struct {
+		storageType FileStorageType
+		path        string
+	}{
+		{FileStorageTypePublic, fm.publicLocalBasePath},
+		{FileStorageTypePrivate, fm.privateLocalBasePath},
+	} {
+		relative, err := filepath.Rel(base.path, localFilePath)
+		if err == nil && relative != "." && !strings.HasPrefix(relative, "..") {
+			return base.storageType, filepath.ToSlash(relative), true
+		}
+	}
+	return "", "", false
+}
+
+// ImportBundle stores the files of a bundle written by ExportBundle below the public and private base paths, with
+// their metadata and processing history, and returns them. Files are saved with SaveFile, so versioning, quotas and
+// replication apply, and existing files of the same path are replaced. Checksums are verified; a bundle that is
+// malformed or does not match its manifest fails with ErrInvalidBundle, keeping the files imported before.
+func (fm *FileManager) ImportBundle(r io.Reader) ([]*ManagedFile, error) {
+	tr := tar.NewReader(r)
+	header, err := tr.Next()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidBundle, err)
+	}
+	if header.Name != BUNDLE_MANIFEST_NAME {
+		return nil, fmt.Errorf("%w: first entry is %q, not %s", ErrInvalidBundle, header.Name, BUNDLE_MANIFEST_NAME)
+	}
+	var manifest BundleManifest
+	err = json.NewDecoder(tr).Decode(&manifest)
+	if err != nil {
+		return nil, fmt.Errorf("%w: manifest: %v", ErrInvalidBundle, err)
+	}
+	if manifest.Version != BUNDLE_FORMAT_VERSION {
+		return nil, fmt.Errorf("%w: unsupported version %d", ErrInvalidBundle, manifest.Version)
+	}
+	entries := make(map[string]*BundleEntry, len(manifest.Files))
+	for _, entry := range manifest.Files {
+		if entry.Record == nil {
+			return nil, fmt.Errorf("%w: file(%s) has no record", ErrInvalidBundle, entry.Path)
+		}
+		entries[entry.Path] = entry
+	}
+	store := fm.getMetadataStore()
+
+	imported := []*ManagedFile{}
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return imported, fmt.Errorf("%w: %v", ErrInvalidBundle, err)
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		entry, ok := entries[header.Name]
+		if !ok {
+			return imported, fmt.Errorf("%w: file(%s) is not in the manifest", ErrInvalidBundle, header.Name)
+		}
+		delete(entries, header.Name)
+		localFilePath, err := fm.bundleLocalPath(entry)
+		if err != nil {
+			return imported, err
+		}
+		content, err := io.ReadAll(tr)
+		if err != nil {
+			return imported, fmt.Errorf("%w: file(%s): %v", ErrInvalidBundle, header.Name, err)
+		}
+		sum := sha256.Sum256(content)
+		checksum := hex.EncodeToString(sum[:])
+		if entry.Record.Checksum != "" && entry.Record.Checksum != checksum {
+			return imported, fmt.Errorf("%w: checksum mismatch of file(%s)", ErrInvalidBundle, header.Name)
+		}
+
+		record := *entry.Record
+		file := &ManagedFile{
+			FileName:      record.FileName,
+			MimeType:      record.MimeType,
+			LocalFilePath: localFilePath,
+			FileSize:      int64(len(content)),
+			Checksum:      checksum,
+			Owner:         record.Owner,
+			MetaData:      record.MetaData,
+			HTTPHeaders:   record.HTTPHeaders,
+			Content:       content,
+		}
+		if file.MetaData == nil {
+			file.MetaData = make(map[string]any)
+		}
+		if entry.StorageType == FileStorageTypePublic {
+			file.URL, _ = fm.GetPublicUrlForFile(localFilePath)
+		}
+		err = fm.SaveFile(file)
+		if err != nil {
+			return imported, fmt.Errorf("failed to save file(%s): %v", localFilePath, err)
+		}
+		if store != nil {
+			record.LocalFilePath = file.LocalFilePath
+			record.URL = file.URL
+			record.FileSize = file.FileSize
+			record.Checksum = checksum
+			record.UpdatedAt = time.Now()
+			err = store.SaveRecord(&record)
+			if err != nil {
+				return imported, fmt.Errorf("failed to save record of file(%s): %v", localFilePath, err)
+			}
+		}
+		if index := fm.getSearchIndex(); index != nil {
+			err = index.IndexDocument(NewSearchDocument(file))
+			if err != nil {
+				fm.LogTo("INFO", fmt.Sprintf("[FileManager.ImportBundle] Indexing file(%s) failed: %v\n", localFilePath, err))
+			}
+		}
+		file.Content = nil
+		imported = append(imported, file)
+	}
+	if len(entries) > 0 {
+		return imported, fmt.Errorf("%w: %d files of the manifest are missing", ErrInvalidBundle, len(entries))
+	}
+	fm.LogTo("INFO", fmt.Sprintf("[FileManager.ImportBundle] Imported %d files\n", len(imported)))
+	return imported, nil
+}
+
+// bundleLocalPath maps the bundle path of an entry below the base path of its storage type, refusing paths that
+// would leave it.
+func (fm *FileManager) bundleLocalPath(entry *BundleEntry) (string, error) {
+	prefix := path.Join(BUNDLE_FILES_DIR, string(entry.StorageType)) + "/"
+	relativePath := strings.TrimPrefix(entry.Path, prefix)
+	if relativePath == entry.Path || relativePath == "" || path.Clean(relativePath) != relativePath || strings.HasPrefix(relativePath, "../") || relativePath == ".." {
+		return "", fmt.Errorf("%w: invalid path %q", ErrInvalidBundle, entry.Path)
+	}
+	switch entry.StorageType {
+	case FileStorageTypePublic:
+		return fm.GetPublicLocalFilePath(relativePath), nil
+	case FileStorageTypePrivate:
+		return fm.GetPrivateLocalFilePath(relativePath), nil
+	default:
+		return "", fmt.Errorf("%w: invalid storage type %q of file(%s)", ErrInvalidBundle, entry.StorageType, entry.Path)
+	}
+}
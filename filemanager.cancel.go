@@ -0,0 +1,95 @@
+package filemanager
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+var (
+	ErrProcessCancelled = errors.New("process cancelled")
+	ErrProcessFinished  = errors.New("process already finished")
+)
+
+// Context returns the context of the process, cancelled by CancelProcess. Long-running plugins can watch it to stop
+// early; the pipeline itself stops at the next step boundary.
+func (fp *FileProcess) Context() context.Context {
+	fp.mu.Lock()
+	defer fp.mu.Unlock()
+	fp.initContextLocked()
+	return fp.ctx
+}
+
+// Cancelled reports whether the process was cancelled.
+func (fp *FileProcess) Cancelled() bool {
+	return fp.Context().Err() != nil
+}
+
+func (fp *FileProcess) initContextLocked() {
+	if fp.ctx == nil {
+		fp.ctx, fp.cancel = context.WithCancel(context.Background())
+	}
+}
+
+// CancelProcess cancels a registered process. ProcessFile finishes the running step, removes the outputs it already
+// saved and ends the process with a terminal status whose Error wraps ErrProcessCancelled, which clients waiting via
+// GetProcessUpdates receive like any other final status. Returns ErrProcessNotFound for unknown processes and
+// ErrProcessFinished for processes that already have their terminal status.
+func (fm *FileManager) CancelProcess(processID string) error {
+	fileProcess, err := fm.GetProcess(processID)
+	if err != nil {
+		return err
+	}
+	if !fileProcess.cancelUnlessFinished() {
+		return fmt.Errorf("%w: %s", ErrProcessFinished, processID)
+	}
+	fm.LogTo("INFO", fmt.Sprintf("[FileManager.CancelProcess] Cancelling process(%s)%s\n", processID, fileProcess.LogLabels()))
+	return nil
+}
+
+// cancelUnlessFinished cancels the context of the process and reports whether it was still running.
+func (fp *FileProcess) cancelUnlessFinished() bool {
+	fp.mu.Lock()
+	defer fp.mu.Unlock()
+	if fp.finished {
+		return false
+	}
+	fp.initContextLocked()
+	fp.cancel()
+	return true
+}
+
+// endCancelledProcess removes the outputs the process saved before it was cancelled and adds the terminal status.
+// Content-addressed outputs are kept, as other files may share them.
+func (fm *FileManager) endCancelledProcess(file *ManagedFile, fileProcess *FileProcess, statusCh chan<- *FileProcess, savedFiles []*ManagedFile) {
+	for _, savedFile := range savedFiles {
+		err := fm.removeOutput(savedFile)
+		if err != nil {
+			fm.LogTo("INFO", fmt.Sprintf("[FileManager.ProcessFile] Removing output(%s)%s of cancelled process failed: %v\n", savedFile.LocalFilePath, fileProcess.LogLabels(), err))
+		}
+	}
+	fileProcess.AddProcessingUpdate(ProcessingStatus{
+		ProcessID:         fileProcess.ID,
+		TimeStamp:         int(time.Now().UnixNano() / int64(time.Millisecond)),
+		ProcessorName:     "FileProcessing",
+		StatusDescription: "Processing cancelled",
+		Error:             fmt.Errorf("%w: %s", ErrProcessCancelled, fileProcess.ID),
+		Done:              true,
+	})
+	fm.LogTo("INFO", fmt.Sprintf("[FileManager.ProcessFile] Processing file(%s)%s cancelled, removed %d outputs\n", file.FileName, fileProcess.LogLabels(), len(savedFiles)))
+	fm.publishFinalStatus(statusCh, fileProcess)
+}
+
+// removeOutput deletes an output file saved by the process, bypassing the trash.
+func (fm *FileManager) removeOutput(outputFile *ManagedFile) error {
+	err := fm.GetStorage().Remove(outputFile.LocalFilePath)
+	if err != nil {
+		return err
+	}
+	fm.removeHTTPHeaders(outputFile.LocalFilePath)
+	fm.removePreCompressed(outputFile.LocalFilePath)
+	fm.releaseQuota(outputFile.LocalFilePath, int64(len(outputFile.Content)))
+	fm.replicate(outputFile.LocalFilePath, true)
+	return nil
+}
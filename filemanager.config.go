@@ -0,0 +1,867 @@
+package filemanager
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+var (
+	ErrInvalidConfig = errors.New("invalid filemanager config")
+)
+
+const (
+	STORAGE_BACKEND_LOCAL  = "local"
+	STORAGE_BACKEND_MEMORY = "memory"
+)
+
+// Config declares a complete FileManager for NewFromConfig. Durations are written like "24h" or "30m".
+//
+//	public_path: /srv/files/public
+//	private_path: /srv/files/private
+//	temp_path: /srv/files/tmp
+//	base_url: https://example.com/files/
+//	recipes_dir: ./recipes
+//	storage:
+//	  backend: local
+//	  encryption_key_env: FM_MASTER # see NewEnvKeyProvider
+//	plugins:
+//	  - type: image_manipulation
+//	  - type: clamav
+//	    options:
+//	      address: tcp://clamav:3310
+//	      fail_on_virus: true
+//	limits:
+//	  download_bytes_per_second: 52428800
+//	  process_retention: 1h
+type Config struct {
+	PublicPath  string `yaml:"public_path"`
+	PrivatePath string `yaml:"private_path"`
+	TempPath    string `yaml:"temp_path"`
+	BaseURL     string `yaml:"base_url"`
+	// CreateDirs creates missing public, private and temp directories instead of reporting them.
+	CreateDirs bool `yaml:"create_dirs"`
+	// RecipesDir is a recipe directory or a remote recipe source, see NewRecipeSource.
+	RecipesDir string `yaml:"recipes_dir"`
+	// RecipeRouting is the path of a routing file for LoadRecipeRouting.
+	RecipeRouting string        `yaml:"recipe_routing"`
+	Storage       StorageConfig `yaml:"storage"`
+	// Storages are added with AddStorage under their names, for the storage routing.
+	Storages map[string]StorageConfig `yaml:"storages"`
+	// StorageRouting is the path of a routing file for LoadStorageRouting.
+	StorageRouting string         `yaml:"storage_routing"`
+	Plugins        []PluginConfig `yaml:"plugins"`
+	Limits         LimitsConfig   `yaml:"limits"`
+	// MetadataDir enables a SidecarMetadataStore in the directory.
+	MetadataDir   string                `yaml:"metadata_dir"`
+	SearchIndex   bool                  `yaml:"search_index"` // enables a MemorySearchIndex
+	Versioning    *VersioningOptions    `yaml:"versioning"`
+	Trash         *TrashOptions         `yaml:"trash"`
+	UploadCleanup *UploadCleanupOptions `yaml:"upload_cleanup"`
+	// UploadTimeouts abort stalled and overlong uploads, see SetUploadTimeouts.
+	UploadTimeouts *UploadTimeoutOptions `yaml:"upload_timeouts"`
+	// UploadScan scans uploads with clamd before they are stored, see EnableUploadScan.
+	UploadScan *UploadScanConfig `yaml:"upload_scan"`
+	// Permissions set the modes of moved files and of their directories, see SetFilePermissions.
+	Permissions *FilePermissions `yaml:"permissions"`
+	// Sharding stores files in hashed shard directories, see EnableSharding.
+	Sharding *ShardingOptions `yaml:"sharding"`
+	// FastTemp writes small uploads to a fast temp path, e.g. on tmpfs, see EnableFastTemp.
+	FastTemp *FastTempOptions `yaml:"fast_temp"`
+	// MemoryMap memory-maps large files instead of reading them, see EnableMemoryMappedReads.
+	MemoryMap *MemoryMapOptions `yaml:"memory_map"`
+	// MimeDetection tunes the MIME detection of files, see SetMimeDetection.
+	MimeDetection *MimeDetectionOptions `yaml:"mime_detection"`
+}
+
+// StorageConfig selects the Storage backend: "local" (default), "memory" or a backend added with
+// RegisterStorageBackend, configured by Options.
+type StorageConfig struct {
+	Backend string         `yaml:"backend"`
+	Options map[string]any `yaml:"options"`
+	// EncryptionKeyEnv wraps the storage in an EncryptedStorage with master keys read by NewEnvKeyProvider from
+	// environment variables with this prefix.
+	EncryptionKeyEnv string `yaml:"encryption_key_env"`
+}
+
+// PluginConfig adds a processing plugin of a type registered with RegisterPluginType (or a built-in one) under
+// Name, which recipes refer to as plugin_name. Name defaults to Type.
+type PluginConfig struct {
+	Name    string         `yaml:"name"`
+	Type    string         `yaml:"type"`
+	Options map[string]any `yaml:"options"`
+	// Limits are set with SetPluginLimits.
+	Limits *PluginLimits `yaml:"limits"`
+}
+
+// UploadScanConfig configures EnableUploadScan with a ClamdScanner.
+type UploadScanConfig struct {
+	Address         string        `yaml:"address"` // tcp://host:port, unix:///path or a socket path
+	Timeout         time.Duration `yaml:"timeout"`
+	StreamMaxLength int64         `yaml:"stream_max_length"`
+	MaxConnections  int           `yaml:"max_connections"`
+	RejectUnscanned bool          `yaml:"reject_unscanned"`
+	MaxSize         int64         `yaml:"max_size"`
+}
+
+type LimitsConfig struct {
+	DownloadBytesPerSecond int64          `yaml:"download_bytes_per_second"` // see SetDownloadRateLimit
+	DownloadBurst          int            `yaml:"download_burst"`
+	ProcessRetention       time.Duration  `yaml:"process_retention"` // see SetProcessRetention
+	PriorityLanes          *PriorityLanes `yaml:"priority_lanes"`    // see SetPriorityLanes
+}
+
+// ConfigError lists every problem found in a Config, so all of them can be fixed at once.
+type ConfigError struct {
+	Problems []string
+}
+
+func (e *ConfigError) Error() string {
+	return fmt.Sprintf("%v:\n  - %s", ErrInvalidConfig, strings.Join(e.Problems, "\n  - "))
+}
+
+func (e *ConfigError) Is(target error) bool {
+	return target == ErrInvalidConfig
+}
+
+func (e *ConfigError) add(format string, args ...any) {
+	e.Problems = append(e.Problems, fmt.Sprintf(format, args...))
+}
+
+// PluginFactory creates a processing plugin from the options of its PluginConfig.
+type PluginFactory func(options map[string]any) (ProcessingPlugin, error)
+
+// StorageFactory creates a Storage from the options of the StorageConfig.
+type StorageFactory func(options map[string]any) (Storage, error)
+
+var (
+	configRegistryMu sync.RWMutex
+	pluginFactories  = map[string]PluginFactory{
+		"image_manipulation":      simplePluginFactory(func() ProcessingPlugin { return &ImageManipulationPlugin{} }),
+		"pdf_manipulation":        newPDFManipulationPluginFromOptions,
+		"pdf_text_extractor":      newPDFTextExtractorPluginFromOptions,
+		"format_converter":        newFormatConverterPluginFromOptions,
+		"exif_metadata_extractor": simplePluginFactory(func() ProcessingPlugin { return &ExifMetadataExtractorPlugin{} }),
+		"perceptual_hash":         simplePluginFactory(func() ProcessingPlugin { return &PerceptualHashPlugin{} }),
+		"placeholder":             newPlaceholderPluginFromOptions,
+		"video_probe":             newVideoProbePluginFromOptions,
+		"document_preview":        newDocumentPreviewPluginFromOptions,
+		"clamav":                  newClamAVPluginFromOptions,
+		"text_analysis":           newTextAnalysisPluginFromOptions,
+		"wasm":                    newWasmPluginFromOptions,
+		"data_validation":         newDataValidationPluginFromOptions,
+		"csv_validation":          simplePluginFactory(func() ProcessingPlugin { return &CSVValidationPlugin{} }),
+		"redaction":               newRedactionPluginFromOptions,
+	}
+	storageFactories = map[string]StorageFactory{
+		STORAGE_BACKEND_LOCAL:  func(map[string]any) (Storage, error) { return LocalStorage{}, nil },
+		STORAGE_BACKEND_MEMORY: func(map[string]any) (Storage, error) { return NewMemoryStorage(), nil },
+	}
+)
+
+// RegisterPluginType makes a plugin type available to configs, e.g. plugins that need providers or sinks
+// (moderation, embeddings, virus_scan) set up in code. Registering an existing type replaces it.
+func RegisterPluginType(pluginType string, factory PluginFactory) {
+	configRegistryMu.Lock()
+	defer configRegistryMu.Unlock()
+	pluginFactories[pluginType] = factory
+}
+
+// RegisterStorageBackend makes a storage backend available to configs.
+func RegisterStorageBackend(backend string, factory StorageFactory) {
+	configRegistryMu.Lock()
+	defer configRegistryMu.Unlock()
+	storageFactories[backend] = factory
+}
+
+func simplePluginFactory(create func() ProcessingPlugin) PluginFactory {
+	return func(options map[string]any) (ProcessingPlugin, error) {
+		if len(options) > 0 {
+			return nil, errors.New("plugin takes no options")
+		}
+		return create(), nil
+	}
+}
+
+// DecodeOptions decodes plugin or storage options into a struct with yaml tags, rejecting unknown options.
+func DecodeOptions(options map[string]any, target any) error {
+	data, err := yaml.Marshal(options)
+	if err != nil {
+		return err
+	}
+	return yaml.UnmarshalStrict(data, target)
+}
+
+type clamAVPluginOptions struct {
+	Address         string        `yaml:"address"` // tcp://host:port, unix:///path or a socket path
+	FailOnVirus     bool          `yaml:"fail_on_virus"`
+	Timeout         time.Duration `yaml:"timeout"`
+	StreamMaxLength int64         `yaml:"stream_max_length"`
+	ScanPaths       bool          `yaml:"scan_paths"`
+	MaxConnections  int           `yaml:"max_connections"`
+}
+
+func newClamAVPluginFromOptions(options map[string]any) (ProcessingPlugin, error) {
+	var opts clamAVPluginOptions
+	err := DecodeOptions(options, &opts)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Address == "" {
+		return nil, errors.New("option address is required, e.g. tcp://localhost:3310")
+	}
+	scanner := newClamdScannerFromAddress(opts.Address)
+	scanner.Timeout = opts.Timeout
+	scanner.StreamMaxLength = opts.StreamMaxLength
+	scanner.ScanPaths = opts.ScanPaths
+	scanner.MaxConnections = opts.MaxConnections
+	plugin, err := NewClamAVPluginWithScanner(scanner)
+	if err != nil {
+		return nil, err
+	}
+	plugin.FailOnVirus = opts.FailOnVirus
+	return plugin, nil
+}
+
+type pdfManipulationPluginOptions struct {
+	Engine string `yaml:"engine"` // a name registered with RegisterPDFEngine, defaults to unipdf
+	// Certificates are the PKCS#12 files of the sign manipulation by name.
+	Certificates map[string]pdfCertificateOptions `yaml:"certificates"`
+	TimestampURL string                           `yaml:"timestamp_url"`
+}
+
+type pdfCertificateOptions struct {
+	File        string `yaml:"file"`
+	PasswordEnv string `yaml:"password_env"` // the environment variable holding the password of the file
+}
+
+func newPDFManipulationPluginFromOptions(options map[string]any) (ProcessingPlugin, error) {
+	var opts pdfManipulationPluginOptions
+	err := DecodeOptions(options, &opts)
+	if err != nil {
+		return nil, err
+	}
+	plugin := &PDFManipulationPlugin{TimestampURL: opts.TimestampURL}
+	if opts.Engine != "" {
+		plugin.Engine, err = NewPDFEngine(opts.Engine)
+		if err != nil {
+			return nil, err
+		}
+	}
+	for name, certificateOpts := range opts.Certificates {
+		if certificateOpts.File == "" {
+			return nil, fmt.Errorf("certificate %s: option file is required", name)
+		}
+		data, err := os.ReadFile(certificateOpts.File)
+		if err != nil {
+			return nil, fmt.Errorf("certificate %s: %w", name, err)
+		}
+		certificate, err := LoadPKCS12Certificate(data, os.Getenv(certificateOpts.PasswordEnv))
+		if err != nil {
+			return nil, fmt.Errorf("certificate %s: %w", name, err)
+		}
+		if plugin.Certificates == nil {
+			plugin.Certificates = make(map[string]*PDFCertificate)
+		}
+		plugin.Certificates[name] = certificate
+	}
+	return plugin, nil
+}
+
+type redactionPluginOptions struct {
+	Patterns map[string]string `yaml:"patterns"` // added to RedactionPatterns
+	Engine   string            `yaml:"engine"`   // a name registered with RegisterPDFEngine, defaults to unipdf
+}
+
+func newRedactionPluginFromOptions(options map[string]any) (ProcessingPlugin, error) {
+	var opts redactionPluginOptions
+	err := DecodeOptions(options, &opts)
+	if err != nil {
+		return nil, err
+	}
+	for name, pattern := range opts.Patterns {
+		_, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("pattern %s: %w", name, err)
+		}
+	}
+	plugin := &RedactionPlugin{Patterns: opts.Patterns}
+	if opts.Engine != "" {
+		plugin.Engine, err = NewPDFEngine(opts.Engine)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return plugin, nil
+}
+
+type pdfTextExtractorPluginOptions struct {
+	Workers int `yaml:"workers"`
+}
+
+func newPDFTextExtractorPluginFromOptions(options map[string]any) (ProcessingPlugin, error) {
+	var opts pdfTextExtractorPluginOptions
+	err := DecodeOptions(options, &opts)
+	if err != nil {
+		return nil, err
+	}
+	return &PDFTextExtractorPlugin{Workers: opts.Workers}, nil
+}
+
+type placeholderPluginOptions struct {
+	Placeholder string `yaml:"placeholder"`
+	ComponentsX int    `yaml:"blurhash_components_x"`
+	ComponentsY int    `yaml:"blurhash_components_y"`
+	LQIPWidth   int    `yaml:"lqip_width"`
+}
+
+func newPlaceholderPluginFromOptions(options map[string]any) (ProcessingPlugin, error) {
+	var opts placeholderPluginOptions
+	err := DecodeOptions(options, &opts)
+	if err != nil {
+		return nil, err
+	}
+	return &PlaceholderPlugin{
+		Placeholder: opts.Placeholder,
+		ComponentsX: opts.ComponentsX,
+		ComponentsY: opts.ComponentsY,
+		LQIPWidth:   opts.LQIPWidth,
+	}, nil
+}
+
+type videoProbePluginOptions struct {
+	FFprobePath      string           `yaml:"ffprobe_path"`
+	FFmpegPath       string           `yaml:"ffmpeg_path"`
+	PosterTimestamps []string         `yaml:"poster_timestamps"`
+	PosterFormat     string           `yaml:"poster_format"`
+	PosterWidth      int              `yaml:"poster_width"`
+	Limits           SubprocessLimits `yaml:"limits"`
+}
+
+func newVideoProbePluginFromOptions(options map[string]any) (ProcessingPlugin, error) {
+	var opts videoProbePluginOptions
+	err := DecodeOptions(options, &opts)
+	if err != nil {
+		return nil, err
+	}
+	return &VideoProbePlugin{
+		FFprobePath:      opts.FFprobePath,
+		FFmpegPath:       opts.FFmpegPath,
+		PosterTimestamps: opts.PosterTimestamps,
+		PosterFormat:     opts.PosterFormat,
+		PosterWidth:      opts.PosterWidth,
+		Limits:           opts.Limits,
+	}, nil
+}
+
+type formatConverterPluginOptions struct {
+	DecompressionLimits DecompressionLimits `yaml:"decompression_limits"`
+}
+
+func newFormatConverterPluginFromOptions(options map[string]any) (ProcessingPlugin, error) {
+	var opts formatConverterPluginOptions
+	err := DecodeOptions(options, &opts)
+	if err != nil {
+		return nil, err
+	}
+	return &FormatConverterPlugin{DecompressionLimits: opts.DecompressionLimits}, nil
+}
+
+type documentPreviewPluginOptions struct {
+	OfficeConverterPath string              `yaml:"office_converter_path"`
+	RasterizerPath      string              `yaml:"rasterizer_path"`
+	Format              string              `yaml:"format"`
+	Width               int                 `yaml:"width"`
+	Timeout             time.Duration       `yaml:"timeout"`
+	DecompressionLimits DecompressionLimits `yaml:"decompression_limits"`
+	Limits              SubprocessLimits    `yaml:"limits"`
+}
+
+func newDocumentPreviewPluginFromOptions(options map[string]any) (ProcessingPlugin, error) {
+	var opts documentPreviewPluginOptions
+	err := DecodeOptions(options, &opts)
+	if err != nil {
+		return nil, err
+	}
+	return &DocumentPreviewPlugin{
+		OfficeConverterPath: opts.OfficeConverterPath,
+		RasterizerPath:      opts.RasterizerPath,
+		Format:              opts.Format,
+		Width:               opts.Width,
+		Timeout:             opts.Timeout,
+		DecompressionLimits: opts.DecompressionLimits,
+		Limits:              opts.Limits,
+	}, nil
+}
+
+type dataValidationPluginOptions struct {
+	XMLLintPath string           `yaml:"xmllint_path"`
+	Timeout     time.Duration    `yaml:"timeout"`
+	MaxProblems int              `yaml:"max_problems"`
+	Limits      SubprocessLimits `yaml:"limits"`
+}
+
+func newDataValidationPluginFromOptions(options map[string]any) (ProcessingPlugin, error) {
+	var opts dataValidationPluginOptions
+	err := DecodeOptions(options, &opts)
+	if err != nil {
+		return nil, err
+	}
+	return &DataValidationPlugin{
+		XMLLintPath: opts.XMLLintPath,
+		Timeout:     opts.Timeout,
+		MaxProblems: opts.MaxProblems,
+		Limits:      opts.Limits,
+	}, nil
+}
+
+type textAnalysisPluginOptions struct {
+	LLMEndpoint      string `yaml:"llm_endpoint"`
+	LLMAPIKey        string `yaml:"llm_api_key"`
+	LLMModel         string `yaml:"llm_model"`
+	LLMInputChars    int    `yaml:"llm_input_chars"`
+	SummarySentences int    `yaml:"summary_sentences"`
+	KeywordCount     int    `yaml:"keyword_count"`
+}
+
+func newTextAnalysisPluginFromOptions(options map[string]any) (ProcessingPlugin, error) {
+	var opts textAnalysisPluginOptions
+	err := DecodeOptions(options, &opts)
+	if err != nil {
+		return nil, err
+	}
+	return &TextAnalysisPlugin{
+		LLMEndpoint:      opts.LLMEndpoint,
+		LLMAPIKey:        opts.LLMAPIKey,
+		LLMModel:         opts.LLMModel,
+		LLMInputChars:    opts.LLMInputChars,
+		SummarySentences: opts.SummarySentences,
+		KeywordCount:     opts.KeywordCount,
+	}, nil
+}
+
+type wasmPluginConfigOptions struct {
+	Path             string        `yaml:"path"`
+	MemoryLimitPages uint32        `yaml:"memory_limit_pages"`
+	Timeout          time.Duration `yaml:"timeout"`
+}
+
+func newWasmPluginFromOptions(options map[string]any) (ProcessingPlugin, error) {
+	var opts wasmPluginConfigOptions
+	err := DecodeOptions(options, &opts)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Path == "" {
+		return nil, errors.New("option path (of the .wasm module) is required")
+	}
+	return NewWasmPluginFromFile(opts.Path, WasmPluginOptions{MemoryLimitPages: opts.MemoryLimitPages, Timeout: opts.Timeout})
+}
+
+// LoadConfig reads a YAML config file. ${VAR} and $VAR references are replaced with environment variables, so
+// secrets and per-environment paths can stay out of the file.
+func LoadConfig(path string) (Config, error) {
+	var config Config
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return config, err
+	}
+	err = yaml.UnmarshalStrict([]byte(os.ExpandEnv(string(data))), &config)
+	if err != nil {
+		return config, fmt.Errorf("%w: %s: %v", ErrInvalidConfig, path, err)
+	}
+	return config, nil
+}
+
+// NewFromConfigFile loads the config file and builds the FileManager with NewFromConfig.
+func NewFromConfigFile(path string, logger LogAdapter) (*FileManager, error) {
+	config, err := LoadConfig(path)
+	if err != nil {
+		return nil, err
+	}
+	return NewFromConfig(config, logger)
+}
+
+// NewFromConfig builds a FileManager from the config. It checks that the directories exist and are writable,
+// creates the storage and plugins and loads the recipes, and fails with a ConfigError listing all problems found
+// (missing settings, unusable directories, unknown plugin types, plugins that cannot start, recipes that do not
+// parse or use plugins that are not configured).
+func NewFromConfig(config Config, logger LogAdapter) (*FileManager, error) {
+	problems := &ConfigError{}
+	config.validate(problems)
+
+	configRegistryMu.RLock()
+	defer configRegistryMu.RUnlock()
+
+	backend := config.Storage.Backend
+	if backend == "" {
+		backend = STORAGE_BACKEND_LOCAL
+	}
+	storage := newConfiguredStorage(problems, "storage", config.Storage)
+	storages := make(map[string]Storage, len(config.Storages))
+	for name, storageConfig := range config.Storages {
+		if !tenantIDPattern.MatchString(name) {
+			problems.add("storages: %v: %q", ErrInvalidStorageName, name)
+			continue
+		}
+		if namedStorage := newConfiguredStorage(problems, "storages."+name, storageConfig); namedStorage != nil {
+			storages[name] = namedStorage
+		}
+	}
+	dirMode := DEFAULT_DIR_MODE
+	if config.Permissions != nil {
+		dirMode = config.Permissions.dirMode()
+	}
+	if backend == STORAGE_BACKEND_LOCAL {
+		for _, dir := range []struct{ key, path string }{
+			{"public_path", config.PublicPath},
+			{"private_path", config.PrivatePath},
+			{"temp_path", config.TempPath},
+		} {
+			checkWritableDir(problems, dir.key, dir.path, config.CreateDirs, dirMode)
+		}
+	}
+	if config.MetadataDir != "" {
+		checkWritableDir(problems, "metadata_dir", config.MetadataDir, config.CreateDirs, dirMode)
+	}
+	if config.Trash != nil {
+		checkWritableDir(problems, "trash.path", config.Trash.Path, config.CreateDirs, dirMode)
+	}
+
+	plugins := make(map[string]ProcessingPlugin)
+	for i, pluginConfig := range config.Plugins {
+		name := pluginConfig.Name
+		if name == "" {
+			name = pluginConfig.Type
+		}
+		factory, ok := pluginFactories[pluginConfig.Type]
+		switch {
+		case pluginConfig.Type == "":
+			problems.add("plugins[%d]: type is required", i)
+			continue
+		case !ok:
+			problems.add("plugins[%d]: unknown type %q, available: %s (custom types need RegisterPluginType)", i, pluginConfig.Type, strings.Join(sortedKeys(pluginFactories), ", "))
+			continue
+		}
+		if _, ok := plugins[name]; ok {
+			problems.add("plugins[%d]: duplicate name %q, set a distinct name", i, name)
+			continue
+		}
+		plugin, err := factory(pluginConfig.Options)
+		if err != nil {
+			problems.add("plugins[%d] %q (%s): %v", i, name, pluginConfig.Type, err)
+			continue
+		}
+		plugins[name] = plugin
+	}
+
+	if config.RecipesDir != "" {
+		source, err := NewRecipeSource(config.RecipesDir)
+		if err != nil {
+			problems.add("recipes_dir: %v", err)
+		} else if _, ok := source.(*DirRecipeSource); ok {
+			// remote sources are only fetched once, by LoadRecipes
+			for _, problem := range checkRecipeFiles(config.RecipesDir, plugins) {
+				problems.add("recipes_dir: %s", problem)
+			}
+		}
+	}
+	if len(problems.Problems) > 0 {
+		return nil, problems
+	}
+
+	fm := NewFileManager(config.PublicPath, config.PrivatePath, config.BaseURL, config.TempPath, logger)
+	fm.SetStorage(storage)
+	for name, namedStorage := range storages {
+		// validated above
+		_ = fm.AddStorage(name, namedStorage)
+	}
+	if config.Permissions != nil {
+		// validated with the config
+		_ = fm.SetFilePermissions(*config.Permissions)
+	}
+	if config.Sharding != nil {
+		// validated with the config
+		_ = fm.EnableSharding(*config.Sharding)
+	}
+	if config.FastTemp != nil {
+		// validated with the config
+		_ = fm.EnableFastTemp(*config.FastTemp)
+	}
+	if config.MemoryMap != nil {
+		// validated with the config
+		_ = fm.EnableMemoryMappedReads(*config.MemoryMap)
+	}
+	if config.MimeDetection != nil {
+		// validated with the config
+		_ = fm.SetMimeDetection(*config.MimeDetection)
+	}
+	for name, plugin := range plugins {
+		fm.AddProcessingPlugin(name, plugin)
+	}
+	for _, pluginConfig := range config.Plugins {
+		if pluginConfig.Limits == nil {
+			continue
+		}
+		name := pluginConfig.Name
+		if name == "" {
+			name = pluginConfig.Type
+		}
+		fm.SetPluginLimits(name, *pluginConfig.Limits)
+	}
+	if config.RecipesDir != "" {
+		err := fm.LoadRecipes(config.RecipesDir)
+		if err != nil {
+			return nil, fmt.Errorf("%w: recipes_dir: %v", ErrInvalidConfig, err)
+		}
+	}
+	if config.RecipeRouting != "" {
+		err := fm.LoadRecipeRouting(config.RecipeRouting)
+		if err != nil {
+			return nil, fmt.Errorf("%w: recipe_routing: %v", ErrInvalidConfig, err)
+		}
+	}
+	if config.StorageRouting != "" {
+		err := fm.LoadStorageRouting(config.StorageRouting)
+		if err != nil {
+			return nil, fmt.Errorf("%w: storage_routing: %v", ErrInvalidConfig, err)
+		}
+	}
+	if config.Limits.DownloadBytesPerSecond > 0 {
+		fm.SetDownloadRateLimit(config.Limits.DownloadBytesPerSecond, config.Limits.DownloadBurst)
+	}
+	if config.Limits.ProcessRetention > 0 {
+		fm.SetProcessRetention(config.Limits.ProcessRetention)
+	}
+	if config.Limits.PriorityLanes != nil {
+		// validated with the config
+		_ = fm.SetPriorityLanes(*config.Limits.PriorityLanes)
+	}
+	if config.MetadataDir != "" {
+		fm.SetMetadataStore(NewSidecarMetadataStore(config.MetadataDir))
+	}
+	if config.SearchIndex {
+		fm.SetSearchIndex(NewMemorySearchIndex())
+	}
+	if config.Versioning != nil {
+		fm.EnableVersioning(*config.Versioning)
+	}
+	if config.Trash != nil {
+		err := fm.EnableTrash(*config.Trash)
+		if err != nil {
+			return nil, fmt.Errorf("%w: trash: %v", ErrInvalidConfig, err)
+		}
+	}
+	if config.UploadCleanup != nil {
+		fm.EnableUploadCleanup(*config.UploadCleanup)
+	}
+	if config.UploadTimeouts != nil {
+		// validated with the config
+		_ = fm.SetUploadTimeouts(*config.UploadTimeouts)
+	}
+	if config.UploadScan != nil {
+		scanner := newClamdScannerFromAddress(config.UploadScan.Address)
+		scanner.Timeout = config.UploadScan.Timeout
+		scanner.StreamMaxLength = config.UploadScan.StreamMaxLength
+		scanner.MaxConnections = config.UploadScan.MaxConnections
+		err := scanner.Ping()
+		if err != nil {
+			return nil, fmt.Errorf("%w: upload_scan: failed to connect to ClamAV: %v", ErrInvalidConfig, err)
+		}
+		fm.EnableUploadScan(UploadScanOptions{
+			Scanner:         scanner,
+			RejectUnscanned: config.UploadScan.RejectUnscanned,
+			MaxSize:         config.UploadScan.MaxSize,
+		})
+	}
+	fm.LogTo("INFO", fmt.Sprintf("[FileManager.NewFromConfig] Created FileManager with storage(%s), %d plugins\n", backend, len(plugins)))
+	return fm, nil
+}
+
+func (config Config) validate(problems *ConfigError) {
+	for _, required := range []struct{ key, value string }{
+		{"public_path", config.PublicPath},
+		{"private_path", config.PrivatePath},
+		{"temp_path", config.TempPath},
+		{"base_url", config.BaseURL},
+	} {
+		if required.value == "" {
+			problems.add("%s is required", required.key)
+		}
+	}
+	if config.BaseURL != "" {
+		_, err := url.Parse(config.BaseURL)
+		if err != nil {
+			problems.add("base_url: %v", err)
+		}
+	}
+	if config.UploadScan != nil && config.UploadScan.Address == "" {
+		problems.add("upload_scan.address is required when the upload scan is enabled")
+	}
+	if config.Trash != nil && config.Trash.Path == "" {
+		problems.add("trash.path is required when the trash is enabled")
+	}
+	if config.Limits.PriorityLanes != nil {
+		if err := config.Limits.PriorityLanes.validate(); err != nil {
+			problems.add("limits.priority_lanes: %v", err)
+		}
+	}
+	if config.Permissions != nil {
+		if err := config.Permissions.validate(); err != nil {
+			problems.add("permissions: %v", err)
+		}
+	}
+	if config.Sharding != nil {
+		if err := config.Sharding.validate(); err != nil {
+			problems.add("sharding: %v", err)
+		}
+	}
+	if config.FastTemp != nil {
+		if err := config.FastTemp.validate(); err != nil {
+			problems.add("fast_temp: %v", err)
+		}
+	}
+	if config.UploadTimeouts != nil {
+		if err := config.UploadTimeouts.validate(); err != nil {
+			problems.add("upload_timeouts: %v", err)
+		}
+	}
+	if config.MemoryMap != nil {
+		if err := config.MemoryMap.validate(); err != nil {
+			problems.add("memory_map: %v", err)
+		}
+	}
+	if config.MimeDetection != nil {
+		if err := config.MimeDetection.validate(); err != nil {
+			problems.add("mime_detection: %v", err)
+		}
+	}
+	if config.RecipeRouting != "" {
+		if _, err := os.Stat(config.RecipeRouting); err != nil {
+			problems.add("recipe_routing: %v", err)
+		}
+	}
+	if config.StorageRouting != "" {
+		if _, err := os.Stat(config.StorageRouting); err != nil {
+			problems.add("storage_routing: %v", err)
+		}
+	}
+}
+
+// newConfiguredStorage creates the storage of a StorageConfig, reporting problems under the key. It returns nil if
+// the storage cannot be created. The caller holds configRegistryMu.
+func newConfiguredStorage(problems *ConfigError, key string, storageConfig StorageConfig) Storage {
+	backend := storageConfig.Backend
+	if backend == "" {
+		backend = STORAGE_BACKEND_LOCAL
+	}
+	factory, ok := storageFactories[backend]
+	if !ok {
+		problems.add("%s.backend: unknown backend %q, available: %s", key, backend, strings.Join(sortedKeys(storageFactories), ", "))
+		return nil
+	}
+	storage, err := factory(storageConfig.Options)
+	if err != nil {
+		problems.add("%s.backend %q: %v", key, backend, err)
+		return nil
+	}
+	if storageConfig.EncryptionKeyEnv != "" {
+		keys, err := NewEnvKeyProvider(storageConfig.EncryptionKeyEnv)
+		if err != nil {
+			problems.add("%s.encryption_key_env: %v", key, err)
+			return nil
+		}
+		storage = NewEncryptedStorage(storage, keys)
+	}
+	return storage
+}
+
+// checkWritableDir reports a directory that is missing (unless created), not a directory or not writable.
+func checkWritableDir(problems *ConfigError, key string, dir string, create bool, dirMode os.FileMode) {
+	if dir == "" {
+		return
+	}
+	info, err := os.Stat(dir)
+	if errors.Is(err, os.ErrNotExist) && create {
+		err = mkdirAllMode(dir, dirMode)
+		if err != nil {
+			problems.add("%s: cannot create %s: %v", key, dir, err)
+			return
+		}
+		info, err = os.Stat(dir)
+	}
+	if errors.Is(err, os.ErrNotExist) {
+		problems.add("%s: directory %s does not exist (create it or set create_dirs: true)", key, dir)
+		return
+	}
+	if err != nil {
+		problems.add("%s: %v", key, err)
+		return
+	}
+	if !info.IsDir() {
+		problems.add("%s: %s is not a directory", key, dir)
+		return
+	}
+	probe, err := os.CreateTemp(dir, ".filemanager-write-check-*")
+	if err != nil {
+		problems.add("%s: directory %s is not writable: %v", key, dir, err)
+		return
+	}
+	probe.Close()
+	os.Remove(probe.Name())
+}
+
+// checkRecipeFiles parses the recipes like LoadRecipes, which skips broken files, and reports parse errors and
+// processing steps using plugins that are not registered.
+func checkRecipeFiles(recipesDir string, plugins map[string]ProcessingPlugin) []string {
+	files, err := os.ReadDir(recipesDir)
+	if err != nil {
+		return []string{err.Error()}
+	}
+	var problems []string
+	for _, file := range files {
+		if file.IsDir() || filepath.Ext(file.Name()) != ".yaml" {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(recipesDir, file.Name()))
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %v", file.Name(), err))
+			continue
+		}
+		recipe, _, err := parseRecipe(data)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %v", file.Name(), err))
+			continue
+		}
+		if recipe.Name == "" {
+			problems = append(problems, fmt.Sprintf("%s: recipe has no name", file.Name()))
+		}
+		err = validateMimePatterns(recipe.AcceptedMimeTypes, recipe.StrictMimeTypes)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s: recipe(%s): %v", file.Name(), recipe.Name, err))
+		}
+		err = checkRecipePlugins(recipe, plugins)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s: recipe(%s) uses plugins that are not configured: %v", file.Name(), recipe.Name, err))
+		}
+	}
+	return problems
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
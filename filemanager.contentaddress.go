@@ -0,0 +1,141 @@
+package filemanager
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"strings"
+	"time"
+)
+
+var (
+	ErrContentAddressNotFound = errors.New("no content addressed file for the logical name")
+	ErrInvalidLogicalName     = errors.New("invalid logical name")
+)
+
+const (
+	// CONTENT_ADDRESSES_DIR_NAME is the hidden directory in the private path holding the logical name mapping.
+	CONTENT_ADDRESSES_DIR_NAME = ".content-addresses"
+	// IMMUTABLE_CACHE_CONTROL is set for content addressed outputs without a Cache-Control header.
+	IMMUTABLE_CACHE_CONTROL = "public, max-age=31536000, immutable"
+)
+
+// ContentAddress maps the logical name of a public file (its path relative to the public path, e.g.
+// "images/avatar.webp") to the content addressed path its current content is stored at.
+type ContentAddress struct {
+	LogicalName   string    `json:"logicalName"`
+	Hash          string    `json:"hash"`       // hex SHA-256 of the content
+	HashedPath    string    `json:"hashedPath"` // relative to the public path, e.g. "ab/cd/abcd.../avatar.webp"
+	LocalFilePath string    `json:"-"`
+	URL           string    `json:"-"`
+	UpdatedAt     time.Time `json:"updatedAt"`
+}
+
+// ContentAddressedPath returns the public path the content is stored at with OutputFormat.ContentAddressed:
+// <public path>/ab/cd/<sha256>/<file name>. The path changes with the content, so its URL can be cached forever.
+func (fm *FileManager) ContentAddressedPath(fileName string, content []byte) string {
+	sum := sha256.Sum256(content)
+	hash := hex.EncodeToString(sum[:])
+	return fm.GetPublicLocalFilePath(path.Join(hash[:2], hash[2:4], hash, path.Base(fileName)))
+}
+
+// saveContentAddressed stores the file at its content addressed path instead of its LocalFilePath, which becomes
+// its logical name, and maps the logical name to it. Previous contents stay available at their paths, as cached
+// URLs may still point to them.
+func (fm *FileManager) saveContentAddressed(file *ManagedFile) error {
+	logicalName, err := fm.logicalName(file.LocalFilePath)
+	if err != nil {
+		return err
+	}
+	file.LocalFilePath = fm.ContentAddressedPath(file.FileName, file.Content)
+	file.URL, _ = fm.GetPublicUrlForFile(file.LocalFilePath)
+	if file.HTTPHeaders == nil || file.HTTPHeaders.CacheControl == "" {
+		headers := HTTPHeaders{}
+		if file.HTTPHeaders != nil {
+			headers = *file.HTTPHeaders
+		}
+		headers.CacheControl = IMMUTABLE_CACHE_CONTROL
+		file.HTTPHeaders = &headers
+	}
+	// the same path means the same content, an existing file is kept as it is
+	if _, err := fm.GetStorage().Stat(file.LocalFilePath); err != nil {
+		err = fm.SaveFile(file)
+		if err != nil {
+			return err
+		}
+	}
+	hashedPath := strings.TrimPrefix(file.LocalFilePath, path.Clean(fm.publicLocalBasePath)+"/")
+	return fm.setContentAddress(ContentAddress{
+		LogicalName: logicalName,
+		Hash:        path.Base(path.Dir(hashedPath)),
+		HashedPath:  hashedPath,
+		UpdatedAt:   time.Now(),
+	})
+}
+
+func (fm *FileManager) setContentAddress(address ContentAddress) error {
+	data, err := json.Marshal(address)
+	if err != nil {
+		return err
+	}
+	mappingPath := fm.contentAddressMappingPath(address.LogicalName)
+	err = fm.GetStorage().WriteFile(mappingPath, data, 0644, false)
+	if err != nil {
+		return err
+	}
+	fm.replicate(mappingPath, false)
+	return nil
+}
+
+// GetContentAddress returns the content addressed file currently stored for the logical name, which is a path
+// relative to the public path or a local file path in it.
+func (fm *FileManager) GetContentAddress(logicalName string) (ContentAddress, error) {
+	name, err := fm.logicalName(logicalName)
+	if err != nil {
+		return ContentAddress{}, err
+	}
+	data, err := fm.GetStorage().ReadFile(fm.contentAddressMappingPath(name))
+	if errors.Is(err, fs.ErrNotExist) {
+		return ContentAddress{}, fmt.Errorf("%w: %s", ErrContentAddressNotFound, name)
+	}
+	if err != nil {
+		return ContentAddress{}, err
+	}
+	var address ContentAddress
+	err = json.Unmarshal(data, &address)
+	if err != nil {
+		return ContentAddress{}, err
+	}
+	address.LocalFilePath = fm.GetPublicLocalFilePath(address.HashedPath)
+	address.URL, err = fm.GetPublicUrlForFile(address.LocalFilePath)
+	return address, err
+}
+
+// GetContentAddressedURL returns the current hashed URL of the logical name, e.g. "images/avatar.webp" ->
+// "https://cdn.example.com/ab/cd/abcd.../avatar.webp".
+func (fm *FileManager) GetContentAddressedURL(logicalName string) (string, error) {
+	address, err := fm.GetContentAddress(logicalName)
+	if err != nil {
+		return "", err
+	}
+	return address.URL, nil
+}
+
+// logicalName normalizes a logical name or public local file path into a path relative to the public path.
+func (fm *FileManager) logicalName(name string) (string, error) {
+	name = strings.TrimPrefix(name, path.Clean(fm.publicLocalBasePath)+"/")
+	name = fm.unshardPath(name)
+	cleaned := path.Clean("/" + name)[1:]
+	if cleaned == "" || cleaned != name {
+		return "", fmt.Errorf("%w: %q", ErrInvalidLogicalName, name)
+	}
+	return cleaned, nil
+}
+
+func (fm *FileManager) contentAddressMappingPath(logicalName string) string {
+	return fm.GetPrivateLocalFilePath(path.Join(CONTENT_ADDRESSES_DIR_NAME, logicalName+".json"))
+}
@@ -0,0 +1,198 @@
+package filemanager
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+var (
+	// ErrDecompressionBomb is matched by every DecompressionBombError.
+	ErrDecompressionBomb = errors.New("decompression limit exceeded")
+)
+
+const (
+	DEFAULT_MAX_DECOMPRESSION_RATIO = 100
+	DEFAULT_MAX_EXPANDED_SIZE       = 1024 * 1024 * 1024
+	DEFAULT_MAX_ARCHIVE_ENTRIES     = 10000
+	// DECOMPRESSION_RATIO_GRACE is the expanded size up to which the ratio is not checked, small files of repeated
+	// content legitimately compress far better than the limit.
+	DECOMPRESSION_RATIO_GRACE = 1024 * 1024
+)
+
+// Decompression limit names reported in DecompressionBombError.Limit.
+const (
+	DecompressionLimitRatio   = "ratio"
+	DecompressionLimitSize    = "expanded_size"
+	DecompressionLimitEntries = "entries"
+)
+
+// DecompressionLimits protect archive and office document processing (docx, xlsx, pptx and OpenDocument files are
+// zip archives) against zip bombs. Zero values use the defaults.
+type DecompressionLimits struct {
+	// MaxRatio is the highest expanded to compressed size ratio of an entry, checked once it expanded beyond
+	// DECOMPRESSION_RATIO_GRACE. Defaults to DEFAULT_MAX_DECOMPRESSION_RATIO.
+	MaxRatio float64 `yaml:"max_ratio"`
+	// MaxExpandedSize is the highest total expanded size of all entries. Defaults to DEFAULT_MAX_EXPANDED_SIZE.
+	MaxExpandedSize int64 `yaml:"max_expanded_size"`
+	// MaxEntries is the highest number of entries. Defaults to DEFAULT_MAX_ARCHIVE_ENTRIES.
+	MaxEntries int `yaml:"max_entries"`
+}
+
+func (l DecompressionLimits) withDefaults() DecompressionLimits {
+	if l.MaxRatio <= 0 {
+		l.MaxRatio = DEFAULT_MAX_DECOMPRESSION_RATIO
+	}
+	if l.MaxExpandedSize <= 0 {
+		l.MaxExpandedSize = DEFAULT_MAX_EXPANDED_SIZE
+	}
+	if l.MaxEntries <= 0 {
+		l.MaxEntries = DEFAULT_MAX_ARCHIVE_ENTRIES
+	}
+	return l
+}
+
+// DecompressionBombError reports an archive exceeding a DecompressionLimits limit. errors.Is(err,
+// ErrDecompressionBomb) matches it.
+type DecompressionBombError struct {
+	FileName string
+	Entry    string // the archive entry that exceeded the limit, empty for the entries limit
+	Limit    string // DecompressionLimitRatio, DecompressionLimitSize or DecompressionLimitEntries
+	Value    float64
+	Max      float64
+}
+
+func (e *DecompressionBombError) Error() string {
+	name := e.FileName
+	if e.Entry != "" {
+		name += ":" + e.Entry
+	}
+	if e.Limit == DecompressionLimitRatio {
+		return fmt.Sprintf("decompression limit exceeded in file(%s): ratio %.2f exceeds %.2f", name, e.Value, e.Max)
+	}
+	return fmt.Sprintf("decompression limit exceeded in file(%s): %s %.0f exceeds %.0f", name, e.Limit, e.Value, e.Max)
+}
+
+func (e *DecompressionBombError) Is(target error) bool {
+	return target == ErrDecompressionBomb
+}
+
+// CheckZipArchive decompresses every entry of the zip archive without keeping the data and returns a
+// DecompressionBombError if it exceeds the limits. The declared entry sizes are checked first, but as they can be
+// forged, only the actually decompressed bytes count. Content that is not a zip archive passes unchecked. Archives
+// with data in front, which zip.NewReader opens as well, are checked like any other.
+func CheckZipArchive(fileName string, content []byte, limits DecompressionLimits) error {
+	return checkZipArchive(fileName, bytes.NewReader(content), int64(len(content)), limits)
+}
+
+// CheckZipArchiveFile checks the zip archive at the local path like CheckZipArchive.
+func CheckZipArchiveFile(fileName string, localFilePath string, limits DecompressionLimits) error {
+	file, err := os.Open(localFilePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	return checkZipArchive(fileName, file, info.Size(), limits)
+}
+
+func checkZipArchive(fileName string, content io.ReaderAt, size int64, limits DecompressionLimits) error {
+	limits = limits.withDefaults()
+	archive, err := zip.NewReader(content, size)
+	if errors.Is(err, zip.ErrFormat) {
+		// not a zip archive
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if len(archive.File) > limits.MaxEntries {
+		return &DecompressionBombError{FileName: fileName, Limit: DecompressionLimitEntries, Value: float64(len(archive.File)), Max: float64(limits.MaxEntries)}
+	}
+	var declared uint64
+	for _, entry := range archive.File {
+		declared += entry.UncompressedSize64
+		if declared > uint64(limits.MaxExpandedSize) {
+			return &DecompressionBombError{FileName: fileName, Entry: entry.Name, Limit: DecompressionLimitSize, Value: float64(declared), Max: float64(limits.MaxExpandedSize)}
+		}
+	}
+
+	remaining := limits.MaxExpandedSize
+	for _, entry := range archive.File {
+		if entry.FileInfo().IsDir() {
+			continue
+		}
+		reader, err := entry.Open()
+		if err != nil {
+			return err
+		}
+		limited := &decompressionLimitReader{
+			reader:         reader,
+			fileName:       fileName,
+			entry:          entry.Name,
+			compressedSize: int64(entry.CompressedSize64),
+			maxRatio:       limits.MaxRatio,
+			remaining:      remaining,
+			maxSize:        limits.MaxExpandedSize,
+		}
+		_, err = io.Copy(io.Discard, limited)
+		reader.Close()
+		if err != nil {
+			return err
+		}
+		remaining = limited.remaining
+	}
+	return nil
+}
+
+// LimitDecompression wraps the reader of decompressed data, e.g. a gzip.Reader or an opened zip entry, so reading
+// fails with a DecompressionBombError once it exceeds the limits. compressedSize is the size of the compressed
+// input, the ratio is not checked if it is unknown (<= 0).
+func LimitDecompression(r io.Reader, fileName string, compressedSize int64, limits DecompressionLimits) io.Reader {
+	limits = limits.withDefaults()
+	return &decompressionLimitReader{
+		reader:         r,
+		fileName:       fileName,
+		compressedSize: compressedSize,
+		maxRatio:       limits.MaxRatio,
+		remaining:      limits.MaxExpandedSize,
+		maxSize:        limits.MaxExpandedSize,
+	}
+}
+
+type decompressionLimitReader struct {
+	reader         io.Reader
+	fileName       string
+	entry          string
+	compressedSize int64
+	maxRatio       float64
+	expanded       int64
+	remaining      int64
+	maxSize        int64
+}
+
+func (r *decompressionLimitReader) Read(p []byte) (int, error) {
+	// read one byte more than allowed to tell an exact fit from an overflow
+	if int64(len(p)) > r.remaining+1 {
+		p = p[:r.remaining+1]
+	}
+	n, err := r.reader.Read(p)
+	r.expanded += int64(n)
+	r.remaining -= int64(n)
+	if r.remaining < 0 {
+		return n, &DecompressionBombError{FileName: r.fileName, Entry: r.entry, Limit: DecompressionLimitSize, Value: float64(r.maxSize - r.remaining), Max: float64(r.maxSize)}
+	}
+	if r.compressedSize > 0 && r.expanded > DECOMPRESSION_RATIO_GRACE {
+		ratio := float64(r.expanded) / float64(r.compressedSize)
+		if ratio > r.maxRatio {
+			return n, &DecompressionBombError{FileName: r.fileName, Entry: r.entry, Limit: DecompressionLimitRatio, Value: ratio, Max: r.maxRatio}
+		}
+	}
+	return n, err
+}
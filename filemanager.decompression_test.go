@@ -0,0 +1,108 @@
+package filemanager_test
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	filemanager "github.com/itsatony/go-filemanager"
+	"github.com/itsatony/go-filemanager/filemanagertest"
+)
+
+// zipWithEntry returns a zip archive with one deflated entry of size zero bytes.
+func zipWithEntry(t *testing.T, name string, size int) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	archive := zip.NewWriter(&buf)
+	entry, err := archive.Create(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = entry.Write(make([]byte, size))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = archive.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestCheckZipArchive(t *testing.T) {
+	bomb := zipWithEntry(t, "word/document.xml", 8*1024*1024)
+	small := zipWithEntry(t, "word/document.xml", 64*1024)
+
+	tests := []struct {
+		name    string
+		content []byte
+		limits  filemanager.DecompressionLimits
+		limit   string // expected DecompressionBombError.Limit, "" for no error
+	}{
+		{name: "ratio", content: bomb, limit: filemanager.DecompressionLimitRatio},
+		{name: "expanded size", content: small, limits: filemanager.DecompressionLimits{MaxExpandedSize: 32 * 1024}, limit: filemanager.DecompressionLimitSize},
+		{name: "prepended data", content: append([]byte{0}, bomb...), limit: filemanager.DecompressionLimitRatio},
+		{name: "within limits", content: small},
+		{name: "not an archive", content: []byte("plain text")},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := filemanager.CheckZipArchive("test.docx", test.content, test.limits)
+			if test.limit == "" {
+				if err != nil {
+					t.Fatalf("CheckZipArchive() = %v, want nil", err)
+				}
+				return
+			}
+			var bombErr *filemanager.DecompressionBombError
+			if !errors.As(err, &bombErr) || bombErr.Limit != test.limit {
+				t.Fatalf("CheckZipArchive() = %v, want a DecompressionBombError of limit %s", err, test.limit)
+			}
+			if !errors.Is(err, filemanager.ErrDecompressionBomb) {
+				t.Fatalf("errors.Is(%v, ErrDecompressionBomb) = false", err)
+			}
+		})
+	}
+}
+
+func TestCheckZipArchiveFilePrependedData(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bomb.docx")
+	err := os.WriteFile(path, append([]byte("MZ"), zipWithEntry(t, "word/document.xml", 8*1024*1024)...), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = filemanager.CheckZipArchiveFile("bomb.docx", path, filemanager.DecompressionLimits{})
+	if !errors.Is(err, filemanager.ErrDecompressionBomb) {
+		t.Fatalf("CheckZipArchiveFile() = %v, want ErrDecompressionBomb", err)
+	}
+}
+
+func TestFormatConverterRejectsZipBombWithPrependedData(t *testing.T) {
+	tfm := filemanagertest.NewTestFileManager(t)
+	tfm.AddProcessingPlugin("format_converter", &filemanager.FormatConverterPlugin{})
+	err := tfm.AddRecipe(filemanager.Recipe{
+		Name:              "docx_to_text",
+		AcceptedMimeTypes: []string{filemanager.DOCX_MIME_TYPE},
+		MaxFileSize:       1024 * 1024,
+		ProcessingSteps:   []filemanager.ProcessingStep{{PluginName: "format_converter"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := append([]byte{0}, zipWithEntry(t, "word/document.xml", 8*1024*1024)...)
+	file := &filemanager.ManagedFile{
+		FileName: "bomb.docx",
+		MimeType: filemanager.DOCX_MIME_TYPE,
+		Content:  content,
+		FileSize: int64(len(content)),
+		MetaData: map[string]any{},
+	}
+
+	status := tfm.Process(file, "docx_to_text", nil)
+	if status == nil || !errors.Is(status.Error, filemanager.ErrDecompressionBomb) {
+		t.Fatalf("final status = %+v, want ErrDecompressionBomb", status)
+	}
+}
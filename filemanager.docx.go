@@ -0,0 +1,549 @@
+package filemanager
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// docxDocument is the content of a Word document reduced to what text and Markdown output need: paragraphs with
+// their heading level, list level and inline formatting, and tables.
+type docxDocument struct {
+	blocks []docxBlock
+}
+
+// docxBlock is a paragraph or, if isTable is set, a table.
+type docxBlock struct {
+	heading int // 1-9, 0 for body text
+	list    bool
+	ordered bool
+	numID   string
+	level   int // list nesting, 0 based
+	runs    []docxRun
+	table   [][]string
+	isTable bool
+}
+
+// docxRun is text of the same formatting.
+type docxRun struct {
+	text   string
+	bold   bool
+	italic bool
+	link   string
+}
+
+func (b docxBlock) plainText() string {
+	var text strings.Builder
+	for _, run := range b.runs {
+		text.WriteString(run.text)
+	}
+	return strings.TrimSpace(text.String())
+}
+
+// docxParser resolves the styles, numbering and hyperlinks of the document part.
+type docxParser struct {
+	headingStyles map[string]int          // style id to heading level
+	numbering     map[string]map[int]bool // numId to list level to ordered
+	links         map[string]string       // relationship id to hyperlink target
+	zipFiles      map[string]*zip.File    // the parts of the package
+}
+
+// parseDocx reads the main document part of a docx file. The archive should be checked with CheckZipArchive first.
+func parseDocx(content []byte) (*docxDocument, error) {
+	archive, err := zip.NewReader(bytes.NewReader(content), int64(len(content)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open docx: %v", err)
+	}
+	p := &docxParser{
+		headingStyles: map[string]int{},
+		numbering:     map[string]map[int]bool{},
+		links:         map[string]string{},
+		zipFiles:      map[string]*zip.File{},
+	}
+	for _, file := range archive.File {
+		p.zipFiles[file.Name] = file
+	}
+	document, ok := p.zipFiles["word/document.xml"]
+	if !ok {
+		return nil, fmt.Errorf("failed to read docx: word/document.xml not found")
+	}
+	// styles, numbering and relationships are optional, documents without them just lack headings, lists or links
+	err = p.readPart("word/styles.xml", p.parseStyles)
+	if err != nil {
+		return nil, err
+	}
+	err = p.readPart("word/numbering.xml", p.parseNumbering)
+	if err != nil {
+		return nil, err
+	}
+	err = p.readPart("word/_rels/document.xml.rels", p.parseRelationships)
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := document.Open()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read docx: %v", err)
+	}
+	defer r.Close()
+	blocks, err := p.parseBody(xml.NewDecoder(r))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse docx: %v", err)
+	}
+	return &docxDocument{blocks: blocks}, nil
+}
+
+func (p *docxParser) readPart(name string, parse func(decoder *xml.Decoder) error) error {
+	file, ok := p.zipFiles[name]
+	if !ok {
+		return nil
+	}
+	r, err := file.Open()
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %v", name, err)
+	}
+	defer r.Close()
+	err = parse(xml.NewDecoder(r))
+	if err != nil {
+		return fmt.Errorf("failed to parse %s: %v", name, err)
+	}
+	return nil
+}
+
+// xmlAttr returns the value of the attribute of the local name, whatever its namespace.
+func xmlAttr(element xml.StartElement, name string) string {
+	for _, attr := range element.Attr {
+		if attr.Name.Local == name {
+			return attr.Value
+		}
+	}
+	return ""
+}
+
+// xmlRelationshipID returns the r:id attribute, telling it apart from plain id attributes by its namespace.
+func xmlRelationshipID(element xml.StartElement) string {
+	for _, attr := range element.Attr {
+		if attr.Name.Local == "id" && attr.Name.Space != "" {
+			return attr.Value
+		}
+	}
+	return ""
+}
+
+// parseStyles finds the heading styles by their name ("heading 1", "Title"), as style ids are localized.
+func (p *docxParser) parseStyles(decoder *xml.Decoder) error {
+	styleID := ""
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		element, ok := token.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		switch element.Name.Local {
+		case "style":
+			styleID = xmlAttr(element, "styleId")
+		case "name":
+			name := strings.ToLower(xmlAttr(element, "val"))
+			if name == "title" {
+				p.headingStyles[styleID] = 1
+			} else if level, err := strconv.Atoi(strings.TrimPrefix(name, "heading ")); err == nil && strings.HasPrefix(name, "heading ") {
+				p.headingStyles[styleID] = level
+			}
+		case "outlineLvl":
+			// outline levels are 0 based, 9 is body text
+			level, err := strconv.Atoi(xmlAttr(element, "val"))
+			if err == nil && level < 9 && p.headingStyles[styleID] == 0 {
+				p.headingStyles[styleID] = level + 1
+			}
+		}
+	}
+}
+
+// parseNumbering finds out which list levels are numbered rather than bulleted.
+func (p *docxParser) parseNumbering(decoder *xml.Decoder) error {
+	abstractNums := map[string]map[int]bool{}
+	numAbstracts := map[string]string{}
+	abstractNumID, numID := "", ""
+	level := 0
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		element, ok := token.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		switch element.Name.Local {
+		case "abstractNum":
+			abstractNumID = xmlAttr(element, "abstractNumId")
+			numID = ""
+			abstractNums[abstractNumID] = map[int]bool{}
+		case "lvl":
+			level, _ = strconv.Atoi(xmlAttr(element, "ilvl"))
+		case "numFmt":
+			if numID == "" && abstractNums[abstractNumID] != nil {
+				format := xmlAttr(element, "val")
+				abstractNums[abstractNumID][level] = format != "bullet" && format != "none"
+			}
+		case "num":
+			numID = xmlAttr(element, "numId")
+		case "abstractNumId":
+			if numID != "" {
+				numAbstracts[numID] = xmlAttr(element, "val")
+			}
+		}
+	}
+	for numID, abstractNumID := range numAbstracts {
+		p.numbering[numID] = abstractNums[abstractNumID]
+	}
+	return nil
+}
+
+func (p *docxParser) parseRelationships(decoder *xml.Decoder) error {
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		element, ok := token.(xml.StartElement)
+		if ok && element.Name.Local == "Relationship" && strings.HasSuffix(xmlAttr(element, "Type"), "/hyperlink") {
+			p.links[xmlAttr(element, "Id")] = xmlAttr(element, "Target")
+		}
+	}
+}
+
+// parseBody collects the paragraphs and tables of the document in order, including those in content controls.
+func (p *docxParser) parseBody(decoder *xml.Decoder) ([]docxBlock, error) {
+	var blocks []docxBlock
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			return blocks, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		element, ok := token.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		switch element.Name.Local {
+		case "p":
+			block, err := p.parseParagraph(decoder)
+			if err != nil {
+				return nil, err
+			}
+			blocks = append(blocks, block)
+		case "tbl":
+			table, err := p.parseTable(decoder)
+			if err != nil {
+				return nil, err
+			}
+			blocks = append(blocks, docxBlock{isTable: true, table: table})
+		}
+	}
+}
+
+// parseParagraph reads a w:p up to its end element.
+func (p *docxParser) parseParagraph(decoder *xml.Decoder) (docxBlock, error) {
+	var block docxBlock
+	var run *docxRun
+	inProperties := false
+	link := ""
+	depth := 0
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return block, err
+		}
+		switch element := token.(type) {
+		case xml.StartElement:
+			depth++
+			switch element.Name.Local {
+			case "pPr":
+				inProperties = true
+			case "pStyle":
+				block.heading = p.headingStyles[xmlAttr(element, "val")]
+			case "ilvl":
+				block.level, _ = strconv.Atoi(xmlAttr(element, "val"))
+			case "numId":
+				block.numID = xmlAttr(element, "val")
+				// numId 0 removes the numbering of the style
+				block.list = block.numID != "0"
+			case "hyperlink":
+				link = p.links[xmlRelationshipID(element)]
+				if anchor := xmlAttr(element, "anchor"); link == "" && anchor != "" {
+					link = "#" + anchor
+				}
+			case "r":
+				block.runs = append(block.runs, docxRun{link: link})
+				run = &block.runs[len(block.runs)-1]
+			case "b":
+				if run != nil && !inProperties {
+					run.bold = isDocxOn(element)
+				}
+			case "i":
+				if run != nil && !inProperties {
+					run.italic = isDocxOn(element)
+				}
+			case "t":
+				if run == nil {
+					continue
+				}
+				var text string
+				err = decoder.DecodeElement(&text, &element)
+				if err != nil {
+					return block, err
+				}
+				depth--
+				run.text += text
+			case "tab":
+				if run != nil && !inProperties {
+					run.text += "\t"
+				}
+			case "br", "cr":
+				if run != nil {
+					run.text += "\n"
+				}
+			}
+		case xml.EndElement:
+			if depth == 0 {
+				// the end of the w:p
+				if block.list {
+					block.ordered = p.numbering[block.numID][block.level]
+				}
+				return block, nil
+			}
+			depth--
+			switch element.Name.Local {
+			case "pPr":
+				inProperties = false
+			case "r":
+				run = nil
+			case "hyperlink":
+				link = ""
+			}
+		}
+	}
+}
+
+// isDocxOn reports whether a toggle property like w:b is on, <w:b/> and <w:b w:val="true"/> are.
+func isDocxOn(element xml.StartElement) bool {
+	switch xmlAttr(element, "val") {
+	case "0", "false", "off":
+		return false
+	}
+	return true
+}
+
+// parseTable reads a w:tbl up to its end element, the text of nested tables is added to their cell.
+func (p *docxParser) parseTable(decoder *xml.Decoder) ([][]string, error) {
+	var rows [][]string
+	var cell []string
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return nil, err
+		}
+		switch element := token.(type) {
+		case xml.StartElement:
+			switch element.Name.Local {
+			case "tr":
+				rows = append(rows, nil)
+			case "tc":
+				cell = nil
+			case "p":
+				block, err := p.parseParagraph(decoder)
+				if err != nil {
+					return nil, err
+				}
+				if text := block.plainText(); text != "" {
+					cell = append(cell, text)
+				}
+			case "tbl":
+				nested, err := p.parseTable(decoder)
+				if err != nil {
+					return nil, err
+				}
+				for _, row := range nested {
+					cell = append(cell, strings.Join(row, " "))
+				}
+			}
+		case xml.EndElement:
+			switch element.Name.Local {
+			case "tc":
+				if len(rows) > 0 {
+					rows[len(rows)-1] = append(rows[len(rows)-1], strings.Join(cell, " "))
+				}
+			case "tbl":
+				return rows, nil
+			}
+		}
+	}
+}
+
+// Text renders the document as plain text: blocks separated by blank lines, list items indented with bullets or
+// numbers, table cells separated by tabs.
+func (d *docxDocument) Text() string {
+	var text strings.Builder
+	counters := map[string][]int{}
+	for i, block := range d.blocks {
+		if i > 0 {
+			text.WriteString(blockSeparator(d.blocks[i-1], block))
+		}
+		switch {
+		case block.isTable:
+			for r, row := range block.table {
+				if r > 0 {
+					text.WriteByte('\n')
+				}
+				text.WriteString(strings.Join(row, "\t"))
+			}
+		case block.list:
+			marker := "-"
+			if block.ordered {
+				marker = strconv.Itoa(nextListNumber(counters, block)) + "."
+			}
+			text.WriteString(strings.Repeat("  ", block.level) + marker + " " + block.plainText())
+		default:
+			text.WriteString(block.plainText())
+		}
+	}
+	return strings.TrimSpace(text.String()) + "\n"
+}
+
+// Markdown renders the document as GitHub flavored Markdown: headings, nested lists, tables (the first row as
+// header), bold, italic and links.
+func (d *docxDocument) Markdown() string {
+	var markdown strings.Builder
+	for i, block := range d.blocks {
+		if i > 0 {
+			markdown.WriteString(blockSeparator(d.blocks[i-1], block))
+		}
+		switch {
+		case block.isTable:
+			markdown.WriteString(markdownTable(block.table))
+		case block.heading > 0:
+			markdown.WriteString(strings.Repeat("#", min(block.heading, 6)) + " " + escapeMarkdown(block.plainText()))
+		case block.list:
+			marker := "-"
+			if block.ordered {
+				// Markdown numbers the items itself
+				marker = "1."
+			}
+			markdown.WriteString(strings.Repeat("    ", block.level) + marker + " " + markdownRuns(block.runs))
+		default:
+			markdown.WriteString(markdownRuns(block.runs))
+		}
+	}
+	return strings.TrimSpace(markdown.String()) + "\n"
+}
+
+// blockSeparator keeps the items of a list on consecutive lines and separates everything else by a blank line.
+// Empty paragraphs add nothing, as they only space out the document.
+func blockSeparator(previous docxBlock, block docxBlock) string {
+	if !block.isTable && !previous.isTable && block.plainText() == "" {
+		return ""
+	}
+	if previous.list && block.list && previous.numID == block.numID {
+		return "\n"
+	}
+	return "\n\n"
+}
+
+// nextListNumber counts the items of every list and level, restarting the deeper levels when a level continues.
+func nextListNumber(counters map[string][]int, block docxBlock) int {
+	counter := counters[block.numID]
+	for len(counter) <= block.level {
+		counter = append(counter, 0)
+	}
+	counter[block.level]++
+	counter = counter[:block.level+1]
+	counters[block.numID] = counter
+	return counter[block.level]
+}
+
+func markdownRuns(runs []docxRun) string {
+	var markdown strings.Builder
+	for i := 0; i < len(runs); i++ {
+		// join runs of the same formatting, Word splits text into many runs
+		run := runs[i]
+		for i+1 < len(runs) && runs[i+1].bold == run.bold && runs[i+1].italic == run.italic && runs[i+1].link == run.link {
+			i++
+			run.text += runs[i].text
+		}
+		text := escapeMarkdown(run.text)
+		// emphasis markers must touch the text, so surrounding spaces stay outside
+		trimmed := strings.TrimSpace(text)
+		if trimmed == "" {
+			markdown.WriteString(text)
+			continue
+		}
+		leading := text[:strings.Index(text, trimmed)]
+		trailing := text[len(leading)+len(trimmed):]
+		if run.italic {
+			trimmed = "*" + trimmed + "*"
+		}
+		if run.bold {
+			trimmed = "**" + trimmed + "**"
+		}
+		if run.link != "" {
+			trimmed = "[" + trimmed + "](" + run.link + ")"
+		}
+		markdown.WriteString(leading + trimmed + trailing)
+	}
+	return strings.TrimSpace(markdown.String())
+}
+
+func markdownTable(rows [][]string) string {
+	columns := 0
+	for _, row := range rows {
+		columns = max(columns, len(row))
+	}
+	if columns == 0 {
+		return ""
+	}
+	var table strings.Builder
+	for r, row := range rows {
+		if r > 0 {
+			table.WriteByte('\n')
+		}
+		table.WriteString("|")
+		for c := 0; c < columns; c++ {
+			cell := ""
+			if c < len(row) {
+				cell = strings.ReplaceAll(escapeMarkdown(row[c]), "|", "\\|")
+				cell = strings.ReplaceAll(cell, "\n", " ")
+			}
+			table.WriteString(" " + cell + " |")
+		}
+		if r == 0 {
+			table.WriteString("\n|" + strings.Repeat(" --- |", columns))
+		}
+	}
+	return table.String()
+}
+
+var markdownEscaper = strings.NewReplacer(`\`, `\\`, "*", `\*`, "_", `\_`, "`", "\\`", "[", `\[`, "]", `\]`)
+
+// escapeMarkdown escapes the characters that would start emphasis, code or links in the text.
+func escapeMarkdown(text string) string {
+	return markdownEscaper.Replace(text)
+}
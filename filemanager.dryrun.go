@@ -0,0 +1,177 @@
+package filemanager
+
+import (
+	"fmt"
+	"maps"
+	"path/filepath"
+	"time"
+)
+
+// DryRunPlugin is implemented by plugins that can check the params of a step and describe the files the step
+// would return without processing them. The described files need no content; names and MIME types are what the
+// dry run of a recipe reports its outputs with.
+type DryRunPlugin interface {
+	DryRun(files []*ManagedFile) ([]*ManagedFile, error)
+}
+
+// dryRunRecipe runs the recipe without processing the file or writing anything: the step params are rendered and
+// checked by the plugins implementing DryRunPlugin (the files pass other steps unchanged), output formats are
+// checked for a converter, and the terminal status lists the outputs that would be stored, with names, paths and
+// URLs but without content. Responsive images depend on the processed image and are not listed; content
+// addressed outputs are listed with their logical path, outputs that would get a unique suffix with their target
+// path.
+func (fm *FileManager) dryRunRecipe(file *ManagedFile, recipe Recipe, fileProcess *FileProcess, statusCh chan<- *FileProcess, opts ProcessOptions) {
+	fail := func(processorName string, description string, err error) {
+		fileProcess.AddProcessingUpdate(ProcessingStatus{
+			ProcessID:         fileProcess.ID,
+			TimeStamp:         int(time.Now().UnixNano() / int64(time.Millisecond)),
+			ProcessorName:     processorName,
+			StatusDescription: description,
+			Error:             err,
+			Done:              true,
+			DryRun:            true,
+		})
+		fm.LogTo("INFO", fmt.Sprintf("[FileManager.ProcessFile] Dry run of file(%s)%s failed: %v\n", file.FileName, fileProcess.LogLabels(), err))
+		fm.publishFinalStatus(statusCh, fileProcess)
+	}
+
+	// work on a copy, the file stays as it is for the real run
+	dryFile := *file
+	dryFile.MetaData = maps.Clone(file.MetaData)
+	if dryFile.MetaData == nil {
+		dryFile.MetaData = make(map[string]any)
+	}
+	dryFile.MetaData["process_id"] = fileProcess.ID
+	if fileProcess.CorrelationID != "" {
+		dryFile.MetaData["correlation_id"] = fileProcess.CorrelationID
+	}
+	if opts.upload != nil {
+		// the size of a streamed upload is only known once it is read
+		err := opts.upload.readInto(&dryFile)
+		if err != nil {
+			fail("FileUpload", fmt.Sprintf("Failed to receive upload: %v", err), err)
+			return
+		}
+	}
+	files := []*ManagedFile{&dryFile}
+
+	for stepIndex, step := range recipe.ProcessingSteps {
+		if step.PluginName == "" {
+			continue
+		}
+		plugin, ok := fm.getProcessingPlugin(step.PluginName)
+		if !ok {
+			fail(step.PluginName, fmt.Sprintf("processing plugin(%s) not found", step.PluginName), fmt.Errorf("%w: %s", ErrProcessingPluginNotFound, step.PluginName))
+			return
+		}
+		params, err := applyStepParams(files, step.Params, opts.Params)
+		if err != nil {
+			err = &ValidationError{Field: "params", Err: err}
+			fail(step.PluginName, fmt.Sprintf("Invalid step params: %v", err), err)
+			return
+		}
+		dryRunPlugin, ok := plugin.(DryRunPlugin)
+		if !ok {
+			fileProcess.AddProcessingUpdate(ProcessingStatus{
+				ProcessID:         fileProcess.ID,
+				TimeStamp:         int(time.Now().UnixNano() / int64(time.Millisecond)),
+				ProcessorName:     step.PluginName,
+				StatusDescription: fmt.Sprintf("Dry run: step params of plugin(%s) not checked", step.PluginName),
+				DryRun:            true,
+			})
+			params.restore(nil)
+			continue
+		}
+		checkedFiles, err := dryRunPlugin.DryRun(files)
+		params.restore(checkedFiles)
+		files = checkedFiles
+		if err != nil {
+			err = &PluginError{Plugin: step.PluginName, Step: stepIndex + 1, Err: err}
+			fail(step.PluginName, fmt.Sprintf("Processing failed: %v", err), err)
+			return
+		}
+		fileProcess.AddProcessingUpdate(ProcessingStatus{
+			ProcessID:         fileProcess.ID,
+			TimeStamp:         int(time.Now().UnixNano() / int64(time.Millisecond)),
+			ProcessorName:     step.PluginName,
+			StatusDescription: fmt.Sprintf("Dry run: step params of plugin(%s) checked", step.PluginName),
+			DryRun:            true,
+		})
+	}
+
+	resultFile := &dryFile
+	if len(files) > 0 {
+		resultFile = files[0]
+	}
+	var resultingFiles []ProcessingResultFile
+	var extraFiles []*ManagedFile
+	if len(files) > 1 {
+		extraFiles = files[1:]
+	}
+	for _, outputFormat := range recipe.OutputFormats {
+		source := resultFile
+		if needsFormatConversion(source, outputFormat.Format) {
+			format := NormalizeOutputFormat(outputFormat.Format)
+			if _, ok := fm.findFormatConverter(source.MimeType, format); !ok {
+				fm.skipOutputFormat(file, fileProcess, outputFormat.Format, fmt.Errorf("%w: %s to %s", ErrUnsupportedOutputFormat, source.MimeType, format))
+				continue
+			}
+			converted := *source
+			converted.FileName = fileNameWithFormat(source.FileName, format)
+			converted.MimeType = MimeTypeForOutputFormat(format)
+			converted.FileSize = 0
+			source = &converted
+		}
+		for _, targetFilepathnameTemplate := range outputFormat.TargetFileNames {
+			targetFilePath := fm.outputTargetPath(targetFilepathnameTemplate, source, outputFormat.Format)
+			targetFiles := append([]*ManagedFile{source}, extraFiles...)
+			extraFiles = nil
+			for i, targetFile := range targetFiles {
+				filePath := targetFilePath
+				if i > 0 {
+					filePath = filepath.Join(filepath.Dir(targetFilePath), targetFile.FileName)
+				}
+				fullFilePath, _, fileName := getFilePathAndName("", filePath)
+				outputFile := &ManagedFile{
+					FileName: fileName,
+					MetaData: targetFile.MetaData,
+					FileSize: targetFile.FileSize,
+					MimeType: targetFile.MimeType,
+				}
+				localFilePath, storageType, ok := fm.routedOutputPath(targetFile, outputFormat.StorageType, fullFilePath)
+				if !ok {
+					fail("OutputFormatCheck", fmt.Sprintf("Invalid storage type: %s", outputFormat.StorageType), fmt.Errorf("%w: %s", ErrInvalidStorageType, outputFormat.StorageType))
+					return
+				}
+				if !outputFormat.ContentAddressed {
+					if !outputFormat.OnCollision.valid() {
+						err := fmt.Errorf("%w: %s", ErrInvalidCollisionPolicy, outputFormat.OnCollision)
+						fail("OutputFormatCheck", fmt.Sprintf("Invalid output collision policy: %s", outputFormat.OnCollision), err)
+						return
+					}
+					localFilePath = collisionTargetPath(outputFormat.OnCollision, localFilePath, fileProcess.ID)
+					outputFile.FileName = filepath.Base(localFilePath)
+				}
+				outputFile.LocalFilePath = localFilePath
+				if storageType == FileStorageTypePublic {
+					outputFile.URL, _ = fm.GetPublicUrlForFile(outputFile.LocalFilePath)
+				}
+				resultingFiles = append(resultingFiles, newProcessingResultFile(outputFile, recipe.ResultMetaData))
+			}
+		}
+	}
+
+	status := ProcessingStatus{
+		ProcessID:         fileProcess.ID,
+		TimeStamp:         int(time.Now().UnixNano() / int64(time.Millisecond)),
+		ProcessorName:     "FileProcessing",
+		StatusDescription: "Dry run completed",
+		Percentage:        100,
+		Done:              true,
+		DryRun:            true,
+		ResultingFiles:    resultingFiles,
+	}
+	fileProcess.AddProcessingUpdate(status)
+	fm.LogTo("INFO", fmt.Sprintf("[FileManager.ProcessFile] Dry run of file(%s)%s COMPLETED with %d outputs\n", file.FileName, fileProcess.LogLabels(), len(resultingFiles)))
+	fm.publishFinalStatus(statusCh, fileProcess)
+}
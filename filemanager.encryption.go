@@ -0,0 +1,317 @@
+package filemanager
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+var (
+	ErrNotEncrypted         = errors.New("file is not encrypted")
+	ErrInvalidEncryptedFile = errors.New("invalid encrypted file")
+)
+
+// encryptedFileMagic starts every file written by an EncryptedStorage, followed by the big-endian length of the
+// JSON header, the header and the AES-256-GCM encrypted content (nonce + ciphertext).
+var encryptedFileMagic = []byte("FMENC1\n")
+
+// encryptedContentOverhead is what AES-256-GCM adds to the content: the nonce and the tag.
+const encryptedContentOverhead = 12 + 16
+
+type encryptedFileHeader struct {
+	Provider   string `json:"provider"`
+	Tenant     string `json:"tenant,omitempty"`
+	KeyID      string `json:"key_id"`
+	WrappedKey []byte `json:"wrapped_key"`
+}
+
+// EncryptedStorage encrypts files at rest: every file gets a random data key, which is stored next to the content
+// wrapped by the KeyProvider (envelope encryption). Files without the encryption header are read as they are, so
+// existing plaintext files stay readable. Set it with fm.SetStorage.
+type EncryptedStorage struct {
+	Storage Storage
+	Keys    KeyProvider
+	// TenantForPath returns the tenant whose keys are used for a path, e.g. derived from a directory name.
+	// Defaults to "" for all paths.
+	TenantForPath func(path string) string
+	// ShouldEncrypt decides which paths are encrypted, defaults to all. Public files served directly by a web
+	// server must stay unencrypted.
+	ShouldEncrypt func(path string) bool
+}
+
+func NewEncryptedStorage(storage Storage, keys KeyProvider) *EncryptedStorage {
+	return &EncryptedStorage{Storage: storage, Keys: keys}
+}
+
+func (s *EncryptedStorage) tenant(path string) string {
+	if s.TenantForPath == nil {
+		return ""
+	}
+	return s.TenantForPath(path)
+}
+
+func (s *EncryptedStorage) encrypts(path string) bool {
+	return s.ShouldEncrypt == nil || s.ShouldEncrypt(path)
+}
+
+func (s *EncryptedStorage) Create(path string) (io.WriteCloser, error) {
+	if !s.encrypts(path) {
+		return s.Storage.Create(path)
+	}
+	// reserve the path, the encrypted content is written on Close
+	w, err := s.Storage.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	err = w.Close()
+	if err != nil {
+		return nil, err
+	}
+	return &encryptedFileWriter{storage: s, path: path}, nil
+}
+
+func (s *EncryptedStorage) WriteFile(path string, data []byte, perm os.FileMode, noOverwrite bool) error {
+	if !s.encrypts(path) {
+		return s.Storage.WriteFile(path, data, perm, noOverwrite)
+	}
+	encrypted, err := s.encrypt(s.tenant(path), data)
+	if err != nil {
+		return err
+	}
+	return s.Storage.WriteFile(path, encrypted, perm, noOverwrite)
+}
+
+func (s *EncryptedStorage) ReadFile(path string) ([]byte, error) {
+	data, err := s.Storage.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.HasPrefix(data, encryptedFileMagic) {
+		return data, nil
+	}
+	return s.decrypt(s.tenant(path), data)
+}
+
+func (s *EncryptedStorage) Remove(path string) error {
+	return s.Storage.Remove(path)
+}
+
+// Stat reports the size of the decrypted content, computed from the size of the encrypted file and the length of
+// its header, which is all that is read of it.
+func (s *EncryptedStorage) Stat(path string) (fs.FileInfo, error) {
+	info, err := s.Storage.Stat(path)
+	if err != nil || info.IsDir() {
+		return info, err
+	}
+	prefix, err := readStoragePrefix(s.Storage, path, len(encryptedFileMagic)+4)
+	if err != nil || !bytes.HasPrefix(prefix, encryptedFileMagic) {
+		return info, err
+	}
+	if len(prefix) < len(encryptedFileMagic)+4 {
+		return nil, fmt.Errorf("%s: %w: truncated header", path, ErrInvalidEncryptedFile)
+	}
+	headerLength := int64(binary.BigEndian.Uint32(prefix[len(encryptedFileMagic):]))
+	size := info.Size() - int64(len(prefix)) - headerLength - encryptedContentOverhead
+	if size < 0 {
+		return nil, fmt.Errorf("%s: %w: shorter than its header", path, ErrInvalidEncryptedFile)
+	}
+	return plaintextFileInfo{FileInfo: info, size: size}, nil
+}
+
+// readStoragePrefix returns the first n bytes of the file, fewer if it is shorter, reading only those from storages
+// implementing RangeStorage or OpenStorage.
+func readStoragePrefix(storage Storage, path string, n int) ([]byte, error) {
+	if rangeStorage, ok := storage.(RangeStorage); ok {
+		prefix, err := rangeStorage.ReadFileRange(path, 0, int64(n))
+		if errors.Is(err, io.EOF) {
+			return nil, nil
+		}
+		return prefix, err
+	}
+	if openStorage, ok := storage.(OpenStorage); ok {
+		file, err := openStorage.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		prefix := make([]byte, n)
+		read, err := io.ReadFull(file, prefix)
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			err = nil
+		}
+		return prefix[:read], err
+	}
+	data, err := storage.ReadFile(path)
+	if len(data) > n {
+		data = data[:n]
+	}
+	return data, err
+}
+
+// ReadDir lists directories if the wrapped storage is a DirStorage, reporting decrypted file sizes.
+func (s *EncryptedStorage) ReadDir(path string) ([]fs.DirEntry, error) {
+	dirStorage, ok := s.Storage.(DirStorage)
+	if !ok {
+		return nil, &fs.PathError{Op: "readdir", Path: path, Err: errors.ErrUnsupported}
+	}
+	entries, err := dirStorage.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+	for i, entry := range entries {
+		if !entry.IsDir() {
+			entries[i] = encryptedDirEntry{DirEntry: entry, storage: s, path: filepath.Join(path, entry.Name())}
+		}
+	}
+	return entries, nil
+}
+
+type encryptedDirEntry struct {
+	fs.DirEntry
+	storage *EncryptedStorage
+	path    string
+}
+
+func (entry encryptedDirEntry) Info() (fs.FileInfo, error) {
+	return entry.storage.Stat(entry.path)
+}
+
+// Rewrap wraps the data key of an encrypted file with the current master key of its tenant, without re-encrypting
+// the content. Run it over all files after rotating or changing master keys. It returns ErrNotEncrypted for
+// plaintext files.
+func (s *EncryptedStorage) Rewrap(path string) error {
+	data, err := s.Storage.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if !bytes.HasPrefix(data, encryptedFileMagic) {
+		return ErrNotEncrypted
+	}
+	header, content, err := parseEncryptedFile(data)
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	dataKey, err := s.Keys.UnwrapKey(header.Tenant, header.KeyID, header.WrappedKey)
+	if err != nil {
+		return err
+	}
+	keyID, wrappedKey, err := s.Keys.WrapKey(header.Tenant, dataKey)
+	if err != nil {
+		return err
+	}
+	header.Provider = s.Keys.Name()
+	header.KeyID = keyID
+	header.WrappedKey = wrappedKey
+	rewrapped, err := marshalEncryptedFile(header, content)
+	if err != nil {
+		return err
+	}
+	info, err := s.Storage.Stat(path)
+	if err != nil {
+		return err
+	}
+	return s.Storage.WriteFile(path, rewrapped, info.Mode().Perm(), false)
+}
+
+func (s *EncryptedStorage) encrypt(tenant string, data []byte) ([]byte, error) {
+	dataKey := make([]byte, 32)
+	_, err := rand.Read(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	keyID, wrappedKey, err := s.Keys.WrapKey(tenant, dataKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to wrap data key: %w", err)
+	}
+	content, err := sealAESGCM(dataKey, data, []byte(tenant))
+	if err != nil {
+		return nil, err
+	}
+	header := encryptedFileHeader{Provider: s.Keys.Name(), Tenant: tenant, KeyID: keyID, WrappedKey: wrappedKey}
+	return marshalEncryptedFile(header, content)
+}
+
+// decrypt refuses files whose stored tenant is not the tenant of their path, so a file moved to another tenant's
+// path is not decrypted. The stored tenant is authenticated as additional data, so it cannot be altered either.
+func (s *EncryptedStorage) decrypt(tenant string, data []byte) ([]byte, error) {
+	header, content, err := parseEncryptedFile(data)
+	if err != nil {
+		return nil, err
+	}
+	if header.Tenant != tenant {
+		return nil, fmt.Errorf("%w: file belongs to another tenant", ErrInvalidEncryptedFile)
+	}
+	dataKey, err := s.Keys.UnwrapKey(header.Tenant, header.KeyID, header.WrappedKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unwrap data key(%s): %w", header.KeyID, err)
+	}
+	return openAESGCM(dataKey, content, []byte(header.Tenant))
+}
+
+func marshalEncryptedFile(header encryptedFileHeader, content []byte) ([]byte, error) {
+	headerJSON, err := json.Marshal(header)
+	if err != nil {
+		return nil, err
+	}
+	data := make([]byte, 0, len(encryptedFileMagic)+4+len(headerJSON)+len(content))
+	data = append(data, encryptedFileMagic...)
+	data = binary.BigEndian.AppendUint32(data, uint32(len(headerJSON)))
+	data = append(data, headerJSON...)
+	return append(data, content...), nil
+}
+
+func parseEncryptedFile(data []byte) (encryptedFileHeader, []byte, error) {
+	var header encryptedFileHeader
+	data = data[len(encryptedFileMagic):]
+	if len(data) < 4 {
+		return header, nil, ErrInvalidEncryptedFile
+	}
+	headerLength := int(binary.BigEndian.Uint32(data))
+	data = data[4:]
+	if headerLength > len(data) {
+		return header, nil, ErrInvalidEncryptedFile
+	}
+	err := json.Unmarshal(data[:headerLength], &header)
+	if err != nil {
+		return header, nil, fmt.Errorf("%w: %v", ErrInvalidEncryptedFile, err)
+	}
+	return header, data[headerLength:], nil
+}
+
+type encryptedFileWriter struct {
+	storage *EncryptedStorage
+	path    string
+	buf     bytes.Buffer
+	closed  bool
+}
+
+func (w *encryptedFileWriter) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, ErrStorageClosed
+	}
+	return w.buf.Write(p)
+}
+
+func (w *encryptedFileWriter) Close() error {
+	if w.closed {
+		return ErrStorageClosed
+	}
+	w.closed = true
+	return w.storage.WriteFile(w.path, w.buf.Bytes(), 0600, false)
+}
+
+type plaintextFileInfo struct {
+	fs.FileInfo
+	size int64
+}
+
+func (info plaintextFileInfo) Size() int64 {
+	return info.size
+}
@@ -0,0 +1,84 @@
+package filemanager_test
+
+import (
+	"bytes"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	filemanager "github.com/itsatony/go-filemanager"
+)
+
+func newTestEncryptedStorage(storage filemanager.Storage) *filemanager.EncryptedStorage {
+	keys := &filemanager.StaticKeyProvider{
+		Keys:         map[string][]byte{"k1": bytes.Repeat([]byte{1}, 32)},
+		CurrentKeyID: "k1",
+	}
+	encrypted := filemanager.NewEncryptedStorage(storage, keys)
+	encrypted.TenantForPath = func(path string) string {
+		return filepath.Base(filepath.Dir(path))
+	}
+	return encrypted
+}
+
+func TestEncryptedStorage(t *testing.T) {
+	for name, storage := range map[string]filemanager.Storage{
+		"local":  filemanager.LocalStorage{},
+		"memory": filemanager.NewMemoryStorage(),
+	} {
+		t.Run(name, func(t *testing.T) {
+			encrypted := newTestEncryptedStorage(storage)
+			dir := t.TempDir()
+			path := filepath.Join(dir, "a", "hello.txt")
+
+			err := encrypted.WriteFile(path, []byte("hello world"), 0600, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			raw, err := storage.ReadFile(path)
+			if err != nil || bytes.Contains(raw, []byte("hello world")) {
+				t.Fatalf("stored content = %q, %v, want it encrypted", raw, err)
+			}
+			content, err := encrypted.ReadFile(path)
+			if err != nil || string(content) != "hello world" {
+				t.Fatalf("ReadFile() = %q, %v, want %q", content, err, "hello world")
+			}
+			info, err := encrypted.Stat(path)
+			if err != nil || info.Size() != int64(len("hello world")) {
+				t.Fatalf("Stat() = %v, %v, want the decrypted size %d", info, err, len("hello world"))
+			}
+
+			moved := filepath.Join(dir, "b", "hello.txt")
+			err = storage.WriteFile(moved, raw, 0600, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = encrypted.ReadFile(moved)
+			if !errors.Is(err, filemanager.ErrInvalidEncryptedFile) {
+				t.Fatalf("ReadFile() of another tenant's file = %v, want ErrInvalidEncryptedFile", err)
+			}
+
+			truncated := filepath.Join(dir, "a", "truncated.txt")
+			headerEnd := bytes.IndexByte(raw, '}') + 1
+			err = storage.WriteFile(truncated, raw[:headerEnd], 0600, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = encrypted.Stat(truncated)
+			if !errors.Is(err, filemanager.ErrInvalidEncryptedFile) {
+				t.Fatalf("Stat() of a truncated file = %v, want ErrInvalidEncryptedFile", err)
+			}
+
+			plain := filepath.Join(dir, "a", "plain.txt")
+			err = storage.WriteFile(plain, []byte(strings.Repeat("x", 3)), 0600, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			info, err = encrypted.Stat(plain)
+			if err != nil || info.Size() != 3 {
+				t.Fatalf("Stat() of a plaintext file = %v, %v, want size 3", info, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,107 @@
+package filemanager
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Failure classes of process errors. Every error of a process belongs to at most one class, matched with
+// errors.Is(err, ErrValidation) and so on; the typed errors below carry the details for errors.As, and wrap the
+// sentinel of the cause (ErrInvalidMimeType, ErrFileOnHold, ErrVirusFound, ...), which errors.Is matches too.
+var (
+	ErrValidation = errors.New("validation failed")
+	ErrStorage    = errors.New("storage operation failed")
+	ErrPlugin     = errors.New("processing plugin failed")
+	ErrScan       = errors.New("scan failed")
+
+	ErrInvalidParam = errors.New("invalid parameter")
+)
+
+// ValidationError reports input that is rejected: a MIME type, a file size, a step parameter or the expectations
+// of an upload session. The caller can fix it and try again.
+type ValidationError struct {
+	Field string // what was validated, e.g. "mime_type", "file_size" or the name of a parameter
+	Err   error
+}
+
+func (e *ValidationError) Error() string {
+	if e.Field == "" {
+		return e.Err.Error()
+	}
+	return fmt.Sprintf("%s: %v", e.Field, e.Err)
+}
+
+func (e *ValidationError) Is(target error) bool {
+	return target == ErrValidation
+}
+
+func (e *ValidationError) Unwrap() error {
+	return e.Err
+}
+
+// invalidParamError is the ValidationError of a step parameter with an unusable value.
+func invalidParamError(name string, value any) error {
+	return &ValidationError{Field: name, Err: fmt.Errorf("%w: %v", ErrInvalidParam, value)}
+}
+
+// StorageError reports a failed storage operation on a file, e.g. writing an upload or saving an output.
+type StorageError struct {
+	Op   string // "create", "read", "save", ...
+	Path string
+	Err  error
+}
+
+func (e *StorageError) Error() string {
+	return fmt.Sprintf("storage %s of file(%s) failed: %v", e.Op, e.Path, e.Err)
+}
+
+func (e *StorageError) Is(target error) bool {
+	return target == ErrStorage
+}
+
+func (e *StorageError) Unwrap() error {
+	return e.Err
+}
+
+// PluginError reports a failed processing step. Errors the plugin returned are wrapped as they are, so a
+// ValidationError of a parameter matches ErrValidation as well as ErrPlugin.
+type PluginError struct {
+	Plugin string
+	Step   int // 1-based index of the step in its recipe, 0 for RunProcessingStep
+	Err    error
+}
+
+func (e *PluginError) Error() string {
+	if e.Step == 0 {
+		return fmt.Sprintf("plugin(%s) failed: %v", e.Plugin, e.Err)
+	}
+	return fmt.Sprintf("plugin(%s) failed in step %d: %v", e.Plugin, e.Step, e.Err)
+}
+
+func (e *PluginError) Is(target error) bool {
+	return target == ErrPlugin
+}
+
+func (e *PluginError) Unwrap() error {
+	return e.Err
+}
+
+// ScanError reports a virus scan that failed or could not be completed. A found virus is a VirusFoundError, which
+// matches ErrScan as well.
+type ScanError struct {
+	Scanner  string
+	FileName string
+	Err      error
+}
+
+func (e *ScanError) Error() string {
+	return fmt.Sprintf("scan of file(%s) by %s failed: %v", e.FileName, e.Scanner, e.Err)
+}
+
+func (e *ScanError) Is(target error) bool {
+	return target == ErrScan
+}
+
+func (e *ScanError) Unwrap() error {
+	return e.Err
+}
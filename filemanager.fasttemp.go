@@ -0,0 +1,172 @@
+package filemanager
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+)
+
+// DEFAULT_SPILL_THRESHOLD is the size above which uploads spill from the fast temp path to the temp path on disk.
+const DEFAULT_SPILL_THRESHOLD = 1 << 20
+
+var (
+	ErrInvalidFastTemp = errors.New("invalid fast temp options")
+)
+
+// FastTempOptions put the temporary files of small uploads on a fast path, e.g. a tmpfs mount, cutting the latency
+// of the dominant small-file case. Uploads growing beyond the threshold spill to the temp path on disk, as do
+// uploads the fast path has no room for.
+type FastTempOptions struct {
+	// Path is the fast temp directory, e.g. /dev/shm/filemanager. Tenant views use <Path>/<tenantID>.
+	Path string `yaml:"path"`
+	// SpillThreshold is the size in bytes above which an upload is moved to the temp path on disk,
+	// DEFAULT_SPILL_THRESHOLD by default. UploadSessionOptions.SpillThreshold overrides it per upload.
+	SpillThreshold int64 `yaml:"spill_threshold"`
+}
+
+func (opts FastTempOptions) validate() error {
+	if opts.Path == "" {
+		return fmt.Errorf("%w: path is required", ErrInvalidFastTemp)
+	}
+	if opts.SpillThreshold < 0 {
+		return fmt.Errorf("%w: spill threshold %d", ErrInvalidFastTemp, opts.SpillThreshold)
+	}
+	return nil
+}
+
+// EnableFastTemp makes HandleFileUpload write uploads to the fast temp path first. Tenant views share the setting
+// of their FileManager. Keep the threshold well below the size of the tmpfs, its files take memory.
+func (fm *FileManager) EnableFastTemp(opts FastTempOptions) error {
+	err := opts.validate()
+	if err != nil {
+		return err
+	}
+	if opts.SpillThreshold == 0 {
+		opts.SpillThreshold = DEFAULT_SPILL_THRESHOLD
+	}
+	root := fm.root()
+	root.mu.Lock()
+	defer root.mu.Unlock()
+	root.fastTemp = &opts
+	return nil
+}
+
+// fastTempPath returns the fast temp path of the FileManager, "" if it is not enabled.
+func (fm *FileManager) fastTempPath() string {
+	root := fm.root()
+	root.mu.RLock()
+	defer root.mu.RUnlock()
+	if root.fastTemp == nil {
+		return ""
+	}
+	if fm.tenant != nil {
+		return filepath.Join(root.fastTemp.Path, fm.tenant.id)
+	}
+	return root.fastTemp.Path
+}
+
+// spillThreshold returns the size above which the upload spills to disk, -1 to write it to disk right away.
+func (fm *FileManager) spillThreshold(fileProcess *FileProcess) int64 {
+	root := fm.root()
+	root.mu.RLock()
+	fastTemp := root.fastTemp
+	root.mu.RUnlock()
+	if fastTemp == nil {
+		return -1
+	}
+	threshold := fastTemp.SpillThreshold
+	if session := fileProcess.session; session != nil {
+		if session.Options.SpillThreshold != 0 {
+			threshold = session.Options.SpillThreshold
+		}
+		// known to be too large
+		if threshold >= 0 && session.Options.ExpectedSize > threshold {
+			return -1
+		}
+	}
+	return threshold
+}
+
+// createUploadFile creates the temporary file of an upload with the name, on the fast temp path if the upload may
+// stay below the spill threshold and in the temp path otherwise.
+func (fm *FileManager) createUploadFile(name string, fileProcess *FileProcess) (*uploadFile, error) {
+	storage := fm.GetStorage()
+	diskPath := filepath.Join(fm.localTempPath, name)
+	threshold := fm.spillThreshold(fileProcess)
+	if threshold >= 0 {
+		fastPath := filepath.Join(fm.fastTempPath(), name)
+		w, err := storage.Create(fastPath)
+		if err == nil {
+			return &uploadFile{fm: fm, storage: storage, w: w, path: fastPath, diskPath: diskPath, threshold: threshold}, nil
+		}
+		fm.LogTo("INFO", fmt.Sprintf("[FileManager.HandleFileUpload] Creating upload file(%s) on the fast temp path failed, using the disk: %v\n", fastPath, err))
+	}
+	w, err := storage.Create(diskPath)
+	if err != nil {
+		return nil, &StorageError{Op: "create", Path: diskPath, Err: err}
+	}
+	return &uploadFile{fm: fm, storage: storage, w: w, path: diskPath, diskPath: diskPath, spilled: true}, nil
+}
+
+// uploadFile is the temporary file an upload is written to. It starts on the fast temp path and moves to the disk
+// once it grows beyond the threshold or the fast path fails to take more.
+type uploadFile struct {
+	fm        *FileManager
+	storage   Storage
+	w         io.WriteCloser
+	path      string // where the file is now
+	diskPath  string
+	threshold int64
+	written   int64
+	spilled   bool
+}
+
+func (f *uploadFile) Write(p []byte) (int, error) {
+	if !f.spilled && f.written+int64(len(p)) > f.threshold {
+		err := f.spill()
+		if err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.w.Write(p)
+	f.written += int64(n)
+	if err != nil && !f.spilled {
+		// e.g. the tmpfs is full
+		if spillErr := f.spill(); spillErr != nil {
+			return n, err
+		}
+		m, err := f.w.Write(p[n:])
+		f.written += int64(m)
+		return n + m, err
+	}
+	return n, err
+}
+
+func (f *uploadFile) Close() error {
+	return f.w.Close()
+}
+
+// spill moves what was written so far from the fast temp path to the disk and continues there.
+func (f *uploadFile) spill() error {
+	// the content is written on close by some storages
+	_ = f.w.Close()
+	data, err := f.storage.ReadFile(f.path)
+	if err != nil {
+		return &StorageError{Op: "read", Path: f.path, Err: err}
+	}
+	w, err := f.storage.Create(f.diskPath)
+	if err != nil {
+		return &StorageError{Op: "create", Path: f.diskPath, Err: err}
+	}
+	_, err = w.Write(data)
+	if err != nil {
+		w.Close()
+		f.storage.Remove(f.diskPath)
+		return &StorageError{Op: "write", Path: f.diskPath, Err: err}
+	}
+	f.storage.Remove(f.path)
+	f.fm.LogTo("DEBUG", fmt.Sprintf("[FileManager.HandleFileUpload] Upload file(%s) spilled to disk after %d bytes\n", filepath.Base(f.path), len(data)))
+	f.w, f.path, f.spilled = w, f.diskPath, true
+	return nil
+}
@@ -0,0 +1,209 @@
+package filemanager
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrFileNotAvailable = errors.New("file has no content, local file or url to read from")
+)
+
+// OpenStorage is implemented by storages that can open files for streaming reads. Without it, ManagedFile.Open
+// reads the whole file into memory.
+type OpenStorage interface {
+	Storage
+	Open(path string) (io.ReadSeekCloser, error)
+}
+
+func (LocalStorage) Open(path string) (io.ReadSeekCloser, error) {
+	return os.Open(path)
+}
+
+func (s *MemoryStorage) Open(path string) (io.ReadSeekCloser, error) {
+	data, err := s.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return nopReadSeekCloser{bytes.NewReader(data)}, nil
+}
+
+type nopReadSeekCloser struct {
+	io.ReadSeeker
+}
+
+func (nopReadSeekCloser) Close() error { return nil }
+
+// Open returns a reader of the file's content, whichever way it is available: the loaded Content, the file at
+// LocalFilePath in the FileManager's Storage, or the URL, which is mapped to the public storage if it has the
+// FileManager's base URL and streamed over HTTP otherwise. Remote files are read with range requests when seeking,
+// within the FileManager's download rate limit. The caller has to close the reader.
+func (entity *ManagedFile) Open(fm *FileManager) (io.ReadSeekCloser, error) {
+	if len(entity.Content) > 0 {
+		return nopReadSeekCloser{bytes.NewReader(entity.Content)}, nil
+	}
+	if entity.LocalFilePath != "" {
+		err := fm.checkOwnsPath(entity.LocalFilePath)
+		if err != nil {
+			return nil, err
+		}
+		reader, err := fm.openStored(entity.LocalFilePath)
+		if !errors.Is(err, fs.ErrNotExist) {
+			return reader, err
+		}
+	}
+	if entity.URL == "" {
+		name := entity.FileName
+		if name == "" {
+			name = entity.LocalFilePath
+		}
+		return nil, fmt.Errorf("%w: %s", ErrFileNotAvailable, name)
+	}
+	if strings.HasPrefix(entity.URL, fm.baseUrl) {
+		localFilePath := fm.storedLocalPath(FileStorageTypePublic, strings.TrimPrefix(entity.URL, fm.baseUrl))
+		reader, err := fm.openStored(localFilePath)
+		if !errors.Is(err, fs.ErrNotExist) {
+			return reader, err
+		}
+	}
+	return fm.openURL(context.Background(), entity.URL)
+}
+
+func (fm *FileManager) openStored(localFilePath string) (io.ReadSeekCloser, error) {
+	err := fm.checkContainedPath(localFilePath)
+	if err != nil {
+		return nil, err
+	}
+	storage := fm.storageFor(localFilePath)
+	if openStorage, ok := storage.(OpenStorage); ok {
+		return openStorage.Open(localFilePath)
+	}
+	data, err := storage.ReadFile(localFilePath)
+	if err != nil {
+		return nil, err
+	}
+	return nopReadSeekCloser{bytes.NewReader(data)}, nil
+}
+
+// openURL returns a reader of the url, fetching from the current offset on the first read after a seek.
+func (fm *FileManager) openURL(ctx context.Context, url string) (io.ReadSeekCloser, error) {
+	reader := &remoteFile{ctx: ctx, url: url, size: -1, limiters: ThrottleOptions{}.limiters(fm.getDownloadLimiter())}
+	// fail early for unreachable urls, the body is read by the first Read
+	err := reader.request()
+	if err != nil {
+		return nil, err
+	}
+	return reader, nil
+}
+
+type remoteFile struct {
+	ctx      context.Context
+	url      string
+	offset   int64
+	rangeEnd int64 // last byte requested, 0 for the rest of the file
+	size     int64 // -1 until known
+	body     io.ReadCloser
+	limiters []*RateLimiter
+}
+
+// request starts a GET from the offset, with a range request if the offset is not 0 or the range is bounded.
+func (f *remoteFile) request() error {
+	req, err := http.NewRequestWithContext(f.ctx, http.MethodGet, f.url, nil)
+	if err != nil {
+		return err
+	}
+	if f.rangeEnd > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", f.offset, f.rangeEnd))
+	} else if f.offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", f.offset))
+	}
+	response, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	switch {
+	case response.StatusCode == http.StatusRequestedRangeNotSatisfiable:
+		response.Body.Close()
+		f.body = io.NopCloser(bytes.NewReader(nil))
+		return nil
+	case response.StatusCode == http.StatusPartialContent:
+		if _, total, ok := strings.Cut(response.Header.Get("Content-Range"), "/"); ok {
+			if size, err := strconv.ParseInt(total, 10, 64); err == nil {
+				f.size = size
+			}
+		}
+	case response.StatusCode == http.StatusOK:
+		if response.ContentLength >= 0 {
+			f.size = response.ContentLength
+		}
+		// the server ignored the range, skip to the offset
+		if f.offset > 0 {
+			_, err = io.CopyN(io.Discard, response.Body, f.offset)
+			if err != nil && err != io.EOF {
+				response.Body.Close()
+				return err
+			}
+		}
+	default:
+		response.Body.Close()
+		return fmt.Errorf("downloading %s failed: %s", f.url, response.Status)
+	}
+	f.body = struct {
+		io.Reader
+		io.Closer
+	}{NewThrottledReader(f.ctx, response.Body, f.limiters...), response.Body}
+	return nil
+}
+
+func (f *remoteFile) Read(p []byte) (int, error) {
+	if f.body == nil {
+		err := f.request()
+		if err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.body.Read(p)
+	f.offset += int64(n)
+	return n, err
+}
+
+func (f *remoteFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		if f.size < 0 {
+			return 0, fmt.Errorf("size of %s is unknown", f.url)
+		}
+		offset += f.size
+	default:
+		return 0, fmt.Errorf("invalid whence: %d", whence)
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("negative position: %d", offset)
+	}
+	if offset != f.offset && f.body != nil {
+		f.body.Close()
+		f.body = nil
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+func (f *remoteFile) Close() error {
+	if f.body == nil {
+		return nil
+	}
+	err := f.body.Close()
+	f.body = nil
+	return err
+}
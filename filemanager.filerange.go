@@ -0,0 +1,122 @@
+package filemanager
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"strings"
+)
+
+// RangeStorage is implemented by storages that can read part of a file without reading all of it, e.g. with
+// ranged GETs of an object store. Without it, ReadFileRange seeks in the file opened through OpenStorage.
+type RangeStorage interface {
+	Storage
+	// ReadFileRange returns up to length bytes from the offset, fewer at the end of the file and io.EOF if the
+	// offset is at or beyond the end.
+	ReadFileRange(path string, offset int64, length int64) ([]byte, error)
+}
+
+func (LocalStorage) ReadFileRange(path string, offset int64, length int64) ([]byte, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return readRange(file, offset, length)
+}
+
+// ReadFileRange returns up to length bytes of the file's content from the offset, e.g. the first lines of a huge
+// CSV for a preview, without reading the whole file. Like ManagedFile.Open it reads the loaded Content, the file
+// in the Storage or the URL, with an HTTP range request for remote files. Near the end of the file fewer bytes are
+// returned; an offset at or beyond the end returns io.EOF.
+func (fm *FileManager) ReadFileRange(file *ManagedFile, offset int64, length int64) ([]byte, error) {
+	if offset < 0 || length < 0 {
+		return nil, fmt.Errorf("invalid range: offset %d, length %d", offset, length)
+	}
+	if file.LocalFilePath != "" {
+		err := fm.checkOwnsPath(file.LocalFilePath)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(file.Content) > 0 {
+		if offset >= int64(len(file.Content)) {
+			return nil, io.EOF
+		}
+		end := offset + length
+		if end > int64(len(file.Content)) {
+			end = int64(len(file.Content))
+		}
+		return append([]byte(nil), file.Content[offset:end]...), nil
+	}
+	if file.LocalFilePath != "" {
+		data, err := fm.readStoredRange(file.LocalFilePath, offset, length)
+		if !errors.Is(err, fs.ErrNotExist) {
+			return data, err
+		}
+	}
+	if file.URL == "" {
+		return nil, fmt.Errorf("%w: %s", ErrFileNotAvailable, file.FileName)
+	}
+	if strings.HasPrefix(file.URL, fm.baseUrl) {
+		data, err := fm.readStoredRange(fm.storedLocalPath(FileStorageTypePublic, strings.TrimPrefix(file.URL, fm.baseUrl)), offset, length)
+		if !errors.Is(err, fs.ErrNotExist) {
+			return data, err
+		}
+	}
+	if length == 0 {
+		return []byte{}, nil
+	}
+	remote := &remoteFile{
+		ctx:      context.Background(),
+		url:      file.URL,
+		offset:   offset,
+		rangeEnd: offset + length - 1,
+		size:     -1,
+		limiters: ThrottleOptions{}.limiters(fm.getDownloadLimiter()),
+	}
+	defer remote.Close()
+	return readRange(remote, 0, length)
+}
+
+func (fm *FileManager) readStoredRange(localFilePath string, offset int64, length int64) ([]byte, error) {
+	err := fm.checkContainedPath(localFilePath)
+	if err != nil {
+		return nil, err
+	}
+	storage := fm.storageFor(localFilePath)
+	if rangeStorage, ok := storage.(RangeStorage); ok {
+		return rangeStorage.ReadFileRange(localFilePath, offset, length)
+	}
+	reader, err := fm.openStored(localFilePath)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return readRange(reader, offset, length)
+}
+
+// readRange reads up to length bytes from the offset of the reader, seeking if the offset is not 0.
+func readRange(reader io.Reader, offset int64, length int64) ([]byte, error) {
+	if offset > 0 {
+		seeker, ok := reader.(io.Seeker)
+		if !ok {
+			return nil, errors.New("reader does not support seeking")
+		}
+		_, err := seeker.Seek(offset, io.SeekStart)
+		if err != nil {
+			return nil, err
+		}
+	}
+	data, err := readAllPooled(io.LimitReader(reader, length))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 && length > 0 {
+		return nil, io.EOF
+	}
+	return data, nil
+}
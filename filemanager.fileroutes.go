@@ -0,0 +1,264 @@
+package filemanager
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var (
+	ErrFileIDNotFound      = errors.New("file id not found")
+	ErrFileAccessDenied    = errors.New("access to the file denied")
+	ErrFileRoutesDisabled  = errors.New("file routes are not enabled")
+	ErrFileOutsideStorages = errors.New("file is not in the public, private or temp path")
+)
+
+const (
+	// FILE_IDS_DIR_NAME is the hidden directory in the private path holding the file id mapping.
+	FILE_IDS_DIR_NAME = ".file-ids"
+	FILE_ID_LENGTH    = 24
+)
+
+// FileReference is a file registered under a stable id, see GetFileURL.
+type FileReference struct {
+	ID            string          `json:"id"`
+	StorageType   FileStorageType `json:"storageType"`
+	LocalFilePath string          `json:"localFilePath"`
+	Owner         string          `json:"owner,omitempty"`
+	CreatedAt     time.Time       `json:"createdAt"`
+}
+
+// FileAuthorizer decides whether the request may read the referenced file, e.g. by comparing ref.Owner with the
+// authenticated user. A returned error denies access.
+type FileAuthorizer func(r *http.Request, ref FileReference) error
+
+// FileRoutesOptions configure the id based URLs of managed files.
+type FileRoutesOptions struct {
+	// BaseURL is the URL FileRouteHandler is mounted at, e.g. "https://api.example.com/files/". File URLs are
+	// BaseURL + id.
+	BaseURL string
+	// Authorize is asked for every request of a private or temp file; without it, only public files are served.
+	// Public files are checked too if AuthorizePublic is set.
+	Authorize       FileAuthorizer
+	AuthorizePublic bool
+}
+
+// EnableFileRoutes makes GetFileURL hand out stable id based URLs (BaseURL + id) for files of all storage types,
+// served by FileRouteHandler. Tenant views share the routes of their FileManager.
+func (fm *FileManager) EnableFileRoutes(options FileRoutesOptions) {
+	root := fm.root()
+	root.mu.Lock()
+	defer root.mu.Unlock()
+	root.fileRoutes = &options
+}
+
+func (fm *FileManager) getFileRoutes() *FileRoutesOptions {
+	root := fm.root()
+	root.mu.RLock()
+	defer root.mu.RUnlock()
+	return root.fileRoutes
+}
+
+// RegisterFileID returns the reference of the file, registering it under a new id on first use. The id stays the
+// same for the path, also when the file is overwritten.
+func (fm *FileManager) RegisterFileID(file *ManagedFile) (FileReference, error) {
+	storageType, ok := fm.storageTypeOf(file.LocalFilePath)
+	if !ok {
+		return FileReference{}, fmt.Errorf("%w: %s", ErrFileOutsideStorages, file.LocalFilePath)
+	}
+	storage := fm.GetStorage()
+	pathIndex := fm.fileIDPathIndex(file.LocalFilePath)
+	id, err := storage.ReadFile(pathIndex)
+	if err == nil {
+		return fm.ResolveFileID(string(id))
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return FileReference{}, err
+	}
+
+	ref := FileReference{
+		ID:            NID("", FILE_ID_LENGTH),
+		StorageType:   storageType,
+		LocalFilePath: path.Clean(filepath.ToSlash(file.LocalFilePath)),
+		Owner:         file.Owner,
+		CreatedAt:     time.Now(),
+	}
+	data, err := json.Marshal(ref)
+	if err != nil {
+		return FileReference{}, err
+	}
+	root := fm.root()
+	err = storage.WriteFile(root.fileIDPath(ref.ID), data, 0600, true)
+	if err != nil {
+		return FileReference{}, err
+	}
+	// a concurrent registration of the same path wins, the id written here stays unused
+	err = storage.WriteFile(pathIndex, []byte(ref.ID), 0600, true)
+	if errors.Is(err, ErrFileExists) {
+		storage.Remove(root.fileIDPath(ref.ID))
+		return fm.RegisterFileID(file)
+	}
+	if err != nil {
+		return FileReference{}, err
+	}
+	fm.replicate(root.fileIDPath(ref.ID), false)
+	fm.replicate(pathIndex, false)
+	return ref, nil
+}
+
+// GetFileURL returns the stable URL of the file, BaseURL + id, registering the file if needed. Unlike
+// GetPublicUrlForFile it covers private and temp files, which FileRouteHandler serves after the access check.
+func (fm *FileManager) GetFileURL(file *ManagedFile) (string, error) {
+	routes := fm.getFileRoutes()
+	if routes == nil {
+		return "", ErrFileRoutesDisabled
+	}
+	ref, err := fm.RegisterFileID(file)
+	if err != nil {
+		return "", err
+	}
+	return joinURL(routes.BaseURL, ref.ID)
+}
+
+// ResolveFileID returns the file registered under the id. Tenant views only resolve their own files.
+func (fm *FileManager) ResolveFileID(id string) (FileReference, error) {
+	if id == "" || strings.ContainsAny(id, "/\\.") {
+		return FileReference{}, fmt.Errorf("%w: %q", ErrFileIDNotFound, id)
+	}
+	data, err := fm.GetStorage().ReadFile(fm.root().fileIDPath(id))
+	if errors.Is(err, fs.ErrNotExist) {
+		return FileReference{}, fmt.Errorf("%w: %s", ErrFileIDNotFound, id)
+	}
+	if err != nil {
+		return FileReference{}, err
+	}
+	var ref FileReference
+	err = json.Unmarshal(data, &ref)
+	if err != nil {
+		return FileReference{}, err
+	}
+	if !fm.ownsPath(ref.LocalFilePath) {
+		return FileReference{}, fmt.Errorf("%w: %s", ErrFileIDNotFound, id)
+	}
+	return ref, nil
+}
+
+// ResolveFileURL returns the file of a URL handed out by GetFileURL.
+func (fm *FileManager) ResolveFileURL(url string) (FileReference, error) {
+	routes := fm.getFileRoutes()
+	if routes == nil {
+		return FileReference{}, ErrFileRoutesDisabled
+	}
+	if !strings.HasPrefix(url, routes.BaseURL) {
+		return FileReference{}, ErrUrlNotMapped
+	}
+	return fm.ResolveFileID(strings.Trim(strings.TrimPrefix(url, routes.BaseURL), "/"))
+}
+
+// UnregisterFileID removes the id of the file, so its URL no longer resolves. DeleteFile does not remove ids: they
+// fail with 404 while the file is missing and resolve again if a file is stored at the path.
+func (fm *FileManager) UnregisterFileID(localFilePath string) error {
+	storage := fm.GetStorage()
+	pathIndex := fm.fileIDPathIndex(localFilePath)
+	id, err := storage.ReadFile(pathIndex)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	err = storage.Remove(fm.root().fileIDPath(string(id)))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	err = storage.Remove(pathIndex)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	fm.replicate(fm.root().fileIDPath(string(id)), true)
+	fm.replicate(pathIndex, true)
+	return nil
+}
+
+// FileRouteHandler serves files by id (the last path segment, e.g. /files/{id}) with their stored HTTP headers.
+// Private and temp files need the Authorize func of the FileRoutesOptions to allow the request; denied requests
+// get 403, unknown ids 404.
+func (fm *FileManager) FileRouteHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		routes := fm.getFileRoutes()
+		if routes == nil {
+			http.NotFound(w, r)
+			return
+		}
+		ref, err := fm.ResolveFileID(path.Base(r.URL.Path))
+		if errors.Is(err, ErrFileIDNotFound) {
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		err = authorizeFileRequest(routes, r, ref)
+		if err != nil {
+			fm.LogTo("DEBUG", fmt.Sprintf("[FileManager.FileRouteHandler] access to file(%s) denied: %v\n", ref.ID, err))
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+		// private and temp files must not end up in shared caches
+		if ref.StorageType != FileStorageTypePublic {
+			w.Header().Set("Cache-Control", "private, no-store")
+		}
+		fsys := fm.root().FS(ref.StorageType).(*storageFS)
+		name, err := filepath.Rel(fsys.root, ref.LocalFilePath)
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		fm.serveFile(w, r, fsys, filepath.ToSlash(name))
+	})
+}
+
+func authorizeFileRequest(routes *FileRoutesOptions, r *http.Request, ref FileReference) error {
+	if ref.StorageType == FileStorageTypePublic && !routes.AuthorizePublic {
+		return nil
+	}
+	if routes.Authorize == nil {
+		return ErrFileAccessDenied
+	}
+	return routes.Authorize(r, ref)
+}
+
+// storageTypeOf returns the storage type whose base path contains the local file path.
+func (fm *FileManager) storageTypeOf(localFilePath string) (FileStorageType, bool) {
+	for _, storageType := range []FileStorageType{FileStorageTypePublic, FileStorageTypePrivate, FileStorageTypeTemp} {
+		relative, err := filepath.Rel(fm.GetLocalPathForFile(storageType, ""), localFilePath)
+		if err == nil && relative != "." && !strings.HasPrefix(relative, "..") {
+			return storageType, true
+		}
+	}
+	return "", false
+}
+
+func (fm *FileManager) fileIDPath(id string) string {
+	return fm.GetPrivateLocalFilePath(path.Join(FILE_IDS_DIR_NAME, id+".json"))
+}
+
+// fileIDPathIndex is the path of the file holding the id of the local file path, named by the path's hash.
+func (fm *FileManager) fileIDPathIndex(localFilePath string) string {
+	sum := sha256.Sum256([]byte(path.Clean(filepath.ToSlash(localFilePath))))
+	return fm.root().GetPrivateLocalFilePath(path.Join(FILE_IDS_DIR_NAME, "paths", hex.EncodeToString(sum[:])))
+}
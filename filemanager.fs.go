@@ -0,0 +1,206 @@
+package filemanager
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"path/filepath"
+	"time"
+)
+
+// DirStorage is implemented by storages that can list directories. Without it, the fs.FS returned by
+// FileManager.FS can open files by name but not list or walk directories.
+type DirStorage interface {
+	Storage
+	// ReadDir returns the entries of the directory sorted by name, like os.ReadDir.
+	ReadDir(path string) ([]fs.DirEntry, error)
+}
+
+// FS returns the files of a storage type as an fs.FS, read through the FileManager's Storage, e.g. for
+// http.FileServer(http.FS(...)), fs.WalkDir or template.ParseFS. Names are relative to the storage type's base
+// path. Files are streamed from storages implementing OpenStorage and read into memory when opened otherwise.
+func (fm *FileManager) FS(storageType FileStorageType) fs.FS {
+	return &storageFS{storage: fm.GetStorage(), root: fm.GetLocalPathForFile(storageType, ""), fm: fm}
+}
+
+type storageFS struct {
+	storage Storage
+	root    string
+	fm      *FileManager // if set, refuses names escaping the root through symlinks
+}
+
+func (fsys *storageFS) path(op string, name string) (string, error) {
+	if !fs.ValidPath(name) {
+		return "", &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	path := filepath.Join(fsys.root, filepath.FromSlash(name))
+	if fsys.fm == nil {
+		return path, nil
+	}
+	if err := fsys.fm.checkContainedPath(path); err != nil {
+		return "", &fs.PathError{Op: op, Path: name, Err: ErrPathEscapesBase}
+	}
+	return path, nil
+}
+
+func (fsys *storageFS) Open(name string) (fs.File, error) {
+	info, err := fsys.Stat(name)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: errors.Unwrap(err)}
+	}
+	if info.IsDir() {
+		return &storageDir{fsys: fsys, name: name, info: info}, nil
+	}
+	if openStorage, ok := fsys.storage.(OpenStorage); ok {
+		path, err := fsys.path("open", name)
+		if err != nil {
+			return nil, err
+		}
+		reader, err := openStorage.Open(path)
+		if err != nil {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: unwrapPathError(err)}
+		}
+		return &streamedFile{ReadSeekCloser: reader, info: info}, nil
+	}
+	data, err := fsys.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	return &storageFile{Reader: bytes.NewReader(data), info: info}, nil
+}
+
+func (fsys *storageFS) ReadFile(name string) ([]byte, error) {
+	path, err := fsys.path("read", name)
+	if err != nil {
+		return nil, err
+	}
+	data, err := fsys.storage.ReadFile(path)
+	if err != nil {
+		return nil, &fs.PathError{Op: "read", Path: name, Err: unwrapPathError(err)}
+	}
+	return data, nil
+}
+
+func (fsys *storageFS) Stat(name string) (fs.FileInfo, error) {
+	path, err := fsys.path("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	info, err := fsys.storage.Stat(path)
+	if err != nil {
+		if name == "." && errors.Is(err, fs.ErrNotExist) {
+			// the base path of an empty storage type
+			return storageDirInfo{name: "."}, nil
+		}
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: unwrapPathError(err)}
+	}
+	return info, nil
+}
+
+func (fsys *storageFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	path, err := fsys.path("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+	dirStorage, ok := fsys.storage.(DirStorage)
+	if !ok {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: errors.ErrUnsupported}
+	}
+	entries, err := dirStorage.ReadDir(path)
+	if err != nil {
+		if name == "." && errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: unwrapPathError(err)}
+	}
+	return entries, nil
+}
+
+// unwrapPathError drops the storage path from errors, fs.FS errors must carry the name relative to the root.
+func unwrapPathError(err error) error {
+	var pathErr *fs.PathError
+	if errors.As(err, &pathErr) {
+		return pathErr.Err
+	}
+	return err
+}
+
+// storageFile implements fs.File, io.Seeker and io.ReaderAt, as needed by http.FileServer.
+type storageFile struct {
+	*bytes.Reader
+	info fs.FileInfo
+}
+
+func (f *storageFile) Stat() (fs.FileInfo, error) {
+	return f.info, nil
+}
+
+func (f *storageFile) Close() error {
+	return nil
+}
+
+// streamedFile implements fs.File and io.Seeker for files of storages implementing OpenStorage.
+type streamedFile struct {
+	io.ReadSeekCloser
+	info fs.FileInfo
+}
+
+func (f *streamedFile) Stat() (fs.FileInfo, error) {
+	return f.info, nil
+}
+
+type storageDir struct {
+	fsys    *storageFS
+	name    string
+	info    fs.FileInfo
+	entries []fs.DirEntry
+	read    bool
+}
+
+func (d *storageDir) Stat() (fs.FileInfo, error) {
+	return d.info, nil
+}
+
+func (d *storageDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.name, Err: errors.New("is a directory")}
+}
+
+func (d *storageDir) Close() error {
+	return nil
+}
+
+func (d *storageDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	if !d.read {
+		entries, err := d.fsys.ReadDir(d.name)
+		if err != nil {
+			return nil, err
+		}
+		d.entries = entries
+		d.read = true
+	}
+	if n <= 0 {
+		entries := d.entries
+		d.entries = nil
+		return entries, nil
+	}
+	if len(d.entries) == 0 {
+		return nil, io.EOF
+	}
+	n = min(n, len(d.entries))
+	entries := d.entries[:n]
+	d.entries = d.entries[n:]
+	return entries, nil
+}
+
+type storageDirInfo struct {
+	name    string
+	modTime time.Time
+}
+
+func (info storageDirInfo) Name() string       { return info.name }
+func (info storageDirInfo) Size() int64        { return 0 }
+func (info storageDirInfo) Mode() fs.FileMode  { return fs.ModeDir | 0755 }
+func (info storageDirInfo) ModTime() time.Time { return info.modTime }
+func (info storageDirInfo) IsDir() bool        { return true }
+func (info storageDirInfo) Sys() any           { return nil }
@@ -38,6 +38,7 @@
 package filemanager
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
@@ -45,12 +46,13 @@ import (
 	"net/url"
 	"os"
 	"path"
-	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/gabriel-vasile/mimetype"
-	"gopkg.in/yaml.v2"
 )
 
 const Version = "0.5.1"
@@ -75,52 +77,201 @@ type FileProcess struct {
 	ID                string
 	IncomingFileName  string
 	RecipeName        string
+	CorrelationID     string // set by the caller, see FileProcessOptions
+	Labels            map[string]string
 	ProcessingUpdates []ProcessingStatus
 	LatestStatus      *ProcessingStatus
+	mu                sync.Mutex
+	updated           chan struct{}
+	steps             *stepProgress
+	finished          bool
+	err               error
+	createdAt         time.Time
+	ctx               context.Context // cancelled by CancelProcess, see Context
+	cancel            context.CancelFunc
+	session           *UploadSession // set by NewUploadSession
 }
 
+// AddProcessingUpdate appends a status to the process. A status with Done is the terminal status of the process,
+// its Error the outcome reported by Err; updates added after it, e.g. by a plugin abandoned after a timeout, are
+// ignored.
 func (fp *FileProcess) AddProcessingUpdate(update ProcessingStatus) {
+	if update.Labels == nil && len(fp.Labels) > 0 {
+		update.Labels = copyLabels(fp.Labels)
+	}
+	if update.CorrelationID == "" {
+		update.CorrelationID = fp.CorrelationID
+	}
+	fp.mu.Lock()
+	if fp.finished {
+		fp.mu.Unlock()
+		return
+	}
+	if update.Done {
+		fp.finished = true
+		fp.err = update.Error
+	}
+	fp.steps.apply(&update)
+	update.Seq = len(fp.ProcessingUpdates) + 1
 	fp.ProcessingUpdates = append(fp.ProcessingUpdates, update)
 	fp.LatestStatus = &update
+	if fp.updated != nil {
+		close(fp.updated)
+		fp.updated = nil
+	}
+	fp.mu.Unlock()
 }
 
 func (fp *FileProcess) GetLatestProcessingStatus() *ProcessingStatus {
 	return fp.LatestStatus
 }
 
+// Finished reports whether the process has its terminal status.
+func (fp *FileProcess) Finished() bool {
+	fp.mu.Lock()
+	defer fp.mu.Unlock()
+	return fp.finished
+}
+
+// Err returns the error of the terminal status, nil while the process runs and after it succeeded. Errors wrap
+// the sentinel errors of their cause (ErrRecipeNotFound, ErrInvalidMimeType, ErrVirusFound, ...) for errors.Is.
+func (fp *FileProcess) Err() error {
+	fp.mu.Lock()
+	defer fp.mu.Unlock()
+	return fp.err
+}
+
+// NewFileProcess creates a FileProcess with a generated ID, see IDConfig for its format.
 func NewFileProcess(incomingFileName, recipeName string) *FileProcess {
-	id := NID(FILE_PROCESS_ID_PREFIX, FILE_PROCESS_ID_LENGTH)
 	return &FileProcess{
-		ID:               id,
+		ID:               newProcessID(),
 		IncomingFileName: incomingFileName,
 		RecipeName:       recipeName,
+		createdAt:        time.Now(),
+	}
+}
+
+// NewFileProcessWithLabels creates a FileProcess carrying caller-supplied labels (user ID, order ID, correlation ID, ...).
+// The labels are copied into every ProcessingStatus added to the process and appended to its log lines.
+func NewFileProcessWithLabels(incomingFileName, recipeName string, labels map[string]string) *FileProcess {
+	fp := NewFileProcess(incomingFileName, recipeName)
+	fp.Labels = copyLabels(labels)
+	return fp
+}
+
+// GetLabel returns the value of a label or an empty string if it is not set.
+func (fp *FileProcess) GetLabel(key string) string {
+	return fp.Labels[key]
+}
+
+// LogLabels renders the correlation ID and the labels as a stable " correlation(id) labels(k=v, ...)" suffix for
+// log lines. Empty if there are neither.
+func (fp *FileProcess) LogLabels() string {
+	if fp == nil {
+		return ""
+	}
+	correlation := ""
+	if fp.CorrelationID != "" {
+		correlation = " correlation(" + fp.CorrelationID + ")"
+	}
+	if len(fp.Labels) == 0 {
+		return correlation
+	}
+	keys := make([]string, 0, len(fp.Labels))
+	for key := range fp.Labels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	pairs := make([]string, 0, len(keys))
+	for _, key := range keys {
+		pairs = append(pairs, key+"="+fp.Labels[key])
+	}
+	return correlation + " labels(" + strings.Join(pairs, ", ") + ")"
+}
+
+func copyLabels(labels map[string]string) map[string]string {
+	if len(labels) == 0 {
+		return nil
 	}
+	copied := make(map[string]string, len(labels))
+	for key, value := range labels {
+		copied[key] = value
+	}
+	return copied
 }
 
 type LogAdapter func(logLevel string, logContent string)
 
 type FileManager struct {
-	publicLocalBasePath  string
-	privateLocalBasePath string
-	baseUrl              string
-	localTempPath        string
-	processingPlugins    map[string]ProcessingPlugin
-	recipes              map[string]Recipe
-	mu                   sync.RWMutex
-	logger               LogAdapter
+	publicLocalBasePath   string
+	privateLocalBasePath  string
+	baseUrl               string
+	localTempPath         string
+	processingPlugins     map[string]ProcessingPlugin
+	recipes               atomic.Pointer[recipeSnapshot] // replaced as a whole, never mutated
+	recipeRouting         *RecipeRouting
+	mu                    sync.RWMutex
+	logger                LogAdapter
+	processes             map[string]*FileProcess
+	processesMu           sync.RWMutex
+	processRetention      time.Duration
+	unprunedProcesses     int // registrations since the last prune, see PROCESS_PRUNE_INTERVAL
+	versioning            *VersioningOptions
+	trash                 *TrashOptions
+	metadataStore         MetadataStore
+	searchIndex           SearchIndex
+	imageHashes           imageHashRegistry
+	uploadCleanup         *UploadCleanupOptions
+	uploadTimeouts        *UploadTimeoutOptions
+	uploadAbortHook       UploadAbortFunc
+	uploadScan            *UploadScanOptions
+	uploads               map[string]struct{} // temp files of uploads returned by HandleFileUpload
+	uploadsMu             sync.Mutex
+	uploadSessions        map[string]*UploadSession   // unused sessions of NewUploadSession, guarded by uploadsMu
+	multipartUploads      map[string]*MultipartUpload // open uploads of NewMultipartUpload, guarded by uploadsMu
+	storage               Storage
+	storages              map[string]Storage // named storages of AddStorage, replaced as a whole
+	storageRouting        *StorageRouting
+	sharding              *ShardingOptions
+	fastTemp              *FastTempOptions
+	memoryMap             *MemoryMapOptions
+	mimeDetection         *MimeDetectionOptions
+	downloadLimiter       *RateLimiter
+	replication           *replicator
+	parent                *FileManager // set for tenant views, which share its plugins, recipes and settings
+	tenant                *tenantScope
+	tenants               map[string]*FileManager
+	tenantOptions         map[string]TenantOptions
+	tenantsMu             sync.Mutex
+	healthChecks          map[string]func(ctx context.Context) error
+	fileRoutes            *FileRoutesOptions
+	pluginLimits          map[string]*pluginLimit
+	pluginMiddleware      []PluginMiddleware // see UsePluginMiddleware
+	statusDeliveryTimeout time.Duration
+	recipeHooks           map[string]RecipeHookFunc
+	processStore          ProcessStore
+	priorityLanes         *priorityLaneSet
+	filePermissions       FilePermissions
+	symlinkTargets        []string // see AllowSymlinkTargets
+	stats                 *statsCollector
 }
 
 func emptyLogger(logLevel string, logContent string) {}
 
 func NewFileManager(publicLocalBasePath, privateLocalBasePath, baseUrl, tempPath string, logger LogAdapter) *FileManager {
 	fm := &FileManager{
-		publicLocalBasePath:  publicLocalBasePath,
-		privateLocalBasePath: privateLocalBasePath,
-		baseUrl:              baseUrl,
-		localTempPath:        tempPath,
-		processingPlugins:    make(map[string]ProcessingPlugin),
-		recipes:              make(map[string]Recipe),
+		publicLocalBasePath:   publicLocalBasePath,
+		privateLocalBasePath:  privateLocalBasePath,
+		baseUrl:               baseUrl,
+		localTempPath:         tempPath,
+		processingPlugins:     make(map[string]ProcessingPlugin),
+		processes:             make(map[string]*FileProcess),
+		processRetention:      DEFAULT_PROCESS_RETENTION,
+		statusDeliveryTimeout: DEFAULT_STATUS_DELIVERY_TIMEOUT,
+		storage:               LocalStorage{},
+		stats:                 newStatsCollector(),
 	}
+	fm.recipes.Store(&recipeSnapshot{recipes: make(map[string]Recipe)})
 
 	if logger == nil {
 		fm.logger = emptyLogger
@@ -136,38 +287,50 @@ func (fm *FileManager) AddProcessingPlugin(name string, plugin ProcessingPlugin)
 	fm.processingPlugins[name] = plugin
 }
 
+// LoadRecipes loads the recipes of a directory or of a remote recipe source (see NewRecipeSource), adding them to
+// the loaded recipes. Files that cannot be parsed are skipped.
 func (fm *FileManager) LoadRecipes(recipesDir string) error {
-	fm.mu.Lock()
-	defer fm.mu.Unlock()
-
 	fm.LogTo("DEBUG", fmt.Sprintf("[FileManager] ########============== Loading recipes from: (%s)\n", recipesDir))
-	files, err := os.ReadDir(recipesDir)
+	source, err := NewRecipeSource(recipesDir)
 	if err != nil {
 		return err
 	}
+	return fm.LoadRecipesFrom(context.Background(), source)
+}
 
-	for _, file := range files {
-		if file.IsDir() {
-			continue
-		}
+// loadRecipeFiles parses the recipe files and swaps them into the loaded recipes. Recipes named in previous that
+// are not in the files any more are removed. It returns the names of the loaded recipes.
+func (fm *FileManager) loadRecipeFiles(files []RecipeFile, previous map[string]bool) (map[string]bool, error) {
+	fm.mu.Lock()
+	defer fm.mu.Unlock()
 
-		if filepath.Ext(file.Name()) != ".yaml" {
+	recipes := fm.recipes.Load().copyRecipes()
+	for name := range previous {
+		delete(recipes, name)
+	}
+	loaded := make(map[string]bool, len(files))
+	// recipes of a newer schema version are skipped like broken files, but reported
+	var schemaErrs []error
+	for _, file := range files {
+		recipe, fromVersion, err := parseRecipe(file.Data)
+		if errors.Is(err, ErrRecipeSchemaVersion) {
+			fm.LogTo("INFO", fmt.Sprintf("[FileManager] Refusing recipe file(%s): %v\n", file.Name, err))
+			schemaErrs = append(schemaErrs, fmt.Errorf("recipe file(%s): %w", file.Name, err))
 			continue
 		}
-
-		filePath := filepath.Join(recipesDir, file.Name())
-		data, err := os.ReadFile(filePath)
 		if err != nil {
-			fm.LogTo("DEBUG", fmt.Sprintf("[FileManager] ########============== Error loading recipe: (%s)\n%v\n", file.Name(), err))
+			fm.LogTo("DEBUG", fmt.Sprintf("[FileManager] ########============== Error unmarshalling recipe: (%s)\n%v\n", file.Name, err))
 			continue
 		}
-
-		var recipe Recipe
-		err = yaml.Unmarshal(data, &recipe)
+		err = validateMimePatterns(recipe.AcceptedMimeTypes, recipe.StrictMimeTypes)
 		if err != nil {
-			fm.LogTo("DEBUG", fmt.Sprintf("[FileManager] ########============== Error unmarshalling recipe: (%s)\n%v\n", file.Name(), err))
+			fm.LogTo("INFO", fmt.Sprintf("[FileManager] Refusing recipe file(%s): %v\n", file.Name, err))
 			continue
 		}
+		if fromVersion < RECIPE_SCHEMA_VERSION {
+			fm.LogTo("INFO", fmt.Sprintf("[FileManager] Recipe file(%s) has schema version %d and was migrated to %d in memory, upgrade it with MigrateRecipeFile\n", file.Name, fromVersion, RECIPE_SCHEMA_VERSION))
+		}
+		recipe.SchemaVersion = RECIPE_SCHEMA_VERSION
 
 		// check if all the processing plugins in the recipe are loaded, warn if not
 		for _, step := range recipe.ProcessingSteps {
@@ -177,23 +340,33 @@ func (fm *FileManager) LoadRecipes(recipesDir string) error {
 			}
 		}
 
-		fm.recipes[recipe.Name] = recipe
+		recipes[recipe.Name] = recipe
+		loaded[recipe.Name] = true
 		fm.LogTo("DEBUG", fmt.Sprintf("[FileManager] ########============== Loaded recipe: (%s)\n%v\n", recipe.Name, recipe))
 	}
+	fm.recipes.Store(&recipeSnapshot{recipes: recipes})
 
-	return nil
+	return loaded, errors.Join(schemaErrs...)
 }
 
+// GetRecipe returns a deep copy of the named recipe, so callers may modify it freely.
 func (fm *FileManager) GetRecipe(name string) (Recipe, error) {
-	fm.mu.RLock()
-	defer fm.mu.RUnlock()
-	if _, ok := fm.recipes[name]; !ok {
+	recipe, ok := fm.root().recipes.Load().get(name)
+	if !ok {
 		return Recipe{}, ErrRecipeNotFound
 	}
-	return fm.recipes[name], nil
+	if err := fm.checkRecipeAllowed(name); err != nil {
+		return Recipe{}, err
+	}
+	return recipe.Clone(), nil
 }
 
+// GetLocalPathForFile returns the local path of a file name below the base path of the storage type, in its shard
+// directories if sharding is enabled (see EnableSharding). An empty file name returns the base path.
 func (aifm *FileManager) GetLocalPathForFile(target FileStorageType, filename string) string {
+	if filename != "" {
+		filename = aifm.shardPath(filename)
+	}
 	var localPath string
 	switch target {
 	case FileStorageTypePrivate:
@@ -212,6 +385,8 @@ func (aifm *FileManager) GetPublicUrlForFile(localFilePath string) (pubUrl strin
 		return pubUrl, ErrLocalFileNotFound
 	}
 	relativePath := strings.TrimPrefix(localFilePath, aifm.publicLocalBasePath)
+	// URLs keep the unsharded path
+	relativePath = aifm.unshardPath(relativePath)
 
 	pubUrl, err = joinURL(aifm.baseUrl, relativePath)
 	if err != nil {
@@ -239,7 +414,7 @@ func (aifm *FileManager) GetLocalPathOfUrl(url string) (localPath string, err er
 	}
 	// get the relative path and filename from the url and append it to the local base path
 	relativePath := strings.TrimPrefix(url, aifm.baseUrl)
-	localPath = path.Join(aifm.publicLocalBasePath, relativePath)
+	localPath = aifm.storedLocalPath(FileStorageTypePublic, relativePath)
 	// check if the file exists
 	if !FileExists(localPath) {
 		return localPath, ErrLocalFileNotFound
@@ -273,8 +448,17 @@ func GuessMimeType(filepath string) (string, error) {
 }
 
 func DownloadFileFromUrl(url string, localFilePath string) (err error) {
+	return downloadFile(context.Background(), url, localFilePath, nil)
+}
+
+// downloadFile downloads the url, reading the response body within the limits of all limiters.
+func downloadFile(ctx context.Context, url string, localFilePath string, limiters []*RateLimiter) (err error) {
 	// Download the file from url
-	response, err := http.Get(url)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	response, err := http.DefaultClient.Do(req)
 	if err != nil {
 		return err
 	}
@@ -284,7 +468,7 @@ func DownloadFileFromUrl(url string, localFilePath string) (err error) {
 		return err
 	}
 	defer file.Close()
-	_, err = io.Copy(file, response.Body)
+	_, err = io.Copy(file, NewThrottledReader(ctx, response.Body, limiters...))
 	if err != nil {
 		return err
 	}
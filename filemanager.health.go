@@ -0,0 +1,293 @@
+package filemanager
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrUnhealthy = errors.New("filemanager is unhealthy")
+)
+
+const (
+	HEALTH_STATUS_OK   = "ok"
+	HEALTH_STATUS_FAIL = "fail"
+	// DEFAULT_HEALTH_CHECK_TIMEOUT applies to HealthHandler requests; checks still running then are reported as failed.
+	DEFAULT_HEALTH_CHECK_TIMEOUT = 5 * time.Second
+)
+
+// HealthChecker is implemented by plugins, scanners, providers and storages that can verify they are usable, e.g.
+// that a remote service is reachable. HealthCheck runs it for the FileManager's storage, plugins, metadata store,
+// search index and replication secondary.
+type HealthChecker interface {
+	HealthCheck(ctx context.Context) error
+}
+
+// HealthCheckResult is the outcome of a single check.
+type HealthCheckResult struct {
+	Name     string        `json:"name"`
+	Status   string        `json:"status"` // "ok" or "fail"
+	Error    string        `json:"error,omitempty"`
+	Duration time.Duration `json:"durationNs"`
+}
+
+// HealthReport lists the results of all checks, sorted by name.
+type HealthReport struct {
+	Healthy bool                `json:"healthy"`
+	Checks  []HealthCheckResult `json:"checks"`
+}
+
+type healthCheck struct {
+	name  string
+	check func(ctx context.Context) error
+}
+
+// AddHealthCheck registers an additional check run by HealthCheck, e.g. for a database the application shares
+// with the FileManager. A check with the same name is replaced.
+func (fm *FileManager) AddHealthCheck(name string, check func(ctx context.Context) error) {
+	root := fm.root()
+	root.mu.Lock()
+	defer root.mu.Unlock()
+	if root.healthChecks == nil {
+		root.healthChecks = make(map[string]func(ctx context.Context) error)
+	}
+	root.healthChecks[name] = check
+}
+
+// HealthCheck verifies that files can be written to, read from and removed in the public, private and temp paths
+// of the storage, that plugins and other dependencies implementing HealthChecker are usable (e.g. clamd answers a
+// PING) and that all recipes only use registered plugins. Checks run concurrently; checks still running when the
+// context is done fail with its error. The error wraps ErrUnhealthy and names the failed checks.
+func (fm *FileManager) HealthCheck(ctx context.Context) (HealthReport, error) {
+	checks := fm.collectHealthChecks()
+	results := make([]HealthCheckResult, len(checks))
+	var wg sync.WaitGroup
+	for i, check := range checks {
+		wg.Add(1)
+		go func(i int, check healthCheck) {
+			defer wg.Done()
+			results[i] = runHealthCheck(ctx, check)
+		}(i, check)
+	}
+	wg.Wait()
+
+	report := HealthReport{Healthy: true, Checks: results}
+	sort.Slice(report.Checks, func(i, j int) bool {
+		return report.Checks[i].Name < report.Checks[j].Name
+	})
+	var failed []string
+	for _, result := range report.Checks {
+		if result.Status != HEALTH_STATUS_OK {
+			report.Healthy = false
+			failed = append(failed, fmt.Sprintf("%s: %s", result.Name, result.Error))
+		}
+	}
+	if !report.Healthy {
+		fm.LogTo("INFO", fmt.Sprintf("[FileManager.HealthCheck] %d of %d checks failed: %s\n", len(failed), len(report.Checks), strings.Join(failed, "; ")))
+		return report, fmt.Errorf("%w: %s", ErrUnhealthy, strings.Join(failed, "; "))
+	}
+	return report, nil
+}
+
+// runHealthCheck runs the check in its own goroutine, so checks that ignore the context cannot block the report.
+func runHealthCheck(ctx context.Context, check healthCheck) HealthCheckResult {
+	start := time.Now()
+	done := make(chan error, 1)
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				done <- fmt.Errorf("panic: %v", r)
+			}
+		}()
+		done <- check.check(ctx)
+	}()
+	var err error
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	result := HealthCheckResult{Name: check.name, Status: HEALTH_STATUS_OK, Duration: time.Since(start)}
+	if err != nil {
+		result.Status = HEALTH_STATUS_FAIL
+		result.Error = err.Error()
+	}
+	return result
+}
+
+func (fm *FileManager) collectHealthChecks() []healthCheck {
+	storage := fm.GetStorage()
+	checks := []healthCheck{}
+	for _, dir := range []struct {
+		name string
+		path string
+	}{
+		{"storage:public", fm.publicLocalBasePath},
+		{"storage:private", fm.privateLocalBasePath},
+		{"storage:temp", fm.localTempPath},
+	} {
+		dir := dir
+		checks = append(checks, healthCheck{dir.name, func(ctx context.Context) error {
+			return checkStorageWritable(storage, dir.path)
+		}})
+	}
+	if fastTempPath := fm.fastTempPath(); fastTempPath != "" {
+		checks = append(checks, healthCheck{"storage:fast_temp", func(ctx context.Context) error {
+			return checkStorageWritable(storage, fastTempPath)
+		}})
+	}
+	checks = appendHealthChecker(checks, "storage", storage)
+	checks = appendHealthChecker(checks, "metadata_store", fm.getMetadataStore())
+	checks = appendHealthChecker(checks, "search_index", fm.getSearchIndex())
+	if replication := fm.getReplicator(); replication != nil {
+		checks = appendHealthChecker(checks, "replication", replication.options.Secondary)
+	}
+
+	root := fm.root()
+	root.mu.RLock()
+	plugins := make(map[string]ProcessingPlugin, len(root.processingPlugins))
+	for name, plugin := range root.processingPlugins {
+		plugins[name] = plugin
+		checks = appendHealthChecker(checks, "plugin:"+name, plugin)
+	}
+	for name, check := range root.healthChecks {
+		checks = append(checks, healthCheck{name, check})
+	}
+	root.mu.RUnlock()
+
+	for name, recipe := range root.recipes.Load().recipes {
+		if fm.checkRecipeAllowed(name) != nil {
+			continue
+		}
+		recipe := recipe
+		checks = append(checks, healthCheck{"recipe:" + name, func(ctx context.Context) error {
+			return checkRecipePlugins(recipe, plugins)
+		}})
+	}
+	return checks
+}
+
+func appendHealthChecker(checks []healthCheck, name string, dependency any) []healthCheck {
+	checker, ok := dependency.(HealthChecker)
+	if !ok {
+		return checks
+	}
+	return append(checks, healthCheck{name, checker.HealthCheck})
+}
+
+// checkStorageWritable writes, reads back and removes a hidden probe file in the directory.
+func checkStorageWritable(storage Storage, dir string) error {
+	probePath := filepath.Join(dir, ".healthcheck-"+NID("", 12))
+	content := []byte("filemanager health check")
+	err := storage.WriteFile(probePath, content, 0600, true)
+	if err != nil {
+		return fmt.Errorf("%s is not writable: %v", dir, err)
+	}
+	read, err := storage.ReadFile(probePath)
+	removeErr := storage.Remove(probePath)
+	if err != nil {
+		return fmt.Errorf("%s is not readable: %v", dir, err)
+	}
+	if !bytes.Equal(read, content) {
+		return fmt.Errorf("%s returned different content than written", dir)
+	}
+	if removeErr != nil {
+		return fmt.Errorf("%s does not allow removing files: %v", dir, removeErr)
+	}
+	return nil
+}
+
+// checkRecipePlugins reports processing steps using plugins that are not registered.
+func checkRecipePlugins(recipe Recipe, plugins map[string]ProcessingPlugin) error {
+	var missing []string
+	for _, step := range recipe.ProcessingSteps {
+		if _, ok := plugins[step.PluginName]; !ok {
+			missing = append(missing, step.PluginName)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("%w: %s", ErrProcessingPluginNotFound, strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// HealthHandler serves the HealthCheck report as JSON for readiness probes, with status 200 if healthy and 503
+// otherwise. Checks time out after DEFAULT_HEALTH_CHECK_TIMEOUT or when the request is cancelled.
+func (fm *FileManager) HealthHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), DEFAULT_HEALTH_CHECK_TIMEOUT)
+		defer cancel()
+		report, _ := fm.HealthCheck(ctx)
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		if report.Healthy {
+			w.WriteHeader(http.StatusOK)
+		} else {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		if r.Method == http.MethodHead {
+			return
+		}
+		json.NewEncoder(w).Encode(report)
+	})
+}
+
+// HealthCheck pings clamd.
+func (s *ClamdScanner) HealthCheck(ctx context.Context) error {
+	return s.Ping()
+}
+
+// HealthCheck pings clamd.
+func (p *ClamAVPlugin) HealthCheck(ctx context.Context) error {
+	if p.scanner == nil {
+		return ErrVirusScannerUnset
+	}
+	return p.scanner.HealthCheck(ctx)
+}
+
+// HealthCheck checks all scanners implementing HealthChecker.
+func (p *VirusScanPlugin) HealthCheck(ctx context.Context) error {
+	var errs []error
+	for name, scanner := range p.Scanners {
+		if checker, ok := scanner.(HealthChecker); ok {
+			err := checker.HealthCheck(ctx)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", name, err))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// HealthCheck checks the provider if it implements HealthChecker.
+func (p *ModerationPlugin) HealthCheck(ctx context.Context) error {
+	if checker, ok := p.Provider.(HealthChecker); ok {
+		return checker.HealthCheck(ctx)
+	}
+	return nil
+}
+
+// HealthCheck checks the provider and sink if they implement HealthChecker.
+func (p *EmbeddingsPlugin) HealthCheck(ctx context.Context) error {
+	var errs []error
+	for _, dependency := range []any{p.Provider, p.Sink} {
+		if checker, ok := dependency.(HealthChecker); ok {
+			errs = append(errs, checker.HealthCheck(ctx))
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -1,12 +1,18 @@
 package filemanager
 
 import (
+	"bytes"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"mime/multipart"
+	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
 	"time"
 
 	gonanoid "github.com/matoous/go-nanoid/v2"
@@ -14,12 +20,12 @@ import (
 
 var (
 	ErrNilResponseBody = errors.New("response body is nil")
+	ErrFileExists      = errors.New("file already exists")
 )
 
-const idAlphabet string = "0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ-_"
-
+// NID returns a random ID of the length in the alphabet of the IDConfig, prefixed with prefix and "_" if set.
 func NID(prefix string, length int) (nid string) {
-	nid, err := gonanoid.Generate(idAlphabet, length)
+	nid, err := gonanoid.Generate(nidAlphabet(), length)
 	if err != nil {
 		nid = strconv.FormatInt(time.Now().UnixMicro(), 10)
 	}
@@ -42,7 +48,7 @@ func (fm *FileManager) CreateManagedFileFromPath(localPath string, targetStorage
 	}
 	fileSize = fileInfo.Size()
 
-	mimeType, err := GuessMimeType(localPath)
+	mimeType, err := fm.DetectFileMimeType(localPath)
 	if err != nil {
 		return nil, err
 	}
@@ -58,7 +64,7 @@ func (fm *FileManager) CreateManagedFileFromPath(localPath string, targetStorage
 	// Move file if not in the correct location
 	targetPath := fm.GetLocalPathForFile(targetStorageType, managedFile.FileName)
 	if localPath != targetPath {
-		err = os.Rename(localPath, targetPath)
+		err = fm.MoveFile(localPath, targetPath)
 		if err != nil {
 			return nil, err
 		}
@@ -97,7 +103,7 @@ func (fm *FileManager) CreateManagedFileFromFileHeader(fileHeader *multipart.Fil
 	}
 
 	fileSize := int64(fileHeader.Size)
-	mimeType, err := GuessMimeType(localFilePath)
+	mimeType, err := fm.DetectFileMimeType(localFilePath)
 	if err != nil {
 		return nil, err
 	}
@@ -129,7 +135,7 @@ func (fm *FileManager) CreateManagedFileFromResponseBody(filename string, respon
 		return nil, err
 	}
 
-	mimeType, err := GuessMimeType(localFilePath)
+	mimeType, err := fm.DetectFileMimeType(localFilePath)
 	if err != nil {
 		return nil, err
 	}
@@ -161,3 +167,146 @@ func getFilePathAndName(localBasePath string, filePathName string) (fullPath str
 
 	return fullPath, dirPath, pureFileName
 }
+
+// copyFile copies the file at src to dst, creating the destination directory with dirMode if needed.
+func copyFile(src string, dst string, dirMode os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	err = mkdirAllMode(filepath.Dir(dst), dirMode)
+	if err != nil {
+		return err
+	}
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// writeFileAtomic writes data to a temporary file next to path, syncs it and renames it into place, so readers
+// never see a partially written file and a crash leaves either the old or the new content. With noOverwrite the
+// file is linked into place instead, which fails with ErrFileExists if path already exists. Missing directories are
+// created with dirMode.
+func writeFileAtomic(path string, data []byte, perm os.FileMode, dirMode os.FileMode, noOverwrite bool) error {
+	dir := filepath.Dir(path)
+	err := mkdirAllMode(dir, dirMode)
+	if err != nil {
+		return err
+	}
+	if noOverwrite && FileExists(path) {
+		return fmt.Errorf("%w: %s", ErrFileExists, path)
+	}
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	tmpPath := tmp.Name()
+	defer os.Remove(tmpPath)
+
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	closeErr := tmp.Close()
+	if err != nil {
+		return err
+	}
+	if closeErr != nil {
+		return closeErr
+	}
+	err = os.Chmod(tmpPath, perm)
+	if err != nil {
+		return err
+	}
+
+	if noOverwrite {
+		err = os.Link(tmpPath, path)
+		if os.IsExist(err) {
+			return fmt.Errorf("%w: %s", ErrFileExists, path)
+		}
+	} else {
+		err = os.Rename(tmpPath, path)
+	}
+	if err != nil {
+		return err
+	}
+	syncDir(dir)
+	return nil
+}
+
+// syncDir persists a rename in the directory. Not all platforms support syncing directories, so errors are ignored.
+func syncDir(dir string) {
+	d, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	d.Sync()
+	d.Close()
+}
+
+// DEFAULT_HTTP_TIMEOUT is used by integrations (moderation, LLM, embedding providers, ...) without a custom http.Client.
+const DEFAULT_HTTP_TIMEOUT = 60 * time.Second
+
+func httpClientOrDefault(client *http.Client) *http.Client {
+	if client != nil {
+		return client
+	}
+	return &http.Client{Timeout: DEFAULT_HTTP_TIMEOUT}
+}
+
+// doJSONRequest sends the request and decodes a JSON response into result (may be nil). Non-2xx responses are
+// returned as errors including the beginning of the response body. Errors leave out the query and the userinfo of
+// the URL, which may hold credentials.
+func doJSONRequest(client *http.Client, req *http.Request, result any) error {
+	response, err := httpClientOrDefault(client).Do(req)
+	if err != nil {
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			urlErr.URL = redactedRequestURL(req.URL)
+		}
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		body, _ := io.ReadAll(io.LimitReader(response.Body, 1024))
+		return fmt.Errorf("%s %s failed with status %d: %s", req.Method, redactedRequestURL(req.URL), response.StatusCode, strings.TrimSpace(string(body)))
+	}
+	if result == nil {
+		return nil
+	}
+	return json.NewDecoder(response.Body).Decode(result)
+}
+
+// redactedRequestURL returns the URL without its query and with a masked password.
+func redactedRequestURL(u *url.URL) string {
+	redacted := *u
+	redacted.RawQuery = ""
+	redacted.ForceQuery = false
+	return redacted.Redacted()
+}
+
+// postJSON encodes body as JSON, posts it to the url with the given headers and decodes the JSON response into result.
+func postJSON(client *http.Client, url string, headers map[string]string, body any, result any) error {
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	return doJSONRequest(client, req, result)
+}
@@ -0,0 +1,251 @@
+package filemanager
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/gabriel-vasile/mimetype"
+)
+
+// HTTP_HEADERS_SIDECAR_SUFFIX is appended to a file path to form the path of the sidecar holding its HTTP headers,
+// for storages that cannot keep them as object metadata.
+const HTTP_HEADERS_SIDECAR_SUFFIX = ".headers.json"
+
+// HTTPHeaders are caching and content headers to send with a stored file. Recipes declare them for all outputs,
+// output formats for their own files (overriding the recipe field by field).
+type HTTPHeaders struct {
+	CacheControl string `yaml:"cache_control" json:"cacheControl,omitempty"` // e.g. "public, max-age=31536000, immutable"
+	// ContentDisposition is "inline" or "attachment"; the file name is added unless the value has parameters.
+	ContentDisposition string `yaml:"content_disposition" json:"contentDisposition,omitempty"`
+	ContentType        string `yaml:"content_type" json:"contentType,omitempty"` // overrides the detected MIME type
+	Charset            string `yaml:"charset" json:"charset,omitempty"`          // e.g. "utf-8", added to the content type
+}
+
+// HTTPHeaderStorage is implemented by storages that keep HTTP headers as object metadata, e.g. object storage
+// backends setting Cache-Control on the object. Other storages get a sidecar file next to the file.
+type HTTPHeaderStorage interface {
+	Storage
+	SetHTTPHeaders(path string, headers HTTPHeaders) error
+	// GetHTTPHeaders returns empty headers if none are set.
+	GetHTTPHeaders(path string) (HTTPHeaders, error)
+}
+
+// merge returns a copy of the headers with the non-empty fields of override applied, nil if both are nil.
+func (h *HTTPHeaders) merge(override *HTTPHeaders) *HTTPHeaders {
+	if h == nil && override == nil {
+		return nil
+	}
+	var merged HTTPHeaders
+	if h != nil {
+		merged = *h
+	}
+	if override != nil {
+		if override.CacheControl != "" {
+			merged.CacheControl = override.CacheControl
+		}
+		if override.ContentDisposition != "" {
+			merged.ContentDisposition = override.ContentDisposition
+		}
+		if override.ContentType != "" {
+			merged.ContentType = override.ContentType
+		}
+		if override.Charset != "" {
+			merged.Charset = override.Charset
+		}
+	}
+	return &merged
+}
+
+func (h *HTTPHeaders) clone() *HTTPHeaders {
+	if h == nil {
+		return nil
+	}
+	cloned := *h
+	return &cloned
+}
+
+// ContentTypeFor returns the Content-Type for a file of the MIME type: ContentType if set, with Charset applied.
+func (h HTTPHeaders) ContentTypeFor(mimeType string) string {
+	if h.ContentType != "" {
+		mimeType = h.ContentType
+	}
+	if h.Charset == "" || mimeType == "" {
+		return mimeType
+	}
+	mediaType, params, err := mime.ParseMediaType(mimeType)
+	if err != nil {
+		return mimeType
+	}
+	params["charset"] = h.Charset
+	return mime.FormatMediaType(mediaType, params)
+}
+
+// ContentDispositionFor returns the Content-Disposition for the file name, "" if none is declared.
+func (h HTTPHeaders) ContentDispositionFor(fileName string) string {
+	if h.ContentDisposition == "" || strings.Contains(h.ContentDisposition, ";") {
+		return h.ContentDisposition
+	}
+	disposition := mime.FormatMediaType(h.ContentDisposition, map[string]string{"filename": fileName})
+	if disposition == "" {
+		return h.ContentDisposition
+	}
+	return disposition
+}
+
+// Apply sets the declared headers for a file with the name and MIME type on the response headers.
+func (h HTTPHeaders) Apply(header http.Header, fileName string, mimeType string) {
+	if h.CacheControl != "" {
+		header.Set("Cache-Control", h.CacheControl)
+	}
+	if disposition := h.ContentDispositionFor(fileName); disposition != "" {
+		header.Set("Content-Disposition", disposition)
+	}
+	if contentType := h.ContentTypeFor(mimeType); contentType != "" {
+		header.Set("Content-Type", contentType)
+	}
+}
+
+// SetHTTPHeaders stores the headers of the file, as object metadata if the Storage supports it, otherwise in a
+// sidecar file.
+func (fm *FileManager) SetHTTPHeaders(localFilePath string, headers HTTPHeaders) error {
+	storage := fm.storageFor(localFilePath)
+	if headerStorage, ok := storage.(HTTPHeaderStorage); ok {
+		return headerStorage.SetHTTPHeaders(localFilePath, headers)
+	}
+	data, err := json.Marshal(headers)
+	if err != nil {
+		return err
+	}
+	err = storage.WriteFile(localFilePath+HTTP_HEADERS_SIDECAR_SUFFIX, data, 0644, false)
+	if err != nil {
+		return err
+	}
+	fm.replicate(localFilePath+HTTP_HEADERS_SIDECAR_SUFFIX, false)
+	return nil
+}
+
+// GetHTTPHeaders returns the stored headers of the file, empty headers if none are stored.
+func (fm *FileManager) GetHTTPHeaders(localFilePath string) (HTTPHeaders, error) {
+	storage := fm.storageFor(localFilePath)
+	if headerStorage, ok := storage.(HTTPHeaderStorage); ok {
+		return headerStorage.GetHTTPHeaders(localFilePath)
+	}
+	var headers HTTPHeaders
+	data, err := storage.ReadFile(localFilePath + HTTP_HEADERS_SIDECAR_SUFFIX)
+	if errors.Is(err, fs.ErrNotExist) {
+		return headers, nil
+	}
+	if err != nil {
+		return headers, err
+	}
+	err = json.Unmarshal(data, &headers)
+	return headers, err
+}
+
+// removeHTTPHeaders deletes the sidecar of a deleted file; object metadata goes with the object.
+func (fm *FileManager) removeHTTPHeaders(localFilePath string) {
+	storage := fm.storageFor(localFilePath)
+	if _, ok := storage.(HTTPHeaderStorage); ok {
+		return
+	}
+	err := storage.Remove(localFilePath + HTTP_HEADERS_SIDECAR_SUFFIX)
+	if err == nil {
+		fm.replicate(localFilePath+HTTP_HEADERS_SIDECAR_SUFFIX, true)
+	}
+}
+
+// FileServer serves the files of a storage type with their stored HTTP headers, supporting range and conditional
+// requests. Compressed variants stored by PreCompressFile are served with their Content-Encoding to clients
+// accepting it. Directories, hidden paths (.trash, .versions) and header sidecars are not served. Mount it with
+// http.StripPrefix if the URL path has a prefix.
+func (fm *FileManager) FileServer(storageType FileStorageType) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		name := strings.TrimPrefix(path.Clean("/"+r.URL.Path), "/")
+		fsys := fm.FS(storageType).(*storageFS)
+		// URLs name files by their unsharded paths
+		if sharded := fm.shardPath(name); sharded != name && isServableName(name) {
+			if _, err := fsys.Stat(sharded); err == nil {
+				name = sharded
+			}
+		}
+		fm.serveFile(w, r, fsys, name)
+	})
+}
+
+// serveFile serves the file with the name relative to the root of the storage FS.
+func (fm *FileManager) serveFile(w http.ResponseWriter, r *http.Request, fsys *storageFS, name string) {
+	if !isServableName(name) {
+		http.NotFound(w, r)
+		return
+	}
+	info, err := fsys.Stat(name)
+	if err != nil || info.IsDir() {
+		http.NotFound(w, r)
+		return
+	}
+	localFilePath := filepath.Join(fsys.root, filepath.FromSlash(name))
+	headers, err := fm.GetHTTPHeaders(localFilePath)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	file, err := fsys.Open(name)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer file.Close()
+	content := file.(io.ReadSeeker)
+	headers.Apply(w.Header(), path.Base(name), detectServedMimeType(name, content))
+
+	variant, encoding, hasVariants := preCompressedVariant(fsys, name, r.Header.Get("Accept-Encoding"))
+	if hasVariants {
+		w.Header().Add("Vary", "Accept-Encoding")
+	}
+	if variant != "" {
+		variantFile, err := fsys.Open(variant)
+		if err == nil {
+			defer variantFile.Close()
+			content = variantFile.(io.ReadSeeker)
+			w.Header().Set("Content-Encoding", encoding)
+		}
+	}
+	http.ServeContent(w, r, path.Base(name), info.ModTime(), content)
+}
+
+func isServableName(name string) bool {
+	if name == "" || name == "." || strings.HasSuffix(name, HTTP_HEADERS_SIDECAR_SUFFIX) {
+		return false
+	}
+	for _, segment := range strings.Split(name, "/") {
+		if strings.HasPrefix(segment, ".") {
+			return false
+		}
+	}
+	return true
+}
+
+// detectServedMimeType uses the extension, sniffing the content for unknown extensions.
+func detectServedMimeType(name string, content io.ReadSeeker) string {
+	if mimeType := mime.TypeByExtension(path.Ext(name)); mimeType != "" {
+		return mimeType
+	}
+	detected, err := mimetype.DetectReader(content)
+	content.Seek(0, io.SeekStart)
+	if err != nil {
+		return "application/octet-stream"
+	}
+	return detected.String()
+}
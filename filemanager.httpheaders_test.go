@@ -0,0 +1,38 @@
+package filemanager_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	filemanager "github.com/itsatony/go-filemanager"
+	"github.com/itsatony/go-filemanager/filemanagertest"
+)
+
+func TestFileServerRangeRequests(t *testing.T) {
+	for name, storage := range map[string]filemanager.Storage{
+		"local":  filemanager.LocalStorage{},
+		"memory": filemanager.NewMemoryStorage(),
+	} {
+		t.Run(name, func(t *testing.T) {
+			tfm := filemanagertest.NewTestFileManager(t)
+			tfm.SetStorage(storage)
+			err := tfm.SaveFile(&filemanager.ManagedFile{
+				FileName:      "hello.txt",
+				LocalFilePath: tfm.GetLocalPathForFile(filemanager.FileStorageTypePublic, "hello.txt"),
+				Content:       []byte("hello world"),
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			request := httptest.NewRequest(http.MethodGet, "/hello.txt", nil)
+			request.Header.Set("Range", "bytes=6-10")
+			recorder := httptest.NewRecorder()
+			tfm.FileServer(filemanager.FileStorageTypePublic).ServeHTTP(recorder, request)
+			if recorder.Code != http.StatusPartialContent || recorder.Body.String() != "world" {
+				t.Fatalf("GET bytes=6-10 = %d %q, want 206 %q", recorder.Code, recorder.Body.String(), "world")
+			}
+		})
+	}
+}
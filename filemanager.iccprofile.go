@@ -0,0 +1,448 @@
+package filemanager
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"io"
+	"math"
+	"strings"
+	"unicode/utf16"
+)
+
+var (
+	ErrUnsupportedICCProfile = errors.New("unsupported ICC profile")
+)
+
+// Values of the color_profile param of the ImageManipulationPlugin.
+const (
+	COLOR_PROFILE_PRESERVE = "preserve" // default: embed the source profile in the output
+	COLOR_PROFILE_SRGB     = "srgb"     // convert the pixels to sRGB and drop the profile
+	COLOR_PROFILE_STRIP    = "strip"    // drop the profile without converting
+)
+
+const (
+	iccJPEGMarker     = "ICC_PROFILE\x00"
+	iccJPEGChunkLimit = 65519 // segment payload limit minus marker and sequence bytes
+	iccHeaderSize     = 128
+)
+
+// ExtractICCProfile returns the ICC profile embedded in a JPEG (APP2 segments), PNG (iCCP chunk) or WebP (ICCP
+// chunk) image, nil if there is none.
+func ExtractICCProfile(content []byte) []byte {
+	switch {
+	case len(content) > 4 && content[0] == 0xFF && content[1] == 0xD8:
+		return extractJPEGICCProfile(content)
+	case bytes.HasPrefix(content, []byte("\x89PNG\r\n\x1a\n")):
+		return extractPNGICCProfile(content)
+	case len(content) > 12 && string(content[0:4]) == "RIFF" && string(content[8:12]) == "WEBP":
+		return extractWebPICCProfile(content)
+	}
+	return nil
+}
+
+func extractJPEGICCProfile(content []byte) []byte {
+	chunks := map[int][]byte{}
+	total := 0
+	for pos := 2; pos+4 <= len(content); {
+		if content[pos] != 0xFF {
+			return nil
+		}
+		marker := content[pos+1]
+		if marker == 0xD8 || marker >= 0xD0 && marker <= 0xD7 || marker == 0x01 || marker == 0xFF {
+			pos++
+			continue
+		}
+		if marker == 0xDA || marker == 0xD9 {
+			break // image data starts, ICC segments come before
+		}
+		length := int(binary.BigEndian.Uint16(content[pos+2:]))
+		if length < 2 || pos+2+length > len(content) {
+			return nil
+		}
+		segment := content[pos+4 : pos+2+length]
+		if marker == 0xE2 && len(segment) > len(iccJPEGMarker)+2 && string(segment[:len(iccJPEGMarker)]) == iccJPEGMarker {
+			seq, count := int(segment[len(iccJPEGMarker)]), int(segment[len(iccJPEGMarker)+1])
+			chunks[seq] = segment[len(iccJPEGMarker)+2:]
+			total = count
+		}
+		pos += 2 + length
+	}
+	if total == 0 || len(chunks) != total {
+		return nil
+	}
+	var profile []byte
+	for seq := 1; seq <= total; seq++ {
+		chunk, ok := chunks[seq]
+		if !ok {
+			return nil
+		}
+		profile = append(profile, chunk...)
+	}
+	return profile
+}
+
+func extractPNGICCProfile(content []byte) []byte {
+	for pos := 8; pos+8 <= len(content); {
+		length := int(binary.BigEndian.Uint32(content[pos:]))
+		chunkType := string(content[pos+4 : pos+8])
+		if length < 0 || pos+12+length > len(content) || chunkType == "IDAT" {
+			return nil
+		}
+		if chunkType == "iCCP" {
+			data := content[pos+8 : pos+8+length]
+			nameEnd := bytes.IndexByte(data, 0)
+			if nameEnd < 0 || nameEnd+2 > len(data) {
+				return nil
+			}
+			reader, err := zlib.NewReader(bytes.NewReader(data[nameEnd+2:]))
+			if err != nil {
+				return nil
+			}
+			profile, err := io.ReadAll(reader)
+			if err != nil {
+				return nil
+			}
+			return profile
+		}
+		pos += 12 + length
+	}
+	return nil
+}
+
+func extractWebPICCProfile(content []byte) []byte {
+	for pos := 12; pos+8 <= len(content); {
+		size := int(binary.LittleEndian.Uint32(content[pos+4:]))
+		if pos+8+size > len(content) {
+			return nil
+		}
+		if string(content[pos:pos+4]) == "ICCP" {
+			return content[pos+8 : pos+8+size]
+		}
+		pos += 8 + size + size%2
+	}
+	return nil
+}
+
+// EmbedICCProfile returns the JPEG or PNG image with the profile embedded, replacing an existing one. Other
+// formats are returned unchanged.
+func EmbedICCProfile(content []byte, profile []byte) ([]byte, error) {
+	if len(profile) == 0 {
+		return content, nil
+	}
+	switch {
+	case len(content) > 4 && content[0] == 0xFF && content[1] == 0xD8:
+		return embedJPEGICCProfile(content, profile)
+	case bytes.HasPrefix(content, []byte("\x89PNG\r\n\x1a\n")):
+		return embedPNGICCProfile(content, profile)
+	}
+	return content, nil
+}
+
+func embedJPEGICCProfile(content []byte, profile []byte) ([]byte, error) {
+	count := (len(profile) + iccJPEGChunkLimit - 1) / iccJPEGChunkLimit
+	if count > 255 {
+		return nil, fmt.Errorf("%w: profile of %d bytes is too large for JPEG", ErrUnsupportedICCProfile, len(profile))
+	}
+	// insert after SOI and a JFIF/EXIF APP0/APP1 segment, dropping existing ICC segments
+	var out bytes.Buffer
+	out.Write(content[:2])
+	pos := 2
+	for pos+4 <= len(content) && content[pos] == 0xFF && (content[pos+1] == 0xE0 || content[pos+1] == 0xE1) {
+		length := int(binary.BigEndian.Uint16(content[pos+2:]))
+		out.Write(content[pos : pos+2+length])
+		pos += 2 + length
+	}
+	for seq := 1; seq <= count; seq++ {
+		chunk := profile[(seq-1)*iccJPEGChunkLimit : min(seq*iccJPEGChunkLimit, len(profile))]
+		out.Write([]byte{0xFF, 0xE2})
+		binary.Write(&out, binary.BigEndian, uint16(2+len(iccJPEGMarker)+2+len(chunk)))
+		out.WriteString(iccJPEGMarker)
+		out.Write([]byte{byte(seq), byte(count)})
+		out.Write(chunk)
+	}
+	for pos+4 <= len(content) && content[pos] == 0xFF && content[pos+1] != 0xDA {
+		length := int(binary.BigEndian.Uint16(content[pos+2:]))
+		segment := content[pos : pos+2+length]
+		if !(content[pos+1] == 0xE2 && bytes.HasPrefix(segment[4:], []byte(iccJPEGMarker))) {
+			out.Write(segment)
+		}
+		pos += 2 + length
+	}
+	out.Write(content[pos:])
+	return out.Bytes(), nil
+}
+
+func embedPNGICCProfile(content []byte, profile []byte) ([]byte, error) {
+	var compressed bytes.Buffer
+	writer := zlib.NewWriter(&compressed)
+	writer.Write(profile)
+	err := writer.Close()
+	if err != nil {
+		return nil, err
+	}
+	data := append([]byte("ICC profile\x00\x00"), compressed.Bytes()...)
+	chunk := make([]byte, 0, 12+len(data))
+	chunk = binary.BigEndian.AppendUint32(chunk, uint32(len(data)))
+	chunk = append(chunk, "iCCP"...)
+	chunk = append(chunk, data...)
+	chunk = binary.BigEndian.AppendUint32(chunk, crc32.ChecksumIEEE(chunk[4:]))
+
+	var out bytes.Buffer
+	out.Write(content[:8])
+	for pos := 8; pos+8 <= len(content); {
+		length := int(binary.BigEndian.Uint32(content[pos:]))
+		chunkType := string(content[pos+4 : pos+8])
+		end := pos + 12 + length
+		if end > len(content) {
+			return nil, errors.New("invalid PNG chunk")
+		}
+		// an iCCP chunk replaces sRGB and gAMA/cHRM
+		if chunkType != "iCCP" && chunkType != "sRGB" {
+			out.Write(content[pos:end])
+		}
+		if chunkType == "IHDR" {
+			out.Write(chunk)
+		}
+		pos = end
+	}
+	return out.Bytes(), nil
+}
+
+// ICCProfileDescription returns the description of the profile, e.g. "Display P3" or "sRGB IEC61966-2.1".
+func ICCProfileDescription(profile []byte) string {
+	data, ok := iccTag(profile, "desc")
+	if !ok || len(data) < 12 {
+		return ""
+	}
+	switch string(data[:4]) {
+	case "desc":
+		length := int(binary.BigEndian.Uint32(data[8:]))
+		if 12+length > len(data) {
+			return ""
+		}
+		return strings.TrimRight(string(data[12:12+length]), "\x00")
+	case "mluc":
+		if len(data) < 28 {
+			return ""
+		}
+		length := int(binary.BigEndian.Uint32(data[20:]))
+		offset := int(binary.BigEndian.Uint32(data[24:]))
+		if offset+length > len(data) {
+			return ""
+		}
+		units := make([]uint16, length/2)
+		for i := range units {
+			units[i] = binary.BigEndian.Uint16(data[offset+2*i:])
+		}
+		return strings.TrimRight(string(utf16.Decode(units)), "\x00")
+	}
+	return ""
+}
+
+func isSRGBProfile(profile []byte) bool {
+	return strings.Contains(strings.ToLower(ICCProfileDescription(profile)), "srgb")
+}
+
+// iccTag returns the data of a tag from the profile's tag table.
+func iccTag(profile []byte, signature string) ([]byte, bool) {
+	if len(profile) < iccHeaderSize+4 {
+		return nil, false
+	}
+	count := int(binary.BigEndian.Uint32(profile[iccHeaderSize:]))
+	for i := 0; i < count; i++ {
+		entry := iccHeaderSize + 4 + 12*i
+		if entry+12 > len(profile) {
+			return nil, false
+		}
+		if string(profile[entry:entry+4]) != signature {
+			continue
+		}
+		offset := int(binary.BigEndian.Uint32(profile[entry+4:]))
+		size := int(binary.BigEndian.Uint32(profile[entry+8:]))
+		if offset < 0 || size < 0 || offset+size > len(profile) {
+			return nil, false
+		}
+		return profile[offset : offset+size], true
+	}
+	return nil, false
+}
+
+// ConvertToSRGB converts the pixels of an image with the RGB matrix/TRC profile (e.g. Display P3, Adobe RGB) to
+// sRGB. Other profiles (LUT based, CMYK, gray) fail with ErrUnsupportedICCProfile.
+func ConvertToSRGB(img image.Image, profile []byte) (image.Image, error) {
+	if len(profile) < iccHeaderSize || string(profile[16:20]) != "RGB " {
+		return nil, fmt.Errorf("%w: not an RGB profile", ErrUnsupportedICCProfile)
+	}
+	var curves [3][256]float64
+	var matrix [3][3]float64
+	for channel, prefix := range []string{"r", "g", "b"} {
+		curve, err := parseICCCurve(profile, prefix+"TRC")
+		if err != nil {
+			return nil, err
+		}
+		for i := range curves[channel] {
+			curves[channel][i] = curve(float64(i) / 255)
+		}
+		xyz, ok := iccTag(profile, prefix+"XYZ")
+		if !ok || len(xyz) < 20 || string(xyz[:4]) != "XYZ " {
+			return nil, fmt.Errorf("%w: missing %sXYZ tag", ErrUnsupportedICCProfile, prefix)
+		}
+		for row := 0; row < 3; row++ {
+			matrix[row][channel] = s15Fixed16(xyz[8+4*row:])
+		}
+	}
+	// XYZ (D50, the profile connection space) to linear sRGB, Bradford adapted
+	xyzToSRGB := [3][3]float64{
+		{3.1338561, -1.6168667, -0.4906146},
+		{-0.9787684, 1.9161415, 0.0334540},
+		{0.0719453, -0.2289914, 1.4052427},
+	}
+	var combined [3][3]float64
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 3; j++ {
+			for k := 0; k < 3; k++ {
+				combined[i][j] += xyzToSRGB[i][k] * matrix[k][j]
+			}
+		}
+	}
+	var encode [4096]uint8
+	for i := range encode {
+		encode[i] = uint8(math.Round(255 * srgbEncode(float64(i)/4095)))
+	}
+	bounds := img.Bounds()
+	converted := image.NewNRGBA(bounds)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			c := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+			linear := [3]float64{curves[0][c.R], curves[1][c.G], curves[2][c.B]}
+			var out [3]uint8
+			for i := 0; i < 3; i++ {
+				v := combined[i][0]*linear[0] + combined[i][1]*linear[1] + combined[i][2]*linear[2]
+				v = math.Max(0, math.Min(1, v))
+				out[i] = encode[int(v*4095+0.5)]
+			}
+			converted.SetNRGBA(x, y, color.NRGBA{R: out[0], G: out[1], B: out[2], A: c.A})
+		}
+	}
+	return converted, nil
+}
+
+func s15Fixed16(data []byte) float64 {
+	return float64(int32(binary.BigEndian.Uint32(data))) / 65536
+}
+
+// parseICCCurve returns the tone curve of a curv or para tag, mapping encoded to linear values in [0, 1].
+func parseICCCurve(profile []byte, signature string) (func(float64) float64, error) {
+	data, ok := iccTag(profile, signature)
+	if !ok || len(data) < 12 {
+		return nil, fmt.Errorf("%w: missing %s tag", ErrUnsupportedICCProfile, signature)
+	}
+	switch string(data[:4]) {
+	case "curv":
+		count := int(binary.BigEndian.Uint32(data[8:]))
+		switch {
+		case count == 0:
+			return func(x float64) float64 { return x }, nil
+		case count == 1 && len(data) >= 14:
+			gamma := float64(binary.BigEndian.Uint16(data[12:])) / 256
+			return func(x float64) float64 { return math.Pow(x, gamma) }, nil
+		case len(data) >= 12+2*count:
+			table := make([]float64, count)
+			for i := range table {
+				table[i] = float64(binary.BigEndian.Uint16(data[12+2*i:])) / 65535
+			}
+			return func(x float64) float64 {
+				position := x * float64(count-1)
+				i := int(position)
+				if i >= count-1 {
+					return table[count-1]
+				}
+				return table[i] + (table[i+1]-table[i])*(position-float64(i))
+			}, nil
+		}
+	case "para":
+		functionType := int(binary.BigEndian.Uint16(data[8:]))
+		paramCounts := []int{1, 3, 4, 5, 7}
+		if functionType >= len(paramCounts) || len(data) < 12+4*paramCounts[functionType] {
+			break
+		}
+		var p [7]float64
+		for i := 0; i < paramCounts[functionType]; i++ {
+			p[i] = s15Fixed16(data[12+4*i:])
+		}
+		g, a, b, c, d, e, f := p[0], p[1], p[2], p[3], p[4], p[5], p[6]
+		return func(x float64) float64 {
+			switch functionType {
+			case 0:
+				return math.Pow(x, g)
+			case 1:
+				if x >= -b/a {
+					return math.Pow(a*x+b, g)
+				}
+				return 0
+			case 2:
+				if x >= -b/a {
+					return math.Pow(a*x+b, g) + c
+				}
+				return c
+			case 3:
+				if x >= d {
+					return math.Pow(a*x+b, g)
+				}
+				return c * x
+			default:
+				if x >= d {
+					return math.Pow(a*x+b, g) + e
+				}
+				return c*x + f
+			}
+		}, nil
+	}
+	return nil, fmt.Errorf("%w: unsupported %s curve", ErrUnsupportedICCProfile, signature)
+}
+
+func srgbEncode(linear float64) float64 {
+	if linear <= 0.0031308 {
+		return 12.92 * linear
+	}
+	return 1.055*math.Pow(linear, 1/2.4) - 0.055
+}
+
+// applyColorProfile handles the color_profile param (preserve, srgb or strip) for an image decoded with the profile
+// and records the profile in the file's MetaData. It returns the image to encode and the profile to embed.
+func applyColorProfile(file *ManagedFile, img image.Image, profile []byte) (image.Image, []byte, error) {
+	if len(profile) == 0 {
+		return img, nil, nil
+	}
+	mode := COLOR_PROFILE_PRESERVE
+	if val, ok := file.MetaData["color_profile"]; ok {
+		mode, ok = val.(string)
+		if !ok {
+			return nil, nil, invalidParamError("color_profile", val)
+		}
+	}
+	file.SetMetaData("icc_profile", ICCProfileDescription(profile))
+	switch mode {
+	case COLOR_PROFILE_PRESERVE:
+		return img, profile, nil
+	case COLOR_PROFILE_STRIP:
+		return img, nil, nil
+	case COLOR_PROFILE_SRGB:
+		if isSRGBProfile(profile) {
+			return img, nil, nil
+		}
+		converted, err := ConvertToSRGB(img, profile)
+		if err != nil {
+			return nil, nil, err
+		}
+		file.SetMetaData("icc_profile_converted", "sRGB")
+		return converted, nil, nil
+	}
+	return nil, nil, invalidParamError("color_profile", mode)
+}
@@ -0,0 +1,118 @@
+package filemanager
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sync"
+)
+
+var (
+	ErrInvalidProcessID = errors.New("invalid process ID")
+	ErrInvalidIDConfig  = errors.New("invalid ID config")
+)
+
+// DEFAULT_ID_ALPHABET is the alphabet of the generated NIDs, URL and file name safe.
+const DEFAULT_ID_ALPHABET = "0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ-_"
+
+// processIDRegex restricts caller supplied process IDs to characters safe in file names and URLs, as they end up
+// in target file names through {metadata.process_id}.
+var processIDRegex = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._:-]{0,127}$`)
+
+// IDConfig configures the IDs generated by the package. Zero values keep the defaults.
+type IDConfig struct {
+	// Alphabet of the NIDs (process, file route and trash IDs), 2 to 255 distinct characters. Keep it URL and file
+	// name safe.
+	Alphabet string
+	// ProcessIDPrefix and ProcessIDLength shape generated process IDs, FILE_PROCESS_ID_PREFIX and
+	// FILE_PROCESS_ID_LENGTH by default.
+	ProcessIDPrefix string
+	ProcessIDLength int
+	// ProcessIDGenerator replaces the NIDs of processes, e.g. with UUIDs or the request IDs of the caller's system.
+	// It must return unique IDs matching the rules of NewFileProcessWithOptions.
+	ProcessIDGenerator func() string
+}
+
+var (
+	idConfigMu sync.RWMutex
+	idConfig   IDConfig
+)
+
+// SetIDConfig replaces the ID configuration of the package, for all FileManagers. Set it at startup, IDs generated
+// before keep their format.
+func SetIDConfig(config IDConfig) error {
+	if config.Alphabet != "" {
+		seen := map[rune]bool{}
+		for _, r := range config.Alphabet {
+			if seen[r] {
+				return fmt.Errorf("%w: duplicate character %q in alphabet", ErrInvalidIDConfig, r)
+			}
+			seen[r] = true
+		}
+		if len(seen) < 2 || len(seen) > 255 {
+			return fmt.Errorf("%w: alphabet needs 2 to 255 characters", ErrInvalidIDConfig)
+		}
+	}
+	if config.ProcessIDLength < 0 {
+		return fmt.Errorf("%w: negative process ID length", ErrInvalidIDConfig)
+	}
+	idConfigMu.Lock()
+	defer idConfigMu.Unlock()
+	idConfig = config
+	return nil
+}
+
+func getIDConfig() IDConfig {
+	idConfigMu.RLock()
+	defer idConfigMu.RUnlock()
+	return idConfig
+}
+
+func nidAlphabet() string {
+	if alphabet := getIDConfig().Alphabet; alphabet != "" {
+		return alphabet
+	}
+	return DEFAULT_ID_ALPHABET
+}
+
+// newProcessID returns a process ID of the configured generator or format.
+func newProcessID() string {
+	config := getIDConfig()
+	if config.ProcessIDGenerator != nil {
+		return config.ProcessIDGenerator()
+	}
+	prefix := config.ProcessIDPrefix
+	if prefix == "" {
+		prefix = FILE_PROCESS_ID_PREFIX
+	}
+	length := config.ProcessIDLength
+	if length == 0 {
+		length = FILE_PROCESS_ID_LENGTH
+	}
+	return NID(prefix, length)
+}
+
+// FileProcessOptions configure NewFileProcessWithOptions.
+type FileProcessOptions struct {
+	// ID is a caller supplied process ID, generated if empty. Up to 128 letters, digits and ".", "_", ":", "-",
+	// starting with a letter or digit; it must be unique, registering a process replaces one of the same ID.
+	ID string
+	// CorrelationID ties the process to a request or job of the caller. It is copied into every ProcessingStatus,
+	// appended to log lines, sent with recipe hooks and stored in the MetaData ("correlation_id") of the outputs.
+	CorrelationID string
+	// Labels are copied into every ProcessingStatus and appended to log lines, see NewFileProcessWithLabels.
+	Labels map[string]string
+}
+
+// NewFileProcessWithOptions creates a FileProcess with a caller supplied ID and/or correlation ID.
+func NewFileProcessWithOptions(incomingFileName, recipeName string, opts FileProcessOptions) (*FileProcess, error) {
+	fp := NewFileProcessWithLabels(incomingFileName, recipeName, opts.Labels)
+	if opts.ID != "" {
+		if !processIDRegex.MatchString(opts.ID) {
+			return nil, fmt.Errorf("%w: %q", ErrInvalidProcessID, opts.ID)
+		}
+		fp.ID = opts.ID
+	}
+	fp.CorrelationID = opts.CorrelationID
+	return fp, nil
+}
@@ -0,0 +1,180 @@
+package filemanager
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/disintegration/imaging"
+)
+
+var (
+	ErrImageDecoderMissing = errors.New("image decoder command not installed")
+)
+
+// ImageDecoder decodes image formats the imaging package cannot, e.g. HEIC/HEIF photos from iPhones or camera RAW
+// files. ImageManipulationPlugin asks its decoders before falling back to imaging.
+type ImageDecoder interface {
+	Decodes(file *ManagedFile) bool
+	Decode(file *ManagedFile) (image.Image, error)
+}
+
+// ICCProfileDecoder is implemented by decoders that also return the ICC profile of the image, so the color_profile
+// param applies to their images too.
+type ICCProfileDecoder interface {
+	DecodeWithICCProfile(file *ManagedFile) (image.Image, []byte, error)
+}
+
+// CommandImageDecoder decodes images with an external command line tool, as there are no pure Go decoders for
+// HEIF or RAW. Files match by MIME type or file name extension.
+type CommandImageDecoder struct {
+	MimeTypes  []string // e.g. "image/heic"
+	Extensions []string // e.g. ".cr2", compared case-insensitively
+	Command    string
+	// Args of the command: {input} is replaced with the path of the encoded file, {output} with the path the
+	// decoded image (PNG, JPEG, TIFF or BMP) is written to. Without {output} the image is read from stdout.
+	Args            []string
+	OutputExtension string // extension of {output}, defaults to ".png"
+}
+
+// NewHEIFImageDecoder decodes HEIC/HEIF with heif-convert (libheif), or ImageMagick if only that is installed.
+// The rotation and mirroring stored in the file are applied.
+func NewHEIFImageDecoder() *CommandImageDecoder {
+	decoder := &CommandImageDecoder{
+		MimeTypes:  []string{"image/heic", "image/heic-sequence", "image/heif", "image/heif-sequence"},
+		Extensions: []string{".heic", ".heif", ".hif"},
+		Command:    "heif-convert",
+		Args:       []string{"-q", "100", "{input}", "{output}"},
+	}
+	if _, err := exec.LookPath(decoder.Command); err != nil {
+		if _, err := exec.LookPath("magick"); err == nil {
+			decoder.Command = "magick"
+			decoder.Args = []string{"{input}[0]", "-auto-orient", "{output}"}
+		}
+	}
+	return decoder
+}
+
+// NewRAWImageDecoder decodes camera RAW files (CR2, CR3, NEF, ARW, DNG, RAF, ORF, RW2, ...) with dcraw, using the
+// camera's white balance. RAW files are usually detected as image/tiff, so they match by extension.
+func NewRAWImageDecoder() *CommandImageDecoder {
+	return &CommandImageDecoder{
+		MimeTypes:  []string{"image/x-canon-cr2", "image/x-canon-cr3", "image/x-nikon-nef", "image/x-sony-arw", "image/x-adobe-dng", "image/x-fuji-raf", "image/x-olympus-orf", "image/x-panasonic-rw2"},
+		Extensions: []string{".cr2", ".cr3", ".nef", ".arw", ".dng", ".raf", ".orf", ".rw2", ".pef", ".srw"},
+		Command:    "dcraw",
+		Args:       []string{"-c", "-w", "-T", "{input}"},
+	}
+}
+
+// DefaultImageDecoders are used by an ImageManipulationPlugin without Decoders.
+func DefaultImageDecoders() []ImageDecoder {
+	return []ImageDecoder{NewHEIFImageDecoder(), NewRAWImageDecoder()}
+}
+
+func (d *CommandImageDecoder) Decodes(file *ManagedFile) bool {
+	mimeType := strings.ToLower(file.MimeType)
+	for _, decodedMimeType := range d.MimeTypes {
+		if mimeType == decodedMimeType {
+			return true
+		}
+	}
+	extension := strings.ToLower(filepath.Ext(file.FileName))
+	if extension == "" {
+		extension = strings.ToLower(filepath.Ext(file.LocalFilePath))
+	}
+	for _, decodedExtension := range d.Extensions {
+		if extension == decodedExtension {
+			return true
+		}
+	}
+	return false
+}
+
+func (d *CommandImageDecoder) Decode(file *ManagedFile) (image.Image, error) {
+	img, _, err := d.DecodeWithICCProfile(file)
+	return img, err
+}
+
+// DecodeWithICCProfile returns the ICC profile the command embedded in its output, if any.
+func (d *CommandImageDecoder) DecodeWithICCProfile(file *ManagedFile) (image.Image, []byte, error) {
+	if _, err := exec.LookPath(d.Command); err != nil {
+		return nil, nil, fmt.Errorf("%w: %s", ErrImageDecoderMissing, d.Command)
+	}
+	dir, err := os.MkdirTemp("", "filemanager-decode-*")
+	if err != nil {
+		return nil, nil, err
+	}
+	defer os.RemoveAll(dir)
+	input, err := commandInputPath(file, dir)
+	if err != nil {
+		return nil, nil, err
+	}
+	outputExtension := d.OutputExtension
+	if outputExtension == "" {
+		outputExtension = ".png"
+	}
+	output := filepath.Join(dir, "output"+outputExtension)
+	toStdout := true
+	args := make([]string, len(d.Args))
+	for i, arg := range d.Args {
+		if strings.Contains(arg, "{output}") {
+			toStdout = false
+		}
+		args[i] = strings.NewReplacer("{input}", input, "{output}", output).Replace(arg)
+	}
+	cmd := exec.Command(d.Command, args...)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err = cmd.Run()
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s failed: %v %s", d.Command, err, strings.TrimSpace(stderr.String()))
+	}
+	decoded := stdout.Bytes()
+	if !toStdout {
+		decoded, err = os.ReadFile(output)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	img, err := imaging.Decode(bytes.NewReader(decoded))
+	if err != nil {
+		return nil, nil, err
+	}
+	return img, ExtractICCProfile(decoded), nil
+}
+
+// decoderFor returns the decoder claiming the file, nil if imaging decodes it.
+func (p *ImageManipulationPlugin) decoderFor(file *ManagedFile) ImageDecoder {
+	decoders := p.Decoders
+	if decoders == nil {
+		decoders = DefaultImageDecoders()
+	}
+	for _, decoder := range decoders {
+		if decoder.Decodes(file) {
+			return decoder
+		}
+	}
+	return nil
+}
+
+// decodeImage decodes the file with a matching decoder or imaging and returns its ICC profile, if any.
+func (p *ImageManipulationPlugin) decodeImage(file *ManagedFile, opts ...imaging.DecodeOption) (image.Image, []byte, error) {
+	if decoder := p.decoderFor(file); decoder != nil {
+		if profileDecoder, ok := decoder.(ICCProfileDecoder); ok {
+			return profileDecoder.DecodeWithICCProfile(file)
+		}
+		img, err := decoder.Decode(file)
+		return img, nil, err
+	}
+	img, err := imaging.Decode(bytes.NewReader(file.Content), opts...)
+	if err != nil {
+		return nil, nil, err
+	}
+	return img, ExtractICCProfile(file.Content), nil
+}
@@ -0,0 +1,214 @@
+package filemanager
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/png"
+	"math"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/disintegration/imaging"
+)
+
+const (
+	DEFAULT_SHARPEN_RADIUS = 1.0
+)
+
+// imageEncodeOptions are the encoder params of the ImageManipulationPlugin.
+type imageEncodeOptions struct {
+	quality           int    // 1-100 for JPEG and WebP, 0 keeps the encoder default
+	progressive       bool   // progressive JPEG, needs cjpeg
+	chromaSubsampling string // "4:2:0" (default), "4:2:2" or "4:4:4"; other than 4:2:0 needs cjpeg
+	pngCompression    png.CompressionLevel
+}
+
+// parseImageEncodeOptions reads the quality, progressive, chroma_subsampling and png_compression params.
+func parseImageEncodeOptions(params map[string]any) (imageEncodeOptions, error) {
+	opts := imageEncodeOptions{pngCompression: png.DefaultCompression}
+	if val, ok := params["quality"]; ok {
+		quality, ok := val.(float64)
+		if !ok || quality < 1 || quality > 100 {
+			return opts, invalidParamError("quality", val)
+		}
+		opts.quality = int(quality)
+	}
+	if val, ok := params["progressive"]; ok {
+		progressive, ok := val.(bool)
+		if !ok {
+			return opts, invalidParamError("progressive", val)
+		}
+		opts.progressive = progressive
+	}
+	if val, ok := params["chroma_subsampling"]; ok {
+		subsampling, ok := val.(string)
+		if !ok || cjpegSampling(subsampling) == "" {
+			return opts, invalidParamError("chroma_subsampling", val)
+		}
+		opts.chromaSubsampling = subsampling
+	}
+	if val, ok := params["png_compression"]; ok {
+		compression, _ := val.(string)
+		switch compression {
+		case "default":
+			opts.pngCompression = png.DefaultCompression
+		case "none":
+			opts.pngCompression = png.NoCompression
+		case "fast":
+			opts.pngCompression = png.BestSpeed
+		case "best":
+			opts.pngCompression = png.BestCompression
+		default:
+			return opts, invalidParamError("png_compression", val)
+		}
+	}
+	return opts, nil
+}
+
+func cjpegSampling(subsampling string) string {
+	switch subsampling {
+	case "4:2:0":
+		return "2x2"
+	case "4:2:2":
+		return "2x1"
+	case "4:4:4":
+		return "1x1"
+	}
+	return ""
+}
+
+// encodeImage encodes the image in the format of the extension (without dot) and embeds the ICC profile.
+func encodeImage(img image.Image, extension string, opts imageEncodeOptions, profile []byte) ([]byte, error) {
+	extension = strings.ToLower(extension)
+	var content []byte
+	var err error
+	switch extension {
+	case "webp":
+		return encodeImageAsWebP(img, profile, opts.quality)
+	case "jpg", "jpeg":
+		if opts.progressive || opts.chromaSubsampling != "" && opts.chromaSubsampling != "4:2:0" {
+			content, err = encodeImageWithCjpeg(img, opts)
+			break
+		}
+		buf := getBuffer()
+		defer putBuffer(buf)
+		encodeOptions := []imaging.EncodeOption{}
+		if opts.quality > 0 {
+			encodeOptions = append(encodeOptions, imaging.JPEGQuality(opts.quality))
+		}
+		err = imaging.Encode(buf, img, imaging.JPEG, encodeOptions...)
+		content = bytes.Clone(buf.Bytes())
+	default:
+		var format imaging.Format
+		format, err = imaging.FormatFromExtension("." + extension)
+		if err != nil {
+			return nil, fmt.Errorf("unsupported image format: %v", err)
+		}
+		buf := getBuffer()
+		defer putBuffer(buf)
+		err = imaging.Encode(buf, img, format, imaging.PNGCompressionLevel(opts.pngCompression))
+		content = bytes.Clone(buf.Bytes())
+	}
+	if err != nil {
+		return nil, err
+	}
+	return EmbedICCProfile(content, profile)
+}
+
+// encodeImageWithCjpeg encodes progressive JPEGs and chroma subsamplings the standard library does not support with
+// cjpeg (libjpeg-turbo or mozjpeg).
+func encodeImageWithCjpeg(img image.Image, opts imageEncodeOptions) ([]byte, error) {
+	if _, err := exec.LookPath("cjpeg"); err != nil {
+		return nil, fmt.Errorf("progressive JPEG and chroma subsampling need cjpeg: %v", err)
+	}
+	args := []string{}
+	if opts.quality > 0 {
+		args = append(args, "-quality", strconv.Itoa(opts.quality))
+	}
+	if opts.progressive {
+		args = append(args, "-progressive")
+	} else {
+		args = append(args, "-baseline")
+	}
+	if sampling := cjpegSampling(opts.chromaSubsampling); sampling != "" {
+		args = append(args, "-sample", sampling)
+	}
+	cmd := exec.Command("cjpeg", args...)
+	ppm := getBuffer()
+	defer putBuffer(ppm)
+	encodePPM(ppm, img)
+	cmd.Stdin = ppm
+	stdout := getBuffer()
+	defer putBuffer(stdout)
+	var stderr bytes.Buffer
+	cmd.Stdout = stdout
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	if err != nil {
+		return nil, fmt.Errorf("cjpeg failed: %v %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return bytes.Clone(stdout.Bytes()), nil
+}
+
+// encodePPM writes the image as binary PPM, the input format every cjpeg understands. Alpha is dropped.
+func encodePPM(buf *bytes.Buffer, img image.Image) {
+	bounds := img.Bounds()
+	fmt.Fprintf(buf, "P6\n%d %d\n255\n", bounds.Dx(), bounds.Dy())
+	nrgba := imaging.Clone(img)
+	for y := 0; y < bounds.Dy(); y++ {
+		row := nrgba.Pix[y*nrgba.Stride : y*nrgba.Stride+4*bounds.Dx()]
+		for x := 0; x < len(row); x += 4 {
+			buf.Write(row[x : x+3])
+		}
+	}
+}
+
+// parseSharpenParams reads sharpen_amount (e.g. 0.5 for 50%), sharpen_radius (sigma of the blur, defaults to 1)
+// and sharpen_threshold (minimal difference in 0-255 to sharpen, keeps flat areas free of noise).
+func parseSharpenParams(params map[string]any) (amount float64, radius float64, threshold float64, err error) {
+	val, ok := params["sharpen_amount"]
+	if !ok {
+		return 0, 0, 0, nil
+	}
+	amount, ok = val.(float64)
+	if !ok || amount < 0 {
+		return 0, 0, 0, invalidParamError("sharpen_amount", val)
+	}
+	radius = DEFAULT_SHARPEN_RADIUS
+	if val, ok := params["sharpen_radius"]; ok {
+		radius, ok = val.(float64)
+		if !ok || radius <= 0 {
+			return 0, 0, 0, invalidParamError("sharpen_radius", val)
+		}
+	}
+	if val, ok := params["sharpen_threshold"]; ok {
+		threshold, ok = val.(float64)
+		if !ok || threshold < 0 {
+			return 0, 0, 0, invalidParamError("sharpen_threshold", val)
+		}
+	}
+	return amount, radius, threshold, nil
+}
+
+// unsharpMask sharpens the image by adding amount times the difference to a blurred copy, for differences above
+// the threshold. It restores the crispness lost when downscaling.
+func unsharpMask(img image.Image, amount float64, radius float64, threshold float64) *image.NRGBA {
+	source := imaging.Clone(img)
+	blurred := imaging.Blur(source, radius)
+	sharpened := image.NewNRGBA(source.Bounds())
+	for i := 0; i < len(source.Pix); i += 4 {
+		for c := 0; c < 3; c++ {
+			original := float64(source.Pix[i+c])
+			difference := original - float64(blurred.Pix[i+c])
+			if math.Abs(difference) < threshold {
+				sharpened.Pix[i+c] = source.Pix[i+c]
+				continue
+			}
+			sharpened.Pix[i+c] = uint8(math.Max(0, math.Min(255, math.Round(original+amount*difference))))
+		}
+		sharpened.Pix[i+3] = source.Pix[i+3]
+	}
+	return sharpened
+}
@@ -0,0 +1,236 @@
+package filemanager
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"math"
+
+	"github.com/rwcarlsen/goexif/exif"
+)
+
+// METADATA_KEY_IMAGE holds the ImageInfo of images written by image steps in their MetaData.
+const METADATA_KEY_IMAGE = "image"
+
+const (
+	INCHES_PER_METER = 39.3701
+	CM_PER_INCH      = 2.54
+)
+
+// ImageInfo describes an image without decoding its pixels.
+type ImageInfo struct {
+	Width  int `json:"width"`
+	Height int `json:"height"`
+	// Frames is the number of frames of animated GIF, PNG (APNG) and WebP images, 1 for still images.
+	Frames int `json:"frames"`
+	// DPIX and DPIY are the resolution in dots per inch stored in the image (JFIF, EXIF, PNG pHYs or BMP header),
+	// 0 if it has none.
+	DPIX float64 `json:"dpiX,omitempty"`
+	DPIY float64 `json:"dpiY,omitempty"`
+}
+
+// ReadImageInfo reads the dimensions, frame count and resolution of an image from its header and chunks, so
+// consumers need not decode the image to get them. The dimensions need a registered image format.
+func ReadImageInfo(content []byte) (ImageInfo, error) {
+	config, format, err := image.DecodeConfig(bytes.NewReader(content))
+	if err != nil {
+		return ImageInfo{}, err
+	}
+	info := ImageInfo{Width: config.Width, Height: config.Height, Frames: 1}
+	switch format {
+	case "gif":
+		info.Frames = max(gifFrames(content), 1)
+	case "png":
+		info.Frames, info.DPIX, info.DPIY = pngInfo(content)
+	case "webp":
+		info.Frames = max(webpFrames(content), 1)
+	case "jpeg":
+		info.DPIX, info.DPIY = jfifDPI(content)
+	case "bmp":
+		info.DPIX, info.DPIY = bmpDPI(content)
+	}
+	if info.DPIX == 0 && (format == "jpeg" || format == "tiff") {
+		info.DPIX, info.DPIY = exifDPI(content)
+	}
+	return info, nil
+}
+
+// setImageInfo stores the ImageInfo of an image file in its MetaData, see METADATA_KEY_IMAGE. Files that are not
+// images or cannot be read are left alone.
+func setImageInfo(file *ManagedFile) {
+	if !isImageFile(file) || len(file.Content) == 0 {
+		return
+	}
+	info, err := ReadImageInfo(file.Content)
+	if err != nil {
+		return
+	}
+	file.SetMetaData(METADATA_KEY_IMAGE, info)
+}
+
+// gifFrames counts the image descriptors of a GIF.
+func gifFrames(content []byte) int {
+	if len(content) < 13 {
+		return 0
+	}
+	pos := 13
+	if flags := content[10]; flags&0x80 != 0 {
+		pos += 3 << ((flags & 0x07) + 1)
+	}
+	frames := 0
+	for pos < len(content) {
+		switch content[pos] {
+		case 0x21: // extension: label and sub-blocks
+			pos = skipGIFSubBlocks(content, pos+2)
+		case 0x2C: // image descriptor, local color table, LZW code size and sub-blocks
+			frames++
+			if pos+10 > len(content) {
+				return frames
+			}
+			flags := content[pos+9]
+			pos += 10
+			if flags&0x80 != 0 {
+				pos += 3 << ((flags & 0x07) + 1)
+			}
+			pos = skipGIFSubBlocks(content, pos+1)
+		default: // trailer or garbage
+			return frames
+		}
+	}
+	return frames
+}
+
+func skipGIFSubBlocks(content []byte, pos int) int {
+	for pos < len(content) {
+		size := int(content[pos])
+		pos++
+		if size == 0 {
+			return pos
+		}
+		pos += size
+	}
+	return pos
+}
+
+// pngInfo reads the frame count of the acTL chunk of APNGs and the resolution of the pHYs chunk, which both come
+// before the image data.
+func pngInfo(content []byte) (frames int, dpiX float64, dpiY float64) {
+	frames = 1
+	pos := 8
+	for pos+8 <= len(content) {
+		length := int(binary.BigEndian.Uint32(content[pos:]))
+		chunkType := string(content[pos+4 : pos+8])
+		data := content[pos+8:]
+		if length < 0 || length > len(data) {
+			break
+		}
+		data = data[:length]
+		switch chunkType {
+		case "acTL":
+			if length >= 4 {
+				frames = max(int(binary.BigEndian.Uint32(data)), 1)
+			}
+		case "pHYs":
+			// unit 1 is the meter, 0 only gives the aspect ratio
+			if length >= 9 && data[8] == 1 {
+				dpiX = roundDPI(float64(binary.BigEndian.Uint32(data)) / INCHES_PER_METER)
+				dpiY = roundDPI(float64(binary.BigEndian.Uint32(data[4:])) / INCHES_PER_METER)
+			}
+		case "IDAT", "IEND":
+			return frames, dpiX, dpiY
+		}
+		pos += 12 + length
+	}
+	return frames, dpiX, dpiY
+}
+
+// webpFrames counts the ANMF chunks of an animated WebP.
+func webpFrames(content []byte) int {
+	if len(content) < 12 || string(content[:4]) != "RIFF" || string(content[8:12]) != "WEBP" {
+		return 0
+	}
+	frames := 0
+	pos := 12
+	for pos+8 <= len(content) {
+		size := int(binary.LittleEndian.Uint32(content[pos+4:]))
+		if string(content[pos:pos+4]) == "ANMF" {
+			frames++
+		}
+		if size < 0 || size > len(content) {
+			break
+		}
+		pos += 8 + size + size%2
+	}
+	return frames
+}
+
+// jfifDPI reads the density of the JFIF APP0 segment of a JPEG.
+func jfifDPI(content []byte) (float64, float64) {
+	pos := 2
+	for pos+4 <= len(content) && content[pos] == 0xFF {
+		marker := content[pos+1]
+		length := int(binary.BigEndian.Uint16(content[pos+2:]))
+		if marker == 0xDA || length < 2 || pos+2+length > len(content) {
+			break
+		}
+		segment := content[pos+4 : pos+2+length]
+		if marker == 0xE0 && len(segment) >= 12 && string(segment[:5]) == "JFIF\x00" {
+			x := float64(binary.BigEndian.Uint16(segment[8:]))
+			y := float64(binary.BigEndian.Uint16(segment[10:]))
+			switch segment[7] {
+			case 1: // dots per inch
+				return x, y
+			case 2: // dots per cm
+				return roundDPI(x * CM_PER_INCH), roundDPI(y * CM_PER_INCH)
+			}
+			return 0, 0
+		}
+		pos += 2 + length
+	}
+	return 0, 0
+}
+
+// bmpDPI reads the resolution of the BITMAPINFOHEADER in pixels per meter.
+func bmpDPI(content []byte) (float64, float64) {
+	if len(content) < 46 || binary.LittleEndian.Uint32(content[14:]) < 40 {
+		return 0, 0
+	}
+	x := float64(int32(binary.LittleEndian.Uint32(content[38:])))
+	y := float64(int32(binary.LittleEndian.Uint32(content[42:])))
+	if x <= 0 || y <= 0 {
+		return 0, 0
+	}
+	return roundDPI(x / INCHES_PER_METER), roundDPI(y / INCHES_PER_METER)
+}
+
+// exifDPI reads XResolution, YResolution and ResolutionUnit of the EXIF data of JPEGs and TIFFs.
+func exifDPI(content []byte) (float64, float64) {
+	x, err := exif.Decode(bytes.NewReader(content))
+	if err != nil {
+		return 0, 0
+	}
+	resolution := func(field exif.FieldName) float64 {
+		tag, err := x.Get(field)
+		if err != nil {
+			return 0
+		}
+		numerator, denominator, err := tag.Rat2(0)
+		if err != nil || denominator == 0 {
+			return 0
+		}
+		return float64(numerator) / float64(denominator)
+	}
+	dpiX, dpiY := resolution(exif.XResolution), resolution(exif.YResolution)
+	if unit, err := x.Get(exif.ResolutionUnit); err == nil {
+		// 2 is the inch (the default), 3 the centimeter
+		if value, err := unit.Int(0); err == nil && value == 3 {
+			dpiX, dpiY = dpiX*CM_PER_INCH, dpiY*CM_PER_INCH
+		}
+	}
+	return roundDPI(dpiX), roundDPI(dpiY)
+}
+
+// roundDPI rounds converted resolutions to two decimals, so 72 dpi stored as 2835 pixels per meter reads 72.01.
+func roundDPI(dpi float64) float64 {
+	return math.Round(dpi*100) / 100
+}
@@ -0,0 +1,210 @@
+package filemanager
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	DEFAULT_INGEST_INTERVAL    = 5 * time.Second
+	DEFAULT_INGEST_SETTLE_TIME = 2 * time.Second
+	INGEST_DONE_DIR            = "done"
+	INGEST_FAILED_DIR          = "failed"
+	// INGEST_ERROR_SUFFIX is appended to the name of a failed file for the file holding its error.
+	INGEST_ERROR_SUFFIX = ".error.txt"
+)
+
+// ingestPartialSuffixes mark files still being written by the tool dropping them.
+var ingestPartialSuffixes = []string{".part", ".partial", ".tmp", ".crdownload", ".download"}
+
+// IngestOptions configure WatchIngestDirectory. Zero values keep the defaults.
+type IngestOptions struct {
+	// Interval between two scans of the directory, DEFAULT_INGEST_INTERVAL by default.
+	Interval time.Duration
+	// SettleTime is how long a file must stay unchanged before it is ingested, so files still being copied are not
+	// picked up half-written. DEFAULT_INGEST_SETTLE_TIME by default.
+	SettleTime time.Duration
+	// DoneDir and FailedDir receive the originals after processing, the "done" and "failed" subdirectories of the
+	// watched directory by default.
+	DoneDir   string
+	FailedDir string
+	// ProcessOptions are passed to every process, e.g. Params or a Priority.
+	ProcessOptions ProcessOptions
+	// OnProcessed is called after each file with its process, e.g. to notify a user.
+	OnProcessed func(fileName string, fileProcess *FileProcess)
+}
+
+// WatchIngestDirectory watches a drop folder until the context is cancelled: every new file is processed with the
+// recipe once it stopped changing and then moved into the done directory, or into the failed directory next to a
+// file with the error (name + INGEST_ERROR_SUFFIX). Hidden files and files with a partial suffix (.part, .tmp,
+// .crdownload, ...) are skipped. The directory is polled, so network shares work too. Files are processed one after
+// the other; their processes are registered like those of ProcessFile and labelled with "ingest_dir".
+func (fm *FileManager) WatchIngestDirectory(ctx context.Context, dir string, recipeName string, opts IngestOptions) error {
+	if opts.Interval <= 0 {
+		opts.Interval = DEFAULT_INGEST_INTERVAL
+	}
+	if opts.SettleTime <= 0 {
+		opts.SettleTime = DEFAULT_INGEST_SETTLE_TIME
+	}
+	if opts.DoneDir == "" {
+		opts.DoneDir = filepath.Join(dir, INGEST_DONE_DIR)
+	}
+	if opts.FailedDir == "" {
+		opts.FailedDir = filepath.Join(dir, INGEST_FAILED_DIR)
+	}
+	info, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("ingest directory(%s) is not a directory", dir)
+	}
+	for _, target := range []string{opts.DoneDir, opts.FailedDir} {
+		err = mkdirAllMode(target, fm.getFilePermissions().dirMode())
+		if err != nil {
+			return err
+		}
+	}
+	watcher := &ingestWatcher{fm: fm, dir: dir, recipeName: recipeName, opts: opts, seen: make(map[string]ingestFileState)}
+	go func() {
+		ticker := time.NewTicker(opts.Interval)
+		defer ticker.Stop()
+		for {
+			watcher.scan(ctx)
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	fm.LogTo("INFO", fmt.Sprintf("[FileManager.WatchIngestDirectory] Watching directory(%s) with recipe(%s)\n", dir, recipeName))
+	return nil
+}
+
+type ingestFileState struct {
+	size    int64
+	modTime time.Time
+	since   time.Time // first scan that saw this size and modification time
+}
+
+type ingestWatcher struct {
+	fm         *FileManager
+	dir        string
+	recipeName string
+	opts       IngestOptions
+	seen       map[string]ingestFileState
+}
+
+// scan ingests the files that settled since the last scan.
+func (w *ingestWatcher) scan(ctx context.Context) {
+	entries, err := os.ReadDir(w.dir)
+	if err != nil {
+		w.fm.LogTo("INFO", fmt.Sprintf("[FileManager.WatchIngestDirectory] Reading directory(%s) failed: %v\n", w.dir, err))
+		return
+	}
+	now := time.Now()
+	present := make(map[string]bool, len(entries))
+	for _, entry := range entries {
+		if ctx.Err() != nil {
+			return
+		}
+		name := entry.Name()
+		if !entry.Type().IsRegular() || isIngestPartialFile(name) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		present[name] = true
+		state, ok := w.seen[name]
+		if !ok || state.size != info.Size() || !state.modTime.Equal(info.ModTime()) {
+			w.seen[name] = ingestFileState{size: info.Size(), modTime: info.ModTime(), since: now}
+			continue
+		}
+		if now.Sub(state.since) < w.opts.SettleTime {
+			continue
+		}
+		w.ingest(name)
+		delete(w.seen, name)
+	}
+	for name := range w.seen {
+		if !present[name] {
+			delete(w.seen, name)
+		}
+	}
+}
+
+func isIngestPartialFile(name string) bool {
+	if strings.HasPrefix(name, ".") {
+		return true
+	}
+	lower := strings.ToLower(name)
+	for _, suffix := range ingestPartialSuffixes {
+		if strings.HasSuffix(lower, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// ingest processes one file and moves it out of the watched directory.
+func (w *ingestWatcher) ingest(name string) {
+	localPath := filepath.Join(w.dir, name)
+	fileProcess := NewFileProcessWithLabels(name, w.recipeName, map[string]string{"ingest_dir": w.dir})
+	err := w.process(localPath, fileProcess)
+	target := w.opts.DoneDir
+	if err != nil {
+		target = w.opts.FailedDir
+		w.fm.LogTo("INFO", fmt.Sprintf("[FileManager.WatchIngestDirectory] Processing file(%s)%s failed: %v\n", localPath, fileProcess.LogLabels(), err))
+	}
+	movedPath, moveErr := w.fm.moveToUniquePath(localPath, target)
+	if moveErr != nil {
+		w.fm.LogTo("INFO", fmt.Sprintf("[FileManager.WatchIngestDirectory] Moving file(%s)%s to %s failed: %v\n", localPath, fileProcess.LogLabels(), target, moveErr))
+	} else if err != nil {
+		writeErr := os.WriteFile(movedPath+INGEST_ERROR_SUFFIX, []byte(err.Error()+"\n"), w.fm.getFilePermissions().fileModeOr(0644))
+		if writeErr != nil {
+			w.fm.LogTo("INFO", fmt.Sprintf("[FileManager.WatchIngestDirectory] Writing error of file(%s)%s failed: %v\n", movedPath, fileProcess.LogLabels(), writeErr))
+		}
+	}
+	if w.opts.OnProcessed != nil {
+		w.opts.OnProcessed(name, fileProcess)
+	}
+}
+
+func (w *ingestWatcher) process(localPath string, fileProcess *FileProcess) error {
+	content, err := os.ReadFile(localPath)
+	if err != nil {
+		return err
+	}
+	mimeType, err := w.fm.DetectFileMimeType(localPath)
+	if err != nil {
+		return err
+	}
+	file := &ManagedFile{
+		FileName:      filepath.Base(localPath),
+		LocalFilePath: localPath,
+		FileSize:      int64(len(content)),
+		MimeType:      mimeType,
+		Content:       content,
+		MetaData:      map[string]any{"ingest_path": localPath},
+	}
+	_, err = w.fm.ProcessFileSync(file, w.recipeName, fileProcess, w.opts.ProcessOptions)
+	return err
+}
+
+// moveToUniquePath moves the file into the directory, adding a timestamp to its name if the name is taken.
+func (fm *FileManager) moveToUniquePath(localPath string, dir string) (string, error) {
+	target := filepath.Join(dir, filepath.Base(localPath))
+	if FileExists(target) {
+		ext := filepath.Ext(localPath)
+		base := strings.TrimSuffix(filepath.Base(localPath), ext)
+		target = filepath.Join(dir, fmt.Sprintf("%s_%d%s", base, time.Now().UnixNano(), ext))
+	}
+	return target, fm.moveFile(localPath, target)
+}
@@ -0,0 +1,242 @@
+package filemanager
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path/filepath"
+	"time"
+)
+
+const (
+	DEFAULT_INTEGRITY_INTERVAL = 24 * time.Hour
+	// QUARANTINE_DIR_NAME is the hidden directory in the private path corrupted files are moved to.
+	QUARANTINE_DIR_NAME  = ".quarantine"
+	QUARANTINE_ID_PREFIX = "QU"
+	QUARANTINE_ID_LENGTH = 16
+)
+
+// METADATA_KEY_INTEGRITY holds the IntegrityFailure of a corrupted file in the MetaData of its record.
+const METADATA_KEY_INTEGRITY = "integrity_failure"
+
+var (
+	ErrFileCorrupted = errors.New("file content does not match its recorded checksum")
+)
+
+// IntegrityOptions control VerifyIntegrity.
+type IntegrityOptions struct {
+	// Quarantine moves corrupted files into the quarantine directory, so they are no longer served. Their records
+	// are kept, with the IntegrityFailure in their MetaData. Files on legal hold are only reported.
+	Quarantine bool
+	// QuarantinePath is the quarantine directory, QUARANTINE_DIR_NAME in the private path by default.
+	QuarantinePath string
+	// RateLimiter limits the read bandwidth, so verifying an archive does not starve the disk of other work.
+	RateLimiter *RateLimiter
+	// OnCorrupted is called for every corrupted file, e.g. to alert or restore it from a backup.
+	OnCorrupted func(failure IntegrityFailure)
+}
+
+// IntegrityFailure describes a file whose content does not match the checksum of its record.
+type IntegrityFailure struct {
+	LocalFilePath    string    `json:"localFilePath"`
+	ExpectedChecksum string    `json:"expectedChecksum"`
+	ActualChecksum   string    `json:"actualChecksum"`
+	DetectedAt       time.Time `json:"detectedAt"`
+	// QuarantinePath is where the file was moved to, empty if it was not quarantined.
+	QuarantinePath string `json:"quarantinePath,omitempty"`
+}
+
+func (f IntegrityFailure) Error() string {
+	return fmt.Sprintf("%v: file(%s) has checksum %s, expected %s", ErrFileCorrupted, f.LocalFilePath, f.ActualChecksum, f.ExpectedChecksum)
+}
+
+func (f IntegrityFailure) Is(target error) bool {
+	return target == ErrFileCorrupted
+}
+
+// IntegrityReport lists the outcome of VerifyIntegrity. Paths are local file paths.
+type IntegrityReport struct {
+	Checked     int
+	Corrupted   []IntegrityFailure
+	Missing     []string // records whose file is missing
+	Unverified  int      // records without a checksum
+	Quarantined int
+	Errors      map[string]string
+}
+
+// VerifyIntegrity recomputes the SHA-256 of every file with a record in the metadata store and compares it to the
+// recorded checksum, catching bit rot and tampering, e.g. of long-lived archives on cheap disks. Corrupted files are
+// reported and, with opts.Quarantine, moved out of the way. Files quarantined before are skipped.
+func (fm *FileManager) VerifyIntegrity(ctx context.Context, opts IntegrityOptions) (IntegrityReport, error) {
+	report := IntegrityReport{Errors: make(map[string]string)}
+	store := fm.getMetadataStore()
+	if store == nil {
+		return report, ErrMetadataStoreMissing
+	}
+	records, err := store.ListRecords()
+	if err != nil {
+		return report, err
+	}
+	for _, record := range records {
+		if ctx.Err() != nil {
+			return report, ctx.Err()
+		}
+		if integrityFailureOfRecord(record) != nil {
+			continue
+		}
+		if record.Checksum == "" {
+			report.Unverified++
+			continue
+		}
+		checksum, err := fm.storedChecksum(ctx, record.LocalFilePath, opts.RateLimiter)
+		if errors.Is(err, fs.ErrNotExist) {
+			report.Missing = append(report.Missing, record.LocalFilePath)
+			continue
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return report, ctx.Err()
+			}
+			report.Errors[record.LocalFilePath] = err.Error()
+			continue
+		}
+		report.Checked++
+		if checksum == record.Checksum {
+			continue
+		}
+		failure := IntegrityFailure{
+			LocalFilePath:    record.LocalFilePath,
+			ExpectedChecksum: record.Checksum,
+			ActualChecksum:   checksum,
+			DetectedAt:       time.Now(),
+		}
+		fm.LogTo("INFO", fmt.Sprintf("[FileManager.VerifyIntegrity] %v\n", failure))
+		if opts.Quarantine {
+			err = fm.quarantine(store, record, &failure, opts.QuarantinePath)
+			if err != nil {
+				report.Errors[record.LocalFilePath] = err.Error()
+			} else {
+				report.Quarantined++
+			}
+		}
+		report.Corrupted = append(report.Corrupted, failure)
+		if opts.OnCorrupted != nil {
+			opts.OnCorrupted(failure)
+		}
+	}
+	fm.LogTo("DEBUG", fmt.Sprintf("[FileManager.VerifyIntegrity] checked(%d) corrupted(%d) missing(%d) unverified(%d) quarantined(%d) errors(%d)\n", report.Checked, len(report.Corrupted), len(report.Missing), report.Unverified, report.Quarantined, len(report.Errors)))
+	return report, nil
+}
+
+// StartIntegrityWorker runs VerifyIntegrity every interval until the context is cancelled. Corrupted files are
+// logged, and reported to opts.OnCorrupted.
+func (fm *FileManager) StartIntegrityWorker(ctx context.Context, interval time.Duration, opts IntegrityOptions) {
+	if interval <= 0 {
+		interval = DEFAULT_INTEGRITY_INTERVAL
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				_, err := fm.VerifyIntegrity(ctx, opts)
+				if err != nil && ctx.Err() == nil {
+					fm.LogTo("INFO", fmt.Sprintf("[FileManager.StartIntegrityWorker] Verifying integrity failed: %v\n", err))
+				}
+			}
+		}
+	}()
+}
+
+// storedChecksum returns the hex encoded SHA-256 of the stored file, read through the storage.
+func (fm *FileManager) storedChecksum(ctx context.Context, localFilePath string, limiter *RateLimiter) (string, error) {
+	file, err := fm.openStored(localFilePath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	var reader io.Reader = file
+	if limiter != nil {
+		reader = NewThrottledReader(ctx, reader, limiter)
+	}
+	hash := sha256.New()
+	_, err = io.Copy(hash, reader)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// quarantine moves a corrupted file into the quarantine directory, with MoveFile for local files, and records
+// the failure in its record.
+func (fm *FileManager) quarantine(store MetadataStore, record *FileRecord, failure *IntegrityFailure, quarantinePath string) error {
+	if holdOfRecord(record) != nil {
+		return fmt.Errorf("%w: %s", ErrFileOnHold, record.LocalFilePath)
+	}
+	if quarantinePath == "" {
+		quarantinePath = filepath.Join(fm.privateLocalBasePath, QUARANTINE_DIR_NAME)
+	}
+	target := filepath.Join(quarantinePath, NID(QUARANTINE_ID_PREFIX, QUARANTINE_ID_LENGTH)+filepath.Ext(record.LocalFilePath))
+	if fm.usesLocalStorage(record.LocalFilePath) && fm.usesLocalStorage(target) {
+		err := fm.moveFile(record.LocalFilePath, target)
+		if err != nil {
+			return err
+		}
+	} else {
+		storage := fm.GetStorage()
+		data, err := storage.ReadFile(record.LocalFilePath)
+		if err != nil {
+			return err
+		}
+		err = storage.WriteFile(target, data, 0600, true)
+		if err != nil {
+			return err
+		}
+		err = storage.Remove(record.LocalFilePath)
+		if err != nil {
+			return err
+		}
+	}
+	failure.QuarantinePath = target
+	fm.imageHashes.remove(record.LocalFilePath)
+	if index := fm.getSearchIndex(); index != nil {
+		_ = index.DeleteDocument(record.LocalFilePath)
+	}
+	if record.MetaData == nil {
+		record.MetaData = make(map[string]any)
+	}
+	record.MetaData[METADATA_KEY_INTEGRITY] = failure
+	record.UpdatedAt = time.Now()
+	fm.LogTo("INFO", fmt.Sprintf("[FileManager.VerifyIntegrity] Quarantined file(%s) at (%s)\n", record.LocalFilePath, target))
+	return store.SaveRecord(record)
+}
+
+// integrityFailureOfRecord decodes the integrity failure of a record, an *IntegrityFailure before and a map after a
+// round trip through the store.
+func integrityFailureOfRecord(record *FileRecord) *IntegrityFailure {
+	value, ok := record.MetaData[METADATA_KEY_INTEGRITY]
+	if !ok || value == nil {
+		return nil
+	}
+	if failure, ok := value.(*IntegrityFailure); ok {
+		return failure
+	}
+	data, err := json.Marshal(value)
+	if err != nil {
+		return nil
+	}
+	failure := &IntegrityFailure{}
+	err = json.Unmarshal(data, failure)
+	if err != nil {
+		return nil
+	}
+	return failure
+}
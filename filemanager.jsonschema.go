@@ -0,0 +1,688 @@
+package filemanager
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/url"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	ErrInvalidSchema = errors.New("invalid schema")
+)
+
+// MAX_SCHEMA_REF_DEPTH bounds the $refs followed while validating a single value, so recursive schemas that never
+// consume any of the value fail instead of looping.
+const MAX_SCHEMA_REF_DEPTH = 64
+
+// JSONSchema validates JSON-like values (as decoded by encoding/json: map[string]any, []any, float64, string, bool,
+// nil) against a JSON Schema. It implements the validation keywords of drafts 4 to 2020-12: type, enum, const, the
+// numeric, string, array and object constraints, the allOf/anyOf/oneOf/not/if-then-else combinators and $refs
+// within the schema document ("#/$defs/...", "#/definitions/..."). format is treated as an annotation, remote $refs
+// and $dynamicRef are not supported.
+type JSONSchema struct {
+	root     any
+	patterns map[string]*regexp.Regexp
+}
+
+// SchemaViolation is a value not matching its schema. Path is the JSON pointer of the value, "" for the document.
+type SchemaViolation struct {
+	Path    string
+	Message string
+}
+
+// ParseJSONSchema parses a JSON Schema given as JSON or YAML.
+func ParseJSONSchema(content []byte) (*JSONSchema, error) {
+	var schema any
+	err := json.Unmarshal(content, &schema)
+	if err != nil {
+		var yamlErr error
+		schema, _, yamlErr = decodeYAMLValue(content)
+		if yamlErr != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidSchema, err)
+		}
+	}
+	return NewJSONSchema(schema)
+}
+
+// NewJSONSchema returns the JSONSchema of an already decoded schema document. Maps may have any keys and numbers
+// any type, as decoded from YAML step params.
+func NewJSONSchema(schema any) (*JSONSchema, error) {
+	s := &JSONSchema{root: normalizeJSONValue(schema), patterns: map[string]*regexp.Regexp{}}
+	err := s.compile(s.root, "#")
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// compile checks the schema, compiles its patterns and resolves its $refs up front, so broken schemas fail before
+// any document is validated.
+func (s *JSONSchema) compile(schema any, location string) error {
+	switch typed := schema.(type) {
+	case bool:
+		return nil
+	case []any:
+		for i, item := range typed {
+			err := s.compile(item, location+"/"+strconv.Itoa(i))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	case map[string]any:
+		for key, value := range typed {
+			switch key {
+			case "enum", "const", "required", "examples", "default":
+				continue
+			case "$ref":
+				ref, _ := value.(string)
+				if _, err := s.resolve(ref); err != nil {
+					return fmt.Errorf("%w: %s/$ref: %v", ErrInvalidSchema, location, err)
+				}
+			case "pattern":
+				pattern, _ := value.(string)
+				if _, err := s.pattern(pattern); err != nil {
+					return fmt.Errorf("%w: %s/pattern: %v", ErrInvalidSchema, location, err)
+				}
+			case "patternProperties":
+				properties, _ := value.(map[string]any)
+				for pattern := range properties {
+					if _, err := s.pattern(pattern); err != nil {
+						return fmt.Errorf("%w: %s/patternProperties: %v", ErrInvalidSchema, location, err)
+					}
+				}
+			}
+			err := s.compile(value, location+"/"+escapeJSONPointer(key))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if location == "#" {
+		return fmt.Errorf("%w: a schema must be an object or a boolean", ErrInvalidSchema)
+	}
+	return nil
+}
+
+func (s *JSONSchema) pattern(pattern string) (*regexp.Regexp, error) {
+	if re, ok := s.patterns[pattern]; ok {
+		return re, nil
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	s.patterns[pattern] = re
+	return re, nil
+}
+
+// resolve returns the subschema of a $ref within the schema document.
+func (s *JSONSchema) resolve(ref string) (any, error) {
+	if !strings.HasPrefix(ref, "#") {
+		return nil, fmt.Errorf("only $refs within the schema are supported: %q", ref)
+	}
+	pointer, err := url.PathUnescape(ref[1:])
+	if err != nil {
+		return nil, err
+	}
+	current := s.root
+	if pointer == "" {
+		return current, nil
+	}
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, fmt.Errorf("unsupported $ref: %q", ref)
+	}
+	for _, token := range strings.Split(pointer[1:], "/") {
+		token = strings.ReplaceAll(strings.ReplaceAll(token, "~1", "/"), "~0", "~")
+		switch typed := current.(type) {
+		case map[string]any:
+			next, ok := typed[token]
+			if !ok {
+				return nil, fmt.Errorf("unresolvable $ref: %q", ref)
+			}
+			current = next
+		case []any:
+			index, err := strconv.Atoi(token)
+			if err != nil || index < 0 || index >= len(typed) {
+				return nil, fmt.Errorf("unresolvable $ref: %q", ref)
+			}
+			current = typed[index]
+		default:
+			return nil, fmt.Errorf("unresolvable $ref: %q", ref)
+		}
+	}
+	return current, nil
+}
+
+// Validate returns the violations of the value, none if it matches the schema. Values decoded from YAML are
+// normalized first.
+func (s *JSONSchema) Validate(value any) []SchemaViolation {
+	return s.validate(s.root, normalizeJSONValue(value), "", 0)
+}
+
+func (s *JSONSchema) validate(schema any, value any, path string, depth int) []SchemaViolation {
+	switch typed := schema.(type) {
+	case bool:
+		if !typed {
+			return []SchemaViolation{{Path: path, Message: "no value is allowed here"}}
+		}
+		return nil
+	case map[string]any:
+		return s.validateObjectSchema(typed, value, path, depth)
+	}
+	return nil
+}
+
+func (s *JSONSchema) validateObjectSchema(schema map[string]any, value any, path string, depth int) []SchemaViolation {
+	var violations []SchemaViolation
+	add := func(format string, args ...any) {
+		violations = append(violations, SchemaViolation{Path: path, Message: fmt.Sprintf(format, args...)})
+	}
+
+	if ref, ok := schema["$ref"].(string); ok {
+		if depth >= MAX_SCHEMA_REF_DEPTH {
+			add("$ref %s nested too deeply", ref)
+			return violations
+		}
+		target, err := s.resolve(ref)
+		if err != nil {
+			add("%v", err)
+			return violations
+		}
+		violations = append(violations, s.validate(target, value, path, depth+1)...)
+	}
+
+	if types, ok := schema["type"]; ok {
+		var allowed []string
+		switch typed := types.(type) {
+		case string:
+			allowed = []string{typed}
+		case []any:
+			for _, item := range typed {
+				if name, ok := item.(string); ok {
+					allowed = append(allowed, name)
+				}
+			}
+		}
+		matches := false
+		for _, name := range allowed {
+			if jsonValueHasType(value, name) {
+				matches = true
+				break
+			}
+		}
+		if !matches {
+			add("expected %s, got %s", strings.Join(allowed, " or "), jsonTypeName(value))
+			// the remaining keywords would only repeat the mismatch
+			return violations
+		}
+	}
+	if enum, ok := schema["enum"].([]any); ok {
+		found := false
+		for _, allowed := range enum {
+			if reflect.DeepEqual(allowed, value) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			add("must be one of %s", compactJSON(enum))
+		}
+	}
+	if constant, ok := schema["const"]; ok && !reflect.DeepEqual(constant, value) {
+		add("must be %s", compactJSON(constant))
+	}
+
+	switch typed := value.(type) {
+	case float64:
+		violations = append(violations, validateJSONNumber(schema, typed, path)...)
+	case string:
+		violations = append(violations, s.validateJSONString(schema, typed, path)...)
+	case []any:
+		violations = append(violations, s.validateJSONArray(schema, typed, path, depth)...)
+	case map[string]any:
+		violations = append(violations, s.validateJSONObject(schema, typed, path, depth)...)
+	}
+
+	if allOf, ok := schema["allOf"].([]any); ok {
+		for _, subschema := range allOf {
+			violations = append(violations, s.validate(subschema, value, path, depth)...)
+		}
+	}
+	if anyOf, ok := schema["anyOf"].([]any); ok {
+		var first []SchemaViolation
+		matched := false
+		for i, subschema := range anyOf {
+			subViolations := s.validate(subschema, value, path, depth)
+			if len(subViolations) == 0 {
+				matched = true
+				break
+			}
+			if i == 0 {
+				first = subViolations
+			}
+		}
+		if !matched {
+			add("does not match any of the anyOf schemas (first: %s)", firstViolationMessage(first))
+		}
+	}
+	if oneOf, ok := schema["oneOf"].([]any); ok {
+		var first []SchemaViolation
+		matches := 0
+		for i, subschema := range oneOf {
+			subViolations := s.validate(subschema, value, path, depth)
+			if len(subViolations) == 0 {
+				matches++
+			} else if i == 0 {
+				first = subViolations
+			}
+		}
+		switch {
+		case matches == 0:
+			add("does not match any of the oneOf schemas (first: %s)", firstViolationMessage(first))
+		case matches > 1:
+			add("matches %d of the oneOf schemas instead of exactly one", matches)
+		}
+	}
+	if not, ok := schema["not"]; ok && len(s.validate(not, value, path, depth)) == 0 {
+		add("must not match the not schema")
+	}
+	if condition, ok := schema["if"]; ok {
+		if len(s.validate(condition, value, path, depth)) == 0 {
+			if then, ok := schema["then"]; ok {
+				violations = append(violations, s.validate(then, value, path, depth)...)
+			}
+		} else if otherwise, ok := schema["else"]; ok {
+			violations = append(violations, s.validate(otherwise, value, path, depth)...)
+		}
+	}
+	return violations
+}
+
+func validateJSONNumber(schema map[string]any, value float64, path string) []SchemaViolation {
+	var violations []SchemaViolation
+	add := func(format string, args ...any) {
+		violations = append(violations, SchemaViolation{Path: path, Message: fmt.Sprintf(format, args...)})
+	}
+	// draft 4 has boolean exclusiveMinimum/exclusiveMaximum modifying minimum/maximum
+	exclusiveMinimum, _ := schema["exclusiveMinimum"].(bool)
+	exclusiveMaximum, _ := schema["exclusiveMaximum"].(bool)
+	if minimum, ok := schema["minimum"].(float64); ok {
+		if exclusiveMinimum && value <= minimum {
+			add("must be greater than %v", minimum)
+		} else if value < minimum {
+			add("must be at least %v", minimum)
+		}
+	}
+	if maximum, ok := schema["maximum"].(float64); ok {
+		if exclusiveMaximum && value >= maximum {
+			add("must be less than %v", maximum)
+		} else if value > maximum {
+			add("must be at most %v", maximum)
+		}
+	}
+	if minimum, ok := schema["exclusiveMinimum"].(float64); ok && value <= minimum {
+		add("must be greater than %v", minimum)
+	}
+	if maximum, ok := schema["exclusiveMaximum"].(float64); ok && value >= maximum {
+		add("must be less than %v", maximum)
+	}
+	if multipleOf, ok := schema["multipleOf"].(float64); ok && multipleOf > 0 {
+		quotient := value / multipleOf
+		if math.Abs(quotient-math.Round(quotient)) > 1e-9 {
+			add("must be a multiple of %v", multipleOf)
+		}
+	}
+	return violations
+}
+
+func (s *JSONSchema) validateJSONString(schema map[string]any, value string, path string) []SchemaViolation {
+	var violations []SchemaViolation
+	add := func(format string, args ...any) {
+		violations = append(violations, SchemaViolation{Path: path, Message: fmt.Sprintf(format, args...)})
+	}
+	length := utf8.RuneCountInString(value)
+	if minLength, ok := schema["minLength"].(float64); ok && float64(length) < minLength {
+		add("must be at least %v characters long", minLength)
+	}
+	if maxLength, ok := schema["maxLength"].(float64); ok && float64(length) > maxLength {
+		add("must be at most %v characters long", maxLength)
+	}
+	if pattern, ok := schema["pattern"].(string); ok {
+		re, err := s.pattern(pattern)
+		if err == nil && !re.MatchString(value) {
+			add("must match the pattern %q", pattern)
+		}
+	}
+	return violations
+}
+
+func (s *JSONSchema) validateJSONArray(schema map[string]any, value []any, path string, depth int) []SchemaViolation {
+	var violations []SchemaViolation
+	add := func(format string, args ...any) {
+		violations = append(violations, SchemaViolation{Path: path, Message: fmt.Sprintf(format, args...)})
+	}
+	if minItems, ok := schema["minItems"].(float64); ok && float64(len(value)) < minItems {
+		add("must have at least %v items", minItems)
+	}
+	if maxItems, ok := schema["maxItems"].(float64); ok && float64(len(value)) > maxItems {
+		add("must have at most %v items", maxItems)
+	}
+	if unique, _ := schema["uniqueItems"].(bool); unique {
+	duplicates:
+		for i := range value {
+			for j := 0; j < i; j++ {
+				if reflect.DeepEqual(value[i], value[j]) {
+					add("items %d and %d are equal, items must be unique", j, i)
+					break duplicates
+				}
+			}
+		}
+	}
+
+	// prefixItems (2020-12) or an items array (up to draft 2019-09) validate the leading items one by one, items or
+	// additionalItems the rest
+	prefix, _ := schema["prefixItems"].([]any)
+	rest, hasRest := schema["items"]
+	if tuple, ok := rest.([]any); ok {
+		prefix = tuple
+		rest, hasRest = schema["additionalItems"]
+	}
+	for i, item := range value {
+		itemPath := path + "/" + strconv.Itoa(i)
+		if i < len(prefix) {
+			violations = append(violations, s.validate(prefix[i], item, itemPath, depth)...)
+		} else if hasRest {
+			violations = append(violations, s.validate(rest, item, itemPath, depth)...)
+		}
+	}
+
+	if contains, ok := schema["contains"]; ok {
+		count := 0
+		for _, item := range value {
+			if len(s.validate(contains, item, path, depth)) == 0 {
+				count++
+			}
+		}
+		minContains := 1.0
+		if value, ok := schema["minContains"].(float64); ok {
+			minContains = value
+		}
+		if float64(count) < minContains {
+			add("must contain at least %v matching items, has %d", minContains, count)
+		}
+		if maxContains, ok := schema["maxContains"].(float64); ok && float64(count) > maxContains {
+			add("must contain at most %v matching items, has %d", maxContains, count)
+		}
+	}
+	return violations
+}
+
+func (s *JSONSchema) validateJSONObject(schema map[string]any, value map[string]any, path string, depth int) []SchemaViolation {
+	var violations []SchemaViolation
+	add := func(format string, args ...any) {
+		violations = append(violations, SchemaViolation{Path: path, Message: fmt.Sprintf(format, args...)})
+	}
+	if minProperties, ok := schema["minProperties"].(float64); ok && float64(len(value)) < minProperties {
+		add("must have at least %v properties", minProperties)
+	}
+	if maxProperties, ok := schema["maxProperties"].(float64); ok && float64(len(value)) > maxProperties {
+		add("must have at most %v properties", maxProperties)
+	}
+	if required, ok := schema["required"].([]any); ok {
+		for _, name := range required {
+			if name, ok := name.(string); ok {
+				if _, present := value[name]; !present {
+					add("missing required property %q", name)
+				}
+			}
+		}
+	}
+	dependentRequired, _ := schema["dependentRequired"].(map[string]any)
+	dependentSchemas, _ := schema["dependentSchemas"].(map[string]any)
+	// draft 7 and earlier combine both in dependencies
+	if dependencies, ok := schema["dependencies"].(map[string]any); ok {
+		for name, dependency := range dependencies {
+			if _, isList := dependency.([]any); isList {
+				dependentRequired = mapWith(dependentRequired, name, dependency)
+			} else {
+				dependentSchemas = mapWith(dependentSchemas, name, dependency)
+			}
+		}
+	}
+
+	properties, _ := schema["properties"].(map[string]any)
+	patternProperties, _ := schema["patternProperties"].(map[string]any)
+	additional, hasAdditional := schema["additionalProperties"]
+	propertyNames, hasPropertyNames := schema["propertyNames"]
+
+	names := make([]string, 0, len(value))
+	for name := range value {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		propertyValue := value[name]
+		propertyPath := path + "/" + escapeJSONPointer(name)
+		if hasPropertyNames {
+			for _, violation := range s.validate(propertyNames, name, propertyPath, depth) {
+				add("property name %q: %s", name, violation.Message)
+			}
+		}
+		if required, ok := dependentRequired[name].([]any); ok {
+			for _, other := range required {
+				if other, ok := other.(string); ok {
+					if _, present := value[other]; !present {
+						add("property %q requires property %q", name, other)
+					}
+				}
+			}
+		}
+		if dependentSchema, ok := dependentSchemas[name]; ok {
+			violations = append(violations, s.validate(dependentSchema, value, path, depth)...)
+		}
+
+		matched := false
+		if propertySchema, ok := properties[name]; ok {
+			matched = true
+			violations = append(violations, s.validate(propertySchema, propertyValue, propertyPath, depth)...)
+		}
+		for pattern, propertySchema := range patternProperties {
+			re, err := s.pattern(pattern)
+			if err == nil && re.MatchString(name) {
+				matched = true
+				violations = append(violations, s.validate(propertySchema, propertyValue, propertyPath, depth)...)
+			}
+		}
+		if !matched && hasAdditional {
+			if allowed, ok := additional.(bool); ok && !allowed {
+				violations = append(violations, SchemaViolation{Path: propertyPath, Message: fmt.Sprintf("property %q is not allowed", name)})
+				continue
+			}
+			violations = append(violations, s.validate(additional, propertyValue, propertyPath, depth)...)
+		}
+	}
+	return violations
+}
+
+func mapWith(m map[string]any, key string, value any) map[string]any {
+	if m == nil {
+		m = map[string]any{}
+	}
+	m[key] = value
+	return m
+}
+
+func jsonValueHasType(value any, typeName string) bool {
+	switch typeName {
+	case "null":
+		return value == nil
+	case "boolean":
+		_, ok := value.(bool)
+		return ok
+	case "object":
+		_, ok := value.(map[string]any)
+		return ok
+	case "array":
+		_, ok := value.([]any)
+		return ok
+	case "string":
+		_, ok := value.(string)
+		return ok
+	case "number":
+		_, ok := value.(float64)
+		return ok
+	case "integer":
+		number, ok := value.(float64)
+		return ok && number == math.Trunc(number) && !math.IsInf(number, 0)
+	}
+	return false
+}
+
+func jsonTypeName(value any) string {
+	switch typed := value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case map[string]any:
+		return "object"
+	case []any:
+		return "array"
+	case string:
+		return "string"
+	case float64:
+		if typed == math.Trunc(typed) {
+			return "integer"
+		}
+		return "number"
+	}
+	return fmt.Sprintf("%T", value)
+}
+
+func firstViolationMessage(violations []SchemaViolation) string {
+	if len(violations) == 0 {
+		return "no match"
+	}
+	if violations[0].Path == "" {
+		return violations[0].Message
+	}
+	return violations[0].Path + ": " + violations[0].Message
+}
+
+func compactJSON(value any) string {
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Sprintf("%v", value)
+	}
+	return string(encoded)
+}
+
+func escapeJSONPointer(token string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(token, "~", "~0"), "/", "~1")
+}
+
+// normalizeJSONValue converts decoded YAML (maps with any keys, integer numbers) to the types of decoded JSON.
+func normalizeJSONValue(value any) any {
+	switch typed := value.(type) {
+	case map[string]any:
+		normalized := make(map[string]any, len(typed))
+		for key, item := range typed {
+			normalized[key] = normalizeJSONValue(item)
+		}
+		return normalized
+	case map[any]any:
+		normalized := make(map[string]any, len(typed))
+		for key, item := range typed {
+			normalized[fmt.Sprintf("%v", key)] = normalizeJSONValue(item)
+		}
+		return normalized
+	case []any:
+		normalized := make([]any, len(typed))
+		for i, item := range typed {
+			normalized[i] = normalizeJSONValue(item)
+		}
+		return normalized
+	case int:
+		return float64(typed)
+	case int64:
+		return float64(typed)
+	case uint64:
+		return float64(typed)
+	case float32:
+		return float64(typed)
+	}
+	return value
+}
+
+// textPosition is a 1-based line and column (in characters) within a document.
+type textPosition struct {
+	Line   int
+	Column int
+}
+
+// decodeYAMLValue decodes the first YAML document of the content and returns it along with the positions of its
+// values by JSON pointer.
+func decodeYAMLValue(content []byte) (any, map[string]textPosition, error) {
+	var document yaml.Node
+	err := yaml.Unmarshal(content, &document)
+	if err != nil {
+		return nil, nil, err
+	}
+	if document.Kind == 0 {
+		// an empty document
+		return nil, map[string]textPosition{}, nil
+	}
+	var value any
+	err = document.Decode(&value)
+	if err != nil {
+		return nil, nil, err
+	}
+	positions := map[string]textPosition{}
+	collectYAMLPositions(&document, "", positions, 0)
+	return normalizeJSONValue(value), positions, nil
+}
+
+func collectYAMLPositions(node *yaml.Node, path string, positions map[string]textPosition, depth int) {
+	// aliases may point back at their parents
+	if depth > MAX_SCHEMA_REF_DEPTH {
+		return
+	}
+	switch node.Kind {
+	case yaml.DocumentNode:
+		if len(node.Content) > 0 {
+			collectYAMLPositions(node.Content[0], path, positions, depth+1)
+		}
+		return
+	case yaml.AliasNode:
+		positions[path] = textPosition{Line: node.Line, Column: node.Column}
+		if node.Alias != nil {
+			collectYAMLPositions(node.Alias, path, positions, depth+1)
+			positions[path] = textPosition{Line: node.Line, Column: node.Column}
+		}
+		return
+	}
+	positions[path] = textPosition{Line: node.Line, Column: node.Column}
+	switch node.Kind {
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key := node.Content[i].Value
+			collectYAMLPositions(node.Content[i+1], path+"/"+escapeJSONPointer(key), positions, depth+1)
+		}
+	case yaml.SequenceNode:
+		for i, item := range node.Content {
+			collectYAMLPositions(item, path+"/"+strconv.Itoa(i), positions, depth+1)
+		}
+	}
+}
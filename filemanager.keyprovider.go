@@ -0,0 +1,265 @@
+package filemanager
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+var (
+	ErrKeyNotFound    = errors.New("encryption key not found")
+	ErrInvalidKeySize = errors.New("encryption keys must be 32 bytes (AES-256)")
+)
+
+// KeyProvider wraps and unwraps the per-file data keys of an EncryptedStorage with master keys it manages
+// (envelope encryption). Keys can be chosen per tenant; tenant is "" for single-tenant setups.
+type KeyProvider interface {
+	Name() string
+	// WrapKey encrypts the data key with the current master key of the tenant and returns that key's ID.
+	WrapKey(tenant string, dataKey []byte) (keyID string, wrappedKey []byte, err error)
+	// UnwrapKey decrypts a data key wrapped by WrapKey, also with master keys that have since been rotated.
+	UnwrapKey(tenant string, keyID string, wrappedKey []byte) ([]byte, error)
+}
+
+// StaticKeyProvider wraps data keys with AES-256-GCM master keys held in memory. Rotate by adding a new key and
+// making it current; old keys stay in Keys until all files are rewrapped (EncryptedStorage.Rewrap).
+type StaticKeyProvider struct {
+	Keys         map[string][]byte // key ID -> 32 byte key
+	CurrentKeyID string
+	TenantKeyIDs map[string]string // tenant -> key ID, overrides CurrentKeyID
+}
+
+// NewEnvKeyProvider reads master keys from the environment: <prefix>_KEY_<id> holds a base64 encoded 32 byte key,
+// <prefix>_CURRENT_KEY the ID of the key for new files and <prefix>_TENANT_<tenant> the key ID of a tenant.
+// IDs and tenants are lowercased.
+func NewEnvKeyProvider(prefix string) (*StaticKeyProvider, error) {
+	provider := &StaticKeyProvider{
+		Keys:         make(map[string][]byte),
+		CurrentKeyID: strings.ToLower(os.Getenv(prefix + "_CURRENT_KEY")),
+		TenantKeyIDs: make(map[string]string),
+	}
+	for _, env := range os.Environ() {
+		name, value, _ := strings.Cut(env, "=")
+		switch {
+		case strings.HasPrefix(name, prefix+"_KEY_"):
+			key, err := base64.StdEncoding.DecodeString(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid key in %s: %v", name, err)
+			}
+			if len(key) != 32 {
+				return nil, fmt.Errorf("%w: %s", ErrInvalidKeySize, name)
+			}
+			provider.Keys[strings.ToLower(strings.TrimPrefix(name, prefix+"_KEY_"))] = key
+		case strings.HasPrefix(name, prefix+"_TENANT_"):
+			provider.TenantKeyIDs[strings.ToLower(strings.TrimPrefix(name, prefix+"_TENANT_"))] = strings.ToLower(value)
+		}
+	}
+	if _, ok := provider.Keys[provider.CurrentKeyID]; !ok {
+		return nil, fmt.Errorf("%w: %s_CURRENT_KEY(%s)", ErrKeyNotFound, prefix, provider.CurrentKeyID)
+	}
+	return provider, nil
+}
+
+func (p *StaticKeyProvider) Name() string {
+	return "static"
+}
+
+func (p *StaticKeyProvider) WrapKey(tenant string, dataKey []byte) (string, []byte, error) {
+	keyID := p.CurrentKeyID
+	if tenantKeyID, ok := p.TenantKeyIDs[strings.ToLower(tenant)]; ok {
+		keyID = tenantKeyID
+	}
+	masterKey, ok := p.Keys[keyID]
+	if !ok {
+		return "", nil, fmt.Errorf("%w: %s", ErrKeyNotFound, keyID)
+	}
+	wrapped, err := sealAESGCM(masterKey, dataKey, []byte(tenant))
+	return keyID, wrapped, err
+}
+
+func (p *StaticKeyProvider) UnwrapKey(tenant string, keyID string, wrappedKey []byte) ([]byte, error) {
+	masterKey, ok := p.Keys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrKeyNotFound, keyID)
+	}
+	return openAESGCM(masterKey, wrappedKey, []byte(tenant))
+}
+
+// sealAESGCM encrypts with AES-GCM and returns nonce + ciphertext.
+func sealAESGCM(key []byte, plaintext []byte, additionalData []byte) ([]byte, error) {
+	aead, err := newAESGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, additionalData), nil
+}
+
+func openAESGCM(key []byte, sealed []byte, additionalData []byte) ([]byte, error) {
+	aead, err := newAESGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+	return aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], additionalData)
+}
+
+func newAESGCM(key []byte) (cipher.AEAD, error) {
+	if len(key) != 32 {
+		return nil, ErrInvalidKeySize
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// AWSKMSKeyProvider wraps data keys with AWS KMS Encrypt/Decrypt, using the tenant as encryption context.
+// KMS rotates the key material of a key itself; to move files to another KMS key, change KeyID and rewrap.
+type AWSKMSKeyProvider struct {
+	Region       string
+	Credentials  AWSCredentials
+	KeyID        string            // key ID, ARN or alias/<name>
+	TenantKeyIDs map[string]string // tenant -> KMS key, overrides KeyID
+	Endpoint     string            // defaults to https://kms.<region>.amazonaws.com
+	Client       *http.Client
+}
+
+func (p *AWSKMSKeyProvider) Name() string {
+	return "aws_kms"
+}
+
+func (p *AWSKMSKeyProvider) WrapKey(tenant string, dataKey []byte) (string, []byte, error) {
+	keyID := p.KeyID
+	if tenantKeyID, ok := p.TenantKeyIDs[tenant]; ok {
+		keyID = tenantKeyID
+	}
+	var response struct {
+		CiphertextBlob []byte `json:"CiphertextBlob"`
+		KeyID          string `json:"KeyId"`
+	}
+	err := p.call("Encrypt", map[string]any{
+		"KeyId":             keyID,
+		"Plaintext":         dataKey,
+		"EncryptionContext": map[string]string{"tenant": tenant},
+	}, &response)
+	if err != nil {
+		return "", nil, err
+	}
+	return response.KeyID, response.CiphertextBlob, nil
+}
+
+func (p *AWSKMSKeyProvider) UnwrapKey(tenant string, keyID string, wrappedKey []byte) ([]byte, error) {
+	var response struct {
+		Plaintext []byte `json:"Plaintext"`
+	}
+	err := p.call("Decrypt", map[string]any{
+		"KeyId":             keyID,
+		"CiphertextBlob":    wrappedKey,
+		"EncryptionContext": map[string]string{"tenant": tenant},
+	}, &response)
+	return response.Plaintext, err
+}
+
+func (p *AWSKMSKeyProvider) call(action string, body any, result any) error {
+	endpoint := p.Endpoint
+	if endpoint == "" {
+		endpoint = "https://kms." + p.Region + ".amazonaws.com/"
+	}
+	// []byte fields are encoded as base64, as expected by KMS
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "TrentService."+action)
+	signAWSRequestV4(req, sha256Hex(payload), p.Region, "kms", p.Credentials, time.Now())
+	return doJSONRequest(p.Client, req, result)
+}
+
+// VaultKeyProvider wraps data keys with the transit secrets engine of HashiCorp Vault. Rotate with
+// "vault write -f transit/keys/<name>/rotate"; old key versions keep decrypting until their minimum decryption
+// version is raised, rewrap files before that.
+type VaultKeyProvider struct {
+	Address        string // e.g. https://vault.example.com:8200
+	Token          string
+	Namespace      string
+	MountPath      string // defaults to "transit"
+	KeyName        string
+	TenantKeyNames map[string]string // tenant -> transit key, overrides KeyName
+	Client         *http.Client
+}
+
+func (p *VaultKeyProvider) Name() string {
+	return "vault"
+}
+
+func (p *VaultKeyProvider) WrapKey(tenant string, dataKey []byte) (string, []byte, error) {
+	keyName := p.KeyName
+	if tenantKeyName, ok := p.TenantKeyNames[tenant]; ok {
+		keyName = tenantKeyName
+	}
+	var response struct {
+		Data struct {
+			Ciphertext string `json:"ciphertext"`
+		} `json:"data"`
+	}
+	err := postJSON(p.Client, p.url("encrypt", keyName), p.headers(), map[string]string{
+		"plaintext": base64.StdEncoding.EncodeToString(dataKey),
+	}, &response)
+	if err != nil {
+		return "", nil, err
+	}
+	return keyName, []byte(response.Data.Ciphertext), nil
+}
+
+func (p *VaultKeyProvider) UnwrapKey(tenant string, keyID string, wrappedKey []byte) ([]byte, error) {
+	var response struct {
+		Data struct {
+			Plaintext string `json:"plaintext"`
+		} `json:"data"`
+	}
+	err := postJSON(p.Client, p.url("decrypt", keyID), p.headers(), map[string]string{
+		"ciphertext": string(wrappedKey),
+	}, &response)
+	if err != nil {
+		return nil, err
+	}
+	return base64.StdEncoding.DecodeString(response.Data.Plaintext)
+}
+
+func (p *VaultKeyProvider) url(operation string, keyName string) string {
+	mountPath := p.MountPath
+	if mountPath == "" {
+		mountPath = "transit"
+	}
+	return strings.TrimSuffix(p.Address, "/") + "/v1/" + strings.Trim(mountPath, "/") + "/" + operation + "/" + keyName
+}
+
+func (p *VaultKeyProvider) headers() map[string]string {
+	headers := map[string]string{"X-Vault-Token": p.Token}
+	if p.Namespace != "" {
+		headers["X-Vault-Namespace"] = p.Namespace
+	}
+	return headers
+}
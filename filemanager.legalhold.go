@@ -0,0 +1,181 @@
+package filemanager
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+var (
+	ErrFileOnHold = errors.New("file is on legal hold")
+	ErrNoHold     = errors.New("file is not on hold")
+)
+
+// METADATA_KEY_LEGAL_HOLD holds the LegalHold of a file in the MetaData of its record, so holds are persisted by
+// every MetadataStore.
+const METADATA_KEY_LEGAL_HOLD = "legal_hold"
+
+// LegalHold makes a file immutable: DeleteFile, SaveFile and RestoreVersion refuse to delete or overwrite it with
+// ErrFileOnHold, recipe hooks cannot remove it and its previous versions are not pruned, until ReleaseHold lifts
+// the hold.
+type LegalHold struct {
+	Reason   string    `json:"reason"`
+	PlacedBy string    `json:"placedBy,omitempty"`
+	PlacedAt time.Time `json:"placedAt"`
+	// ProcessID is set for holds placed with PlaceProcessHold.
+	ProcessID string `json:"processId,omitempty"`
+}
+
+// PlaceHold puts the file at the local path on hold. Holds live in the record of the file in the metadata store,
+// which is required; files without a record get one.
+func (fm *FileManager) PlaceHold(localFilePath string, hold LegalHold) error {
+	store := fm.getMetadataStore()
+	if store == nil {
+		return ErrMetadataStoreMissing
+	}
+	record, err := store.LoadRecord(localFilePath)
+	if errors.Is(err, ErrMetadataNotFound) {
+		var file *ManagedFile
+		file, err = fm.LoadManagedFile(localFilePath)
+		if err != nil {
+			return err
+		}
+		err = fm.PersistManagedFile(file, nil)
+		if err != nil {
+			return err
+		}
+		record, err = store.LoadRecord(localFilePath)
+	}
+	if err != nil {
+		return err
+	}
+	return fm.saveHold(store, record, &hold)
+}
+
+// ReleaseHold lifts the hold of the file at the local path, failing with ErrNoHold if there is none.
+func (fm *FileManager) ReleaseHold(localFilePath string) error {
+	store := fm.getMetadataStore()
+	if store == nil {
+		return ErrMetadataStoreMissing
+	}
+	record, err := store.LoadRecord(localFilePath)
+	if errors.Is(err, ErrMetadataNotFound) {
+		return ErrNoHold
+	}
+	if err != nil {
+		return err
+	}
+	if holdOfRecord(record) == nil {
+		return ErrNoHold
+	}
+	return fm.saveHold(store, record, nil)
+}
+
+// GetHold returns the hold of the file at the local path, nil if it is not on hold.
+func (fm *FileManager) GetHold(localFilePath string) (*LegalHold, error) {
+	store := fm.getMetadataStore()
+	if store == nil {
+		return nil, nil
+	}
+	record, err := store.LoadRecord(localFilePath)
+	if errors.Is(err, ErrMetadataNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return holdOfRecord(record), nil
+}
+
+// PlaceProcessHold puts all files of a process on hold, the outputs whose records carry its process ID, and returns
+// their local paths.
+func (fm *FileManager) PlaceProcessHold(processID string, hold LegalHold) ([]string, error) {
+	hold.ProcessID = processID
+	return fm.updateProcessHolds(processID, &hold)
+}
+
+// ReleaseProcessHold lifts the holds placed with PlaceProcessHold and returns the local paths of the released
+// files. Holds placed on single files are kept.
+func (fm *FileManager) ReleaseProcessHold(processID string) ([]string, error) {
+	return fm.updateProcessHolds(processID, nil)
+}
+
+func (fm *FileManager) updateProcessHolds(processID string, hold *LegalHold) ([]string, error) {
+	store := fm.getMetadataStore()
+	if store == nil {
+		return nil, ErrMetadataStoreMissing
+	}
+	records, err := store.ListRecords()
+	if err != nil {
+		return nil, err
+	}
+	paths := []string{}
+	for _, record := range records {
+		if fmt.Sprint(record.MetaData["process_id"]) != processID {
+			continue
+		}
+		current := holdOfRecord(record)
+		if hold == nil && (current == nil || current.ProcessID != processID) {
+			continue
+		}
+		err = fm.saveHold(store, record, hold)
+		if err != nil {
+			return paths, err
+		}
+		paths = append(paths, record.LocalFilePath)
+	}
+	return paths, nil
+}
+
+func (fm *FileManager) saveHold(store MetadataStore, record *FileRecord, hold *LegalHold) error {
+	if record.MetaData == nil {
+		record.MetaData = make(map[string]any)
+	}
+	if hold == nil {
+		delete(record.MetaData, METADATA_KEY_LEGAL_HOLD)
+		fm.LogTo("INFO", fmt.Sprintf("[FileManager.ReleaseHold] Released hold of file(%s)\n", record.LocalFilePath))
+	} else {
+		if hold.PlacedAt.IsZero() {
+			hold.PlacedAt = time.Now()
+		}
+		record.MetaData[METADATA_KEY_LEGAL_HOLD] = hold
+		fm.LogTo("INFO", fmt.Sprintf("[FileManager.PlaceHold] Placed hold on file(%s): %s\n", record.LocalFilePath, hold.Reason))
+	}
+	record.UpdatedAt = time.Now()
+	return store.SaveRecord(record)
+}
+
+// holdOfRecord decodes the hold of a record, a *LegalHold before and a map after a round trip through the store.
+func holdOfRecord(record *FileRecord) *LegalHold {
+	value, ok := record.MetaData[METADATA_KEY_LEGAL_HOLD]
+	if !ok || value == nil {
+		return nil
+	}
+	if hold, ok := value.(*LegalHold); ok {
+		return hold
+	}
+	data, err := json.Marshal(value)
+	if err != nil {
+		return nil
+	}
+	hold := &LegalHold{}
+	err = json.Unmarshal(data, hold)
+	if err != nil {
+		return nil
+	}
+	return hold
+}
+
+// checkNotOnHold fails with ErrFileOnHold if the file at the local path is on hold. Errors of the store are
+// returned as they are, refusing the change rather than risking a held file.
+func (fm *FileManager) checkNotOnHold(localFilePath string) error {
+	hold, err := fm.GetHold(localFilePath)
+	if err != nil {
+		return err
+	}
+	if hold != nil {
+		return fmt.Errorf("%w: %s (%s)", ErrFileOnHold, localFilePath, hold.Reason)
+	}
+	return nil
+}
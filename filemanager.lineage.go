@@ -0,0 +1,138 @@
+package filemanager
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"time"
+)
+
+// METADATA_KEY_DERIVATION holds the FileDerivation of an output in its MetaData, so the lineage is persisted by
+// every MetadataStore.
+const METADATA_KEY_DERIVATION = "derived_from"
+
+// FileDerivation records how an output of ProcessFile was derived from its original.
+type FileDerivation struct {
+	// Original is the local path of the processed file, empty for files processed from memory.
+	Original  string `json:"original,omitempty"`
+	Recipe    string `json:"recipe,omitempty"`
+	ProcessID string `json:"processId"`
+	// Step is the plugin of the last processing step, whose file the output was written from, or "ResponsiveImages".
+	Step string `json:"step,omitempty"`
+	// Format is the output format the file was converted to, empty if it was stored as the step returned it.
+	Format    string    `json:"format,omitempty"`
+	DerivedAt time.Time `json:"derivedAt"`
+}
+
+// withDerivation returns a copy of the MetaData with the derivation, outputs of a process share their MetaData maps.
+func withDerivation(metaData map[string]any, derivation FileDerivation) map[string]any {
+	metaData = maps.Clone(metaData)
+	if metaData == nil {
+		metaData = make(map[string]any)
+	}
+	metaData[METADATA_KEY_DERIVATION] = &derivation
+	return metaData
+}
+
+// GetDerivation returns how the file at the local path was derived, nil for originals and files without a record.
+func (fm *FileManager) GetDerivation(localFilePath string) (*FileDerivation, error) {
+	store := fm.getMetadataStore()
+	if store == nil {
+		return nil, ErrMetadataStoreMissing
+	}
+	record, err := store.LoadRecord(localFilePath)
+	if errors.Is(err, ErrMetadataNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return derivationOfRecord(record), nil
+}
+
+// GetDerivedFiles returns the records of the outputs derived from the file at the local path, e.g. to re-process
+// or delete them with the original. Outputs derived from those outputs in turn are not included. Needs a metadata
+// store that can list its records.
+func (fm *FileManager) GetDerivedFiles(original string) ([]*FileRecord, error) {
+	store := fm.getMetadataStore()
+	if store == nil {
+		return nil, ErrMetadataStoreMissing
+	}
+	records, err := store.ListRecords()
+	if err != nil {
+		return nil, err
+	}
+	derived := []*FileRecord{}
+	for _, record := range records {
+		derivation := derivationOfRecord(record)
+		if derivation != nil && derivation.Original == original && record.LocalFilePath != original {
+			derived = append(derived, record)
+		}
+	}
+	return derived, nil
+}
+
+// DeleteDerivedFiles deletes the outputs derived from the file at the local path, and the outputs derived from
+// those, with DeleteFile, and returns their local paths. The original is kept. Derivatives deleted before are
+// skipped; a file on hold stops the deletion with ErrFileOnHold.
+func (fm *FileManager) DeleteDerivedFiles(original string) ([]string, error) {
+	deleted := []string{}
+	visited := map[string]bool{original: true}
+	queue := []string{original}
+	for len(queue) > 0 {
+		derived, err := fm.GetDerivedFiles(queue[0])
+		if err != nil {
+			return deleted, err
+		}
+		queue = queue[1:]
+		for _, record := range derived {
+			if visited[record.LocalFilePath] {
+				continue
+			}
+			visited[record.LocalFilePath] = true
+			queue = append(queue, record.LocalFilePath)
+			if !FileExists(record.LocalFilePath) {
+				continue
+			}
+			err = fm.DeleteFile(&ManagedFile{FileName: record.FileName, LocalFilePath: record.LocalFilePath, MetaData: record.MetaData})
+			if err != nil {
+				return deleted, fmt.Errorf("deleting derived file(%s): %w", record.LocalFilePath, err)
+			}
+			deleted = append(deleted, record.LocalFilePath)
+		}
+	}
+	fm.LogTo("INFO", fmt.Sprintf("[FileManager.DeleteDerivedFiles] Deleted %d files derived from file(%s)\n", len(deleted), original))
+	return deleted, nil
+}
+
+// isDerivedFrom reports whether the record of the file at the local path names original as its original.
+func (fm *FileManager) isDerivedFrom(localFilePath string, original string) bool {
+	if original == "" {
+		return false
+	}
+	derivation, err := fm.GetDerivation(localFilePath)
+	return err == nil && derivation != nil && derivation.Original == original
+}
+
+// derivationOfRecord decodes the derivation of a record, a *FileDerivation before and a map after a round trip
+// through the store.
+func derivationOfRecord(record *FileRecord) *FileDerivation {
+	value, ok := record.MetaData[METADATA_KEY_DERIVATION]
+	if !ok || value == nil {
+		return nil
+	}
+	if derivation, ok := value.(*FileDerivation); ok {
+		return derivation
+	}
+	data, err := json.Marshal(value)
+	if err != nil {
+		return nil
+	}
+	derivation := &FileDerivation{}
+	err = json.Unmarshal(data, derivation)
+	if err != nil {
+		return nil
+	}
+	return derivation
+}
@@ -0,0 +1,423 @@
+package filemanager
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+var (
+	ErrMetadataNotFound     = errors.New("metadata record not found")
+	ErrInvalidSQLTableName  = errors.New("invalid sql table name")
+	ErrMetadataStoreMissing = errors.New("no metadata store configured")
+)
+
+// SIDECAR_METADATA_SUFFIX is appended to a file path to form the path of its sidecar metadata file.
+const SIDECAR_METADATA_SUFFIX = ".meta.json"
+
+// FileRecord is the persisted state of a ManagedFile.
+type FileRecord struct {
+	LocalFilePath     string             `json:"localFilePath"`
+	FileName          string             `json:"fileName"`
+	MimeType          string             `json:"mimetype"`
+	URL               string             `json:"url"`
+	FileSize          int64              `json:"fileSize"`
+	Checksum          string             `json:"checksum"`
+	Owner             string             `json:"owner"`
+	MetaData          map[string]any     `json:"metaData"`
+	ProcessingHistory []ProcessingStatus `json:"processingHistory"`
+	HTTPHeaders       *HTTPHeaders       `json:"httpHeaders,omitempty"`
+	UpdatedAt         time.Time          `json:"updatedAt"`
+}
+
+// MetadataStore persists FileRecords keyed by the local file path.
+type MetadataStore interface {
+	SaveRecord(record *FileRecord) error
+	LoadRecord(localFilePath string) (*FileRecord, error) // returns ErrMetadataNotFound for unknown paths
+	DeleteRecord(localFilePath string) error
+	ListRecords() ([]*FileRecord, error)
+}
+
+// SetMetadataStore enables persisting metadata of processed files. ProcessFile stores a record for every output file.
+func (fm *FileManager) SetMetadataStore(store MetadataStore) {
+	if sidecars, ok := store.(*SidecarMetadataStore); ok {
+		sidecars.fm = fm
+	}
+	fm.mu.Lock()
+	defer fm.mu.Unlock()
+	fm.metadataStore = store
+}
+
+func (fm *FileManager) getMetadataStore() MetadataStore {
+	if fm.parent != nil {
+		return fm.parent.getMetadataStore()
+	}
+	fm.mu.RLock()
+	defer fm.mu.RUnlock()
+	return fm.metadataStore
+}
+
+// PersistManagedFile writes the metadata, checksum, owner and the processing history of the process (may be nil)
+// of a file to the metadata store.
+func (fm *FileManager) PersistManagedFile(file *ManagedFile, fileProcess *FileProcess) error {
+	store := fm.getMetadataStore()
+	if store == nil {
+		return ErrMetadataStoreMissing
+	}
+	file.UpdateFilesize()
+	if file.Checksum == "" {
+		checksum, err := file.ComputeChecksum()
+		if err != nil {
+			return err
+		}
+		file.Checksum = checksum
+	}
+	record := &FileRecord{
+		LocalFilePath: file.LocalFilePath,
+		FileName:      file.FileName,
+		MimeType:      file.MimeType,
+		URL:           file.URL,
+		FileSize:      file.FileSize,
+		Checksum:      file.Checksum,
+		Owner:         file.Owner,
+		MetaData:      file.MetaData,
+		HTTPHeaders:   file.HTTPHeaders,
+		UpdatedAt:     time.Now(),
+	}
+	if fileProcess != nil {
+		record.ProcessingHistory = fileProcess.UpdatesAfter(0)
+	}
+	// a hold outlives the MetaData of the ManagedFile
+	if _, ok := record.MetaData[METADATA_KEY_LEGAL_HOLD]; !ok {
+		if previous, err := store.LoadRecord(file.LocalFilePath); err == nil && holdOfRecord(previous) != nil {
+			metaData := make(map[string]any, len(record.MetaData)+1)
+			for key, value := range record.MetaData {
+				metaData[key] = value
+			}
+			metaData[METADATA_KEY_LEGAL_HOLD] = previous.MetaData[METADATA_KEY_LEGAL_HOLD]
+			record.MetaData = metaData
+		}
+	}
+	return store.SaveRecord(record)
+}
+
+// LoadFileRecord returns the persisted record of the file at the local path.
+func (fm *FileManager) LoadFileRecord(localFilePath string) (*FileRecord, error) {
+	err := fm.checkOwnsPath(localFilePath)
+	if err != nil {
+		return nil, err
+	}
+	store := fm.getMetadataStore()
+	if store == nil {
+		return nil, ErrMetadataStoreMissing
+	}
+	return store.LoadRecord(localFilePath)
+}
+
+// LoadManagedFile recreates a ManagedFile for a stored file including its persisted metadata.
+// Without a record the ManagedFile is built from the file on disk.
+func (fm *FileManager) LoadManagedFile(localFilePath string) (*ManagedFile, error) {
+	err := fm.checkOwnsPath(localFilePath)
+	if err != nil {
+		return nil, err
+	}
+	if !FileExists(localFilePath) {
+		return nil, ErrLocalFileNotFound
+	}
+	record, err := fm.LoadFileRecord(localFilePath)
+	if err != nil && !errors.Is(err, ErrMetadataNotFound) && !errors.Is(err, ErrMetadataStoreMissing) {
+		return nil, err
+	}
+	if record == nil {
+		file := &ManagedFile{
+			FileName:      filepath.Base(localFilePath),
+			LocalFilePath: localFilePath,
+			MetaData:      make(map[string]any),
+		}
+		file.UpdateFilesize()
+		file.UpdateMimeType()
+		file.URL, _ = fm.GetPublicUrlForFile(localFilePath)
+		return file, nil
+	}
+	metaData := record.MetaData
+	if metaData == nil {
+		metaData = make(map[string]any)
+	}
+	return &ManagedFile{
+		FileName:      record.FileName,
+		MimeType:      record.MimeType,
+		URL:           record.URL,
+		LocalFilePath: record.LocalFilePath,
+		FileSize:      record.FileSize,
+		Checksum:      record.Checksum,
+		Owner:         record.Owner,
+		MetaData:      metaData,
+		HTTPHeaders:   record.HTTPHeaders,
+	}, nil
+}
+
+// ComputeChecksum returns the hex encoded SHA-256 of the file content, read from disk if Content is not loaded.
+func (entity *ManagedFile) ComputeChecksum() (string, error) {
+	if len(entity.Content) > 0 || entity.LocalFilePath == "" {
+		sum := sha256.Sum256(entity.Content)
+		return hex.EncodeToString(sum[:]), nil
+	}
+	return checksumOfLocalFile(entity.LocalFilePath)
+}
+
+func checksumOfLocalFile(localFilePath string) (string, error) {
+	file, err := os.Open(localFilePath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	hash := sha256.New()
+	_, err = io.Copy(hash, file)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// SidecarMetadataStore stores each record as a JSON file. Without a directory the sidecar is placed next to the file
+// as <file>.meta.json, otherwise all sidecars are kept in the directory, named by the hash of the file path.
+type SidecarMetadataStore struct {
+	dir string
+	fm  *FileManager // set by SetMetadataStore, for the FilePermissions of the sidecars
+}
+
+// NewSidecarMetadataStore creates a sidecar store. Use a directory outside the public base path if sidecars must not be served.
+func NewSidecarMetadataStore(dir string) *SidecarMetadataStore {
+	return &SidecarMetadataStore{dir: dir}
+}
+
+func (s *SidecarMetadataStore) sidecarPath(localFilePath string) string {
+	if s.dir == "" {
+		return localFilePath + SIDECAR_METADATA_SUFFIX
+	}
+	sum := sha256.Sum256([]byte(localFilePath))
+	return filepath.Join(s.dir, hex.EncodeToString(sum[:])+SIDECAR_METADATA_SUFFIX)
+}
+
+func (s *SidecarMetadataStore) SaveRecord(record *FileRecord) error {
+	data, err := json.MarshalIndent(record, "", "  ")
+	if err != nil {
+		return err
+	}
+	sidecarPath := s.sidecarPath(record.LocalFilePath)
+	var perms FilePermissions
+	if s.fm != nil {
+		perms = s.fm.getFilePermissions()
+	}
+	err = mkdirAllMode(filepath.Dir(sidecarPath), perms.dirMode())
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(sidecarPath, data, perms.fileModeOr(0644))
+}
+
+func (s *SidecarMetadataStore) LoadRecord(localFilePath string) (*FileRecord, error) {
+	data, err := os.ReadFile(s.sidecarPath(localFilePath))
+	if os.IsNotExist(err) {
+		return nil, ErrMetadataNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	record := &FileRecord{}
+	err = json.Unmarshal(data, record)
+	if err != nil {
+		return nil, err
+	}
+	return record, nil
+}
+
+func (s *SidecarMetadataStore) DeleteRecord(localFilePath string) error {
+	err := os.Remove(s.sidecarPath(localFilePath))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// ListRecords is only supported with a sidecar directory; sidecars placed next to files cannot be enumerated.
+func (s *SidecarMetadataStore) ListRecords() ([]*FileRecord, error) {
+	if s.dir == "" {
+		return nil, fmt.Errorf("listing records requires a sidecar directory")
+	}
+	entries, err := os.ReadDir(s.dir)
+	if os.IsNotExist(err) {
+		return []*FileRecord{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	records := []*FileRecord{}
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), SIDECAR_METADATA_SUFFIX) {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(s.dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		record := &FileRecord{}
+		err = json.Unmarshal(data, record)
+		if err != nil {
+			continue
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+// SQLPlaceholderStyle selects how query parameters are written for the database driver in use.
+type SQLPlaceholderStyle int
+
+const (
+	SQLPlaceholderQuestion SQLPlaceholderStyle = iota // ? (MySQL, SQLite)
+	SQLPlaceholderDollar                              // $1 (PostgreSQL)
+)
+
+var sqlTableNameRegex = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_.]*$`)
+
+// SQLMetadataStore stores records in a database table using database/sql. Metadata and processing history are
+// stored as JSON text columns.
+type SQLMetadataStore struct {
+	db          *sql.DB
+	table       string
+	placeholder SQLPlaceholderStyle
+}
+
+// NewSQLMetadataStore creates a store on an open database. Call EnsureSchema to create the table if needed.
+func NewSQLMetadataStore(db *sql.DB, table string, placeholder SQLPlaceholderStyle) (*SQLMetadataStore, error) {
+	if !sqlTableNameRegex.MatchString(table) {
+		return nil, ErrInvalidSQLTableName
+	}
+	return &SQLMetadataStore{db: db, table: table, placeholder: placeholder}, nil
+}
+
+// EnsureSchema creates the records table if it does not exist.
+func (s *SQLMetadataStore) EnsureSchema() error {
+	_, err := s.db.Exec(`CREATE TABLE IF NOT EXISTS ` + s.table + ` (
+	local_file_path VARCHAR(1024) PRIMARY KEY,
+	file_name TEXT NOT NULL,
+	mime_type TEXT NOT NULL,
+	url TEXT NOT NULL,
+	file_size BIGINT NOT NULL,
+	checksum TEXT NOT NULL,
+	owner TEXT NOT NULL,
+	meta_data TEXT NOT NULL,
+	processing_history TEXT NOT NULL,
+	updated_at BIGINT NOT NULL
+)`)
+	return err
+}
+
+func (s *SQLMetadataStore) params(count int) []string {
+	params := make([]string, count)
+	for i := range params {
+		if s.placeholder == SQLPlaceholderDollar {
+			params[i] = fmt.Sprintf("$%d", i+1)
+		} else {
+			params[i] = "?"
+		}
+	}
+	return params
+}
+
+const sqlMetadataColumns = "local_file_path, file_name, mime_type, url, file_size, checksum, owner, meta_data, processing_history, updated_at"
+
+func (s *SQLMetadataStore) SaveRecord(record *FileRecord) error {
+	metaData, err := json.Marshal(record.MetaData)
+	if err != nil {
+		return err
+	}
+	history, err := json.Marshal(record.ProcessingHistory)
+	if err != nil {
+		return err
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("DELETE FROM "+s.table+" WHERE local_file_path = "+s.params(1)[0], record.LocalFilePath)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("INSERT INTO "+s.table+" ("+sqlMetadataColumns+") VALUES ("+strings.Join(s.params(10), ", ")+")",
+		record.LocalFilePath, record.FileName, record.MimeType, record.URL, record.FileSize, record.Checksum, record.Owner,
+		string(metaData), string(history), record.UpdatedAt.UnixMilli())
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *SQLMetadataStore) LoadRecord(localFilePath string) (*FileRecord, error) {
+	row := s.db.QueryRow("SELECT "+sqlMetadataColumns+" FROM "+s.table+" WHERE local_file_path = "+s.params(1)[0], localFilePath)
+	record, err := scanFileRecord(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrMetadataNotFound
+	}
+	return record, err
+}
+
+func (s *SQLMetadataStore) DeleteRecord(localFilePath string) error {
+	_, err := s.db.Exec("DELETE FROM "+s.table+" WHERE local_file_path = "+s.params(1)[0], localFilePath)
+	return err
+}
+
+func (s *SQLMetadataStore) ListRecords() ([]*FileRecord, error) {
+	rows, err := s.db.Query("SELECT " + sqlMetadataColumns + " FROM " + s.table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	records := []*FileRecord{}
+	for rows.Next() {
+		record, err := scanFileRecord(rows)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+	return records, rows.Err()
+}
+
+type sqlRowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanFileRecord(row sqlRowScanner) (*FileRecord, error) {
+	record := &FileRecord{}
+	var metaData, history string
+	var updatedAt int64
+	err := row.Scan(&record.LocalFilePath, &record.FileName, &record.MimeType, &record.URL, &record.FileSize,
+		&record.Checksum, &record.Owner, &metaData, &history, &updatedAt)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal([]byte(metaData), &record.MetaData)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal([]byte(history), &record.ProcessingHistory)
+	if err != nil {
+		return nil, err
+	}
+	record.UpdatedAt = time.UnixMilli(updatedAt)
+	return record, nil
+}
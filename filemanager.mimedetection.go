@@ -0,0 +1,216 @@
+package filemanager
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/gabriel-vasile/mimetype"
+)
+
+// DEFAULT_MIME_READ_LIMIT is how many leading bytes of a file are inspected to detect its MIME type, the default of
+// the mimetype library.
+const DEFAULT_MIME_READ_LIMIT = 3072
+
+var (
+	ErrInvalidMimeDetection = errors.New("invalid MIME detection options")
+)
+
+// MimeDetectionOptions tune how a FileManager detects MIME types, for formats the defaults misdetect.
+type MimeDetectionOptions struct {
+	// ReadLimit is how many leading bytes are inspected, DEFAULT_MIME_READ_LIMIT by default. Formats identified by
+	// content further into the file, like Office documents whose identifying zip entry is not the first one, need
+	// more.
+	ReadLimit int `yaml:"read_limit"`
+	// Extensions map file extensions, like ".ifc", to the MIME type of files with them, which replaces the detected
+	// one. The extension is trusted, so only map formats the content does not identify, not ones uploads must be
+	// checked for.
+	Extensions map[string]string `yaml:"extensions"`
+	// Aliases map MIME types to the canonical type they stand for, like "application/x-pdf" to "application/pdf".
+	// Detected types are replaced by theirs, and the accepted MIME types of recipes and the declared types of
+	// upload sessions are compared by theirs.
+	Aliases map[string]string `yaml:"aliases"`
+}
+
+func (opts MimeDetectionOptions) validate() error {
+	if opts.ReadLimit < 0 {
+		return fmt.Errorf("%w: read limit %d", ErrInvalidMimeDetection, opts.ReadLimit)
+	}
+	for extension, mimeType := range opts.Extensions {
+		if strings.TrimPrefix(extension, ".") == "" || strings.ContainsAny(extension, `/\`) {
+			return fmt.Errorf("%w: extension %q", ErrInvalidMimeDetection, extension)
+		}
+		if _, _, err := mime.ParseMediaType(mimeType); err != nil {
+			return fmt.Errorf("%w: MIME type %q of extension %s: %v", ErrInvalidMimeDetection, mimeType, extension, err)
+		}
+	}
+	for alias, mimeType := range opts.Aliases {
+		if _, _, err := mime.ParseMediaType(alias); err != nil {
+			return fmt.Errorf("%w: alias %q: %v", ErrInvalidMimeDetection, alias, err)
+		}
+		if _, _, err := mime.ParseMediaType(mimeType); err != nil {
+			return fmt.Errorf("%w: MIME type %q of alias %s: %v", ErrInvalidMimeDetection, mimeType, alias, err)
+		}
+	}
+	return nil
+}
+
+// withDefaults sets the default read limit and lowercases the extensions and aliases, giving extensions their dot.
+func (opts MimeDetectionOptions) withDefaults() MimeDetectionOptions {
+	if opts.ReadLimit == 0 {
+		opts.ReadLimit = DEFAULT_MIME_READ_LIMIT
+	}
+	extensions := make(map[string]string, len(opts.Extensions))
+	for extension, mimeType := range opts.Extensions {
+		extensions["."+strings.ToLower(strings.TrimPrefix(extension, "."))] = mimeType
+	}
+	opts.Extensions = extensions
+	aliases := make(map[string]string, len(opts.Aliases))
+	for alias, mimeType := range opts.Aliases {
+		aliases[strings.ToLower(alias)] = mimeType
+	}
+	opts.Aliases = aliases
+	return opts
+}
+
+// mimeReadLimit is the read limit of the mimetype library, the largest one of every FileManager. FileManagers with
+// a smaller one truncate the content they detect.
+var mimeReadLimit = struct {
+	sync.Mutex
+	limit int
+}{limit: DEFAULT_MIME_READ_LIMIT}
+
+func raiseMimeReadLimit(limit int) {
+	mimeReadLimit.Lock()
+	defer mimeReadLimit.Unlock()
+	if limit > mimeReadLimit.limit {
+		mimeReadLimit.limit = limit
+		mimetype.SetLimit(uint32(limit))
+	}
+}
+
+// SetMimeDetection replaces the MIME detection options of the FileManager, used for uploads, ingested, reprocessed
+// and stored files and by the helpers creating ManagedFiles. Tenant views share the setting of their FileManager.
+// The package level GuessMimeType keeps the defaults.
+func (fm *FileManager) SetMimeDetection(opts MimeDetectionOptions) error {
+	err := opts.validate()
+	if err != nil {
+		return err
+	}
+	opts = opts.withDefaults()
+	raiseMimeReadLimit(opts.ReadLimit)
+	root := fm.root()
+	root.mu.Lock()
+	defer root.mu.Unlock()
+	root.mimeDetection = &opts
+	return nil
+}
+
+func (fm *FileManager) getMimeDetection() MimeDetectionOptions {
+	root := fm.root()
+	root.mu.RLock()
+	defer root.mu.RUnlock()
+	if root.mimeDetection == nil {
+		return MimeDetectionOptions{ReadLimit: DEFAULT_MIME_READ_LIMIT}
+	}
+	return *root.mimeDetection
+}
+
+// mimeReadSize is how many leading bytes of a file DetectMimeType inspects.
+func (fm *FileManager) mimeReadSize() int {
+	return fm.getMimeDetection().ReadLimit
+}
+
+// DetectMimeType returns the MIME type of a file with the name and content: the one of its extension if the
+// options of SetMimeDetection map it, the detected one otherwise, replaced by its canonical type.
+func (fm *FileManager) DetectMimeType(fileName string, content []byte) string {
+	opts := fm.getMimeDetection()
+	if mimeType, ok := opts.Extensions[strings.ToLower(filepath.Ext(fileName))]; ok {
+		return canonicalMimeType(mimeType, opts.Aliases)
+	}
+	if len(content) > opts.ReadLimit {
+		content = content[:opts.ReadLimit]
+	}
+	return canonicalMimeType(mimetype.Detect(content).String(), opts.Aliases)
+}
+
+// DetectFileMimeType is DetectMimeType for a file on the local disk, reading only what is inspected.
+func (fm *FileManager) DetectFileMimeType(localPath string) (string, error) {
+	file, err := os.Open(localPath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	header, err := io.ReadAll(io.LimitReader(file, int64(fm.mimeReadSize())))
+	if err != nil {
+		return "", err
+	}
+	return fm.DetectMimeType(localPath, header), nil
+}
+
+// CanonicalMimeType returns the MIME type the alias stands for, see MimeDetectionOptions.Aliases, keeping its
+// parameters. Other MIME types are returned as they are.
+func (fm *FileManager) CanonicalMimeType(mimeType string) string {
+	return canonicalMimeType(mimeType, fm.getMimeDetection().Aliases)
+}
+
+func canonicalMimeType(mimeType string, aliases map[string]string) string {
+	base, params, hasParams := strings.Cut(mimeType, ";")
+	canonical, ok := aliases[strings.ToLower(strings.TrimSpace(base))]
+	if !ok {
+		return mimeType
+	}
+	if hasParams {
+		return canonical + ";" + params
+	}
+	return canonical
+}
+
+// acceptsMimeType is isValidMimeType comparing the canonical MIME types.
+func (fm *FileManager) acceptsMimeType(mimeType string, acceptedMimeTypes []string, strict bool) bool {
+	aliases := fm.getMimeDetection().Aliases
+	if len(aliases) == 0 {
+		return isValidMimeType(mimeType, acceptedMimeTypes, strict)
+	}
+	accepted := make([]string, len(acceptedMimeTypes))
+	for i, acceptedMimeType := range acceptedMimeTypes {
+		accepted[i] = canonicalMimeType(acceptedMimeType, aliases)
+	}
+	return isValidMimeType(canonicalMimeType(mimeType, aliases), accepted, strict)
+}
+
+// extensionForMimeType returns the extension of files of the MIME type: the first one the options of
+// SetMimeDetection map to it, the one known for it otherwise, "" if there is none or the type is unknown.
+func (fm *FileManager) extensionForMimeType(mimeType string) string {
+	opts := fm.getMimeDetection()
+	mimeType = canonicalMimeType(mimeType, opts.Aliases)
+	base, _, _ := strings.Cut(mimeType, ";")
+	base = strings.ToLower(strings.TrimSpace(base))
+	var extensions []string
+	for extension, extensionMimeType := range opts.Extensions {
+		extensionBase, _, _ := strings.Cut(canonicalMimeType(extensionMimeType, opts.Aliases), ";")
+		if strings.EqualFold(strings.TrimSpace(extensionBase), base) {
+			extensions = append(extensions, extension)
+		}
+	}
+	if len(extensions) > 0 {
+		sort.Strings(extensions)
+		return extensions[0]
+	}
+	if base == "application/octet-stream" {
+		return ""
+	}
+	if known := mimetype.Lookup(base); known != nil && known.Extension() != "" {
+		return known.Extension()
+	}
+	if extensions, err := mime.ExtensionsByType(base); err == nil && len(extensions) > 0 {
+		return extensions[0]
+	}
+	return ""
+}
@@ -0,0 +1,61 @@
+package filemanager
+
+import (
+	"errors"
+	"fmt"
+	"mime"
+	"path"
+	"strings"
+)
+
+var (
+	ErrInvalidMimePattern = errors.New("invalid MIME type pattern")
+)
+
+// isMimeGlob reports whether the accepted MIME type is a glob pattern like "image/*" or "*/*+json".
+func isMimeGlob(pattern string) bool {
+	return strings.ContainsAny(pattern, "*?[")
+}
+
+// matchMimeType reports whether the MIME type matches the accepted MIME type pattern, ignoring case and the
+// parameters of the MIME type:
+//   - glob patterns match type and subtype separately, like "image/*", "*/*+json" or "application/vnd.ms-*"
+//   - other patterns match the exact type, or any type they are a prefix of (like "image/") unless strict is set
+func matchMimeType(pattern string, mimeType string, strict bool) bool {
+	pattern = strings.ToLower(strings.TrimSpace(pattern))
+	base, _, _ := strings.Cut(mimeType, ";")
+	base = strings.ToLower(strings.TrimSpace(base))
+	if isMimeGlob(pattern) {
+		matched, err := path.Match(pattern, base)
+		return err == nil && matched
+	}
+	if strict {
+		return base == pattern
+	}
+	return strings.HasPrefix(strings.ToLower(mimeType), pattern)
+}
+
+// validateMimePatterns checks the glob patterns of accepted MIME types, and with strict that every pattern is a
+// full type/subtype.
+func validateMimePatterns(patterns []string, strict bool) error {
+	for _, pattern := range patterns {
+		pattern = strings.TrimSpace(pattern)
+		if isMimeGlob(pattern) {
+			mediaType, subtype, ok := strings.Cut(pattern, "/")
+			if !ok || mediaType == "" || subtype == "" || strings.Contains(subtype, "/") {
+				return fmt.Errorf("%w: %q is not a type/subtype pattern", ErrInvalidMimePattern, pattern)
+			}
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("%w: %q: %v", ErrInvalidMimePattern, pattern, err)
+			}
+			continue
+		}
+		if strict {
+			mediaType, params, err := mime.ParseMediaType(pattern)
+			if err != nil || len(params) > 0 || !strings.Contains(mediaType, "/") {
+				return fmt.Errorf("%w: %q is not a type/subtype", ErrInvalidMimePattern, pattern)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+package filemanager
+
+import (
+	"errors"
+	"fmt"
+)
+
+// DEFAULT_MMAP_MIN_FILE_SIZE is the size from which files are memory-mapped once EnableMemoryMappedReads is called.
+const DEFAULT_MMAP_MIN_FILE_SIZE = 64 * 1024 * 1024
+
+var (
+	ErrInvalidMemoryMap = errors.New("invalid memory map options")
+)
+
+// MemoryMapOptions control EnableMemoryMappedReads.
+type MemoryMapOptions struct {
+	// MinFileSize is the size in bytes from which files are mapped, DEFAULT_MMAP_MIN_FILE_SIZE by default. Smaller
+	// files are read as usual.
+	MinFileSize int64 `yaml:"min_file_size"`
+}
+
+func (opts MemoryMapOptions) validate() error {
+	if opts.MinFileSize < 0 {
+		return fmt.Errorf("%w: min file size %d", ErrInvalidMemoryMap, opts.MinFileSize)
+	}
+	return nil
+}
+
+// EnableMemoryMappedReads makes HandleFileUpload, ReprocessFile and Reconcile memory-map large files in the local
+// storage into the Content of their ManagedFile instead of reading them, see ManagedFile.MapContent. Plugins with
+// random access to multi-hundred-MB inputs, like PDFs and video containers, then only page in what they touch.
+// Release the content of uploads with ManagedFile.ReleaseContent once done with them; DiscardUpload and the
+// AutoDelete of the upload cleanup do so. Tenant views share the setting of their FileManager.
+func (fm *FileManager) EnableMemoryMappedReads(opts MemoryMapOptions) error {
+	err := opts.validate()
+	if err != nil {
+		return err
+	}
+	if opts.MinFileSize == 0 {
+		opts.MinFileSize = DEFAULT_MMAP_MIN_FILE_SIZE
+	}
+	root := fm.root()
+	root.mu.Lock()
+	defer root.mu.Unlock()
+	root.memoryMap = &opts
+	return nil
+}
+
+// readContent loads the content of a stored file, memory-mapped if it is large enough and in the local storage.
+func (fm *FileManager) readContent(file *ManagedFile) error {
+	root := fm.root()
+	root.mu.RLock()
+	memoryMap := root.memoryMap
+	root.mu.RUnlock()
+	if memoryMap != nil && fm.usesLocalStorage(file.LocalFilePath) {
+		info, err := fm.GetStorage().Stat(file.LocalFilePath)
+		if err != nil {
+			return err
+		}
+		if info.Size() >= memoryMap.MinFileSize {
+			return file.MapContent()
+		}
+	}
+	content, err := fm.GetStorage().ReadFile(file.LocalFilePath)
+	if err != nil {
+		return err
+	}
+	file.Content = content
+	return nil
+}
+
+// MapContent memory-maps the local file into Content instead of reading it, so its pages are loaded as they are
+// accessed and can be dropped again under memory pressure. The mapping is copy-on-write: changing Content does not
+// change the file. Content must not be used after ReleaseContent, nor the file truncated while it is mapped.
+// Platforms without mmap read the file.
+func (entity *ManagedFile) MapContent() error {
+	if entity.LocalFilePath == "" {
+		return ErrLocalFileNotFound
+	}
+	err := entity.ReleaseContent()
+	if err != nil {
+		return err
+	}
+	data, mapped, err := mmapFile(entity.LocalFilePath)
+	if err != nil {
+		return err
+	}
+	entity.Content = data
+	entity.FileSize = int64(len(data))
+	if mapped {
+		entity.mapping = data
+	}
+	return nil
+}
+
+// ReleaseContent unmaps the content mapped by MapContent and clears Content if it still is the mapping. It does
+// nothing for content that is not mapped.
+func (entity *ManagedFile) ReleaseContent() error {
+	if entity.mapping == nil {
+		return nil
+	}
+	if len(entity.Content) > 0 && &entity.Content[0] == &entity.mapping[0] {
+		entity.Content = nil
+	}
+	mapping := entity.mapping
+	entity.mapping = nil
+	return munmapFile(mapping)
+}
+
+// ContentMapped reports whether Content is memory-mapped.
+func (entity *ManagedFile) ContentMapped() bool {
+	return entity.mapping != nil
+}
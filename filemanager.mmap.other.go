@@ -0,0 +1,15 @@
+//go:build !unix
+
+package filemanager
+
+import "os"
+
+// mmapFile reads the file on platforms without mmap.
+func mmapFile(path string) ([]byte, bool, error) {
+	data, err := os.ReadFile(path)
+	return data, false, err
+}
+
+func munmapFile(data []byte) error {
+	return nil
+}
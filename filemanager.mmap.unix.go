@@ -0,0 +1,38 @@
+//go:build unix
+
+package filemanager
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// mmapFile maps the file copy-on-write and reports whether it did; empty files are not mapped.
+func mmapFile(path string) ([]byte, bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, false, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, false, err
+	}
+	size := info.Size()
+	if size == 0 {
+		return []byte{}, false, nil
+	}
+	if int64(int(size)) != size {
+		return nil, false, fmt.Errorf("file(%s) too large to map: %d bytes", path, size)
+	}
+	data, err := syscall.Mmap(int(f.Fd()), 0, int(size), syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_PRIVATE)
+	if err != nil {
+		return nil, false, &os.PathError{Op: "mmap", Path: path, Err: err}
+	}
+	return data, true, nil
+}
+
+func munmapFile(data []byte) error {
+	return syscall.Munmap(data)
+}
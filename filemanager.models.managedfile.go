@@ -11,9 +11,13 @@ type ManagedFile struct {
 	URL              string         `json:"url"`
 	LocalFilePath    string         `json:"localFilePath"`
 	FileSize         int64          `json:"fileSize"`
+	Checksum         string         `json:"checksum,omitempty"` // hex encoded SHA-256 of the content
+	Owner            string         `json:"owner,omitempty"`
 	MetaData         map[string]any `json:"metaData"`
 	ProcessingErrors []string       `json:"processingErrors"`
+	HTTPHeaders      *HTTPHeaders   `json:"httpHeaders,omitempty"` // stored with the file by FileManager.SaveFile
 	Content          []byte         `json:"-"`
+	mapping          []byte         // set while Content is memory-mapped, see MapContent
 }
 
 func (entity *ManagedFile) GetFileName() string {
@@ -48,11 +52,17 @@ func (entity *ManagedFile) UpdateFilesize() int64 {
 }
 
 func (entity *ManagedFile) EnsureFileIsLocal(fm *FileManager, target FileStorageType) (file *ManagedFile, err error) {
+	return entity.EnsureFileIsLocalWithOptions(fm, target, ThrottleOptions{})
+}
+
+// EnsureFileIsLocalWithOptions is EnsureFileIsLocal with a bandwidth limit for the download, in addition to the
+// FileManager's download rate limit.
+func (entity *ManagedFile) EnsureFileIsLocalWithOptions(fm *FileManager, target FileStorageType, opts ThrottleOptions) (file *ManagedFile, err error) {
 	if entity.LocalFilePath == "" || (entity.LocalFilePath != "" && !FileExists(entity.LocalFilePath)) {
 
 		// decide where to download the file to based on the target var and get the respective local path from the FileManager
 		localFilePath := fm.GetLocalPathForFile(target, entity.FileName)
-		err = DownloadFileFromUrl(entity.URL, localFilePath)
+		err = fm.DownloadFile(entity.URL, localFilePath, opts)
 		if err != nil {
 			return file, err
 		}
@@ -92,29 +102,36 @@ func (entity *ManagedFile) GetMetaData(key string) (value any) {
 	return nil
 }
 
+// SaveOptions control how ManagedFile.SaveWithOptions writes the file.
+type SaveOptions struct {
+	NoOverwrite bool        // fail with ErrFileExists instead of replacing an existing file
+	FileMode    os.FileMode // defaults to 0644
+	DirMode     os.FileMode // of created directories, defaults to DEFAULT_DIR_MODE
+}
+
+// Save writes the content to LocalFilePath atomically, replacing an existing file.
 func (file *ManagedFile) Save() error {
-	// Create the directory if it doesn't exist
-	dirs := filepath.Dir(file.LocalFilePath)
-	err := os.MkdirAll(dirs, os.ModePerm)
-	if err != nil {
-		return err
-	}
+	return file.SaveWithOptions(SaveOptions{})
+}
 
-	// Open the file for writing
-	outputFile, err := os.Create(file.LocalFilePath)
-	if err != nil {
-		return err
+// SaveWithOptions writes the content to a temporary file in the destination directory, syncs it and moves it into
+// place, so a crash never leaves a partially written file at LocalFilePath.
+func (file *ManagedFile) SaveWithOptions(opts SaveOptions) error {
+	mode := opts.FileMode
+	if mode == 0 {
+		mode = 0644
 	}
-	defer outputFile.Close()
-
-	// Write the file content to the output file
-	_, err = outputFile.Write(file.Content)
+	dirMode := opts.DirMode
+	if dirMode == 0 {
+		dirMode = DEFAULT_DIR_MODE
+	}
+	err := writeFileAtomic(file.LocalFilePath, file.Content, mode, dirMode, opts.NoOverwrite)
 	if err != nil {
 		return err
 	}
 
 	// Update the file metadata
-	file.FileSize = file.UpdateFilesize()
+	file.FileSize = int64(len(file.Content))
 	file.MimeType = file.UpdateMimeType()
 
 	return nil
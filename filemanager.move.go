@@ -0,0 +1,209 @@
+package filemanager
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// DEFAULT_DIR_MODE is the mode of directories created for moved files.
+const DEFAULT_DIR_MODE os.FileMode = 0755
+
+// FilePermissions control the modes of files moved and written by the FileManager (outputs moved into their storage,
+// saved files, files moved into place by CreateManagedFileFromPath, archived versions, the trash, metadata sidecars,
+// hot folders) and of the directories created for them. Modes are written as octal numbers in a config file, e.g. file_mode: 0640.
+type FilePermissions struct {
+	// FileMode is set on moved and written files. 0 keeps the mode moved files had and writes files with the mode
+	// of their kind, like 0644 for saved files.
+	FileMode os.FileMode `yaml:"file_mode"`
+	// DirMode is the mode of created directories, DEFAULT_DIR_MODE by default.
+	DirMode os.FileMode `yaml:"dir_mode"`
+	// Umask is cleared from FileMode and DirMode. The modes are set explicitly, so the umask of the process does not
+	// apply to them.
+	Umask os.FileMode `yaml:"umask"`
+}
+
+func (perms FilePermissions) validate() error {
+	for _, mode := range []struct {
+		key  string
+		mode os.FileMode
+	}{{"file_mode", perms.FileMode}, {"dir_mode", perms.DirMode}, {"umask", perms.Umask}} {
+		if mode.mode&^os.ModePerm != 0 {
+			return fmt.Errorf("%s %#o is not a permission mode", mode.key, uint32(mode.mode))
+		}
+	}
+	return nil
+}
+
+func (perms FilePermissions) fileMode() os.FileMode {
+	return perms.FileMode &^ perms.Umask
+}
+
+// fileModeOr is the FileMode for written files, which get the fallback mode if none is set.
+func (perms FilePermissions) fileModeOr(fallback os.FileMode) os.FileMode {
+	if mode := perms.fileMode(); mode != 0 {
+		return mode
+	}
+	return fallback &^ perms.Umask
+}
+
+func (perms FilePermissions) dirMode() os.FileMode {
+	mode := perms.DirMode
+	if mode == 0 {
+		mode = DEFAULT_DIR_MODE
+	}
+	return mode &^ perms.Umask
+}
+
+// SetFilePermissions sets the modes of moved files and of the directories created for them. Tenant views share the
+// permissions of their FileManager.
+func (fm *FileManager) SetFilePermissions(perms FilePermissions) error {
+	err := perms.validate()
+	if err != nil {
+		return err
+	}
+	root := fm.root()
+	root.mu.Lock()
+	defer root.mu.Unlock()
+	root.filePermissions = perms
+	return nil
+}
+
+func (fm *FileManager) getFilePermissions() FilePermissions {
+	root := fm.root()
+	root.mu.RLock()
+	defer root.mu.RUnlock()
+	return root.filePermissions
+}
+
+// MoveFile moves a file on the local disk, creating the directories of the destination with the configured
+// DirMode and giving the file the configured FileMode. Moves across file systems, where a rename fails with
+// EXDEV (a temp path on tmpfs, a trash on another volume), fall back to copying the file next to the destination,
+// syncing it, renaming it into place and removing the source; the copy keeps the owner (where permitted) and the
+// modification time of the source. An existing destination is replaced. Tenant views only move their own files.
+func (fm *FileManager) MoveFile(src string, dst string) error {
+	for _, path := range []string{src, dst} {
+		err := fm.checkOwnsPath(path)
+		if err != nil {
+			return err
+		}
+	}
+	return fm.moveFile(src, dst)
+}
+
+// moveFile is MoveFile for the FileManager's own moves, like into the shared trash, which tenant views may make.
+func (fm *FileManager) moveFile(src string, dst string) error {
+	for _, path := range []string{src, dst} {
+		err := fm.checkContainedPath(path)
+		if err != nil {
+			return err
+		}
+	}
+	perms := fm.getFilePermissions()
+	err := mkdirAllMode(filepath.Dir(dst), perms.dirMode())
+	if err != nil {
+		return err
+	}
+	err = os.Rename(src, dst)
+	if err != nil && errors.Is(err, syscall.EXDEV) {
+		fm.LogTo("DEBUG", fmt.Sprintf("[FileManager.MoveFile] Copying file(%s) to %s across file systems\n", src, dst))
+		err = copyAcrossDevices(src, dst)
+	}
+	if err != nil {
+		return err
+	}
+	if mode := perms.fileMode(); mode != 0 {
+		return os.Chmod(dst, mode)
+	}
+	return nil
+}
+
+// copyAcrossDevices moves src to dst by copying. The copy is synced and renamed into place before src is removed,
+// so a crash leaves at least one complete file.
+func copyAcrossDevices(src string, dst string) error {
+	info, err := os.Lstat(src)
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return &os.LinkError{Op: "move", Old: src, New: dst, Err: syscall.EXDEV}
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	dir := filepath.Dir(dst)
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(dst)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	tmpPath := tmp.Name()
+	defer os.Remove(tmpPath)
+
+	_, err = io.Copy(tmp, in)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	closeErr := tmp.Close()
+	if err != nil {
+		return err
+	}
+	if closeErr != nil {
+		return closeErr
+	}
+	err = os.Chmod(tmpPath, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	// keeping the owner needs privileges a service often does not have, the copy then belongs to the service
+	preserveOwner(tmpPath, info)
+	os.Chtimes(tmpPath, info.ModTime(), info.ModTime())
+
+	err = os.Rename(tmpPath, dst)
+	if err != nil {
+		return err
+	}
+	syncDir(dir)
+	err = os.Remove(src)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		os.Remove(dst)
+		return fmt.Errorf("failed to remove moved file(%s): %w", src, err)
+	}
+	return nil
+}
+
+// mkdirAllMode creates the directory and its missing parents with the mode, which is set explicitly on every
+// created directory.
+func mkdirAllMode(dir string, mode os.FileMode) error {
+	info, err := os.Stat(dir)
+	if err == nil {
+		if !info.IsDir() {
+			return &os.PathError{Op: "mkdir", Path: dir, Err: syscall.ENOTDIR}
+		}
+		return nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	parent := filepath.Dir(dir)
+	if parent != dir {
+		err = mkdirAllMode(parent, mode)
+		if err != nil {
+			return err
+		}
+	}
+	err = os.Mkdir(dir, mode)
+	if err != nil {
+		if errors.Is(err, fs.ErrExist) {
+			return nil
+		}
+		return err
+	}
+	return os.Chmod(dir, mode)
+}
@@ -0,0 +1,8 @@
+//go:build !unix
+
+package filemanager
+
+import "os"
+
+// preserveOwner is a no-op on platforms without unix owners.
+func preserveOwner(path string, info os.FileInfo) {}
@@ -0,0 +1,17 @@
+//go:build unix
+
+package filemanager
+
+import (
+	"os"
+	"syscall"
+)
+
+// preserveOwner gives the file the owner and group of the file info, ignoring missing privileges.
+func preserveOwner(path string, info os.FileInfo) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return
+	}
+	os.Lchown(path, int(stat.Uid), int(stat.Gid))
+}
@@ -0,0 +1,46 @@
+package filemanager_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	filemanager "github.com/itsatony/go-filemanager"
+	"github.com/itsatony/go-filemanager/filemanagertest"
+)
+
+func TestFilePermissionsApplyToWrittenFiles(t *testing.T) {
+	tfm := filemanagertest.NewTestFileManager(t)
+	tfm.SetStorage(filemanager.LocalStorage{})
+	err := tfm.SetFilePermissions(filemanager.FilePermissions{FileMode: 0640, DirMode: 0750})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tfm.EnableTrash(filemanager.TrashOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := &filemanager.ManagedFile{
+		FileName:      "hello.txt",
+		LocalFilePath: tfm.GetLocalPathForFile(filemanager.FileStorageTypePrivate, "nested/hello.txt"),
+		Content:       []byte("hello"),
+	}
+	err = tfm.SaveFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for path, want := range map[string]os.FileMode{
+		file.LocalFilePath:                       0640,
+		filepath.Dir(file.LocalFilePath):         0750 | os.ModeDir,
+		filepath.Join(tfm.PrivatePath, ".trash"): 0750 | os.ModeDir,
+	} {
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode() != want {
+			t.Errorf("mode of %s = %v, want %v", path, info.Mode(), want)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package filemanager
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// OutputCollisionPolicy decides what happens when the target file name of an output is taken, e.g. by the output
+// of a concurrent process rendering the same template.
+type OutputCollisionPolicy string
+
+const (
+	// OutputCollisionUniqueSuffix stores the output as name-1.ext, name-2.ext, ... if name.ext is taken. The default.
+	OutputCollisionUniqueSuffix OutputCollisionPolicy = "unique_suffix"
+	// OutputCollisionProcessID prefixes the file name with the process ID, <process id>-name.ext. Reruns of a
+	// process replace its outputs.
+	OutputCollisionProcessID OutputCollisionPolicy = "process_id"
+	// OutputCollisionFail fails the process with ErrFileExists.
+	OutputCollisionFail OutputCollisionPolicy = "fail"
+	// OutputCollisionOverwrite replaces the existing file, keeping it as a previous version with versioning enabled.
+	OutputCollisionOverwrite OutputCollisionPolicy = "overwrite"
+)
+
+// MAX_OUTPUT_NAME_SUFFIX is the highest suffix OutputCollisionUniqueSuffix tries before failing with ErrFileExists.
+const MAX_OUTPUT_NAME_SUFFIX = 1000
+
+var (
+	ErrInvalidCollisionPolicy = errors.New("invalid output collision policy")
+)
+
+func (policy OutputCollisionPolicy) valid() bool {
+	switch policy {
+	case "", OutputCollisionUniqueSuffix, OutputCollisionProcessID, OutputCollisionFail, OutputCollisionOverwrite:
+		return true
+	}
+	return false
+}
+
+// collisionTargetPath returns the path an output is first tried at under the policy.
+func collisionTargetPath(policy OutputCollisionPolicy, localFilePath string, processID string) string {
+	if policy != OutputCollisionProcessID {
+		return localFilePath
+	}
+	dir, name := filepath.Split(localFilePath)
+	return filepath.Join(dir, processID+"-"+name)
+}
+
+// uniqueSuffixPath returns the path with -n added to the file name before its extension.
+func uniqueSuffixPath(localFilePath string, n int) string {
+	ext := filepath.Ext(localFilePath)
+	return fmt.Sprintf("%s-%d%s", strings.TrimSuffix(localFilePath, ext), n, ext)
+}
+
+// saveOutput saves an output file like SaveFile, resolving a taken target name by the policy. LocalFilePath and
+// FileName of the file are updated to where it was stored. Taken names are claimed atomically by the storage, so
+// concurrent processes never replace each other's outputs unless the policy is OutputCollisionOverwrite. With an
+// original set, files derived from it are replaced instead of colliding, see ReprocessFile.
+func (fm *FileManager) saveOutput(file *ManagedFile, policy OutputCollisionPolicy, processID string, original string) error {
+	if !policy.valid() {
+		return fmt.Errorf("%w: %s", ErrInvalidCollisionPolicy, policy)
+	}
+	file.LocalFilePath = collisionTargetPath(policy, file.LocalFilePath, processID)
+	file.FileName = filepath.Base(file.LocalFilePath)
+	switch policy {
+	case OutputCollisionOverwrite, OutputCollisionProcessID:
+		return fm.SaveFile(file)
+	case OutputCollisionFail:
+		err := fm.saveManagedFile(file, true)
+		if errors.Is(err, ErrFileExists) && fm.isDerivedFrom(file.LocalFilePath, original) {
+			return fm.SaveFile(file)
+		}
+		return err
+	}
+	targetFilePath := file.LocalFilePath
+	for n := 1; ; n++ {
+		err := fm.saveManagedFile(file, true)
+		if errors.Is(err, ErrFileExists) && fm.isDerivedFrom(file.LocalFilePath, original) {
+			return fm.SaveFile(file)
+		}
+		// a held file is taken as well
+		if n > MAX_OUTPUT_NAME_SUFFIX || !(errors.Is(err, ErrFileExists) || errors.Is(err, ErrFileOnHold)) {
+			return err
+		}
+		file.LocalFilePath = uniqueSuffixPath(targetFilePath, n)
+		file.FileName = filepath.Base(file.LocalFilePath)
+	}
+}
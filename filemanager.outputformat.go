@@ -0,0 +1,124 @@
+package filemanager
+
+import (
+	"errors"
+	"fmt"
+	"mime"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+var (
+	ErrUnsupportedOutputFormat = errors.New("no registered plugin converts to the output format")
+)
+
+// FormatConversionPlugin is implemented by processing plugins that can convert a file into another format.
+// ProcessFile uses them to produce the Format declared by an OutputFormat of a recipe.
+type FormatConversionPlugin interface {
+	ProcessingPlugin
+	// ConvertsTo reports whether files of the MIME type can be converted to the (normalized) format, e.g. "webp".
+	ConvertsTo(mimeType string, format string) bool
+	// ConvertFormat returns a converted copy of the file with content, MIME type and file name extension set.
+	ConvertFormat(file *ManagedFile, format string) (*ManagedFile, error)
+}
+
+var outputFormatAliases = map[string]string{
+	"jpeg":     "jpg",
+	"tiff":     "tif",
+	"text":     "txt",
+	"markdown": "md",
+	"htm":      "html",
+}
+
+var outputFormatMimeTypes = map[string]string{
+	"md":   "text/markdown",
+	"csv":  "text/csv",
+	"webp": "image/webp",
+	"txt":  "text/plain",
+}
+
+// NormalizeOutputFormat lowercases a format and maps aliases to the canonical extension (jpeg -> jpg, text -> txt, ...).
+func NormalizeOutputFormat(format string) string {
+	format = strings.TrimPrefix(strings.ToLower(strings.TrimSpace(format)), ".")
+	if alias, ok := outputFormatAliases[format]; ok {
+		return alias
+	}
+	return format
+}
+
+// MimeTypeForOutputFormat returns the MIME type of files in the format, application/octet-stream if unknown.
+func MimeTypeForOutputFormat(format string) string {
+	format = NormalizeOutputFormat(format)
+	if mimeType, ok := outputFormatMimeTypes[format]; ok {
+		return mimeType
+	}
+	if mimeType := mime.TypeByExtension("." + format); mimeType != "" {
+		return mimeType
+	}
+	return "application/octet-stream"
+}
+
+// fileNameWithFormat replaces the extension of the file name with the one of the format.
+func fileNameWithFormat(fileName string, format string) string {
+	return strings.TrimSuffix(fileName, filepath.Ext(fileName)) + "." + NormalizeOutputFormat(format)
+}
+
+// needsFormatConversion is false for an empty format, "original" and formats matching the file's extension.
+func needsFormatConversion(file *ManagedFile, format string) bool {
+	format = NormalizeOutputFormat(format)
+	if format == "" || format == "original" {
+		return false
+	}
+	return NormalizeOutputFormat(filepath.Ext(file.FileName)) != format
+}
+
+// convertForOutput returns the file converted to the format using the first registered FormatConversionPlugin
+// (by plugin name) that supports it, or the file itself if no conversion is needed.
+func (fm *FileManager) convertForOutput(file *ManagedFile, format string) (*ManagedFile, error) {
+	if !needsFormatConversion(file, format) {
+		return file, nil
+	}
+	format = NormalizeOutputFormat(format)
+	converter, ok := fm.findFormatConverter(file.MimeType, format)
+	if !ok {
+		return nil, fmt.Errorf("%w: %s to %s", ErrUnsupportedOutputFormat, file.MimeType, format)
+	}
+	converted, err := converter.ConvertFormat(file, format)
+	if err != nil {
+		return nil, fmt.Errorf("failed to convert %s to %s: %w", file.FileName, format, err)
+	}
+	return converted, nil
+}
+
+func (fm *FileManager) findFormatConverter(mimeType string, format string) (FormatConversionPlugin, bool) {
+	if fm.parent != nil {
+		return fm.parent.findFormatConverter(mimeType, format)
+	}
+	fm.mu.RLock()
+	defer fm.mu.RUnlock()
+	names := make([]string, 0, len(fm.processingPlugins))
+	for name := range fm.processingPlugins {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		converter, ok := fm.processingPlugins[name].(FormatConversionPlugin)
+		if ok && converter.ConvertsTo(mimeType, format) {
+			return converter, true
+		}
+	}
+	return nil, false
+}
+
+// convertedCopy returns a shallow copy of the file with new content and format.
+func convertedCopy(file *ManagedFile, content []byte, format string) *ManagedFile {
+	converted := *file
+	converted.Content = content
+	converted.FileSize = int64(len(content))
+	converted.FileName = fileNameWithFormat(file.FileName, format)
+	converted.MimeType = MimeTypeForOutputFormat(format)
+	converted.LocalFilePath = ""
+	converted.URL = ""
+	return &converted
+}
@@ -0,0 +1,209 @@
+package filemanager
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+var (
+	ErrMissingParam = errors.New("missing parameter")
+)
+
+// ProcessOptions configure a single ProcessFileWithOptions call.
+type ProcessOptions struct {
+	// Params are runtime parameters available in step params as {{.params.<name>}}, so one recipe can serve many
+	// variations (target width, watermark text, page range, ...).
+	Params map[string]any
+	// Priority overrides the Priority of the recipe, e.g. PRIORITY_BATCH for bulk reprocessing.
+	Priority string
+	// DryRun checks the recipe on the file without processing it or writing anything to storage: the file is
+	// validated, the step params are rendered and checked by plugins implementing DryRunPlugin, and the terminal
+	// status lists the outputs that would be stored. Recipe hooks do not run, and the upload is kept.
+	DryRun bool
+	// SkipUnchanged makes ReprocessFile skip files whose content and recipe digest (see Recipe.Digest) match the
+	// last successful run recorded in the process store, returning the outputs of that run. Needs a process store
+	// implementing ProcessRunStore, like the JSONProcessStore. ProcessFile ignores it.
+	SkipUnchanged bool
+	upload        *uploadStream // set by ProcessUpload to stream the upload into the first step
+	// replaceDerivedFrom is set by ReprocessFile to replace the outputs derived from the original before
+	replaceDerivedFrom string
+}
+
+var paramTemplateFuncs = template.FuncMap{
+	// default returns value unless it is missing or empty: {{.params.width | default 800}}
+	"default": func(defaultValue any, value any) any {
+		if value == nil || value == "" {
+			return defaultValue
+		}
+		return value
+	},
+}
+
+var singleParamActionRegex = regexp.MustCompile(`^\s*\{\{[^{}]*\}\}\s*$`)
+
+// stepParamValue is a param set in the MetaData of a file for a step, and the value it replaced.
+type stepParamValue struct {
+	rendered any
+	previous any
+	existed  bool
+}
+
+// appliedStepParams remembers the params applyStepParams set for a step, so restore can take them out of the
+// MetaData again once the step ran. Params must not leak into later steps or the stored outputs.
+type appliedStepParams struct {
+	files   []*ManagedFile
+	applied map[*ManagedFile]map[string]stepParamValue
+}
+
+// applyStepParams renders the step params for every file and sets them in the file's MetaData, where the plugins
+// read their parameters from. Templates see {{.params.x}} (runtime params), {{.metadata.x}} and {{.file.name}},
+// {{.file.mimetype}}, {{.file.size}}. Call restore on the result once the step ran.
+func applyStepParams(files []*ManagedFile, params map[string]any, runtimeParams map[string]any) (*appliedStepParams, error) {
+	applied := &appliedStepParams{files: files, applied: make(map[*ManagedFile]map[string]stepParamValue, len(files))}
+	if len(params) == 0 {
+		return applied, nil
+	}
+	// render first, so templates of every param see the MetaData without the params of the step
+	for _, file := range files {
+		data := map[string]any{
+			"params":   runtimeParams,
+			"metadata": file.MetaData,
+			"file": map[string]any{
+				"name":     file.FileName,
+				"mimetype": file.MimeType,
+				"size":     file.FileSize,
+			},
+		}
+		values := make(map[string]stepParamValue, len(params))
+		for key, value := range params {
+			rendered, err := renderParamValue(value, data)
+			if err != nil {
+				applied.restore(nil)
+				return nil, fmt.Errorf("param(%s): %w", key, err)
+			}
+			previous, existed := file.MetaData[key]
+			values[key] = stepParamValue{rendered: rendered, previous: previous, existed: existed}
+		}
+		applied.applied[file] = values
+		for key, value := range values {
+			file.SetMetaData(key, value.rendered)
+		}
+	}
+	return applied, nil
+}
+
+// restore takes the params out of the MetaData of the files the step got and of the files it returned, putting
+// back the values they replaced. New files of the step are restored like its first file, whose MetaData plugins
+// copy. Values the plugin changed are kept.
+func (p *appliedStepParams) restore(processedFiles []*ManagedFile) {
+	if len(p.applied) == 0 {
+		return
+	}
+	restoreFile := func(file *ManagedFile, values map[string]stepParamValue) {
+		for key, value := range values {
+			current, ok := file.MetaData[key]
+			if !ok || !reflect.DeepEqual(current, value.rendered) {
+				continue
+			}
+			if value.existed {
+				file.MetaData[key] = value.previous
+			} else {
+				delete(file.MetaData, key)
+			}
+		}
+	}
+	for _, file := range p.files {
+		if values, ok := p.applied[file]; ok {
+			restoreFile(file, values)
+		}
+	}
+	var first map[string]stepParamValue
+	if len(p.files) > 0 {
+		first = p.applied[p.files[0]]
+	}
+	for _, file := range processedFiles {
+		values, ok := p.applied[file]
+		if !ok {
+			values = first
+		}
+		restoreFile(file, values)
+	}
+}
+
+// renderParamValue executes templates in string values (recursively in lists and maps) and normalizes values to
+// the types of JSON decoded metadata (numbers as float64, maps with string keys) that plugins expect.
+// A string consisting of a single template action yields a number or bool if it renders as one.
+func renderParamValue(value any, data map[string]any) (any, error) {
+	switch typed := value.(type) {
+	case string:
+		if !strings.Contains(typed, "{{") {
+			return typed, nil
+		}
+		tmpl, err := template.New("param").Funcs(paramTemplateFuncs).Parse(typed)
+		if err != nil {
+			return nil, err
+		}
+		var rendered strings.Builder
+		err = tmpl.Execute(&rendered, data)
+		if err != nil {
+			return nil, err
+		}
+		result := rendered.String()
+		if strings.Contains(result, "<no value>") {
+			return nil, fmt.Errorf("%w in %q", ErrMissingParam, typed)
+		}
+		if singleParamActionRegex.MatchString(typed) {
+			if number, err := strconv.ParseFloat(result, 64); err == nil {
+				return number, nil
+			}
+			if boolean, err := strconv.ParseBool(result); err == nil {
+				return boolean, nil
+			}
+		}
+		return result, nil
+	case []any:
+		rendered := make([]any, len(typed))
+		for i, item := range typed {
+			renderedItem, err := renderParamValue(item, data)
+			if err != nil {
+				return nil, err
+			}
+			rendered[i] = renderedItem
+		}
+		return rendered, nil
+	case map[any]any:
+		rendered := make(map[string]any, len(typed))
+		for key, item := range typed {
+			renderedItem, err := renderParamValue(item, data)
+			if err != nil {
+				return nil, err
+			}
+			rendered[fmt.Sprintf("%v", key)] = renderedItem
+		}
+		return rendered, nil
+	case map[string]any:
+		rendered := make(map[string]any, len(typed))
+		for key, item := range typed {
+			renderedItem, err := renderParamValue(item, data)
+			if err != nil {
+				return nil, err
+			}
+			rendered[key] = renderedItem
+		}
+		return rendered, nil
+	case int:
+		return float64(typed), nil
+	case int64:
+		return float64(typed), nil
+	case uint64:
+		return float64(typed), nil
+	case float32:
+		return float64(typed), nil
+	}
+	return value, nil
+}
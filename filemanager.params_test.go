@@ -0,0 +1,79 @@
+package filemanager_test
+
+import (
+	"testing"
+
+	filemanager "github.com/itsatony/go-filemanager"
+	"github.com/itsatony/go-filemanager/filemanagertest"
+)
+
+// metaDataRecorder records the MetaData each step sees and passes the files on.
+type metaDataRecorder struct {
+	seen []map[string]any
+}
+
+func (p *metaDataRecorder) Process(files []*filemanager.ManagedFile, fileProcess *filemanager.FileProcess) ([]*filemanager.ManagedFile, error) {
+	seen := make(map[string]any, len(files[0].MetaData))
+	for key, value := range files[0].MetaData {
+		seen[key] = value
+	}
+	p.seen = append(p.seen, seen)
+	return files, nil
+}
+
+func TestStepParamsAreScopedToTheirStep(t *testing.T) {
+	tfm := filemanagertest.NewTestFileManager(t)
+	recorder := &metaDataRecorder{}
+	tfm.AddProcessingPlugin("recorder", recorder)
+	err := tfm.AddRecipe(filemanager.Recipe{
+		Name:              "steps",
+		AcceptedMimeTypes: []string{"text/plain"},
+		MaxFileSize:       1024,
+		ProcessingSteps: []filemanager.ProcessingStep{
+			{PluginName: "recorder", Params: map[string]any{"width": "{{.params.width}}", "owner": "step"}},
+			{PluginName: "recorder", Params: map[string]any{"format": "png"}},
+		},
+		OutputFormats:  []filemanager.OutputFormat{{TargetFileNames: []string{"out/{metadata.process_id}"}, StorageType: filemanager.FileStorageTypePrivate}},
+		ResultMetaData: []string{"width", "format", "owner"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := []byte("hello")
+	file := &filemanager.ManagedFile{
+		FileName: "hello.txt",
+		MimeType: "text/plain",
+		Content:  content,
+		FileSize: int64(len(content)),
+		MetaData: map[string]any{"owner": "upload"},
+	}
+
+	status := tfm.Process(file, "steps", map[string]any{"width": 1200})
+	if status == nil || status.Error != nil || len(status.ResultingFiles) != 1 {
+		t.Fatalf("final status = %+v, want one output", status)
+	}
+	if len(recorder.seen) != 2 {
+		t.Fatalf("recorder ran %d times, want 2", len(recorder.seen))
+	}
+	if recorder.seen[0]["width"] != 1200.0 || recorder.seen[0]["owner"] != "step" {
+		t.Errorf("first step saw %v, want width 1200 and owner step", recorder.seen[0])
+	}
+	if _, ok := recorder.seen[1]["width"]; ok {
+		t.Errorf("second step saw width %v of the first step", recorder.seen[1]["width"])
+	}
+	if recorder.seen[1]["owner"] != "upload" || recorder.seen[1]["format"] != "png" {
+		t.Errorf("second step saw %v, want owner upload and format png", recorder.seen[1])
+	}
+	output := status.ResultingFiles[0].MetaData
+	for _, key := range []string{"width", "format"} {
+		if _, ok := output[key]; ok {
+			t.Errorf("output metadata has step param %s", key)
+		}
+	}
+	if output["owner"] != "upload" {
+		t.Errorf("output metadata owner = %v, want upload", output["owner"])
+	}
+	if file.MetaData["owner"] != "upload" {
+		t.Errorf("file metadata owner = %v, want upload", file.MetaData["owner"])
+	}
+}
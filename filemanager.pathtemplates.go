@@ -0,0 +1,63 @@
+package filemanager
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// DEFAULT_PATH_DATE_LAYOUT is the layout of {date} in target file names, a directory per day.
+const DEFAULT_PATH_DATE_LAYOUT = "2006/01/02"
+
+var dateVariableRegex = regexp.MustCompile(`{date(?::([^}]+))?}`)
+
+// replacePathVariables replaces {owner}, {process_id} and {date:layout} in a target file name template. The date
+// is rendered at now, layouts may contain slashes to create nested directories.
+func replacePathVariables(fileName string, file *ManagedFile, now time.Time) string {
+	fileName = dateVariableRegex.ReplaceAllStringFunc(fileName, func(match string) string {
+		layout := dateVariableRegex.FindStringSubmatch(match)[1]
+		if layout == "" {
+			layout = DEFAULT_PATH_DATE_LAYOUT
+		}
+		return now.Format(layout)
+	})
+	processID := ""
+	if value, ok := file.MetaData["process_id"]; ok {
+		processID = fmt.Sprintf("%v", value)
+	}
+	return strings.NewReplacer(
+		"{owner}", pathSegment(file.Owner),
+		"{process_id}", pathSegment(processID),
+	).Replace(fileName)
+}
+
+// pathSegment makes a template value safe as a single path segment: separators and control characters become
+// underscores, and "." and ".." cannot climb the directory tree.
+func pathSegment(value string) string {
+	value = strings.Map(func(r rune) rune {
+		if r == '/' || r == '\\' || r < 0x20 || r == 0x7f {
+			return '_'
+		}
+		return r
+	}, value)
+	if value == "." || value == ".." {
+		return "_"
+	}
+	return value
+}
+
+// normalizeTargetPath turns a rendered target file name into a relative slash-separated path that stays below the
+// base path of its storage type: empty segments, as left by empty values, "." and ".." are dropped.
+func normalizeTargetPath(targetPath string) string {
+	segments := strings.Split(filepath.ToSlash(targetPath), "/")
+	kept := segments[:0]
+	for _, segment := range segments {
+		if segment == "" || segment == "." || segment == ".." {
+			continue
+		}
+		kept = append(kept, segment)
+	}
+	return strings.Join(kept, "/")
+}
@@ -0,0 +1,117 @@
+package filemanager
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+var (
+	ErrUnknownPDFEngine = errors.New("unknown PDF engine")
+)
+
+const (
+	PDF_ENGINE_UNIPDF = "unipdf"
+	// PDF_ENGINE_PDFCPU is registered by building with -tags pdfcpu, see filemanager.pdfengine.pdfcpu.go.
+	PDF_ENGINE_PDFCPU = "pdfcpu"
+)
+
+// PDFEngine is the PDF library behind the PDFManipulationPlugin. UniPDFEngine is the default; unipdf needs a
+// commercial license for many uses, so other libraries can be plugged in by implementing this interface. Pages are
+// numbered from 1.
+type PDFEngine interface {
+	// PageCount returns the number of pages of the PDF.
+	PageCount(content []byte) (int, error)
+	// ExtractPages returns a PDF of the given pages in the given order, pages may repeat.
+	ExtractPages(content []byte, pages []int) ([]byte, error)
+	// Merge returns a PDF of the pages of all PDFs, one after the other.
+	Merge(contents [][]byte) ([]byte, error)
+	// Split returns PDFs of span pages each, the last one holding the remaining pages.
+	Split(content []byte, span int) ([][]byte, error)
+	// Compress optimizes the PDF, level is "low", "medium" or "high". Engines without image downsampling may treat
+	// all levels alike.
+	Compress(content []byte, level string) ([]byte, error)
+	// Watermark stamps the text diagonally across every page.
+	Watermark(content []byte, text string) ([]byte, error)
+	// Chapters returns the page ranges of the top-level bookmarks (outline) of the PDF, none if it has no bookmarks.
+	Chapters(content []byte) ([]PDFChapter, error)
+}
+
+// PDFChapter is a top-level bookmark of a PDF and the pages up to the next one.
+type PDFChapter struct {
+	Title     string
+	FirstPage int
+	LastPage  int
+}
+
+var (
+	pdfEnginesMu sync.RWMutex
+	pdfEngines   = map[string]func() PDFEngine{
+		PDF_ENGINE_UNIPDF: func() PDFEngine { return UniPDFEngine{} },
+	}
+)
+
+// RegisterPDFEngine makes a PDF engine available by name, e.g. to the engine option of the pdf_manipulation plugin
+// in configs. Registering an existing name replaces it.
+func RegisterPDFEngine(name string, factory func() PDFEngine) {
+	pdfEnginesMu.Lock()
+	defer pdfEnginesMu.Unlock()
+	pdfEngines[name] = factory
+}
+
+// NewPDFEngine returns the registered PDF engine of the name.
+func NewPDFEngine(name string) (PDFEngine, error) {
+	pdfEnginesMu.RLock()
+	defer pdfEnginesMu.RUnlock()
+	factory, ok := pdfEngines[name]
+	if !ok {
+		names := make([]string, 0, len(pdfEngines))
+		for registered := range pdfEngines {
+			names = append(names, registered)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("%w: %s (registered: %v)", ErrUnknownPDFEngine, name, names)
+	}
+	return factory(), nil
+}
+
+// splitPageRanges returns the page numbers of numPages pages in chunks of span pages.
+func splitPageRanges(numPages int, span int) [][]int {
+	if span < 1 {
+		span = 1
+	}
+	var ranges [][]int
+	for start := 1; start <= numPages; start += span {
+		var pages []int
+		for page := start; page < start+span && page <= numPages; page++ {
+			pages = append(pages, page)
+		}
+		ranges = append(ranges, pages)
+	}
+	return ranges
+}
+
+// chaptersOfBookmarks turns the titles and first pages of top-level bookmarks into chapters, each ending before the
+// next one starts. Pages before the first bookmark belong to the first chapter; bookmarks without a valid page or on
+// the page of the previous one are skipped.
+func chaptersOfBookmarks(titles []string, firstPages []int, numPages int) []PDFChapter {
+	var chapters []PDFChapter
+	for i, title := range titles {
+		firstPage := firstPages[i]
+		if firstPage < 1 || firstPage > numPages {
+			continue
+		}
+		if len(chapters) > 0 {
+			previous := &chapters[len(chapters)-1]
+			if firstPage <= previous.FirstPage {
+				continue
+			}
+			previous.LastPage = firstPage - 1
+		} else {
+			firstPage = 1
+		}
+		chapters = append(chapters, PDFChapter{Title: title, FirstPage: firstPage, LastPage: numPages})
+	}
+	return chapters
+}
@@ -0,0 +1,129 @@
+//go:build pdfcpu
+
+package filemanager
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+
+	"github.com/pdfcpu/pdfcpu/pkg/api"
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu/model"
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu/types"
+)
+
+// The pdfcpu engine is opt-in, so the default build does not depend on pdfcpu:
+//
+//	go get github.com/pdfcpu/pdfcpu
+//	go build -tags pdfcpu
+func init() {
+	RegisterPDFEngine(PDF_ENGINE_PDFCPU, func() PDFEngine { return PDFCPUEngine{} })
+}
+
+// PDFCPUEngine is the PDFEngine of pdfcpu (Apache-2.0), needing no license key. pdfcpu does not downsample images,
+// so Compress optimizes the structure of the PDF at every level.
+type PDFCPUEngine struct{}
+
+func (e PDFCPUEngine) configuration() *model.Configuration {
+	conf := model.NewDefaultConfiguration()
+	// accept the slightly broken PDFs out in the wild, like unipdf does
+	conf.ValidationMode = model.ValidationRelaxed
+	return conf
+}
+
+func (e PDFCPUEngine) PageCount(content []byte) (int, error) {
+	numPages, err := api.PageCount(bytes.NewReader(content), e.configuration())
+	if err != nil {
+		return 0, fmt.Errorf("failed to get number of pages: %v", err)
+	}
+	return numPages, nil
+}
+
+func (e PDFCPUEngine) ExtractPages(content []byte, pages []int) ([]byte, error) {
+	selectedPages := make([]string, len(pages))
+	for i, page := range pages {
+		selectedPages[i] = strconv.Itoa(page)
+	}
+	// Collect keeps the order of the selected pages and allows duplicates, unlike Trim
+	return e.write(func(w io.Writer) error {
+		return api.Collect(bytes.NewReader(content), w, selectedPages, e.configuration())
+	})
+}
+
+func (e PDFCPUEngine) Merge(contents [][]byte) ([]byte, error) {
+	readers := make([]io.ReadSeeker, len(contents))
+	for i, content := range contents {
+		readers[i] = bytes.NewReader(content)
+	}
+	return e.write(func(w io.Writer) error {
+		return api.MergeRaw(readers, w, false, e.configuration())
+	})
+}
+
+func (e PDFCPUEngine) Split(content []byte, span int) ([][]byte, error) {
+	if span < 1 {
+		span = 1
+	}
+	spans, err := api.SplitRaw(bytes.NewReader(content), span, e.configuration())
+	if err != nil {
+		return nil, fmt.Errorf("failed to split PDF: %v", err)
+	}
+	parts := make([][]byte, len(spans))
+	for i, pageSpan := range spans {
+		parts[i], err = io.ReadAll(pageSpan.Reader)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read pages %d-%d: %v", pageSpan.From, pageSpan.Thru, err)
+		}
+	}
+	return parts, nil
+}
+
+func (e PDFCPUEngine) Compress(content []byte, level string) ([]byte, error) {
+	switch level {
+	case "low", "medium", "high":
+	default:
+		return nil, fmt.Errorf("invalid compression level: %s", level)
+	}
+	return e.write(func(w io.Writer) error {
+		return api.Optimize(bytes.NewReader(content), w, e.configuration())
+	})
+}
+
+func (e PDFCPUEngine) Watermark(content []byte, text string) ([]byte, error) {
+	watermark, err := api.TextWatermark(text, "font:Helvetica, points:48, rot:45, fillcol:#C8C8C8, opacity:0.5", true, false, types.POINTS)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create watermark: %v", err)
+	}
+	return e.write(func(w io.Writer) error {
+		return api.AddWatermarks(bytes.NewReader(content), w, nil, watermark, e.configuration())
+	})
+}
+
+func (e PDFCPUEngine) Chapters(content []byte) ([]PDFChapter, error) {
+	numPages, err := e.PageCount(content)
+	if err != nil {
+		return nil, err
+	}
+	bookmarks, err := api.Bookmarks(bytes.NewReader(content), e.configuration())
+	if err != nil {
+		return nil, fmt.Errorf("failed to read bookmarks: %v", err)
+	}
+	var titles []string
+	var firstPages []int
+	for _, bookmark := range bookmarks {
+		titles = append(titles, bookmark.Title)
+		firstPages = append(firstPages, bookmark.PageFrom)
+	}
+	return chaptersOfBookmarks(titles, firstPages, numPages), nil
+}
+
+func (e PDFCPUEngine) write(run func(w io.Writer) error) ([]byte, error) {
+	buf := getBuffer()
+	defer putBuffer(buf)
+	err := run(buf)
+	if err != nil {
+		return nil, fmt.Errorf("failed to write PDF: %v", err)
+	}
+	return bytes.Clone(buf.Bytes()), nil
+}
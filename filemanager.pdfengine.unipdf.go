@@ -0,0 +1,379 @@
+package filemanager
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rsa"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"regexp"
+	"time"
+
+	"github.com/unidoc/unipdf/v3/annotator"
+	"github.com/unidoc/unipdf/v3/core"
+	"github.com/unidoc/unipdf/v3/creator"
+	"github.com/unidoc/unipdf/v3/model"
+	"github.com/unidoc/unipdf/v3/model/optimize"
+	"github.com/unidoc/unipdf/v3/model/sighandler"
+	"github.com/unidoc/unipdf/v3/redactor"
+)
+
+// UniPDFEngine is the PDFEngine of unipdf, the default of the PDF plugins. Writing PDFs needs a UniPDF license.
+type UniPDFEngine struct{}
+
+func (e UniPDFEngine) PageCount(content []byte) (int, error) {
+	pdfReader, err := model.NewPdfReader(bytes.NewReader(content))
+	if err != nil {
+		return 0, fmt.Errorf("failed to read PDF: %v", err)
+	}
+	numPages, err := pdfReader.GetNumPages()
+	if err != nil {
+		return 0, fmt.Errorf("failed to get number of pages: %v", err)
+	}
+	return numPages, nil
+}
+
+func (e UniPDFEngine) ExtractPages(content []byte, pages []int) ([]byte, error) {
+	pdfReader, err := model.NewPdfReader(bytes.NewReader(content))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read PDF: %v", err)
+	}
+	pdfWriter := model.NewPdfWriter()
+	err = addPDFPages(&pdfWriter, pdfReader, pages)
+	if err != nil {
+		return nil, err
+	}
+	return writePDF(&pdfWriter)
+}
+
+func (e UniPDFEngine) Merge(contents [][]byte) ([]byte, error) {
+	pdfWriter := model.NewPdfWriter()
+	for i, content := range contents {
+		pdfReader, err := model.NewPdfReader(bytes.NewReader(content))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read PDF %d: %v", i+1, err)
+		}
+		err = addPDFPages(&pdfWriter, pdfReader, nil)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return writePDF(&pdfWriter)
+}
+
+func (e UniPDFEngine) Split(content []byte, span int) ([][]byte, error) {
+	pdfReader, err := model.NewPdfReader(bytes.NewReader(content))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read PDF: %v", err)
+	}
+	numPages, err := pdfReader.GetNumPages()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get number of pages: %v", err)
+	}
+	var parts [][]byte
+	for _, pages := range splitPageRanges(numPages, span) {
+		pdfWriter := model.NewPdfWriter()
+		err = addPDFPages(&pdfWriter, pdfReader, pages)
+		if err != nil {
+			return nil, err
+		}
+		part, err := writePDF(&pdfWriter)
+		if err != nil {
+			return nil, err
+		}
+		parts = append(parts, part)
+	}
+	return parts, nil
+}
+
+func (e UniPDFEngine) Compress(content []byte, level string) ([]byte, error) {
+	options := optimize.Options{
+		CombineDuplicateDirectObjects:   true,
+		CombineIdenticalIndirectObjects: true,
+		CombineDuplicateStreams:         true,
+		CompressStreams:                 true,
+		UseObjectStreams:                true,
+	}
+	switch level {
+	case "low":
+		options.ImageQuality = 90
+		options.ImageUpperPPI = 150
+	case "medium":
+		options.ImageQuality = 80
+		options.ImageUpperPPI = 100
+	case "high":
+		options.ImageQuality = 70
+		options.ImageUpperPPI = 50
+	default:
+		return nil, fmt.Errorf("invalid compression level: %s", level)
+	}
+
+	pdfReader, err := model.NewPdfReader(bytes.NewReader(content))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read PDF: %v", err)
+	}
+	pdfWriter := model.NewPdfWriter()
+	pdfWriter.SetOptimizer(optimize.New(options))
+	err = addPDFPages(&pdfWriter, pdfReader, nil)
+	if err != nil {
+		return nil, err
+	}
+	return writePDF(&pdfWriter)
+}
+
+func (e UniPDFEngine) Watermark(content []byte, text string) ([]byte, error) {
+	pdfReader, err := model.NewPdfReader(bytes.NewReader(content))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read PDF: %v", err)
+	}
+	numPages, err := pdfReader.GetNumPages()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get number of pages: %v", err)
+	}
+	c := creator.New()
+	for i := 1; i <= numPages; i++ {
+		page, err := pdfReader.GetPage(i)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get page %d: %v", i, err)
+		}
+		err = c.AddPage(page)
+		if err != nil {
+			return nil, fmt.Errorf("failed to add page %d: %v", i, err)
+		}
+		watermark := c.NewParagraph(text)
+		watermark.SetFontSize(48)
+		watermark.SetColor(creator.ColorRGBFrom8bit(200, 200, 200))
+		watermark.SetAngle(45)
+		watermark.SetPos(c.Width()/4, c.Height()/2)
+		err = c.Draw(watermark)
+		if err != nil {
+			return nil, fmt.Errorf("failed to draw watermark on page %d: %v", i, err)
+		}
+	}
+	buf := getBuffer()
+	defer putBuffer(buf)
+	err = c.Write(buf)
+	if err != nil {
+		return nil, fmt.Errorf("failed to write PDF: %v", err)
+	}
+	return bytes.Clone(buf.Bytes()), nil
+}
+
+func (e UniPDFEngine) Chapters(content []byte) ([]PDFChapter, error) {
+	pdfReader, err := model.NewPdfReader(bytes.NewReader(content))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read PDF: %v", err)
+	}
+	numPages, err := pdfReader.GetNumPages()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get number of pages: %v", err)
+	}
+	outline, err := pdfReader.GetOutlines()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read bookmarks: %v", err)
+	}
+	if outline == nil {
+		return nil, nil
+	}
+	var titles []string
+	var firstPages []int
+	for _, item := range outline.Entries {
+		titles = append(titles, item.Title)
+		// outline destinations are zero-based page indexes
+		firstPages = append(firstPages, int(item.Dest.Page)+1)
+	}
+	return chaptersOfBookmarks(titles, firstPages, numPages), nil
+}
+
+// Redact removes the matches of the patterns from the content streams of the pages and draws boxes where they were.
+func (e UniPDFEngine) Redact(content []byte, patterns []*regexp.Regexp) ([]byte, error) {
+	pdfReader, err := model.NewPdfReader(bytes.NewReader(content))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read PDF: %v", err)
+	}
+	terms := make([]redactor.RedactionTerm, len(patterns))
+	for i, pattern := range patterns {
+		terms[i] = redactor.RedactionTerm{Pattern: pattern}
+	}
+	r := redactor.New(pdfReader, &redactor.RedactionOptions{Terms: terms}, redactor.RedactRectanglePropsNew())
+	err = r.Redact()
+	if err != nil {
+		return nil, fmt.Errorf("failed to redact PDF: %v", err)
+	}
+	buf := getBuffer()
+	defer putBuffer(buf)
+	err = r.Write(buf)
+	if err != nil {
+		return nil, fmt.Errorf("failed to write PDF: %v", err)
+	}
+	return bytes.Clone(buf.Bytes()), nil
+}
+
+// addPDFPages adds the pages of the reader to the writer, all of them if pages is nil. Pages are copied, so a page
+// can be added more than once.
+func addPDFPages(pdfWriter *model.PdfWriter, pdfReader *model.PdfReader, pages []int) error {
+	if pages == nil {
+		numPages, err := pdfReader.GetNumPages()
+		if err != nil {
+			return fmt.Errorf("failed to get number of pages: %v", err)
+		}
+		for i := 1; i <= numPages; i++ {
+			pages = append(pages, i)
+		}
+	}
+	for _, pageNum := range pages {
+		page, err := pdfReader.GetPage(pageNum)
+		if err != nil {
+			return fmt.Errorf("failed to get page %d: %v", pageNum, err)
+		}
+		pageCopy := *page
+		err = pdfWriter.AddPage(&pageCopy)
+		if err != nil {
+			return fmt.Errorf("failed to add page %d to writer: %v", pageNum, err)
+		}
+	}
+	return nil
+}
+
+func writePDF(pdfWriter *model.PdfWriter) ([]byte, error) {
+	buf := getBuffer()
+	defer putBuffer(buf)
+	err := pdfWriter.Write(buf)
+	if err != nil {
+		return nil, fmt.Errorf("failed to write PDF: %v", err)
+	}
+	return bytes.Clone(buf.Bytes()), nil
+}
+
+// Sign adds a PAdES (ETSI.CAdES.detached) signature, at level B-T with a timestamp authority and B-B without.
+// unipdf signs with RSA keys only and embeds the direct issuer of the certificate.
+func (e UniPDFEngine) Sign(content []byte, opts PDFSignOptions) ([]byte, error) {
+	if opts.Certificate == nil || opts.Certificate.Certificate == nil {
+		return nil, errors.New("no signing certificate")
+	}
+	key, ok := opts.Certificate.PrivateKey.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%w: unipdf signs with RSA keys only, not %T", ErrPDFSigningUnsupported, opts.Certificate.PrivateKey)
+	}
+	var issuer *x509.Certificate
+	if len(opts.Certificate.Chain) > 0 {
+		issuer = opts.Certificate.Chain[0]
+	}
+	var handler model.SignatureHandler
+	var err error
+	if opts.TimestampURL != "" {
+		handler, err = sighandler.NewEtsiPAdESLevelT(key, opts.Certificate.Certificate, issuer, opts.TimestampURL)
+	} else {
+		handler, err = sighandler.NewEtsiPAdESLevelB(key, opts.Certificate.Certificate, issuer)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to create signature handler: %v", err)
+	}
+
+	pdfReader, err := model.NewPdfReader(bytes.NewReader(content))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read PDF: %v", err)
+	}
+	numPages, err := pdfReader.GetNumPages()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get number of pages: %v", err)
+	}
+	if opts.Page < 1 || opts.Page > numPages {
+		return nil, fmt.Errorf("invalid signature page %d of %d pages", opts.Page, numPages)
+	}
+	fieldNumber := 1
+	if pdfReader.AcroForm != nil {
+		fieldNumber += len(pdfReader.AcroForm.AllFields())
+	}
+	appender, err := model.NewPdfAppender(pdfReader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to append to PDF: %v", err)
+	}
+
+	signedAt := time.Now()
+	signature := model.NewPdfSignature(handler)
+	signature.SetName(opts.Name)
+	signature.SetReason(opts.Reason)
+	signature.SetLocation(opts.Location)
+	signature.SetDate(signedAt, "")
+	err = signature.Initialize()
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize signature: %v", err)
+	}
+	fieldOpts := annotator.NewSignatureFieldOpts()
+	// invisible signatures have an empty rectangle
+	fieldOpts.Rect = []float64{0, 0, 0, 0}
+	var lines []*annotator.SignatureLine
+	if opts.Visible {
+		fieldOpts.Rect = opts.Rect[:]
+		fieldOpts.AutoSize = true
+		lines = append(lines,
+			annotator.NewSignatureLine("Signed by", opts.Name),
+			annotator.NewSignatureLine("Date", signedAt.Format(time.RFC3339)),
+		)
+		if opts.Reason != "" {
+			lines = append(lines, annotator.NewSignatureLine("Reason", opts.Reason))
+		}
+		if opts.Location != "" {
+			lines = append(lines, annotator.NewSignatureLine("Location", opts.Location))
+		}
+	}
+	field, err := annotator.NewSignatureField(signature, lines, fieldOpts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create signature field: %v", err)
+	}
+	field.T = core.MakeString(fmt.Sprintf("Signature%d", fieldNumber))
+	err = appender.Sign(opts.Page, field)
+	if err != nil {
+		return nil, fmt.Errorf("failed to add signature: %v", err)
+	}
+	buf := getBuffer()
+	defer putBuffer(buf)
+	err = appender.Write(buf)
+	if err != nil {
+		return nil, fmt.Errorf("failed to write PDF: %v", err)
+	}
+	return bytes.Clone(buf.Bytes()), nil
+}
+
+func (e UniPDFEngine) VerifySignatures(content []byte) ([]PDFSignature, error) {
+	pdfReader, err := model.NewPdfReader(bytes.NewReader(content))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read PDF: %v", err)
+	}
+	if pdfReader.AcroForm == nil {
+		return nil, nil
+	}
+	var handlers []model.SignatureHandler
+	for _, newHandler := range []func() (model.SignatureHandler, error){
+		func() (model.SignatureHandler, error) { return sighandler.NewEtsiPAdESLevelB(nil, nil, nil) },
+		func() (model.SignatureHandler, error) { return sighandler.NewAdobePKCS7Detached(nil, nil) },
+		func() (model.SignatureHandler, error) { return sighandler.NewAdobeX509RSASHA1(nil, nil) },
+		func() (model.SignatureHandler, error) { return sighandler.NewDocTimeStamp("", crypto.SHA512) },
+	} {
+		handler, err := newHandler()
+		if err != nil {
+			return nil, fmt.Errorf("failed to create signature handler: %v", err)
+		}
+		handlers = append(handlers, handler)
+	}
+	results, err := pdfReader.ValidateSignatures(handlers)
+	if err != nil {
+		return nil, fmt.Errorf("failed to validate signatures: %v", err)
+	}
+	var signatures []PDFSignature
+	for _, result := range results {
+		signatures = append(signatures, PDFSignature{
+			Name:          result.Name,
+			Reason:        result.Reason,
+			Location:      result.Location,
+			SignedAt:      result.Date.ToGoTime(),
+			TimestampedAt: result.GeneralizedTime,
+			Verified:      result.IsSigned && result.IsVerified,
+			Trusted:       result.IsTrusted,
+			Errors:        result.Errors,
+		})
+	}
+	return signatures, nil
+}
@@ -0,0 +1,288 @@
+package filemanager
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"time"
+
+	"golang.org/x/crypto/pkcs12"
+)
+
+// METADATA_KEY_PDF_SIGNATURES holds the []PDFSignature found by the verify_signatures manipulation.
+const METADATA_KEY_PDF_SIGNATURES = "pdf_signatures"
+
+var (
+	ErrPDFSigningUnsupported = errors.New("PDF engine does not support signatures")
+	ErrPDFSignatureInvalid   = errors.New("invalid PDF signature")
+	ErrPDFNotSigned          = errors.New("PDF is not signed")
+	ErrInvalidPKCS12         = errors.New("invalid PKCS#12 certificate")
+)
+
+// DEFAULT_PDF_SIGNATURE_RECT is where visible signatures are drawn unless the signature_rect param says otherwise:
+// x1, y1, x2, y2 in PDF points from the bottom left of the page.
+var DEFAULT_PDF_SIGNATURE_RECT = [4]float64{36, 36, 236, 96}
+
+// PDFSigningEngine is implemented by PDF engines that sign PDFs and verify their signatures, like UniPDFEngine. The
+// sign and verify_signatures manipulations fail with ErrPDFSigningUnsupported on other engines.
+type PDFSigningEngine interface {
+	// Sign adds a signature as an incremental update, so earlier signatures stay valid.
+	Sign(content []byte, opts PDFSignOptions) ([]byte, error)
+	// VerifySignatures checks every signature of the PDF, returning none if it is not signed.
+	VerifySignatures(content []byte) ([]PDFSignature, error)
+}
+
+// PDFCertificate is the key and certificate PDFs are signed with, see LoadPKCS12Certificate.
+type PDFCertificate struct {
+	PrivateKey  crypto.Signer
+	Certificate *x509.Certificate
+	// Chain holds the issuers of the certificate, the direct issuer first. Engines embed it, or at least the direct
+	// issuer, in signatures so verifiers can build the path to their trusted roots.
+	Chain []*x509.Certificate
+}
+
+// PDFSignOptions describe a signature of PDFSigningEngine.Sign.
+type PDFSignOptions struct {
+	Certificate *PDFCertificate
+	Name        string // of the signer, the common name of the certificate by default
+	Reason      string
+	Location    string
+	// Visible draws the signature into Rect on Page (1-based), otherwise it is only listed by PDF readers.
+	Visible bool
+	Page    int
+	Rect    [4]float64
+	// TimestampURL is an RFC 3161 timestamp authority whose token proves the signing time. Without one the
+	// signature only carries the clock of the host.
+	TimestampURL string
+}
+
+// PDFSignature is a signature of a PDF as verified by PDFSigningEngine.VerifySignatures.
+type PDFSignature struct {
+	Name     string    `json:"name"`
+	Reason   string    `json:"reason,omitempty"`
+	Location string    `json:"location,omitempty"`
+	SignedAt time.Time `json:"signedAt"` // claimed by the signer
+	// TimestampedAt is the time of the token of the timestamp authority, zero without one.
+	TimestampedAt time.Time `json:"timestampedAt"`
+	// Verified is true if the signature matches the signed content and certificate, i.e. the document was not
+	// changed since.
+	Verified bool `json:"verified"`
+	// Trusted is true if the certificate chains to a root trusted by the host.
+	Trusted bool     `json:"trusted"`
+	Errors  []string `json:"errors,omitempty"`
+}
+
+// LoadPKCS12Certificate reads the private key, certificate and chain of a PKCS#12 (.p12, .pfx) file.
+func LoadPKCS12Certificate(data []byte, password string) (*PDFCertificate, error) {
+	blocks, err := pkcs12.ToPEM(data, password)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidPKCS12, err)
+	}
+	var key crypto.Signer
+	var certificates []*x509.Certificate
+	for _, block := range blocks {
+		switch block.Type {
+		case "PRIVATE KEY":
+			// converted to PKCS#1 for RSA and SEC 1 for ECDSA keys
+			if rsaKey, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+				key = rsaKey
+			} else if ecKey, err := x509.ParseECPrivateKey(block.Bytes); err == nil {
+				key = ecKey
+			} else {
+				return nil, fmt.Errorf("%w: unsupported private key", ErrInvalidPKCS12)
+			}
+		case "CERTIFICATE":
+			certificate, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return nil, fmt.Errorf("%w: %v", ErrInvalidPKCS12, err)
+			}
+			certificates = append(certificates, certificate)
+		}
+	}
+	if key == nil {
+		return nil, fmt.Errorf("%w: no private key", ErrInvalidPKCS12)
+	}
+	certificate := &PDFCertificate{PrivateKey: key}
+	for _, c := range certificates {
+		if certificate.Certificate == nil && publicKeyOf(c, key) {
+			certificate.Certificate = c
+		} else {
+			certificate.Chain = append(certificate.Chain, c)
+		}
+	}
+	if certificate.Certificate == nil {
+		return nil, fmt.Errorf("%w: no certificate of the private key", ErrInvalidPKCS12)
+	}
+	certificate.Chain = orderChain(certificate.Certificate, certificate.Chain)
+	return certificate, nil
+}
+
+func publicKeyOf(certificate *x509.Certificate, key crypto.Signer) bool {
+	switch public := certificate.PublicKey.(type) {
+	case *rsa.PublicKey:
+		return public.Equal(key.Public())
+	case *ecdsa.PublicKey:
+		return public.Equal(key.Public())
+	}
+	return false
+}
+
+// orderChain sorts the issuers from the one of the certificate up to the root, leaving unrelated certificates at
+// the end.
+func orderChain(certificate *x509.Certificate, chain []*x509.Certificate) []*x509.Certificate {
+	remaining := append([]*x509.Certificate(nil), chain...)
+	var ordered []*x509.Certificate
+	for current := certificate; ; {
+		found := -1
+		for i, c := range remaining {
+			if current.CheckSignatureFrom(c) == nil {
+				found = i
+				break
+			}
+		}
+		if found < 0 {
+			break
+		}
+		current = remaining[found]
+		ordered = append(ordered, current)
+		remaining = append(remaining[:found], remaining[found+1:]...)
+	}
+	return append(ordered, remaining...)
+}
+
+func pdfSigningEngine(engine PDFEngine) (PDFSigningEngine, error) {
+	signer, ok := engine.(PDFSigningEngine)
+	if !ok {
+		return nil, fmt.Errorf("%w: %T", ErrPDFSigningUnsupported, engine)
+	}
+	return signer, nil
+}
+
+// certificate returns the signing certificate named by the certificate param, which may be left out if the plugin
+// has a single one.
+func (p *PDFManipulationPlugin) certificate(file *ManagedFile) (*PDFCertificate, error) {
+	name, ok := file.MetaData["certificate"].(string)
+	if !ok && file.MetaData["certificate"] != nil {
+		return nil, invalidParamError("certificate", file.MetaData["certificate"])
+	}
+	if name == "" {
+		if len(p.Certificates) != 1 {
+			return nil, &ValidationError{Field: "certificate", Err: ErrMissingParam}
+		}
+		for _, certificate := range p.Certificates {
+			return certificate, nil
+		}
+	}
+	certificate, ok := p.Certificates[name]
+	if !ok {
+		return nil, invalidParamError("certificate", name)
+	}
+	return certificate, nil
+}
+
+// signPDF signs the PDF with the certificate param, see PDFSignOptions for the signer_name, reason, location,
+// visible, signature_page, signature_rect and timestamp_url params.
+func (p *PDFManipulationPlugin) signPDF(engine PDFEngine, file *ManagedFile) (*ManagedFile, error) {
+	signer, err := pdfSigningEngine(engine)
+	if err != nil {
+		return nil, err
+	}
+	certificate, err := p.certificate(file)
+	if err != nil {
+		return nil, err
+	}
+	opts := PDFSignOptions{
+		Certificate:  certificate,
+		Name:         certificate.Certificate.Subject.CommonName,
+		Page:         1,
+		Rect:         DEFAULT_PDF_SIGNATURE_RECT,
+		TimestampURL: p.TimestampURL,
+	}
+	for param, target := range map[string]*string{
+		"signer_name":   &opts.Name,
+		"reason":        &opts.Reason,
+		"location":      &opts.Location,
+		"timestamp_url": &opts.TimestampURL,
+	} {
+		if val, ok := file.MetaData[param]; ok {
+			*target, ok = val.(string)
+			if !ok {
+				return nil, invalidParamError(param, val)
+			}
+		}
+	}
+	if val, ok := file.MetaData["visible"]; ok {
+		opts.Visible, ok = val.(bool)
+		if !ok {
+			return nil, invalidParamError("visible", val)
+		}
+	}
+	if val, ok := file.MetaData["signature_page"]; ok {
+		page, ok := val.(float64)
+		if !ok || page < 1 {
+			return nil, invalidParamError("signature_page", val)
+		}
+		opts.Page = int(page)
+	}
+	if val, ok := file.MetaData["signature_rect"]; ok {
+		rect, ok := val.([]interface{})
+		if !ok || len(rect) != 4 {
+			return nil, invalidParamError("signature_rect", val)
+		}
+		for i, coordinate := range rect {
+			opts.Rect[i], ok = coordinate.(float64)
+			if !ok {
+				return nil, invalidParamError("signature_rect", val)
+			}
+		}
+		if opts.Rect[0] >= opts.Rect[2] || opts.Rect[1] >= opts.Rect[3] {
+			return nil, invalidParamError("signature_rect", val)
+		}
+	}
+
+	content, err := signer.Sign(file.Content, opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign PDF: %w", err)
+	}
+	return newManipulatedPDF(file.FileName, content, file.MetaData), nil
+}
+
+// verifyPDFSignatures stores the signatures of the PDF in its METADATA_KEY_PDF_SIGNATURES metadata. It fails if a
+// signature does not verify, if require_signature is set and the PDF is not signed, and if require_trusted is set
+// and a certificate is not trusted.
+func verifyPDFSignatures(engine PDFEngine, file *ManagedFile) error {
+	signer, err := pdfSigningEngine(engine)
+	if err != nil {
+		return err
+	}
+	var required, trusted bool
+	for param, target := range map[string]*bool{"require_signature": &required, "require_trusted": &trusted} {
+		if val, ok := file.MetaData[param]; ok {
+			*target, ok = val.(bool)
+			if !ok {
+				return invalidParamError(param, val)
+			}
+		}
+	}
+
+	signatures, err := signer.VerifySignatures(file.Content)
+	if err != nil {
+		return fmt.Errorf("failed to verify PDF signatures: %w", err)
+	}
+	file.SetMetaData(METADATA_KEY_PDF_SIGNATURES, signatures)
+	if required && len(signatures) == 0 {
+		return &ValidationError{Field: "signature", Err: fmt.Errorf("%w: %s", ErrPDFNotSigned, file.FileName)}
+	}
+	for _, signature := range signatures {
+		if !signature.Verified {
+			return &ValidationError{Field: "signature", Err: fmt.Errorf("%w: signature of %q on %s: %v", ErrPDFSignatureInvalid, signature.Name, file.FileName, signature.Errors)}
+		}
+		if trusted && !signature.Trusted {
+			return &ValidationError{Field: "signature", Err: fmt.Errorf("%w: certificate of %q on %s is not trusted", ErrPDFSignatureInvalid, signature.Name, file.FileName)}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,251 @@
+package filemanager
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"os/exec"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrResourceLimitExceeded is matched by every ResourceLimitError.
+	ErrResourceLimitExceeded = errors.New("resource limit exceeded")
+	// ErrPluginPanicked is matched by every PluginPanicError.
+	ErrPluginPanicked = errors.New("processing plugin panicked")
+)
+
+// Resource limit names reported in ResourceLimitError.Limit.
+const (
+	ResourceLimitTimeout = "timeout"
+	ResourceLimitMemory  = "memory"
+)
+
+// PluginLimits guard the service against pathological inputs of a processing plugin. Zero values disable a limit.
+type PluginLimits struct {
+	// Timeout fails the step once the plugin runs longer. Plugins cannot be stopped from the outside, so the
+	// plugin keeps running in the background until it returns; its results are discarded. Subprocess plugins
+	// should have a timeout of their own (see DocumentPreviewPlugin.Timeout) or SubprocessLimits.
+	Timeout time.Duration `yaml:"timeout"`
+	// MaxMemory rejects inputs whose estimated memory use exceeds it before the plugin runs. The estimate is the
+	// input size times MemoryFactor plus 4 bytes per pixel of images, or the plugin's own if it implements
+	// MemoryEstimator.
+	MaxMemory    int64   `yaml:"max_memory"`
+	MemoryFactor float64 `yaml:"memory_factor"` // defaults to 1
+	// MaxConcurrent limits how many steps of the plugin run at the same time; further steps wait.
+	MaxConcurrent int `yaml:"max_concurrent"`
+}
+
+// MemoryEstimator is implemented by plugins that know their memory needs better than the default estimate of
+// PluginLimits.MaxMemory.
+type MemoryEstimator interface {
+	EstimateMemory(files []*ManagedFile) int64
+}
+
+// ResourceLimitError reports a step stopped by its PluginLimits. errors.Is(err, ErrResourceLimitExceeded) matches
+// it.
+type ResourceLimitError struct {
+	Plugin string
+	Limit  string // ResourceLimitTimeout or ResourceLimitMemory
+	Detail string
+}
+
+func (e *ResourceLimitError) Error() string {
+	return fmt.Sprintf("resource limit of plugin(%s) exceeded: %s %s", e.Plugin, e.Limit, e.Detail)
+}
+
+func (e *ResourceLimitError) Is(target error) bool {
+	return target == ErrResourceLimitExceeded
+}
+
+// PluginPanicError reports a plugin that panicked. The panic fails the step like an error returned by the plugin;
+// other processes are not affected. errors.Is(err, ErrPluginPanicked) matches it, errors.As on the Error of the
+// final status gets the stack trace.
+type PluginPanicError struct {
+	Plugin string
+	Value  any    // the value passed to panic
+	Stack  []byte // the stack of the plugin's goroutine at the panic
+}
+
+func (e *PluginPanicError) Error() string {
+	return fmt.Sprintf("plugin(%s) panicked: %v", e.Plugin, e.Value)
+}
+
+func (e *PluginPanicError) Is(target error) bool {
+	return target == ErrPluginPanicked
+}
+
+type pluginLimit struct {
+	limits PluginLimits
+	slots  chan struct{} // nil without MaxConcurrent
+}
+
+// SetPluginLimits sets the resource limits of the plugin added under the name, for ProcessFile and
+// RunProcessingStep. Tenant views share the limits of their FileManager.
+func (fm *FileManager) SetPluginLimits(pluginName string, limits PluginLimits) {
+	limit := &pluginLimit{limits: limits}
+	if limits.MaxConcurrent > 0 {
+		limit.slots = make(chan struct{}, limits.MaxConcurrent)
+	}
+	root := fm.root()
+	root.mu.Lock()
+	defer root.mu.Unlock()
+	if root.pluginLimits == nil {
+		root.pluginLimits = make(map[string]*pluginLimit)
+	}
+	root.pluginLimits[pluginName] = limit
+}
+
+func (fm *FileManager) getPluginLimit(pluginName string) *pluginLimit {
+	root := fm.root()
+	root.mu.RLock()
+	defer root.mu.RUnlock()
+	return root.pluginLimits[pluginName]
+}
+
+// runPlugin runs a processing step within the limits of the plugin. Plugins with limits run in their own
+// goroutine. Panics of the plugin are turned into a PluginPanicError instead of taking down the service.
+func (fm *FileManager) runPlugin(pluginName string, plugin ProcessingPlugin, files []*ManagedFile, fileProcess *FileProcess) (_ []*ManagedFile, err error) {
+	started := time.Now()
+	defer func() {
+		fm.recordPluginStats(pluginName, started, err)
+	}()
+	limit := fm.getPluginLimit(pluginName)
+	if limit == nil {
+		return fm.callPlugin(pluginName, plugin, files, fileProcess)
+	}
+	limits := limit.limits
+	if limits.MaxMemory > 0 {
+		estimate := fm.estimateMemory(plugin, files, limits.MemoryFactor)
+		if estimate > limits.MaxMemory {
+			return nil, &ResourceLimitError{Plugin: pluginName, Limit: ResourceLimitMemory, Detail: fmt.Sprintf("estimated %d bytes exceeds %d", estimate, limits.MaxMemory)}
+		}
+	}
+	if limit.slots != nil {
+		limit.slots <- struct{}{}
+	}
+
+	type outcome struct {
+		files []*ManagedFile
+		err   error
+	}
+	done := make(chan outcome, 1)
+	go func() {
+		// the slot is held until the plugin returns, also after a timeout
+		if limit.slots != nil {
+			defer func() { <-limit.slots }()
+		}
+		processedFiles, err := fm.callPlugin(pluginName, plugin, files, fileProcess)
+		done <- outcome{files: processedFiles, err: err}
+	}()
+
+	var timeout <-chan time.Time
+	if limits.Timeout > 0 {
+		timer := time.NewTimer(limits.Timeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case result := <-done:
+		return result.files, result.err
+	case <-timeout:
+		fm.LogTo("INFO", fmt.Sprintf("[FileManager.runPlugin] Plugin(%s)%s timed out after %v, abandoning it\n", pluginName, fileProcess.LogLabels(), limits.Timeout))
+		return nil, &ResourceLimitError{Plugin: pluginName, Limit: ResourceLimitTimeout, Detail: fmt.Sprintf("after %v", limits.Timeout)}
+	}
+}
+
+// callPlugin calls the plugin through its middleware chain. Panics of the plugin are recovered into a
+// PluginPanicError before they reach the middleware, panics of the middleware once the chain returns; the stack
+// trace is logged as well.
+func (fm *FileManager) callPlugin(pluginName string, plugin ProcessingPlugin, files []*ManagedFile, fileProcess *FileProcess) ([]*ManagedFile, error) {
+	chain := fm.pluginChain(pluginName, fm.recoverPanics(pluginName, plugin.Process))
+	return fm.recoverPanics(pluginName, chain)(files, fileProcess)
+}
+
+func (fm *FileManager) recoverPanics(pluginName string, next PluginFunc) PluginFunc {
+	return func(files []*ManagedFile, fileProcess *FileProcess) (processedFiles []*ManagedFile, err error) {
+		defer func() {
+			if recovered := recover(); recovered != nil {
+				panicErr := &PluginPanicError{Plugin: pluginName, Value: recovered, Stack: debug.Stack()}
+				fm.LogTo("INFO", fmt.Sprintf("[FileManager.runPlugin] Plugin(%s)%s panicked: %v\n%s\n", pluginName, fileProcess.LogLabels(), recovered, panicErr.Stack))
+				processedFiles, err = nil, panicErr
+			}
+		}()
+		return next(files, fileProcess)
+	}
+}
+
+// estimateMemory is the plugin's own estimate, or the input size times the factor plus the decoded size of images.
+func (fm *FileManager) estimateMemory(plugin ProcessingPlugin, files []*ManagedFile, factor float64) int64 {
+	if estimator, ok := plugin.(MemoryEstimator); ok {
+		return estimator.EstimateMemory(files)
+	}
+	if factor <= 0 {
+		factor = 1
+	}
+	var estimate int64
+	for _, file := range files {
+		size := int64(len(file.Content))
+		if size == 0 {
+			size = file.FileSize
+		}
+		estimate += int64(float64(size) * factor)
+		if strings.HasPrefix(file.MimeType, "image/") {
+			estimate += fm.decodedImageSize(file)
+		}
+	}
+	return estimate
+}
+
+// decodedImageSize reads the dimensions from the image header, 0 if they cannot be read.
+func (fm *FileManager) decodedImageSize(file *ManagedFile) int64 {
+	reader, err := file.Open(fm)
+	if err != nil {
+		return 0
+	}
+	defer reader.Close()
+	config, _, err := image.DecodeConfig(reader)
+	if err != nil {
+		return 0
+	}
+	return int64(config.Width) * int64(config.Height) * 4
+}
+
+// SubprocessLimits are operating system resource limits (rlimits) of the external tools run by a plugin, so a
+// pathological input makes the tool fail instead of exhausting the host. They are set with the ulimit builtin of
+// /bin/sh and not applied on Windows.
+type SubprocessLimits struct {
+	// MaxMemory limits the address space in bytes (ulimit -v). Tools reserving large address spaces up front may
+	// need more than they actually use.
+	MaxMemory int64 `yaml:"max_memory"`
+	// MaxCPUTime limits the CPU time (ulimit -t, whole seconds); the tool is killed when it is used up.
+	MaxCPUTime time.Duration `yaml:"max_cpu_time"`
+}
+
+func (l SubprocessLimits) enabled() bool {
+	return runtime.GOOS != "windows" && (l.MaxMemory > 0 || l.MaxCPUTime > 0)
+}
+
+// LimitedCommand returns an exec.Cmd running the command within the limits, for plugins running external tools.
+// Without limits it is exec.CommandContext(ctx, name, args...).
+func LimitedCommand(ctx context.Context, limits SubprocessLimits, name string, args ...string) *exec.Cmd {
+	if !limits.enabled() {
+		return exec.CommandContext(ctx, name, args...)
+	}
+	var script []string
+	if limits.MaxMemory > 0 {
+		script = append(script, "ulimit -v "+strconv.FormatInt((limits.MaxMemory+1023)/1024, 10))
+	}
+	if limits.MaxCPUTime > 0 {
+		seconds := int64((limits.MaxCPUTime + time.Second - 1) / time.Second)
+		script = append(script, "ulimit -t "+strconv.FormatInt(seconds, 10))
+	}
+	// exec replaces the shell, so exit codes and signals are the tool's own
+	script = append(script, `exec "$0" "$@"`)
+	return exec.CommandContext(ctx, "/bin/sh", append([]string{"-c", strings.Join(script, " && "), name}, args...)...)
+}
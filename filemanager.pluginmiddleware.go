@@ -0,0 +1,74 @@
+package filemanager
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// PluginFunc runs a processing step, like ProcessingPlugin.Process.
+type PluginFunc func(files []*ManagedFile, fileProcess *FileProcess) ([]*ManagedFile, error)
+
+// PluginMiddleware wraps the invocations of plugins for cross-cutting concerns (logging, timing, retries,
+// metrics, tracing, dry runs) without changing the plugins. It is called with the name the plugin was added under
+// and the next function of the chain, and returns the function run in its place; it may call next any number of
+// times, or not at all.
+type PluginMiddleware func(pluginName string, next PluginFunc) PluginFunc
+
+// UsePluginMiddleware adds middleware wrapping every plugin invocation of ProcessFile and RunProcessingStep. The
+// middleware added first is the outermost. Middleware runs within the PluginLimits of the plugin, panics of the
+// plugin reach it as a PluginPanicError and its own panics are recovered the same way. Tenant views share the
+// middleware of their FileManager.
+func (fm *FileManager) UsePluginMiddleware(middleware ...PluginMiddleware) {
+	root := fm.root()
+	root.mu.Lock()
+	defer root.mu.Unlock()
+	root.pluginMiddleware = append(root.pluginMiddleware, middleware...)
+}
+
+// pluginChain returns the function wrapped in the middleware.
+func (fm *FileManager) pluginChain(pluginName string, process PluginFunc) PluginFunc {
+	root := fm.root()
+	root.mu.RLock()
+	middleware := root.pluginMiddleware
+	root.mu.RUnlock()
+	chain := process
+	for i := len(middleware) - 1; i >= 0; i-- {
+		chain = middleware[i](pluginName, chain)
+	}
+	return chain
+}
+
+// RetryPluginMiddleware runs failed steps again, up to attempts runs in total, waiting delay before each retry.
+// retryable decides which errors are retried, nil retries all but cancellations, validation errors and panics.
+// Retries stop when the process is cancelled. Plugins must leave their input files usable on errors for retries
+// to make sense.
+func RetryPluginMiddleware(attempts int, delay time.Duration, retryable func(err error) bool) PluginMiddleware {
+	if retryable == nil {
+		retryable = func(err error) bool {
+			return !errors.Is(err, ErrProcessCancelled) && !errors.Is(err, ErrValidation) && !errors.Is(err, ErrPluginPanicked)
+		}
+	}
+	return func(pluginName string, next PluginFunc) PluginFunc {
+		return func(files []*ManagedFile, fileProcess *FileProcess) ([]*ManagedFile, error) {
+			processedFiles, err := next(files, fileProcess)
+			for attempt := 2; attempt <= attempts && err != nil && retryable(err); attempt++ {
+				fileProcess.AddProcessingUpdate(ProcessingStatus{
+					ProcessID:         fileProcess.ID,
+					TimeStamp:         int(time.Now().UnixNano() / int64(time.Millisecond)),
+					ProcessorName:     pluginName,
+					StatusDescription: fmt.Sprintf("Retrying step (attempt %d of %d) after: %v", attempt, attempts, err),
+				})
+				timer := time.NewTimer(delay)
+				select {
+				case <-timer.C:
+				case <-fileProcess.Context().Done():
+					timer.Stop()
+					return processedFiles, err
+				}
+				processedFiles, err = next(files, fileProcess)
+			}
+			return processedFiles, err
+		}
+	}
+}
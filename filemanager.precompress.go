@@ -0,0 +1,194 @@
+package filemanager
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+)
+
+var (
+	ErrUnsupportedEncoding = errors.New("unsupported content encoding")
+)
+
+const (
+	ENCODING_BROTLI = "br"
+	ENCODING_GZIP   = "gzip"
+	// PRECOMPRESS_MIN_SIZE skips files too small to benefit from compression.
+	PRECOMPRESS_MIN_SIZE = 1024
+)
+
+// preCompressEncodings lists the supported encodings in order of preference when serving, with the extension of
+// their variant files.
+var preCompressEncodings = []struct {
+	encoding  string
+	extension string
+}{
+	{ENCODING_BROTLI, ".br"},
+	{ENCODING_GZIP, ".gz"},
+}
+
+func preCompressExtension(encoding string) (string, bool) {
+	for _, e := range preCompressEncodings {
+		if e.encoding == encoding {
+			return e.extension, true
+		}
+	}
+	return "", false
+}
+
+// IsCompressibleMimeType reports whether files of the MIME type are text-like (text/*, JSON, XML, SVG, JavaScript)
+// and worth compressing.
+func IsCompressibleMimeType(mimeType string) bool {
+	mimeType, _, _ = strings.Cut(strings.ToLower(mimeType), ";")
+	mimeType = strings.TrimSpace(mimeType)
+	switch {
+	case strings.HasPrefix(mimeType, "text/"),
+		strings.HasSuffix(mimeType, "+json"),
+		strings.HasSuffix(mimeType, "+xml"):
+		return true
+	}
+	switch mimeType {
+	case "application/json", "application/xml", "application/javascript", "application/x-javascript",
+		"application/x-ndjson", "image/svg+xml":
+		return true
+	}
+	return false
+}
+
+// PreCompressFile stores compressed variants (<file>.br, <file>.gz) next to a saved text-like file, which
+// FileServer serves with the matching Content-Encoding. Files that are not text-like, smaller than
+// PRECOMPRESS_MIN_SIZE or do not get smaller are skipped. It returns the encodings written.
+func (fm *FileManager) PreCompressFile(file *ManagedFile, encodings []string) ([]string, error) {
+	if !IsCompressibleMimeType(file.MimeType) {
+		return nil, nil
+	}
+	content := file.Content
+	if len(content) == 0 {
+		var err error
+		content, err = fm.GetStorage().ReadFile(file.LocalFilePath)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(content) < PRECOMPRESS_MIN_SIZE {
+		return nil, nil
+	}
+	var written []string
+	for _, encoding := range encodings {
+		encoding = strings.ToLower(strings.TrimSpace(encoding))
+		extension, ok := preCompressExtension(encoding)
+		if !ok {
+			return written, fmt.Errorf("%w: %s", ErrUnsupportedEncoding, encoding)
+		}
+		compressed, err := compressContent(content, encoding)
+		if err != nil {
+			return written, err
+		}
+		if len(compressed) >= len(content) {
+			continue
+		}
+		err = fm.GetStorage().WriteFile(file.LocalFilePath+extension, compressed, 0644, false)
+		if err != nil {
+			return written, err
+		}
+		fm.replicate(file.LocalFilePath+extension, false)
+		written = append(written, encoding)
+	}
+	return written, nil
+}
+
+func compressContent(content []byte, encoding string) ([]byte, error) {
+	buf := getBuffer()
+	defer putBuffer(buf)
+	var w io.WriteCloser
+	switch encoding {
+	case ENCODING_BROTLI:
+		w = brotli.NewWriterLevel(buf, brotli.BestCompression)
+	case ENCODING_GZIP:
+		var err error
+		w, err = gzip.NewWriterLevel(buf, gzip.BestCompression)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedEncoding, encoding)
+	}
+	_, err := w.Write(content)
+	if err != nil {
+		return nil, err
+	}
+	err = w.Close()
+	if err != nil {
+		return nil, err
+	}
+	return bytes.Clone(buf.Bytes()), nil
+}
+
+// preCompressedEncodings returns the encodings of the stored compressed variants of a file.
+func (fm *FileManager) preCompressedEncodings(localFilePath string) []string {
+	var encodings []string
+	for _, e := range preCompressEncodings {
+		_, err := fm.GetStorage().Stat(localFilePath + e.extension)
+		if err == nil {
+			encodings = append(encodings, e.encoding)
+		}
+	}
+	return encodings
+}
+
+// removePreCompressed deletes the compressed variants of a deleted file.
+func (fm *FileManager) removePreCompressed(localFilePath string) {
+	for _, e := range preCompressEncodings {
+		err := fm.GetStorage().Remove(localFilePath + e.extension)
+		if err == nil {
+			fm.replicate(localFilePath+e.extension, true)
+		}
+	}
+}
+
+// preCompressedVariant returns the name of the preferred compressed variant of a file accepted by the client.
+// hasVariants reports whether any variant exists, so responses can vary on Accept-Encoding.
+func preCompressedVariant(fsys *storageFS, name string, acceptEncoding string) (variant string, encoding string, hasVariants bool) {
+	for _, e := range preCompressEncodings {
+		info, err := fsys.Stat(name + e.extension)
+		if err != nil || info.IsDir() {
+			continue
+		}
+		hasVariants = true
+		if variant == "" && acceptsEncoding(acceptEncoding, e.encoding) {
+			variant, encoding = name+e.extension, e.encoding
+		}
+	}
+	return variant, encoding, hasVariants
+}
+
+// acceptsEncoding parses an Accept-Encoding header like "gzip, deflate, br;q=0.9"; q=0 rejects an encoding.
+func acceptsEncoding(acceptEncoding string, encoding string) bool {
+	accepted := false
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		name, params, _ := strings.Cut(part, ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name != encoding && name != "*" {
+			continue
+		}
+		q := 1.0
+		if key, value, ok := strings.Cut(strings.TrimSpace(params), "="); ok && strings.TrimSpace(key) == "q" {
+			parsed, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+			if err == nil {
+				q = parsed
+			}
+		}
+		if name == encoding {
+			// an explicit entry overrides the wildcard
+			return q > 0
+		}
+		accepted = q > 0
+	}
+	return accepted
+}
@@ -0,0 +1,129 @@
+package filemanager
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+var (
+	ErrInvalidPriorityLanes = errors.New("invalid priority lanes")
+)
+
+// Common priorities of recipes and processes. Any name configured in PriorityLanes works.
+const (
+	PRIORITY_INTERACTIVE = "interactive"
+	PRIORITY_BATCH       = "batch"
+)
+
+// PriorityLanes limit how many processes of each priority run at the same time, so small user-facing jobs
+// (thumbnails, avatars) are not starved behind long batch jobs (video transcodes, archive extraction). Every lane
+// has its own slots; processes wait for a free slot of their lane before their first step.
+type PriorityLanes struct {
+	// Lanes maps a priority to the number of processes of that priority running at the same time.
+	Lanes map[string]int `yaml:"lanes"`
+	// Default is the lane of processes without a priority or with one not in Lanes. Empty lets them run without a
+	// limit.
+	Default string `yaml:"default"`
+}
+
+func (lanes PriorityLanes) validate() error {
+	for _, name := range sortedKeys(lanes.Lanes) {
+		if lanes.Lanes[name] <= 0 {
+			return fmt.Errorf("%w: lane(%s) needs a concurrency > 0", ErrInvalidPriorityLanes, name)
+		}
+	}
+	if _, ok := lanes.Lanes[lanes.Default]; lanes.Default != "" && !ok {
+		return fmt.Errorf("%w: default lane(%s) is not configured", ErrInvalidPriorityLanes, lanes.Default)
+	}
+	return nil
+}
+
+type priorityLane struct {
+	name  string
+	slots chan struct{}
+}
+
+type priorityLaneSet struct {
+	lanes       map[string]*priorityLane
+	defaultLane string
+}
+
+// SetPriorityLanes makes ProcessFile and ProcessUpload run their processes in priority lanes.
+// The priority of a process is ProcessOptions.Priority or the Priority of its recipe. Processes already waiting keep
+// their lane. Tenant views share the lanes of their FileManager.
+func (fm *FileManager) SetPriorityLanes(lanes PriorityLanes) error {
+	err := lanes.validate()
+	if err != nil {
+		return err
+	}
+	set := &priorityLaneSet{lanes: make(map[string]*priorityLane, len(lanes.Lanes)), defaultLane: lanes.Default}
+	for name, concurrency := range lanes.Lanes {
+		set.lanes[name] = &priorityLane{name: name, slots: make(chan struct{}, concurrency)}
+	}
+	root := fm.root()
+	root.mu.Lock()
+	defer root.mu.Unlock()
+	root.priorityLanes = set
+	return nil
+}
+
+// PriorityLaneUsage returns the number of running processes per lane.
+func (fm *FileManager) PriorityLaneUsage() map[string]int {
+	set := fm.getPriorityLanes()
+	usage := map[string]int{}
+	if set == nil {
+		return usage
+	}
+	for name, lane := range set.lanes {
+		usage[name] = len(lane.slots)
+	}
+	return usage
+}
+
+func (fm *FileManager) getPriorityLanes() *priorityLaneSet {
+	root := fm.root()
+	root.mu.RLock()
+	defer root.mu.RUnlock()
+	return root.priorityLanes
+}
+
+func (set *priorityLaneSet) lane(priority string) *priorityLane {
+	if lane, ok := set.lanes[priority]; ok {
+		return lane
+	}
+	return set.lanes[set.defaultLane]
+}
+
+// acquirePriorityLane waits for a free slot in the lane of the priority and returns the function releasing it. A
+// waiting process reports that it is queued; if it is cancelled while waiting, ErrProcessCancelled is returned.
+func (fm *FileManager) acquirePriorityLane(priority string, fileProcess *FileProcess, statusCh chan<- *FileProcess) (func(), error) {
+	set := fm.getPriorityLanes()
+	if set == nil {
+		return func() {}, nil
+	}
+	lane := set.lane(priority)
+	if lane == nil {
+		return func() {}, nil
+	}
+	release := func() { <-lane.slots }
+	select {
+	case lane.slots <- struct{}{}:
+		return release, nil
+	default:
+	}
+	fileProcess.AddProcessingUpdate(ProcessingStatus{
+		ProcessID:         fileProcess.ID,
+		TimeStamp:         int(time.Now().UnixNano() / int64(time.Millisecond)),
+		ProcessorName:     "PriorityLane",
+		StatusDescription: fmt.Sprintf("Queued in lane(%s)", lane.name),
+	})
+	publishStatus(statusCh, fileProcess)
+	fm.LogTo("DEBUG", fmt.Sprintf("[FileManager.ProcessFile] Process(%s)%s queued in lane(%s)\n", fileProcess.ID, fileProcess.LogLabels(), lane.name))
+	select {
+	case lane.slots <- struct{}{}:
+		return release, nil
+	case <-fileProcess.Context().Done():
+		return nil, fmt.Errorf("%w: %s", ErrProcessCancelled, fileProcess.ID)
+	}
+}
@@ -0,0 +1,595 @@
+package filemanager
+
+import (
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/net/html/charset"
+)
+
+const (
+	CSV_COLUMN_TYPE_STRING   = "string"
+	CSV_COLUMN_TYPE_INTEGER  = "integer"
+	CSV_COLUMN_TYPE_NUMBER   = "number"
+	CSV_COLUMN_TYPE_BOOLEAN  = "boolean"
+	CSV_COLUMN_TYPE_DATE     = "date"
+	CSV_COLUMN_TYPE_DATETIME = "datetime"
+
+	CSV_INVALID_ROWS_DROP = "drop"
+	CSV_INVALID_ROWS_KEEP = "keep"
+	CSV_INVALID_ROWS_FAIL = "fail"
+
+	METADATA_KEY_CSV_ROWS         = "csv_rows"
+	METADATA_KEY_CSV_INVALID_ROWS = "csv_invalid_rows"
+	METADATA_KEY_CSV_DELIMITER    = "csv_delimiter"
+	METADATA_KEY_CSV_ENCODING     = "csv_encoding"
+
+	CSV_MIME_TYPE = "text/csv"
+)
+
+// csvDelimiterCandidates are tried in this order when the delimiter is detected, the first wins ties.
+var csvDelimiterCandidates = []rune{',', ';', '\t', '|'}
+
+// CSVColumn declares a column of the CSVValidationPlugin. Values are trimmed; empty values are allowed unless the
+// column is required.
+type CSVColumn struct {
+	Name     string `yaml:"name"`
+	Type     string `yaml:"type"`     // string (default), integer, number, boolean, date or datetime
+	Required bool   `yaml:"required"` // the column must exist and its values must not be empty
+	Pattern  string `yaml:"pattern"`  // regular expression the (trimmed) value must match
+	// Values are the allowed values, compared after normalization.
+	Values []string `yaml:"values"`
+	// Format is the Go time layout of date and datetime values, "2006-01-02" and RFC 3339 by default.
+	Format string `yaml:"format"`
+}
+
+// CSVValidationPlugin validates CSV files against declared columns and normalizes them: the output is UTF-8
+// without BOM, comma separated with minimal RFC 4180 quoting, has the declared columns in their declared order
+// (followed by undeclared ones) and values in canonical form (numbers without decimal comma, booleans as
+// true/false, dates as 2006-01-02, datetimes as RFC 3339). Input encoding and delimiter are detected unless set.
+//
+// Rows with invalid values are listed in a "<file name>.errors.csv" report (line, column, value, error), a further
+// file of the step stored next to the first output. Missing required columns fail the recipe with a
+// DataValidationError, as do invalid rows with invalid_rows "fail".
+//
+// Params:
+//   - columns: list of CSVColumn (name, type, required, pattern, values, format)
+//   - header: whether the first row names the columns (default true); without, columns are matched by position
+//   - delimiter, output_delimiter: e.g. ";" or "tab"; the input delimiter is detected if not set
+//   - encoding: the input encoding, e.g. "windows-1252"; detected from the BOM, else UTF-8 falling back to
+//     windows-1252
+//   - decimal_separator: "." (default) or ","
+//   - invalid_rows: "drop" (default) leaves invalid rows out of the output, "keep" keeps them as they are, "fail"
+//     fails the recipe
+//   - allow_extra_columns: whether undeclared columns are kept (default true) or are an error
+type CSVValidationPlugin struct{}
+
+type csvValidationParams struct {
+	Columns           []CSVColumn `yaml:"columns"`
+	Header            *bool       `yaml:"header"`
+	Delimiter         string      `yaml:"delimiter"`
+	OutputDelimiter   string      `yaml:"output_delimiter"`
+	Encoding          string      `yaml:"encoding"`
+	DecimalSeparator  string      `yaml:"decimal_separator"`
+	InvalidRows       string      `yaml:"invalid_rows"`
+	AllowExtraColumns *bool       `yaml:"allow_extra_columns"`
+}
+
+// csvRowError is a line of the errors report.
+type csvRowError struct {
+	line    int
+	column  string
+	value   string
+	message string
+}
+
+func (p *CSVValidationPlugin) Process(files []*ManagedFile, fileProcess *FileProcess) ([]*ManagedFile, error) {
+	var processedFiles []*ManagedFile
+	var reports []*ManagedFile
+
+	for _, file := range files {
+		if !isCSVFile(file) {
+			processedFiles = append(processedFiles, file)
+			continue
+		}
+		status := ProcessingStatus{
+			ProcessID:         fileProcess.ID,
+			TimeStamp:         int(time.Now().UnixNano() / int64(time.Millisecond)),
+			ProcessorName:     "CSVValidation",
+			StatusDescription: fmt.Sprintf("Validating CSV file(%s)", file.FileName),
+		}
+		fileProcess.AddProcessingUpdate(status)
+
+		params, err := parseCSVValidationParams(file.MetaData)
+		if err != nil {
+			return nil, err
+		}
+		report, err := validateCSV(file, params)
+		if err != nil {
+			return nil, err
+		}
+		processedFiles = append(processedFiles, file)
+		if report != nil {
+			reports = append(reports, report)
+		}
+	}
+
+	return append(processedFiles, reports...), nil
+}
+
+// DryRun implements DryRunPlugin: it checks the validation params. Whether a report is produced depends on the
+// content, so none is described.
+func (p *CSVValidationPlugin) DryRun(files []*ManagedFile) ([]*ManagedFile, error) {
+	for _, file := range files {
+		if !isCSVFile(file) {
+			continue
+		}
+		_, err := parseCSVValidationParams(file.MetaData)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return files, nil
+}
+
+func isCSVFile(file *ManagedFile) bool {
+	mimeType := strings.ToLower(file.MimeType)
+	if strings.HasPrefix(mimeType, CSV_MIME_TYPE) || strings.HasPrefix(mimeType, "text/tab-separated-values") {
+		return true
+	}
+	name := strings.ToLower(file.FileName)
+	return strings.HasSuffix(name, ".csv") || strings.HasSuffix(name, ".tsv")
+}
+
+func parseCSVValidationParams(metaData map[string]any) (csvValidationParams, error) {
+	var params csvValidationParams
+	options := map[string]any{}
+	for _, key := range []string{"columns", "header", "delimiter", "output_delimiter", "encoding", "decimal_separator", "invalid_rows", "allow_extra_columns"} {
+		if value, ok := metaData[key]; ok {
+			options[key] = value
+		}
+	}
+	err := DecodeOptions(options, &params)
+	if err != nil {
+		return params, fmt.Errorf("invalid CSV validation params: %v", err)
+	}
+	if params.InvalidRows == "" {
+		params.InvalidRows = CSV_INVALID_ROWS_DROP
+	}
+	if params.InvalidRows != CSV_INVALID_ROWS_DROP && params.InvalidRows != CSV_INVALID_ROWS_KEEP && params.InvalidRows != CSV_INVALID_ROWS_FAIL {
+		return params, fmt.Errorf("invalid invalid_rows: %s", params.InvalidRows)
+	}
+	if params.DecimalSeparator == "" {
+		params.DecimalSeparator = "."
+	}
+	if params.DecimalSeparator != "." && params.DecimalSeparator != "," {
+		return params, fmt.Errorf("invalid decimal_separator: %s", params.DecimalSeparator)
+	}
+	for i, column := range params.Columns {
+		if column.Name == "" {
+			return params, fmt.Errorf("CSV column %d has no name", i+1)
+		}
+		switch column.Type {
+		case "":
+			params.Columns[i].Type = CSV_COLUMN_TYPE_STRING
+		case CSV_COLUMN_TYPE_STRING, CSV_COLUMN_TYPE_INTEGER, CSV_COLUMN_TYPE_NUMBER, CSV_COLUMN_TYPE_BOOLEAN, CSV_COLUMN_TYPE_DATE, CSV_COLUMN_TYPE_DATETIME:
+		default:
+			return params, fmt.Errorf("invalid type of CSV column(%s): %s", column.Name, column.Type)
+		}
+	}
+	return params, nil
+}
+
+// csvColumnValidator checks and normalizes the values of a declared column.
+type csvColumnValidator struct {
+	CSVColumn
+	pattern          *regexp.Regexp
+	decimalSeparator string
+}
+
+func (v *csvColumnValidator) normalize(value string) (string, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		if v.Required {
+			return "", errors.New("value is required")
+		}
+		return "", nil
+	}
+	if v.pattern != nil && !v.pattern.MatchString(value) {
+		return "", fmt.Errorf("does not match the pattern %q", v.Pattern)
+	}
+	normalized := value
+	switch v.Type {
+	case CSV_COLUMN_TYPE_INTEGER:
+		number, err := strconv.ParseInt(strings.TrimPrefix(value, "+"), 10, 64)
+		if err != nil {
+			return "", errors.New("not an integer")
+		}
+		normalized = strconv.FormatInt(number, 10)
+	case CSV_COLUMN_TYPE_NUMBER:
+		if v.decimalSeparator == "," {
+			if strings.Contains(value, ".") {
+				return "", errors.New("not a number (the decimal separator is \",\")")
+			}
+			value = strings.Replace(value, ",", ".", 1)
+		}
+		number, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return "", errors.New("not a number")
+		}
+		normalized = strconv.FormatFloat(number, 'f', -1, 64)
+	case CSV_COLUMN_TYPE_BOOLEAN:
+		switch strings.ToLower(value) {
+		case "true", "yes", "y", "1", "on":
+			normalized = "true"
+		case "false", "no", "n", "0", "off":
+			normalized = "false"
+		default:
+			return "", errors.New("not a boolean")
+		}
+	case CSV_COLUMN_TYPE_DATE:
+		layout := v.Format
+		if layout == "" {
+			layout = time.DateOnly
+		}
+		date, err := time.Parse(layout, value)
+		if err != nil {
+			return "", fmt.Errorf("not a date of the format %q", layout)
+		}
+		normalized = date.Format(time.DateOnly)
+	case CSV_COLUMN_TYPE_DATETIME:
+		layout := v.Format
+		if layout == "" {
+			layout = time.RFC3339
+		}
+		datetime, err := time.Parse(layout, value)
+		if err != nil {
+			return "", fmt.Errorf("not a datetime of the format %q", layout)
+		}
+		normalized = datetime.Format(time.RFC3339)
+	}
+	if len(v.Values) > 0 {
+		allowed := false
+		for _, candidate := range v.Values {
+			if candidate == normalized {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return "", fmt.Errorf("not one of %s", strings.Join(v.Values, ", "))
+		}
+	}
+	return normalized, nil
+}
+
+// validateCSV normalizes the file in place and returns the errors report, nil if all rows are valid.
+func validateCSV(file *ManagedFile, params csvValidationParams) (*ManagedFile, error) {
+	content, encoding, err := decodeCSVText(file.Content, params.Encoding)
+	if err != nil {
+		return nil, err
+	}
+	delimiter, err := csvDelimiter(params.Delimiter)
+	if err != nil {
+		return nil, err
+	}
+	if delimiter == 0 {
+		delimiter = detectCSVDelimiter(content)
+	}
+	outputDelimiter, err := csvDelimiter(params.OutputDelimiter)
+	if err != nil {
+		return nil, err
+	}
+	if outputDelimiter == 0 {
+		outputDelimiter = ','
+	}
+
+	reader := csv.NewReader(bytes.NewReader(content))
+	reader.Comma = delimiter
+	reader.FieldsPerRecord = -1
+	reader.LazyQuotes = true
+
+	validators := make([]*csvColumnValidator, len(params.Columns))
+	for i, column := range params.Columns {
+		validators[i] = &csvColumnValidator{CSVColumn: column, decimalSeparator: params.DecimalSeparator}
+		if column.Pattern != "" {
+			validators[i].pattern, err = regexp.Compile(column.Pattern)
+			if err != nil {
+				return nil, fmt.Errorf("invalid pattern of CSV column(%s): %v", column.Name, err)
+			}
+		}
+	}
+
+	// layout maps output columns to input fields (-1 for declared columns missing from the input) and validators
+	var outputHeader []string
+	var sources []int
+	var columnValidators []*csvColumnValidator
+	var problems []DataValidationProblem
+	hasHeader := params.Header == nil || *params.Header
+	allowExtraColumns := params.AllowExtraColumns == nil || *params.AllowExtraColumns
+	var rowErrors []csvRowError
+	var rows [][]string
+	validRows, invalidRows := 0, 0
+	fieldCount := -1
+
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		line, _ := reader.FieldPos(0)
+		if err != nil {
+			var parseErr *csv.ParseError
+			if errors.As(err, &parseErr) {
+				line = parseErr.StartLine
+			}
+			rowErrors = append(rowErrors, csvRowError{line: line, message: err.Error()})
+			invalidRows++
+			continue
+		}
+		if fieldCount < 0 {
+			fieldCount = len(record)
+			var header []string
+			if hasHeader {
+				header = record
+				header[0] = strings.TrimPrefix(header[0], "\ufeff")
+			}
+			outputHeader, sources, columnValidators, problems = csvLayout(header, len(record), validators, allowExtraColumns)
+			if len(problems) > 0 {
+				for i := range problems {
+					problems[i].Line = line
+				}
+				return nil, &DataValidationError{FileName: file.FileName, Format: "csv", Problems: problems}
+			}
+			if hasHeader {
+				rows = append(rows, outputHeader)
+				continue
+			}
+		}
+		if len(record) == 1 && strings.TrimSpace(record[0]) == "" && fieldCount > 1 {
+			// blank lines with whitespace only
+			continue
+		}
+
+		var errs []csvRowError
+		if len(record) != fieldCount {
+			errs = append(errs, csvRowError{line: line, message: fmt.Sprintf("expected %d fields, got %d", fieldCount, len(record))})
+		}
+		row := make([]string, len(sources))
+		for i, source := range sources {
+			value := ""
+			if source >= 0 && source < len(record) {
+				value = record[source]
+			}
+			if columnValidators[i] == nil {
+				row[i] = value
+				continue
+			}
+			normalized, err := columnValidators[i].normalize(value)
+			if err != nil {
+				errs = append(errs, csvRowError{line: line, column: outputHeader[i], value: value, message: err.Error()})
+				row[i] = value
+				continue
+			}
+			row[i] = normalized
+		}
+		if len(errs) > 0 {
+			rowErrors = append(rowErrors, errs...)
+			invalidRows++
+			if params.InvalidRows == CSV_INVALID_ROWS_DROP {
+				continue
+			}
+		} else {
+			validRows++
+		}
+		rows = append(rows, row)
+	}
+
+	if len(rowErrors) > 0 && params.InvalidRows == CSV_INVALID_ROWS_FAIL {
+		problems := make([]DataValidationProblem, len(rowErrors))
+		for i, rowErr := range rowErrors {
+			message := rowErr.message
+			if rowErr.column != "" {
+				message = fmt.Sprintf("column %q: %s", rowErr.column, message)
+			}
+			problems[i] = DataValidationProblem{Line: rowErr.line, Message: message}
+		}
+		if len(problems) > DEFAULT_MAX_VALIDATION_PROBLEMS {
+			problems = problems[:DEFAULT_MAX_VALIDATION_PROBLEMS]
+		}
+		return nil, &DataValidationError{FileName: file.FileName, Format: "csv", Problems: problems}
+	}
+
+	normalized, err := writeCSV(rows, outputDelimiter)
+	if err != nil {
+		return nil, err
+	}
+	file.Content = normalized
+	file.FileSize = int64(len(normalized))
+	file.FileName = fileNameWithFormat(file.FileName, "csv")
+	file.MimeType = CSV_MIME_TYPE
+	file.SetMetaData(METADATA_KEY_CSV_ROWS, validRows)
+	file.SetMetaData(METADATA_KEY_CSV_INVALID_ROWS, invalidRows)
+	file.SetMetaData(METADATA_KEY_CSV_DELIMITER, string(delimiter))
+	file.SetMetaData(METADATA_KEY_CSV_ENCODING, encoding)
+
+	if len(rowErrors) == 0 {
+		return nil, nil
+	}
+	reportRows := [][]string{{"line", "column", "value", "error"}}
+	for _, rowErr := range rowErrors {
+		reportRows = append(reportRows, []string{strconv.Itoa(rowErr.line), rowErr.column, rowErr.value, rowErr.message})
+	}
+	report, err := writeCSV(reportRows, ',')
+	if err != nil {
+		return nil, err
+	}
+	return &ManagedFile{
+		FileName: file.FileName + ".errors.csv",
+		MimeType: CSV_MIME_TYPE,
+		Owner:    file.Owner,
+		Content:  report,
+		FileSize: int64(len(report)),
+		MetaData: map[string]any{
+			METADATA_KEY_CSV_INVALID_ROWS: invalidRows,
+			"source_file_name":            file.FileName,
+		},
+	}, nil
+}
+
+// csvLayout matches the header (nil without one) against the declared columns. It returns the output header, the
+// input field of every output column (-1 if missing) and the validators of the output columns (nil for undeclared
+// ones), or the problems of the header.
+func csvLayout(header []string, fieldCount int, validators []*csvColumnValidator, allowExtraColumns bool) ([]string, []int, []*csvColumnValidator, []DataValidationProblem) {
+	var outputHeader []string
+	var sources []int
+	var columnValidators []*csvColumnValidator
+	var problems []DataValidationProblem
+
+	if header == nil {
+		for i := 0; i < fieldCount || i < len(validators); i++ {
+			if i < len(validators) {
+				outputHeader = append(outputHeader, validators[i].Name)
+				columnValidators = append(columnValidators, validators[i])
+			} else if !allowExtraColumns {
+				problems = append(problems, DataValidationProblem{Message: fmt.Sprintf("undeclared column %d", i+1)})
+				continue
+			} else {
+				outputHeader = append(outputHeader, "")
+				columnValidators = append(columnValidators, nil)
+			}
+			sources = append(sources, i)
+		}
+		return outputHeader, sources, columnValidators, problems
+	}
+
+	fields := map[string]int{}
+	for i, name := range header {
+		key := strings.ToLower(strings.TrimSpace(name))
+		if _, duplicate := fields[key]; duplicate && key != "" {
+			problems = append(problems, DataValidationProblem{Message: fmt.Sprintf("duplicate column %q", strings.TrimSpace(name))})
+			continue
+		}
+		fields[key] = i
+	}
+	used := map[int]bool{}
+	for _, validator := range validators {
+		source, ok := fields[strings.ToLower(validator.Name)]
+		if !ok {
+			if validator.Required {
+				problems = append(problems, DataValidationProblem{Message: fmt.Sprintf("missing required column %q", validator.Name)})
+			}
+			source = -1
+		}
+		used[source] = true
+		outputHeader = append(outputHeader, validator.Name)
+		sources = append(sources, source)
+		columnValidators = append(columnValidators, validator)
+	}
+	for i, name := range header {
+		if used[i] {
+			continue
+		}
+		name = strings.TrimSpace(name)
+		if !allowExtraColumns && len(validators) > 0 {
+			problems = append(problems, DataValidationProblem{Message: fmt.Sprintf("undeclared column %q", name)})
+			continue
+		}
+		outputHeader = append(outputHeader, name)
+		sources = append(sources, i)
+		columnValidators = append(columnValidators, nil)
+	}
+	return outputHeader, sources, columnValidators, problems
+}
+
+// decodeCSVText converts the content to UTF-8 (without BOM) and returns the name of its encoding: the given one,
+// the one of the BOM, UTF-8 if valid, otherwise windows-1252.
+func decodeCSVText(content []byte, encodingLabel string) ([]byte, string, error) {
+	switch {
+	case encodingLabel != "":
+	case bytes.HasPrefix(content, []byte{0xEF, 0xBB, 0xBF}):
+		return content[3:], "utf-8", nil
+	case bytes.HasPrefix(content, []byte{0xFF, 0xFE}):
+		encodingLabel = "utf-16le"
+		content = content[2:]
+	case bytes.HasPrefix(content, []byte{0xFE, 0xFF}):
+		encodingLabel = "utf-16be"
+		content = content[2:]
+	case utf8.Valid(content):
+		return content, "utf-8", nil
+	default:
+		encodingLabel = "windows-1252"
+	}
+	encoding, name := charset.Lookup(encodingLabel)
+	if encoding == nil {
+		return nil, "", fmt.Errorf("unknown encoding: %s", encodingLabel)
+	}
+	decoded, err := encoding.NewDecoder().Bytes(content)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to decode %s: %v", name, err)
+	}
+	return bytes.TrimPrefix(decoded, []byte("\ufeff")), name, nil
+}
+
+func csvDelimiter(delimiter string) (rune, error) {
+	switch delimiter {
+	case "":
+		return 0, nil
+	case "tab", "\\t":
+		return '\t', nil
+	}
+	r, size := utf8.DecodeRuneInString(delimiter)
+	if size != len(delimiter) || r == '"' || r == '\r' || r == '\n' || r == utf8.RuneError {
+		return 0, fmt.Errorf("invalid CSV delimiter: %q", delimiter)
+	}
+	return r, nil
+}
+
+// detectCSVDelimiter picks the candidate splitting most of the first lines into the same number of fields, the one
+// with more fields if several do equally well. Files with a single column fall back to a comma.
+func detectCSVDelimiter(content []byte) rune {
+	best, bestMatches, bestFields := ',', 0, 1
+	for _, candidate := range csvDelimiterCandidates {
+		reader := csv.NewReader(bytes.NewReader(content))
+		reader.Comma = candidate
+		reader.FieldsPerRecord = -1
+		reader.LazyQuotes = true
+		counts := map[int]int{}
+		for i := 0; i < 20; i++ {
+			record, err := reader.Read()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				continue
+			}
+			counts[len(record)]++
+		}
+		for fields, matches := range counts {
+			if fields > 1 && (matches > bestMatches || (matches == bestMatches && fields > bestFields)) {
+				best, bestMatches, bestFields = candidate, matches, fields
+			}
+		}
+	}
+	return best
+}
+
+func writeCSV(rows [][]string, delimiter rune) ([]byte, error) {
+	buf := getBuffer()
+	defer putBuffer(buf)
+	writer := csv.NewWriter(buf)
+	writer.Comma = delimiter
+	err := writer.WriteAll(rows)
+	if err != nil {
+		return nil, fmt.Errorf("failed to write CSV: %v", err)
+	}
+	return bytes.Clone(buf.Bytes()), nil
+}
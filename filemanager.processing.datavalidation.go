@@ -0,0 +1,509 @@
+package filemanager
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/net/html/charset"
+)
+
+var (
+	ErrDataValidation       = errors.New("structured data validation failed")
+	ErrValidatorToolMissing = errors.New("schema validation tool not installed")
+)
+
+const (
+	DATA_FORMAT_JSON = "json"
+	DATA_FORMAT_YAML = "yaml"
+	DATA_FORMAT_XML  = "xml"
+
+	METADATA_KEY_DATA_FORMAT = "data_format"
+
+	DEFAULT_MAX_VALIDATION_PROBLEMS = 20
+	DEFAULT_XML_VALIDATOR_TIMEOUT   = 30 * time.Second
+)
+
+// DataValidationProblem is a single reason a document is invalid. Line and Column (1-based) are set when the
+// position is known, Path is the JSON pointer of the offending value for JSON Schema violations.
+type DataValidationProblem struct {
+	Line    int    `json:"line,omitempty"`
+	Column  int    `json:"column,omitempty"`
+	Path    string `json:"path,omitempty"`
+	Message string `json:"message"`
+}
+
+func (p DataValidationProblem) String() string {
+	var location []string
+	if p.Line > 0 {
+		location = append(location, "line "+strconv.Itoa(p.Line))
+	}
+	if p.Column > 0 {
+		location = append(location, "column "+strconv.Itoa(p.Column))
+	}
+	if p.Path != "" {
+		location = append(location, p.Path)
+	}
+	if len(location) == 0 {
+		return p.Message
+	}
+	return strings.Join(location, ", ") + ": " + p.Message
+}
+
+// DataValidationError is returned by the DataValidationPlugin for a malformed document or one not matching its
+// schema, failing the recipe. It matches ErrDataValidation with errors.Is.
+type DataValidationError struct {
+	FileName string
+	Format   string
+	Problems []DataValidationProblem
+}
+
+func (e *DataValidationError) Error() string {
+	problems := make([]string, len(e.Problems))
+	for i, problem := range e.Problems {
+		problems[i] = problem.String()
+	}
+	return fmt.Sprintf("%v: %s file(%s): %s", ErrDataValidation, e.Format, e.FileName, strings.Join(problems, "; "))
+}
+
+func (e *DataValidationError) Unwrap() error {
+	return ErrDataValidation
+}
+
+// DataValidationPlugin checks JSON, YAML and XML files for well-formedness and optionally validates them against a
+// schema: a JSON Schema for JSON and YAML (see JSONSchema), an XSD for XML. XSD validation runs xmllint (libxml2),
+// which has to be installed then. Invalid documents fail the recipe with a DataValidationError listing the problems
+// with their line, column and (for schema violations of JSON and YAML) the JSON pointer of the value. Valid files
+// pass unchanged with MetaData["data_format"], files of other types are passed through.
+//
+// Params:
+//   - data_format: "json", "yaml" or "xml", detected from the MIME type and extension if not set
+//   - schema: the schema document, a JSON Schema as a map or a JSON/YAML string, an XSD as a string
+//   - schema_file: path of the schema document instead of schema; relative xs:includes are resolved from there
+type DataValidationPlugin struct {
+	XMLLintPath string        // defaults to "xmllint" in PATH
+	Timeout     time.Duration // per XSD validation, defaults to DEFAULT_XML_VALIDATOR_TIMEOUT
+	MaxProblems int           // problems reported per file, defaults to DEFAULT_MAX_VALIDATION_PROBLEMS
+	// Limits are the rlimits of the xmllint runs.
+	Limits SubprocessLimits
+}
+
+func (p *DataValidationPlugin) Process(files []*ManagedFile, fileProcess *FileProcess) ([]*ManagedFile, error) {
+	var processedFiles []*ManagedFile
+
+	for _, file := range files {
+		format, err := dataFormatOf(file)
+		if err != nil {
+			return nil, err
+		}
+		if format == "" {
+			processedFiles = append(processedFiles, file)
+			continue
+		}
+		status := ProcessingStatus{
+			ProcessID:         fileProcess.ID,
+			TimeStamp:         int(time.Now().UnixNano() / int64(time.Millisecond)),
+			ProcessorName:     "DataValidation",
+			StatusDescription: fmt.Sprintf("Validating %s of file(%s)", format, file.FileName),
+		}
+		fileProcess.AddProcessingUpdate(status)
+
+		problems, err := p.validate(file, file.Content, format)
+		if err != nil {
+			return nil, err
+		}
+		if len(problems) > 0 {
+			if len(problems) > p.maxProblems() {
+				problems = problems[:p.maxProblems()]
+			}
+			return nil, &DataValidationError{FileName: file.FileName, Format: format, Problems: problems}
+		}
+		file.SetMetaData(METADATA_KEY_DATA_FORMAT, format)
+		processedFiles = append(processedFiles, file)
+	}
+
+	return processedFiles, nil
+}
+
+func (p *DataValidationPlugin) maxProblems() int {
+	if p.MaxProblems > 0 {
+		return p.MaxProblems
+	}
+	return DEFAULT_MAX_VALIDATION_PROBLEMS
+}
+
+// dataFormatOf returns the data_format param or the format of the MIME type or extension, "" for other files.
+func dataFormatOf(file *ManagedFile) (string, error) {
+	if format, ok := file.MetaData["data_format"].(string); ok && format != "" {
+		format = strings.ToLower(format)
+		if format == "yml" {
+			format = DATA_FORMAT_YAML
+		}
+		if format != DATA_FORMAT_JSON && format != DATA_FORMAT_YAML && format != DATA_FORMAT_XML {
+			return "", fmt.Errorf("invalid data_format: %s", format)
+		}
+		return format, nil
+	}
+	mimeType := strings.ToLower(file.MimeType)
+	if i := strings.Index(mimeType, ";"); i >= 0 {
+		mimeType = strings.TrimSpace(mimeType[:i])
+	}
+	switch {
+	case mimeType == "application/json" || mimeType == "text/json" || strings.HasSuffix(mimeType, "+json"):
+		return DATA_FORMAT_JSON, nil
+	case strings.HasSuffix(mimeType, "/yaml") || strings.HasSuffix(mimeType, "/x-yaml") || strings.HasSuffix(mimeType, "+yaml"):
+		return DATA_FORMAT_YAML, nil
+	case mimeType == "application/xml" || mimeType == "text/xml" || strings.HasSuffix(mimeType, "+xml"):
+		return DATA_FORMAT_XML, nil
+	}
+	// YAML and JSON without a signature are often detected as text/plain
+	switch strings.ToLower(filepath.Ext(file.FileName)) {
+	case ".json":
+		return DATA_FORMAT_JSON, nil
+	case ".yaml", ".yml":
+		return DATA_FORMAT_YAML, nil
+	case ".xml":
+		return DATA_FORMAT_XML, nil
+	}
+	return "", nil
+}
+
+func (p *DataValidationPlugin) validate(file *ManagedFile, content []byte, format string) ([]DataValidationProblem, error) {
+	if format == DATA_FORMAT_XML {
+		problems := checkXML(content)
+		if len(problems) > 0 {
+			return problems, nil
+		}
+		return p.validateXSD(file, content)
+	}
+
+	var value any
+	var positions map[string]textPosition
+	var problems []DataValidationProblem
+	if format == DATA_FORMAT_JSON {
+		value, positions, problems = checkJSON(content)
+	} else {
+		value, positions, problems = checkYAML(content)
+	}
+	if len(problems) > 0 {
+		return problems, nil
+	}
+	schema, err := jsonSchemaParam(file)
+	if err != nil || schema == nil {
+		return nil, err
+	}
+	for _, violation := range schema.Validate(value) {
+		position := positions[violation.Path]
+		problems = append(problems, DataValidationProblem{
+			Line:    position.Line,
+			Column:  position.Column,
+			Path:    violation.Path,
+			Message: violation.Message,
+		})
+	}
+	sort.SliceStable(problems, func(i, j int) bool {
+		if problems[i].Line != problems[j].Line {
+			return problems[i].Line < problems[j].Line
+		}
+		return problems[i].Column < problems[j].Column
+	})
+	return problems, nil
+}
+
+// jsonSchemaParam returns the JSON Schema of the schema or schema_file param, nil if there is none.
+func jsonSchemaParam(file *ManagedFile) (*JSONSchema, error) {
+	if schemaFile, ok := file.MetaData["schema_file"].(string); ok && schemaFile != "" {
+		content, err := os.ReadFile(schemaFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read schema_file(%s): %v", schemaFile, err)
+		}
+		return ParseJSONSchema(content)
+	}
+	switch schema := file.MetaData["schema"].(type) {
+	case nil:
+		return nil, nil
+	case string:
+		return ParseJSONSchema([]byte(schema))
+	default:
+		return NewJSONSchema(schema)
+	}
+}
+
+// checkJSON decodes a single JSON value, returning it and the positions of its values by JSON pointer, or the
+// position of the syntax error.
+func checkJSON(content []byte) (any, map[string]textPosition, []DataValidationProblem) {
+	problemAt := func(offset int64, message string) []DataValidationProblem {
+		position := positionAt(content, offset)
+		return []DataValidationProblem{{Line: position.Line, Column: position.Column, Message: message}}
+	}
+	if !utf8.Valid(content) {
+		return nil, nil, problemAt(int64(invalidUTF8Offset(content)), "invalid UTF-8")
+	}
+	var value any
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	err := decoder.Decode(&value)
+	if err != nil {
+		var syntaxErr *json.SyntaxError
+		switch {
+		case errors.As(err, &syntaxErr):
+			// the offset is that of the byte after the offending one
+			return nil, nil, problemAt(max(syntaxErr.Offset-1, 0), strings.TrimPrefix(syntaxErr.Error(), "json: "))
+		case err == io.EOF:
+			return nil, nil, []DataValidationProblem{{Message: "empty document"}}
+		case err == io.ErrUnexpectedEOF:
+			return nil, nil, problemAt(int64(len(content)), "unexpected end of JSON input")
+		}
+		return nil, nil, []DataValidationProblem{{Message: err.Error()}}
+	}
+	rest := decoder.InputOffset()
+	rest += int64(len(content[rest:]) - len(bytes.TrimLeft(content[rest:], " \t\r\n")))
+	if rest < int64(len(content)) {
+		return nil, nil, problemAt(rest, "unexpected data after the JSON value")
+	}
+	return value, jsonValuePositions(content), nil
+}
+
+// jsonValuePositions returns the positions where the values of a well-formed JSON document start, by JSON pointer.
+func jsonValuePositions(content []byte) map[string]textPosition {
+	positions := map[string]textPosition{}
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	var readValue func(path string) error
+	readValue = func(path string) error {
+		start := decoder.InputOffset()
+		for start < int64(len(content)) && strings.IndexByte(" \t\r\n:,", content[start]) >= 0 {
+			start++
+		}
+		token, err := decoder.Token()
+		if err != nil {
+			return err
+		}
+		positions[path] = positionAt(content, start)
+		switch token {
+		case json.Delim('{'):
+			for decoder.More() {
+				key, err := decoder.Token()
+				if err != nil {
+					return err
+				}
+				name, _ := key.(string)
+				err = readValue(path + "/" + escapeJSONPointer(name))
+				if err != nil {
+					return err
+				}
+			}
+			_, err = decoder.Token()
+			return err
+		case json.Delim('['):
+			for i := 0; decoder.More(); i++ {
+				err = readValue(path + "/" + strconv.Itoa(i))
+				if err != nil {
+					return err
+				}
+			}
+			_, err = decoder.Token()
+			return err
+		}
+		return nil
+	}
+	_ = readValue("")
+	return positions
+}
+
+var yamlErrorLineRegex = regexp.MustCompile(`^(?:yaml: )?line (\d+): (.*)$`)
+
+// checkYAML decodes the first document of a YAML stream, returning it and the positions of its values by JSON
+// pointer, or the problems of the YAML parser.
+func checkYAML(content []byte) (any, map[string]textPosition, []DataValidationProblem) {
+	value, positions, err := decodeYAMLValue(content)
+	if err == nil {
+		return value, positions, nil
+	}
+	// unmarshal errors list one problem per line
+	var problems []DataValidationProblem
+	for _, line := range strings.Split(err.Error(), "\n") {
+		line = strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(line), "yaml: unmarshal errors:"))
+		if line == "" {
+			continue
+		}
+		if match := yamlErrorLineRegex.FindStringSubmatch(line); match != nil {
+			lineNumber, _ := strconv.Atoi(match[1])
+			problems = append(problems, DataValidationProblem{Line: lineNumber, Message: match[2]})
+			continue
+		}
+		problems = append(problems, DataValidationProblem{Message: strings.TrimPrefix(line, "yaml: ")})
+	}
+	return nil, nil, problems
+}
+
+// checkXML reads all tokens of an XML document, which also checks that elements are closed properly, and that it
+// has exactly one root element.
+func checkXML(content []byte) []DataValidationProblem {
+	problemAt := func(offset int64, message string) []DataValidationProblem {
+		position := positionAt(content, offset)
+		return []DataValidationProblem{{Line: position.Line, Column: position.Column, Message: message}}
+	}
+	decoder := xml.NewDecoder(bytes.NewReader(content))
+	decoder.CharsetReader = charset.NewReaderLabel
+	depth := 0
+	hasRoot := false
+	for {
+		start := decoder.InputOffset()
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			var syntaxErr *xml.SyntaxError
+			if errors.As(err, &syntaxErr) {
+				line, column := decoder.InputPos()
+				if line != syntaxErr.Line {
+					column = 0
+				}
+				return []DataValidationProblem{{Line: syntaxErr.Line, Column: column, Message: syntaxErr.Msg}}
+			}
+			return problemAt(decoder.InputOffset(), strings.TrimPrefix(err.Error(), "xml: "))
+		}
+		switch typed := token.(type) {
+		case xml.StartElement:
+			if depth == 0 && hasRoot {
+				return problemAt(skipXMLSpace(content, start), fmt.Sprintf("second root element <%s>", typed.Name.Local))
+			}
+			hasRoot = true
+			depth++
+		case xml.EndElement:
+			depth--
+		case xml.CharData:
+			if depth == 0 && len(bytes.TrimSpace(typed)) > 0 {
+				return problemAt(skipXMLSpace(content, start), "text outside the root element")
+			}
+		}
+	}
+	if !hasRoot {
+		return []DataValidationProblem{{Message: "no root element"}}
+	}
+	return nil
+}
+
+func skipXMLSpace(content []byte, offset int64) int64 {
+	for offset < int64(len(content)) && strings.IndexByte(" \t\r\n", content[offset]) >= 0 {
+		offset++
+	}
+	return offset
+}
+
+var xmllintProblemRegex = regexp.MustCompile(`^:(\d+): (?:element \S+: )?(?:Schemas validity error : )?(.*)$`)
+
+// validateXSD validates the well-formed XML document against the XSD of the schema or schema_file param with
+// xmllint. Network access is disabled, so imports of remote schemas fail.
+func (p *DataValidationPlugin) validateXSD(file *ManagedFile, content []byte) ([]DataValidationProblem, error) {
+	schemaFile, _ := file.MetaData["schema_file"].(string)
+	schema, isString := file.MetaData["schema"].(string)
+	if schemaFile == "" && file.MetaData["schema"] == nil {
+		return nil, nil
+	}
+	if schemaFile == "" && !isString {
+		return nil, fmt.Errorf("%w: XML is validated against an XSD document, not a %T", ErrInvalidSchema, file.MetaData["schema"])
+	}
+
+	command := p.XMLLintPath
+	if command == "" {
+		command = "xmllint"
+	}
+	if _, err := exec.LookPath(command); err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrValidatorToolMissing, command)
+	}
+	dir, err := os.MkdirTemp("", "filemanager-validation-*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	if schemaFile == "" {
+		schemaFile = filepath.Join(dir, "schema.xsd")
+		err = os.WriteFile(schemaFile, []byte(schema), 0600)
+		if err != nil {
+			return nil, fmt.Errorf("failed to write schema: %v", err)
+		}
+	}
+	input := filepath.Join(dir, "document.xml")
+	err = os.WriteFile(input, content, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to write document: %v", err)
+	}
+
+	timeout := p.Timeout
+	if timeout <= 0 {
+		timeout = DEFAULT_XML_VALIDATOR_TIMEOUT
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	cmd := LimitedCommand(ctx, p.Limits, command, "--noout", "--nonet", "--schema", schemaFile, input)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	err = cmd.Run()
+	if err == nil {
+		return nil, nil
+	}
+	// the temp dir means nothing to the reader of the error
+	output := strings.TrimSpace(strings.ReplaceAll(stderr.String(), dir+string(filepath.Separator), ""))
+	var exitErr *exec.ExitError
+	// xmllint exits with 3 or 4 for invalid documents, 5 for invalid schemas
+	if !errors.As(err, &exitErr) || (exitErr.ExitCode() != 3 && exitErr.ExitCode() != 4) {
+		if errors.As(err, &exitErr) && exitErr.ExitCode() == 5 {
+			return nil, fmt.Errorf("%w: %s", ErrInvalidSchema, output)
+		}
+		return nil, fmt.Errorf("%s failed: %v: %s", command, err, output)
+	}
+	var problems []DataValidationProblem
+	for _, line := range strings.Split(stderr.String(), "\n") {
+		if !strings.HasPrefix(line, input+":") {
+			continue
+		}
+		match := xmllintProblemRegex.FindStringSubmatch(strings.TrimPrefix(line, input))
+		if match == nil {
+			continue
+		}
+		lineNumber, _ := strconv.Atoi(match[1])
+		problems = append(problems, DataValidationProblem{Line: lineNumber, Message: match[2]})
+	}
+	if len(problems) == 0 {
+		problems = append(problems, DataValidationProblem{Message: "document does not match the XSD"})
+	}
+	return problems, nil
+}
+
+// positionAt returns the line and column of the byte offset within the content.
+func positionAt(content []byte, offset int64) textPosition {
+	if offset > int64(len(content)) {
+		offset = int64(len(content))
+	}
+	before := content[:offset]
+	lineStart := bytes.LastIndexByte(before, '\n') + 1
+	return textPosition{
+		Line:   bytes.Count(before, []byte{'\n'}) + 1,
+		Column: utf8.RuneCount(before[lineStart:]) + 1,
+	}
+}
+
+func invalidUTF8Offset(content []byte) int {
+	for offset := 0; offset < len(content); {
+		r, size := utf8.DecodeRune(content[offset:])
+		if r == utf8.RuneError && size == 1 {
+			return offset
+		}
+		offset += size
+	}
+	return len(content)
+}
@@ -0,0 +1,302 @@
+package filemanager
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrPreviewToolMissing = errors.New("document preview tool not installed")
+)
+
+const (
+	METADATA_KEY_PREVIEW_PAGE = "preview_page"
+	DEFAULT_PREVIEW_FORMAT    = "png"
+	DEFAULT_PREVIEW_WIDTH     = 512
+	DEFAULT_PREVIEW_TIMEOUT   = 60 * time.Second
+)
+
+var officeDocumentMimeTypes = map[string]bool{
+	"application/msword":            true,
+	"application/vnd.ms-excel":      true,
+	"application/vnd.ms-powerpoint": true,
+	"application/rtf":               true,
+	"application/vnd.openxmlformats-officedocument.wordprocessingml.document":   true,
+	"application/vnd.openxmlformats-officedocument.spreadsheetml.sheet":         true,
+	"application/vnd.openxmlformats-officedocument.presentationml.presentation": true,
+	"application/vnd.oasis.opendocument.text":                                   true,
+	"application/vnd.oasis.opendocument.spreadsheet":                            true,
+	"application/vnd.oasis.opendocument.presentation":                           true,
+}
+
+var officeDocumentExtensions = map[string]bool{
+	".doc": true, ".docx": true, ".xls": true, ".xlsx": true, ".ppt": true, ".pptx": true,
+	".odt": true, ".ods": true, ".odp": true, ".rtf": true,
+}
+
+// DocumentPreviewPlugin renders the first page of PDFs and office documents (docx, xlsx, pptx, their legacy and
+// OpenDocument variants) as a PNG or JPEG thumbnail. Office documents are converted to PDF with LibreOffice first,
+// PDFs are rasterized with pdftoppm (poppler). The preview is added as a further file of the step (stored next to
+// the first output) with MetaData["preview_page"].
+//
+// Params: preview_format ("png" or "jpg") and preview_width (pixels, keeps the aspect ratio).
+type DocumentPreviewPlugin struct {
+	OfficeConverterPath string        // defaults to "soffice" in PATH
+	RasterizerPath      string        // defaults to "pdftoppm" in PATH
+	Format              string        // defaults to DEFAULT_PREVIEW_FORMAT
+	Width               int           // defaults to DEFAULT_PREVIEW_WIDTH
+	Timeout             time.Duration // per document and tool, defaults to DEFAULT_PREVIEW_TIMEOUT
+	// DecompressionLimits are checked for zip based office documents before they are converted.
+	DecompressionLimits DecompressionLimits
+	// Limits are the rlimits of the soffice and pdftoppm runs.
+	Limits SubprocessLimits
+}
+
+func (p *DocumentPreviewPlugin) Process(files []*ManagedFile, fileProcess *FileProcess) ([]*ManagedFile, error) {
+	var processedFiles []*ManagedFile
+
+	for _, file := range files {
+		if !isPDFFile(file) && !isOfficeDocument(file) {
+			processedFiles = append(processedFiles, file)
+			continue
+		}
+		status := ProcessingStatus{
+			ProcessID:         fileProcess.ID,
+			TimeStamp:         int(time.Now().UnixNano() / int64(time.Millisecond)),
+			ProcessorName:     "DocumentPreview",
+			StatusDescription: fmt.Sprintf("Rendering preview of document: %s", file.FileName),
+		}
+		fileProcess.AddProcessingUpdate(status)
+
+		format, width, err := p.parseParams(file.MetaData)
+		if err != nil {
+			return nil, err
+		}
+		preview, err := p.RenderPreview(file, format, width)
+		if err != nil {
+			return nil, err
+		}
+		processedFiles = append(processedFiles, file, preview)
+	}
+
+	return processedFiles, nil
+}
+
+// DryRun implements DryRunPlugin: it checks the preview params and describes the previews.
+func (p *DocumentPreviewPlugin) DryRun(files []*ManagedFile) ([]*ManagedFile, error) {
+	var processedFiles []*ManagedFile
+	for _, file := range files {
+		processedFiles = append(processedFiles, file)
+		if !isPDFFile(file) && !isOfficeDocument(file) {
+			continue
+		}
+		format, _, err := p.parseParams(file.MetaData)
+		if err != nil {
+			return nil, err
+		}
+		processedFiles = append(processedFiles, &ManagedFile{
+			FileName: strings.TrimSuffix(file.FileName, filepath.Ext(file.FileName)) + ".preview." + format,
+			MimeType: MimeTypeForOutputFormat(format),
+			Owner:    file.Owner,
+		})
+	}
+	return processedFiles, nil
+}
+
+func (p *DocumentPreviewPlugin) parseParams(params map[string]any) (format string, width int, err error) {
+	format = p.Format
+	if val, ok := params["preview_format"]; ok {
+		format, _ = val.(string)
+	}
+	format = NormalizeOutputFormat(format)
+	if format == "" {
+		format = DEFAULT_PREVIEW_FORMAT
+	}
+	if format != "png" && format != "jpg" {
+		return "", 0, invalidParamError("preview_format", format)
+	}
+	width = p.Width
+	if width == 0 {
+		width = DEFAULT_PREVIEW_WIDTH
+	}
+	if val, ok := params["preview_width"]; ok {
+		number, ok := val.(float64)
+		if !ok || number < 1 {
+			return "", 0, invalidParamError("preview_width", val)
+		}
+		width = int(number)
+	}
+	return format, width, nil
+}
+
+// RenderPreview returns the first page of the PDF or office document as an image file in the format.
+func (p *DocumentPreviewPlugin) RenderPreview(file *ManagedFile, format string, width int) (*ManagedFile, error) {
+	dir, err := os.MkdirTemp("", "filemanager-preview-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	input, err := p.pdfInputPath(file, dir)
+	if err != nil {
+		return nil, err
+	}
+	content, err := p.rasterizeFirstPage(input, dir, format, width)
+	if err != nil {
+		return nil, err
+	}
+	return &ManagedFile{
+		FileName: strings.TrimSuffix(file.FileName, filepath.Ext(file.FileName)) + ".preview." + format,
+		MimeType: MimeTypeForOutputFormat(format),
+		Owner:    file.Owner,
+		Content:  content,
+		FileSize: int64(len(content)),
+		MetaData: map[string]any{
+			METADATA_KEY_PREVIEW_PAGE: 1,
+			"source_file_name":        file.FileName,
+		},
+	}, nil
+}
+
+// RenderPages returns every page of the PDF or office document (e.g. the slides of a presentation) as an image
+// file in the format, named <name>.page-<n>.<format> with the page number in MetaData["preview_page"].
+func (p *DocumentPreviewPlugin) RenderPages(file *ManagedFile, format string, width int) ([]*ManagedFile, error) {
+	dir, err := os.MkdirTemp("", "filemanager-preview-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	input, err := p.pdfInputPath(file, dir)
+	if err != nil {
+		return nil, err
+	}
+	imageFormat := "-png"
+	if format == "jpg" {
+		imageFormat = "-jpeg"
+	}
+	outputPrefix := filepath.Join(dir, "page")
+	err = p.run(p.RasterizerPath, "pdftoppm", imageFormat, "-scale-to-x", strconv.Itoa(width), "-scale-to-y", "-1", input, outputPrefix)
+	if err != nil {
+		return nil, err
+	}
+	// pdftoppm names the pages <prefix>-<n>.<format>, n zero padded to the digits of the page count
+	outputs, err := filepath.Glob(outputPrefix + "-*." + format)
+	if err != nil {
+		return nil, err
+	}
+	pages := make([]*ManagedFile, 0, len(outputs))
+	name := strings.TrimSuffix(file.FileName, filepath.Ext(file.FileName))
+	for _, output := range outputs {
+		page, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(filepath.Base(output), "page-"), "."+format))
+		if err != nil {
+			continue
+		}
+		content, err := os.ReadFile(output)
+		if err != nil {
+			return nil, err
+		}
+		pages = append(pages, &ManagedFile{
+			FileName: fmt.Sprintf("%s.page-%d.%s", name, page, format),
+			MimeType: MimeTypeForOutputFormat(format),
+			Owner:    file.Owner,
+			Content:  content,
+			FileSize: int64(len(content)),
+			MetaData: map[string]any{
+				METADATA_KEY_PREVIEW_PAGE: page,
+				"source_file_name":        file.FileName,
+			},
+		})
+	}
+	sort.Slice(pages, func(i, j int) bool {
+		return pages[i].MetaData[METADATA_KEY_PREVIEW_PAGE].(int) < pages[j].MetaData[METADATA_KEY_PREVIEW_PAGE].(int)
+	})
+	return pages, nil
+}
+
+// pdfInputPath writes the file to the directory for the tools, converting office documents to PDF.
+func (p *DocumentPreviewPlugin) pdfInputPath(file *ManagedFile, dir string) (string, error) {
+	input, err := commandInputPath(file, dir)
+	if err != nil {
+		return "", err
+	}
+	if isPDFFile(file) {
+		return input, nil
+	}
+	err = CheckZipArchiveFile(file.FileName, input, p.DecompressionLimits)
+	if err != nil {
+		return "", err
+	}
+	return p.convertToPDF(input, dir)
+}
+
+// convertToPDF converts the office document with LibreOffice, using a profile in the directory so concurrent
+// conversions do not block each other on the shared user profile.
+func (p *DocumentPreviewPlugin) convertToPDF(input string, dir string) (string, error) {
+	outputDir := filepath.Join(dir, "pdf")
+	err := p.run(p.OfficeConverterPath, "soffice",
+		"-env:UserInstallation=file://"+filepath.ToSlash(filepath.Join(dir, "profile")),
+		"--headless", "--norestore", "--convert-to", "pdf", "--outdir", outputDir, input)
+	if err != nil {
+		return "", err
+	}
+	output := filepath.Join(outputDir, strings.TrimSuffix(filepath.Base(input), filepath.Ext(input))+".pdf")
+	if _, err := os.Stat(output); err != nil {
+		return "", fmt.Errorf("soffice did not convert the document: %v", err)
+	}
+	return output, nil
+}
+
+func (p *DocumentPreviewPlugin) rasterizeFirstPage(input string, dir string, format string, width int) ([]byte, error) {
+	imageFormat := "-png"
+	if format == "jpg" {
+		imageFormat = "-jpeg"
+	}
+	outputPrefix := filepath.Join(dir, "preview")
+	err := p.run(p.RasterizerPath, "pdftoppm", "-f", "1", "-l", "1", "-singlefile", imageFormat,
+		"-scale-to-x", strconv.Itoa(width), "-scale-to-y", "-1", input, outputPrefix)
+	if err != nil {
+		return nil, err
+	}
+	return os.ReadFile(outputPrefix + "." + format)
+}
+
+func (p *DocumentPreviewPlugin) run(command string, defaultCommand string, args ...string) error {
+	if command == "" {
+		command = defaultCommand
+	}
+	if _, err := exec.LookPath(command); err != nil {
+		return fmt.Errorf("%w: %s", ErrPreviewToolMissing, command)
+	}
+	timeout := p.Timeout
+	if timeout <= 0 {
+		timeout = DEFAULT_PREVIEW_TIMEOUT
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	cmd := LimitedCommand(ctx, p.Limits, command, args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	if ctx.Err() != nil {
+		return fmt.Errorf("%s timed out after %v", filepath.Base(command), timeout)
+	}
+	if err != nil {
+		return fmt.Errorf("%s failed: %v %s", filepath.Base(command), err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+func isOfficeDocument(file *ManagedFile) bool {
+	if officeDocumentMimeTypes[file.MimeType] {
+		return true
+	}
+	return officeDocumentExtensions[strings.ToLower(filepath.Ext(file.FileName))]
+}
@@ -0,0 +1,251 @@
+package filemanager
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+	"unicode"
+)
+
+var (
+	ErrEmbeddingProviderUnset = errors.New("embeddings plugin has no provider")
+)
+
+const (
+	METADATA_KEY_EMBEDDING_CHUNKS   = "embedding_chunks"
+	METADATA_KEY_EMBEDDING_PROVIDER = "embedding_provider"
+
+	DEFAULT_EMBEDDING_CHUNK_SIZE    = 1000
+	DEFAULT_EMBEDDING_CHUNK_OVERLAP = 100
+	DEFAULT_EMBEDDING_BATCH_SIZE    = 16
+	EMBEDDINGS_MIME_TYPE            = "application/x-ndjson"
+)
+
+// EmbeddingChunk is a chunk of a file's text together with its embedding vector.
+// Start and End are rune offsets into the text.
+type EmbeddingChunk struct {
+	FileName   string         `json:"fileName"`
+	ChunkIndex int            `json:"chunkIndex"`
+	Start      int            `json:"start"`
+	End        int            `json:"end"`
+	Text       string         `json:"text"`
+	Vector     []float32      `json:"vector"`
+	MetaData   map[string]any `json:"metaData,omitempty"`
+}
+
+// EmbeddingProvider turns texts into vectors, one per text in the same order.
+type EmbeddingProvider interface {
+	Name() string
+	Embed(texts []string) ([][]float32, error)
+}
+
+// VectorSink receives the embedded chunks of a file, e.g. to upsert them into a vector database.
+type VectorSink interface {
+	WriteVectors(file *ManagedFile, chunks []EmbeddingChunk) error
+}
+
+// EmbeddingsPlugin splits the text of text-like files into overlapping chunks, embeds them with the Provider and
+// hands the chunks to the Sink. With WriteOutputFile the chunks are also emitted as an additional
+// "<file name>.embeddings.jsonl" output file (one JSON encoded EmbeddingChunk per line).
+// Chunk size and overlap are in characters (a negative overlap disables it); chunks end at whitespace where possible.
+type EmbeddingsPlugin struct {
+	Provider        EmbeddingProvider
+	Sink            VectorSink
+	WriteOutputFile bool
+	ChunkSize       int
+	ChunkOverlap    int
+	BatchSize       int
+}
+
+func (p *EmbeddingsPlugin) Process(files []*ManagedFile, fileProcess *FileProcess) ([]*ManagedFile, error) {
+	if p.Provider == nil {
+		return nil, ErrEmbeddingProviderUnset
+	}
+	var processedFiles []*ManagedFile
+
+	for _, file := range files {
+		if !isTextLikeMimeType(file.MimeType) {
+			processedFiles = append(processedFiles, file)
+			continue
+		}
+		status := ProcessingStatus{
+			ProcessID:         fileProcess.ID,
+			TimeStamp:         int(time.Now().UnixNano() / int64(time.Millisecond)),
+			ProcessorName:     "Embeddings",
+			StatusDescription: fmt.Sprintf("Embedding text of file(%s) using %s", file.FileName, p.Provider.Name()),
+		}
+		fileProcess.AddProcessingUpdate(status)
+
+		chunks, err := p.embedFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("embedding failed: %v", err)
+		}
+		file.SetMetaData(METADATA_KEY_EMBEDDING_CHUNKS, len(chunks))
+		file.SetMetaData(METADATA_KEY_EMBEDDING_PROVIDER, p.Provider.Name())
+
+		if p.Sink != nil {
+			err = p.Sink.WriteVectors(file, chunks)
+			if err != nil {
+				return nil, fmt.Errorf("failed to write vectors: %v", err)
+			}
+		}
+		processedFiles = append(processedFiles, file)
+
+		if p.WriteOutputFile {
+			outputFile, err := newEmbeddingsFile(file, chunks)
+			if err != nil {
+				return nil, err
+			}
+			processedFiles = append(processedFiles, outputFile)
+		}
+	}
+
+	return processedFiles, nil
+}
+
+func (p *EmbeddingsPlugin) embedFile(file *ManagedFile) ([]EmbeddingChunk, error) {
+	chunkSize := p.ChunkSize
+	if chunkSize <= 0 {
+		chunkSize = DEFAULT_EMBEDDING_CHUNK_SIZE
+	}
+	overlap := p.ChunkOverlap
+	if overlap == 0 {
+		overlap = min(DEFAULT_EMBEDDING_CHUNK_OVERLAP, chunkSize/2)
+	}
+	if overlap < 0 || overlap >= chunkSize {
+		overlap = 0
+	}
+	batchSize := p.BatchSize
+	if batchSize <= 0 {
+		batchSize = DEFAULT_EMBEDDING_BATCH_SIZE
+	}
+
+	chunks := ChunkText(string(file.Content), chunkSize, overlap)
+	for i := range chunks {
+		chunks[i].FileName = file.FileName
+	}
+	for start := 0; start < len(chunks); start += batchSize {
+		end := min(start+batchSize, len(chunks))
+		texts := make([]string, 0, end-start)
+		for _, chunk := range chunks[start:end] {
+			texts = append(texts, chunk.Text)
+		}
+		vectors, err := p.Provider.Embed(texts)
+		if err != nil {
+			return nil, err
+		}
+		if len(vectors) != len(texts) {
+			return nil, fmt.Errorf("provider returned %d vectors for %d texts", len(vectors), len(texts))
+		}
+		for i, vector := range vectors {
+			chunks[start+i].Vector = vector
+		}
+	}
+	return chunks, nil
+}
+
+func newEmbeddingsFile(file *ManagedFile, chunks []EmbeddingChunk) (*ManagedFile, error) {
+	var buffer bytes.Buffer
+	encoder := json.NewEncoder(&buffer)
+	for _, chunk := range chunks {
+		err := encoder.Encode(chunk)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode embedding chunk: %v", err)
+		}
+	}
+	return &ManagedFile{
+		FileName: file.FileName + ".embeddings.jsonl",
+		MimeType: EMBEDDINGS_MIME_TYPE,
+		Owner:    file.Owner,
+		Content:  buffer.Bytes(),
+		MetaData: map[string]any{
+			METADATA_KEY_EMBEDDING_CHUNKS: len(chunks),
+			"source_file_name":            file.FileName,
+		},
+	}, nil
+}
+
+// ChunkText splits text into chunks of at most size runes, each starting overlap runes before the end of the
+// previous one. Chunks are cut at the last whitespace in their second half if there is one, and overlaps start
+// at a word boundary.
+func ChunkText(text string, size int, overlap int) []EmbeddingChunk {
+	runes := []rune(text)
+	chunks := []EmbeddingChunk{}
+	start := 0
+	for start < len(runes) {
+		end := min(start+size, len(runes))
+		if end < len(runes) {
+			for cut := end; cut > start+size/2; cut-- {
+				if unicode.IsSpace(runes[cut-1]) {
+					end = cut
+					break
+				}
+			}
+		}
+		chunkText := strings.TrimSpace(string(runes[start:end]))
+		if chunkText != "" {
+			chunks = append(chunks, EmbeddingChunk{ChunkIndex: len(chunks), Start: start, End: end, Text: chunkText})
+		}
+		if end == len(runes) {
+			break
+		}
+		next := max(end-overlap, start+1)
+		// start the overlap at a word boundary
+		for next < end && !unicode.IsSpace(runes[next-1]) {
+			next++
+		}
+		start = next
+	}
+	return chunks
+}
+
+// OpenAIEmbeddingProvider calls an OpenAI-compatible /v1/embeddings endpoint. Most local embedding servers
+// (Ollama, text-embeddings-inference, vLLM, LocalAI) offer this API as well.
+type OpenAIEmbeddingProvider struct {
+	Endpoint string // e.g. https://api.openai.com/v1/embeddings
+	APIKey   string // sent as bearer token if set
+	Model    string
+	Client   *http.Client
+}
+
+func (p *OpenAIEmbeddingProvider) Name() string {
+	return "openai:" + p.Model
+}
+
+func (p *OpenAIEmbeddingProvider) Embed(texts []string) ([][]float32, error) {
+	headers := map[string]string{}
+	if p.APIKey != "" {
+		headers["Authorization"] = "Bearer " + p.APIKey
+	}
+	request := map[string]any{
+		"model": p.Model,
+		"input": texts,
+	}
+	var response struct {
+		Data []struct {
+			Index     int       `json:"index"`
+			Embedding []float32 `json:"embedding"`
+		} `json:"data"`
+	}
+	err := postJSON(p.Client, p.Endpoint, headers, request, &response)
+	if err != nil {
+		return nil, err
+	}
+	vectors := make([][]float32, len(texts))
+	for _, data := range response.Data {
+		if data.Index < 0 || data.Index >= len(vectors) {
+			return nil, fmt.Errorf("embedding index %d out of range", data.Index)
+		}
+		vectors[data.Index] = data.Embedding
+	}
+	for i, vector := range vectors {
+		if vector == nil {
+			return nil, fmt.Errorf("missing embedding for input %d", i)
+		}
+	}
+	return vectors, nil
+}
@@ -14,13 +14,26 @@ import (
 	"github.com/yuin/goldmark/renderer/html"
 )
 
-type FormatConverterPlugin struct{}
+const DOCX_MIME_TYPE = "application/vnd.openxmlformats-officedocument.wordprocessingml.document"
+
+// FormatConverterPlugin converts Word documents to text or Markdown (output_format param "text" or "markdown"),
+// presentations (pptx, odp) to Markdown or text and Excel sheets to csv. Office documents are checked against
+// DecompressionLimits before they are parsed, so zip bombs fail with a DecompressionBombError.
+//
+// Presentation params: include_notes (default true) adds the speaker notes, slide_thumbnails renders every slide as
+// an image (preview_format and preview_width as for the DocumentPreviewPlugin) added as further files of the step.
+type FormatConverterPlugin struct {
+	DecompressionLimits DecompressionLimits
+	// SlideRenderer renders slide thumbnails, defaults to a DocumentPreviewPlugin with soffice and pdftoppm in PATH.
+	SlideRenderer *DocumentPreviewPlugin
+}
 
 func (p *FormatConverterPlugin) Process(files []*ManagedFile, fileProcess *FileProcess) ([]*ManagedFile, error) {
 	var processedFiles []*ManagedFile
 
 	for _, file := range files {
 		var convertedContent []byte
+		var slideImages []*ManagedFile
 		var err error
 
 		status := ProcessingStatus{
@@ -32,13 +45,38 @@ func (p *FormatConverterPlugin) Process(files []*ManagedFile, fileProcess *FileP
 		fileProcess.AddProcessingUpdate(status)
 
 		switch strings.ToLower(file.MimeType) {
-		case "application/vnd.openxmlformats-officedocument.wordprocessingml.document":
-			convertedContent, err = convertDocxToText(file.Content)
+		case DOCX_MIME_TYPE, PPTX_MIME_TYPE, ODP_MIME_TYPE, "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet":
+			err = CheckZipArchive(file.FileName, file.Content, p.DecompressionLimits)
 			if err != nil {
-				convertedContent, err = convertDocxToMarkdown(file.Content)
+				return nil, fmt.Errorf("failed to convert file format: %w", err)
+			}
+		}
+
+		fileName := file.FileName
+		mimeType := "text/plain"
+		switch strings.ToLower(file.MimeType) {
+		case DOCX_MIME_TYPE:
+			format := "txt"
+			if outputFormat, _ := file.MetaData["output_format"].(string); outputFormat == "markdown" || outputFormat == "md" {
+				format = "md"
+			}
+			convertedContent, err = convertDocx(file.Content, format)
+			fileName = fileNameWithFormat(file.FileName, format)
+			mimeType = MimeTypeForOutputFormat(format)
+		case PPTX_MIME_TYPE, ODP_MIME_TYPE:
+			format := "md"
+			if outputFormat, _ := file.MetaData["output_format"].(string); outputFormat == "text" || outputFormat == "txt" {
+				format = "txt"
+			}
+			includeNotes, ok := file.MetaData["include_notes"].(bool)
+			convertedContent, err = convertPresentation(file.Content, file.MimeType, format, includeNotes || !ok)
+			fileName = fileNameWithFormat(file.FileName, format)
+			mimeType = MimeTypeForOutputFormat(format)
+			if thumbnails, _ := file.MetaData["slide_thumbnails"].(bool); thumbnails && err == nil {
+				slideImages, err = p.renderSlides(file)
 			}
 		case "application/vnd.ms-excel", "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet":
-			convertedContent, err = convertExcelToCSV(file.Content)
+			convertedContent, err = convertExcelToCSV(file.Content, p.DecompressionLimits)
 		default:
 			processedFiles = append(processedFiles, file)
 			continue
@@ -49,29 +87,121 @@ func (p *FormatConverterPlugin) Process(files []*ManagedFile, fileProcess *FileP
 		}
 
 		convertedFile := &ManagedFile{
-			FileName:         file.FileName,
+			FileName:         fileName,
 			Content:          convertedContent,
-			MimeType:         "text/plain",
+			MimeType:         mimeType,
 			FileSize:         int64(len(convertedContent)),
 			MetaData:         file.MetaData,
 			ProcessingErrors: []string{},
 		}
 
 		processedFiles = append(processedFiles, convertedFile)
+		processedFiles = append(processedFiles, slideImages...)
 	}
 
 	return processedFiles, nil
 }
 
-func convertDocxToText(content []byte) ([]byte, error) {
-	// Convert DOCX to plain text using a library or custom implementation
-	// Here's a placeholder implementation that assumes the content is already in plain text format
-	return content, nil
+// ConvertsTo reports the supported conversions: Excel to csv, Word to txt, md and html, presentations to txt and
+// md, Markdown to html and text-like files to txt.
+func (p *FormatConverterPlugin) ConvertsTo(mimeType string, format string) bool {
+	mimeType = strings.ToLower(mimeType)
+	switch format {
+	case "csv":
+		return mimeType == "application/vnd.ms-excel" || mimeType == "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"
+	case "html":
+		return isMarkdownMimeType(mimeType) || mimeType == DOCX_MIME_TYPE
+	case "md":
+		return mimeType == DOCX_MIME_TYPE || isPresentation(mimeType)
+	case "txt":
+		return isTextLikeMimeType(mimeType) || mimeType == DOCX_MIME_TYPE || isPresentation(mimeType)
+	}
+	return false
+}
+
+func isMarkdownMimeType(mimeType string) bool {
+	return strings.HasPrefix(mimeType, "text/markdown") || strings.HasPrefix(mimeType, "text/x-markdown")
+}
+
+func (p *FormatConverterPlugin) ConvertFormat(file *ManagedFile, format string) (*ManagedFile, error) {
+	var content []byte
+	var err error
+	switch format {
+	case "csv":
+		err = CheckZipArchive(file.FileName, file.Content, p.DecompressionLimits)
+		if err == nil {
+			content, err = convertExcelToCSV(file.Content, p.DecompressionLimits)
+		}
+	case "html", "md", "txt":
+		if isPresentation(file.MimeType) && format != "html" {
+			err = CheckZipArchive(file.FileName, file.Content, p.DecompressionLimits)
+			if err == nil {
+				content, err = convertPresentation(file.Content, file.MimeType, format, true)
+			}
+		} else if strings.ToLower(file.MimeType) == DOCX_MIME_TYPE {
+			err = CheckZipArchive(file.FileName, file.Content, p.DecompressionLimits)
+			if err == nil {
+				content, err = convertDocx(file.Content, format)
+			}
+		} else if format == "html" {
+			content, err = convertMarkdownToHTML(file.Content)
+		} else {
+			content = file.Content
+		}
+	default:
+		err = fmt.Errorf("unsupported format: %s", format)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return convertedCopy(file, content, format), nil
+}
+
+// convertDocx converts a Word document to plain text (txt), Markdown (md) or HTML rendered from the Markdown (html).
+func convertDocx(content []byte, format string) ([]byte, error) {
+	document, err := parseDocx(content)
+	if err != nil {
+		return nil, err
+	}
+	switch format {
+	case "txt":
+		return []byte(document.Text()), nil
+	case "md":
+		return []byte(document.Markdown()), nil
+	case "html":
+		return convertMarkdownToHTML([]byte(document.Markdown()))
+	}
+	return nil, fmt.Errorf("unsupported format: %s", format)
+}
+
+// convertPresentation extracts the slide text of a pptx or odp presentation as Markdown (md) or plain text (txt).
+func convertPresentation(content []byte, mimeType string, format string, includeNotes bool) ([]byte, error) {
+	slides, err := parseSlides(content, mimeType)
+	if err != nil {
+		return nil, err
+	}
+	if format == "txt" {
+		return []byte(slidesText(slides, includeNotes)), nil
+	}
+	return []byte(slidesMarkdown(slides, includeNotes)), nil
+}
+
+// renderSlides renders every slide of the presentation with the SlideRenderer.
+func (p *FormatConverterPlugin) renderSlides(file *ManagedFile) ([]*ManagedFile, error) {
+	renderer := p.SlideRenderer
+	if renderer == nil {
+		renderer = &DocumentPreviewPlugin{DecompressionLimits: p.DecompressionLimits}
+	}
+	format, width, err := renderer.parseParams(file.MetaData)
+	if err != nil {
+		return nil, err
+	}
+	return renderer.RenderPages(file, format, width)
 }
 
-func convertDocxToMarkdown(content []byte) ([]byte, error) {
-	// Convert DOCX to Markdown using the goldmark library
-	var buf bytes.Buffer
+func convertMarkdownToHTML(content []byte) ([]byte, error) {
+	buf := getBuffer()
+	defer putBuffer(buf)
 	md := goldmark.New(
 		goldmark.WithExtensions(extension.GFM),
 		goldmark.WithParserOptions(
@@ -82,15 +212,15 @@ func convertDocxToMarkdown(content []byte) ([]byte, error) {
 			html.WithXHTML(),
 		),
 	)
-	if err := md.Convert(content, &buf); err != nil {
+	if err := md.Convert(content, buf); err != nil {
 		return nil, err
 	}
-	return buf.Bytes(), nil
+	return bytes.Clone(buf.Bytes()), nil
 }
 
-func convertExcelToCSV(content []byte) ([]byte, error) {
-	// Load the Excel file
-	xlsx, err := excelize.OpenReader(bytes.NewReader(content))
+func convertExcelToCSV(content []byte, limits DecompressionLimits) ([]byte, error) {
+	// Load the Excel file, excelize checks the declared sizes of the entries against the limit as well
+	xlsx, err := excelize.OpenReader(bytes.NewReader(content), excelize.Options{UnzipSizeLimit: limits.withDefaults().MaxExpandedSize})
 	if err != nil {
 		return nil, err
 	}
@@ -105,8 +235,9 @@ func convertExcelToCSV(content []byte) ([]byte, error) {
 	}
 
 	// Create a new CSV writer
-	var csvBuf bytes.Buffer
-	csvWriter := csv.NewWriter(&csvBuf)
+	csvBuf := getBuffer()
+	defer putBuffer(csvBuf)
+	csvWriter := csv.NewWriter(csvBuf)
 
 	// Write the rows to the CSV writer
 	for _, row := range rows {
@@ -121,5 +252,5 @@ func convertExcelToCSV(content []byte) ([]byte, error) {
 		return nil, err
 	}
 
-	return csvBuf.Bytes(), nil
+	return bytes.Clone(csvBuf.Bytes()), nil
 }
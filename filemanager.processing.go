@@ -2,14 +2,17 @@
 package filemanager
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"mime"
-	"os"
 	"path/filepath"
 	"regexp"
 	"strings"
 	"time"
+
+	"github.com/gabriel-vasile/mimetype"
 )
 
 var (
@@ -17,6 +20,9 @@ var (
 	ErrInvalidMimeType          = errors.New("invalid MIME type")
 	ErrInvalidFileSize          = errors.New("invalid file size")
 	ErrProcessingPluginNotFound = errors.New("processing plugin not found")
+	ErrInvalidStorageType       = errors.New("invalid storage type")
+	ErrProcessingPanicked       = errors.New("processing panicked")
+	ErrProcessingIncomplete     = errors.New("processing ended without a final status")
 )
 
 type ProcessingPlugin interface {
@@ -26,117 +32,342 @@ type ProcessingPlugin interface {
 type ProcessingStep struct {
 	PluginName string         `yaml:"plugin_name"`
 	Params     map[string]any `yaml:"params"`
+	Weight     float64        `yaml:"weight"` // share of the overall progress relative to the other steps, defaults to 1
 }
 
 type OutputFormat struct {
 	Format          string          `yaml:"format"`
 	TargetFileNames []string        `yaml:"target_file_names"`
 	StorageType     FileStorageType `yaml:"storage_type"` // public, private, temp
+	HTTPHeaders     *HTTPHeaders    `yaml:"http_headers"` // overrides the recipe's HTTPHeaders
+	// PreCompress stores compressed variants ("br", "gzip") of text-like outputs, served by FileServer.
+	PreCompress []string `yaml:"precompress"`
+	// ContentAddressed stores public outputs at a path derived from their content, with the target file name as
+	// logical name resolvable by GetContentAddressedURL.
+	ContentAddressed bool `yaml:"content_addressed"`
+	// OnCollision decides what happens if the target file name is taken, OutputCollisionUniqueSuffix by default.
+	// Content addressed outputs do not collide.
+	OnCollision OutputCollisionPolicy `yaml:"on_collision"`
 }
 
 type Recipe struct {
-	Name              string           `yaml:"name"`
-	AcceptedMimeTypes []string         `yaml:"accepted_mime_types"`
-	MinFileSize       int64            `yaml:"min_file_size"`
-	MaxFileSize       int64            `yaml:"max_file_size"`
-	ProcessingSteps   []ProcessingStep `yaml:"processing_steps"`
-	OutputFormats     []OutputFormat   `yaml:"output_formats"`
+	// SchemaVersion is the schema_version of the recipe file, RECIPE_SCHEMA_VERSION once loaded, see MigrateRecipe.
+	SchemaVersion     int               `yaml:"schema_version"`
+	Name              string            `yaml:"name"`
+	AcceptedMimeTypes []string          `yaml:"accepted_mime_types"` // exact ("application/pdf"), glob ("image/*", "*/*+json") or prefix ("image/")
+	StrictMimeTypes   bool              `yaml:"strict_mime_types"`   // match AcceptedMimeTypes that are not globs exactly, not as prefixes
+	MinFileSize       int64             `yaml:"min_file_size"`
+	MaxFileSize       int64             `yaml:"max_file_size"`
+	ProcessingSteps   []ProcessingStep  `yaml:"processing_steps"`
+	OutputFormats     []OutputFormat    `yaml:"output_formats"`
+	HTTPHeaders       *HTTPHeaders      `yaml:"http_headers"`      // stored with every output file, served by FileServer
+	ResponsiveImages  *ResponsiveImages `yaml:"responsive_images"` // srcset preset generated in addition to OutputFormats
+	OnSuccess         []RecipeHook      `yaml:"on_success"`        // run after the pipeline succeeded
+	OnFailure         []RecipeHook      `yaml:"on_failure"`        // run after the pipeline failed
+	// ResultMetaData are the MetaData keys of the outputs copied into their ProcessingResultFiles, e.g. "language".
+	ResultMetaData []string `yaml:"result_metadata"`
+	// Priority selects the lane of the recipe's processes, see SetPriorityLanes.
+	Priority string `yaml:"priority"`
+	// Version labels the revision of the recipe, e.g. "2". It is part of the Digest, so bumping it makes
+	// SkipUnchanged reprocess files after changes outside the recipe, like a new release of a plugin.
+	Version string `yaml:"version"`
 }
 
+// ProcessingResultFile describes a stored output of a process, with the basic facts downstream services need
+// without opening the file.
 type ProcessingResultFile struct {
-	FileName      string
-	LocalFilePath string
-	URL           string
-	FileSize      int64
-	MimeType      string
+	FileName         string           `json:"fileName"`
+	LocalFilePath    string           `json:"localFilePath"`
+	URL              string           `json:"url"`
+	FileSize         int64            `json:"fileSize"`
+	MimeType         string           `json:"mimetype"`
+	DetectedMimeType string           `json:"detectedMimetype,omitempty"` // sniffed from the content
+	Checksum         string           `json:"checksum,omitempty"`         // hex encoded SHA-256 of the content
+	BlurHash         string           `json:"blurHash,omitempty"`         // set by the PlaceholderPlugin
+	LQIP             string           `json:"lqip,omitempty"`             // base64 data URI, set by the PlaceholderPlugin
+	Width            int              `json:"width,omitempty"`            // of images and probed videos
+	Height           int              `json:"height,omitempty"`
+	Frames           int              `json:"frames,omitempty"`    // of animated images
+	DPI              float64          `json:"dpi,omitempty"`       // horizontal resolution of images that store one
+	Duration         float64          `json:"duration,omitempty"`  // seconds, of videos probed by the VideoProbePlugin
+	VirusScan        *VirusScanResult `json:"virusScan,omitempty"` // verdict of the upload scan or VirusScanPlugin
+	// MetaData holds the MetaData entries of the output named by the recipe's ResultMetaData.
+	MetaData map[string]any `json:"metaData,omitempty"`
 }
 
 type ProcessingStatus struct {
-	ProcessID         string
-	TimeStamp         int // js timestamp in unix milliseconds
-	ProcessorName     string
-	StatusDescription string
-	Percentage        int
-	Error             error
-	Done              bool
-	ResultingFiles    []ProcessingResultFile
+	ProcessID         string                 `json:"processId"`
+	CorrelationID     string                 `json:"correlationId,omitempty"` // of the FileProcess
+	Seq               int                    `json:"seq"`                     // 1-based position of the status within its FileProcess, usable as a cursor
+	TimeStamp         int                    `json:"timeStamp"`               // js timestamp in unix milliseconds
+	ProcessorName     string                 `json:"processorName"`
+	StatusDescription string                 `json:"statusDescription"`
+	Percentage        int                    `json:"percentage"`     // overall progress of the process
+	Step              int                    `json:"step,omitempty"` // 1-based index of the running recipe step, 0 outside of steps
+	StepCount         int                    `json:"stepCount,omitempty"`
+	StepPercentage    int                    `json:"stepPercentage,omitempty"` // progress within the running step
+	Error             error                  `json:"-"`
+	Done              bool                   `json:"done"`
+	DryRun            bool                   `json:"dryRun,omitempty"` // set on the statuses of a dry run, see ProcessOptions
+	ResultingFiles    []ProcessingResultFile `json:"resultingFiles,omitempty"`
+	ResponsiveImages  *ResponsiveImageSet    `json:"responsiveImages,omitempty"` // srcset mapping of the recipe's ResponsiveImages
+	Labels            map[string]string      `json:"labels,omitempty"`
 }
 
+type processingStatusJSON ProcessingStatus
+
+// MarshalJSON encodes the status with its Error as a message string.
+func (status ProcessingStatus) MarshalJSON() ([]byte, error) {
+	errorMessage := ""
+	if status.Error != nil {
+		errorMessage = status.Error.Error()
+	}
+	return json.Marshal(struct {
+		processingStatusJSON
+		Error string `json:"error,omitempty"`
+	}{processingStatusJSON(status), errorMessage})
+}
+
+// UnmarshalJSON decodes a status encoded by MarshalJSON. The Error is restored as a plain error with the original message.
+func (status *ProcessingStatus) UnmarshalJSON(data []byte) error {
+	decoded := struct {
+		*processingStatusJSON
+		Error string `json:"error,omitempty"`
+	}{processingStatusJSON: (*processingStatusJSON)(status)}
+	err := json.Unmarshal(data, &decoded)
+	if err != nil {
+		return err
+	}
+	if decoded.Error != "" {
+		status.Error = errors.New(decoded.Error)
+	}
+	return nil
+}
+
+// ProcessFile runs the recipe on the file, sending status updates to statusCh, which it closes when done. The
+// process ends with exactly one terminal status (Done set), whose Error is also returned by fileProcess.Err().
 func (fm *FileManager) ProcessFile(file *ManagedFile, recipeName string, fileProcess *FileProcess, statusCh chan<- *FileProcess) {
+	fm.ProcessFileWithOptions(file, recipeName, fileProcess, statusCh, ProcessOptions{})
+}
+
+// ProcessFileSync processes the file like ProcessFileWithOptions and returns once it is done, with the resulting
+// files of the terminal status or its error (see FileProcess.Err). fileProcess may be nil.
+func (fm *FileManager) ProcessFileSync(file *ManagedFile, recipeName string, fileProcess *FileProcess, opts ProcessOptions) ([]ProcessingResultFile, error) {
+	if fileProcess == nil {
+		fileProcess = NewFileProcess(file.FileName, recipeName)
+	}
+	statusCh := NewStatusChannel()
+	go drainStatusChannel(statusCh)
+	fm.ProcessFileWithOptions(file, recipeName, fileProcess, statusCh, opts)
+	err := fileProcess.Err()
+	if err != nil {
+		return nil, err
+	}
+	return fileProcess.GetLatestProcessingStatus().ResultingFiles, nil
+}
+
+// ProcessFileAndWait processes the file for request-scoped use and returns the resulting files or the error of
+// the process. If the context ends first, its error is returned right away and the process is cancelled like with
+// CancelProcess: it stops once the running step returns, removes the outputs it already saved and ends with a
+// terminal status wrapping ErrProcessCancelled, queryable with GetProcessUpdates.
+func (fm *FileManager) ProcessFileAndWait(ctx context.Context, file *ManagedFile, recipeName string) ([]ProcessingResultFile, error) {
+	fileProcess := NewFileProcess(file.FileName, recipeName)
+	stop := context.AfterFunc(ctx, func() {
+		fileProcess.cancelUnlessFinished()
+	})
+	defer stop()
+	type outcome struct {
+		results []ProcessingResultFile
+		err     error
+	}
+	done := make(chan outcome, 1)
+	go func() {
+		results, err := fm.ProcessFileSync(file, recipeName, fileProcess, ProcessOptions{})
+		done <- outcome{results: results, err: err}
+	}()
+	select {
+	case result := <-done:
+		return result.results, result.err
+	case <-ctx.Done():
+		return nil, fmt.Errorf("waiting for process(%s): %w", fileProcess.ID, ctx.Err())
+	}
+}
+
+// ProcessFileWithOptions processes the file like ProcessFile, with runtime parameters for the recipe's step params.
+func (fm *FileManager) ProcessFileWithOptions(file *ManagedFile, recipeName string, fileProcess *FileProcess, statusCh chan<- *FileProcess, opts ProcessOptions) {
+	// hooks of the recipe run once the final status is published, before the upload is released and the status
+	// channel is closed
+	var hookRecipe *Recipe
+	started := time.Now()
 	defer close(statusCh)
+	defer func() {
+		// a dry run keeps the upload for the real run
+		if !opts.DryRun {
+			fm.releaseUpload(file, fileProcess)
+		}
+	}()
+	defer func() {
+		fm.finishProcess(file, fileProcess, statusCh, recover())
+		if !opts.DryRun {
+			fm.recordRecipeStats(recipeName, started, fileProcess)
+		}
+		fm.runRecipeHooks(hookRecipe, file, fileProcess)
+	}()
+	fm.RegisterProcess(fileProcess)
 
-	recipe, ok := fm.recipes[recipeName]
+	recipe, ok := fm.root().recipes.Load().get(recipeName)
+	if ok {
+		if err := fm.checkRecipeAllowed(recipeName); err != nil {
+			status := ProcessingStatus{
+				ProcessID:         fileProcess.ID,
+				TimeStamp:         int(time.Now().UnixNano() / int64(time.Millisecond)),
+				ProcessorName:     "RecipeCheck",
+				StatusDescription: fmt.Sprintf("Recipe not allowed: %s", recipeName),
+				Error:             err,
+				Done:              true,
+			}
+			fileProcess.AddProcessingUpdate(status)
+			fm.LogTo("INFO", fmt.Sprintf("[FileManager.ProcessFile] Processing file(%s)%s Recipe(%s) not allowed for tenant(%s).\n", file.FileName, fileProcess.LogLabels(), recipeName, fm.TenantID()))
+			fm.publishFinalStatus(statusCh, fileProcess)
+			return
+		}
+	}
 	if !ok {
 		status := ProcessingStatus{
 			ProcessID:         fileProcess.ID,
 			TimeStamp:         int(time.Now().UnixNano() / int64(time.Millisecond)),
 			ProcessorName:     "RecipeCheck",
 			StatusDescription: fmt.Sprintf("Recipe not found: %s", recipeName),
-			Error:             fmt.Errorf("recipe not found: %s", recipeName),
+			Error:             fmt.Errorf("%w: %s", ErrRecipeNotFound, recipeName),
 			Done:              true,
 		}
 		fileProcess.AddProcessingUpdate(status)
-		fm.LogTo("INFO", fmt.Sprintf("[FileManager.ProcessFile] Processing file(%s) Recipe(%s) not found.\n", file.FileName, recipeName))
-		statusCh <- fileProcess
+		fm.LogTo("INFO", fmt.Sprintf("[FileManager.ProcessFile] Processing file(%s)%s Recipe(%s) not found.\n", file.FileName, fileProcess.LogLabels(), recipeName))
+		fm.publishFinalStatus(statusCh, fileProcess)
 		return
 	}
-	fm.LogTo("DEBUG", fmt.Sprintf("[FileManager.ProcessFile] Processing file(%s) using recipe(%s)\n", file.FileName, recipeName))
-	if !isValidMimeType(file.MimeType, recipe.AcceptedMimeTypes) {
+	if file.LocalFilePath != "" {
+		if err := fm.checkOwnsPath(file.LocalFilePath); err != nil {
+			status := ProcessingStatus{
+				ProcessID:         fileProcess.ID,
+				TimeStamp:         int(time.Now().UnixNano() / int64(time.Millisecond)),
+				ProcessorName:     "TenantCheck",
+				StatusDescription: fmt.Sprintf("File not allowed: %s", file.FileName),
+				Error:             err,
+				Done:              true,
+			}
+			fileProcess.AddProcessingUpdate(status)
+			fm.LogTo("INFO", fmt.Sprintf("[FileManager.ProcessFile] Processing file(%s)%s refused, it is no file of tenant(%s).\n", file.FileName, fileProcess.LogLabels(), fm.TenantID()))
+			fm.publishFinalStatus(statusCh, fileProcess)
+			return
+		}
+	}
+	if !opts.DryRun {
+		hookRecipe = &recipe
+	}
+	fm.LogTo("DEBUG", fmt.Sprintf("[FileManager.ProcessFile] Processing file(%s)%s using recipe(%s)\n", file.FileName, fileProcess.LogLabels(), recipeName))
+	if !fm.acceptsMimeType(file.MimeType, recipe.AcceptedMimeTypes, recipe.StrictMimeTypes) {
 		status := ProcessingStatus{
 			ProcessID:         fileProcess.ID,
 			TimeStamp:         int(time.Now().UnixNano() / int64(time.Millisecond)),
 			ProcessorName:     "MimeTypeCheck",
 			StatusDescription: fmt.Sprintf("Invalid MIME type: %s", file.MimeType),
-			Error:             fmt.Errorf("invalid MIME type: %s", file.MimeType),
+			Error:             &ValidationError{Field: "mime_type", Err: fmt.Errorf("%w: %s", ErrInvalidMimeType, file.MimeType)},
 			Done:              true,
 		}
 		fileProcess.AddProcessingUpdate(status)
-		fm.LogTo("INFO", fmt.Sprintf("[FileManager.ProcessFile] Processing file(%s) MimeTypeCheck filed: \n%v\n", file.FileName, status))
-		statusCh <- fileProcess
+		fm.LogTo("INFO", fmt.Sprintf("[FileManager.ProcessFile] Processing file(%s)%s MimeTypeCheck filed: \n%v\n", file.FileName, fileProcess.LogLabels(), status))
+		fm.publishFinalStatus(statusCh, fileProcess)
 		return
 	}
 
-	if file.FileSize < recipe.MinFileSize || file.FileSize > recipe.MaxFileSize {
+	// the size of a streamed upload is checked while it is read
+	if opts.upload == nil && (file.FileSize < recipe.MinFileSize || file.FileSize > recipe.MaxFileSize) {
 		status := ProcessingStatus{
 			ProcessID:         fileProcess.ID,
 			TimeStamp:         int(time.Now().UnixNano() / int64(time.Millisecond)),
 			ProcessorName:     "FileSizeCheck",
 			StatusDescription: fmt.Sprintf("Invalid file size: %d bytes", file.FileSize),
-			Error:             fmt.Errorf("invalid file size: %d bytes", file.FileSize),
+			Error:             &ValidationError{Field: "file_size", Err: fmt.Errorf("%w: %d bytes", ErrInvalidFileSize, file.FileSize)},
 			Done:              true,
 		}
 		fileProcess.AddProcessingUpdate(status)
 		// fm.LogTo("DEBUG", fmt.Sprintf("[GO-FILEMANAGER.ProcessFile #3] Processing file ERROR: \n%v\n\n", status))
-		fm.LogTo("INFO", fmt.Sprintf("[FileManager.ProcessFile] Processing file(%s) filesize check failed\n", file.FileName))
-		statusCh <- fileProcess
+		fm.LogTo("INFO", fmt.Sprintf("[FileManager.ProcessFile] Processing file(%s)%s filesize check failed\n", file.FileName, fileProcess.LogLabels()))
+		fm.publishFinalStatus(statusCh, fileProcess)
+		return
+	}
+
+	if opts.DryRun {
+		fm.dryRunRecipe(file, recipe, fileProcess, statusCh, opts)
 		return
 	}
 
+	priority := opts.Priority
+	if priority == "" {
+		priority = recipe.Priority
+	}
+	releaseLane, err := fm.acquirePriorityLane(priority, fileProcess, statusCh)
+	if err != nil {
+		fm.endCancelledProcess(file, fileProcess, statusCh, nil)
+		return
+	}
+	defer releaseLane()
+
 	files := []*ManagedFile{file}
 
-	for _, step := range recipe.ProcessingSteps {
+	fileProcess.startSteps(recipe.stepWeights())
+	for stepIndex, step := range recipe.ProcessingSteps {
 		if step.PluginName == "" {
 			continue
 		}
-		plugin, ok := fm.processingPlugins[step.PluginName]
+		if fileProcess.Cancelled() {
+			fm.endCancelledProcess(file, fileProcess, statusCh, nil)
+			return
+		}
+		fileProcess.setStep(stepIndex)
+		plugin, ok := fm.getProcessingPlugin(step.PluginName)
 		if !ok {
 			status := ProcessingStatus{
 				ProcessID:         fileProcess.ID,
 				TimeStamp:         int(time.Now().UnixNano() / int64(time.Millisecond)),
 				ProcessorName:     step.PluginName,
 				StatusDescription: fmt.Sprintf("processing plugin(%s) not found", step.PluginName),
-				Error:             fmt.Errorf("processing plugin(%s) not found", step.PluginName),
+				Error:             fmt.Errorf("%w: %s", ErrProcessingPluginNotFound, step.PluginName),
 				Done:              true,
 			}
 			fileProcess.AddProcessingUpdate(status)
 			// fm.LogTo("DEBUG", fmt.Sprintf("[GO-FILEMANAGER.ProcessFile #4] Processing file ERROR: \n%v\n\n", status))
-			fm.LogTo("INFO", fmt.Sprintf("[FileManager.ProcessFile] Processing file(%s) Processing-Plugin(%s) not found!\n", file.FileName, step.PluginName))
-			statusCh <- fileProcess
+			fm.LogTo("INFO", fmt.Sprintf("[FileManager.ProcessFile] Processing file(%s)%s Processing-Plugin(%s) not found!\n", file.FileName, fileProcess.LogLabels(), step.PluginName))
+			fm.publishFinalStatus(statusCh, fileProcess)
 			return
 		}
 
-		processedFiles, err := plugin.Process(files, fileProcess)
+		params, err := applyStepParams(files, step.Params, opts.Params)
 		if err != nil {
+			err = &ValidationError{Field: "params", Err: err}
+			status := ProcessingStatus{
+				ProcessID:         fileProcess.ID,
+				TimeStamp:         int(time.Now().UnixNano() / int64(time.Millisecond)),
+				ProcessorName:     step.PluginName,
+				StatusDescription: fmt.Sprintf("Invalid step params: %v", err),
+				Error:             err,
+				Done:              true,
+			}
+			fileProcess.AddProcessingUpdate(status)
+			fm.LogTo("INFO", fmt.Sprintf("[FileManager.ProcessFile] Processing file(%s)%s Step(%s) params invalid: %v\n", file.FileName, fileProcess.LogLabels(), step.PluginName, err))
+			fm.publishFinalStatus(statusCh, fileProcess)
+			return
+		}
+
+		if opts.upload != nil {
+			plugin = &uploadStep{plugin: plugin, upload: opts.upload}
+			opts.upload = nil
+		}
+		processedFiles, err := fm.runPlugin(step.PluginName, plugin, files, fileProcess)
+		params.restore(processedFiles)
+		if err != nil {
+			err = &PluginError{Plugin: step.PluginName, Step: stepIndex + 1, Err: err}
 			status := ProcessingStatus{
 				ProcessID:         fileProcess.ID,
 				TimeStamp:         int(time.Now().UnixNano() / int64(time.Millisecond)),
@@ -146,111 +377,220 @@ func (fm *FileManager) ProcessFile(file *ManagedFile, recipeName string, filePro
 				Done:              true,
 			}
 			fileProcess.AddProcessingUpdate(status)
-			fm.LogTo("INFO", fmt.Sprintf("[FileManager.ProcessFile] Processing file(%s) Step failed:\n%v\n\n", file.FileName, status))
-			statusCh <- fileProcess
+			fm.LogTo("INFO", fmt.Sprintf("[FileManager.ProcessFile] Processing file(%s)%s Step failed:\n%v\n\n", file.FileName, fileProcess.LogLabels(), status))
+			fm.publishFinalStatus(statusCh, fileProcess)
 			return
 		}
 
 		files = processedFiles
-		percentage := (len(files) * 100) / len(recipe.ProcessingSteps)
-		status := ProcessingStatus{
-			ProcessID:         fileProcess.ID,
-			TimeStamp:         int(time.Now().UnixNano() / int64(time.Millisecond)),
-			ProcessorName:     step.PluginName,
-			StatusDescription: fmt.Sprintf("Processing step completed: %s", step.PluginName),
-			Percentage:        percentage,
-		}
-		fileProcess.AddProcessingUpdate(status)
+		fileProcess.AddStepProgress(step.PluginName, fmt.Sprintf("Processing step completed: %s", step.PluginName), 100)
 		// fm.LogTo("DEBUG", fmt.Sprintf("[GO-FILEMANAGER.ProcessFile #6] Processing file status update: \n%v\n\n", status))
-		statusCh <- fileProcess
+		fm.saveProcessState(fileProcess)
+		publishStatus(statusCh, fileProcess)
+	}
+	fileProcess.finishSteps()
+	if fileProcess.Cancelled() {
+		fm.endCancelledProcess(file, fileProcess, statusCh, nil)
+		return
+	}
+	if opts.upload != nil {
+		// the recipe changed since ProcessUpload chose to stream and has no steps now
+		err := opts.upload.readInto(file)
+		if err != nil {
+			status := ProcessingStatus{
+				ProcessID:         fileProcess.ID,
+				TimeStamp:         int(time.Now().UnixNano() / int64(time.Millisecond)),
+				ProcessorName:     "FileUpload",
+				StatusDescription: fmt.Sprintf("Failed to receive upload: %v", err),
+				Error:             err,
+				Done:              true,
+			}
+			fileProcess.AddProcessingUpdate(status)
+			fm.LogTo("INFO", fmt.Sprintf("[FileManager.ProcessFile] Processing file(%s)%s receiving upload failed: %v\n", file.FileName, fileProcess.LogLabels(), err))
+			fm.publishFinalStatus(statusCh, fileProcess)
+			return
+		}
 	}
 
 	var outputFiles []*ManagedFile
+	// outputs to remove if the process is cancelled while they are written
+	var savedFiles []*ManagedFile
 	if file.MetaData == nil {
 		file.MetaData = make(map[string]any)
 	}
 	file.MetaData["process_id"] = fileProcess.ID
+	if fileProcess.CorrelationID != "" {
+		file.MetaData["correlation_id"] = fileProcess.CorrelationID
+	}
+	// outputs are written from the primary file of the last step; further files it produced are stored next to
+	// the first output written
+	resultFile := file
+	if len(files) > 0 {
+		resultFile = files[0]
+	}
+	for _, processedFile := range files {
+		processedFile.SetMetaData("process_id", fileProcess.ID)
+		if fileProcess.CorrelationID != "" {
+			processedFile.SetMetaData("correlation_id", fileProcess.CorrelationID)
+		}
+	}
 
+	derivation := FileDerivation{Original: file.LocalFilePath, Recipe: recipe.Name, ProcessID: fileProcess.ID, DerivedAt: time.Now()}
+	for _, step := range recipe.ProcessingSteps {
+		if step.PluginName != "" {
+			derivation.Step = step.PluginName
+		}
+	}
+
+	var extraFiles []*ManagedFile
+	if len(files) > 1 {
+		extraFiles = files[1:]
+	}
 	for _, outputFormat := range recipe.OutputFormats {
-		for _, targetFilepathnameTemplate := range outputFormat.TargetFileNames {
-			// Perform variable replacement in the target file name
-			targetFilePath := ReplaceFileNameVariables(targetFilepathnameTemplate, file)
-			// add file extension if not present
-			if filepath.Ext(targetFilePath) == "" {
-				targetFilePath = targetFilePath + filepath.Ext(file.FileName)
-			}
-			// fm.logger("DEBUG", fmt.Sprintf("################## [ProcessFile]: AFTER FILE-REPLACEMENT: targetFilePath(%s)\n", targetFilePath))
-			fullFilePath, _, fileName := getFilePathAndName("", targetFilePath)
-			// fm.logger("DEBUG", fmt.Sprintf("################## [ProcessFile]: AFTER EXTRACTION: fullFilePath(%s), fileName(%s)\n", fullFilePath, fileName))
-			outputFile := &ManagedFile{
-				FileName: fileName,
-				MetaData: file.MetaData,
-				FileSize: file.FileSize,
-				MimeType: file.MimeType,
+		source, err := fm.convertForOutput(resultFile, outputFormat.Format)
+		if errors.Is(err, ErrUnsupportedOutputFormat) {
+			fm.skipOutputFormat(file, fileProcess, outputFormat.Format, err)
+			continue
+		}
+		if err != nil {
+			status := ProcessingStatus{
+				ProcessID:         fileProcess.ID,
+				TimeStamp:         int(time.Now().UnixNano() / int64(time.Millisecond)),
+				ProcessorName:     "OutputFormatConversion",
+				StatusDescription: fmt.Sprintf("Output format conversion failed: %v", err),
+				Error:             err,
+				Done:              true,
 			}
-
-			switch outputFormat.StorageType {
-			case FileStorageTypePrivate:
-				outputFile.LocalFilePath = fm.GetPrivateLocalFilePath(fullFilePath)
-			case FileStorageTypeTemp:
-				outputFile.LocalFilePath = fm.GetLocalTemporaryFilePath(fullFilePath)
-			case FileStorageTypePublic:
-				outputFile.LocalFilePath = fm.GetPublicLocalFilePath(fullFilePath)
-			default:
-				status := ProcessingStatus{
-					ProcessID:         fileProcess.ID,
-					TimeStamp:         int(time.Now().UnixNano() / int64(time.Millisecond)),
-					ProcessorName:     "OutputFormatCheck",
-					StatusDescription: fmt.Sprintf("Invalid storage type: %s", outputFormat.StorageType),
-					Error:             fmt.Errorf("invalid storage type: %s", outputFormat.StorageType),
-					Done:              true,
+			fileProcess.AddProcessingUpdate(status)
+			fm.LogTo("INFO", fmt.Sprintf("[FileManager.ProcessFile] Processing file(%s)%s Output format(%s) conversion failed: %v\n", file.FileName, fileProcess.LogLabels(), outputFormat.Format, err))
+			fm.publishFinalStatus(statusCh, fileProcess)
+			return
+		}
+		for _, targetFilepathnameTemplate := range outputFormat.TargetFileNames {
+			targetFilePath := fm.outputTargetPath(targetFilepathnameTemplate, source, outputFormat.Format)
+			targetFiles := append([]*ManagedFile{source}, extraFiles...)
+			extraFiles = nil
+			for i, targetFile := range targetFiles {
+				filePath := targetFilePath
+				if i > 0 {
+					filePath = filepath.Join(filepath.Dir(targetFilePath), targetFile.FileName)
+				}
+				// fm.logger("DEBUG", fmt.Sprintf("################## [ProcessFile]: AFTER FILE-REPLACEMENT: targetFilePath(%s)\n", targetFilePath))
+				fullFilePath, _, fileName := getFilePathAndName("", filePath)
+				// fm.logger("DEBUG", fmt.Sprintf("################## [ProcessFile]: AFTER EXTRACTION: fullFilePath(%s), fileName(%s)\n", fullFilePath, fileName))
+				metaData := targetFile.MetaData
+				if metaData == nil {
+					metaData = file.MetaData
+				}
+				outputDerivation := derivation
+				if i == 0 && needsFormatConversion(resultFile, outputFormat.Format) {
+					outputDerivation.Format = NormalizeOutputFormat(outputFormat.Format)
+				}
+				metaData = withDerivation(metaData, outputDerivation)
+				outputFile := &ManagedFile{
+					FileName:    fileName,
+					MetaData:    metaData,
+					FileSize:    targetFile.FileSize,
+					MimeType:    targetFile.MimeType,
+					Owner:       file.Owner,
+					HTTPHeaders: recipe.HTTPHeaders.merge(outputFormat.HTTPHeaders),
 				}
-				fileProcess.AddProcessingUpdate(status)
-				// fm.LogTo("DEBUG", fmt.Sprintf("[GO-FILEMANAGER.ProcessFile.OutputFormatCheck #6] Processing file ERROR: \n%v\n\n", status))
-				statusCh <- fileProcess
-				return
-			}
-			// fm.logger("DEBUG", fmt.Sprintf("################## [ProcessFile]: BASE-PATH-ADDITION: fullFilePath(%s)\n", outputFile.LocalFilePath))
 
-			if outputFormat.StorageType == FileStorageTypePublic {
-				outputFile.URL, _ = fm.GetPublicUrlForFile(outputFile.LocalFilePath)
-			} else {
-				outputFile.URL = ""
-			}
+				var ok bool
+				var storageType FileStorageType
+				outputFile.LocalFilePath, storageType, ok = fm.routedOutputPath(targetFile, outputFormat.StorageType, fullFilePath)
+				if !ok {
+					status := ProcessingStatus{
+						ProcessID:         fileProcess.ID,
+						TimeStamp:         int(time.Now().UnixNano() / int64(time.Millisecond)),
+						ProcessorName:     "OutputFormatCheck",
+						StatusDescription: fmt.Sprintf("Invalid storage type: %s", outputFormat.StorageType),
+						Error:             fmt.Errorf("%w: %s", ErrInvalidStorageType, outputFormat.StorageType),
+						Done:              true,
+					}
+					fileProcess.AddProcessingUpdate(status)
+					fm.LogTo("INFO", fmt.Sprintf("[FileManager.ProcessFile] Processing file(%s)%s Invalid storage type(%s)\n", file.FileName, fileProcess.LogLabels(), outputFormat.StorageType))
+					// fm.LogTo("DEBUG", fmt.Sprintf("[GO-FILEMANAGER.ProcessFile.OutputFormatCheck #6] Processing file ERROR: \n%v\n\n", status))
+					fm.publishFinalStatus(statusCh, fileProcess)
+					return
+				}
+				// fm.logger("DEBUG", fmt.Sprintf("################## [ProcessFile]: BASE-PATH-ADDITION: fullFilePath(%s)\n", outputFile.LocalFilePath))
 
-			outputFile.Content = file.Content
-			err := outputFile.Save()
-			if err != nil {
-				status := ProcessingStatus{
-					ProcessID:         fileProcess.ID,
-					TimeStamp:         int(time.Now().UnixNano() / int64(time.Millisecond)),
-					ProcessorName:     "FileSave",
-					StatusDescription: fmt.Sprintf("Failed to save output file: %v", err),
-					Error:             err,
-					Done:              true,
+				if fileProcess.Cancelled() {
+					fm.endCancelledProcess(file, fileProcess, statusCh, savedFiles)
+					return
+				}
+				outputFile.Content = targetFile.Content
+				var err error
+				if outputFormat.ContentAddressed && storageType == FileStorageTypePublic {
+					err = fm.saveContentAddressed(outputFile)
+				} else {
+					err = fm.saveOutput(outputFile, outputFormat.OnCollision, fileProcess.ID, opts.replaceDerivedFrom)
+					if err == nil {
+						savedFiles = append(savedFiles, outputFile)
+					}
+				}
+				if err == nil && storageType == FileStorageTypePublic {
+					outputFile.URL, _ = fm.GetPublicUrlForFile(outputFile.LocalFilePath)
+				}
+				if err != nil {
+					err = &StorageError{Op: "save", Path: outputFile.LocalFilePath, Err: err}
+					status := ProcessingStatus{
+						ProcessID:         fileProcess.ID,
+						TimeStamp:         int(time.Now().UnixNano() / int64(time.Millisecond)),
+						ProcessorName:     "FileSave",
+						StatusDescription: fmt.Sprintf("Failed to save output file: %v", err),
+						Error:             err,
+						Done:              true,
+					}
+					fileProcess.AddProcessingUpdate(status)
+					// fm.LogTo("DEBUG", fmt.Sprintf("[GO-FILEMANAGER.ProcessFile.FileSave #1] Processing file ERROR: \n%v\n\n", status))
+					fm.LogTo("INFO", fmt.Sprintf("[FileManager.ProcessFile] Processing file(%s)%s Saving Result failed: \n%v\n", file.FileName, fileProcess.LogLabels(), status))
+					fm.publishFinalStatus(statusCh, fileProcess)
+					return
+				}
+				if len(outputFormat.PreCompress) > 0 {
+					_, err = fm.PreCompressFile(outputFile, outputFormat.PreCompress)
+					if err != nil {
+						fm.LogTo("INFO", fmt.Sprintf("[FileManager.ProcessFile] Processing file(%s)%s Pre-compressing output(%s) failed: %v\n", file.FileName, fileProcess.LogLabels(), outputFile.LocalFilePath, err))
+					}
 				}
-				fileProcess.AddProcessingUpdate(status)
-				// fm.LogTo("DEBUG", fmt.Sprintf("[GO-FILEMANAGER.ProcessFile.FileSave #1] Processing file ERROR: \n%v\n\n", status))
-				fm.LogTo("INFO", fmt.Sprintf("[FileManager.ProcessFile] Processing file(%s) Saving Result failed: \n%v\n", file.FileName, status))
-				statusCh <- fileProcess
-				return
+
+				outputFiles = append(outputFiles, outputFile)
 			}
+		}
+	}
 
-			outputFiles = append(outputFiles, outputFile)
+	if fileProcess.Cancelled() {
+		fm.endCancelledProcess(file, fileProcess, statusCh, savedFiles)
+		return
+	}
+	responsiveFiles, responsiveImages, err := fm.generateResponsiveImages(resultFile, file, recipe)
+	if err != nil {
+		status := ProcessingStatus{
+			ProcessID:         fileProcess.ID,
+			TimeStamp:         int(time.Now().UnixNano() / int64(time.Millisecond)),
+			ProcessorName:     "ResponsiveImages",
+			StatusDescription: fmt.Sprintf("Generating responsive images failed: %v", err),
+			Error:             err,
+			Done:              true,
 		}
+		fileProcess.AddProcessingUpdate(status)
+		fm.LogTo("INFO", fmt.Sprintf("[FileManager.ProcessFile] Processing file(%s)%s Generating responsive images failed: %v\n", file.FileName, fileProcess.LogLabels(), err))
+		fm.publishFinalStatus(statusCh, fileProcess)
+		return
+	}
+	for _, responsiveFile := range responsiveFiles {
+		responsiveDerivation := derivation
+		responsiveDerivation.Step = "ResponsiveImages"
+		responsiveFile.MetaData = withDerivation(responsiveFile.MetaData, responsiveDerivation)
 	}
+	outputFiles = append(outputFiles, responsiveFiles...)
 
 	var resultingFiles []ProcessingResultFile
 
 	for _, outputFile := range outputFiles {
-		resultingFile := ProcessingResultFile{
-			FileName:      outputFile.FileName,
-			LocalFilePath: outputFile.LocalFilePath,
-			URL:           outputFile.URL,
-			FileSize:      outputFile.FileSize,
-			MimeType:      outputFile.MimeType,
-		}
-		resultingFiles = append(resultingFiles, resultingFile)
+		resultingFiles = append(resultingFiles, newProcessingResultFile(outputFile, recipe.ResultMetaData))
 	}
 
 	status := ProcessingStatus{
@@ -261,17 +601,162 @@ func (fm *FileManager) ProcessFile(file *ManagedFile, recipeName string, filePro
 		Percentage:        100,
 		Done:              true,
 		ResultingFiles:    resultingFiles,
+		ResponsiveImages:  responsiveImages,
 	}
 	fileProcess.AddProcessingUpdate(status)
 	fileProcess.LatestStatus.Done = true
-	fm.LogTo("INFO", fmt.Sprintf("[FileManager.ProcessFile] Processing file(%s) COMPLETED: \n%v\n", file.FileName, status))
-	statusCh <- fileProcess
+	fm.storeOutputs(outputFiles, fileProcess)
+	fm.LogTo("INFO", fmt.Sprintf("[FileManager.ProcessFile] Processing file(%s)%s COMPLETED: \n%v\n", file.FileName, fileProcess.LogLabels(), status))
+	fm.publishFinalStatus(statusCh, fileProcess)
+}
+
+// skipOutputFormat reports an output that is left out because no plugin converts the result file to its format,
+// e.g. a jpg output of a recipe accepting PDFs as well as images. The process goes on with the other outputs.
+func (fm *FileManager) skipOutputFormat(file *ManagedFile, fileProcess *FileProcess, format string, err error) {
+	status := ProcessingStatus{
+		ProcessID:         fileProcess.ID,
+		TimeStamp:         int(time.Now().UnixNano() / int64(time.Millisecond)),
+		ProcessorName:     "OutputFormatConversion",
+		StatusDescription: fmt.Sprintf("Skipping output format(%s): %v", format, err),
+	}
+	fileProcess.AddProcessingUpdate(status)
+	fm.LogTo("INFO", fmt.Sprintf("[FileManager.ProcessFile] Processing file(%s)%s Skipping output format(%s): %v\n", file.FileName, fileProcess.LogLabels(), format, err))
 }
 
-func isValidMimeType(mimeType string, acceptedMimeTypes []string) bool {
+// outputTargetPath renders the target file name template of an output for the source file. The extension of the
+// source is added if the template has none, the one of its MIME type if the source has none either, and it is made
+// to match the declared format otherwise.
+func (fm *FileManager) outputTargetPath(targetFilepathnameTemplate string, source *ManagedFile, format string) string {
+	targetFilePath := ReplaceFileNameVariables(targetFilepathnameTemplate, source)
+	if filepath.Ext(targetFilePath) == "" {
+		extension := filepath.Ext(source.FileName)
+		if extension == "" && source.MimeType != "" {
+			extension = fm.extensionForMimeType(source.MimeType)
+		}
+		targetFilePath = targetFilePath + extension
+	} else if needsFormatConversion(&ManagedFile{FileName: targetFilePath}, format) {
+		targetFilePath = fileNameWithFormat(targetFilePath, format)
+	}
+	return targetFilePath
+}
+
+// outputLocalFilePath returns the local path of an output below the base path of its storage type, false for an
+// invalid storage type.
+func (fm *FileManager) outputLocalFilePath(storageType FileStorageType, fullFilePath string) (string, bool) {
+	if !validStorageType(storageType) {
+		return "", false
+	}
+	return fm.GetLocalPathForFile(storageType, fullFilePath), true
+}
+
+// finishProcess guarantees the terminal status of every process: a panic outside of the plugins or a return
+// without a final status ends the process with an error instead of leaving it running forever. recovered is the
+// result of recover() in the deferred call.
+func (fm *FileManager) finishProcess(file *ManagedFile, fileProcess *FileProcess, statusCh chan<- *FileProcess, recovered any) {
+	if recovered == nil && fileProcess.Finished() {
+		return
+	}
+	err := ErrProcessingIncomplete
+	if recovered != nil {
+		err = fmt.Errorf("%w: %v", ErrProcessingPanicked, recovered)
+	}
+	fileProcess.AddProcessingUpdate(ProcessingStatus{
+		ProcessID:         fileProcess.ID,
+		TimeStamp:         int(time.Now().UnixNano() / int64(time.Millisecond)),
+		ProcessorName:     "FileProcessing",
+		StatusDescription: fmt.Sprintf("Processing failed: %v", err),
+		Error:             err,
+		Done:              true,
+	})
+	fm.LogTo("INFO", fmt.Sprintf("[FileManager.ProcessFile] Processing file(%s)%s failed: %v\n", file.FileName, fileProcess.LogLabels(), err))
+	fm.publishFinalStatus(statusCh, fileProcess)
+}
+
+// storeOutputs runs the bookkeeping for saved output files: metadata persistence, search indexing and image hash
+// registration. Failures are logged and do not fail the process, as the outputs themselves are already stored.
+func (fm *FileManager) storeOutputs(outputFiles []*ManagedFile, fileProcess *FileProcess) {
+	store := fm.getMetadataStore()
+	index := fm.getSearchIndex()
+	for _, outputFile := range outputFiles {
+		fm.registerImageHash(outputFile)
+		if store != nil {
+			err := fm.PersistManagedFile(outputFile, fileProcess)
+			if err != nil {
+				fm.LogTo("INFO", fmt.Sprintf("[FileManager.ProcessFile] Persisting metadata of file(%s)%s failed: %v\n", outputFile.LocalFilePath, fileProcess.LogLabels(), err))
+			}
+		}
+		if index != nil {
+			err := index.IndexDocument(NewSearchDocument(outputFile))
+			if err != nil {
+				fm.LogTo("INFO", fmt.Sprintf("[FileManager.ProcessFile] Indexing file(%s)%s failed: %v\n", outputFile.LocalFilePath, fileProcess.LogLabels(), err))
+			}
+		}
+	}
+}
+
+// newProcessingResultFile describes the output file. Content sniffing and image dimensions need the content
+// loaded, which outputs of a process have.
+func newProcessingResultFile(outputFile *ManagedFile, metaDataKeys []string) ProcessingResultFile {
+	resultingFile := ProcessingResultFile{
+		FileName:      outputFile.FileName,
+		LocalFilePath: outputFile.LocalFilePath,
+		URL:           outputFile.URL,
+		FileSize:      outputFile.FileSize,
+		MimeType:      outputFile.MimeType,
+		Checksum:      outputFile.Checksum,
+	}
+	if len(outputFile.Content) > 0 {
+		resultingFile.DetectedMimeType = mimetype.Detect(outputFile.Content).String()
+		if resultingFile.Checksum == "" {
+			resultingFile.Checksum, _ = outputFile.ComputeChecksum()
+		}
+	}
+	// image steps store the info, other outputs are read
+	imageInfo, ok := outputFile.GetMetaData(METADATA_KEY_IMAGE).(ImageInfo)
+	if !ok && len(outputFile.Content) > 0 && strings.HasPrefix(outputFile.MimeType, "image/") {
+		var err error
+		imageInfo, err = ReadImageInfo(outputFile.Content)
+		ok = err == nil
+	}
+	if ok {
+		resultingFile.Width, resultingFile.Height = imageInfo.Width, imageInfo.Height
+		resultingFile.Frames, resultingFile.DPI = imageInfo.Frames, imageInfo.DPIX
+	}
+	resultingFile.BlurHash, _ = outputFile.GetMetaData(METADATA_KEY_BLURHASH).(string)
+	resultingFile.LQIP, _ = outputFile.GetMetaData(METADATA_KEY_LQIP).(string)
+	switch video := outputFile.GetMetaData(METADATA_KEY_VIDEO).(type) {
+	case VideoInfo:
+		resultingFile.Duration = video.Duration
+		if resultingFile.Width == 0 {
+			resultingFile.Width, resultingFile.Height = video.Width, video.Height
+		}
+	case *VideoInfo:
+		resultingFile.Duration = video.Duration
+		if resultingFile.Width == 0 {
+			resultingFile.Width, resultingFile.Height = video.Width, video.Height
+		}
+	}
+	switch scan := outputFile.GetMetaData(METADATA_KEY_VIRUS_SCAN).(type) {
+	case VirusScanResult:
+		resultingFile.VirusScan = &scan
+	case *VirusScanResult:
+		resultingFile.VirusScan = scan
+	}
+	for _, key := range metaDataKeys {
+		if value, ok := outputFile.MetaData[key]; ok {
+			if resultingFile.MetaData == nil {
+				resultingFile.MetaData = make(map[string]any, len(metaDataKeys))
+			}
+			resultingFile.MetaData[key] = value
+		}
+	}
+	return resultingFile
+}
+
+// isValidMimeType reports whether the MIME type matches one of the accepted ones, see matchMimeType.
+func isValidMimeType(mimeType string, acceptedMimeTypes []string, strict bool) bool {
 	for _, accepted := range acceptedMimeTypes {
-		// check lowercase matching and match as prefix
-		if strings.HasPrefix(strings.ToLower(mimeType), strings.ToLower(accepted)) {
+		if matchMimeType(accepted, mimeType, strict) {
 			return true
 		}
 	}
@@ -280,18 +765,21 @@ func isValidMimeType(mimeType string, acceptedMimeTypes []string) bool {
 
 // RunProcessingStep applies a single processing step to a ManagedFile.
 func (fm *FileManager) RunProcessingStep(file *ManagedFile, pluginName string, params map[string]any, targetStorageType FileStorageType) (*ManagedFile, error) {
-	fm.mu.RLock()
-	plugin, exists := fm.processingPlugins[pluginName]
-	fm.mu.RUnlock()
+	plugin, exists := fm.getProcessingPlugin(pluginName)
 	if !exists {
-		return nil, fmt.Errorf("processing plugin not found: %s", pluginName)
+		return nil, fmt.Errorf("%w: %s", ErrProcessingPluginNotFound, pluginName)
 	}
 
 	// Wrap the file in a slice as some plugins may expect multiple files
 	files := []*ManagedFile{file}
+	applied, err := applyStepParams(files, params, nil)
+	if err != nil {
+		return nil, &ValidationError{Field: "params", Err: err}
+	}
 
 	// Create a dummy FileProcess to monitor the progress
 	fileProcess := NewFileProcess(file.FileName, "SingleStepProcess")
+	fm.RegisterProcess(fileProcess)
 	fileProcess.AddProcessingUpdate(ProcessingStatus{
 		ProcessID:         fileProcess.ID,
 		TimeStamp:         int(time.Now().UnixNano() / int64(time.Millisecond)),
@@ -299,22 +787,28 @@ func (fm *FileManager) RunProcessingStep(file *ManagedFile, pluginName string, p
 		StatusDescription: "Initiating single step processing",
 	})
 
-	// Execute the plugin processing
-	processedFiles, err := plugin.Process(files, fileProcess)
-	if err != nil {
+	// every return finishes the process with a final status
+	fail := func(description string, err error) (*ManagedFile, error) {
 		fileProcess.AddProcessingUpdate(ProcessingStatus{
 			ProcessID:         fileProcess.ID,
 			TimeStamp:         int(time.Now().UnixNano() / int64(time.Millisecond)),
 			ProcessorName:     pluginName,
-			StatusDescription: "Error during processing",
+			StatusDescription: description,
 			Error:             err,
 			Done:              true,
 		})
 		return nil, err
 	}
 
+	// Execute the plugin processing
+	processedFiles, err := fm.runPlugin(pluginName, plugin, files, fileProcess)
+	applied.restore(processedFiles)
+	if err != nil {
+		return fail("Error during processing", &PluginError{Plugin: pluginName, Err: err})
+	}
+
 	if len(processedFiles) == 0 {
-		return nil, fmt.Errorf("no file processed by plugin: %s", pluginName)
+		return fail("No file processed", fmt.Errorf("no file processed by plugin: %s", pluginName))
 	}
 
 	// Assume the first file is the one we're interested in (since we provided one file)
@@ -324,9 +818,9 @@ func (fm *FileManager) RunProcessingStep(file *ManagedFile, pluginName string, p
 	if targetStorageType != "" {
 		localPath := fm.GetLocalPathForFile(targetStorageType, resultFile.FileName)
 		if localPath != resultFile.LocalFilePath {
-			err := os.Rename(resultFile.LocalFilePath, localPath)
+			err := fm.moveFile(resultFile.LocalFilePath, localPath)
 			if err != nil {
-				return nil, err
+				return fail("Error moving the processed file", err)
 			}
 			resultFile.LocalFilePath = localPath
 		}
@@ -343,6 +837,10 @@ func (fm *FileManager) RunProcessingStep(file *ManagedFile, pluginName string, p
 	return resultFile, nil
 }
 
+// ReplaceFileNameVariables renders a target file name template for the file. Besides {metadata.x}, {owner},
+// {process_id} and {date:layout} (a Go time layout, DEFAULT_PATH_DATE_LAYOUT for {date}) are replaced, so outputs
+// can be spread over directories like {date}/{owner}/{process_id}/. Values are inserted as single path segments and
+// the result is normalized to a relative path, see normalizeTargetPath.
 func ReplaceFileNameVariables(fileName string, file *ManagedFile) string {
 	// Replace {metadata.whatever} with the corresponding value from file.MetaData
 	metadataRegex := regexp.MustCompile(`{metadata\.([^}]+)}`)
@@ -351,10 +849,11 @@ func ReplaceFileNameVariables(fileName string, file *ManagedFile) string {
 		key = strings.TrimSuffix(key, "}")
 		value, ok := file.MetaData[key]
 		if ok {
-			return fmt.Sprintf("%v", value)
+			return pathSegment(fmt.Sprintf("%v", value))
 		}
 		return ""
 	})
+	fileName = replacePathVariables(fileName, file, time.Now().UTC())
 
 	// Automatically add the correct file extension based on the MIME type
 	extension := mime.TypeByExtension(file.FileName)
@@ -362,5 +861,5 @@ func ReplaceFileNameVariables(fileName string, file *ManagedFile) string {
 		fileName = fileName + extension
 	}
 
-	return fileName
+	return normalizeTargetPath(fileName)
 }
@@ -0,0 +1,305 @@
+package filemanager
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+var (
+	ErrContentBlocked          = errors.New("content blocked by moderation")
+	ErrModerationUnsupported   = errors.New("file type not supported by moderation provider")
+	ErrModerationProviderUnset = errors.New("moderation plugin has no provider")
+)
+
+const METADATA_KEY_MODERATION = "moderation"
+
+const (
+	DEFAULT_MODERATION_FLAG_THRESHOLD  = 0.5
+	DEFAULT_MODERATION_BLOCK_THRESHOLD = 0.9
+)
+
+type ModerationAction string
+
+const (
+	ModerationActionAllow ModerationAction = "allow"
+	ModerationActionFlag  ModerationAction = "flag"
+	ModerationActionBlock ModerationAction = "block"
+)
+
+// ModerationLabel is a detected category with a confidence between 0 and 1.
+type ModerationLabel struct {
+	Name       string  `json:"name"`
+	Confidence float64 `json:"confidence"`
+}
+
+// ModerationResult is stored in MetaData["moderation"] by the ModerationPlugin.
+type ModerationResult struct {
+	Provider string            `json:"provider"`
+	Labels   []ModerationLabel `json:"labels"`
+	Action   ModerationAction  `json:"action"`
+}
+
+// ModerationProvider classifies a file. Providers return ErrModerationUnsupported for files they cannot handle.
+type ModerationProvider interface {
+	Name() string
+	Moderate(file *ManagedFile) ([]ModerationLabel, error)
+}
+
+// ModerationPlugin runs images and videos through a ModerationProvider. Files with a label at or above the
+// BlockThreshold fail the recipe with ErrContentBlocked, files at or above the FlagThreshold get a processing error
+// and are passed on. BlockLabels restricts blocking to the listed label names (case-insensitive).
+type ModerationPlugin struct {
+	Provider       ModerationProvider
+	FlagThreshold  float64
+	BlockThreshold float64
+	BlockLabels    []string
+}
+
+func (p *ModerationPlugin) Process(files []*ManagedFile, fileProcess *FileProcess) ([]*ManagedFile, error) {
+	if p.Provider == nil {
+		return nil, ErrModerationProviderUnset
+	}
+	var processedFiles []*ManagedFile
+
+	for _, file := range files {
+		if !isImageFile(file) && !strings.HasPrefix(file.MimeType, "video/") {
+			processedFiles = append(processedFiles, file)
+			continue
+		}
+		status := ProcessingStatus{
+			ProcessID:         fileProcess.ID,
+			TimeStamp:         int(time.Now().UnixNano() / int64(time.Millisecond)),
+			ProcessorName:     "Moderation",
+			StatusDescription: fmt.Sprintf("Moderating file(%s) using %s", file.FileName, p.Provider.Name()),
+		}
+		fileProcess.AddProcessingUpdate(status)
+
+		labels, err := p.Provider.Moderate(file)
+		if errors.Is(err, ErrModerationUnsupported) {
+			processedFiles = append(processedFiles, file)
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("moderation failed: %v", err)
+		}
+
+		result := ModerationResult{
+			Provider: p.Provider.Name(),
+			Labels:   labels,
+			Action:   p.decideAction(labels),
+		}
+		file.SetMetaData(METADATA_KEY_MODERATION, result)
+
+		switch result.Action {
+		case ModerationActionBlock:
+			return nil, fmt.Errorf("%w: file(%s) labels(%s)", ErrContentBlocked, file.FileName, formatModerationLabels(labels))
+		case ModerationActionFlag:
+			file.ProcessingErrors = append(file.ProcessingErrors, fmt.Sprintf("flagged by moderation: %s", formatModerationLabels(labels)))
+		}
+		processedFiles = append(processedFiles, file)
+	}
+
+	return processedFiles, nil
+}
+
+func (p *ModerationPlugin) decideAction(labels []ModerationLabel) ModerationAction {
+	flagThreshold := p.FlagThreshold
+	if flagThreshold <= 0 {
+		flagThreshold = DEFAULT_MODERATION_FLAG_THRESHOLD
+	}
+	blockThreshold := p.BlockThreshold
+	if blockThreshold <= 0 {
+		blockThreshold = DEFAULT_MODERATION_BLOCK_THRESHOLD
+	}
+
+	action := ModerationActionAllow
+	for _, label := range labels {
+		if label.Confidence >= blockThreshold && p.isBlockLabel(label.Name) {
+			return ModerationActionBlock
+		}
+		if label.Confidence >= flagThreshold {
+			action = ModerationActionFlag
+		}
+	}
+	return action
+}
+
+func (p *ModerationPlugin) isBlockLabel(name string) bool {
+	if len(p.BlockLabels) == 0 {
+		return true
+	}
+	for _, blockLabel := range p.BlockLabels {
+		if strings.EqualFold(blockLabel, name) {
+			return true
+		}
+	}
+	return false
+}
+
+func formatModerationLabels(labels []ModerationLabel) string {
+	parts := make([]string, 0, len(labels))
+	for _, label := range labels {
+		parts = append(parts, fmt.Sprintf("%s=%.2f", label.Name, label.Confidence))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// HTTPModerationProvider posts the raw file content to a moderation endpoint, e.g. a locally hosted model server.
+// The endpoint must answer with {"labels": [{"name": "...", "confidence": 0.0-1.0}]}.
+type HTTPModerationProvider struct {
+	Endpoint string
+	APIKey   string // sent as bearer token if set
+	Client   *http.Client
+}
+
+func (p *HTTPModerationProvider) Name() string {
+	return "http"
+}
+
+func (p *HTTPModerationProvider) Moderate(file *ManagedFile) ([]ModerationLabel, error) {
+	req, err := http.NewRequest(http.MethodPost, p.Endpoint, bytes.NewReader(file.Content))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", file.MimeType)
+	if p.APIKey != "" {
+		req.Header.Set("Authorization", "Bearer "+p.APIKey)
+	}
+	var response struct {
+		Labels []ModerationLabel `json:"labels"`
+	}
+	err = doJSONRequest(p.Client, req, &response)
+	if err != nil {
+		return nil, err
+	}
+	return response.Labels, nil
+}
+
+const GOOGLE_VISION_ANNOTATE_ENDPOINT = "https://vision.googleapis.com/v1/images:annotate"
+
+// GoogleVisionModerationProvider uses Google Cloud Vision SafeSearch detection (images only).
+// Likelihoods are mapped to confidences: VERY_UNLIKELY 0.05, UNLIKELY 0.25, POSSIBLE 0.5, LIKELY 0.75, VERY_LIKELY 0.95.
+type GoogleVisionModerationProvider struct {
+	APIKey   string // sent in the X-Goog-Api-Key header
+	Endpoint string // defaults to GOOGLE_VISION_ANNOTATE_ENDPOINT
+	Client   *http.Client
+}
+
+func (p *GoogleVisionModerationProvider) Name() string {
+	return "google_vision"
+}
+
+var googleVisionLikelihoods = map[string]float64{
+	"UNKNOWN":       0,
+	"VERY_UNLIKELY": 0.05,
+	"UNLIKELY":      0.25,
+	"POSSIBLE":      0.5,
+	"LIKELY":        0.75,
+	"VERY_LIKELY":   0.95,
+}
+
+func (p *GoogleVisionModerationProvider) Moderate(file *ManagedFile) ([]ModerationLabel, error) {
+	if !isImageFile(file) {
+		return nil, ErrModerationUnsupported
+	}
+	endpoint := p.Endpoint
+	if endpoint == "" {
+		endpoint = GOOGLE_VISION_ANNOTATE_ENDPOINT
+	}
+	request := map[string]any{
+		"requests": []map[string]any{{
+			"image":    map[string]string{"content": base64.StdEncoding.EncodeToString(file.Content)},
+			"features": []map[string]string{{"type": "SAFE_SEARCH_DETECTION"}},
+		}},
+	}
+	var response struct {
+		Responses []struct {
+			SafeSearchAnnotation map[string]string `json:"safeSearchAnnotation"`
+			Error                *struct {
+				Message string `json:"message"`
+			} `json:"error"`
+		} `json:"responses"`
+	}
+	err := postJSON(p.Client, endpoint, map[string]string{"X-Goog-Api-Key": p.APIKey}, request, &response)
+	if err != nil {
+		return nil, err
+	}
+	if len(response.Responses) == 0 {
+		return nil, fmt.Errorf("google vision returned no response")
+	}
+	if response.Responses[0].Error != nil {
+		return nil, fmt.Errorf("google vision: %s", response.Responses[0].Error.Message)
+	}
+	labels := []ModerationLabel{}
+	for category, likelihood := range response.Responses[0].SafeSearchAnnotation {
+		confidence, ok := googleVisionLikelihoods[likelihood]
+		if !ok {
+			continue
+		}
+		labels = append(labels, ModerationLabel{Name: category, Confidence: confidence})
+	}
+	return labels, nil
+}
+
+// RekognitionModerationProvider uses AWS Rekognition DetectModerationLabels (images only, up to 5 MB).
+type RekognitionModerationProvider struct {
+	Region        string
+	Credentials   AWSCredentials
+	MinConfidence float64 // in percent as used by Rekognition, defaults to 50
+	Endpoint      string  // defaults to https://rekognition.<region>.amazonaws.com
+	Client        *http.Client
+}
+
+func (p *RekognitionModerationProvider) Name() string {
+	return "aws_rekognition"
+}
+
+func (p *RekognitionModerationProvider) Moderate(file *ManagedFile) ([]ModerationLabel, error) {
+	if !isImageFile(file) {
+		return nil, ErrModerationUnsupported
+	}
+	endpoint := p.Endpoint
+	if endpoint == "" {
+		endpoint = "https://rekognition." + p.Region + ".amazonaws.com/"
+	}
+	minConfidence := p.MinConfidence
+	if minConfidence <= 0 {
+		minConfidence = 50
+	}
+	payload, err := json.Marshal(map[string]any{
+		"Image":         map[string]string{"Bytes": base64.StdEncoding.EncodeToString(file.Content)},
+		"MinConfidence": minConfidence,
+	})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "RekognitionService.DetectModerationLabels")
+	signAWSRequestV4(req, sha256Hex(payload), p.Region, "rekognition", p.Credentials, time.Now())
+
+	var response struct {
+		ModerationLabels []struct {
+			Name       string  `json:"Name"`
+			Confidence float64 `json:"Confidence"`
+		} `json:"ModerationLabels"`
+	}
+	err = doJSONRequest(p.Client, req, &response)
+	if err != nil {
+		return nil, err
+	}
+	labels := make([]ModerationLabel, 0, len(response.ModerationLabels))
+	for _, label := range response.ModerationLabels {
+		labels = append(labels, ModerationLabel{Name: label.Name, Confidence: label.Confidence / 100})
+	}
+	return labels, nil
+}
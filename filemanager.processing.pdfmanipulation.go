@@ -1,18 +1,45 @@
 package filemanager
 
 import (
-	"bytes"
 	"fmt"
+	"maps"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"time"
+	"unicode"
+)
 
-	"github.com/unidoc/unipdf/v3/model"
-	"github.com/unidoc/unipdf/v3/model/optimize"
+const (
+	PDF_SPLIT_BY_PAGE    = "page"
+	PDF_SPLIT_BY_CHAPTER = "chapter"
+	// DEFAULT_PDF_SPLIT_FILE_NAME names the parts of a split, see splitPDF for the variables.
+	DEFAULT_PDF_SPLIT_FILE_NAME         = "{name}_{from}-{to}.pdf"
+	DEFAULT_PDF_SPLIT_PAGE_FILE_NAME    = "{name}_page_{page}.pdf"
+	DEFAULT_PDF_SPLIT_CHAPTER_FILE_NAME = "{name}_{index}_{chapter}.pdf"
 )
 
-type PDFManipulationPlugin struct{}
+// PDFManipulationPlugin extracts, merges, compresses, reorders, splits, watermarks and signs PDFs and verifies their
+// signatures, selected by the manipulation_type param.
+type PDFManipulationPlugin struct {
+	// Engine is the PDF library doing the work, defaults to UniPDFEngine. See NewPDFEngine for engines by name.
+	Engine PDFEngine
+	// Certificates are the certificates of the sign manipulation by name, selected by its certificate param.
+	Certificates map[string]*PDFCertificate
+	// TimestampURL is the RFC 3161 timestamp authority of signatures, unless the timestamp_url param overrides it.
+	TimestampURL string
+}
+
+func (p *PDFManipulationPlugin) engine() PDFEngine {
+	if p.Engine != nil {
+		return p.Engine
+	}
+	return UniPDFEngine{}
+}
 
 func (p *PDFManipulationPlugin) Process(files []*ManagedFile, fileProcess *FileProcess) ([]*ManagedFile, error) {
 	var processedFiles []*ManagedFile
+	engine := p.engine()
 
 	for _, file := range files {
 		if !isPDFFile(file) {
@@ -26,39 +53,58 @@ func (p *PDFManipulationPlugin) Process(files []*ManagedFile, fileProcess *FileP
 			StatusDescription: fmt.Sprintf("Manipulating PDF: %s", file.FileName),
 		}
 		fileProcess.AddProcessingUpdate(status)
-		reader := bytes.NewReader(file.Content)
-		pdfReader, err := model.NewPdfReader(reader)
-		if err != nil {
-			return nil, fmt.Errorf("failed to read PDF: %v", err)
-		}
 
 		manipulationType := file.MetaData["manipulation_type"].(string)
 
 		switch manipulationType {
 		case "extract":
-			extractedFile, err := extractPages(pdfReader, file.MetaData)
+			extractedFile, err := extractPages(engine, file)
 			if err != nil {
 				return nil, err
 			}
 			processedFiles = append(processedFiles, extractedFile)
 		case "merge":
-			mergedFile, err := mergePDFs(pdfReader, files, file.MetaData)
+			mergedFile, err := mergePDFs(engine, file, files)
 			if err != nil {
 				return nil, err
 			}
 			processedFiles = append(processedFiles, mergedFile)
 		case "compress":
-			compressedFile, err := compressPDF(pdfReader, file.MetaData)
+			compressedFile, err := compressPDF(engine, file)
 			if err != nil {
 				return nil, err
 			}
 			processedFiles = append(processedFiles, compressedFile)
 		case "reorder":
-			reorderedFile, err := reorderPages(pdfReader, file.MetaData)
+			reorderedFile, err := reorderPages(engine, file)
 			if err != nil {
 				return nil, err
 			}
 			processedFiles = append(processedFiles, reorderedFile)
+		case "split":
+			parts, err := splitPDF(engine, file)
+			if err != nil {
+				return nil, err
+			}
+			processedFiles = append(processedFiles, parts...)
+		case "watermark":
+			watermarkedFile, err := watermarkPDF(engine, file)
+			if err != nil {
+				return nil, err
+			}
+			processedFiles = append(processedFiles, watermarkedFile)
+		case "sign":
+			signedFile, err := p.signPDF(engine, file)
+			if err != nil {
+				return nil, err
+			}
+			processedFiles = append(processedFiles, signedFile)
+		case "verify_signatures":
+			err := verifyPDFSignatures(engine, file)
+			if err != nil {
+				return nil, err
+			}
+			processedFiles = append(processedFiles, file)
 		default:
 			return nil, fmt.Errorf("unsupported manipulation type: %s", manipulationType)
 		}
@@ -67,123 +113,47 @@ func (p *PDFManipulationPlugin) Process(files []*ManagedFile, fileProcess *FileP
 	return processedFiles, nil
 }
 
-// func isPDFFile(file *ManagedFile) bool {
-// 	return file.MimeType == "application/pdf"
-// }
-
-func extractPages(pdfReader *model.PdfReader, metaData map[string]interface{}) (*ManagedFile, error) {
-	startPage := int(metaData["start_page"].(float64))
-	endPage := int(metaData["end_page"].(float64))
+func extractPages(engine PDFEngine, file *ManagedFile) (*ManagedFile, error) {
+	startPage := int(file.MetaData["start_page"].(float64))
+	endPage := int(file.MetaData["end_page"].(float64))
 
-	numberOfPages, err := pdfReader.GetNumPages()
+	numberOfPages, err := engine.PageCount(file.Content)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get number of pages: %v", err)
+		return nil, err
 	}
 	if startPage < 1 || endPage > numberOfPages || startPage > endPage {
 		return nil, fmt.Errorf("invalid page range: start=%d, end=%d", startPage, endPage)
 	}
 
-	pdfWriter := model.NewPdfWriter()
-
+	var pages []int
 	for i := startPage; i <= endPage; i++ {
-		page, err := pdfReader.GetPage(i)
-		if err != nil {
-			return nil, fmt.Errorf("failed to get page %d: %v", i, err)
-		}
-
-		err = pdfWriter.AddPage(page)
-		if err != nil {
-			return nil, fmt.Errorf("failed to add page %d to writer: %v", i, err)
-		}
+		pages = append(pages, i)
 	}
-
-	var buf bytes.Buffer
-	err = pdfWriter.Write(&buf)
+	content, err := engine.ExtractPages(file.Content, pages)
 	if err != nil {
-		return nil, fmt.Errorf("failed to write PDF: %v", err)
+		return nil, err
 	}
-
-	extractedFile := &ManagedFile{
-		FileName:         fmt.Sprintf("extracted_%d-%d.pdf", startPage, endPage),
-		Content:          buf.Bytes(),
-		MimeType:         "application/pdf",
-		FileSize:         int64(buf.Len()),
-		MetaData:         metaData,
-		ProcessingErrors: []string{},
-	}
-
-	return extractedFile, nil
+	return newManipulatedPDF(fmt.Sprintf("extracted_%d-%d.pdf", startPage, endPage), content, file.MetaData), nil
 }
 
-func mergePDFs(pdfReader *model.PdfReader, files []*ManagedFile, metaData map[string]interface{}) (*ManagedFile, error) {
-	mergeFileNames := metaData["merge_files"].([]interface{})
-
-	pdfWriter := model.NewPdfWriter()
-
-	// Add pages from the base PDF
-	numPages, err := pdfReader.GetNumPages()
-	if err != nil {
-		return nil, fmt.Errorf("failed to get number of pages: %v", err)
-	}
-
-	for i := 1; i <= numPages; i++ {
-		page, err := pdfReader.GetPage(i)
-		if err != nil {
-			return nil, fmt.Errorf("failed to get page %d: %v", i, err)
-		}
-
-		err = pdfWriter.AddPage(page)
-		if err != nil {
-			return nil, fmt.Errorf("failed to add page %d to writer: %v", i, err)
-		}
-	}
+func mergePDFs(engine PDFEngine, file *ManagedFile, files []*ManagedFile) (*ManagedFile, error) {
+	mergeFileNames := file.MetaData["merge_files"].([]interface{})
 
-	// Merge pages from the specified files
+	// the base PDF first, then the specified files
+	contents := [][]byte{file.Content}
 	for _, fileName := range mergeFileNames {
 		mergeFile := findFileByName(files, fileName.(string))
 		if mergeFile == nil {
 			return nil, fmt.Errorf("merge file not found: %s", fileName)
 		}
-
-		mergeReader, err := model.NewPdfReader(bytes.NewReader(mergeFile.Content))
-		if err != nil {
-			return nil, fmt.Errorf("failed to read merge file: %v", err)
-		}
-
-		numPages, err := mergeReader.GetNumPages()
-		if err != nil {
-			return nil, fmt.Errorf("failed to get number of pages in merge file: %v", err)
-		}
-
-		for i := 1; i <= numPages; i++ {
-			page, err := mergeReader.GetPage(i)
-			if err != nil {
-				return nil, fmt.Errorf("failed to get page %d from merge file: %v", i, err)
-			}
-
-			err = pdfWriter.AddPage(page)
-			if err != nil {
-				return nil, fmt.Errorf("failed to add page %d from merge file to writer: %v", i, err)
-			}
-		}
+		contents = append(contents, mergeFile.Content)
 	}
 
-	var buf bytes.Buffer
-	err = pdfWriter.Write(&buf)
+	content, err := engine.Merge(contents)
 	if err != nil {
-		return nil, fmt.Errorf("failed to write merged PDF: %v", err)
-	}
-
-	mergedFile := &ManagedFile{
-		FileName:         "merged.pdf",
-		Content:          buf.Bytes(),
-		MimeType:         "application/pdf",
-		FileSize:         int64(buf.Len()),
-		MetaData:         metaData,
-		ProcessingErrors: []string{},
+		return nil, fmt.Errorf("failed to merge PDFs: %w", err)
 	}
-
-	return mergedFile, nil
+	return newManipulatedPDF("merged.pdf", content, file.MetaData), nil
 }
 
 func findFileByName(files []*ManagedFile, fileName string) *ManagedFile {
@@ -195,135 +165,177 @@ func findFileByName(files []*ManagedFile, fileName string) *ManagedFile {
 	return nil
 }
 
-func compressPDF(pdfReader *model.PdfReader, metaData map[string]interface{}) (*ManagedFile, error) {
-	compressionLevel := metaData["compression_level"].(string)
-
-	// Create a new PDF writer
-	pdfWriter := model.NewPdfWriter()
+func compressPDF(engine PDFEngine, file *ManagedFile) (*ManagedFile, error) {
+	compressionLevel := file.MetaData["compression_level"].(string)
 
-	// Set the compression level based on the provided metadata
-	switch compressionLevel {
-	case "low":
-		pdfWriter.SetOptimizer(optimize.New(optimize.Options{
-			CombineDuplicateDirectObjects:   true,
-			CombineIdenticalIndirectObjects: true,
-			CombineDuplicateStreams:         true,
-			CompressStreams:                 true,
-			UseObjectStreams:                true,
-			ImageQuality:                    90,
-			ImageUpperPPI:                   150,
-		}))
-	case "medium":
-		pdfWriter.SetOptimizer(optimize.New(optimize.Options{
-			CombineDuplicateDirectObjects:   true,
-			CombineIdenticalIndirectObjects: true,
-			CombineDuplicateStreams:         true,
-			CompressStreams:                 true,
-			UseObjectStreams:                true,
-			ImageQuality:                    80,
-			ImageUpperPPI:                   100,
-		}))
-	case "high":
-		pdfWriter.SetOptimizer(optimize.New(optimize.Options{
-			CombineDuplicateDirectObjects:   true,
-			CombineIdenticalIndirectObjects: true,
-			CombineDuplicateStreams:         true,
-			CompressStreams:                 true,
-			UseObjectStreams:                true,
-			ImageQuality:                    70,
-			ImageUpperPPI:                   50,
-		}))
-	default:
-		return nil, fmt.Errorf("invalid compression level: %s", compressionLevel)
+	content, err := engine.Compress(file.Content, compressionLevel)
+	if err != nil {
+		return nil, err
 	}
+	return newManipulatedPDF("compressed.pdf", content, file.MetaData), nil
+}
+
+func reorderPages(engine PDFEngine, file *ManagedFile) (*ManagedFile, error) {
+	pageOrder := file.MetaData["page_order"].([]interface{})
 
-	// Add pages from the original PDF to the writer
-	numPages, err := pdfReader.GetNumPages()
+	numPages, err := engine.PageCount(file.Content)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get number of pages: %v", err)
+		return nil, err
 	}
 
-	for i := 1; i <= numPages; i++ {
-		page, err := pdfReader.GetPage(i)
-		if err != nil {
-			return nil, fmt.Errorf("failed to get page %d: %v", i, err)
-		}
-
-		err = pdfWriter.AddPage(page)
-		if err != nil {
-			return nil, fmt.Errorf("failed to add page %d to writer: %v", i, err)
+	var pages []int
+	for _, pageNum := range pageOrder {
+		pageNumber := int(pageNum.(float64))
+		if pageNumber < 1 || pageNumber > numPages {
+			return nil, fmt.Errorf("invalid page number: %d", pageNumber)
 		}
+		pages = append(pages, pageNumber)
 	}
 
-	// Write the compressed PDF to a buffer
-	var buf bytes.Buffer
-	err = pdfWriter.Write(&buf)
+	content, err := engine.ExtractPages(file.Content, pages)
 	if err != nil {
-		return nil, fmt.Errorf("failed to write compressed PDF: %v", err)
-	}
-
-	compressedFile := &ManagedFile{
-		FileName:         "compressed.pdf",
-		Content:          buf.Bytes(),
-		MimeType:         "application/pdf",
-		FileSize:         int64(buf.Len()),
-		MetaData:         metaData,
-		ProcessingErrors: []string{},
+		return nil, err
 	}
-
-	return compressedFile, nil
+	return newManipulatedPDF("reordered.pdf", content, file.MetaData), nil
 }
 
-func reorderPages(pdfReader *model.PdfReader, metaData map[string]interface{}) (*ManagedFile, error) {
-	pageOrder := metaData["page_order"].([]interface{})
-
-	numPages, err := pdfReader.GetNumPages()
-	if err != nil {
-		return nil, fmt.Errorf("failed to get number of pages: %v", err)
+// splitPDF splits the PDF into one file per page, per pages_per_file pages or, with split_by "chapter", per
+// top-level bookmark. Parts are named by the split_file_name param, in which {name} is the file name without
+// extension, {index} the 1-based number of the part, {from} and {to} its first and last page, {page} its first page
+// and {chapter} the bookmark title. Every part has the page range in its page_from and page_to metadata, chapters
+// their title in chapter.
+func splitPDF(engine PDFEngine, file *ManagedFile) ([]*ManagedFile, error) {
+	splitBy := PDF_SPLIT_BY_PAGE
+	if val, ok := file.MetaData["split_by"]; ok {
+		splitBy, ok = val.(string)
+		if !ok {
+			return nil, invalidParamError("split_by", val)
+		}
 	}
+	span := 1
+	if val, ok := file.MetaData["pages_per_file"]; ok {
+		spanFloat, ok := val.(float64)
+		if !ok || spanFloat < 1 {
+			return nil, invalidParamError("pages_per_file", val)
+		}
+		span = int(spanFloat)
+	}
+	fileNameTemplate, _ := file.MetaData["split_file_name"].(string)
 
-	// Create a map to store the original page number and its corresponding page object
-	pageMap := make(map[int]model.PdfPage)
-	for i := 1; i <= numPages; i++ {
-		page, err := pdfReader.GetPage(i)
+	var chapters []PDFChapter
+	var contents [][]byte
+	switch splitBy {
+	case PDF_SPLIT_BY_PAGE:
+		numPages, err := engine.PageCount(file.Content)
 		if err != nil {
-			return nil, fmt.Errorf("failed to get page %d: %v", i, err)
+			return nil, err
+		}
+		for _, pages := range splitPageRanges(numPages, span) {
+			chapters = append(chapters, PDFChapter{FirstPage: pages[0], LastPage: pages[len(pages)-1]})
 		}
-		pageMap[i] = *page
+		contents, err = engine.Split(file.Content, span)
+		if err != nil {
+			return nil, fmt.Errorf("failed to split PDF: %w", err)
+		}
+		if len(contents) != len(chapters) {
+			return nil, fmt.Errorf("failed to split PDF: %d parts of %d pages", len(contents), numPages)
+		}
+		if fileNameTemplate == "" {
+			fileNameTemplate = DEFAULT_PDF_SPLIT_FILE_NAME
+			if span == 1 {
+				fileNameTemplate = DEFAULT_PDF_SPLIT_PAGE_FILE_NAME
+			}
+		}
+	case PDF_SPLIT_BY_CHAPTER:
+		var err error
+		chapters, err = engine.Chapters(file.Content)
+		if err != nil {
+			return nil, err
+		}
+		if len(chapters) == 0 {
+			return nil, fmt.Errorf("cannot split PDF by chapter: %s has no bookmarks", file.FileName)
+		}
+		for _, chapter := range chapters {
+			var pages []int
+			for page := chapter.FirstPage; page <= chapter.LastPage; page++ {
+				pages = append(pages, page)
+			}
+			content, err := engine.ExtractPages(file.Content, pages)
+			if err != nil {
+				return nil, err
+			}
+			contents = append(contents, content)
+		}
+		if fileNameTemplate == "" {
+			fileNameTemplate = DEFAULT_PDF_SPLIT_CHAPTER_FILE_NAME
+		}
+	default:
+		return nil, invalidParamError("split_by", splitBy)
 	}
 
-	// Create a new PDF writer
-	pdfWriter := model.NewPdfWriter()
-
-	// Add pages to the writer in the specified order
-	for _, pageNum := range pageOrder {
-		pageNumber := int(pageNum.(float64))
-		page, ok := pageMap[pageNumber]
-		if !ok {
-			return nil, fmt.Errorf("invalid page number: %d", pageNumber)
+	name := strings.TrimSuffix(file.FileName, filepath.Ext(file.FileName))
+	parts := make([]*ManagedFile, len(contents))
+	for i, content := range contents {
+		chapter := chapters[i]
+		fileName := strings.NewReplacer(
+			"{name}", name,
+			"{index}", strconv.Itoa(i+1),
+			"{from}", strconv.Itoa(chapter.FirstPage),
+			"{to}", strconv.Itoa(chapter.LastPage),
+			"{page}", strconv.Itoa(chapter.FirstPage),
+			"{chapter}", fileNameOfTitle(chapter.Title),
+		).Replace(fileNameTemplate)
+		metaData := maps.Clone(file.MetaData)
+		if metaData == nil {
+			metaData = make(map[string]interface{})
+		}
+		metaData["page_from"] = chapter.FirstPage
+		metaData["page_to"] = chapter.LastPage
+		if splitBy == PDF_SPLIT_BY_CHAPTER {
+			metaData["chapter"] = chapter.Title
 		}
+		parts[i] = newManipulatedPDF(fileName, content, metaData)
+	}
+	return parts, nil
+}
 
-		err = pdfWriter.AddPage(&page)
-		if err != nil {
-			return nil, fmt.Errorf("failed to add page %d to writer: %v", pageNumber, err)
+// fileNameOfTitle makes a bookmark title usable in a file name, keeping letters and digits and replacing runs of
+// anything else with a single dash.
+func fileNameOfTitle(title string) string {
+	var name strings.Builder
+	dash := false
+	for _, r := range title {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			name.WriteRune(r)
+			dash = false
+		} else if !dash && name.Len() > 0 {
+			name.WriteByte('-')
+			dash = true
 		}
 	}
+	return strings.TrimSuffix(name.String(), "-")
+}
 
-	// Write the reordered PDF to a buffer
-	var buf bytes.Buffer
-	err = pdfWriter.Write(&buf)
+func watermarkPDF(engine PDFEngine, file *ManagedFile) (*ManagedFile, error) {
+	text, ok := file.MetaData["watermark_text"].(string)
+	if !ok || text == "" {
+		return nil, &ValidationError{Field: "watermark_text", Err: ErrMissingParam}
+	}
+
+	content, err := engine.Watermark(file.Content, text)
 	if err != nil {
-		return nil, fmt.Errorf("failed to write reordered PDF: %v", err)
+		return nil, err
 	}
+	return newManipulatedPDF(file.FileName, content, file.MetaData), nil
+}
 
-	reorderedFile := &ManagedFile{
-		FileName:         "reordered.pdf",
-		Content:          buf.Bytes(),
+func newManipulatedPDF(fileName string, content []byte, metaData map[string]interface{}) *ManagedFile {
+	return &ManagedFile{
+		FileName:         fileName,
+		Content:          content,
 		MimeType:         "application/pdf",
-		FileSize:         int64(buf.Len()),
+		FileSize:         int64(len(content)),
 		MetaData:         metaData,
 		ProcessingErrors: []string{},
 	}
-
-	return reorderedFile, nil
 }
@@ -2,16 +2,39 @@ package filemanager
 
 import (
 	"bytes"
+	"cmp"
+	"encoding/json"
 	"fmt"
+	"math"
+	"runtime"
+	"slices"
 	"strings"
+	"sync"
 	"time"
+	"unicode/utf8"
 
 	md "github.com/JohannesKaufmann/html-to-markdown"
 	"github.com/unidoc/unipdf/v3/extractor"
 	"github.com/unidoc/unipdf/v3/model"
 )
 
-type PDFTextExtractorPlugin struct{}
+// DEFAULT_PDF_EXTRACT_WORKERS caps the default number of pages the PDFTextExtractorPlugin extracts concurrently.
+const DEFAULT_PDF_EXTRACT_WORKERS = 8
+
+// PDFTextExtractorPlugin extracts the text of PDFs as plain text or Markdown. Pages are extracted concurrently and
+// joined in page order, with a progress update per page.
+type PDFTextExtractorPlugin struct {
+	// Workers is the number of pages extracted at the same time, defaults to the number of CPUs up to
+	// DEFAULT_PDF_EXTRACT_WORKERS. 1 extracts one page after the other.
+	Workers int
+}
+
+func (p *PDFTextExtractorPlugin) workers() int {
+	if p.Workers > 0 {
+		return p.Workers
+	}
+	return min(runtime.NumCPU(), DEFAULT_PDF_EXTRACT_WORKERS)
+}
 
 func (p *PDFTextExtractorPlugin) Process(files []*ManagedFile, fileProcess *FileProcess) ([]*ManagedFile, error) {
 	var processedFiles []*ManagedFile
@@ -29,64 +52,320 @@ func (p *PDFTextExtractorPlugin) Process(files []*ManagedFile, fileProcess *File
 		}
 		fileProcess.AddProcessingUpdate(status)
 
-		reader := bytes.NewReader(file.Content)
-		pdfReader, err := model.NewPdfReader(reader)
+		outputFormatName, _ := file.MetaData["output_format"].(string)
+		outputFormat, ok := pdfTextOutputFormats[outputFormatName]
+		if !ok {
+			return nil, fmt.Errorf("unsupported output format: %v", file.MetaData["output_format"])
+		}
+		fileName := file.FileName
+		pages, err := extractPDFPageTexts(file.Content, p.workers(), outputFormat.words, func(done int, total int) {
+			fileProcess.AddStepProgress("PDFTextExtractor", fmt.Sprintf("Extracted page %d of %d: %s", done, total, fileName), done*100/total)
+		})
 		if err != nil {
-			return nil, fmt.Errorf("failed to read PDF: %v", err)
+			return nil, err
 		}
 
-		numPages, err := pdfReader.GetNumPages()
+		outputContent, err := renderExtractedText(pages, outputFormat.name)
 		if err != nil {
-			return nil, fmt.Errorf("failed to get number of pages: %v", err)
+			return nil, err
 		}
 
-		var extractedText []string
+		file.Content = outputContent
+		file.FileSize = int64(len(outputContent))
+		file.MimeType = outputFormat.mimeType
+		file.FileName = fmt.Sprintf("%s.%s", strings.TrimSuffix(file.FileName, ".pdf"), outputFormat.extension)
+
+		processedFiles = append(processedFiles, file)
+	}
+
+	return processedFiles, nil
+}
+
+// ConvertsTo reports that PDFs can be converted to txt, md and json.
+func (p *PDFTextExtractorPlugin) ConvertsTo(mimeType string, format string) bool {
+	return mimeType == "application/pdf" && (format == "txt" || format == "md" || format == "json")
+}
+
+// ConvertFormat extracts the text of a PDF as plain text (txt), Markdown (md) or per-page JSON (json).
+func (p *PDFTextExtractorPlugin) ConvertFormat(file *ManagedFile, format string) (*ManagedFile, error) {
+	outputFormat, ok := pdfTextOutputFormats[format]
+	if !ok {
+		return nil, fmt.Errorf("unsupported output format: %s", format)
+	}
+	pages, err := extractPDFPageTexts(file.Content, p.workers(), outputFormat.words, nil)
+	if err != nil {
+		return nil, err
+	}
+	content, err := renderExtractedText(pages, outputFormat.name)
+	if err != nil {
+		return nil, err
+	}
+	return convertedCopy(file, content, format), nil
+}
+
+const (
+	PDF_TEXT_FORMAT_TEXT     = "text"
+	PDF_TEXT_FORMAT_MARKDOWN = "markdown"
+	PDF_TEXT_FORMAT_JSON     = "json"
+	PDF_TEXT_FORMAT_LAYOUT   = "layout"
+)
+
+type pdfTextOutputFormat struct {
+	name      string
+	extension string
+	mimeType  string
+	words     bool // needs the word boxes of the pages
+}
+
+// pdfTextOutputFormats are the values of the output_format param, the file extensions being accepted as well.
+var pdfTextOutputFormats = map[string]pdfTextOutputFormat{
+	PDF_TEXT_FORMAT_TEXT:     {name: PDF_TEXT_FORMAT_TEXT, extension: "txt", mimeType: "text/plain"},
+	"txt":                    {name: PDF_TEXT_FORMAT_TEXT, extension: "txt", mimeType: "text/plain"},
+	PDF_TEXT_FORMAT_MARKDOWN: {name: PDF_TEXT_FORMAT_MARKDOWN, extension: "md", mimeType: "text/markdown"},
+	"md":                     {name: PDF_TEXT_FORMAT_MARKDOWN, extension: "md", mimeType: "text/markdown"},
+	PDF_TEXT_FORMAT_JSON:     {name: PDF_TEXT_FORMAT_JSON, extension: "json", mimeType: "application/json", words: true},
+	PDF_TEXT_FORMAT_LAYOUT:   {name: PDF_TEXT_FORMAT_LAYOUT, extension: "txt", mimeType: "text/plain", words: true},
+}
 
+// PDFPageText is the text of a page, as written by the json output format of the PDFTextExtractorPlugin.
+type PDFPageText struct {
+	Page  int       `json:"page"`
+	Text  string    `json:"text"`
+	Words []PDFWord `json:"words"`
+}
+
+// PDFWord is a word of a page and its bounding box in PDF points, with the origin at the bottom left of the page.
+type PDFWord struct {
+	Text string  `json:"text"`
+	X0   float64 `json:"x0"`
+	Y0   float64 `json:"y0"`
+	X1   float64 `json:"x1"`
+	Y1   float64 `json:"y1"`
+}
+
+// extractPDFPageTexts returns the text of every page of the PDF, with its words if withWords is set, extracting up
+// to workers pages at the same time. Every worker reads the PDF with its own reader, as readers resolve objects
+// lazily and are not safe for concurrent use. progress, if set, is called after each page with the number of pages
+// done.
+func extractPDFPageTexts(content []byte, workers int, withWords bool, progress func(done int, total int)) ([]PDFPageText, error) {
+	pdfReader, err := model.NewPdfReader(bytes.NewReader(content))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read PDF: %v", err)
+	}
+
+	numPages, err := pdfReader.GetNumPages()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get number of pages: %v", err)
+	}
+	workers = min(workers, numPages)
+	extractedText := make([]PDFPageText, numPages)
+	if workers <= 1 {
 		for i := 0; i < numPages; i++ {
-			page, err := pdfReader.GetPage(i + 1)
+			extractedText[i], err = extractPDFPageText(pdfReader, i+1, withWords)
 			if err != nil {
-				return nil, fmt.Errorf("failed to get page %d: %v", i+1, err)
+				return nil, err
 			}
-
-			ex, err := extractor.New(page)
-			if err != nil {
-				return nil, fmt.Errorf("failed to create extractor: %v", err)
+			if progress != nil {
+				progress(i+1, numPages)
 			}
+		}
+		return extractedText, nil
+	}
 
-			text, err := ex.ExtractText()
-			if err != nil {
-				return nil, fmt.Errorf("failed to extract text: %v", err)
+	pages := make(chan int)
+	var mu sync.Mutex
+	var firstErr error
+	done := 0
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// the first worker reuses the reader of the page count
+			reader, readerErr := pdfReader, error(nil)
+			if w > 0 {
+				reader, readerErr = model.NewPdfReader(bytes.NewReader(content))
 			}
-
-			extractedText = append(extractedText, text)
+			for pageNum := range pages {
+				var text PDFPageText
+				pageErr := readerErr
+				if pageErr != nil {
+					pageErr = fmt.Errorf("failed to read PDF: %v", pageErr)
+				} else {
+					text, pageErr = extractPDFPageText(reader, pageNum, withWords)
+				}
+				mu.Lock()
+				if pageErr != nil {
+					if firstErr == nil {
+						firstErr = pageErr
+					}
+				} else {
+					extractedText[pageNum-1] = text
+					done++
+					if progress != nil {
+						progress(done, numPages)
+					}
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for pageNum := 1; pageNum <= numPages; pageNum++ {
+		mu.Lock()
+		failed := firstErr != nil
+		mu.Unlock()
+		if failed {
+			break
 		}
+		pages <- pageNum
+	}
+	close(pages)
+	wg.Wait()
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	return extractedText, nil
+}
 
-		outputFormat := file.MetaData["output_format"].(string)
+func extractPDFPageText(pdfReader *model.PdfReader, pageNum int, withWords bool) (PDFPageText, error) {
+	pageText := PDFPageText{Page: pageNum}
+	page, err := pdfReader.GetPage(pageNum)
+	if err != nil {
+		return pageText, fmt.Errorf("failed to get page %d: %v", pageNum, err)
+	}
+	ex, err := extractor.New(page)
+	if err != nil {
+		return pageText, fmt.Errorf("failed to create extractor: %v", err)
+	}
+	text, _, _, err := ex.ExtractPageText()
+	if err != nil {
+		return pageText, fmt.Errorf("failed to extract text: %v", err)
+	}
+	pageText.Text = text.Text()
+	if withWords {
+		pageText.Words = wordsOfTextMarks(text.Marks().Elements())
+	}
+	return pageText, nil
+}
 
-		var outputContent []byte
-		switch outputFormat {
-		case "text":
-			outputContent = []byte(strings.Join(extractedText, "\n"))
-		case "markdown":
-			html := convertToHTML(extractedText)
-			converter := md.NewConverter("", true, nil)
-			markdown, err := converter.ConvertString(html)
-			if err != nil {
-				return nil, fmt.Errorf("failed to convert HTML to Markdown: %v", err)
-			}
-			outputContent = []byte(markdown)
-		default:
-			return nil, fmt.Errorf("unsupported output format: %s", outputFormat)
+// wordsOfTextMarks joins the marks (usually characters) between whitespace into words, their boxes into the box of
+// the word.
+func wordsOfTextMarks(marks []extractor.TextMark) []PDFWord {
+	words := []PDFWord{}
+	var word *PDFWord
+	for _, mark := range marks {
+		if strings.TrimSpace(mark.Text) == "" {
+			word = nil
+			continue
+		}
+		box := mark.BBox
+		if word == nil {
+			words = append(words, PDFWord{X0: box.Llx, Y0: box.Lly, X1: box.Urx, Y1: box.Ury})
+			word = &words[len(words)-1]
 		}
+		word.Text += mark.Text
+		word.X0 = math.Min(word.X0, box.Llx)
+		word.Y0 = math.Min(word.Y0, box.Lly)
+		word.X1 = math.Max(word.X1, box.Urx)
+		word.Y1 = math.Max(word.Y1, box.Ury)
+	}
+	return words
+}
 
-		file.Content = outputContent
-		file.MimeType = "text/plain"
-		file.FileName = fmt.Sprintf("%s.%s", strings.TrimSuffix(file.FileName, ".pdf"), outputFormat)
+// renderExtractedText renders the page texts as "text", "markdown", "json" or "layout".
+func renderExtractedText(pages []PDFPageText, outputFormat string) ([]byte, error) {
+	texts := make([]string, len(pages))
+	for i, page := range pages {
+		texts[i] = page.Text
+	}
+	switch outputFormat {
+	case PDF_TEXT_FORMAT_TEXT:
+		return []byte(strings.Join(texts, "\n")), nil
+	case PDF_TEXT_FORMAT_MARKDOWN:
+		html := convertToHTML(texts)
+		converter := md.NewConverter("", true, nil)
+		markdown, err := converter.ConvertString(html)
+		if err != nil {
+			return nil, fmt.Errorf("failed to convert HTML to Markdown: %v", err)
+		}
+		return []byte(markdown), nil
+	case PDF_TEXT_FORMAT_JSON:
+		return json.Marshal(pages)
+	case PDF_TEXT_FORMAT_LAYOUT:
+		layouts := make([]string, len(pages))
+		for i, page := range pages {
+			layouts[i] = layoutOfWords(page.Words)
+		}
+		// pages are separated by form feeds, like pdftotext -layout does
+		return []byte(strings.Join(layouts, "\f")), nil
+	default:
+		return nil, fmt.Errorf("unsupported output format: %s", outputFormat)
+	}
+}
 
-		processedFiles = append(processedFiles, file)
+// layoutOfWords renders the words of a page as monospaced text that keeps their positions: words are grouped into
+// lines by their vertical center, top to bottom, and indented by their distance from the leftmost word measured in
+// average character widths.
+func layoutOfWords(words []PDFWord) string {
+	if len(words) == 0 {
+		return ""
+	}
+	var width, height float64
+	runes := 0
+	left := words[0].X0
+	for _, word := range words {
+		left = math.Min(left, word.X0)
+		width += word.X1 - word.X0
+		height += word.Y1 - word.Y0
+		runes += utf8.RuneCountInString(word.Text)
+	}
+	charWidth := width / float64(runes)
+	lineHeight := height / float64(len(words))
+	if charWidth <= 0 || lineHeight <= 0 {
+		texts := make([]string, len(words))
+		for i, word := range words {
+			texts[i] = word.Text
+		}
+		return strings.Join(texts, " ")
 	}
 
-	return processedFiles, nil
+	sorted := slices.Clone(words)
+	slices.SortStableFunc(sorted, func(a, b PDFWord) int {
+		return cmp.Compare(b.Y0+b.Y1, a.Y0+a.Y1)
+	})
+	var lines [][]PDFWord
+	lineCenter := 0.0
+	for _, word := range sorted {
+		center := (word.Y0 + word.Y1) / 2
+		if len(lines) == 0 || lineCenter-center > lineHeight/2 {
+			lines = append(lines, nil)
+			lineCenter = center
+		}
+		lines[len(lines)-1] = append(lines[len(lines)-1], word)
+	}
+
+	var layout strings.Builder
+	for i, line := range lines {
+		if i > 0 {
+			layout.WriteByte('\n')
+		}
+		slices.SortStableFunc(line, func(a, b PDFWord) int { return cmp.Compare(a.X0, b.X0) })
+		column := 0
+		for j, word := range line {
+			indent := int(math.Round((word.X0 - left) / charWidth))
+			if j > 0 {
+				// keep words apart even if they overlap
+				indent = max(indent, column+1)
+			}
+			if indent > column {
+				layout.WriteString(strings.Repeat(" ", indent-column))
+				column = indent
+			}
+			layout.WriteString(word.Text)
+			column += utf8.RuneCountInString(word.Text)
+		}
+	}
+	return layout.String()
 }
 
 func isPDFFile(file *ManagedFile) bool {
@@ -0,0 +1,278 @@
+package filemanager
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"math"
+	"math/bits"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/disintegration/imaging"
+)
+
+var (
+	ErrNoPerceptualHash = errors.New("file has no perceptual hash")
+)
+
+const (
+	METADATA_KEY_PHASH = "phash"
+	METADATA_KEY_DHASH = "dhash"
+	phashSampleSize    = 32
+	phashLowFrequency  = 8
+)
+
+// PerceptualHashPlugin computes perceptual hashes (pHash and dHash) of images and stores them as 16 character hex
+// strings in MetaData["phash"] and MetaData["dhash"]. Near-duplicate images have hashes with a small Hamming distance.
+type PerceptualHashPlugin struct{}
+
+func (p *PerceptualHashPlugin) Process(files []*ManagedFile, fileProcess *FileProcess) ([]*ManagedFile, error) {
+	var processedFiles []*ManagedFile
+
+	for _, file := range files {
+		if !isImageFile(file) {
+			processedFiles = append(processedFiles, file)
+			continue
+		}
+		status := ProcessingStatus{
+			ProcessID:         fileProcess.ID,
+			TimeStamp:         int(time.Now().UnixNano() / int64(time.Millisecond)),
+			ProcessorName:     "PerceptualHash",
+			StatusDescription: fmt.Sprintf("Computing perceptual hashes of image: %s", file.FileName),
+		}
+		fileProcess.AddProcessingUpdate(status)
+
+		img, err := imaging.Decode(bytes.NewReader(file.Content))
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode image: %v", err)
+		}
+		file.SetMetaData(METADATA_KEY_PHASH, formatImageHash(PHash(img)))
+		file.SetMetaData(METADATA_KEY_DHASH, formatImageHash(DHash(img)))
+		processedFiles = append(processedFiles, file)
+	}
+
+	return processedFiles, nil
+}
+
+// DHash computes the 64 bit difference hash: the sign of the horizontal gradients of a 9x8 grayscale thumbnail.
+func DHash(img image.Image) uint64 {
+	small := imaging.Resize(imaging.Grayscale(img), 9, 8, imaging.Lanczos)
+	var hash uint64
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			hash <<= 1
+			if small.Pix[small.PixOffset(x, y)] < small.Pix[small.PixOffset(x+1, y)] {
+				hash |= 1
+			}
+		}
+	}
+	return hash
+}
+
+// PHash computes the 64 bit DCT based perceptual hash: the low frequencies of the DCT of a 32x32 grayscale
+// thumbnail compared against their median.
+func PHash(img image.Image) uint64 {
+	small := imaging.Resize(imaging.Grayscale(img), phashSampleSize, phashSampleSize, imaging.Lanczos)
+	pixels := make([][]float64, phashSampleSize)
+	for y := range pixels {
+		pixels[y] = make([]float64, phashSampleSize)
+		for x := range pixels[y] {
+			pixels[y][x] = float64(small.Pix[small.PixOffset(x, y)])
+		}
+	}
+	coefficients := dct2D(pixels)
+
+	lowFrequencies := make([]float64, 0, phashLowFrequency*phashLowFrequency)
+	for y := 0; y < phashLowFrequency; y++ {
+		for x := 0; x < phashLowFrequency; x++ {
+			lowFrequencies = append(lowFrequencies, coefficients[y][x])
+		}
+	}
+	// the DC coefficient only reflects the average brightness and is left out of the median
+	sorted := append([]float64(nil), lowFrequencies[1:]...)
+	sort.Float64s(sorted)
+	median := (sorted[len(sorted)/2-1] + sorted[len(sorted)/2]) / 2
+
+	var hash uint64
+	for _, coefficient := range lowFrequencies {
+		hash <<= 1
+		if coefficient > median {
+			hash |= 1
+		}
+	}
+	return hash
+}
+
+func dct2D(input [][]float64) [][]float64 {
+	size := len(input)
+	cosines := make([][]float64, size)
+	for u := range cosines {
+		cosines[u] = make([]float64, size)
+		for x := range cosines[u] {
+			cosines[u][x] = math.Cos(float64(2*x+1) * float64(u) * math.Pi / float64(2*size))
+		}
+	}
+	rows := make([][]float64, size)
+	for y := range input {
+		rows[y] = dct1D(input[y], cosines)
+	}
+	output := make([][]float64, size)
+	for y := range output {
+		output[y] = make([]float64, size)
+	}
+	column := make([]float64, size)
+	for x := 0; x < size; x++ {
+		for y := 0; y < size; y++ {
+			column[y] = rows[y][x]
+		}
+		transformed := dct1D(column, cosines)
+		for y := 0; y < size; y++ {
+			output[y][x] = transformed[y]
+		}
+	}
+	return output
+}
+
+func dct1D(input []float64, cosines [][]float64) []float64 {
+	output := make([]float64, len(input))
+	for u := range output {
+		sum := 0.0
+		for x, value := range input {
+			sum += value * cosines[u][x]
+		}
+		output[u] = sum
+	}
+	return output
+}
+
+// HammingDistance returns the number of differing bits of two image hashes.
+func HammingDistance(a, b uint64) int {
+	return bits.OnesCount64(a ^ b)
+}
+
+func formatImageHash(hash uint64) string {
+	return fmt.Sprintf("%016x", hash)
+}
+
+// ParseImageHash parses a hash as stored in MetaData by the PerceptualHashPlugin.
+func ParseImageHash(hash string) (uint64, error) {
+	return strconv.ParseUint(hash, 16, 64)
+}
+
+// SimilarImage is a stored image whose perceptual hash is within the requested distance.
+type SimilarImage struct {
+	LocalFilePath string `json:"localFilePath"`
+	Distance      int    `json:"distance"`
+}
+
+type imageHashRegistry struct {
+	mu     sync.RWMutex
+	hashes map[string]uint64 // local file path -> pHash
+}
+
+func (r *imageHashRegistry) set(localFilePath string, hash uint64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.hashes == nil {
+		r.hashes = make(map[string]uint64)
+	}
+	r.hashes[localFilePath] = hash
+}
+
+func (r *imageHashRegistry) remove(localFilePath string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.hashes, localFilePath)
+}
+
+func (r *imageHashRegistry) snapshot() map[string]uint64 {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	snapshot := make(map[string]uint64, len(r.hashes))
+	for path, hash := range r.hashes {
+		snapshot[path] = hash
+	}
+	return snapshot
+}
+
+// registerImageHash remembers the pHash of a stored file for FindSimilarImages.
+func (fm *FileManager) registerImageHash(file *ManagedFile) {
+	hash, err := imageHashOfMetaData(file.MetaData)
+	if err != nil {
+		return
+	}
+	fm.imageHashes.set(file.LocalFilePath, hash)
+}
+
+func imageHashOfMetaData(metaData map[string]any) (uint64, error) {
+	value, ok := metaData[METADATA_KEY_PHASH].(string)
+	if !ok {
+		return 0, ErrNoPerceptualHash
+	}
+	return ParseImageHash(value)
+}
+
+// FindSimilarImages returns stored images whose pHash is within threshold bits (Hamming distance) of the file,
+// closest first. Hashes come from stored outputs of the PerceptualHashPlugin and, if configured, the metadata store.
+// Files without a hash in their metadata are hashed on the fly.
+func (fm *FileManager) FindSimilarImages(file *ManagedFile, threshold int) ([]SimilarImage, error) {
+	hash, err := imageHashOfMetaData(file.MetaData)
+	if err != nil {
+		hash, err = computeImageHashOfFile(file)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	candidates := fm.imageHashes.snapshot()
+	if store := fm.getMetadataStore(); store != nil {
+		records, err := store.ListRecords()
+		if err == nil {
+			for _, record := range records {
+				recordHash, err := imageHashOfMetaData(record.MetaData)
+				if err == nil {
+					candidates[record.LocalFilePath] = recordHash
+				}
+			}
+		}
+	}
+
+	similar := []SimilarImage{}
+	for localFilePath, candidateHash := range candidates {
+		if localFilePath == file.LocalFilePath || !fm.ownsPath(localFilePath) {
+			continue
+		}
+		distance := HammingDistance(hash, candidateHash)
+		if distance <= threshold {
+			similar = append(similar, SimilarImage{LocalFilePath: localFilePath, Distance: distance})
+		}
+	}
+	sort.Slice(similar, func(i, j int) bool {
+		if similar[i].Distance == similar[j].Distance {
+			return similar[i].LocalFilePath < similar[j].LocalFilePath
+		}
+		return similar[i].Distance < similar[j].Distance
+	})
+	return similar, nil
+}
+
+func computeImageHashOfFile(file *ManagedFile) (uint64, error) {
+	content := file.Content
+	if len(content) == 0 {
+		var err error
+		content, err = os.ReadFile(file.LocalFilePath)
+		if err != nil {
+			return 0, err
+		}
+	}
+	img, err := imaging.Decode(bytes.NewReader(content))
+	if err != nil {
+		return 0, fmt.Errorf("failed to decode image: %v", err)
+	}
+	return PHash(img), nil
+}
@@ -0,0 +1,260 @@
+package filemanager
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"image"
+	"image/png"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/disintegration/imaging"
+)
+
+const (
+	METADATA_KEY_BLURHASH = "blurhash"
+	METADATA_KEY_LQIP     = "lqip"
+	PLACEHOLDER_BLURHASH  = "blurhash"
+	PLACEHOLDER_LQIP      = "lqip"
+	PLACEHOLDER_BOTH      = "both"
+	// DEFAULT_BLURHASH_COMPONENTS_X and DEFAULT_BLURHASH_COMPONENTS_Y are the components recommended by BlurHash.
+	DEFAULT_BLURHASH_COMPONENTS_X = 4
+	DEFAULT_BLURHASH_COMPONENTS_Y = 3
+	DEFAULT_LQIP_WIDTH            = 16
+	blurHashSampleSize            = 64
+	blurHashCharacters            = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz#$%*+,-.:;=?@[]^_{|}~"
+	lqipJPEGQuality               = 40
+)
+
+// PlaceholderPlugin computes placeholders frontends render while the full image loads: a BlurHash string in
+// MetaData["blurhash"] and a tiny base64 data URI image (LQIP) in MetaData["lqip"]. Both end up in every
+// ProcessingResultFile of the outputs. Run it as the last step, so the placeholders match the output images.
+//
+// Params: placeholder ("blurhash", "lqip" or "both"), blurhash_components_x and blurhash_components_y (1-9) and
+// lqip_width (pixels).
+type PlaceholderPlugin struct {
+	Placeholder string // "blurhash", "lqip" or "both" (default)
+	ComponentsX int    // BlurHash components along the x axis, defaults to DEFAULT_BLURHASH_COMPONENTS_X
+	ComponentsY int    // BlurHash components along the y axis, defaults to DEFAULT_BLURHASH_COMPONENTS_Y
+	LQIPWidth   int    // width of the LQIP in pixels, defaults to DEFAULT_LQIP_WIDTH
+}
+
+func (p *PlaceholderPlugin) Process(files []*ManagedFile, fileProcess *FileProcess) ([]*ManagedFile, error) {
+	var processedFiles []*ManagedFile
+
+	for _, file := range files {
+		if !isImageFile(file) {
+			processedFiles = append(processedFiles, file)
+			continue
+		}
+		status := ProcessingStatus{
+			ProcessID:         fileProcess.ID,
+			TimeStamp:         int(time.Now().UnixNano() / int64(time.Millisecond)),
+			ProcessorName:     "Placeholder",
+			StatusDescription: fmt.Sprintf("Computing placeholders of image: %s", file.FileName),
+		}
+		fileProcess.AddProcessingUpdate(status)
+
+		placeholder, componentsX, componentsY, lqipWidth, err := p.parseParams(file.MetaData)
+		if err != nil {
+			return nil, err
+		}
+		img, err := imaging.Decode(bytes.NewReader(file.Content), imaging.AutoOrientation(true))
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode image: %v", err)
+		}
+		if placeholder != PLACEHOLDER_LQIP {
+			hash, err := BlurHash(img, componentsX, componentsY)
+			if err != nil {
+				return nil, err
+			}
+			file.SetMetaData(METADATA_KEY_BLURHASH, hash)
+		}
+		if placeholder != PLACEHOLDER_BLURHASH {
+			lqip, err := LQIP(img, lqipWidth)
+			if err != nil {
+				return nil, err
+			}
+			file.SetMetaData(METADATA_KEY_LQIP, lqip)
+		}
+		processedFiles = append(processedFiles, file)
+	}
+
+	return processedFiles, nil
+}
+
+// DryRun implements DryRunPlugin: it checks the placeholder params.
+func (p *PlaceholderPlugin) DryRun(files []*ManagedFile) ([]*ManagedFile, error) {
+	for _, file := range files {
+		if !isImageFile(file) {
+			continue
+		}
+		_, _, _, _, err := p.parseParams(file.MetaData)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return files, nil
+}
+
+func (p *PlaceholderPlugin) parseParams(params map[string]any) (placeholder string, componentsX int, componentsY int, lqipWidth int, err error) {
+	placeholder = p.Placeholder
+	if placeholder == "" {
+		placeholder = PLACEHOLDER_BOTH
+	}
+	componentsX = p.ComponentsX
+	if componentsX == 0 {
+		componentsX = DEFAULT_BLURHASH_COMPONENTS_X
+	}
+	componentsY = p.ComponentsY
+	if componentsY == 0 {
+		componentsY = DEFAULT_BLURHASH_COMPONENTS_Y
+	}
+	lqipWidth = p.LQIPWidth
+	if lqipWidth == 0 {
+		lqipWidth = DEFAULT_LQIP_WIDTH
+	}
+	if val, ok := params["placeholder"]; ok {
+		placeholder, _ = val.(string)
+	}
+	switch placeholder {
+	case PLACEHOLDER_BLURHASH, PLACEHOLDER_LQIP, PLACEHOLDER_BOTH:
+	default:
+		return "", 0, 0, 0, invalidParamError("placeholder", placeholder)
+	}
+	for key, target := range map[string]*int{"blurhash_components_x": &componentsX, "blurhash_components_y": &componentsY, "lqip_width": &lqipWidth} {
+		if val, ok := params[key]; ok {
+			number, ok := val.(float64)
+			if !ok || number < 1 {
+				return "", 0, 0, 0, invalidParamError(key, val)
+			}
+			*target = int(number)
+		}
+	}
+	return placeholder, componentsX, componentsY, lqipWidth, nil
+}
+
+// BlurHash encodes the image as a BlurHash (https://blurha.sh) with componentsX * componentsY components (1-9
+// each). More components keep more detail at the cost of a longer string.
+func BlurHash(img image.Image, componentsX int, componentsY int) (string, error) {
+	if componentsX < 1 || componentsX > 9 || componentsY < 1 || componentsY > 9 {
+		return "", fmt.Errorf("blurhash components must be between 1 and 9: %dx%d", componentsX, componentsY)
+	}
+	// the hash only keeps the lowest frequencies, a small sample gives the same result much faster
+	sample := imaging.Fit(img, blurHashSampleSize, blurHashSampleSize, imaging.Box)
+	width, height := sample.Bounds().Dx(), sample.Bounds().Dy()
+	if width == 0 || height == 0 {
+		return "", fmt.Errorf("cannot compute blurhash of an empty image")
+	}
+	linear := make([][3]float64, width*height)
+	for i := range linear {
+		for c := 0; c < 3; c++ {
+			linear[i][c] = sRGBToLinear(sample.Pix[i*4+c])
+		}
+	}
+
+	factors := make([][3]float64, 0, componentsX*componentsY)
+	for j := 0; j < componentsY; j++ {
+		for i := 0; i < componentsX; i++ {
+			normalization := 2.0
+			if i == 0 && j == 0 {
+				normalization = 1
+			}
+			var factor [3]float64
+			for y := 0; y < height; y++ {
+				cosY := math.Cos(math.Pi * float64(j) * float64(y) / float64(height))
+				for x := 0; x < width; x++ {
+					basis := math.Cos(math.Pi*float64(i)*float64(x)/float64(width)) * cosY
+					pixel := linear[y*width+x]
+					for c := 0; c < 3; c++ {
+						factor[c] += basis * pixel[c]
+					}
+				}
+			}
+			scale := normalization / float64(width*height)
+			for c := 0; c < 3; c++ {
+				factor[c] *= scale
+			}
+			factors = append(factors, factor)
+		}
+	}
+
+	var hash strings.Builder
+	hash.WriteString(encodeBase83((componentsX-1)+(componentsY-1)*9, 1))
+	maximumValue := 1.0
+	if len(factors) > 1 {
+		actualMaximum := 0.0
+		for _, factor := range factors[1:] {
+			for c := 0; c < 3; c++ {
+				actualMaximum = math.Max(actualMaximum, math.Abs(factor[c]))
+			}
+		}
+		quantisedMaximum := int(math.Max(0, math.Min(82, math.Floor(actualMaximum*166-0.5))))
+		maximumValue = float64(quantisedMaximum+1) / 166
+		hash.WriteString(encodeBase83(quantisedMaximum, 1))
+	} else {
+		hash.WriteString(encodeBase83(0, 1))
+	}
+	dc := factors[0]
+	hash.WriteString(encodeBase83(linearToSRGB(dc[0])<<16+linearToSRGB(dc[1])<<8+linearToSRGB(dc[2]), 4))
+	for _, factor := range factors[1:] {
+		value := 0
+		for c := 0; c < 3; c++ {
+			quantised := math.Floor(signedPow(factor[c]/maximumValue, 0.5)*9 + 9.5)
+			value = value*19 + int(math.Max(0, math.Min(18, quantised)))
+		}
+		hash.WriteString(encodeBase83(value, 2))
+	}
+	return hash.String(), nil
+}
+
+func encodeBase83(value int, length int) string {
+	encoded := make([]byte, length)
+	for i := length - 1; i >= 0; i-- {
+		encoded[i] = blurHashCharacters[value%83]
+		value /= 83
+	}
+	return string(encoded)
+}
+
+func sRGBToLinear(value uint8) float64 {
+	v := float64(value) / 255
+	if v <= 0.04045 {
+		return v / 12.92
+	}
+	return math.Pow((v+0.055)/1.055, 2.4)
+}
+
+func linearToSRGB(value float64) int {
+	v := math.Max(0, math.Min(1, value))
+	if v <= 0.0031308 {
+		return int(v*12.92*255 + 0.5)
+	}
+	return int((1.055*math.Pow(v, 1/2.4)-0.055)*255 + 0.5)
+}
+
+func signedPow(value float64, exponent float64) float64 {
+	return math.Copysign(math.Pow(math.Abs(value), exponent), value)
+}
+
+// LQIP scales the image down to the width and returns it as a base64 data URI, usable directly as the src of an
+// <img> that the browser upscales with a blur. Opaque images are JPEG, images with transparency PNG.
+func LQIP(img image.Image, width int) (string, error) {
+	if width < 1 {
+		return "", fmt.Errorf("invalid lqip width: %d", width)
+	}
+	thumbnail := imaging.Resize(img, width, 0, imaging.Linear)
+	format, mimeType := imaging.JPEG, "image/jpeg"
+	if !thumbnail.Opaque() {
+		format, mimeType = imaging.PNG, "image/png"
+	}
+	buf := getBuffer()
+	defer putBuffer(buf)
+	err := imaging.Encode(buf, thumbnail, format, imaging.JPEGQuality(lqipJPEGQuality), imaging.PNGCompressionLevel(png.BestCompression))
+	if err != nil {
+		return "", err
+	}
+	return "data:" + mimeType + ";base64," + base64.StdEncoding.EncodeToString(buf.Bytes()), nil
+}
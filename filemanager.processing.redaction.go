@@ -0,0 +1,300 @@
+package filemanager
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// METADATA_KEY_REDACTIONS holds the number of redacted matches by pattern name, a map[string]int.
+	METADATA_KEY_REDACTIONS = "redactions"
+	// METADATA_KEY_REDACTION_COUNT holds the total number of redacted matches.
+	METADATA_KEY_REDACTION_COUNT = "redaction_count"
+
+	DEFAULT_REDACTION_REPLACEMENT = "[REDACTED]"
+)
+
+var (
+	ErrRedactionUnsupported = errors.New("PDF engine does not support redaction")
+	ErrRedactionIncomplete  = errors.New("redacted text remains")
+)
+
+// RedactionPatterns are the built-in patterns of the RedactionPlugin by name.
+var RedactionPatterns = map[string]string{
+	"ssn":         `\b\d{3}-\d{2}-\d{4}\b`,
+	"email":       `\b[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}\b`,
+	"iban":        `\b[A-Z]{2}\d{2}(?: ?[A-Z0-9]{4}){2,7}(?: ?[A-Z0-9]{1,3})?\b`,
+	"credit_card": `\b\d{4}(?:[ -]?\d{4}){2}[ -]?\d{1,7}\b`,
+}
+
+// PDFRedactionEngine is implemented by PDF engines that remove text from PDFs, like UniPDFEngine. The
+// RedactionPlugin fails with ErrRedactionUnsupported on PDFs with other engines.
+type PDFRedactionEngine interface {
+	// Redact removes the text matching any of the patterns from the content streams of every page and covers the
+	// places it was drawn at.
+	Redact(content []byte, patterns []*regexp.Regexp) ([]byte, error)
+}
+
+// RedactionPlugin removes the text matching regular expressions from PDFs and text files, e.g. for compliance
+// before documents are shared. Text files get the matches replaced, PDFs get them removed from the page content, so
+// the text cannot be recovered by copying it or by removing a box drawn over it. The number of matches is written
+// into the METADATA_KEY_REDACTIONS and METADATA_KEY_REDACTION_COUNT metadata. PDFs are checked after the
+// redaction: if a pattern still matches their text, the step fails with ErrRedactionIncomplete.
+//
+// The redact param lists the names of the patterns to apply, all of them by default; the redaction_patterns param
+// adds patterns by name for the step; the replacement param is the text replacing matches in text files,
+// DEFAULT_REDACTION_REPLACEMENT by default. Other files are passed on as they are.
+//
+// Only the text of text files and of the page content of PDFs is redacted, not document metadata, annotations,
+// form fields or text in images.
+type RedactionPlugin struct {
+	// Patterns are regular expressions by name added to RedactionPatterns, replacing built-in ones of the same name.
+	Patterns map[string]string
+	// Engine redacts PDFs, UniPDFEngine by default. It has to implement PDFRedactionEngine.
+	Engine PDFEngine
+}
+
+func (p *RedactionPlugin) engine() PDFEngine {
+	if p.Engine != nil {
+		return p.Engine
+	}
+	return UniPDFEngine{}
+}
+
+// redactionPattern is a compiled pattern and its name.
+type redactionPattern struct {
+	name   string
+	regexp *regexp.Regexp
+}
+
+func (p *RedactionPlugin) Process(files []*ManagedFile, fileProcess *FileProcess) ([]*ManagedFile, error) {
+	var processedFiles []*ManagedFile
+
+	for _, file := range files {
+		pdf := isPDFFile(file)
+		if !pdf && !isTextLikeMimeType(file.MimeType) {
+			processedFiles = append(processedFiles, file)
+			continue
+		}
+		status := ProcessingStatus{
+			ProcessID:         fileProcess.ID,
+			TimeStamp:         int(time.Now().UnixNano() / int64(time.Millisecond)),
+			ProcessorName:     "Redaction",
+			StatusDescription: fmt.Sprintf("Redacting file(%s)", file.FileName),
+		}
+		fileProcess.AddProcessingUpdate(status)
+
+		patterns, err := p.patterns(file)
+		if err != nil {
+			return nil, err
+		}
+		var counts map[string]int
+		if pdf {
+			counts, err = p.redactPDF(file, patterns)
+		} else {
+			counts, err = redactText(file, patterns)
+		}
+		if err != nil {
+			return nil, err
+		}
+		file.SetMetaData(METADATA_KEY_REDACTIONS, counts)
+		file.SetMetaData(METADATA_KEY_REDACTION_COUNT, sumCounts(counts))
+
+		processedFiles = append(processedFiles, file)
+	}
+
+	return processedFiles, nil
+}
+
+// patterns returns the patterns selected by the redact param, sorted by name.
+func (p *RedactionPlugin) patterns(file *ManagedFile) ([]redactionPattern, error) {
+	available := make(map[string]string, len(RedactionPatterns)+len(p.Patterns))
+	for name, pattern := range RedactionPatterns {
+		available[name] = pattern
+	}
+	for name, pattern := range p.Patterns {
+		available[name] = pattern
+	}
+	var stepPatterns []string
+	if val, ok := file.MetaData["redaction_patterns"]; ok {
+		patterns, ok := val.(map[string]interface{})
+		if !ok {
+			return nil, invalidParamError("redaction_patterns", val)
+		}
+		for name, pattern := range patterns {
+			available[name], ok = pattern.(string)
+			if !ok {
+				return nil, invalidParamError("redaction_patterns", val)
+			}
+			stepPatterns = append(stepPatterns, name)
+		}
+	}
+
+	var names []string
+	if val, ok := file.MetaData["redact"]; ok {
+		list, ok := val.([]interface{})
+		if !ok {
+			return nil, invalidParamError("redact", val)
+		}
+		for _, item := range list {
+			name, ok := item.(string)
+			if !ok {
+				return nil, invalidParamError("redact", val)
+			}
+			if _, ok := available[name]; !ok {
+				return nil, invalidParamError("redact", name)
+			}
+			names = append(names, name)
+		}
+		// patterns of the step apply even if they are not listed
+		for _, name := range stepPatterns {
+			if !slices.Contains(names, name) {
+				names = append(names, name)
+			}
+		}
+	} else {
+		for name := range available {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return nil, &ValidationError{Field: "redact", Err: ErrMissingParam}
+	}
+	sort.Strings(names)
+
+	patterns := make([]redactionPattern, 0, len(names))
+	for _, name := range names {
+		compiled, err := regexp.Compile(available[name])
+		if err != nil {
+			return nil, &ValidationError{Field: "redaction_patterns", Err: fmt.Errorf("%w: pattern %s: %v", ErrInvalidParam, name, err)}
+		}
+		patterns = append(patterns, redactionPattern{name: name, regexp: compiled})
+	}
+	return patterns, nil
+}
+
+// redactText replaces the matches of the patterns in the content of the text file.
+func redactText(file *ManagedFile, patterns []redactionPattern) (map[string]int, error) {
+	replacement := DEFAULT_REDACTION_REPLACEMENT
+	if val, ok := file.MetaData["replacement"]; ok {
+		replacement, ok = val.(string)
+		if !ok {
+			return nil, invalidParamError("replacement", val)
+		}
+	}
+	text := string(file.Content)
+	spans, counts := redactionMatches(text, patterns)
+	if len(spans) > 0 {
+		var redacted strings.Builder
+		end := 0
+		for _, span := range spans {
+			redacted.WriteString(text[end:span[0]])
+			redacted.WriteString(replacement)
+			end = span[1]
+		}
+		redacted.WriteString(text[end:])
+		setRedactedContent(file, []byte(redacted.String()))
+	}
+	return counts, nil
+}
+
+// redactionMatches returns the spans of the text matched by the patterns in order, and the number of matches per
+// pattern. Where matches of different patterns overlap, the one starting first (the longer one of those starting
+// at the same place) counts, and the span covers all of them.
+func redactionMatches(text string, patterns []redactionPattern) ([][2]int, map[string]int) {
+	type match struct {
+		start, end int
+		pattern    string
+	}
+	var matches []match
+	counts := make(map[string]int, len(patterns))
+	for _, pattern := range patterns {
+		counts[pattern.name] = 0
+		for _, loc := range pattern.regexp.FindAllStringIndex(text, -1) {
+			if loc[1] > loc[0] {
+				matches = append(matches, match{start: loc[0], end: loc[1], pattern: pattern.name})
+			}
+		}
+	}
+	sort.SliceStable(matches, func(i, j int) bool {
+		if matches[i].start != matches[j].start {
+			return matches[i].start < matches[j].start
+		}
+		return matches[i].end > matches[j].end
+	})
+	var spans [][2]int
+	for _, m := range matches {
+		if last := len(spans) - 1; last >= 0 && m.start < spans[last][1] {
+			spans[last][1] = max(spans[last][1], m.end)
+			continue
+		}
+		spans = append(spans, [2]int{m.start, m.end})
+		counts[m.pattern]++
+	}
+	return spans, counts
+}
+
+// redactPDF counts the matches of the patterns in the text of the pages, removes them and checks that none are
+// left.
+func (p *RedactionPlugin) redactPDF(file *ManagedFile, patterns []redactionPattern) (map[string]int, error) {
+	engine := p.engine()
+	redactor, ok := engine.(PDFRedactionEngine)
+	if !ok {
+		return nil, fmt.Errorf("%w: %T", ErrRedactionUnsupported, engine)
+	}
+	pages, err := extractPDFPageTexts(file.Content, 1, false, nil)
+	if err != nil {
+		return nil, err
+	}
+	counts := make(map[string]int, len(patterns))
+	for _, page := range pages {
+		_, pageCounts := redactionMatches(page.Text, patterns)
+		for name, count := range pageCounts {
+			counts[name] += count
+		}
+	}
+	regexps := make([]*regexp.Regexp, len(patterns))
+	for i, pattern := range patterns {
+		regexps[i] = pattern.regexp
+	}
+
+	if sumCounts(counts) > 0 {
+		content, err := redactor.Redact(file.Content, regexps)
+		if err != nil {
+			return nil, fmt.Errorf("failed to redact PDF: %w", err)
+		}
+		pages, err = extractPDFPageTexts(content, 1, false, nil)
+		if err != nil {
+			return nil, err
+		}
+		for _, page := range pages {
+			for _, pattern := range patterns {
+				if pattern.regexp.MatchString(page.Text) {
+					return nil, fmt.Errorf("%w: pattern %s matches page %d of %s", ErrRedactionIncomplete, pattern.name, page.Page, file.FileName)
+				}
+			}
+		}
+		setRedactedContent(file, content)
+	}
+	return counts, nil
+}
+
+// setRedactedContent replaces the content of the file, dropping the checksum of the original content.
+func setRedactedContent(file *ManagedFile, content []byte) {
+	file.Content = content
+	file.FileSize = int64(len(content))
+	file.Checksum = ""
+}
+
+func sumCounts(counts map[string]int) int {
+	total := 0
+	for _, count := range counts {
+		total += count
+	}
+	return total
+}
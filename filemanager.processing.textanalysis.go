@@ -0,0 +1,267 @@
+package filemanager
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	METADATA_KEY_LANGUAGE            = "language"
+	METADATA_KEY_LANGUAGE_CONFIDENCE = "language_confidence"
+	METADATA_KEY_SUMMARY             = "summary"
+	METADATA_KEY_SUMMARY_SOURCE      = "summary_source"
+	METADATA_KEY_KEYWORDS            = "keywords"
+
+	DEFAULT_SUMMARY_SENTENCES = 3
+	DEFAULT_KEYWORD_COUNT     = 10
+	DEFAULT_LLM_INPUT_CHARS   = 12000
+	UNDETERMINED_LANGUAGE     = "und"
+)
+
+// TextAnalysisPlugin detects the language of text files and writes a summary and keywords into MetaData.
+// Without an LLM endpoint the summary is extractive (the highest scoring sentences of the text).
+// With an OpenAI-compatible chat completions endpoint, summary and keywords are generated by the model;
+// if that call fails the extractive result is used and the failure is recorded in ProcessingErrors.
+// Place it after a text extraction step (PDF text extractor, format converter) in the recipe.
+type TextAnalysisPlugin struct {
+	LLMEndpoint      string // e.g. http://localhost:8000/v1/chat/completions
+	LLMAPIKey        string
+	LLMModel         string
+	LLMInputChars    int // text sent to the model is truncated to this many characters
+	SummarySentences int
+	KeywordCount     int
+	Client           *http.Client
+}
+
+func (p *TextAnalysisPlugin) Process(files []*ManagedFile, fileProcess *FileProcess) ([]*ManagedFile, error) {
+	var processedFiles []*ManagedFile
+
+	for _, file := range files {
+		if !isTextLikeMimeType(file.MimeType) {
+			processedFiles = append(processedFiles, file)
+			continue
+		}
+		status := ProcessingStatus{
+			ProcessID:         fileProcess.ID,
+			TimeStamp:         int(time.Now().UnixNano() / int64(time.Millisecond)),
+			ProcessorName:     "TextAnalysis",
+			StatusDescription: fmt.Sprintf("Analyzing text of file(%s)", file.FileName),
+		}
+		fileProcess.AddProcessingUpdate(status)
+
+		text := string(file.Content)
+		language, confidence := DetectLanguage(text)
+		file.SetMetaData(METADATA_KEY_LANGUAGE, language)
+		file.SetMetaData(METADATA_KEY_LANGUAGE_CONFIDENCE, confidence)
+
+		summary := ExtractiveSummary(text, language, p.summarySentences())
+		keywords := ExtractKeywords(text, language, p.keywordCount())
+		source := "extractive"
+		if p.LLMEndpoint != "" {
+			llmSummary, llmKeywords, err := p.summarizeWithLLM(text, language)
+			if err != nil {
+				file.ProcessingErrors = append(file.ProcessingErrors, fmt.Sprintf("llm summarization failed: %v", err))
+			} else {
+				summary, keywords, source = llmSummary, llmKeywords, "llm"
+			}
+		}
+		file.SetMetaData(METADATA_KEY_SUMMARY, summary)
+		file.SetMetaData(METADATA_KEY_KEYWORDS, keywords)
+		file.SetMetaData(METADATA_KEY_SUMMARY_SOURCE, source)
+
+		processedFiles = append(processedFiles, file)
+	}
+
+	return processedFiles, nil
+}
+
+func (p *TextAnalysisPlugin) summarySentences() int {
+	if p.SummarySentences > 0 {
+		return p.SummarySentences
+	}
+	return DEFAULT_SUMMARY_SENTENCES
+}
+
+func (p *TextAnalysisPlugin) keywordCount() int {
+	if p.KeywordCount > 0 {
+		return p.KeywordCount
+	}
+	return DEFAULT_KEYWORD_COUNT
+}
+
+func (p *TextAnalysisPlugin) summarizeWithLLM(text string, language string) (string, []string, error) {
+	maxChars := p.LLMInputChars
+	if maxChars <= 0 {
+		maxChars = DEFAULT_LLM_INPUT_CHARS
+	}
+	if len(text) > maxChars {
+		text = strings.ToValidUTF8(text[:maxChars], "")
+	}
+	prompt := fmt.Sprintf("Summarize the following document in at most %d sentences in its own language (%s) and list up to %d keywords. "+
+		"Answer only with JSON of the form {\"summary\": \"...\", \"keywords\": [\"...\"]}.\n\n%s",
+		p.summarySentences(), language, p.keywordCount(), text)
+
+	headers := map[string]string{}
+	if p.LLMAPIKey != "" {
+		headers["Authorization"] = "Bearer " + p.LLMAPIKey
+	}
+	request := map[string]any{
+		"model":       p.LLMModel,
+		"temperature": 0,
+		"messages": []map[string]string{
+			{"role": "user", "content": prompt},
+		},
+	}
+	var response struct {
+		Choices []struct {
+			Message struct {
+				Content string `json:"content"`
+			} `json:"message"`
+		} `json:"choices"`
+	}
+	err := postJSON(p.Client, p.LLMEndpoint, headers, request, &response)
+	if err != nil {
+		return "", nil, err
+	}
+	if len(response.Choices) == 0 {
+		return "", nil, fmt.Errorf("llm returned no choices")
+	}
+
+	content := strings.TrimSpace(response.Choices[0].Message.Content)
+	// models like to wrap JSON answers in markdown code fences
+	if start, end := strings.Index(content, "{"), strings.LastIndex(content, "}"); start >= 0 && end > start {
+		content = content[start : end+1]
+	}
+	var result struct {
+		Summary  string   `json:"summary"`
+		Keywords []string `json:"keywords"`
+	}
+	err = json.Unmarshal([]byte(content), &result)
+	if err != nil {
+		return "", nil, fmt.Errorf("invalid llm answer: %v", err)
+	}
+	return result.Summary, result.Keywords, nil
+}
+
+var languageStopwords = map[string]map[string]bool{
+	"en": stopwordSet("the and of to in is that it for was on are as with be by this have from or at not but an they which you his her we were has been their"),
+	"de": stopwordSet("der die das und ist nicht ein eine zu den von mit sich des auf für im dem auch es an werden aus er hat dass sie nach wird bei einer um"),
+	"fr": stopwordSet("le la les et est des une un du en que qui dans pour pas sur au avec ce il elle sont par plus ne se aux ont cette nous vous"),
+	"es": stopwordSet("el la los las y es de que en un una por con para no se del al lo como más pero sus le ya o este sí porque esta entre cuando"),
+	"it": stopwordSet("il lo la gli le e di che è per non un una con del della sono si da al nel come anche ma ha questo alla più dei delle"),
+	"nl": stopwordSet("de het een en is van dat die in te niet op zijn met voor er aan ook als bij maar om dan zo naar nog wel door"),
+	"pt": stopwordSet("o a os as e de que em um uma do da dos das para com não por se na no mais como mas foi ao ele ela são também"),
+}
+
+func stopwordSet(words string) map[string]bool {
+	set := make(map[string]bool)
+	for _, word := range strings.Fields(words) {
+		set[word] = true
+	}
+	return set
+}
+
+// DetectLanguage guesses the ISO 639-1 language code of a text (en, de, fr, es, it, nl, pt) from stopword frequencies.
+// It returns "und" with confidence 0 if the language cannot be determined.
+func DetectLanguage(text string) (string, float64) {
+	counts := make(map[string]int)
+	total := 0
+	for _, token := range tokenizeSearchText(text) {
+		for language, stopwords := range languageStopwords {
+			if stopwords[token] {
+				counts[language]++
+				total++
+			}
+		}
+	}
+	best, bestCount := UNDETERMINED_LANGUAGE, 0
+	for language, count := range counts {
+		if count > bestCount || (count == bestCount && language < best) {
+			best, bestCount = language, count
+		}
+	}
+	if bestCount == 0 {
+		return UNDETERMINED_LANGUAGE, 0
+	}
+	return best, float64(bestCount) / float64(total)
+}
+
+var sentenceSplitRegex = regexp.MustCompile(`[^.!?\n]+[.!?]*`)
+
+// ExtractiveSummary returns the count highest scoring sentences of the text in their original order.
+// Sentences are scored by the average frequency of their non-stopword terms.
+func ExtractiveSummary(text string, language string, count int) string {
+	sentences := []string{}
+	for _, sentence := range sentenceSplitRegex.FindAllString(text, -1) {
+		sentence = strings.TrimSpace(sentence)
+		if len(tokenizeSearchText(sentence)) >= 3 {
+			sentences = append(sentences, sentence)
+		}
+	}
+	if len(sentences) <= count {
+		return strings.Join(sentences, " ")
+	}
+
+	frequencies := termFrequencies(text, language)
+	type scoredSentence struct {
+		index int
+		score float64
+	}
+	scored := make([]scoredSentence, len(sentences))
+	for i, sentence := range sentences {
+		tokens := tokenizeSearchText(sentence)
+		sum := 0
+		for _, token := range tokens {
+			sum += frequencies[token]
+		}
+		scored[i] = scoredSentence{index: i, score: float64(sum) / float64(len(tokens))}
+	}
+	sort.SliceStable(scored, func(i, j int) bool {
+		return scored[i].score > scored[j].score
+	})
+	selected := scored[:count]
+	sort.Slice(selected, func(i, j int) bool {
+		return selected[i].index < selected[j].index
+	})
+	parts := make([]string, 0, count)
+	for _, sentence := range selected {
+		parts = append(parts, sentences[sentence.index])
+	}
+	return strings.Join(parts, " ")
+}
+
+// ExtractKeywords returns the count most frequent non-stopword terms with at least 3 characters.
+func ExtractKeywords(text string, language string, count int) []string {
+	frequencies := termFrequencies(text, language)
+	keywords := make([]string, 0, len(frequencies))
+	for term := range frequencies {
+		keywords = append(keywords, term)
+	}
+	sort.Slice(keywords, func(i, j int) bool {
+		if frequencies[keywords[i]] == frequencies[keywords[j]] {
+			return keywords[i] < keywords[j]
+		}
+		return frequencies[keywords[i]] > frequencies[keywords[j]]
+	})
+	if len(keywords) > count {
+		keywords = keywords[:count]
+	}
+	return keywords
+}
+
+func termFrequencies(text string, language string) map[string]int {
+	stopwords := languageStopwords[language]
+	frequencies := make(map[string]int)
+	for _, token := range tokenizeSearchText(text) {
+		if len([]rune(token)) < 3 || stopwords[token] || languageStopwords["en"][token] {
+			continue
+		}
+		frequencies[token]++
+	}
+	return frequencies
+}
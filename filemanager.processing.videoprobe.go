@@ -0,0 +1,370 @@
+package filemanager
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrFFprobeMissing = errors.New("ffprobe not installed")
+)
+
+const (
+	METADATA_KEY_VIDEO            = "video"
+	METADATA_KEY_POSTER_TIMESTAMP = "poster_timestamp"
+	DEFAULT_POSTER_FORMAT         = "jpg"
+)
+
+// VideoInfo is the result of the VideoProbePlugin, stored in MetaData["video"].
+type VideoInfo struct {
+	Duration     float64 `json:"duration"` // seconds
+	Width        int     `json:"width"`
+	Height       int     `json:"height"`
+	Rotation     int     `json:"rotation,omitempty"` // degrees players rotate the video by, e.g. 90 for portrait phone videos
+	FrameRate    float64 `json:"frameRate,omitempty"`
+	VideoCodec   string  `json:"videoCodec"`
+	AudioCodec   string  `json:"audioCodec,omitempty"`
+	Bitrate      int64   `json:"bitrate"` // overall bits per second
+	VideoBitrate int64   `json:"videoBitrate,omitempty"`
+	AudioBitrate int64   `json:"audioBitrate,omitempty"`
+	Container    string  `json:"container"` // ffprobe format name, e.g. "mov,mp4,m4a,3gp,3g2,mj2"
+}
+
+// VideoProbePlugin reads duration, resolution, codecs and bitrates of videos with ffprobe into MetaData["video"]
+// and grabs poster frames with ffmpeg. Posters are added as further files of the step (stored next to the first
+// output), with MetaData["poster_timestamp"] in seconds.
+//
+// Params: poster_timestamps (list of seconds, "hh:mm:ss" or percentages of the duration like "10%"),
+// poster_format ("jpg" or "png") and poster_width (pixels, keeps the aspect ratio).
+type VideoProbePlugin struct {
+	FFprobePath      string   // defaults to "ffprobe" in PATH
+	FFmpegPath       string   // defaults to "ffmpeg" in PATH, only needed for posters
+	PosterTimestamps []string // posters grabbed if the params have none, e.g. []string{"10%"}
+	PosterFormat     string   // defaults to DEFAULT_POSTER_FORMAT
+	PosterWidth      int      // 0 keeps the video's width
+	// Limits are the rlimits of the ffprobe and ffmpeg runs.
+	Limits SubprocessLimits
+}
+
+func (p *VideoProbePlugin) Process(files []*ManagedFile, fileProcess *FileProcess) ([]*ManagedFile, error) {
+	var processedFiles []*ManagedFile
+
+	for _, file := range files {
+		if !strings.HasPrefix(file.MimeType, "video/") {
+			processedFiles = append(processedFiles, file)
+			continue
+		}
+		status := ProcessingStatus{
+			ProcessID:         fileProcess.ID,
+			TimeStamp:         int(time.Now().UnixNano() / int64(time.Millisecond)),
+			ProcessorName:     "VideoProbe",
+			StatusDescription: fmt.Sprintf("Probing video: %s", file.FileName),
+		}
+		fileProcess.AddProcessingUpdate(status)
+
+		timestamps, format, width, err := p.parseParams(file.MetaData)
+		if err != nil {
+			return nil, err
+		}
+		dir, err := os.MkdirTemp("", "filemanager-video-*")
+		if err != nil {
+			return nil, err
+		}
+		posters, err := p.probe(file, dir, timestamps, format, width)
+		os.RemoveAll(dir)
+		if err != nil {
+			return nil, err
+		}
+		processedFiles = append(processedFiles, file)
+		processedFiles = append(processedFiles, posters...)
+	}
+
+	return processedFiles, nil
+}
+
+func (p *VideoProbePlugin) probe(file *ManagedFile, dir string, timestamps []string, format string, width int) ([]*ManagedFile, error) {
+	input, err := commandInputPath(file, dir)
+	if err != nil {
+		return nil, err
+	}
+	info, err := p.Probe(input)
+	if err != nil {
+		return nil, err
+	}
+	file.SetMetaData(METADATA_KEY_VIDEO, info)
+
+	var posters []*ManagedFile
+	for i, timestamp := range timestamps {
+		seconds, err := parseVideoTimestamp(timestamp, info.Duration)
+		if err != nil {
+			return nil, err
+		}
+		content, err := p.GrabFrame(input, seconds, format, width)
+		if err != nil {
+			return nil, err
+		}
+		posters = append(posters, &ManagedFile{
+			FileName: fmt.Sprintf("%s.poster-%d.%s", strings.TrimSuffix(file.FileName, filepath.Ext(file.FileName)), i+1, format),
+			MimeType: MimeTypeForOutputFormat(format),
+			Owner:    file.Owner,
+			Content:  content,
+			FileSize: int64(len(content)),
+			MetaData: map[string]any{
+				METADATA_KEY_POSTER_TIMESTAMP: seconds,
+				"source_file_name":            file.FileName,
+			},
+		})
+	}
+	return posters, nil
+}
+
+// DryRun implements DryRunPlugin: it checks the poster params and describes the posters.
+func (p *VideoProbePlugin) DryRun(files []*ManagedFile) ([]*ManagedFile, error) {
+	var processedFiles []*ManagedFile
+	var posters []*ManagedFile
+	for _, file := range files {
+		processedFiles = append(processedFiles, file)
+		if !strings.HasPrefix(file.MimeType, "video/") {
+			continue
+		}
+		timestamps, format, _, err := p.parseParams(file.MetaData)
+		if err != nil {
+			return nil, err
+		}
+		for i := range timestamps {
+			posters = append(posters, &ManagedFile{
+				FileName: fmt.Sprintf("%s.poster-%d.%s", strings.TrimSuffix(file.FileName, filepath.Ext(file.FileName)), i+1, format),
+				MimeType: MimeTypeForOutputFormat(format),
+				Owner:    file.Owner,
+			})
+		}
+	}
+	return append(processedFiles, posters...), nil
+}
+
+func (p *VideoProbePlugin) parseParams(params map[string]any) (timestamps []string, format string, width int, err error) {
+	timestamps = p.PosterTimestamps
+	if val, ok := params["poster_timestamps"]; ok {
+		list, ok := val.([]any)
+		if !ok {
+			return nil, "", 0, invalidParamError("poster_timestamps", val)
+		}
+		timestamps = make([]string, 0, len(list))
+		for _, item := range list {
+			switch typed := item.(type) {
+			case float64:
+				timestamps = append(timestamps, strconv.FormatFloat(typed, 'f', -1, 64))
+			case string:
+				timestamps = append(timestamps, typed)
+			default:
+				return nil, "", 0, invalidParamError("poster_timestamps", val)
+			}
+		}
+	}
+	format = p.PosterFormat
+	if val, ok := params["poster_format"]; ok {
+		format, _ = val.(string)
+	}
+	format = NormalizeOutputFormat(format)
+	if format == "" {
+		format = DEFAULT_POSTER_FORMAT
+	}
+	if format != "jpg" && format != "png" {
+		return nil, "", 0, invalidParamError("poster_format", format)
+	}
+	width = p.PosterWidth
+	if val, ok := params["poster_width"]; ok {
+		number, ok := val.(float64)
+		if !ok || number < 1 {
+			return nil, "", 0, invalidParamError("poster_width", val)
+		}
+		width = int(number)
+	}
+	return timestamps, format, width, nil
+}
+
+type ffprobeOutput struct {
+	Streams []struct {
+		CodecType    string            `json:"codec_type"`
+		CodecName    string            `json:"codec_name"`
+		Width        int               `json:"width"`
+		Height       int               `json:"height"`
+		BitRate      string            `json:"bit_rate"`
+		AvgFrameRate string            `json:"avg_frame_rate"`
+		Tags         map[string]string `json:"tags"`
+		SideDataList []struct {
+			Rotation float64 `json:"rotation"`
+		} `json:"side_data_list"`
+		Disposition struct {
+			AttachedPic int `json:"attached_pic"`
+		} `json:"disposition"`
+	} `json:"streams"`
+	Format struct {
+		FormatName string `json:"format_name"`
+		Duration   string `json:"duration"`
+		BitRate    string `json:"bit_rate"`
+	} `json:"format"`
+}
+
+// Probe runs ffprobe on the video file at the path.
+func (p *VideoProbePlugin) Probe(path string) (*VideoInfo, error) {
+	ffprobe := p.FFprobePath
+	if ffprobe == "" {
+		ffprobe = "ffprobe"
+	}
+	if _, err := exec.LookPath(ffprobe); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrFFprobeMissing, err)
+	}
+	cmd := LimitedCommand(context.Background(), p.Limits, ffprobe, "-v", "error", "-print_format", "json", "-show_format", "-show_streams", path)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	if err != nil {
+		return nil, fmt.Errorf("ffprobe failed: %v %s", err, strings.TrimSpace(stderr.String()))
+	}
+	var output ffprobeOutput
+	err = json.Unmarshal(stdout.Bytes(), &output)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse ffprobe output: %v", err)
+	}
+
+	info := &VideoInfo{Container: output.Format.FormatName}
+	info.Duration, _ = strconv.ParseFloat(output.Format.Duration, 64)
+	info.Bitrate, _ = strconv.ParseInt(output.Format.BitRate, 10, 64)
+	for _, stream := range output.Streams {
+		switch {
+		case stream.CodecType == "video" && stream.Disposition.AttachedPic == 0 && info.VideoCodec == "":
+			info.VideoCodec = stream.CodecName
+			info.Width = stream.Width
+			info.Height = stream.Height
+			info.VideoBitrate, _ = strconv.ParseInt(stream.BitRate, 10, 64)
+			info.FrameRate = parseFrameRate(stream.AvgFrameRate)
+			if rotate, err := strconv.Atoi(stream.Tags["rotate"]); err == nil {
+				info.Rotation = rotate
+			}
+			for _, sideData := range stream.SideDataList {
+				if sideData.Rotation != 0 {
+					// the display matrix rotates counterclockwise, the rotate tag clockwise
+					info.Rotation = (360 - int(sideData.Rotation)) % 360
+				}
+			}
+		case stream.CodecType == "audio" && info.AudioCodec == "":
+			info.AudioCodec = stream.CodecName
+			info.AudioBitrate, _ = strconv.ParseInt(stream.BitRate, 10, 64)
+		}
+	}
+	if info.VideoCodec == "" {
+		return nil, fmt.Errorf("no video stream found")
+	}
+	return info, nil
+}
+
+// GrabFrame returns the frame at the second as JPEG or PNG, scaled to the width if not 0.
+func (p *VideoProbePlugin) GrabFrame(path string, seconds float64, format string, width int) ([]byte, error) {
+	ffmpeg := p.FFmpegPath
+	if ffmpeg == "" {
+		ffmpeg = "ffmpeg"
+	}
+	if _, err := exec.LookPath(ffmpeg); err != nil {
+		return nil, fmt.Errorf("poster frames need ffmpeg: %v", err)
+	}
+	codec := "mjpeg"
+	if format == "png" {
+		codec = "png"
+	}
+	// -ss before -i seeks by keyframes first and is fast even for long videos
+	args := []string{"-v", "error", "-ss", strconv.FormatFloat(seconds, 'f', 3, 64), "-i", path, "-frames:v", "1"}
+	if width > 0 {
+		args = append(args, "-vf", fmt.Sprintf("scale=%d:-2", width))
+	}
+	if codec == "mjpeg" {
+		args = append(args, "-q:v", "2")
+	}
+	args = append(args, "-f", "image2pipe", "-c:v", codec, "pipe:1")
+	cmd := LimitedCommand(context.Background(), p.Limits, ffmpeg, args...)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	if err != nil {
+		return nil, fmt.Errorf("ffmpeg failed: %v %s", err, strings.TrimSpace(stderr.String()))
+	}
+	if stdout.Len() == 0 {
+		return nil, fmt.Errorf("ffmpeg returned no frame at %.3fs", seconds)
+	}
+	return stdout.Bytes(), nil
+}
+
+// parseVideoTimestamp converts seconds ("12.5"), "hh:mm:ss(.ms)" or a percentage of the duration ("10%") into
+// seconds, clamped to the video.
+func parseVideoTimestamp(timestamp string, duration float64) (float64, error) {
+	timestamp = strings.TrimSpace(timestamp)
+	var seconds float64
+	switch {
+	case strings.HasSuffix(timestamp, "%"):
+		percentage, err := strconv.ParseFloat(strings.TrimSuffix(timestamp, "%"), 64)
+		if err != nil || percentage < 0 || percentage > 100 {
+			return 0, fmt.Errorf("invalid poster timestamp: %s", timestamp)
+		}
+		seconds = duration * percentage / 100
+	case strings.Contains(timestamp, ":"):
+		for _, part := range strings.Split(timestamp, ":") {
+			value, err := strconv.ParseFloat(part, 64)
+			if err != nil || value < 0 {
+				return 0, fmt.Errorf("invalid poster timestamp: %s", timestamp)
+			}
+			seconds = seconds*60 + value
+		}
+	default:
+		value, err := strconv.ParseFloat(timestamp, 64)
+		if err != nil || value < 0 {
+			return 0, fmt.Errorf("invalid poster timestamp: %s", timestamp)
+		}
+		seconds = value
+	}
+	// seeking to the very end yields no frame
+	if duration > 0 && seconds > duration-0.1 {
+		seconds = max(0, duration-0.1)
+	}
+	return seconds, nil
+}
+
+func parseFrameRate(rate string) float64 {
+	numerator, denominator, found := strings.Cut(rate, "/")
+	n, err := strconv.ParseFloat(numerator, 64)
+	if err != nil {
+		return 0
+	}
+	if !found {
+		return n
+	}
+	d, err := strconv.ParseFloat(denominator, 64)
+	if err != nil || d == 0 {
+		return 0
+	}
+	return n / d
+}
+
+// commandInputPath returns a path external tools can read the file from: its local path if the content is not
+// loaded, otherwise the content written to the directory, keeping the extension some tools pick the format by.
+func commandInputPath(file *ManagedFile, dir string) (string, error) {
+	if len(file.Content) == 0 && file.LocalFilePath != "" {
+		return file.LocalFilePath, nil
+	}
+	input := filepath.Join(dir, "input"+strings.ToLower(filepath.Ext(file.FileName)))
+	err := os.WriteFile(input, file.Content, 0600)
+	if err != nil {
+		return "", err
+	}
+	return input, nil
+}
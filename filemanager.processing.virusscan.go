@@ -0,0 +1,312 @@
+package filemanager
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+var (
+	ErrVirusScannerUnset   = errors.New("virus scan plugin has no scanner")
+	ErrVirusScannerUnknown = errors.New("unknown virus scanner")
+	// ErrScannerUnavailable is wrapped by scan errors caused by an unreachable or failing scanner, as opposed to
+	// ErrVirusFound for infected files.
+	ErrScannerUnavailable = errors.New("virus scanner unavailable")
+	ErrVirusFound         = errors.New("virus found")
+)
+
+// VirusFoundError is returned by the virus scan plugins with FailOnVirus set. errors.Is(err, ErrVirusFound) and
+// errors.Is(err, ErrScan) match it.
+type VirusFoundError struct {
+	FileName  string
+	Scanner   string
+	Signature string
+}
+
+func (e *VirusFoundError) Error() string {
+	return fmt.Sprintf("virus found in file(%s) by %s: %s", e.FileName, e.Scanner, e.Signature)
+}
+
+func (e *VirusFoundError) Is(target error) bool {
+	return target == ErrVirusFound || target == ErrScan
+}
+
+const (
+	METADATA_KEY_VIRUS_SCAN = "virus_scan"
+	// PARAM_VIRUS_SCANNER selects the scanner of a VirusScanPlugin in the step params of a recipe.
+	PARAM_VIRUS_SCANNER = "virus_scanner"
+)
+
+const DEFAULT_COMMAND_SCANNER_TIMEOUT = 5 * time.Minute
+
+// VirusScanResult is stored in MetaData["virus_scan"] by the virus scan plugins.
+type VirusScanResult struct {
+	Scanner   string `json:"scanner"`
+	Infected  bool   `json:"infected"`
+	Signature string `json:"signature,omitempty"`
+	// Skipped and Truncated report files not or only partly scanned, e.g. because they exceed the scanner's size
+	// limit; Reason explains why.
+	Skipped   bool   `json:"skipped,omitempty"`
+	Truncated bool   `json:"truncated,omitempty"`
+	Reason    string `json:"reason,omitempty"`
+}
+
+// VirusScanner scans the content of a file. Scan returns an error only if the scan could not be completed.
+type VirusScanner interface {
+	Name() string
+	Scan(file *ManagedFile) (VirusScanResult, error)
+}
+
+// VirusScanPlugin scans files with one of its Scanners, selected by the "virus_scanner" step param or
+// DefaultScanner. Infected files get a processing error and are passed on, like with the ClamAVPlugin, or fail the
+// recipe with a VirusFoundError if FailOnVirus is set.
+//
+//	processing_steps:
+//	  - plugin_name: virus_scan
+//	    params:
+//	      virus_scanner: virustotal
+type VirusScanPlugin struct {
+	Scanners       map[string]VirusScanner
+	DefaultScanner string // may be empty if there is only one scanner
+	FailOnVirus    bool
+}
+
+func (p *VirusScanPlugin) Process(files []*ManagedFile, fileProcess *FileProcess) ([]*ManagedFile, error) {
+	var processedFiles []*ManagedFile
+
+	for _, file := range files {
+		scanner, err := p.selectScanner(file)
+		if err != nil {
+			return nil, err
+		}
+		err = scanFile(scanner, file, fileProcess, p.FailOnVirus)
+		if err != nil {
+			return nil, err
+		}
+		processedFiles = append(processedFiles, file)
+	}
+
+	return processedFiles, nil
+}
+
+// ProcessStream implements StreamingPlugin: with a StreamScanner, the upload is scanned while it is read into
+// memory, otherwise it is scanned once it is read.
+func (p *VirusScanPlugin) ProcessStream(r io.Reader, file *ManagedFile, fileProcess *FileProcess) ([]*ManagedFile, error) {
+	scanner, err := p.selectScanner(file)
+	if err != nil {
+		return nil, err
+	}
+	streamScanner, ok := scanner.(StreamScanner)
+	if !ok {
+		file.Content, err = readAllPooled(r)
+		if err != nil {
+			return nil, err
+		}
+		file.FileSize = int64(len(file.Content))
+		return p.Process([]*ManagedFile{file}, fileProcess)
+	}
+
+	status := ProcessingStatus{
+		ProcessID:         fileProcess.ID,
+		TimeStamp:         int(time.Now().UnixNano() / int64(time.Millisecond)),
+		ProcessorName:     "VirusScan",
+		StatusDescription: fmt.Sprintf("Scanning file for viruses: %s using %s", file.FileName, scanner.Name()),
+	}
+	fileProcess.AddProcessingUpdate(status)
+	content := getBuffer()
+	defer putBuffer(content)
+	result, scanErr, err := teeScan(r, streamScanner, content)
+	if err != nil {
+		return nil, err
+	}
+	if scanErr != nil {
+		return nil, &ScanError{Scanner: scanner.Name(), FileName: file.FileName, Err: scanErr}
+	}
+	file.Content = bytes.Clone(content.Bytes())
+	file.FileSize = int64(len(file.Content))
+	err = recordScanResult(scanner, file, result, p.FailOnVirus)
+	if err != nil {
+		return nil, err
+	}
+	return []*ManagedFile{file}, nil
+}
+
+func (p *VirusScanPlugin) selectScanner(file *ManagedFile) (VirusScanner, error) {
+	if len(p.Scanners) == 0 {
+		return nil, ErrVirusScannerUnset
+	}
+	name := p.DefaultScanner
+	if value, ok := file.MetaData[PARAM_VIRUS_SCANNER].(string); ok && value != "" {
+		name = value
+	}
+	if name == "" && len(p.Scanners) == 1 {
+		for _, scanner := range p.Scanners {
+			return scanner, nil
+		}
+	}
+	scanner, ok := p.Scanners[name]
+	if !ok {
+		names := make([]string, 0, len(p.Scanners))
+		for scannerName := range p.Scanners {
+			names = append(names, scannerName)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("%w: %q (available: %s)", ErrVirusScannerUnknown, name, strings.Join(names, ", "))
+	}
+	return scanner, nil
+}
+
+// scanFile scans a single file, stores the result in its metadata and records a processing error if it is infected,
+// or returns a VirusFoundError with failOnVirus.
+func scanFile(scanner VirusScanner, file *ManagedFile, fileProcess *FileProcess, failOnVirus bool) error {
+	status := ProcessingStatus{
+		ProcessID:         fileProcess.ID,
+		TimeStamp:         int(time.Now().UnixNano() / int64(time.Millisecond)),
+		ProcessorName:     "VirusScan",
+		StatusDescription: fmt.Sprintf("Scanning file for viruses: %s using %s", file.FileName, scanner.Name()),
+	}
+	fileProcess.AddProcessingUpdate(status)
+
+	result, err := scanner.Scan(file)
+	if err != nil {
+		return &ScanError{Scanner: scanner.Name(), FileName: file.FileName, Err: err}
+	}
+	return recordScanResult(scanner, file, result, failOnVirus)
+}
+
+// recordScanResult stores the scan result in the metadata of the file and records a processing error if it is
+// infected, or returns a VirusFoundError with failOnVirus.
+func recordScanResult(scanner VirusScanner, file *ManagedFile, result VirusScanResult, failOnVirus bool) error {
+	if result.Scanner == "" {
+		result.Scanner = scanner.Name()
+	}
+	file.SetMetaData(METADATA_KEY_VIRUS_SCAN, result)
+	switch {
+	case result.Infected && failOnVirus:
+		return &VirusFoundError{FileName: file.FileName, Scanner: result.Scanner, Signature: result.Signature}
+	case result.Infected:
+		file.ProcessingErrors = append(file.ProcessingErrors, fmt.Sprintf("virus detected: %s", result.Signature))
+	case result.Skipped:
+		file.ProcessingErrors = append(file.ProcessingErrors, fmt.Sprintf("virus scan skipped: %s", result.Reason))
+	case result.Truncated:
+		file.ProcessingErrors = append(file.ProcessingErrors, fmt.Sprintf("virus scan incomplete: %s", result.Reason))
+	}
+	return nil
+}
+
+// CommandScanner runs a command-line virus scanner (clamscan, sophos, ...) on a temporary copy of the file.
+// "{path}" in Args is replaced with the path of the copy, it is appended if no argument contains it.
+// Exit code 0 means clean, InfectedExitCodes (default 1, as used by clamscan) infected, anything else is an error.
+type CommandScanner struct {
+	ScannerName       string // defaults to the base name of Command
+	Command           string
+	Args              []string
+	InfectedExitCodes []int
+	// SignatureRegex extracts the signature name from the output, from its first group.
+	// Defaults to the clamscan format "<path>: <signature> FOUND".
+	SignatureRegex *regexp.Regexp
+	TempDir        string // defaults to os.TempDir()
+	Timeout        time.Duration
+	Limits         SubprocessLimits
+}
+
+var defaultScannerSignatureRegex = regexp.MustCompile(`(?m):\s*(\S.*?)\s+FOUND\s*$`)
+
+func (s *CommandScanner) Name() string {
+	if s.ScannerName != "" {
+		return s.ScannerName
+	}
+	return strings.TrimSuffix(baseName(s.Command), ".exe")
+}
+
+func (s *CommandScanner) Scan(file *ManagedFile) (VirusScanResult, error) {
+	tmp, err := os.CreateTemp(s.TempDir, "virusscan-*")
+	if err != nil {
+		return VirusScanResult{}, err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(file.Content)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return VirusScanResult{}, err
+	}
+
+	args := make([]string, 0, len(s.Args)+1)
+	hasPath := false
+	for _, arg := range s.Args {
+		if strings.Contains(arg, "{path}") {
+			hasPath = true
+			arg = strings.ReplaceAll(arg, "{path}", tmp.Name())
+		}
+		args = append(args, arg)
+	}
+	if !hasPath {
+		args = append(args, tmp.Name())
+	}
+
+	timeout := s.Timeout
+	if timeout <= 0 {
+		timeout = DEFAULT_COMMAND_SCANNER_TIMEOUT
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	var output bytes.Buffer
+	cmd := LimitedCommand(ctx, s.Limits, s.Command, args...)
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	err = cmd.Run()
+
+	result := VirusScanResult{Scanner: s.Name()}
+	if err == nil {
+		return result, nil
+	}
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) || ctx.Err() != nil {
+		// not installed, not executable or timed out
+		return result, fmt.Errorf("%w: %s: %v", ErrScannerUnavailable, s.Command, err)
+	}
+	if !s.isInfectedExitCode(exitErr.ExitCode()) {
+		return result, fmt.Errorf("%s failed: %v: %s", s.Command, err, strings.TrimSpace(output.String()))
+	}
+	result.Infected = true
+	signatureRegex := s.SignatureRegex
+	if signatureRegex == nil {
+		signatureRegex = defaultScannerSignatureRegex
+	}
+	if match := signatureRegex.FindStringSubmatch(output.String()); len(match) > 1 {
+		result.Signature = match[1]
+	} else {
+		result.Signature = "unknown"
+	}
+	return result, nil
+}
+
+func (s *CommandScanner) isInfectedExitCode(code int) bool {
+	codes := s.InfectedExitCodes
+	if len(codes) == 0 {
+		codes = []int{1}
+	}
+	for _, infectedCode := range codes {
+		if code == infectedCode {
+			return true
+		}
+	}
+	return false
+}
+
+func baseName(command string) string {
+	if i := strings.LastIndexAny(command, `/\`); i >= 0 {
+		return command[i+1:]
+	}
+	return command
+}
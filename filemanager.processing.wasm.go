@@ -0,0 +1,334 @@
+package filemanager
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+)
+
+// WASM plugin ABI
+//
+// A processing module must export:
+//   - memory
+//   - alloc(size i32) -> i32: returns a pointer to size bytes of guest memory the host can write to
+//   - process(contentPtr i32, contentLen i32, headerPtr i32, headerLen i32) -> i64: processes the file content and
+//     returns the resulting content as (ptr << 32 | len). The header is the JSON encoded WasmFileHeader of the input.
+//
+// A module may import the following functions from the "filemanager" host module:
+//   - set_result_header(ptr i32, len i32): replaces file name, MIME type and metadata with the JSON encoded WasmFileHeader
+//   - set_error(ptr i32, len i32): fails processing of the file with the given message
+//   - log(ptr i32, len i32): writes a DEBUG log line
+//
+// Every file is processed in a fresh module instance without filesystem, network or clock access beyond WASI defaults.
+
+const (
+	WASM_HOST_MODULE_NAME           = "filemanager"
+	DEFAULT_WASM_MEMORY_LIMIT_PAGES = 256 // 64 KiB pages -> 16 MiB
+	DEFAULT_WASM_TIMEOUT            = 30 * time.Second
+	WASM_PLUGIN_FILE_EXTENSION      = ".wasm"
+	wasmPluginProcessorNameFormat   = "Wasm(%s)"
+	wasmMaxBufferLength             = 1<<32 - 1
+)
+
+var (
+	ErrWasmMissingExport = errors.New("wasm module is missing a required export")
+	ErrWasmTimeout       = errors.New("wasm plugin exceeded its time limit")
+)
+
+// WasmFileHeader is the JSON document exchanged with WASM modules describing the file besides its content.
+type WasmFileHeader struct {
+	FileName string         `json:"file_name"`
+	MimeType string         `json:"mime_type"`
+	MetaData map[string]any `json:"meta_data"`
+}
+
+// WasmPluginOptions limits the resources a WASM module may use.
+type WasmPluginOptions struct {
+	MemoryLimitPages uint32        // maximum guest memory in 64 KiB pages, defaults to DEFAULT_WASM_MEMORY_LIMIT_PAGES
+	Timeout          time.Duration // maximum processing time per file, defaults to DEFAULT_WASM_TIMEOUT
+}
+
+// WasmPlugin runs custom processing logic compiled to WebAssembly inside the wazero sandbox.
+type WasmPlugin struct {
+	name     string
+	options  WasmPluginOptions
+	runtime  wazero.Runtime
+	compiled wazero.CompiledModule
+	logger   LogAdapter
+}
+
+type wasmInvocation struct {
+	header   *WasmFileHeader
+	errorMsg string
+	logger   LogAdapter
+	name     string
+}
+
+type wasmInvocationKey struct{}
+
+// NewWasmPlugin compiles the given WASM binary into a plugin. Close the plugin to release the runtime.
+func NewWasmPlugin(name string, wasmBinary []byte, options WasmPluginOptions) (*WasmPlugin, error) {
+	if options.MemoryLimitPages == 0 {
+		options.MemoryLimitPages = DEFAULT_WASM_MEMORY_LIMIT_PAGES
+	}
+	if options.Timeout <= 0 {
+		options.Timeout = DEFAULT_WASM_TIMEOUT
+	}
+
+	ctx := context.Background()
+	runtimeConfig := wazero.NewRuntimeConfig().
+		WithMemoryLimitPages(options.MemoryLimitPages).
+		WithCloseOnContextDone(true)
+	runtime := wazero.NewRuntimeWithConfig(ctx, runtimeConfig)
+
+	_, err := wasi_snapshot_preview1.Instantiate(ctx, runtime)
+	if err != nil {
+		runtime.Close(ctx)
+		return nil, fmt.Errorf("failed to instantiate WASI: %v", err)
+	}
+
+	_, err = runtime.NewHostModuleBuilder(WASM_HOST_MODULE_NAME).
+		NewFunctionBuilder().WithFunc(wasmHostSetResultHeader).Export("set_result_header").
+		NewFunctionBuilder().WithFunc(wasmHostSetError).Export("set_error").
+		NewFunctionBuilder().WithFunc(wasmHostLog).Export("log").
+		Instantiate(ctx)
+	if err != nil {
+		runtime.Close(ctx)
+		return nil, fmt.Errorf("failed to instantiate host module: %v", err)
+	}
+
+	compiled, err := runtime.CompileModule(ctx, wasmBinary)
+	if err != nil {
+		runtime.Close(ctx)
+		return nil, fmt.Errorf("failed to compile wasm module(%s): %v", name, err)
+	}
+
+	exports := compiled.ExportedFunctions()
+	for _, required := range []string{"alloc", "process"} {
+		if _, ok := exports[required]; !ok {
+			runtime.Close(ctx)
+			return nil, fmt.Errorf("%w: %s (module %s)", ErrWasmMissingExport, required, name)
+		}
+	}
+
+	return &WasmPlugin{
+		name:     name,
+		options:  options,
+		runtime:  runtime,
+		compiled: compiled,
+		logger:   emptyLogger,
+	}, nil
+}
+
+// NewWasmPluginFromFile reads and compiles a .wasm file into a plugin named after the file.
+func NewWasmPluginFromFile(wasmFilePath string, options WasmPluginOptions) (*WasmPlugin, error) {
+	wasmBinary, err := os.ReadFile(wasmFilePath)
+	if err != nil {
+		return nil, err
+	}
+	name := strings.TrimSuffix(filepath.Base(wasmFilePath), filepath.Ext(wasmFilePath))
+	return NewWasmPlugin(name, wasmBinary, options)
+}
+
+// LoadWasmPlugins compiles every .wasm file in the directory and registers it as a processing plugin named after the file.
+func (fm *FileManager) LoadWasmPlugins(pluginsDir string, options WasmPluginOptions) error {
+	entries, err := os.ReadDir(pluginsDir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != WASM_PLUGIN_FILE_EXTENSION {
+			continue
+		}
+		plugin, err := NewWasmPluginFromFile(filepath.Join(pluginsDir, entry.Name()), options)
+		if err != nil {
+			fm.LogTo("DEBUG", fmt.Sprintf("[FileManager.LoadWasmPlugins] Error loading wasm plugin: (%s)\n%v\n", entry.Name(), err))
+			return err
+		}
+		plugin.logger = fm.LogTo
+		fm.AddProcessingPlugin(plugin.name, plugin)
+		fm.LogTo("DEBUG", fmt.Sprintf("[FileManager.LoadWasmPlugins] Loaded wasm plugin: (%s)\n", plugin.name))
+	}
+	return nil
+}
+
+// Name returns the plugin name, which is the file name without extension for plugins loaded from disk.
+func (p *WasmPlugin) Name() string {
+	return p.name
+}
+
+// Close releases the compiled module and the runtime.
+func (p *WasmPlugin) Close() error {
+	return p.runtime.Close(context.Background())
+}
+
+func (p *WasmPlugin) Process(files []*ManagedFile, fileProcess *FileProcess) ([]*ManagedFile, error) {
+	var processedFiles []*ManagedFile
+
+	for _, file := range files {
+		status := ProcessingStatus{
+			ProcessID:         fileProcess.ID,
+			TimeStamp:         int(time.Now().UnixNano() / int64(time.Millisecond)),
+			ProcessorName:     fmt.Sprintf(wasmPluginProcessorNameFormat, p.name),
+			StatusDescription: fmt.Sprintf("Processing file(%s)", file.FileName),
+		}
+		fileProcess.AddProcessingUpdate(status)
+
+		err := p.processFile(file)
+		if err != nil {
+			return nil, err
+		}
+		processedFiles = append(processedFiles, file)
+	}
+
+	return processedFiles, nil
+}
+
+func (p *WasmPlugin) processFile(file *ManagedFile) error {
+	header := &WasmFileHeader{
+		FileName: file.FileName,
+		MimeType: file.MimeType,
+		MetaData: file.MetaData,
+	}
+	headerBytes, err := json.Marshal(header)
+	if err != nil {
+		return fmt.Errorf("failed to encode wasm file header: %v", err)
+	}
+
+	invocation := &wasmInvocation{header: header, logger: p.logger, name: p.name}
+	ctx, cancel := context.WithTimeout(context.WithValue(context.Background(), wasmInvocationKey{}, invocation), p.options.Timeout)
+	defer cancel()
+
+	moduleConfig := wazero.NewModuleConfig().WithName("").WithStartFunctions("_initialize")
+	module, err := p.runtime.InstantiateModule(ctx, p.compiled, moduleConfig)
+	if err != nil {
+		return p.wrapError(ctx, fmt.Errorf("failed to instantiate wasm module(%s): %v", p.name, err))
+	}
+	defer module.Close(context.Background())
+
+	contentPtr, err := wasmWriteBytes(ctx, module, file.Content)
+	if err != nil {
+		return p.wrapError(ctx, err)
+	}
+	headerPtr, err := wasmWriteBytes(ctx, module, headerBytes)
+	if err != nil {
+		return p.wrapError(ctx, err)
+	}
+
+	results, err := module.ExportedFunction("process").Call(ctx,
+		uint64(contentPtr), uint64(len(file.Content)), uint64(headerPtr), uint64(len(headerBytes)))
+	if err != nil {
+		return p.wrapError(ctx, fmt.Errorf("wasm module(%s) failed: %v", p.name, err))
+	}
+	if invocation.errorMsg != "" {
+		return fmt.Errorf("wasm module(%s) reported an error: %s", p.name, invocation.errorMsg)
+	}
+	if len(results) != 1 {
+		return fmt.Errorf("wasm module(%s) returned %d values, expected 1", p.name, len(results))
+	}
+
+	resultPtr := uint32(results[0] >> 32)
+	resultLen := uint32(results[0])
+	content, ok := module.Memory().Read(resultPtr, resultLen)
+	if !ok {
+		return fmt.Errorf("wasm module(%s) returned an out of range result (ptr=%d, len=%d)", p.name, resultPtr, resultLen)
+	}
+
+	// the memory is released with the module, so the result has to be copied
+	file.Content = append([]byte(nil), content...)
+	file.FileSize = int64(len(file.Content))
+	file.FileName = invocation.header.FileName
+	file.MimeType = invocation.header.MimeType
+	file.MetaData = invocation.header.MetaData
+	return nil
+}
+
+func (p *WasmPlugin) wrapError(ctx context.Context, err error) error {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("%w: module(%s) timeout(%s)", ErrWasmTimeout, p.name, p.options.Timeout)
+	}
+	return err
+}
+
+func wasmWriteBytes(ctx context.Context, module api.Module, data []byte) (uint32, error) {
+	if uint64(len(data)) > wasmMaxBufferLength {
+		return 0, fmt.Errorf("input of %d bytes is too large for a wasm module", len(data))
+	}
+	results, err := module.ExportedFunction("alloc").Call(ctx, uint64(len(data)))
+	if err != nil {
+		return 0, fmt.Errorf("wasm alloc of %d bytes failed: %v", len(data), err)
+	}
+	ptr := uint32(results[0])
+	if !module.Memory().Write(ptr, data) {
+		return 0, fmt.Errorf("wasm alloc returned an out of range pointer(%d) for %d bytes", ptr, len(data))
+	}
+	return ptr, nil
+}
+
+func wasmReadString(module api.Module, ptr, length uint32) (string, bool) {
+	data, ok := module.Memory().Read(ptr, length)
+	if !ok {
+		return "", false
+	}
+	return string(data), true
+}
+
+func wasmHostSetResultHeader(ctx context.Context, module api.Module, ptr, length uint32) {
+	invocation, ok := ctx.Value(wasmInvocationKey{}).(*wasmInvocation)
+	if !ok {
+		return
+	}
+	data, ok := module.Memory().Read(ptr, length)
+	if !ok {
+		invocation.errorMsg = "set_result_header called with an out of range buffer"
+		return
+	}
+	header := &WasmFileHeader{}
+	err := json.Unmarshal(data, header)
+	if err != nil {
+		invocation.errorMsg = fmt.Sprintf("invalid result header: %v", err)
+		return
+	}
+	if header.FileName == "" {
+		header.FileName = invocation.header.FileName
+	}
+	if header.MimeType == "" {
+		header.MimeType = invocation.header.MimeType
+	}
+	if header.MetaData == nil {
+		header.MetaData = invocation.header.MetaData
+	}
+	invocation.header = header
+}
+
+func wasmHostSetError(ctx context.Context, module api.Module, ptr, length uint32) {
+	invocation, ok := ctx.Value(wasmInvocationKey{}).(*wasmInvocation)
+	if !ok {
+		return
+	}
+	message, ok := wasmReadString(module, ptr, length)
+	if !ok {
+		message = "set_error called with an out of range buffer"
+	}
+	invocation.errorMsg = message
+}
+
+func wasmHostLog(ctx context.Context, module api.Module, ptr, length uint32) {
+	invocation, ok := ctx.Value(wasmInvocationKey{}).(*wasmInvocation)
+	if !ok || invocation.logger == nil {
+		return
+	}
+	message, ok := wasmReadString(module, ptr, length)
+	if ok {
+		invocation.logger("DEBUG", fmt.Sprintf("[WasmPlugin(%s)] %s", invocation.name, message))
+	}
+}
@@ -0,0 +1,54 @@
+package filemanager_test
+
+import (
+	"errors"
+	"testing"
+
+	filemanager "github.com/itsatony/go-filemanager"
+	"github.com/itsatony/go-filemanager/filemanagertest"
+)
+
+// dropAllPlugin processes files into nothing.
+type dropAllPlugin struct{}
+
+func (dropAllPlugin) Process(files []*filemanager.ManagedFile, fileProcess *filemanager.FileProcess) ([]*filemanager.ManagedFile, error) {
+	return nil, nil
+}
+
+func TestRunProcessingStepFinishesFailedProcesses(t *testing.T) {
+	tfm := filemanagertest.NewTestFileManager(t)
+	tfm.AddProcessingPlugin("drop", dropAllPlugin{})
+	file := &filemanager.ManagedFile{FileName: "hello.txt", MimeType: "text/plain", Content: []byte("hello"), MetaData: map[string]any{}}
+
+	_, err := tfm.RunProcessingStep(file, "drop", nil, "")
+	if err == nil {
+		t.Fatal("RunProcessingStep() = nil, want an error for a plugin returning no files")
+	}
+	active, err := tfm.ListActiveProcesses()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(active) != 0 {
+		t.Fatalf("ListActiveProcesses() = %d processes, want the failed step finished", len(active))
+	}
+}
+
+func TestProcessRejectsFilesAboveMaxFileSize(t *testing.T) {
+	tfm := filemanagertest.NewTestFileManager(t)
+	tfm.AddProcessingPlugin("drop", dropAllPlugin{})
+	err := tfm.AddRecipe(filemanager.Recipe{
+		Name:              "small",
+		AcceptedMimeTypes: []string{"text/plain"},
+		MaxFileSize:       4,
+		ProcessingSteps:   []filemanager.ProcessingStep{{PluginName: "drop"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := &filemanager.ManagedFile{FileName: "hello.txt", MimeType: "text/plain", Content: []byte("hello"), FileSize: 5, MetaData: map[string]any{}}
+
+	status := tfm.Process(file, "small", nil)
+	if status == nil || !status.Done || !errors.Is(status.Error, filemanager.ErrInvalidFileSize) {
+		t.Fatalf("final status = %+v, want ErrInvalidFileSize", status)
+	}
+}
@@ -1,55 +1,55 @@
 package filemanager
 
 import (
-	"bytes"
 	"fmt"
-	"time"
-
-	"github.com/dutchcoders/go-clamd"
 )
 
 type ClamAVPlugin struct {
-	clam *clamd.Clamd
+	scanner *ClamdScanner
+	// FailOnVirus fails the recipe with a VirusFoundError instead of recording a processing error.
+	FailOnVirus bool
 }
 
-// NewClamAVPlugin creates a new ClamAVPlugin instance - only works with TCP connection
+// NewClamAVPlugin creates a new ClamAVPlugin instance for clamd at tcp://host:port or a unix socket
+// (unix:///path or a plain path). Use a VirusScanPlugin to choose between several scanners.
 // tcp := viper.GetString("CLAMAV_TCP")
-func NewClamAVPlugin(tcpConnection string) (*ClamAVPlugin, error) {
-	var clam *clamd.Clamd
-	var err error
+func NewClamAVPlugin(address string) (*ClamAVPlugin, error) {
+	scanner := newClamdScannerFromAddress(address)
 
-	clam = clamd.NewClamd(tcpConnection)
+	err := scanner.Ping()
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to ClamAV: %v", err)
+	}
 
-	err = clam.Ping()
+	return &ClamAVPlugin{scanner: scanner}, nil
+}
+
+// NewClamAVPluginWithScanner creates a ClamAVPlugin using a configured ClamdScanner, e.g. with ScanPaths or a
+// StreamMaxLength.
+func NewClamAVPluginWithScanner(scanner *ClamdScanner) (*ClamAVPlugin, error) {
+	err := scanner.Ping()
 	if err != nil {
 		return nil, fmt.Errorf("failed to connect to ClamAV: %v", err)
 	}
+	return &ClamAVPlugin{scanner: scanner}, nil
+}
 
-	return &ClamAVPlugin{clam: clam}, nil
+// Scanner returns the clamd scanner of the plugin, e.g. to start its health check.
+func (p *ClamAVPlugin) Scanner() *ClamdScanner {
+	return p.scanner
 }
 
 func (p *ClamAVPlugin) Process(files []*ManagedFile, fileProcess *FileProcess) ([]*ManagedFile, error) {
+	if p.scanner == nil {
+		return nil, ErrVirusScannerUnset
+	}
 	var processedFiles []*ManagedFile
 
 	for _, file := range files {
-		status := ProcessingStatus{
-			ProcessID:         fileProcess.ID,
-			TimeStamp:         int(time.Now().UnixNano() / int64(time.Millisecond)),
-			ProcessorName:     "ClamAV",
-			StatusDescription: fmt.Sprintf("Scanning file for viruses: %s", file.FileName),
-		}
-		fileProcess.AddProcessingUpdate(status)
-		scanResultChan, err := p.clam.ScanStream(bytes.NewReader(file.Content), nil)
+		err := scanFile(p.scanner, file, fileProcess, p.FailOnVirus)
 		if err != nil {
-			return nil, fmt.Errorf("failed to scan file: %v", err)
-		}
-
-		scanResult := <-scanResultChan
-
-		if scanResult.Status != "OK" {
-			file.ProcessingErrors = append(file.ProcessingErrors, fmt.Sprintf("virus detected: %s", scanResult.Description))
+			return nil, err
 		}
-
 		processedFiles = append(processedFiles, file)
 	}
 
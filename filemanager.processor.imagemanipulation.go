@@ -4,21 +4,30 @@ import (
 	"bytes"
 	"fmt"
 	"image"
+	"maps"
 	"mime"
+	"os"
+	"os/exec"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/disintegration/imaging"
 )
 
-type ImageManipulationPlugin struct{}
+// ImageManipulationPlugin converts, resizes and crops images. HEIC/HEIF and camera RAW files are decoded by its
+// Decoders (DefaultImageDecoders if nil) and stored as JPEG unless a format is set.
+type ImageManipulationPlugin struct {
+	Decoders []ImageDecoder
+}
 
 func (p *ImageManipulationPlugin) Process(files []*ManagedFile, fileProcess *FileProcess) ([]*ManagedFile, error) {
 	var processedFiles []*ManagedFile
 
 	for _, file := range files {
-		if !isImageFile(file) {
+		decoder := p.decoderFor(file)
+		if !isImageFile(file) && decoder == nil {
 			processedFiles = append(processedFiles, file)
 			continue
 		}
@@ -30,17 +39,26 @@ func (p *ImageManipulationPlugin) Process(files []*ManagedFile, fileProcess *Fil
 			Error:             nil,
 		}
 		fileProcess.AddProcessingUpdate(status)
-		img, err := imaging.Decode(bytes.NewReader(file.Content))
+		img, profile, err := p.decodeImage(file)
 		if err != nil {
 			return nil, fmt.Errorf("failed to decode image: %v", err)
 		}
+		img, profile, err = applyColorProfile(file, img, profile)
+		if err != nil {
+			return nil, err
+		}
 
 		// Perform image manipulation based on the specified parameters
 		params := file.MetaData
+		if _, ok := params["format"]; !ok && decoder != nil {
+			// formats that need a decoder cannot be encoded again
+			file.MimeType = "image/jpeg"
+			file.FileName = strings.TrimSuffix(file.FileName, filepath.Ext(file.FileName)) + ".jpg"
+		}
 		if val, ok := params["format"]; ok {
 			format, ok := val.(string)
 			if !ok {
-				return nil, fmt.Errorf("invalid format parameter: %v", val)
+				return nil, invalidParamError("format", val)
 			}
 			img, err = convertImageFormat(img, format)
 			if err != nil {
@@ -53,7 +71,7 @@ func (p *ImageManipulationPlugin) Process(files []*ManagedFile, fileProcess *Fil
 		if val, ok := params["width"]; ok {
 			widthFloat, ok := val.(float64)
 			if !ok {
-				return nil, fmt.Errorf("invalid width parameter: %v", val)
+				return nil, invalidParamError("width", val)
 			}
 			width := int(widthFloat)
 			img = imaging.Resize(img, width, 0, imaging.Lanczos)
@@ -62,7 +80,7 @@ func (p *ImageManipulationPlugin) Process(files []*ManagedFile, fileProcess *Fil
 		if val, ok := params["height"]; ok {
 			heightFloat, ok := val.(float64)
 			if !ok {
-				return nil, fmt.Errorf("invalid height parameter: %v", val)
+				return nil, invalidParamError("height", val)
 			}
 			height := int(heightFloat)
 			img = imaging.Resize(img, 0, height, imaging.Lanczos)
@@ -71,7 +89,7 @@ func (p *ImageManipulationPlugin) Process(files []*ManagedFile, fileProcess *Fil
 		if val, ok := params["aspect_ratio"]; ok {
 			aspectRatio, ok := val.(string)
 			if !ok {
-				return nil, fmt.Errorf("invalid aspect_ratio parameter: %v", val)
+				return nil, invalidParamError("aspect_ratio", val)
 			}
 			img, err = cropToAspectRatio(img, aspectRatio)
 			if err != nil {
@@ -79,24 +97,212 @@ func (p *ImageManipulationPlugin) Process(files []*ManagedFile, fileProcess *Fil
 			}
 		}
 
+		amount, radius, threshold, err := parseSharpenParams(params)
+		if err != nil {
+			return nil, err
+		}
+		if amount > 0 {
+			img = unsharpMask(img, amount, radius, threshold)
+		}
+
 		// Encode the processed image
-		var buf bytes.Buffer
-		format, err := imaging.FormatFromExtension(filepath.Ext(file.FileName))
+		encodeOptions, err := parseImageEncodeOptions(params)
 		if err != nil {
-			return nil, fmt.Errorf("unsupported image format: %v", err)
+			return nil, err
 		}
-		err = imaging.Encode(&buf, img, format)
+		file.Content, err = encodeImage(img, strings.TrimPrefix(filepath.Ext(file.FileName), "."), encodeOptions, profile)
 		if err != nil {
 			return nil, fmt.Errorf("failed to encode image: %v", err)
 		}
-
-		file.Content = buf.Bytes()
+		setImageInfo(file)
 		processedFiles = append(processedFiles, file)
 	}
 
 	return processedFiles, nil
 }
 
+// DryRun implements DryRunPlugin: it checks the params Process reads and names the images like Process would.
+func (p *ImageManipulationPlugin) DryRun(files []*ManagedFile) ([]*ManagedFile, error) {
+	for _, file := range files {
+		decoder := p.decoderFor(file)
+		if !isImageFile(file) && decoder == nil {
+			continue
+		}
+		params := file.MetaData
+		for _, key := range []string{"width", "height"} {
+			if val, ok := params[key]; ok {
+				if _, ok := val.(float64); !ok {
+					return nil, invalidParamError(key, val)
+				}
+			}
+		}
+		if val, ok := params["aspect_ratio"]; ok {
+			if _, ok := val.(string); !ok {
+				return nil, invalidParamError("aspect_ratio", val)
+			}
+		}
+		if val, ok := params["color_profile"]; ok {
+			mode, _ := val.(string)
+			if mode != COLOR_PROFILE_PRESERVE && mode != COLOR_PROFILE_SRGB && mode != COLOR_PROFILE_STRIP {
+				return nil, invalidParamError("color_profile", val)
+			}
+		}
+		_, _, _, err := parseSharpenParams(params)
+		if err != nil {
+			return nil, err
+		}
+		_, err = parseImageEncodeOptions(params)
+		if err != nil {
+			return nil, err
+		}
+		// the size is known once the image is encoded
+		file.FileSize = 0
+		val, ok := params["format"]
+		if !ok {
+			if decoder != nil {
+				file.MimeType = "image/jpeg"
+				file.FileName = strings.TrimSuffix(file.FileName, filepath.Ext(file.FileName)) + ".jpg"
+			}
+			continue
+		}
+		format, ok := val.(string)
+		if !ok {
+			return nil, invalidParamError("format", val)
+		}
+		_, err = convertImageFormat(nil, format)
+		if err != nil {
+			return nil, err
+		}
+		file.MimeType = mime.TypeByExtension("." + format)
+		file.FileName = fmt.Sprintf("%s.%s", strings.TrimSuffix(file.FileName, filepath.Ext(file.FileName)), format)
+	}
+	return files, nil
+}
+
+// ConvertsTo reports the formats images (including HEIC/HEIF and RAW, see Decoders) can be converted to: jpg, png,
+// gif, tif, bmp, pdf (one page of the image's size) and webp if the cwebp binary is installed.
+func (p *ImageManipulationPlugin) ConvertsTo(mimeType string, format string) bool {
+	if !strings.HasPrefix(mimeType, "image/") {
+		return false
+	}
+	switch format {
+	case "jpg", "png", "gif", "tif", "bmp", "pdf":
+		return true
+	case "webp":
+		_, err := exec.LookPath("cwebp")
+		return err == nil
+	}
+	return false
+}
+
+func (p *ImageManipulationPlugin) ConvertFormat(file *ManagedFile, format string) (*ManagedFile, error) {
+	img, profile, err := p.decodeImage(file, imaging.AutoOrientation(true))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode image: %v", err)
+	}
+	img, profile, err = applyColorProfile(file, img, profile)
+	if err != nil {
+		return nil, err
+	}
+	encodeOptions, err := parseImageEncodeOptions(file.MetaData)
+	if err != nil {
+		return nil, err
+	}
+	var content []byte
+	if format == "pdf" {
+		content, err = encodeImageAsPDF(img)
+	} else {
+		content, err = encodeImage(img, format, encodeOptions, profile)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode image as %s: %v", format, err)
+	}
+	converted := convertedCopy(file, content, format)
+	// the info of the source image does not describe the conversion
+	converted.MetaData = maps.Clone(file.MetaData)
+	delete(converted.MetaData, METADATA_KEY_IMAGE)
+	setImageInfo(converted)
+	return converted, nil
+}
+
+// encodeImageAsPDF writes a single page PDF of the image's size (one point per pixel) with the image embedded as JPEG.
+func encodeImageAsPDF(img image.Image) ([]byte, error) {
+	jpegData := getBuffer()
+	defer putBuffer(jpegData)
+	err := imaging.Encode(jpegData, img, imaging.JPEG, imaging.JPEGQuality(90))
+	if err != nil {
+		return nil, err
+	}
+	width, height := img.Bounds().Dx(), img.Bounds().Dy()
+	drawing := fmt.Sprintf("q %d 0 0 %d 0 0 cm /Im0 Do Q", width, height)
+
+	pdf := getBuffer()
+	defer putBuffer(pdf)
+	offsets := []int{}
+	writeObject := func(body string, stream []byte) {
+		offsets = append(offsets, pdf.Len())
+		fmt.Fprintf(pdf, "%d 0 obj\n%s\n", len(offsets), body)
+		if stream != nil {
+			pdf.WriteString("stream\n")
+			pdf.Write(stream)
+			pdf.WriteString("\nendstream\n")
+		}
+		pdf.WriteString("endobj\n")
+	}
+	pdf.WriteString("%PDF-1.4\n")
+	writeObject("<< /Type /Catalog /Pages 2 0 R >>", nil)
+	writeObject("<< /Type /Pages /Kids [3 0 R] /Count 1 >>", nil)
+	writeObject(fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %d %d] /Resources << /XObject << /Im0 4 0 R >> >> /Contents 5 0 R >>", width, height), nil)
+	writeObject(fmt.Sprintf("<< /Type /XObject /Subtype /Image /Width %d /Height %d /ColorSpace /DeviceRGB /BitsPerComponent 8 /Filter /DCTDecode /Length %d >>", width, height, jpegData.Len()), jpegData.Bytes())
+	writeObject(fmt.Sprintf("<< /Length %d >>", len(drawing)), []byte(drawing))
+
+	xref := pdf.Len()
+	fmt.Fprintf(pdf, "xref\n0 %d\n0000000000 65535 f \n", len(offsets)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(pdf, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(pdf, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(offsets)+1, xref)
+	return bytes.Clone(pdf.Bytes()), nil
+}
+
+// encodeImageAsWebP encodes the image with the cwebp command line tool, as there is no pure Go WebP encoder. The ICC
+// profile is passed on through the intermediate PNG; quality 0 keeps the cwebp default.
+func encodeImageAsWebP(img image.Image, profile []byte, quality int) ([]byte, error) {
+	dir, err := os.MkdirTemp("", "filemanager-webp-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	input := filepath.Join(dir, "input.png")
+	output := filepath.Join(dir, "output.webp")
+	png := getBuffer()
+	defer putBuffer(png)
+	err = imaging.Encode(png, img, imaging.PNG)
+	if err != nil {
+		return nil, err
+	}
+	content, err := EmbedICCProfile(png.Bytes(), profile)
+	if err != nil {
+		return nil, err
+	}
+	err = os.WriteFile(input, content, 0600)
+	if err != nil {
+		return nil, err
+	}
+	args := []string{"-quiet", input, "-o", output}
+	if quality > 0 {
+		args = append([]string{"-q", strconv.Itoa(quality)}, args...)
+	}
+	if len(profile) > 0 {
+		args = append([]string{"-metadata", "icc"}, args...)
+	}
+	result, err := exec.Command("cwebp", args...).CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("cwebp failed: %v %s", err, strings.TrimSpace(string(result)))
+	}
+	return os.ReadFile(output)
+}
+
 func isImageFile(file *ManagedFile) bool {
 	mimeType := file.MimeType
 	return strings.HasPrefix(mimeType, "image/")
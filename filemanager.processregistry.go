@@ -0,0 +1,218 @@
+package filemanager
+
+import (
+	"errors"
+	"sort"
+	"time"
+)
+
+var (
+	ErrProcessNotFound = errors.New("process not found")
+)
+
+// DEFAULT_PROCESS_RETENTION is how long finished processes stay queryable via GetProcessUpdates.
+const DEFAULT_PROCESS_RETENTION = time.Hour
+
+// PROCESS_PRUNE_INTERVAL is after how many registrations finished processes past their retention are dropped, so
+// registering does not scan the whole registry every time.
+const PROCESS_PRUNE_INTERVAL = 256
+
+// UpdatesAfter returns a copy of all processing updates with a sequence number greater than afterSeq.
+func (fp *FileProcess) UpdatesAfter(afterSeq int) []ProcessingStatus {
+	fp.mu.Lock()
+	defer fp.mu.Unlock()
+	return fp.updatesAfterLocked(afterSeq)
+}
+
+func (fp *FileProcess) updatesAfterLocked(afterSeq int) []ProcessingStatus {
+	if afterSeq < 0 {
+		afterSeq = 0
+	}
+	if afterSeq >= len(fp.ProcessingUpdates) {
+		return []ProcessingStatus{}
+	}
+	updates := make([]ProcessingStatus, len(fp.ProcessingUpdates)-afterSeq)
+	copy(updates, fp.ProcessingUpdates[afterSeq:])
+	return updates
+}
+
+// WaitForUpdates returns the updates newer than afterSeq. If there are none yet and the process is not done,
+// it blocks until a new update arrives or the timeout expires, in which case an empty slice is returned.
+func (fp *FileProcess) WaitForUpdates(afterSeq int, timeout time.Duration) []ProcessingStatus {
+	fp.mu.Lock()
+	updates := fp.updatesAfterLocked(afterSeq)
+	if len(updates) > 0 || timeout <= 0 || (fp.LatestStatus != nil && fp.LatestStatus.Done) {
+		fp.mu.Unlock()
+		return updates
+	}
+	if fp.updated == nil {
+		fp.updated = make(chan struct{})
+	}
+	updated := fp.updated
+	fp.mu.Unlock()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-updated:
+		return fp.UpdatesAfter(afterSeq)
+	case <-timer.C:
+		return []ProcessingStatus{}
+	}
+}
+
+func (fp *FileProcess) isFinishedBefore(deadline time.Time) bool {
+	fp.mu.Lock()
+	defer fp.mu.Unlock()
+	if fp.LatestStatus == nil || !fp.LatestStatus.Done {
+		return false
+	}
+	return int64(fp.LatestStatus.TimeStamp) < deadline.UnixMilli()
+}
+
+// RegisterProcess makes a FileProcess queryable by its ID. ProcessFile, HandleFileUpload and RunProcessingStep
+// register their processes automatically. Finished processes are dropped after the process retention period, checked
+// every PROCESS_PRUNE_INTERVAL registrations.
+func (fm *FileManager) RegisterProcess(fileProcess *FileProcess) {
+	if fileProcess == nil {
+		return
+	}
+	fm.processesMu.Lock()
+	fm.unprunedProcesses++
+	if fm.unprunedProcesses >= PROCESS_PRUNE_INTERVAL {
+		fm.pruneProcessesLocked()
+	}
+	fm.processes[fileProcess.ID] = fileProcess
+	fm.processesMu.Unlock()
+	fm.saveProcessState(fileProcess)
+}
+
+// SetProcessRetention sets how long finished processes are kept in the registry.
+func (fm *FileManager) SetProcessRetention(retention time.Duration) {
+	fm.processesMu.Lock()
+	defer fm.processesMu.Unlock()
+	fm.processRetention = retention
+}
+
+// GetProcess returns a registered FileProcess by its ID.
+func (fm *FileManager) GetProcess(processID string) (*FileProcess, error) {
+	fm.processesMu.RLock()
+	defer fm.processesMu.RUnlock()
+	fileProcess, ok := fm.processes[processID]
+	if !ok {
+		return nil, ErrProcessNotFound
+	}
+	return fileProcess, nil
+}
+
+// GetProcessUpdates returns the updates of a process that are newer than the afterSeq cursor (0 returns all).
+// With a timeout > 0 the call long-polls until a new update arrives, the process is done or the timeout expires.
+// Clients resume tracking by passing the Seq of the last status they have seen.
+func (fm *FileManager) GetProcessUpdates(processID string, afterSeq int, timeout time.Duration) ([]ProcessingStatus, error) {
+	fileProcess, err := fm.GetProcess(processID)
+	if err != nil {
+		return nil, err
+	}
+	return fileProcess.WaitForUpdates(afterSeq, timeout), nil
+}
+
+func (fm *FileManager) pruneProcessesLocked() {
+	fm.unprunedProcesses = 0
+	if fm.processRetention <= 0 {
+		return
+	}
+	deadline := time.Now().Add(-fm.processRetention)
+	for id, fileProcess := range fm.processes {
+		if fileProcess.isFinishedBefore(deadline) {
+			delete(fm.processes, id)
+		}
+	}
+}
+
+// Info returns a snapshot of the process state.
+func (fp *FileProcess) Info() *ProcessInfo {
+	fp.mu.Lock()
+	defer fp.mu.Unlock()
+	info := &ProcessInfo{
+		ID:               fp.ID,
+		CorrelationID:    fp.CorrelationID,
+		IncomingFileName: fp.IncomingFileName,
+		RecipeName:       fp.RecipeName,
+		Labels:           copyLabels(fp.Labels),
+		StartedAt:        fp.createdAt,
+		Done:             fp.finished,
+	}
+	if info.StartedAt.IsZero() && len(fp.ProcessingUpdates) > 0 {
+		info.StartedAt = time.UnixMilli(int64(fp.ProcessingUpdates[0].TimeStamp))
+	}
+	info.UpdatedAt = info.StartedAt
+	if fp.LatestStatus != nil {
+		status := *fp.LatestStatus
+		info.Status = &status
+		info.UpdatedAt = time.UnixMilli(int64(status.TimeStamp))
+	}
+	return info
+}
+
+// ListActiveProcesses returns the processes that have not finished yet, oldest first: the registered ones and,
+// with a process store, those the store knows of, e.g. processes of other instances. Tenant views list the
+// processes of their tenant.
+func (fm *FileManager) ListActiveProcesses() ([]*ProcessInfo, error) {
+	fm.processesMu.RLock()
+	processes := make([]*FileProcess, 0, len(fm.processes))
+	for _, fileProcess := range fm.processes {
+		processes = append(processes, fileProcess)
+	}
+	fm.processesMu.RUnlock()
+
+	tenantID := fm.TenantID()
+	seen := map[string]bool{}
+	infos := []*ProcessInfo{}
+	for _, fileProcess := range processes {
+		info := fileProcess.Info()
+		seen[info.ID] = true
+		if info.Done {
+			continue
+		}
+		info.TenantID = tenantID
+		infos = append(infos, info)
+	}
+	if store := fm.getProcessStore(); store != nil {
+		stored, err := store.ListActiveProcesses()
+		if err != nil {
+			return nil, err
+		}
+		for _, info := range stored {
+			if seen[info.ID] || info.TenantID != tenantID {
+				continue
+			}
+			seen[info.ID] = true
+			infos = append(infos, info)
+		}
+	}
+	sort.SliceStable(infos, func(i, j int) bool { return infos[i].StartedAt.Before(infos[j].StartedAt) })
+	return infos, nil
+}
+
+// GetProcessStatus returns the state of a process by its ID, from the registry or, for processes already dropped
+// from it or run by other instances, from the process store.
+func (fm *FileManager) GetProcessStatus(processID string) (*ProcessInfo, error) {
+	fileProcess, err := fm.GetProcess(processID)
+	if err == nil {
+		info := fileProcess.Info()
+		info.TenantID = fm.TenantID()
+		return info, nil
+	}
+	store := fm.getProcessStore()
+	if store == nil {
+		return nil, ErrProcessNotFound
+	}
+	info, err := store.LoadProcess(processID)
+	if err != nil {
+		return nil, err
+	}
+	if info.TenantID != fm.TenantID() {
+		return nil, ErrProcessNotFound
+	}
+	return info, nil
+}
@@ -0,0 +1,32 @@
+package filemanager_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	filemanager "github.com/itsatony/go-filemanager"
+	"github.com/itsatony/go-filemanager/filemanagertest"
+)
+
+func TestRegisterProcessPrunesFinishedProcesses(t *testing.T) {
+	tfm := filemanagertest.NewTestFileManager(t)
+	tfm.SetProcessRetention(time.Millisecond)
+	finished := filemanager.NewFileProcess("done.txt", "")
+	tfm.RegisterProcess(finished)
+	finished.AddProcessingUpdate(filemanager.ProcessingStatus{ProcessID: finished.ID, TimeStamp: int(time.Now().Add(-time.Minute).UnixMilli()), Done: true})
+	running := filemanager.NewFileProcess("running.txt", "")
+	tfm.RegisterProcess(running)
+
+	for i := 0; i < filemanager.PROCESS_PRUNE_INTERVAL; i++ {
+		tfm.RegisterProcess(filemanager.NewFileProcess("other.txt", ""))
+	}
+	_, err := tfm.GetProcess(finished.ID)
+	if !errors.Is(err, filemanager.ErrProcessNotFound) {
+		t.Fatalf("GetProcess(finished) = %v, want ErrProcessNotFound", err)
+	}
+	_, err = tfm.GetProcess(running.ID)
+	if err != nil {
+		t.Fatalf("GetProcess(running) = %v, want the unfinished process kept", err)
+	}
+}
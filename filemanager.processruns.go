@@ -0,0 +1,125 @@
+package filemanager
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// PROCESS_RUNS_DIR_NAME is the directory of the JSONProcessStore keeping the ProcessRuns.
+const PROCESS_RUNS_DIR_NAME = "runs"
+
+var (
+	ErrProcessRunNotFound = errors.New("process run not found")
+)
+
+// ProcessRun records the last successful run of a recipe on a stored file, so ReprocessFile with SkipUnchanged can
+// tell whether running it again would change anything.
+type ProcessRun struct {
+	LocalFilePath  string                 `json:"localFilePath"`
+	RecipeName     string                 `json:"recipeName"`
+	Checksum       string                 `json:"checksum"`     // hex encoded SHA-256 of the file content
+	RecipeDigest   string                 `json:"recipeDigest"` // see Recipe.Digest
+	ProcessID      string                 `json:"processId"`
+	FinishedAt     time.Time              `json:"finishedAt"`
+	ResultingFiles []ProcessingResultFile `json:"resultingFiles"`
+}
+
+// ProcessRunStore is implemented by process stores that also keep the last successful run of every recipe on every
+// file. ReprocessFile records its runs in it.
+type ProcessRunStore interface {
+	SaveProcessRun(run *ProcessRun) error
+	// LoadProcessRun returns ErrProcessRunNotFound if the recipe never ran successfully on the file.
+	LoadProcessRun(localFilePath string, recipeName string) (*ProcessRun, error)
+}
+
+// Digest returns the hex encoded SHA-256 of the recipe definition with the runtime params, which changes whenever a
+// run of the recipe might produce different outputs from the same file. Bump the Version of the recipe for changes
+// outside its definition, like a new release of one of its plugins.
+func (recipe Recipe) Digest(params map[string]any) string {
+	data, err := yaml.Marshal(struct {
+		Recipe Recipe         `yaml:"recipe"`
+		Params map[string]any `yaml:"params"`
+	}{recipe, params})
+	if err != nil {
+		// never matches a recorded digest
+		return ""
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func (fm *FileManager) getProcessRunStore() ProcessRunStore {
+	store, _ := fm.getProcessStore().(ProcessRunStore)
+	return store
+}
+
+// unchangedRun returns the recorded run of the recipe on the file if the file content and the recipe digest still
+// match it and its resulting files still exist, and the checksum of the file.
+func (fm *FileManager) unchangedRun(ctx context.Context, store ProcessRunStore, localFilePath string, recipeName string, digest string) (*ProcessRun, string) {
+	run, err := store.LoadProcessRun(localFilePath, recipeName)
+	if err != nil {
+		if !errors.Is(err, ErrProcessRunNotFound) {
+			fm.LogTo("INFO", fmt.Sprintf("[FileManager.ReprocessFile] Loading the last run of recipe(%s) on file(%s) failed: %v\n", recipeName, localFilePath, err))
+		}
+		return nil, ""
+	}
+	if run.RecipeDigest != digest {
+		return nil, ""
+	}
+	checksum, err := fm.storedChecksum(ctx, localFilePath, nil)
+	if err != nil || checksum != run.Checksum {
+		return nil, checksum
+	}
+	storage := fm.GetStorage()
+	for _, resultingFile := range run.ResultingFiles {
+		if resultingFile.LocalFilePath == "" {
+			continue
+		}
+		_, err = storage.Stat(resultingFile.LocalFilePath)
+		if err != nil {
+			fm.LogTo("DEBUG", fmt.Sprintf("[FileManager.ReprocessFile] Output(%s) of the last run of recipe(%s) on file(%s) is gone: %v\n", resultingFile.LocalFilePath, recipeName, localFilePath, err))
+			return nil, checksum
+		}
+	}
+	return run, checksum
+}
+
+// SaveProcessRun keeps the run in the runs directory of the store, replacing the previous run of its recipe on its
+// file.
+func (s *JSONProcessStore) SaveProcessRun(run *ProcessRun) error {
+	data, err := json.Marshal(run)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.runPath(run.LocalFilePath, run.RecipeName), data, 0640, DEFAULT_DIR_MODE, false)
+}
+
+func (s *JSONProcessStore) LoadProcessRun(localFilePath string, recipeName string) (*ProcessRun, error) {
+	data, err := os.ReadFile(s.runPath(localFilePath, recipeName))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrProcessRunNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	var run ProcessRun
+	err = json.Unmarshal(data, &run)
+	if err != nil {
+		return nil, err
+	}
+	return &run, nil
+}
+
+func (s *JSONProcessStore) runPath(localFilePath string, recipeName string) string {
+	sum := sha256.Sum256([]byte(filepath.Clean(localFilePath) + "\x00" + recipeName))
+	return filepath.Join(s.dir, PROCESS_RUNS_DIR_NAME, hex.EncodeToString(sum[:16])+".json")
+}
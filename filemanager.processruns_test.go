@@ -0,0 +1,60 @@
+package filemanager_test
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	filemanager "github.com/itsatony/go-filemanager"
+	"github.com/itsatony/go-filemanager/filemanagertest"
+)
+
+func TestSkipUnchangedReprocessesMissingOutputs(t *testing.T) {
+	tfm := filemanagertest.NewTestFileManager(t)
+	store, err := filemanager.NewJSONProcessStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tfm.SetProcessStore(store)
+	tfm.AddProcessingPlugin("recorder", &metaDataRecorder{})
+	err = tfm.AddRecipe(filemanager.Recipe{
+		Name:              "copy",
+		AcceptedMimeTypes: []string{"text/plain"},
+		MaxFileSize:       1024,
+		ProcessingSteps:   []filemanager.ProcessingStep{{PluginName: "recorder"}},
+		OutputFormats:     []filemanager.OutputFormat{{TargetFileNames: []string{"out/{metadata.process_id}"}, StorageType: filemanager.FileStorageTypePrivate}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	localFilePath := filepath.Join(tfm.PublicPath, "doc.txt")
+	err = tfm.Storage.WriteFile(localFilePath, []byte("hello"), 0644, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reprocess := func() filemanager.ReprocessResult {
+		t.Helper()
+		results, err := tfm.ReprocessFiles(context.Background(), []string{localFilePath}, "copy", filemanager.ReprocessOptions{ProcessOptions: filemanager.ProcessOptions{SkipUnchanged: true}})
+		if err != nil || len(results) != 1 || results[0].Err != nil || len(results[0].ResultingFiles) != 1 {
+			t.Fatalf("ReprocessFiles() = %+v, %v, want one output", results, err)
+		}
+		return results[0]
+	}
+
+	first := reprocess()
+	if first.Skipped {
+		t.Fatal("first run was skipped")
+	}
+	if second := reprocess(); !second.Skipped {
+		t.Fatal("run with existing outputs was not skipped")
+	}
+	err = tfm.Storage.Remove(first.ResultingFiles[0].LocalFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	third := reprocess()
+	if third.Skipped {
+		t.Fatal("run with a deleted output was skipped")
+	}
+	tfm.ReadFile(third.ResultingFiles[0].LocalFilePath)
+}
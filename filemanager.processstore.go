@@ -0,0 +1,171 @@
+package filemanager
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ProcessInfo is the state of a FileProcess as listed by ListActiveProcesses and returned by GetProcessStatus.
+type ProcessInfo struct {
+	ID               string            `json:"id"`
+	CorrelationID    string            `json:"correlationId,omitempty"`
+	TenantID         string            `json:"tenantId,omitempty"`
+	IncomingFileName string            `json:"incomingFileName"`
+	RecipeName       string            `json:"recipeName"`
+	Labels           map[string]string `json:"labels,omitempty"`
+	StartedAt        time.Time         `json:"startedAt"`
+	UpdatedAt        time.Time         `json:"updatedAt"`
+	Done             bool              `json:"done"`
+	// Status is the latest status, nil if the process has none yet.
+	Status *ProcessingStatus `json:"status,omitempty"`
+}
+
+// ProcessStore persists ProcessInfos beyond the in-memory registry: for processes dropped after the process
+// retention, after restarts and across instances sharing the store. Implementations must be safe for concurrent use.
+type ProcessStore interface {
+	SaveProcess(info *ProcessInfo) error
+	LoadProcess(processID string) (*ProcessInfo, error) // returns ErrProcessNotFound for unknown IDs
+	// ListActiveProcesses returns the processes that are not done.
+	ListActiveProcesses() ([]*ProcessInfo, error)
+}
+
+// SetProcessStore makes ProcessFile, ProcessUpload and HandleFileUpload save the state of their processes when they
+// start, after every step and when they end. GetProcessStatus and ListActiveProcesses fall back to it. Tenant views
+// share the store of their FileManager.
+func (fm *FileManager) SetProcessStore(store ProcessStore) {
+	root := fm.root()
+	root.mu.Lock()
+	defer root.mu.Unlock()
+	root.processStore = store
+}
+
+func (fm *FileManager) getProcessStore() ProcessStore {
+	root := fm.root()
+	root.mu.RLock()
+	defer root.mu.RUnlock()
+	return root.processStore
+}
+
+// saveProcessState saves the process to the process store, if there is one. Failures are logged.
+func (fm *FileManager) saveProcessState(fileProcess *FileProcess) {
+	store := fm.getProcessStore()
+	if store == nil || fileProcess == nil {
+		return
+	}
+	info := fileProcess.Info()
+	info.TenantID = fm.TenantID()
+	err := store.SaveProcess(info)
+	if err != nil {
+		fm.LogTo("INFO", fmt.Sprintf("[FileManager.saveProcessState] Saving process(%s)%s failed: %v\n", fileProcess.ID, fileProcess.LogLabels(), err))
+	}
+}
+
+// JSONProcessStore is a ProcessStore keeping one JSON file per process in a directory. Done processes are kept until
+// Prune removes them.
+type JSONProcessStore struct {
+	dir string
+}
+
+// NewJSONProcessStore creates a JSONProcessStore in the directory, creating it if needed.
+func NewJSONProcessStore(dir string) (*JSONProcessStore, error) {
+	err := os.MkdirAll(dir, 0750)
+	if err != nil {
+		return nil, err
+	}
+	return &JSONProcessStore{dir: dir}, nil
+}
+
+// path names the file by the hash of the ID, as IDs of custom generators may contain any characters.
+func (s *JSONProcessStore) path(processID string) string {
+	sum := sha256.Sum256([]byte(processID))
+	return filepath.Join(s.dir, hex.EncodeToString(sum[:16])+".json")
+}
+
+func (s *JSONProcessStore) SaveProcess(info *ProcessInfo) error {
+	data, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path(info.ID), data, 0640, DEFAULT_DIR_MODE, false)
+}
+
+func (s *JSONProcessStore) LoadProcess(processID string) (*ProcessInfo, error) {
+	data, err := os.ReadFile(s.path(processID))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrProcessNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	var info ProcessInfo
+	err = json.Unmarshal(data, &info)
+	if err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+func (s *JSONProcessStore) ListActiveProcesses() ([]*ProcessInfo, error) {
+	infos, err := s.list()
+	if err != nil {
+		return nil, err
+	}
+	var active []*ProcessInfo
+	for _, info := range infos {
+		if !info.Done {
+			active = append(active, info)
+		}
+	}
+	return active, nil
+}
+
+// Prune removes processes that were last updated before the deadline, done or not (processes of crashed instances
+// never finish).
+func (s *JSONProcessStore) Prune(deadline time.Time) error {
+	infos, err := s.list()
+	if err != nil {
+		return err
+	}
+	for _, info := range infos {
+		if info.UpdatedAt.Before(deadline) {
+			err = os.Remove(s.path(info.ID))
+			if err != nil && !errors.Is(err, os.ErrNotExist) {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *JSONProcessStore) list() ([]*ProcessInfo, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	var infos []*ProcessInfo
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(s.dir, entry.Name()))
+		if err != nil {
+			// removed by a concurrent Prune
+			continue
+		}
+		var info ProcessInfo
+		if json.Unmarshal(data, &info) != nil {
+			continue
+		}
+		infos = append(infos, &info)
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].StartedAt.Before(infos[j].StartedAt) })
+	return infos, nil
+}
@@ -0,0 +1,99 @@
+package filemanager
+
+import (
+	"math"
+	"time"
+)
+
+// stepProgress tracks the running recipe step of a FileProcess to derive the overall percentage from the
+// completed step weights plus the progress within the running step.
+type stepProgress struct {
+	weights []float64
+	total   float64
+	current int
+}
+
+// stepWeights returns the progress weight of every step: Weight if set, 1 otherwise and 0 for empty steps.
+func (recipe Recipe) stepWeights() []float64 {
+	weights := make([]float64, len(recipe.ProcessingSteps))
+	for i, step := range recipe.ProcessingSteps {
+		switch {
+		case step.PluginName == "":
+			weights[i] = 0
+		case step.Weight > 0:
+			weights[i] = step.Weight
+		default:
+			weights[i] = 1
+		}
+	}
+	return weights
+}
+
+func (fp *FileProcess) startSteps(weights []float64) {
+	progress := &stepProgress{weights: weights}
+	for _, weight := range weights {
+		progress.total += weight
+	}
+	fp.mu.Lock()
+	fp.steps = progress
+	fp.mu.Unlock()
+}
+
+func (fp *FileProcess) setStep(index int) {
+	fp.mu.Lock()
+	if fp.steps != nil {
+		fp.steps.current = index
+	}
+	fp.mu.Unlock()
+}
+
+func (fp *FileProcess) finishSteps() {
+	fp.mu.Lock()
+	fp.steps = nil
+	fp.mu.Unlock()
+}
+
+// overallPercentage returns the overall progress when the current step is at stepPercentage.
+func (progress *stepProgress) overallPercentage(stepPercentage int) int {
+	if progress.total <= 0 {
+		return 0
+	}
+	stepPercentage = min(max(stepPercentage, 0), 100)
+	done := 0.0
+	for _, weight := range progress.weights[:progress.current] {
+		done += weight
+	}
+	done += progress.weights[progress.current] * float64(stepPercentage) / 100
+	return int(math.Round(done / progress.total * 100))
+}
+
+// apply fills in the step fields of updates added while a step is running. Updates of plugins that do not report
+// progress themselves get the overall percentage of their step position.
+func (progress *stepProgress) apply(update *ProcessingStatus) {
+	if progress == nil || update.Done || update.StepCount != 0 {
+		return
+	}
+	update.Step = progress.current + 1
+	update.StepCount = len(progress.weights)
+	if update.Percentage == 0 {
+		update.Percentage = progress.overallPercentage(update.StepPercentage)
+	}
+}
+
+// AddStepProgress adds an update for the running recipe step. Plugins can use it to report progress within their
+// step; the overall Percentage is derived from the step weights of the recipe.
+func (fp *FileProcess) AddStepProgress(processorName string, description string, stepPercentage int) {
+	update := ProcessingStatus{
+		ProcessID:         fp.ID,
+		TimeStamp:         int(time.Now().UnixNano() / int64(time.Millisecond)),
+		ProcessorName:     processorName,
+		StatusDescription: description,
+		StepPercentage:    min(max(stepPercentage, 0), 100),
+	}
+	fp.mu.Lock()
+	if fp.steps != nil {
+		update.Percentage = fp.steps.overallPercentage(update.StepPercentage)
+	}
+	fp.mu.Unlock()
+	fp.AddProcessingUpdate(update)
+}
@@ -0,0 +1,248 @@
+package filemanager
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+)
+
+var (
+	ErrRecipeHookUnknown = errors.New("unknown recipe hook action")
+	ErrInvalidHookParams = errors.New("invalid recipe hook params")
+)
+
+// Built-in recipe hook actions.
+const (
+	RECIPE_HOOK_WEBHOOK         = "webhook"
+	RECIPE_HOOK_MOVE_ORIGINAL   = "move_original"
+	RECIPE_HOOK_DELETE_ORIGINAL = "delete_original"
+)
+
+// RecipeHook is an action of a recipe's on_success or on_failure list, run after the processing pipeline.
+//
+//	on_success:
+//	  - action: move_original
+//	    params:
+//	      target: archive/{metadata.process_id}
+//	on_failure:
+//	  - action: webhook
+//	    params:
+//	      url: https://example.com/hooks/processing-failed
+//	  - action: delete_original
+type RecipeHook struct {
+	Action string         `yaml:"action"` // a built-in action or one added with AddRecipeHook
+	Params map[string]any `yaml:"params"`
+}
+
+// RecipeHookEvent is what a recipe hook is run for: the input file of the process and its terminal status.
+type RecipeHookEvent struct {
+	RecipeName  string
+	File        *ManagedFile
+	FileProcess *FileProcess
+	Status      ProcessingStatus
+	Err         error // nil for on_success hooks
+}
+
+// RecipeHookFunc implements a recipe hook action. Errors are logged, the following hooks run anyway.
+type RecipeHookFunc func(fm *FileManager, event RecipeHookEvent, params map[string]any) error
+
+// RecipeHookPayload is the JSON body posted by the webhook action.
+type RecipeHookPayload struct {
+	ProcessID     string            `json:"processId"`
+	CorrelationID string            `json:"correlationId,omitempty"`
+	Recipe        string            `json:"recipe"`
+	FileName      string            `json:"fileName"`
+	Success       bool              `json:"success"`
+	Error         string            `json:"error,omitempty"`
+	Status        ProcessingStatus  `json:"status"`
+	Labels        map[string]string `json:"labels,omitempty"`
+}
+
+var builtinRecipeHooks = map[string]RecipeHookFunc{
+	RECIPE_HOOK_WEBHOOK:         webhookRecipeHook,
+	RECIPE_HOOK_MOVE_ORIGINAL:   moveOriginalRecipeHook,
+	RECIPE_HOOK_DELETE_ORIGINAL: deleteOriginalRecipeHook,
+}
+
+// AddRecipeHook adds a recipe hook action under the name, replacing a built-in one of the same name. Tenant views
+// share the hooks of their FileManager.
+func (fm *FileManager) AddRecipeHook(action string, hook RecipeHookFunc) {
+	root := fm.root()
+	root.mu.Lock()
+	defer root.mu.Unlock()
+	if root.recipeHooks == nil {
+		root.recipeHooks = make(map[string]RecipeHookFunc)
+	}
+	root.recipeHooks[action] = hook
+}
+
+func (fm *FileManager) getRecipeHook(action string) (RecipeHookFunc, bool) {
+	root := fm.root()
+	root.mu.RLock()
+	hook, ok := root.recipeHooks[action]
+	root.mu.RUnlock()
+	if ok {
+		return hook, true
+	}
+	hook, ok = builtinRecipeHooks[action]
+	return hook, ok
+}
+
+// runRecipeHooks runs the on_success or on_failure hooks of the recipe for the finished process.
+func (fm *FileManager) runRecipeHooks(recipe *Recipe, file *ManagedFile, fileProcess *FileProcess) {
+	if recipe == nil {
+		return
+	}
+	err := fileProcess.Err()
+	hooks := recipe.OnSuccess
+	if err != nil {
+		hooks = recipe.OnFailure
+	}
+	if len(hooks) == 0 {
+		return
+	}
+	event := RecipeHookEvent{RecipeName: recipe.Name, File: file, FileProcess: fileProcess, Err: err}
+	if status := fileProcess.GetLatestProcessingStatus(); status != nil {
+		event.Status = *status
+	}
+	for _, hook := range hooks {
+		hookFunc, ok := fm.getRecipeHook(hook.Action)
+		if !ok {
+			fm.LogTo("INFO", fmt.Sprintf("[FileManager.ProcessFile] Recipe(%s)%s hook failed: %v: %s\n", recipe.Name, fileProcess.LogLabels(), ErrRecipeHookUnknown, hook.Action))
+			continue
+		}
+		hookErr := runRecipeHook(hookFunc, fm, event, hook.Params)
+		if hookErr != nil {
+			fm.LogTo("INFO", fmt.Sprintf("[FileManager.ProcessFile] Recipe(%s)%s hook(%s) failed: %v\n", recipe.Name, fileProcess.LogLabels(), hook.Action, hookErr))
+			continue
+		}
+		fm.LogTo("DEBUG", fmt.Sprintf("[FileManager.ProcessFile] Recipe(%s)%s hook(%s) done\n", recipe.Name, fileProcess.LogLabels(), hook.Action))
+	}
+}
+
+func runRecipeHook(hookFunc RecipeHookFunc, fm *FileManager, event RecipeHookEvent, params map[string]any) (err error) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			err = fmt.Errorf("hook panicked: %v", recovered)
+		}
+	}()
+	return hookFunc(fm, event, params)
+}
+
+// webhookRecipeHook posts a RecipeHookPayload to params["url"] with the optional params["headers"].
+func webhookRecipeHook(fm *FileManager, event RecipeHookEvent, params map[string]any) error {
+	url, _ := params["url"].(string)
+	if url == "" {
+		return fmt.Errorf("%w: webhook needs a url", ErrInvalidHookParams)
+	}
+	headers := map[string]string{}
+	switch values := params["headers"].(type) {
+	case nil:
+	case map[string]any:
+		for name, header := range values {
+			headers[name] = fmt.Sprint(header)
+		}
+	case map[any]any: // as decoded from yaml
+		for name, header := range values {
+			headers[fmt.Sprint(name)] = fmt.Sprint(header)
+		}
+	default:
+		return fmt.Errorf("%w: invalid headers: %v", ErrInvalidHookParams, values)
+	}
+	payload := RecipeHookPayload{
+		ProcessID:     event.FileProcess.ID,
+		CorrelationID: event.FileProcess.CorrelationID,
+		Recipe:        event.RecipeName,
+		FileName:      event.File.FileName,
+		Success:       event.Err == nil,
+		Status:        event.Status,
+		Labels:        event.FileProcess.Labels,
+	}
+	if event.Err != nil {
+		payload.Error = event.Err.Error()
+	}
+	return postJSON(nil, url, headers, payload, nil)
+}
+
+// moveOriginalRecipeHook moves the input file to params["target"], a file name template like the target file
+// names of output formats, in params["storage_type"] (default private).
+func moveOriginalRecipeHook(fm *FileManager, event RecipeHookEvent, params map[string]any) error {
+	file := event.File
+	target, _ := params["target"].(string)
+	if target == "" {
+		return fmt.Errorf("%w: move_original needs a target", ErrInvalidHookParams)
+	}
+	storageType := FileStorageTypePrivate
+	if value, ok := params["storage_type"].(string); ok && value != "" {
+		storageType = FileStorageType(value)
+	}
+	if storageType != FileStorageTypePrivate && storageType != FileStorageTypePublic && storageType != FileStorageTypeTemp {
+		return fmt.Errorf("%w: %s", ErrInvalidStorageType, storageType)
+	}
+	if file.LocalFilePath == "" {
+		return fmt.Errorf("%w: %s", ErrLocalFileNotFound, file.FileName)
+	}
+	content, err := fm.GetStorage().ReadFile(file.LocalFilePath)
+	if err != nil {
+		return err
+	}
+	targetFilePath := ReplaceFileNameVariables(target, file)
+	if filepath.Ext(targetFilePath) == "" {
+		targetFilePath += filepath.Ext(file.FileName)
+	}
+	moved := &ManagedFile{
+		FileName:      filepath.Base(targetFilePath),
+		MimeType:      file.MimeType,
+		Owner:         file.Owner,
+		Content:       content,
+		FileSize:      int64(len(content)),
+		LocalFilePath: fm.GetLocalPathForFile(storageType, targetFilePath),
+		MetaData:      file.MetaData,
+	}
+	err = fm.SaveFile(moved)
+	if err != nil {
+		return err
+	}
+	err = removeOriginal(fm, file)
+	if err != nil {
+		return err
+	}
+	file.LocalFilePath = moved.LocalFilePath
+	file.FileName = moved.FileName
+	if storageType == FileStorageTypePublic {
+		file.URL, _ = fm.GetPublicUrlForFile(moved.LocalFilePath)
+	}
+	return nil
+}
+
+// deleteOriginalRecipeHook deletes the input file, uploads right away and other files through DeleteFile, which
+// moves them into the trash if it is enabled.
+func deleteOriginalRecipeHook(fm *FileManager, event RecipeHookEvent, params map[string]any) error {
+	if event.File.LocalFilePath == "" {
+		return nil
+	}
+	if fm.isUploadTempFile(event.File.LocalFilePath) {
+		return fm.DiscardUpload(event.File)
+	}
+	return fm.DeleteFile(event.File)
+}
+
+func removeOriginal(fm *FileManager, file *ManagedFile) error {
+	if fm.isUploadTempFile(file.LocalFilePath) {
+		return fm.DiscardUpload(file)
+	}
+	err := fm.checkContainedPath(file.LocalFilePath)
+	if err != nil {
+		return err
+	}
+	err = fm.checkNotOnHold(file.LocalFilePath)
+	if err != nil {
+		return err
+	}
+	err = fm.GetStorage().Remove(file.LocalFilePath)
+	if err != nil {
+		return err
+	}
+	fm.replicate(file.LocalFilePath, true)
+	return nil
+}
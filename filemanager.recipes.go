@@ -0,0 +1,138 @@
+package filemanager
+
+import "fmt"
+
+// recipeSnapshot is an immutable set of recipes. LoadRecipes and AddRecipe build a new snapshot and swap it in
+// atomically, so running processes keep a consistent view while recipes are (re)loaded.
+type recipeSnapshot struct {
+	recipes map[string]Recipe
+}
+
+func (snapshot *recipeSnapshot) get(name string) (Recipe, bool) {
+	recipe, ok := snapshot.recipes[name]
+	return recipe, ok
+}
+
+// copyRecipes returns a new map with the recipes of the snapshot, to build the next snapshot from.
+func (snapshot *recipeSnapshot) copyRecipes() map[string]Recipe {
+	recipes := make(map[string]Recipe, len(snapshot.recipes)+1)
+	for name, recipe := range snapshot.recipes {
+		recipes[name] = recipe
+	}
+	return recipes
+}
+
+// AddRecipe adds or replaces a recipe. The recipe is copied, later changes to it have no effect.
+func (fm *FileManager) AddRecipe(recipe Recipe) error {
+	if recipe.Name == "" {
+		return fmt.Errorf("recipe has no name")
+	}
+	if recipe.SchemaVersion > RECIPE_SCHEMA_VERSION {
+		return fmt.Errorf("%w: %d, this version of the package reads recipes up to schema version %d", ErrRecipeSchemaVersion, recipe.SchemaVersion, RECIPE_SCHEMA_VERSION)
+	}
+	err := validateMimePatterns(recipe.AcceptedMimeTypes, recipe.StrictMimeTypes)
+	if err != nil {
+		return fmt.Errorf("recipe(%s): %w", recipe.Name, err)
+	}
+	fm.mu.Lock()
+	defer fm.mu.Unlock()
+	recipes := fm.recipes.Load().copyRecipes()
+	recipes[recipe.Name] = recipe.Clone()
+	fm.recipes.Store(&recipeSnapshot{recipes: recipes})
+	return nil
+}
+
+// GetRecipeNames returns the names of all loaded recipes.
+func (fm *FileManager) GetRecipeNames() []string {
+	snapshot := fm.root().recipes.Load()
+	names := make([]string, 0, len(snapshot.recipes))
+	for name := range snapshot.recipes {
+		if fm.checkRecipeAllowed(name) != nil {
+			continue
+		}
+		names = append(names, name)
+	}
+	return names
+}
+
+func (fm *FileManager) getProcessingPlugin(name string) (ProcessingPlugin, bool) {
+	if fm.parent != nil {
+		return fm.parent.getProcessingPlugin(name)
+	}
+	fm.mu.RLock()
+	defer fm.mu.RUnlock()
+	plugin, ok := fm.processingPlugins[name]
+	return plugin, ok
+}
+
+// Clone returns a deep copy of the recipe, including step params.
+func (recipe Recipe) Clone() Recipe {
+	clone := recipe
+	clone.AcceptedMimeTypes = append([]string(nil), recipe.AcceptedMimeTypes...)
+	clone.HTTPHeaders = recipe.HTTPHeaders.clone()
+	clone.ResponsiveImages = recipe.ResponsiveImages.clone()
+	if recipe.ProcessingSteps != nil {
+		clone.ProcessingSteps = make([]ProcessingStep, len(recipe.ProcessingSteps))
+		for i, step := range recipe.ProcessingSteps {
+			step.Params = deepCopyParams(step.Params)
+			clone.ProcessingSteps[i] = step
+		}
+	}
+	clone.OnSuccess = cloneRecipeHooks(recipe.OnSuccess)
+	clone.OnFailure = cloneRecipeHooks(recipe.OnFailure)
+	if recipe.OutputFormats != nil {
+		clone.OutputFormats = make([]OutputFormat, len(recipe.OutputFormats))
+		for i, outputFormat := range recipe.OutputFormats {
+			outputFormat.TargetFileNames = append([]string(nil), outputFormat.TargetFileNames...)
+			outputFormat.HTTPHeaders = outputFormat.HTTPHeaders.clone()
+			outputFormat.PreCompress = append([]string(nil), outputFormat.PreCompress...)
+			clone.OutputFormats[i] = outputFormat
+		}
+	}
+	return clone
+}
+
+func cloneRecipeHooks(hooks []RecipeHook) []RecipeHook {
+	if hooks == nil {
+		return nil
+	}
+	cloned := make([]RecipeHook, len(hooks))
+	for i, hook := range hooks {
+		hook.Params = deepCopyParams(hook.Params)
+		cloned[i] = hook
+	}
+	return cloned
+}
+
+func deepCopyParams(params map[string]any) map[string]any {
+	if params == nil {
+		return nil
+	}
+	copied := make(map[string]any, len(params))
+	for key, value := range params {
+		copied[key] = deepCopyValue(value)
+	}
+	return copied
+}
+
+func deepCopyValue(value any) any {
+	switch typed := value.(type) {
+	case map[string]any:
+		return deepCopyParams(typed)
+	case map[any]any:
+		copied := make(map[any]any, len(typed))
+		for key, subValue := range typed {
+			copied[key] = deepCopyValue(subValue)
+		}
+		return copied
+	case []any:
+		copied := make([]any, len(typed))
+		for i, subValue := range typed {
+			copied[i] = deepCopyValue(subValue)
+		}
+		return copied
+	case []string:
+		return append([]string(nil), typed...)
+	}
+	return value
+}
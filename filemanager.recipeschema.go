@@ -0,0 +1,141 @@
+package filemanager
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+
+	yamlv2 "gopkg.in/yaml.v2"
+	"gopkg.in/yaml.v3"
+)
+
+// RECIPE_SCHEMA_VERSION is the schema_version of recipe files written for this version of the package. Older
+// recipe files are migrated when they are loaded, newer ones are refused.
+const RECIPE_SCHEMA_VERSION = 1
+
+var (
+	ErrRecipeSchemaVersion = errors.New("unsupported recipe schema version")
+)
+
+// recipeMigrations[i] upgrades a recipe document from schema version i to i+1.
+var recipeMigrations = []func(document *yaml.Node) error{
+	migrateRecipeV0,
+}
+
+// migrateRecipeV0 upgrades recipes without a schema_version. Schema version 1 only introduced the
+// schema_version field, so there is nothing to rewrite; later schema changes add their migration after it.
+func migrateRecipeV0(document *yaml.Node) error {
+	return nil
+}
+
+// MigrateRecipe upgrades the YAML of a recipe to RECIPE_SCHEMA_VERSION and returns it with the schema version it
+// had, 0 for recipes without a schema_version. Comments are kept; a recipe of the current version is returned as
+// it is. Recipes of a newer version fail with ErrRecipeSchemaVersion.
+func MigrateRecipe(data []byte) (migrated []byte, fromVersion int, err error) {
+	var document yaml.Node
+	err = yaml.Unmarshal(data, &document)
+	if err != nil {
+		return nil, 0, err
+	}
+	if document.Kind != yaml.DocumentNode || len(document.Content) == 0 || document.Content[0].Kind != yaml.MappingNode {
+		return nil, 0, fmt.Errorf("recipe is not a YAML mapping")
+	}
+	root := document.Content[0]
+	fromVersion, err = recipeSchemaVersion(root)
+	if err != nil {
+		return nil, 0, err
+	}
+	if fromVersion == RECIPE_SCHEMA_VERSION {
+		return data, fromVersion, nil
+	}
+	for version := fromVersion; version < RECIPE_SCHEMA_VERSION; version++ {
+		err = recipeMigrations[version](root)
+		if err != nil {
+			return nil, fromVersion, fmt.Errorf("migrating recipe from schema version %d: %w", version, err)
+		}
+	}
+	versionNode := &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!int", Value: strconv.Itoa(RECIPE_SCHEMA_VERSION)}
+	if existing := yamlMappingValue(root, "schema_version"); existing != nil {
+		*existing = *versionNode
+	} else {
+		keyNode := &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: "schema_version"}
+		if len(root.Content) > 0 {
+			// a comment heading the file stays on top
+			keyNode.HeadComment, root.Content[0].HeadComment = root.Content[0].HeadComment, ""
+		}
+		root.Content = append([]*yaml.Node{keyNode, versionNode}, root.Content...)
+	}
+	var buffer bytes.Buffer
+	encoder := yaml.NewEncoder(&buffer)
+	encoder.SetIndent(2)
+	err = encoder.Encode(&document)
+	if err != nil {
+		return nil, fromVersion, err
+	}
+	err = encoder.Close()
+	if err != nil {
+		return nil, fromVersion, err
+	}
+	return buffer.Bytes(), fromVersion, nil
+}
+
+// MigrateRecipeFile upgrades the recipe file to RECIPE_SCHEMA_VERSION in place and reports whether it changed.
+func MigrateRecipeFile(path string) (bool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return false, err
+	}
+	migrated, fromVersion, err := MigrateRecipe(data)
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", path, err)
+	}
+	if fromVersion == RECIPE_SCHEMA_VERSION {
+		return false, nil
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return false, err
+	}
+	return true, writeFileAtomic(path, migrated, info.Mode().Perm(), DEFAULT_DIR_MODE, false)
+}
+
+// parseRecipe decodes a recipe file, migrating older schema versions in memory. fromVersion is the schema version
+// of the file.
+func parseRecipe(data []byte) (recipe Recipe, fromVersion int, err error) {
+	migrated, fromVersion, err := MigrateRecipe(data)
+	if err != nil {
+		return Recipe{}, fromVersion, err
+	}
+	err = yamlv2.Unmarshal(migrated, &recipe)
+	return recipe, fromVersion, err
+}
+
+func recipeSchemaVersion(root *yaml.Node) (int, error) {
+	node := yamlMappingValue(root, "schema_version")
+	if node == nil {
+		return 0, nil
+	}
+	version, err := strconv.Atoi(node.Value)
+	if err != nil || node.Kind != yaml.ScalarNode || version < 0 {
+		return 0, fmt.Errorf("%w: %q", ErrRecipeSchemaVersion, node.Value)
+	}
+	if version > RECIPE_SCHEMA_VERSION {
+		return 0, fmt.Errorf("%w: %d, this version of the package reads recipes up to schema version %d", ErrRecipeSchemaVersion, version, RECIPE_SCHEMA_VERSION)
+	}
+	return version, nil
+}
+
+// yamlMappingValue returns the value of the key in the mapping node, nil if the node is no mapping or lacks the key.
+func yamlMappingValue(mapping *yaml.Node, key string) *yaml.Node {
+	if mapping.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		if mapping.Content[i].Value == key {
+			return mapping.Content[i+1]
+		}
+	}
+	return nil
+}
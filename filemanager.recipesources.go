@@ -0,0 +1,433 @@
+package filemanager
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	// ErrRecipesNotModified is returned by RecipeSource.FetchRecipes when the recipe set still has the given ETag.
+	ErrRecipesNotModified  = errors.New("recipes not modified")
+	ErrInvalidRecipeSource = errors.New("invalid recipe source")
+)
+
+const (
+	// DEFAULT_RECIPE_REFRESH_INTERVAL is how often WatchRecipes polls its source by default.
+	DEFAULT_RECIPE_REFRESH_INTERVAL = time.Minute
+	// MAX_REMOTE_RECIPES_SIZE limits the size of a recipe set or recipe file fetched from a remote source.
+	MAX_REMOTE_RECIPES_SIZE = 16 << 20
+)
+
+// RecipeFile is a recipe document of a RecipeSource.
+type RecipeFile struct {
+	Name string // file name or URL, for logs and errors
+	Data []byte
+}
+
+// RecipeSource provides a set of recipe files, e.g. a central recipe catalog shared by a fleet of worker instances.
+type RecipeSource interface {
+	// FetchRecipes returns the recipe files and the ETag of the set. With the ETag of the last fetch it returns
+	// ErrRecipesNotModified if the set did not change since.
+	FetchRecipes(ctx context.Context, etag string) (files []RecipeFile, newETag string, err error)
+}
+
+// NewRecipeSource returns the source of a recipe location:
+//
+//	./recipes                                              a directory of .yaml files
+//	https://config.example.com/recipes.yaml                a YAML stream of recipes separated by ---
+//	s3://bucket/recipes/?region=eu-central-1               the .yaml objects below the prefix, credentials from the environment
+//	git+https://github.com/org/recipes.git?ref=main&dir=x  the .yaml files of a directory of a git repository
+func NewRecipeSource(location string) (RecipeSource, error) {
+	switch {
+	case strings.HasPrefix(location, "http://"), strings.HasPrefix(location, "https://"):
+		return &HTTPRecipeSource{URL: location}, nil
+	case strings.HasPrefix(location, "s3://"):
+		parsed, err := url.Parse(location)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidRecipeSource, err)
+		}
+		region := parsed.Query().Get("region")
+		if region == "" {
+			region = os.Getenv("AWS_REGION")
+		}
+		if parsed.Host == "" || region == "" {
+			return nil, fmt.Errorf("%w: %s needs a bucket and a region", ErrInvalidRecipeSource, location)
+		}
+		return &S3RecipeSource{
+			Bucket:      parsed.Host,
+			Prefix:      strings.TrimPrefix(parsed.Path, "/"),
+			Region:      region,
+			Endpoint:    parsed.Query().Get("endpoint"),
+			Credentials: AWSCredentialsFromEnv(),
+		}, nil
+	case strings.HasPrefix(location, "git+"):
+		parsed, err := url.Parse(strings.TrimPrefix(location, "git+"))
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidRecipeSource, err)
+		}
+		query := parsed.Query()
+		parsed.RawQuery = ""
+		return &GitRecipeSource{URL: parsed.String(), Ref: query.Get("ref"), Dir: query.Get("dir")}, nil
+	}
+	return &DirRecipeSource{Dir: location}, nil
+}
+
+// LoadRecipesFrom loads the recipes of the source once, adding them to the loaded recipes like LoadRecipes.
+func (fm *FileManager) LoadRecipesFrom(ctx context.Context, source RecipeSource) error {
+	files, _, err := source.FetchRecipes(ctx, "")
+	if err != nil {
+		return err
+	}
+	_, err = fm.loadRecipeFiles(files, nil)
+	return err
+}
+
+// WatchRecipes loads the recipes of the source and refreshes them every interval until the context is cancelled.
+// Refreshes only download the set when its ETag changed; recipes removed from the source are removed from the
+// FileManager, running processes keep the recipe they started with. The first load fails the call, later
+// failures are logged and the recipes of the last successful fetch stay in place.
+func (fm *FileManager) WatchRecipes(ctx context.Context, source RecipeSource, interval time.Duration) error {
+	if interval <= 0 {
+		interval = DEFAULT_RECIPE_REFRESH_INTERVAL
+	}
+	files, etag, err := source.FetchRecipes(ctx, "")
+	if err != nil {
+		return err
+	}
+	loaded, err := fm.loadRecipeFiles(files, nil)
+	if err != nil {
+		fm.LogTo("INFO", fmt.Sprintf("[FileManager.WatchRecipes] Loading recipes failed: %v\n", err))
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			files, newETag, err := source.FetchRecipes(ctx, etag)
+			if errors.Is(err, ErrRecipesNotModified) {
+				continue
+			}
+			if err != nil {
+				fm.LogTo("INFO", fmt.Sprintf("[FileManager.WatchRecipes] Fetching recipes failed: %v\n", err))
+				continue
+			}
+			etag = newETag
+			loaded, err = fm.loadRecipeFiles(files, loaded)
+			if err != nil {
+				fm.LogTo("INFO", fmt.Sprintf("[FileManager.WatchRecipes] Loading recipes failed: %v\n", err))
+			}
+			fm.LogTo("INFO", fmt.Sprintf("[FileManager.WatchRecipes] Refreshed %d recipes, etag(%s)\n", len(loaded), etag))
+		}
+	}()
+	return nil
+}
+
+// DirRecipeSource reads the .yaml files of a local directory. Its ETag covers the names, sizes and modification
+// times of the files.
+type DirRecipeSource struct {
+	Dir string
+}
+
+func (s *DirRecipeSource) FetchRecipes(ctx context.Context, etag string) ([]RecipeFile, string, error) {
+	entries, err := os.ReadDir(s.Dir)
+	if err != nil {
+		return nil, "", err
+	}
+	hash := sha256.New()
+	var files []RecipeFile
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != ".yaml" {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil, "", err
+		}
+		fmt.Fprintf(hash, "%s\x00%d\x00%d\n", entry.Name(), info.Size(), info.ModTime().UnixNano())
+		files = append(files, RecipeFile{Name: entry.Name()})
+	}
+	newETag := hex.EncodeToString(hash.Sum(nil))
+	if etag != "" && etag == newETag {
+		return nil, etag, ErrRecipesNotModified
+	}
+	for i := range files {
+		files[i].Data, err = os.ReadFile(filepath.Join(s.Dir, files[i].Name))
+		if err != nil {
+			return nil, "", err
+		}
+	}
+	return files, newETag, nil
+}
+
+// HTTPRecipeSource fetches a YAML stream of recipes, separated by ---, from a URL. Refreshes send the ETag of the
+// last response in If-None-Match; servers without ETags are compared by the SHA-256 of the response.
+type HTTPRecipeSource struct {
+	URL    string
+	Header http.Header // e.g. an Authorization header
+	Client *http.Client
+}
+
+func (s *HTTPRecipeSource) FetchRecipes(ctx context.Context, etag string) ([]RecipeFile, string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.URL, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	for name, values := range s.Header {
+		req.Header[name] = values
+	}
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+	response, err := httpClientOrDefault(s.Client).Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer response.Body.Close()
+	if response.StatusCode == http.StatusNotModified {
+		return nil, etag, ErrRecipesNotModified
+	}
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		body, _ := io.ReadAll(io.LimitReader(response.Body, 1024))
+		return nil, "", fmt.Errorf("GET %s failed with status %d: %s", req.URL.Redacted(), response.StatusCode, strings.TrimSpace(string(body)))
+	}
+	data, err := readLimited(response.Body, MAX_REMOTE_RECIPES_SIZE)
+	if err != nil {
+		return nil, "", fmt.Errorf("GET %s: %w", req.URL.Redacted(), err)
+	}
+	newETag := response.Header.Get("ETag")
+	if newETag == "" {
+		newETag = sha256Hex(data)
+	}
+	if etag != "" && etag == newETag {
+		return nil, etag, ErrRecipesNotModified
+	}
+	files, err := splitRecipeStream(req.URL.Redacted(), data)
+	return files, newETag, err
+}
+
+// splitRecipeStream splits a YAML stream into its documents.
+func splitRecipeStream(name string, data []byte) ([]RecipeFile, error) {
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	var files []RecipeFile
+	for i := 1; ; i++ {
+		var document yaml.Node
+		err := decoder.Decode(&document)
+		if err == io.EOF {
+			return files, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: document %d: %w", name, i, err)
+		}
+		documentData, err := yaml.Marshal(&document)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, RecipeFile{Name: fmt.Sprintf("%s#%d", name, i), Data: documentData})
+	}
+}
+
+// S3RecipeSource reads the .yaml objects below a prefix of an S3 bucket. Its ETag covers the keys and ETags of
+// the objects, so a refresh of an unchanged set costs a single list request.
+type S3RecipeSource struct {
+	Bucket      string
+	Prefix      string
+	Region      string
+	Endpoint    string // for S3 compatible services, addressed path-style; AWS virtual-hosted style by default
+	Credentials AWSCredentials
+	Client      *http.Client
+}
+
+type s3ListBucketResult struct {
+	Contents []struct {
+		Key  string `xml:"Key"`
+		ETag string `xml:"ETag"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+func (s *S3RecipeSource) FetchRecipes(ctx context.Context, etag string) ([]RecipeFile, string, error) {
+	var keys []string
+	objectETags := map[string]string{}
+	continuationToken := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {s.Prefix}}
+		if continuationToken != "" {
+			query.Set("continuation-token", continuationToken)
+		}
+		data, err := s.get(ctx, "", query)
+		if err != nil {
+			return nil, "", err
+		}
+		var result s3ListBucketResult
+		err = xml.Unmarshal(data, &result)
+		if err != nil {
+			return nil, "", fmt.Errorf("listing s3://%s/%s: %w", s.Bucket, s.Prefix, err)
+		}
+		for _, object := range result.Contents {
+			if path.Ext(object.Key) == ".yaml" {
+				keys = append(keys, object.Key)
+				objectETags[object.Key] = object.ETag
+			}
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			break
+		}
+		continuationToken = result.NextContinuationToken
+	}
+	sort.Strings(keys)
+	hash := sha256.New()
+	for _, key := range keys {
+		fmt.Fprintf(hash, "%s\x00%s\n", key, objectETags[key])
+	}
+	newETag := hex.EncodeToString(hash.Sum(nil))
+	if etag != "" && etag == newETag {
+		return nil, etag, ErrRecipesNotModified
+	}
+	files := make([]RecipeFile, 0, len(keys))
+	for _, key := range keys {
+		data, err := s.get(ctx, key, nil)
+		if err != nil {
+			return nil, "", err
+		}
+		files = append(files, RecipeFile{Name: "s3://" + s.Bucket + "/" + key, Data: data})
+	}
+	return files, newETag, nil
+}
+
+// get sends a signed GET for the key (the bucket itself if empty) and returns the body.
+func (s *S3RecipeSource) get(ctx context.Context, key string, query url.Values) ([]byte, error) {
+	target := &url.URL{Scheme: "https", Host: s.Bucket + ".s3." + s.Region + ".amazonaws.com", Path: "/" + key}
+	if s.Endpoint != "" {
+		endpoint, err := url.Parse(s.Endpoint)
+		if err != nil {
+			return nil, fmt.Errorf("%w: endpoint: %v", ErrInvalidRecipeSource, err)
+		}
+		target = endpoint.JoinPath(s.Bucket, key)
+	}
+	target.RawQuery = query.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	signAWSRequestV4(req, sha256Hex(nil), s.Region, "s3", s.Credentials, time.Now())
+	response, err := httpClientOrDefault(s.Client).Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		body, _ := io.ReadAll(io.LimitReader(response.Body, 1024))
+		return nil, fmt.Errorf("GET s3://%s/%s failed with status %d: %s", s.Bucket, key, response.StatusCode, strings.TrimSpace(string(body)))
+	}
+	return readLimited(response.Body, MAX_REMOTE_RECIPES_SIZE)
+}
+
+// GitRecipeSource reads the .yaml files of a directory of a git repository with the git command line tool. The
+// ref (a branch, tag or commit, HEAD by default) is fetched shallowly into CacheDir, its commit is the ETag; a
+// refresh of an unchanged ref only asks the remote for the commit.
+type GitRecipeSource struct {
+	URL      string
+	Ref      string
+	Dir      string // directory of the recipes within the repository, its root by default
+	CacheDir string // working copy, a directory below os.TempDir() derived from the URL by default
+}
+
+func (s *GitRecipeSource) FetchRecipes(ctx context.Context, etag string) ([]RecipeFile, string, error) {
+	ref := s.Ref
+	if ref == "" {
+		ref = "HEAD"
+	}
+	if etag != "" {
+		output, err := s.git(ctx, "", "ls-remote", s.URL, ref)
+		if err == nil {
+			fields := strings.Fields(output)
+			if len(fields) > 0 && fields[0] == etag {
+				return nil, etag, ErrRecipesNotModified
+			}
+		}
+	}
+	cacheDir := s.CacheDir
+	if cacheDir == "" {
+		cacheDir = filepath.Join(os.TempDir(), "filemanager-recipes-"+sha256Hex([]byte(s.URL))[:16])
+	}
+	if _, err := os.Stat(filepath.Join(cacheDir, ".git")); err != nil {
+		err = os.MkdirAll(cacheDir, DEFAULT_DIR_MODE)
+		if err != nil {
+			return nil, "", err
+		}
+		_, err = s.git(ctx, cacheDir, "init", "--quiet")
+		if err != nil {
+			return nil, "", err
+		}
+	}
+	_, err := s.git(ctx, cacheDir, "fetch", "--quiet", "--depth", "1", s.URL, ref)
+	if err != nil {
+		return nil, "", err
+	}
+	_, err = s.git(ctx, cacheDir, "checkout", "--quiet", "--force", "--detach", "FETCH_HEAD")
+	if err != nil {
+		return nil, "", err
+	}
+	output, err := s.git(ctx, cacheDir, "rev-parse", "HEAD")
+	if err != nil {
+		return nil, "", err
+	}
+	commit := strings.TrimSpace(output)
+	if etag != "" && etag == commit {
+		return nil, etag, ErrRecipesNotModified
+	}
+	dir := filepath.Join(cacheDir, filepath.FromSlash(s.Dir))
+	if !isWithinDir(filepath.Clean(cacheDir), filepath.Clean(dir)) {
+		return nil, "", fmt.Errorf("%w: dir %s is outside of the repository", ErrInvalidRecipeSource, s.Dir)
+	}
+	files, _, err := (&DirRecipeSource{Dir: dir}).FetchRecipes(ctx, "")
+	return files, commit, err
+}
+
+func (s *GitRecipeSource) git(ctx context.Context, dir string, args ...string) (string, error) {
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Dir = dir
+	// never wait for credentials on a terminal
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("git %s: %v: %s", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return string(output), nil
+}
+
+// readLimited reads the body, failing if it is larger than limit bytes.
+func readLimited(body io.Reader, limit int64) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(body, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > limit {
+		return nil, fmt.Errorf("response exceeds %d bytes", limit)
+	}
+	return data, nil
+}
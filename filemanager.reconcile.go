@@ -0,0 +1,215 @@
+package filemanager
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// DEFAULT_RECONCILE_MIN_AGE is how old files and process states must be before Reconcile reports them, younger
+// ones may belong to processes that did not persist their records yet.
+const DEFAULT_RECONCILE_MIN_AGE = 10 * time.Minute
+
+var (
+	ErrConflictingRepairs = errors.New("conflicting reconcile repairs")
+)
+
+// ReconcileStorageOptions control Reconcile. Without repairs it only reports.
+type ReconcileStorageOptions struct {
+	// StorageTypes are walked for orphaned files, FileStorageTypePublic and FileStorageTypePrivate by default.
+	StorageTypes []FileStorageType
+	// MinAge skips files modified and processes updated more recently, DEFAULT_RECONCILE_MIN_AGE by default.
+	MinAge time.Duration
+	// AdoptOrphans creates records for orphaned files, built from the files like LoadManagedFile does.
+	AdoptOrphans bool
+	// DeleteOrphans deletes orphaned files with DeleteFile, into the trash if it is enabled.
+	DeleteOrphans bool
+	// RemoveGhosts deletes the records of ghosts.
+	RemoveGhosts bool
+	// FinishStaleProcesses ends stale processes in the process store with a status matching ErrProcessingIncomplete.
+	FinishStaleProcesses bool
+}
+
+// ReconcileReport lists the inconsistencies found by Reconcile. Paths are local file paths.
+type ReconcileReport struct {
+	Checked int
+	Orphans []string // in the storage, without a record in the metadata store
+	Ghosts  []string // records in the metadata store whose file is missing
+	// StaleProcesses are the IDs of processes the process store lists as active, which are not running on this
+	// instance and were not updated within MinAge, e.g. after a crash.
+	StaleProcesses []string
+	Repaired       int
+	Errors         map[string]string // failed repairs by path or process ID
+}
+
+// Reconcile compares the storage with the metadata store, and the process store with the running processes, e.g. on
+// startup after a crash. It reports orphaned files (in the storage, unknown to the metadata store), ghosts (in the
+// metadata store, missing in the storage) and stale processes, and repairs them as the options say. Hidden
+// directories like .trash and .versions, sidecar files and pre-compressed variants are skipped. Needs a metadata
+// store that can list its records and a storage implementing DirStorage; the process store is optional.
+func (fm *FileManager) Reconcile(ctx context.Context, opts ReconcileStorageOptions) (ReconcileReport, error) {
+	report := ReconcileReport{Errors: make(map[string]string)}
+	if opts.AdoptOrphans && opts.DeleteOrphans {
+		return report, fmt.Errorf("%w: AdoptOrphans and DeleteOrphans", ErrConflictingRepairs)
+	}
+	store := fm.getMetadataStore()
+	if store == nil {
+		return report, ErrMetadataStoreMissing
+	}
+	storage, ok := fm.GetStorage().(DirStorage)
+	if !ok {
+		return report, ErrReplicationNotDirectory
+	}
+	storageTypes := opts.StorageTypes
+	if len(storageTypes) == 0 {
+		storageTypes = []FileStorageType{FileStorageTypePublic, FileStorageTypePrivate}
+	}
+	minAge := opts.MinAge
+	if minAge <= 0 {
+		minAge = DEFAULT_RECONCILE_MIN_AGE
+	}
+	cutoff := time.Now().Add(-minAge)
+
+	records, err := store.ListRecords()
+	if err != nil {
+		return report, err
+	}
+	known := make(map[string]bool, len(records))
+	for _, record := range records {
+		known[filepath.Clean(record.LocalFilePath)] = true
+	}
+
+	for _, storageType := range storageTypes {
+		paths, err := listStorageFiles(storage, fm.GetLocalPathForFile(storageType, ""))
+		if err != nil {
+			return report, err
+		}
+		for _, path := range paths {
+			if ctx.Err() != nil {
+				return report, ctx.Err()
+			}
+			if isReconcileSidecar(path, known) {
+				continue
+			}
+			report.Checked++
+			if known[path] {
+				continue
+			}
+			info, err := storage.Stat(path)
+			if err != nil || info.ModTime().After(cutoff) {
+				continue
+			}
+			report.Orphans = append(report.Orphans, path)
+			switch {
+			case opts.AdoptOrphans:
+				err = fm.adoptOrphan(path)
+			case opts.DeleteOrphans:
+				err = fm.DeleteFile(&ManagedFile{FileName: filepath.Base(path), LocalFilePath: path})
+			default:
+				continue
+			}
+			if err != nil {
+				report.Errors[path] = err.Error()
+				continue
+			}
+			report.Repaired++
+		}
+	}
+
+	for _, record := range records {
+		if ctx.Err() != nil {
+			return report, ctx.Err()
+		}
+		_, err := storage.Stat(record.LocalFilePath)
+		// quarantined files keep their records on purpose
+		if !errors.Is(err, fs.ErrNotExist) || integrityFailureOfRecord(record) != nil {
+			continue
+		}
+		report.Ghosts = append(report.Ghosts, record.LocalFilePath)
+		if !opts.RemoveGhosts {
+			continue
+		}
+		if holdOfRecord(record) != nil {
+			report.Errors[record.LocalFilePath] = ErrFileOnHold.Error()
+			continue
+		}
+		err = store.DeleteRecord(record.LocalFilePath)
+		if err != nil {
+			report.Errors[record.LocalFilePath] = err.Error()
+			continue
+		}
+		report.Repaired++
+	}
+
+	if processStore := fm.getProcessStore(); processStore != nil {
+		infos, err := processStore.ListActiveProcesses()
+		if err != nil {
+			return report, err
+		}
+		for _, info := range infos {
+			if _, err := fm.GetProcess(info.ID); err == nil || info.UpdatedAt.After(cutoff) {
+				continue
+			}
+			report.StaleProcesses = append(report.StaleProcesses, info.ID)
+			if !opts.FinishStaleProcesses {
+				continue
+			}
+			err = processStore.SaveProcess(finishedStaleProcess(info))
+			if err != nil {
+				report.Errors[info.ID] = err.Error()
+				continue
+			}
+			report.Repaired++
+		}
+	}
+
+	fm.LogTo("INFO", fmt.Sprintf("[FileManager.Reconcile] checked(%d) orphans(%d) ghosts(%d) stale processes(%d) repaired(%d) errors(%d)\n", report.Checked, len(report.Orphans), len(report.Ghosts), len(report.StaleProcesses), report.Repaired, len(report.Errors)))
+	return report, nil
+}
+
+// isReconcileSidecar reports whether the file belongs to another file rather than being stored on its own: metadata
+// and HTTP header sidecars, pre-compressed variants of known files and errors of the ingest directory.
+func isReconcileSidecar(localFilePath string, known map[string]bool) bool {
+	for _, suffix := range []string{SIDECAR_METADATA_SUFFIX, HTTP_HEADERS_SIDECAR_SUFFIX, INGEST_ERROR_SUFFIX} {
+		if strings.HasSuffix(localFilePath, suffix) {
+			return true
+		}
+	}
+	for _, e := range preCompressEncodings {
+		if strings.HasSuffix(localFilePath, e.extension) && known[strings.TrimSuffix(localFilePath, e.extension)] {
+			return true
+		}
+	}
+	return false
+}
+
+// adoptOrphan persists a record for an orphaned file.
+func (fm *FileManager) adoptOrphan(localFilePath string) error {
+	file, err := fm.loadStoredFile(localFilePath)
+	if err != nil {
+		return err
+	}
+	defer file.ReleaseContent()
+	return fm.PersistManagedFile(file, nil)
+}
+
+// finishedStaleProcess returns the info of a stale process ended with ErrProcessingIncomplete.
+func finishedStaleProcess(info *ProcessInfo) *ProcessInfo {
+	finished := *info
+	now := time.Now()
+	finished.Done = true
+	finished.UpdatedAt = now
+	finished.Status = &ProcessingStatus{
+		ProcessID:         info.ID,
+		TimeStamp:         int(now.UnixNano() / int64(time.Millisecond)),
+		ProcessorName:     "Reconcile",
+		StatusDescription: "Process was abandoned and ended by Reconcile",
+		Error:             fmt.Errorf("%w: abandoned since %s", ErrProcessingIncomplete, info.UpdatedAt.Format(time.RFC3339)),
+		Done:              true,
+	}
+	return &finished
+}
@@ -0,0 +1,322 @@
+package filemanager
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+var (
+	ErrReplicationDisabled     = errors.New("replication is not enabled")
+	ErrReplicationTargetUnset  = errors.New("replication needs a secondary storage")
+	ErrReplicationQueueFull    = errors.New("replication queue is full")
+	ErrReplicationNotDirectory = errors.New("reconciliation needs storages implementing DirStorage")
+)
+
+const (
+	DEFAULT_REPLICATION_WORKERS    = 2
+	DEFAULT_REPLICATION_QUEUE_SIZE = 1000
+)
+
+// ReplicationOptions configure mirroring of public and private files to a secondary storage, e.g. for durability or
+// to migrate from the local disk to object storage. Files are copied under the same path, as read through the
+// FileManager's Storage; wrap the secondary in an EncryptedStorage to keep mirrored copies encrypted.
+type ReplicationOptions struct {
+	Secondary Storage
+	Workers   int // concurrent copies, defaults to 2
+	// QueueSize bounds the pending copies (default 1000). Files that do not fit are left to ReconcileReplication.
+	QueueSize int
+	// MirrorDeletes removes files from the secondary when they are deleted (or moved to the trash).
+	MirrorDeletes bool
+	// OnError is called for failed copies and removals, which are also logged.
+	OnError func(localFilePath string, err error)
+}
+
+type replicationTask struct {
+	localFilePath string
+	remove        bool
+}
+
+type replicator struct {
+	options ReplicationOptions
+	queue   chan replicationTask
+	wg      sync.WaitGroup
+}
+
+// EnableReplication starts the replication workers. From then on every file saved with SaveFile (or restored from
+// the trash or a version) below the public or private base path is copied to the secondary in the background.
+// Files saved before are picked up by ReconcileReplication.
+func (fm *FileManager) EnableReplication(opts ReplicationOptions) error {
+	if opts.Secondary == nil {
+		return ErrReplicationTargetUnset
+	}
+	if opts.Workers <= 0 {
+		opts.Workers = DEFAULT_REPLICATION_WORKERS
+	}
+	if opts.QueueSize <= 0 {
+		opts.QueueSize = DEFAULT_REPLICATION_QUEUE_SIZE
+	}
+	r := &replicator{options: opts, queue: make(chan replicationTask, opts.QueueSize)}
+	for i := 0; i < opts.Workers; i++ {
+		r.wg.Add(1)
+		go fm.runReplicationWorker(r)
+	}
+	fm.mu.Lock()
+	previous := fm.replication
+	fm.replication = r
+	fm.mu.Unlock()
+	if previous != nil {
+		previous.stop()
+	}
+	return nil
+}
+
+// StopReplication finishes the pending copies and stops the replication workers.
+func (fm *FileManager) StopReplication() {
+	fm.mu.Lock()
+	r := fm.replication
+	fm.replication = nil
+	fm.mu.Unlock()
+	if r != nil {
+		r.stop()
+	}
+}
+
+func (fm *FileManager) getReplicator() *replicator {
+	if fm.parent != nil {
+		return fm.parent.getReplicator()
+	}
+	fm.mu.RLock()
+	defer fm.mu.RUnlock()
+	return fm.replication
+}
+
+func (r *replicator) stop() {
+	close(r.queue)
+	r.wg.Wait()
+}
+
+// replicate queues the copy (or removal) of a saved file, if it is a public or private file.
+func (fm *FileManager) replicate(localFilePath string, remove bool) {
+	if fm.parent != nil {
+		fm.parent.replicate(localFilePath, remove)
+		return
+	}
+	fm.mu.RLock()
+	r := fm.replication
+	if r == nil || !fm.isReplicatedPath(localFilePath) || (remove && !r.options.MirrorDeletes) {
+		fm.mu.RUnlock()
+		return
+	}
+	// the read lock keeps StopReplication from closing the queue while sending
+	queued := true
+	select {
+	case r.queue <- replicationTask{localFilePath: localFilePath, remove: remove}:
+	default:
+		queued = false
+	}
+	fm.mu.RUnlock()
+	if !queued {
+		fm.replicationFailed(r, localFilePath, ErrReplicationQueueFull)
+	}
+}
+
+func (fm *FileManager) isReplicatedPath(localFilePath string) bool {
+	for _, base := range []string{fm.publicLocalBasePath, fm.privateLocalBasePath} {
+		relative, err := filepath.Rel(base, localFilePath)
+		if err == nil && relative != "." && !strings.HasPrefix(relative, "..") {
+			return true
+		}
+	}
+	return false
+}
+
+func (fm *FileManager) runReplicationWorker(r *replicator) {
+	defer r.wg.Done()
+	for task := range r.queue {
+		var err error
+		if task.remove {
+			err = r.options.Secondary.Remove(task.localFilePath)
+			if errors.Is(err, fs.ErrNotExist) {
+				err = nil
+			}
+		} else {
+			err = fm.copyToSecondary(r.options.Secondary, task.localFilePath)
+		}
+		if err != nil {
+			fm.replicationFailed(r, task.localFilePath, err)
+			continue
+		}
+		fm.LogTo("DEBUG", fmt.Sprintf("[FileManager.Replication] Replicated file(%s) remove(%v)\n", task.localFilePath, task.remove))
+	}
+}
+
+func (fm *FileManager) copyToSecondary(secondary Storage, localFilePath string) error {
+	storage := fm.GetStorage()
+	info, err := storage.Stat(localFilePath)
+	if errors.Is(err, fs.ErrNotExist) {
+		// deleted again before it was copied
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	data, err := storage.ReadFile(localFilePath)
+	if err != nil {
+		return err
+	}
+	return secondary.WriteFile(localFilePath, data, info.Mode().Perm(), false)
+}
+
+func (fm *FileManager) replicationFailed(r *replicator, localFilePath string, err error) {
+	fm.LogTo("INFO", fmt.Sprintf("[FileManager.Replication] Replicating file(%s) failed: %v\n", localFilePath, err))
+	if r.options.OnError != nil {
+		r.options.OnError(localFilePath, err)
+	}
+}
+
+// ReconcileOptions control ReconcileReplication.
+type ReconcileOptions struct {
+	// Repair copies missing and mismatched files to the secondary.
+	Repair bool
+	// CompareContent compares the content of files, not only their sizes.
+	CompareContent bool
+	// RemoveExtra deletes files only found on the secondary (with Repair).
+	RemoveExtra bool
+}
+
+// ReplicationReport lists the drift found by ReconcileReplication. Paths are local file paths.
+type ReplicationReport struct {
+	Checked    int
+	Missing    []string // not on the secondary
+	Mismatched []string // different size or content on the secondary
+	Extra      []string // only on the secondary
+	Repaired   int
+	Errors     map[string]string
+}
+
+// ReconcileReplication compares all public and private files with the secondary and reports, and with
+// opts.Repair repairs, the drift. Hidden directories like .trash and .versions are skipped. Both storages must
+// implement DirStorage; Extra is only reported if the secondary does.
+func (fm *FileManager) ReconcileReplication(opts ReconcileOptions) (ReplicationReport, error) {
+	report := ReplicationReport{Errors: make(map[string]string)}
+	r := fm.getReplicator()
+	if r == nil {
+		return report, ErrReplicationDisabled
+	}
+	primary, ok := fm.GetStorage().(DirStorage)
+	if !ok {
+		return report, ErrReplicationNotDirectory
+	}
+	secondary := r.options.Secondary
+
+	primaryFiles := make(map[string]bool)
+	for _, base := range []string{fm.publicLocalBasePath, fm.privateLocalBasePath} {
+		paths, err := listStorageFiles(primary, base)
+		if err != nil {
+			return report, err
+		}
+		for _, path := range paths {
+			primaryFiles[path] = true
+			report.Checked++
+			inSync, exists, err := fm.compareWithSecondary(secondary, path, opts.CompareContent)
+			if err != nil {
+				report.Errors[path] = err.Error()
+				continue
+			}
+			if inSync {
+				continue
+			}
+			if exists {
+				report.Mismatched = append(report.Mismatched, path)
+			} else {
+				report.Missing = append(report.Missing, path)
+			}
+			if opts.Repair {
+				err = fm.copyToSecondary(secondary, path)
+				if err != nil {
+					report.Errors[path] = err.Error()
+					continue
+				}
+				report.Repaired++
+			}
+		}
+	}
+
+	if secondaryDirs, ok := secondary.(DirStorage); ok {
+		for _, base := range []string{fm.publicLocalBasePath, fm.privateLocalBasePath} {
+			paths, err := listStorageFiles(secondaryDirs, base)
+			if err != nil {
+				return report, err
+			}
+			for _, path := range paths {
+				if primaryFiles[path] {
+					continue
+				}
+				report.Extra = append(report.Extra, path)
+				if opts.Repair && opts.RemoveExtra {
+					err = secondary.Remove(path)
+					if err != nil {
+						report.Errors[path] = err.Error()
+						continue
+					}
+					report.Repaired++
+				}
+			}
+		}
+	}
+	fm.LogTo("DEBUG", fmt.Sprintf("[FileManager.ReconcileReplication] checked(%d) missing(%d) mismatched(%d) extra(%d) repaired(%d) errors(%d)\n", report.Checked, len(report.Missing), len(report.Mismatched), len(report.Extra), report.Repaired, len(report.Errors)))
+	return report, nil
+}
+
+func (fm *FileManager) compareWithSecondary(secondary Storage, localFilePath string, compareContent bool) (inSync bool, exists bool, err error) {
+	secondaryInfo, err := secondary.Stat(localFilePath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, false, nil
+	}
+	if err != nil {
+		return false, false, err
+	}
+	info, err := fm.GetStorage().Stat(localFilePath)
+	if err != nil {
+		return false, true, err
+	}
+	if info.Size() != secondaryInfo.Size() {
+		return false, true, nil
+	}
+	if !compareContent {
+		return true, true, nil
+	}
+	data, err := fm.GetStorage().ReadFile(localFilePath)
+	if err != nil {
+		return false, true, err
+	}
+	secondaryData, err := secondary.ReadFile(localFilePath)
+	if err != nil {
+		return false, true, err
+	}
+	return bytes.Equal(data, secondaryData), true, nil
+}
+
+// listStorageFiles returns the paths of all files below base, skipping hidden directories.
+func listStorageFiles(storage DirStorage, base string) ([]string, error) {
+	var paths []string
+	err := fs.WalkDir(&storageFS{storage: storage, root: base}, ".", func(name string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() {
+			if name != "." && strings.HasPrefix(entry.Name(), ".") {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		paths = append(paths, filepath.Join(base, filepath.FromSlash(name)))
+		return nil
+	})
+	return paths, err
+}
@@ -0,0 +1,245 @@
+package filemanager
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// ReprocessOptions control ReprocessFiles.
+type ReprocessOptions struct {
+	// ProcessOptions of every process; the Priority defaults to PRIORITY_BATCH.
+	ProcessOptions ProcessOptions
+	// Concurrency is the number of files processed at the same time, 1 by default.
+	Concurrency int
+	// OnProgress is called after every file, from one goroutine at a time.
+	OnProgress func(progress ReprocessProgress)
+}
+
+// ReprocessResult is the outcome of reprocessing one file.
+type ReprocessResult struct {
+	LocalFilePath  string
+	ResultingFiles []ProcessingResultFile
+	// Skipped is set for files skipped as unchanged by SkipUnchanged, ResultingFiles are those of their last run.
+	Skipped bool
+	Err     error
+}
+
+// ReprocessProgress reports how far ReprocessFiles got.
+type ReprocessProgress struct {
+	Total   int
+	Done    int // files finished, including the failed and skipped ones
+	Failed  int
+	Skipped int
+	Last    ReprocessResult // the file finished last
+}
+
+// ReprocessFile runs a recipe on an already stored file, e.g. to regenerate its thumbnails after the sizes of the
+// recipe changed. The file is read from the storage with the metadata of its record. Outputs derived from the file
+// by an earlier process are replaced where the recipe writes to the same target names, whatever the collision
+// policy of the output; outputs of the recipe not written again are deleted afterwards. Both need a metadata store,
+// without one the outputs are stored like those of ProcessFile. If the context ends first, the process is
+// cancelled.
+func (fm *FileManager) ReprocessFile(ctx context.Context, localFilePath string, recipeName string, opts ProcessOptions) ([]ProcessingResultFile, error) {
+	resultingFiles, _, err := fm.reprocessFile(ctx, localFilePath, recipeName, opts)
+	return resultingFiles, err
+}
+
+// reprocessFile is ReprocessFile, reporting whether the file was skipped as unchanged.
+func (fm *FileManager) reprocessFile(ctx context.Context, localFilePath string, recipeName string, opts ProcessOptions) ([]ProcessingResultFile, bool, error) {
+	err := fm.checkOwnsPath(localFilePath)
+	if err != nil {
+		return nil, false, err
+	}
+	// successful runs are recorded even without SkipUnchanged, so the next job with it can skip
+	var runStore ProcessRunStore
+	var digest, checksum string
+	if recipe, ok := fm.root().recipes.Load().get(recipeName); ok && !opts.DryRun {
+		runStore = fm.getProcessRunStore()
+		digest = recipe.Digest(opts.Params)
+	}
+	if runStore != nil && opts.SkipUnchanged {
+		var run *ProcessRun
+		run, checksum = fm.unchangedRun(ctx, runStore, localFilePath, recipeName, digest)
+		if run != nil {
+			fm.LogTo("DEBUG", fmt.Sprintf("[FileManager.ReprocessFile] Skipped unchanged file(%s) for recipe(%s), last processed by process(%s)\n", localFilePath, recipeName, run.ProcessID))
+			return run.ResultingFiles, true, nil
+		}
+	}
+
+	file, err := fm.loadStoredFile(localFilePath)
+	if err != nil {
+		return nil, false, err
+	}
+	defer file.ReleaseContent()
+	if runStore != nil && checksum == "" {
+		sum := sha256.Sum256(file.Content)
+		checksum = hex.EncodeToString(sum[:])
+	}
+	fileProcess := NewFileProcess(file.FileName, recipeName)
+	stop := context.AfterFunc(ctx, func() {
+		fileProcess.cancelUnlessFinished()
+	})
+	defer stop()
+	opts.upload = nil
+	opts.replaceDerivedFrom = localFilePath
+	resultingFiles, err := fm.ProcessFileSync(file, recipeName, fileProcess, opts)
+	if err != nil {
+		if errors.Is(err, ErrProcessCancelled) && ctx.Err() != nil {
+			return nil, false, fmt.Errorf("reprocessing file(%s): %w", localFilePath, ctx.Err())
+		}
+		return nil, false, err
+	}
+	if !opts.DryRun {
+		fm.removeStaleDerivatives(localFilePath, recipeName, fileProcess.ID)
+	}
+	if runStore != nil {
+		err = runStore.SaveProcessRun(&ProcessRun{
+			LocalFilePath:  localFilePath,
+			RecipeName:     recipeName,
+			Checksum:       checksum,
+			RecipeDigest:   digest,
+			ProcessID:      fileProcess.ID,
+			FinishedAt:     time.Now(),
+			ResultingFiles: resultingFiles,
+		})
+		if err != nil {
+			fm.LogTo("INFO", fmt.Sprintf("[FileManager.ReprocessFile] Recording the run of recipe(%s) on file(%s) failed: %v\n", recipeName, localFilePath, err))
+		}
+	}
+	return resultingFiles, false, nil
+}
+
+// ReprocessFiles runs ReprocessFile for every file, reporting the progress after each of them. Failed files do not
+// stop the others; the results are in the order of the paths. The error is only set if the context ended before
+// all files were processed, the files not started are reported with the context's error.
+func (fm *FileManager) ReprocessFiles(ctx context.Context, localFilePaths []string, recipeName string, opts ReprocessOptions) ([]ReprocessResult, error) {
+	concurrency := opts.Concurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	processOptions := opts.ProcessOptions
+	if processOptions.Priority == "" {
+		processOptions.Priority = PRIORITY_BATCH
+	}
+	results := make([]ReprocessResult, len(localFilePaths))
+	progress := ReprocessProgress{Total: len(localFilePaths)}
+	var progressMu sync.Mutex
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for worker := 0; worker < concurrency; worker++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				result := ReprocessResult{LocalFilePath: localFilePaths[i]}
+				result.ResultingFiles, result.Skipped, result.Err = fm.reprocessFile(ctx, localFilePaths[i], recipeName, processOptions)
+				results[i] = result
+				progressMu.Lock()
+				progress.Done++
+				if result.Skipped {
+					progress.Skipped++
+				}
+				if result.Err != nil {
+					progress.Failed++
+					fm.LogTo("INFO", fmt.Sprintf("[FileManager.ReprocessFiles] Reprocessing file(%s) with recipe(%s) failed: %v\n", result.LocalFilePath, recipeName, result.Err))
+				}
+				progress.Last = result
+				if opts.OnProgress != nil {
+					opts.OnProgress(progress)
+				}
+				progressMu.Unlock()
+			}
+		}()
+	}
+	next := 0
+feed:
+	for ; next < len(localFilePaths); next++ {
+		select {
+		case indexes <- next:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(indexes)
+	wg.Wait()
+	if next < len(localFilePaths) {
+		for i := next; i < len(localFilePaths); i++ {
+			results[i] = ReprocessResult{LocalFilePath: localFilePaths[i], Err: ctx.Err()}
+		}
+		return results, ctx.Err()
+	}
+	fm.LogTo("INFO", fmt.Sprintf("[FileManager.ReprocessFiles] Reprocessed %d files with recipe(%s), %d failed, %d skipped as unchanged\n", progress.Total, recipeName, progress.Failed, progress.Skipped))
+	return results, nil
+}
+
+// loadStoredFile reads a stored file with its content from the storage and the metadata of its record. Large
+// content is memory-mapped if enabled, release it with ReleaseContent.
+func (fm *FileManager) loadStoredFile(localFilePath string) (*ManagedFile, error) {
+	file := &ManagedFile{
+		FileName:      filepath.Base(localFilePath),
+		LocalFilePath: localFilePath,
+		MetaData:      make(map[string]any),
+	}
+	err := fm.readContent(file)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("%w: %s", ErrLocalFileNotFound, localFilePath)
+	}
+	if err != nil {
+		return nil, &StorageError{Op: "read", Path: localFilePath, Err: err}
+	}
+	record, err := fm.LoadFileRecord(localFilePath)
+	if err != nil && !errors.Is(err, ErrMetadataNotFound) && !errors.Is(err, ErrMetadataStoreMissing) {
+		file.ReleaseContent()
+		return nil, err
+	}
+	if record != nil {
+		file.FileName = record.FileName
+		file.Owner = record.Owner
+		file.HTTPHeaders = record.HTTPHeaders
+		for key, value := range record.MetaData {
+			// the file is the original of the new outputs
+			if key != METADATA_KEY_DERIVATION && key != METADATA_KEY_LEGAL_HOLD {
+				file.MetaData[key] = value
+			}
+		}
+	}
+	file.FileSize = int64(len(file.Content))
+	file.MimeType = fm.DetectMimeType(file.FileName, file.Content)
+	file.URL, _ = fm.GetPublicUrlForFile(localFilePath)
+	return file, nil
+}
+
+// removeStaleDerivatives deletes the outputs an earlier run of the recipe derived from the original, which the
+// process did not write again. Failures are logged, the reprocessing succeeded anyway.
+func (fm *FileManager) removeStaleDerivatives(original string, recipeName string, processID string) {
+	store := fm.getMetadataStore()
+	if store == nil {
+		return
+	}
+	derived, err := fm.GetDerivedFiles(original)
+	if err != nil {
+		fm.LogTo("INFO", fmt.Sprintf("[FileManager.ReprocessFile] Listing outputs derived from file(%s) failed: %v\n", original, err))
+		return
+	}
+	for _, record := range derived {
+		derivation := derivationOfRecord(record)
+		if derivation.Recipe != recipeName || derivation.ProcessID == processID {
+			continue
+		}
+		if FileExists(record.LocalFilePath) {
+			err = fm.DeleteFile(&ManagedFile{FileName: record.FileName, LocalFilePath: record.LocalFilePath, MetaData: record.MetaData})
+		} else {
+			err = store.DeleteRecord(record.LocalFilePath)
+		}
+		if err != nil {
+			fm.LogTo("INFO", fmt.Sprintf("[FileManager.ReprocessFile] Removing stale output(%s) of file(%s) failed: %v\n", record.LocalFilePath, original, err))
+		}
+	}
+}
@@ -0,0 +1,205 @@
+package filemanager
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"maps"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/disintegration/imaging"
+)
+
+const (
+	DEFAULT_RESPONSIVE_TARGET_FILE_NAME = "images/{metadata.process_id}-{width}w"
+)
+
+var (
+	DefaultResponsiveWidths  = []int{320, 640, 1280, 1920}
+	DefaultResponsiveFormats = []string{"webp", "jpg"}
+)
+
+// ResponsiveImages is a recipe output preset generating every width in every format, instead of hand-written
+// OutputFormats per size. The image is never upscaled, widths larger than the image are replaced by its width.
+type ResponsiveImages struct {
+	Widths  []int    `yaml:"widths"`  // defaults to DefaultResponsiveWidths
+	Formats []string `yaml:"formats"` // most modern first, the last one is the <img> fallback; defaults to DefaultResponsiveFormats
+	// TargetFileName is the template of the stored files without extension. {width} and {format} are replaced
+	// besides {metadata.x}; defaults to DEFAULT_RESPONSIVE_TARGET_FILE_NAME.
+	TargetFileName string          `yaml:"target_file_name"`
+	StorageType    FileStorageType `yaml:"storage_type"` // defaults to public
+	Quality        int             `yaml:"quality"`      // 1-100 for JPEG and WebP, 0 keeps the encoder default
+	Sizes          string          `yaml:"sizes"`        // the sizes attribute, passed through to the result
+	HTTPHeaders    *HTTPHeaders    `yaml:"http_headers"` // overrides the recipe's HTTPHeaders
+	// ContentAddressed stores public images at paths derived from their content, see OutputFormat.ContentAddressed.
+	ContentAddressed bool `yaml:"content_addressed"`
+}
+
+// ResponsiveImageSet is the srcset mapping of the generated images, returned in the final ProcessingStatus.
+type ResponsiveImageSet struct {
+	Sizes   string                  `json:"sizes,omitempty"`
+	Src     string                  `json:"src"` // URL of the largest image in the fallback format
+	Width   int                     `json:"width"`
+	Height  int                     `json:"height"`
+	Sources []ResponsiveImageSource `json:"sources"` // one per format, in the order of ResponsiveImages.Formats
+}
+
+// ResponsiveImageSource lists the images of one format, usable as a <source> of a <picture>.
+type ResponsiveImageSource struct {
+	Format   string            `json:"format"`
+	MimeType string            `json:"type"`
+	Srcset   string            `json:"srcset"` // "url 320w, url 640w, ..."
+	Images   []ResponsiveImage `json:"images"`
+}
+
+type ResponsiveImage struct {
+	Width         int    `json:"width"`
+	Height        int    `json:"height"`
+	URL           string `json:"url"`
+	LocalFilePath string `json:"localFilePath"`
+	FileSize      int64  `json:"fileSize"`
+}
+
+func (preset *ResponsiveImages) clone() *ResponsiveImages {
+	if preset == nil {
+		return nil
+	}
+	clone := *preset
+	clone.Widths = append([]int(nil), preset.Widths...)
+	clone.Formats = append([]string(nil), preset.Formats...)
+	clone.HTTPHeaders = preset.HTTPHeaders.clone()
+	return &clone
+}
+
+// widthsFor returns the sorted, distinct widths not larger than the image. If larger widths were requested, the
+// image width is added instead, so the largest screens still get the full resolution.
+func (preset *ResponsiveImages) widthsFor(imageWidth int) []int {
+	widths := preset.Widths
+	if len(widths) == 0 {
+		widths = DefaultResponsiveWidths
+	}
+	sorted := append([]int(nil), widths...)
+	sort.Ints(sorted)
+	var result []int
+	for _, width := range sorted {
+		if width > imageWidth {
+			width = imageWidth
+		}
+		if len(result) > 0 && result[len(result)-1] == width {
+			continue
+		}
+		result = append(result, width)
+	}
+	return result
+}
+
+// generateResponsiveImages resizes the processed image to the widths of the recipe's preset, stores every size in
+// every format and returns the stored files with their srcset mapping. Files that are not images are skipped.
+func (fm *FileManager) generateResponsiveImages(source *ManagedFile, original *ManagedFile, recipe Recipe) ([]*ManagedFile, *ResponsiveImageSet, error) {
+	preset := recipe.ResponsiveImages
+	if preset == nil || !isImageFile(source) {
+		return nil, nil, nil
+	}
+	formats := preset.Formats
+	if len(formats) == 0 {
+		formats = DefaultResponsiveFormats
+	}
+	storageType := preset.StorageType
+	if storageType == "" {
+		storageType = FileStorageTypePublic
+	}
+	if storageType != FileStorageTypePublic && storageType != FileStorageTypePrivate && storageType != FileStorageTypeTemp {
+		return nil, nil, fmt.Errorf("%w: %s", ErrInvalidStorageType, storageType)
+	}
+	targetFileName := preset.TargetFileName
+	if targetFileName == "" {
+		targetFileName = DEFAULT_RESPONSIVE_TARGET_FILE_NAME
+	}
+	if preset.Quality < 0 || preset.Quality > 100 {
+		return nil, nil, fmt.Errorf("invalid responsive image quality: %d", preset.Quality)
+	}
+	for _, width := range preset.Widths {
+		if width <= 0 {
+			return nil, nil, fmt.Errorf("invalid responsive image width: %d", width)
+		}
+	}
+
+	img, err := imaging.Decode(bytes.NewReader(source.Content), imaging.AutoOrientation(true))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to decode image: %v", err)
+	}
+	profile := ExtractICCProfile(source.Content)
+	widths := preset.widthsFor(img.Bounds().Dx())
+	resized := make([]image.Image, len(widths))
+	for i, width := range widths {
+		resized[i] = img
+		if width != img.Bounds().Dx() {
+			resized[i] = imaging.Resize(img, width, 0, imaging.Lanczos)
+		}
+	}
+	metaData := source.MetaData
+	if metaData == nil {
+		metaData = original.MetaData
+	}
+
+	set := &ResponsiveImageSet{Sizes: preset.Sizes}
+	var outputFiles []*ManagedFile
+	for _, format := range formats {
+		format = NormalizeOutputFormat(format)
+		responsiveSource := ResponsiveImageSource{Format: format, MimeType: MimeTypeForOutputFormat(format)}
+		var srcset []string
+		for i, width := range widths {
+			content, err := encodeImage(resized[i], format, imageEncodeOptions{quality: preset.Quality}, profile)
+			if err != nil {
+				return nil, nil, fmt.Errorf("failed to encode %dw %s: %w", width, format, err)
+			}
+			filePath := strings.NewReplacer("{width}", strconv.Itoa(width), "{format}", format).Replace(targetFileName)
+			filePath = ReplaceFileNameVariables(filePath, source)
+			fullFilePath, _, fileName := getFilePathAndName("", fileNameWithFormat(filePath, format))
+			outputFile := &ManagedFile{
+				FileName:    fileName,
+				MetaData:    maps.Clone(metaData),
+				Content:     content,
+				FileSize:    int64(len(content)),
+				MimeType:    responsiveSource.MimeType,
+				Owner:       original.Owner,
+				HTTPHeaders: recipe.HTTPHeaders.merge(preset.HTTPHeaders),
+			}
+			delete(outputFile.MetaData, METADATA_KEY_IMAGE)
+			setImageInfo(outputFile)
+			// the storage type is validated above
+			localFilePath, outputStorageType, _ := fm.routedOutputPath(outputFile, storageType, fullFilePath)
+			outputFile.LocalFilePath = localFilePath
+			if outputStorageType == FileStorageTypePublic {
+				outputFile.URL, _ = fm.GetPublicUrlForFile(outputFile.LocalFilePath)
+			}
+			if preset.ContentAddressed && outputStorageType == FileStorageTypePublic {
+				err = fm.saveContentAddressed(outputFile)
+			} else {
+				err = fm.SaveFile(outputFile)
+			}
+			if err != nil {
+				return nil, nil, fmt.Errorf("failed to save %s: %w", filepath.Base(outputFile.LocalFilePath), err)
+			}
+			outputFiles = append(outputFiles, outputFile)
+			responsiveImage := ResponsiveImage{
+				Width:         width,
+				Height:        resized[i].Bounds().Dy(),
+				URL:           outputFile.URL,
+				LocalFilePath: outputFile.LocalFilePath,
+				FileSize:      outputFile.FileSize,
+			}
+			responsiveSource.Images = append(responsiveSource.Images, responsiveImage)
+			if outputFile.URL != "" {
+				srcset = append(srcset, fmt.Sprintf("%s %dw", outputFile.URL, width))
+			}
+			set.Src, set.Width, set.Height = responsiveImage.URL, responsiveImage.Width, responsiveImage.Height
+		}
+		responsiveSource.Srcset = strings.Join(srcset, ", ")
+		set.Sources = append(set.Sources, responsiveSource)
+	}
+	return outputFiles, set, nil
+}
@@ -0,0 +1,52 @@
+package filemanager
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+const DEFAULT_RETENTION_INTERVAL = time.Hour
+
+// RunRetention runs all retention tasks once: purging expired trash entries and, if upload cleanup is enabled,
+// sweeping orphaned upload files.
+func (fm *FileManager) RunRetention() error {
+	purged, err := fm.PurgeTrash()
+	if err != nil {
+		fm.LogTo("INFO", fmt.Sprintf("[FileManager.RunRetention] Purging trash failed: %v\n", err))
+		return err
+	}
+	if purged > 0 {
+		fm.LogTo("DEBUG", fmt.Sprintf("[FileManager.RunRetention] Purged %d trash entries\n", purged))
+	}
+	if cleanup := fm.getUploadCleanup(); cleanup != nil {
+		removed, err := fm.SweepOrphanedUploads(cleanup.OrphanMaxAge)
+		if err != nil {
+			fm.LogTo("INFO", fmt.Sprintf("[FileManager.RunRetention] Sweeping orphaned uploads failed: %v\n", err))
+			return err
+		}
+		if removed > 0 {
+			fm.LogTo("DEBUG", fmt.Sprintf("[FileManager.RunRetention] Removed %d orphaned upload files\n", removed))
+		}
+	}
+	return nil
+}
+
+// StartRetentionWorker runs RunRetention every interval until the context is cancelled.
+func (fm *FileManager) StartRetentionWorker(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		interval = DEFAULT_RETENTION_INTERVAL
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				fm.RunRetention()
+			}
+		}
+	}()
+}
@@ -0,0 +1,106 @@
+package filemanager
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"gopkg.in/yaml.v2"
+)
+
+var (
+	ErrNoRecipeRoute = errors.New("no recipe route matches the file")
+)
+
+// RecipeRoute selects a recipe for files matching all of its conditions. Empty conditions match every file.
+type RecipeRoute struct {
+	Recipe      string   `yaml:"recipe"`
+	MimeTypes   []string `yaml:"mime_types"` // matched like accepted_mime_types of recipes, e.g. "image/" or "application/pdf"
+	MinFileSize int64    `yaml:"min_file_size"`
+	MaxFileSize int64    `yaml:"max_file_size"` // 0 means no limit
+	// MetaData values must equal the file's metadata values (compared as strings); "*" only requires the key to be set.
+	MetaData map[string]string `yaml:"metadata"`
+}
+
+// RecipeRouting maps uploaded files to recipe names. Routes are checked in order, the first match wins;
+// DefaultRecipe is used if no route matches.
+type RecipeRouting struct {
+	Routes        []RecipeRoute `yaml:"routes"`
+	DefaultRecipe string        `yaml:"default_recipe"`
+}
+
+// SetRecipeRouting configures the routing used by ResolveRecipeForFile.
+func (fm *FileManager) SetRecipeRouting(routing RecipeRouting) {
+	fm.mu.Lock()
+	defer fm.mu.Unlock()
+	fm.recipeRouting = &routing
+}
+
+// LoadRecipeRouting reads the routing from a YAML file. Keep it outside of the recipes directory, as LoadRecipes
+// treats every YAML file there as a recipe.
+func (fm *FileManager) LoadRecipeRouting(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var routing RecipeRouting
+	err = yaml.Unmarshal(data, &routing)
+	if err != nil {
+		return fmt.Errorf("failed to parse recipe routing(%s): %v", path, err)
+	}
+	fm.SetRecipeRouting(routing)
+	return nil
+}
+
+// ResolveRecipeForFile returns the name of the recipe the routing selects for the file. It returns
+// ErrNoRecipeRoute if neither a route nor a default recipe applies and ErrRecipeNotFound if the selected
+// recipe is not loaded.
+func (fm *FileManager) ResolveRecipeForFile(file *ManagedFile) (string, error) {
+	root := fm.root()
+	root.mu.RLock()
+	routing := root.recipeRouting
+	root.mu.RUnlock()
+
+	recipeName := ""
+	if routing != nil {
+		for _, route := range routing.Routes {
+			if route.matches(file) {
+				recipeName = route.Recipe
+				break
+			}
+		}
+		if recipeName == "" {
+			recipeName = routing.DefaultRecipe
+		}
+	}
+	if recipeName == "" {
+		return "", fmt.Errorf("%w: file(%s) mimetype(%s)", ErrNoRecipeRoute, file.FileName, file.MimeType)
+	}
+	if _, ok := root.recipes.Load().get(recipeName); !ok {
+		return "", fmt.Errorf("%w: %s", ErrRecipeNotFound, recipeName)
+	}
+	if err := fm.checkRecipeAllowed(recipeName); err != nil {
+		return "", err
+	}
+	return recipeName, nil
+}
+
+func (route RecipeRoute) matches(file *ManagedFile) bool {
+	if len(route.MimeTypes) > 0 && !isValidMimeType(file.MimeType, route.MimeTypes, false) {
+		return false
+	}
+	fileSize := file.FileSize
+	if fileSize == 0 {
+		fileSize = int64(len(file.Content))
+	}
+	if fileSize < route.MinFileSize || (route.MaxFileSize > 0 && fileSize > route.MaxFileSize) {
+		return false
+	}
+	for key, expected := range route.MetaData {
+		value, ok := file.MetaData[key]
+		if !ok || (expected != "*" && fmt.Sprintf("%v", value) != expected) {
+			return false
+		}
+	}
+	return true
+}
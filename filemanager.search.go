@@ -0,0 +1,268 @@
+package filemanager
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+var (
+	ErrSearchIndexMissing = errors.New("no search index configured")
+)
+
+// SEARCH_MAX_INDEXED_TEXT_BYTES limits how much text content of a single file is indexed.
+const SEARCH_MAX_INDEXED_TEXT_BYTES = 10 << 20
+
+// SearchDocument is the indexed representation of a stored file.
+// Fields hold filterable values such as "mime_type", "exif.Model" or "metadata.user_id".
+type SearchDocument struct {
+	ID       string // the local file path
+	FileName string
+	MimeType string
+	Text     string
+	Fields   map[string]string
+}
+
+// SearchHit is a single search result, ordered by descending score.
+type SearchHit struct {
+	ID       string  `json:"id"`
+	FileName string  `json:"fileName"`
+	MimeType string  `json:"mimetype"`
+	Score    float64 `json:"score"`
+}
+
+// SearchIndex indexes stored files for full-text and metadata search. The package bundles no search engine, to keep
+// bleve and its dependencies out of the module; persistent implementations backed by one (bleve, Elasticsearch,
+// ...) can be plugged in via fm.SetSearchIndex.
+type SearchIndex interface {
+	IndexDocument(doc SearchDocument) error
+	DeleteDocument(id string) error
+	// Search returns documents containing all query terms (an empty query matches all documents) whose fields
+	// equal all filter values (case-insensitive).
+	Search(query string, filters map[string]string) ([]SearchHit, error)
+}
+
+// SetSearchIndex enables indexing of all output files of ProcessFile.
+func (fm *FileManager) SetSearchIndex(index SearchIndex) {
+	fm.mu.Lock()
+	defer fm.mu.Unlock()
+	fm.searchIndex = index
+}
+
+func (fm *FileManager) getSearchIndex() SearchIndex {
+	if fm.parent != nil {
+		return fm.parent.getSearchIndex()
+	}
+	fm.mu.RLock()
+	defer fm.mu.RUnlock()
+	return fm.searchIndex
+}
+
+// Search queries the configured search index for files by name, extracted text, EXIF fields and custom metadata.
+func (fm *FileManager) Search(query string, filters map[string]string) ([]SearchHit, error) {
+	index := fm.getSearchIndex()
+	if index == nil {
+		return nil, ErrSearchIndexMissing
+	}
+	hits, err := index.Search(query, filters)
+	if err != nil || fm.tenant == nil {
+		return hits, err
+	}
+	// the index is shared by all tenants
+	tenantHits := []SearchHit{}
+	for _, hit := range hits {
+		if fm.ownsPath(hit.ID) {
+			tenantHits = append(tenantHits, hit)
+		}
+	}
+	return tenantHits, nil
+}
+
+// IndexManagedFile adds or replaces a file in the search index.
+func (fm *FileManager) IndexManagedFile(file *ManagedFile) error {
+	index := fm.getSearchIndex()
+	if index == nil {
+		return ErrSearchIndexMissing
+	}
+	return index.IndexDocument(NewSearchDocument(file))
+}
+
+// NewSearchDocument builds the search document of a file: text content for text-like MIME types,
+// EXIF fields as "exif.<tag>" and scalar metadata values as "metadata.<key>".
+func NewSearchDocument(file *ManagedFile) SearchDocument {
+	doc := SearchDocument{
+		ID:       file.LocalFilePath,
+		FileName: file.FileName,
+		MimeType: file.MimeType,
+		Fields: map[string]string{
+			"file_name": file.FileName,
+			"mime_type": file.MimeType,
+		},
+	}
+	if file.Owner != "" {
+		doc.Fields["owner"] = file.Owner
+	}
+	if isTextLikeMimeType(file.MimeType) {
+		content := file.Content
+		if len(content) > SEARCH_MAX_INDEXED_TEXT_BYTES {
+			content = content[:SEARCH_MAX_INDEXED_TEXT_BYTES]
+		}
+		doc.Text = string(content)
+	}
+	for key, value := range file.MetaData {
+		switch typed := value.(type) {
+		case map[string]string:
+			for subKey, subValue := range typed {
+				doc.Fields[key+"."+subKey] = subValue
+			}
+		case map[string]any:
+			for subKey, subValue := range typed {
+				if isScalar(subValue) {
+					doc.Fields[key+"."+subKey] = fmt.Sprintf("%v", subValue)
+				}
+			}
+		default:
+			if isScalar(value) {
+				doc.Fields["metadata."+key] = fmt.Sprintf("%v", value)
+			}
+		}
+	}
+	return doc
+}
+
+func isScalar(value any) bool {
+	switch value.(type) {
+	case string, bool, int, int32, int64, uint, uint32, uint64, float32, float64:
+		return true
+	}
+	return false
+}
+
+func isTextLikeMimeType(mimeType string) bool {
+	mimeType = strings.ToLower(mimeType)
+	if strings.HasPrefix(mimeType, "text/") {
+		return true
+	}
+	for _, textLike := range []string{"application/json", "application/xml", "application/x-yaml", "application/yaml", "+json", "+xml"} {
+		if strings.Contains(mimeType, textLike) {
+			return true
+		}
+	}
+	return false
+}
+
+// MemorySearchIndex is an in-memory inverted index with TF-IDF scoring, suitable for small to medium collections
+// and tests. It is not persisted.
+type MemorySearchIndex struct {
+	mu        sync.RWMutex
+	documents map[string]SearchDocument
+	postings  map[string]map[string]int // term -> document ID -> term frequency
+}
+
+func NewMemorySearchIndex() *MemorySearchIndex {
+	return &MemorySearchIndex{
+		documents: make(map[string]SearchDocument),
+		postings:  make(map[string]map[string]int),
+	}
+}
+
+func (idx *MemorySearchIndex) IndexDocument(doc SearchDocument) error {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.deleteLocked(doc.ID)
+	idx.documents[doc.ID] = doc
+
+	terms := tokenizeSearchText(doc.FileName + " " + doc.Text)
+	for _, value := range doc.Fields {
+		terms = append(terms, tokenizeSearchText(value)...)
+	}
+	for _, term := range terms {
+		if idx.postings[term] == nil {
+			idx.postings[term] = make(map[string]int)
+		}
+		idx.postings[term][doc.ID]++
+	}
+	return nil
+}
+
+func (idx *MemorySearchIndex) DeleteDocument(id string) error {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.deleteLocked(id)
+	return nil
+}
+
+func (idx *MemorySearchIndex) deleteLocked(id string) {
+	if _, ok := idx.documents[id]; !ok {
+		return
+	}
+	delete(idx.documents, id)
+	for term, docs := range idx.postings {
+		delete(docs, id)
+		if len(docs) == 0 {
+			delete(idx.postings, term)
+		}
+	}
+}
+
+func (idx *MemorySearchIndex) Search(query string, filters map[string]string) ([]SearchHit, error) {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	terms := tokenizeSearchText(query)
+	scores := make(map[string]float64)
+	if len(terms) == 0 {
+		for id := range idx.documents {
+			scores[id] = 0
+		}
+	}
+	for i, term := range terms {
+		docs := idx.postings[term]
+		idf := math.Log(1 + float64(len(idx.documents))/float64(len(docs)+1))
+		next := make(map[string]float64)
+		for id, frequency := range docs {
+			previous, ok := scores[id]
+			if i > 0 && !ok {
+				continue
+			}
+			next[id] = previous + float64(frequency)*idf
+		}
+		scores = next
+	}
+
+	hits := []SearchHit{}
+	for id, score := range scores {
+		doc := idx.documents[id]
+		if !matchesSearchFilters(doc, filters) {
+			continue
+		}
+		hits = append(hits, SearchHit{ID: id, FileName: doc.FileName, MimeType: doc.MimeType, Score: score})
+	}
+	sort.Slice(hits, func(i, j int) bool {
+		if hits[i].Score == hits[j].Score {
+			return hits[i].ID < hits[j].ID
+		}
+		return hits[i].Score > hits[j].Score
+	})
+	return hits, nil
+}
+
+func matchesSearchFilters(doc SearchDocument, filters map[string]string) bool {
+	for key, expected := range filters {
+		value, ok := doc.Fields[key]
+		if !ok || !strings.EqualFold(value, expected) {
+			return false
+		}
+	}
+	return true
+}
+
+func tokenizeSearchText(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
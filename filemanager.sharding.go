@@ -0,0 +1,137 @@
+package filemanager
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	DEFAULT_SHARD_LEVELS = 1
+	DEFAULT_SHARD_WIDTH  = 2
+	MAX_SHARD_LEVELS     = 4
+	MAX_SHARD_WIDTH      = 8
+)
+
+var (
+	ErrInvalidSharding = errors.New("invalid sharding options")
+)
+
+// ShardingOptions spread the files of a directory over subdirectories named by the hash of their path, so no
+// directory grows to millions of files: with the defaults, images/photo.jpg is stored as images/3f/photo.jpg.
+type ShardingOptions struct {
+	// Levels is the number of nested shard directories, DEFAULT_SHARD_LEVELS by default.
+	Levels int `yaml:"levels"`
+	// Width is the number of hex characters of the hash per shard directory, DEFAULT_SHARD_WIDTH (256 directories
+	// per level) by default.
+	Width int `yaml:"width"`
+}
+
+func (opts ShardingOptions) validate() error {
+	if opts.Levels < 0 || opts.Levels > MAX_SHARD_LEVELS {
+		return fmt.Errorf("%w: levels %d, at most %d", ErrInvalidSharding, opts.Levels, MAX_SHARD_LEVELS)
+	}
+	if opts.Width < 0 || opts.Width > MAX_SHARD_WIDTH {
+		return fmt.Errorf("%w: width %d, at most %d", ErrInvalidSharding, opts.Width, MAX_SHARD_WIDTH)
+	}
+	return nil
+}
+
+func (opts ShardingOptions) withDefaults() ShardingOptions {
+	if opts.Levels == 0 {
+		opts.Levels = DEFAULT_SHARD_LEVELS
+	}
+	if opts.Width == 0 {
+		opts.Width = DEFAULT_SHARD_WIDTH
+	}
+	return opts
+}
+
+// EnableSharding makes GetLocalPathForFile, and with it every output, store files in shard directories. URLs keep
+// the unsharded paths: GetPublicUrlForFile removes the shard directories, and FileServer, ManagedFile.Open and
+// GetLocalPathOfUrl find the sharded files by them. Files stored before stay where they are and are found under
+// their plain paths. Tenant views share the sharding of their FileManager.
+func (fm *FileManager) EnableSharding(opts ShardingOptions) error {
+	err := opts.validate()
+	if err != nil {
+		return err
+	}
+	opts = opts.withDefaults()
+	root := fm.root()
+	root.mu.Lock()
+	defer root.mu.Unlock()
+	root.sharding = &opts
+	return nil
+}
+
+func (fm *FileManager) getSharding() *ShardingOptions {
+	root := fm.root()
+	root.mu.RLock()
+	defer root.mu.RUnlock()
+	return root.sharding
+}
+
+// shards returns the shard directories of a slash-separated path relative to the base path of its storage type.
+func (opts ShardingOptions) shards(relative string) []string {
+	sum := sha256.Sum256([]byte(relative))
+	hash := hex.EncodeToString(sum[:])
+	shards := make([]string, opts.Levels)
+	for i := range shards {
+		shards[i] = hash[i*opts.Width : (i+1)*opts.Width]
+	}
+	return shards
+}
+
+// shardPath inserts the shard directories before the file name of a relative path.
+func (fm *FileManager) shardPath(relative string) string {
+	opts := fm.getSharding()
+	if opts == nil {
+		return relative
+	}
+	relative = strings.TrimPrefix(path.Clean("/"+filepath.ToSlash(relative)), "/")
+	if relative == "" {
+		return relative
+	}
+	dir, name := path.Split(relative)
+	return path.Join(append(append([]string{dir}, opts.shards(relative)...), name)...)
+}
+
+// unshardPath removes the shard directories from a relative path, which is returned as it is if it is not the
+// sharded path of a file.
+func (fm *FileManager) unshardPath(relative string) string {
+	opts := fm.getSharding()
+	if opts == nil {
+		return relative
+	}
+	cleaned := strings.TrimPrefix(path.Clean("/"+filepath.ToSlash(relative)), "/")
+	segments := strings.Split(cleaned, "/")
+	if len(segments) <= opts.Levels {
+		return relative
+	}
+	dirs := len(segments) - 1 - opts.Levels
+	plain := path.Join(path.Join(segments[:dirs]...), segments[len(segments)-1])
+	for i, shard := range opts.shards(plain) {
+		if segments[dirs+i] != shard {
+			return relative
+		}
+	}
+	return plain
+}
+
+// storedLocalPath returns the local path of a file by its unsharded path relative to the base path of the storage
+// type: the sharded path if the file is stored there, the plain path otherwise.
+func (fm *FileManager) storedLocalPath(storageType FileStorageType, relative string) string {
+	plain := path.Join(fm.GetLocalPathForFile(storageType, ""), relative)
+	if fm.getSharding() == nil {
+		return plain
+	}
+	sharded := fm.GetLocalPathForFile(storageType, relative)
+	if _, err := fm.GetStorage().Stat(sharded); err == nil {
+		return sharded
+	}
+	return plain
+}
@@ -0,0 +1,537 @@
+package filemanager
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"path"
+	"strconv"
+	"strings"
+)
+
+const (
+	PPTX_MIME_TYPE = "application/vnd.openxmlformats-officedocument.presentationml.presentation"
+	ODP_MIME_TYPE  = "application/vnd.oasis.opendocument.presentation"
+)
+
+// slideText is the text of a slide of a presentation.
+type slideText struct {
+	title  string
+	blocks []slideBlock
+	notes  []string // paragraphs of the speaker notes
+}
+
+// slideBlock is a paragraph, a bullet point or, if table is set, a table of a slide.
+type slideBlock struct {
+	text   string
+	bullet bool
+	level  int // bullet nesting, 0 based
+	table  [][]string
+}
+
+// slideShape is a text shape of a slide: its placeholder type ("title", "body", ... or "" for text boxes) and its
+// paragraphs.
+type slideShape struct {
+	placeholder string
+	blocks      []slideBlock
+}
+
+// isPresentation reports whether the MIME type is a presentation the FormatConverterPlugin extracts text from.
+func isPresentation(mimeType string) bool {
+	mimeType = strings.ToLower(mimeType)
+	return mimeType == PPTX_MIME_TYPE || mimeType == ODP_MIME_TYPE
+}
+
+// parseSlides reads the slides of a pptx or odp presentation in order. The archive should be checked with
+// CheckZipArchive first.
+func parseSlides(content []byte, mimeType string) ([]slideText, error) {
+	archive, err := zip.NewReader(bytes.NewReader(content), int64(len(content)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open presentation: %v", err)
+	}
+	parts := map[string]*zip.File{}
+	for _, file := range archive.File {
+		parts[file.Name] = file
+	}
+	if strings.ToLower(mimeType) == ODP_MIME_TYPE {
+		return parseODPSlides(parts)
+	}
+	return parsePPTXSlides(parts)
+}
+
+// decodePart runs parse on the XML of the archive part, missing parts are skipped.
+func decodePart(parts map[string]*zip.File, name string, parse func(decoder *xml.Decoder) error) error {
+	file, ok := parts[name]
+	if !ok {
+		return nil
+	}
+	r, err := file.Open()
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %v", name, err)
+	}
+	defer r.Close()
+	err = parse(xml.NewDecoder(r))
+	if err != nil {
+		return fmt.Errorf("failed to parse %s: %v", name, err)
+	}
+	return nil
+}
+
+// partRelationships returns the targets of the relationships of a part by id, resolved to part names.
+func partRelationships(parts map[string]*zip.File, partName string) (map[string]string, map[string]string, error) {
+	targets := map[string]string{}
+	types := map[string]string{}
+	relsName := path.Join(path.Dir(partName), "_rels", path.Base(partName)+".rels")
+	err := decodePart(parts, relsName, func(decoder *xml.Decoder) error {
+		for {
+			token, err := decoder.Token()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			element, ok := token.(xml.StartElement)
+			if ok && element.Name.Local == "Relationship" {
+				id := xmlAttr(element, "Id")
+				targets[id] = path.Join(path.Dir(partName), xmlAttr(element, "Target"))
+				types[id] = path.Base(xmlAttr(element, "Type"))
+			}
+		}
+	})
+	return targets, types, err
+}
+
+// parsePPTXSlides reads the slides in the order of ppt/presentation.xml, with the notes of their notes slides.
+func parsePPTXSlides(parts map[string]*zip.File) ([]slideText, error) {
+	const presentation = "ppt/presentation.xml"
+	if _, ok := parts[presentation]; !ok {
+		return nil, fmt.Errorf("failed to read pptx: %s not found", presentation)
+	}
+	targets, _, err := partRelationships(parts, presentation)
+	if err != nil {
+		return nil, err
+	}
+	var slideParts []string
+	err = decodePart(parts, presentation, func(decoder *xml.Decoder) error {
+		for {
+			token, err := decoder.Token()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			element, ok := token.(xml.StartElement)
+			if ok && element.Name.Local == "sldId" {
+				slideParts = append(slideParts, targets[xmlRelationshipID(element)])
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	slides := make([]slideText, 0, len(slideParts))
+	for _, slidePart := range slideParts {
+		var shapes []slideShape
+		err = decodePart(parts, slidePart, func(decoder *xml.Decoder) error {
+			shapes, err = parsePPTXShapes(decoder)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		slide := slideText{}
+		for _, shape := range shapes {
+			switch shape.placeholder {
+			case "title", "ctrTitle":
+				var title []string
+				for _, block := range shape.blocks {
+					title = append(title, block.text)
+				}
+				slide.title = strings.Join(title, " ")
+			case "sldNum", "dt", "ftr", "hdr":
+				// slide numbers, dates and footers repeat on every slide
+			default:
+				slide.blocks = append(slide.blocks, shape.blocks...)
+			}
+		}
+
+		slideTargets, slideTypes, err := partRelationships(parts, slidePart)
+		if err != nil {
+			return nil, err
+		}
+		for id, relType := range slideTypes {
+			if relType != "notesSlide" {
+				continue
+			}
+			var noteShapes []slideShape
+			err = decodePart(parts, slideTargets[id], func(decoder *xml.Decoder) error {
+				noteShapes, err = parsePPTXShapes(decoder)
+				return err
+			})
+			if err != nil {
+				return nil, err
+			}
+			for _, shape := range noteShapes {
+				if shape.placeholder != "body" {
+					// the slide image and number of the notes page
+					continue
+				}
+				for _, block := range shape.blocks {
+					slide.notes = append(slide.notes, block.text)
+				}
+			}
+		}
+		slides = append(slides, slide)
+	}
+	return slides, nil
+}
+
+// parsePPTXShapes reads the text shapes and tables of a slide or notes slide. Paragraphs of body placeholders are
+// bullet points, those of other shapes (subtitles, text boxes) plain paragraphs.
+func parsePPTXShapes(decoder *xml.Decoder) ([]slideShape, error) {
+	var shapes []slideShape
+	var shape *slideShape
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			return shapes, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch element := token.(type) {
+		case xml.StartElement:
+			switch element.Name.Local {
+			case "sp":
+				shapes = append(shapes, slideShape{})
+				shape = &shapes[len(shapes)-1]
+			case "ph":
+				if shape != nil {
+					shape.placeholder = xmlAttr(element, "type")
+					if shape.placeholder == "" {
+						// placeholders without type are content placeholders
+						shape.placeholder = "body"
+					}
+				}
+			case "p":
+				block, err := parseDrawingMLParagraph(decoder)
+				if err != nil {
+					return nil, err
+				}
+				if block.text == "" {
+					continue
+				}
+				if shape == nil {
+					// paragraphs outside of shapes, e.g. in diagrams
+					shapes = append(shapes, slideShape{})
+					shape = &shapes[len(shapes)-1]
+				}
+				block.bullet = shape.placeholder == "body" || shape.placeholder == "obj"
+				shape.blocks = append(shape.blocks, block)
+			case "tbl":
+				table, err := parseDrawingMLTable(decoder)
+				if err != nil {
+					return nil, err
+				}
+				shapes = append(shapes, slideShape{blocks: []slideBlock{{table: table}}})
+				shape = nil
+			}
+		case xml.EndElement:
+			if element.Name.Local == "sp" {
+				shape = nil
+			}
+		}
+	}
+}
+
+// parseDrawingMLParagraph reads an a:p up to its end element.
+func parseDrawingMLParagraph(decoder *xml.Decoder) (slideBlock, error) {
+	var block slideBlock
+	var text strings.Builder
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return block, err
+		}
+		switch element := token.(type) {
+		case xml.StartElement:
+			switch element.Name.Local {
+			case "pPr":
+				block.level, _ = strconv.Atoi(xmlAttr(element, "lvl"))
+			case "t":
+				var t string
+				err = decoder.DecodeElement(&t, &element)
+				if err != nil {
+					return block, err
+				}
+				text.WriteString(t)
+			case "br":
+				text.WriteString("\n")
+			}
+		case xml.EndElement:
+			if element.Name.Local == "p" {
+				block.text = strings.TrimSpace(text.String())
+				return block, nil
+			}
+		}
+	}
+}
+
+// parseDrawingMLTable reads an a:tbl up to its end element.
+func parseDrawingMLTable(decoder *xml.Decoder) ([][]string, error) {
+	var rows [][]string
+	var cell []string
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return nil, err
+		}
+		switch element := token.(type) {
+		case xml.StartElement:
+			switch element.Name.Local {
+			case "tr":
+				rows = append(rows, nil)
+			case "tc":
+				cell = nil
+			case "p":
+				block, err := parseDrawingMLParagraph(decoder)
+				if err != nil {
+					return nil, err
+				}
+				if block.text != "" {
+					cell = append(cell, block.text)
+				}
+			}
+		case xml.EndElement:
+			switch element.Name.Local {
+			case "tc":
+				if len(rows) > 0 {
+					rows[len(rows)-1] = append(rows[len(rows)-1], strings.Join(cell, " "))
+				}
+			case "tbl":
+				return rows, nil
+			}
+		}
+	}
+}
+
+// parseODPSlides reads the draw:page elements of content.xml. Frames of class "title" are the slide title, text in
+// lists bullet points and frames of class "notes" in presentation:notes the speaker notes.
+func parseODPSlides(parts map[string]*zip.File) ([]slideText, error) {
+	if _, ok := parts["content.xml"]; !ok {
+		return nil, fmt.Errorf("failed to read odp: content.xml not found")
+	}
+	var slides []slideText
+	err := decodePart(parts, "content.xml", func(decoder *xml.Decoder) error {
+		var slide *slideText
+		frameClass := ""
+		inNotes := false
+		listDepth := 0
+		for {
+			token, err := decoder.Token()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			switch element := token.(type) {
+			case xml.StartElement:
+				switch element.Name.Local {
+				case "page":
+					slides = append(slides, slideText{})
+					slide = &slides[len(slides)-1]
+				case "notes":
+					inNotes = true
+				case "frame":
+					frameClass = xmlAttr(element, "class")
+				case "list":
+					listDepth++
+				case "p", "h":
+					text, err := readODFText(decoder, element.Name.Local)
+					if err != nil {
+						return err
+					}
+					if slide == nil || text == "" {
+						continue
+					}
+					switch {
+					case inNotes:
+						if frameClass == "notes" {
+							slide.notes = append(slide.notes, text)
+						}
+					case frameClass == "title":
+						slide.title = strings.TrimSpace(slide.title + " " + text)
+					case frameClass == "page-number" || frameClass == "footer" || frameClass == "date-time" || frameClass == "header":
+					default:
+						slide.blocks = append(slide.blocks, slideBlock{text: text, bullet: listDepth > 0, level: max(listDepth-1, 0)})
+					}
+				case "table":
+					table, err := parseODFTable(decoder)
+					if err != nil {
+						return err
+					}
+					if slide != nil && !inNotes {
+						slide.blocks = append(slide.blocks, slideBlock{table: table})
+					}
+				}
+			case xml.EndElement:
+				switch element.Name.Local {
+				case "notes":
+					inNotes = false
+				case "frame":
+					frameClass = ""
+				case "list":
+					listDepth--
+				}
+			}
+		}
+	})
+	return slides, err
+}
+
+// readODFText reads the text of a text:p or text:h up to its end element, expanding text:s, text:tab and
+// text:line-break.
+func readODFText(decoder *xml.Decoder, name string) (string, error) {
+	var text strings.Builder
+	depth := 0
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return "", err
+		}
+		switch element := token.(type) {
+		case xml.CharData:
+			text.Write(element)
+		case xml.StartElement:
+			depth++
+			switch element.Name.Local {
+			case "s":
+				count, err := strconv.Atoi(xmlAttr(element, "c"))
+				if err != nil || count < 1 {
+					count = 1
+				}
+				text.WriteString(strings.Repeat(" ", count))
+			case "tab":
+				text.WriteString("\t")
+			case "line-break":
+				text.WriteString("\n")
+			}
+		case xml.EndElement:
+			if depth == 0 && element.Name.Local == name {
+				return strings.TrimSpace(text.String()), nil
+			}
+			depth--
+		}
+	}
+}
+
+// parseODFTable reads a table:table up to its end element.
+func parseODFTable(decoder *xml.Decoder) ([][]string, error) {
+	var rows [][]string
+	var cell []string
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return nil, err
+		}
+		switch element := token.(type) {
+		case xml.StartElement:
+			switch element.Name.Local {
+			case "table-row":
+				rows = append(rows, nil)
+			case "table-cell":
+				cell = nil
+			case "p", "h":
+				text, err := readODFText(decoder, element.Name.Local)
+				if err != nil {
+					return nil, err
+				}
+				if text != "" {
+					cell = append(cell, text)
+				}
+			}
+		case xml.EndElement:
+			switch element.Name.Local {
+			case "table-cell":
+				if len(rows) > 0 {
+					rows[len(rows)-1] = append(rows[len(rows)-1], strings.Join(cell, " "))
+				}
+			case "table":
+				return rows, nil
+			}
+		}
+	}
+}
+
+// slidesMarkdown renders the slides as Markdown: a "## Slide n: title" heading per slide, bullet points as nested
+// lists, tables as GFM tables and the speaker notes (if includeNotes) as a quote, slides separated by "---".
+func slidesMarkdown(slides []slideText, includeNotes bool) string {
+	var markdown strings.Builder
+	for i, slide := range slides {
+		if i > 0 {
+			markdown.WriteString("\n---\n\n")
+		}
+		heading := fmt.Sprintf("## Slide %d", i+1)
+		if slide.title != "" {
+			heading += ": " + escapeMarkdown(strings.ReplaceAll(slide.title, "\n", " "))
+		}
+		markdown.WriteString(heading + "\n")
+		for j, block := range slide.blocks {
+			if j == 0 || !block.bullet || !slide.blocks[j-1].bullet {
+				markdown.WriteString("\n")
+			}
+			switch {
+			case block.table != nil:
+				markdown.WriteString(markdownTable(block.table) + "\n")
+			case block.bullet:
+				markdown.WriteString(strings.Repeat("    ", block.level) + "- " + escapeMarkdown(strings.ReplaceAll(block.text, "\n", " ")) + "\n")
+			default:
+				markdown.WriteString(escapeMarkdown(block.text) + "\n")
+			}
+		}
+		if includeNotes && len(slide.notes) > 0 {
+			markdown.WriteString("\n> **Notes:**\n")
+			for _, note := range slide.notes {
+				for _, line := range strings.Split(note, "\n") {
+					markdown.WriteString(">\n> " + escapeMarkdown(line) + "\n")
+				}
+			}
+		}
+	}
+	return markdown.String()
+}
+
+// slidesText renders the slides as plain text, slides separated by form feeds.
+func slidesText(slides []slideText, includeNotes bool) string {
+	pages := make([]string, len(slides))
+	for i, slide := range slides {
+		lines := []string{fmt.Sprintf("Slide %d", i+1)}
+		if slide.title != "" {
+			lines[0] += ": " + slide.title
+		}
+		for _, block := range slide.blocks {
+			switch {
+			case block.table != nil:
+				for _, row := range block.table {
+					lines = append(lines, strings.Join(row, "\t"))
+				}
+			case block.bullet:
+				lines = append(lines, strings.Repeat("  ", block.level)+"- "+block.text)
+			default:
+				lines = append(lines, block.text)
+			}
+		}
+		if includeNotes && len(slide.notes) > 0 {
+			lines = append(lines, "", "Notes:")
+			lines = append(lines, slide.notes...)
+		}
+		pages[i] = strings.Join(lines, "\n") + "\n"
+	}
+	return strings.Join(pages, "\f")
+}
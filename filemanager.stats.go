@@ -0,0 +1,246 @@
+package filemanager
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+const (
+	// STATS_SLOT_DURATION is the resolution of StatsOver, windows are rounded up to full slots.
+	STATS_SLOT_DURATION = time.Minute
+	// STATS_MAX_WINDOW is the longest window of StatsOver.
+	STATS_MAX_WINDOW = time.Hour
+)
+
+// LatencyBucketBounds are the upper bounds of the buckets of latency histograms. The last bucket of a histogram
+// counts the durations above the last bound.
+var LatencyBucketBounds = []time.Duration{
+	10 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	2500 * time.Millisecond,
+	5 * time.Second,
+	10 * time.Second,
+	30 * time.Second,
+	time.Minute,
+	5 * time.Minute,
+}
+
+// Stats are the counters and latencies of recipes (whole processes, from ProcessFile to the final status) and
+// plugins (single steps, also of RunProcessingStep), e.g. for an admin endpoint. The struct marshals to JSON.
+type Stats struct {
+	Since   time.Time                  `json:"since"`
+	Until   time.Time                  `json:"until"`
+	Recipes map[string]*OperationStats `json:"recipes"`
+	Plugins map[string]*OperationStats `json:"plugins"`
+}
+
+// OperationStats count the runs of a recipe or plugin by their outcome.
+type OperationStats struct {
+	Count     int64 `json:"count"`
+	Succeeded int64 `json:"succeeded"`
+	Failed    int64 `json:"failed"`
+	Cancelled int64 `json:"cancelled"`
+	// TotalDuration is the sum of the durations of all runs.
+	TotalDuration time.Duration `json:"totalDuration"`
+	MinDuration   time.Duration `json:"minDuration"`
+	MaxDuration   time.Duration `json:"maxDuration"`
+	// Histogram counts the runs per bucket of LatencyBucketBounds, with one more bucket for longer runs.
+	Histogram []int64 `json:"histogram"`
+}
+
+// MeanDuration returns the average duration of the runs.
+func (stats *OperationStats) MeanDuration() time.Duration {
+	if stats.Count == 0 {
+		return 0
+	}
+	return stats.TotalDuration / time.Duration(stats.Count)
+}
+
+// Quantile estimates the duration below which the fraction q (0.5 for the median, 0.99, ...) of the runs took,
+// as the upper bound of the histogram bucket it falls into. Runs in the last bucket are reported with MaxDuration.
+func (stats *OperationStats) Quantile(q float64) time.Duration {
+	if stats.Count == 0 {
+		return 0
+	}
+	rank := int64(q*float64(stats.Count) + 0.5)
+	if rank < 1 {
+		rank = 1
+	}
+	var seen int64
+	for i, count := range stats.Histogram {
+		seen += count
+		if seen >= rank {
+			if i < len(LatencyBucketBounds) && LatencyBucketBounds[i] < stats.MaxDuration {
+				return LatencyBucketBounds[i]
+			}
+			return stats.MaxDuration
+		}
+	}
+	return stats.MaxDuration
+}
+
+func (stats *OperationStats) add(duration time.Duration, err error) {
+	if stats.Histogram == nil {
+		stats.Histogram = make([]int64, len(LatencyBucketBounds)+1)
+	}
+	switch {
+	case err == nil:
+		stats.Succeeded++
+	case errors.Is(err, ErrProcessCancelled):
+		stats.Cancelled++
+	default:
+		stats.Failed++
+	}
+	if stats.Count == 0 || duration < stats.MinDuration {
+		stats.MinDuration = duration
+	}
+	if duration > stats.MaxDuration {
+		stats.MaxDuration = duration
+	}
+	stats.Count++
+	stats.TotalDuration += duration
+	bucket := len(LatencyBucketBounds)
+	for i, bound := range LatencyBucketBounds {
+		if duration <= bound {
+			bucket = i
+			break
+		}
+	}
+	stats.Histogram[bucket]++
+}
+
+func (stats *OperationStats) merge(other *OperationStats) {
+	if other.Count == 0 {
+		return
+	}
+	if stats.Histogram == nil {
+		stats.Histogram = make([]int64, len(LatencyBucketBounds)+1)
+	}
+	if stats.Count == 0 || other.MinDuration < stats.MinDuration {
+		stats.MinDuration = other.MinDuration
+	}
+	if other.MaxDuration > stats.MaxDuration {
+		stats.MaxDuration = other.MaxDuration
+	}
+	stats.Count += other.Count
+	stats.Succeeded += other.Succeeded
+	stats.Failed += other.Failed
+	stats.Cancelled += other.Cancelled
+	stats.TotalDuration += other.TotalDuration
+	for i, count := range other.Histogram {
+		stats.Histogram[i] += count
+	}
+}
+
+// statsSlot holds the runs of one STATS_SLOT_DURATION.
+type statsSlot struct {
+	start   time.Time
+	recipes map[string]*OperationStats
+	plugins map[string]*OperationStats
+}
+
+// statsCollector keeps the totals since start and a ring of slots for the sliding windows of StatsOver.
+type statsCollector struct {
+	mu      sync.Mutex
+	started time.Time
+	total   statsSlot
+	slots   []*statsSlot
+}
+
+func newStatsCollector() *statsCollector {
+	now := time.Now()
+	return &statsCollector{
+		started: now,
+		total:   statsSlot{start: now, recipes: map[string]*OperationStats{}, plugins: map[string]*OperationStats{}},
+		slots:   make([]*statsSlot, int(STATS_MAX_WINDOW/STATS_SLOT_DURATION)),
+	}
+}
+
+func (c *statsCollector) record(recipe bool, name string, duration time.Duration, err error) {
+	now := time.Now()
+	start := now.Truncate(STATS_SLOT_DURATION)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	index := int(start.Unix()/int64(STATS_SLOT_DURATION/time.Second)) % len(c.slots)
+	slot := c.slots[index]
+	if slot == nil || !slot.start.Equal(start) {
+		slot = &statsSlot{start: start, recipes: map[string]*OperationStats{}, plugins: map[string]*OperationStats{}}
+		c.slots[index] = slot
+	}
+	for _, target := range []*statsSlot{&c.total, slot} {
+		operations := target.plugins
+		if recipe {
+			operations = target.recipes
+		}
+		stats, ok := operations[name]
+		if !ok {
+			stats = &OperationStats{}
+			operations[name] = stats
+		}
+		stats.add(duration, err)
+	}
+}
+
+// Stats returns the statistics of the recipes and plugins since the FileManager was created. Tenant views share
+// the statistics of their FileManager.
+func (fm *FileManager) Stats() *Stats {
+	c := fm.root().stats
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	stats := &Stats{Since: c.started, Until: time.Now(), Recipes: map[string]*OperationStats{}, Plugins: map[string]*OperationStats{}}
+	addSlot(stats, &c.total)
+	return stats
+}
+
+// StatsOver returns the statistics of the recipes and plugins of the last window, rounded up to full minutes and
+// limited to STATS_MAX_WINDOW.
+func (fm *FileManager) StatsOver(window time.Duration) *Stats {
+	if window > STATS_MAX_WINDOW {
+		window = STATS_MAX_WINDOW
+	}
+	now := time.Now()
+	slotCount := int((window + STATS_SLOT_DURATION - 1) / STATS_SLOT_DURATION)
+	since := now.Truncate(STATS_SLOT_DURATION).Add(-time.Duration(slotCount-1) * STATS_SLOT_DURATION)
+	c := fm.root().stats
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if since.Before(c.started) {
+		since = c.started
+	}
+	stats := &Stats{Since: since, Until: now, Recipes: map[string]*OperationStats{}, Plugins: map[string]*OperationStats{}}
+	for _, slot := range c.slots {
+		if slot != nil && !slot.start.Before(since.Truncate(STATS_SLOT_DURATION)) {
+			addSlot(stats, slot)
+		}
+	}
+	return stats
+}
+
+func addSlot(stats *Stats, slot *statsSlot) {
+	for _, operations := range []struct {
+		from map[string]*OperationStats
+		to   map[string]*OperationStats
+	}{{slot.recipes, stats.Recipes}, {slot.plugins, stats.Plugins}} {
+		for name, operation := range operations.from {
+			merged, ok := operations.to[name]
+			if !ok {
+				merged = &OperationStats{}
+				operations.to[name] = merged
+			}
+			merged.merge(operation)
+		}
+	}
+}
+
+func (fm *FileManager) recordRecipeStats(recipeName string, started time.Time, fileProcess *FileProcess) {
+	fm.root().stats.record(true, recipeName, time.Since(started), fileProcess.Err())
+}
+
+func (fm *FileManager) recordPluginStats(pluginName string, started time.Time, err error) {
+	fm.root().stats.record(false, pluginName, time.Since(started), err)
+}
@@ -0,0 +1,68 @@
+package filemanager
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	DEFAULT_STATUS_CHANNEL_BUFFER = 16
+	// DEFAULT_STATUS_DELIVERY_TIMEOUT is how long the final status of HandleFileUpload and ProcessFile waits for a
+	// consumer that stopped reading, see SetStatusDeliveryTimeout. 0 waits forever, so no final status is lost.
+	DEFAULT_STATUS_DELIVERY_TIMEOUT time.Duration = 0
+)
+
+// NewStatusChannel returns a buffered status channel for HandleFileUpload and ProcessFile. Any channel works, but
+// with a buffer, updates are not coalesced while the consumer handles the previous one, and the final status
+// never has to wait.
+func NewStatusChannel() chan *FileProcess {
+	return make(chan *FileProcess, DEFAULT_STATUS_CHANNEL_BUFFER)
+}
+
+// SetStatusDeliveryTimeout sets how long the final status of HandleFileUpload and ProcessFile waits to be received
+// before it is given up and logged, so a consumer that stopped reading cannot wedge them forever. 0, the default,
+// waits forever. The status stays available in the FileProcess either way. Tenant views share the timeout of their FileManager.
+func (fm *FileManager) SetStatusDeliveryTimeout(timeout time.Duration) {
+	root := fm.root()
+	root.mu.Lock()
+	defer root.mu.Unlock()
+	root.statusDeliveryTimeout = timeout
+}
+
+func (fm *FileManager) getStatusDeliveryTimeout() time.Duration {
+	root := fm.root()
+	root.mu.RLock()
+	defer root.mu.RUnlock()
+	return root.statusDeliveryTimeout
+}
+
+// publishStatus notifies the consumer of an update without blocking. If it is busy and the channel has no room,
+// the notification is dropped: all notifications carry the same FileProcess, so the next one it receives shows
+// the latest status, and UpdatesAfter returns the updates it missed.
+func publishStatus(statusCh chan<- *FileProcess, fileProcess *FileProcess) {
+	select {
+	case statusCh <- fileProcess:
+	default:
+	}
+}
+
+// publishFinalStatus delivers the final status of a process, waiting for the consumer, up to the status delivery
+// timeout if one is set.
+func (fm *FileManager) publishFinalStatus(statusCh chan<- *FileProcess, fileProcess *FileProcess) {
+	fm.saveProcessState(fileProcess)
+	if statusCh == nil {
+		return
+	}
+	timeout := fm.getStatusDeliveryTimeout()
+	if timeout <= 0 {
+		statusCh <- fileProcess
+		return
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case statusCh <- fileProcess:
+	case <-timer.C:
+		fm.LogTo("INFO", fmt.Sprintf("[FileManager.publishFinalStatus] Final status of process(%s)%s not received within %v, the consumer stopped reading\n", fileProcess.ID, fileProcess.LogLabels(), timeout))
+	}
+}
@@ -0,0 +1,156 @@
+package filemanager
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+var (
+	ErrStreamingUnsupported = errors.New("response writer does not support streaming")
+	ErrClientDisconnected   = errors.New("client disconnected")
+)
+
+const DEFAULT_STATUS_STREAM_KEEP_ALIVE = 15 * time.Second
+
+// StatusStreamOptions configure StreamStatusSSE and StreamStatusWebSocket.
+type StatusStreamOptions struct {
+	KeepAliveInterval time.Duration // comment lines (SSE) or pings (WebSocket), defaults to 15s
+	// CheckOrigin decides whether a WebSocket upgrade is accepted, defaults to same-origin requests only.
+	CheckOrigin func(r *http.Request) bool
+}
+
+func (opts StatusStreamOptions) keepAliveInterval() time.Duration {
+	if opts.KeepAliveInterval > 0 {
+		return opts.KeepAliveInterval
+	}
+	return DEFAULT_STATUS_STREAM_KEEP_ALIVE
+}
+
+// StreamStatusSSE forwards the updates of a FileProcess status channel (as passed to ProcessFile or
+// HandleFileUpload) to the client as Server-Sent Events. Every ProcessingStatus is sent once as a JSON encoded
+// "status" event with its Seq as event id; a "done" event follows when the channel is closed.
+// If the client disconnects, the channel is drained in the background so the sender never blocks, and the
+// request context error is returned.
+func StreamStatusSSE(w http.ResponseWriter, r *http.Request, statusCh <-chan *FileProcess, opts StatusStreamOptions) error {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		go drainStatusChannel(statusCh)
+		return ErrStreamingUnsupported
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	return bridgeStatusChannel(r, nil, statusCh, opts,
+		func(status ProcessingStatus) error {
+			data, err := json.Marshal(status)
+			if err != nil {
+				return err
+			}
+			_, err = fmt.Fprintf(w, "id: %d\nevent: status\ndata: %s\n\n", status.Seq, data)
+			flusher.Flush()
+			return err
+		},
+		func() error {
+			_, err := fmt.Fprint(w, ": keep-alive\n\n")
+			flusher.Flush()
+			return err
+		},
+		func() error {
+			_, err := fmt.Fprint(w, "event: done\ndata: {}\n\n")
+			flusher.Flush()
+			return err
+		},
+	)
+}
+
+// StreamStatusWebSocket upgrades the request to a WebSocket and forwards the updates of a FileProcess status
+// channel as JSON encoded ProcessingStatus text messages. The connection is closed with a normal closure when
+// the channel is closed. Disconnects are handled like in StreamStatusSSE.
+func StreamStatusWebSocket(w http.ResponseWriter, r *http.Request, statusCh <-chan *FileProcess, opts StatusStreamOptions) error {
+	upgrader := websocket.Upgrader{CheckOrigin: opts.CheckOrigin}
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		go drainStatusChannel(statusCh)
+		return err
+	}
+	defer conn.Close()
+
+	// the read loop processes control frames and notices when the client goes away
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			_, _, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	writeTimeout := opts.keepAliveInterval()
+	return bridgeStatusChannel(r, closed, statusCh, opts,
+		func(status ProcessingStatus) error {
+			conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+			return conn.WriteJSON(status)
+		},
+		func() error {
+			return conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(writeTimeout))
+		},
+		func() error {
+			message := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "done")
+			return conn.WriteControl(websocket.CloseMessage, message, time.Now().Add(writeTimeout))
+		},
+	)
+}
+
+// bridgeStatusChannel sends new updates until statusCh is closed, the request is cancelled or closed is closed
+// (a nil closed channel never fires).
+func bridgeStatusChannel(r *http.Request, closed <-chan struct{}, statusCh <-chan *FileProcess, opts StatusStreamOptions, send func(ProcessingStatus) error, keepAlive func() error, done func() error) error {
+	ticker := time.NewTicker(opts.keepAliveInterval())
+	defer ticker.Stop()
+
+	lastSeq := 0
+	for {
+		select {
+		case fileProcess, ok := <-statusCh:
+			if !ok {
+				return done()
+			}
+			for _, status := range fileProcess.UpdatesAfter(lastSeq) {
+				err := send(status)
+				if err != nil {
+					go drainStatusChannel(statusCh)
+					return err
+				}
+				lastSeq = status.Seq
+			}
+		case <-ticker.C:
+			err := keepAlive()
+			if err != nil {
+				go drainStatusChannel(statusCh)
+				return err
+			}
+		case <-closed:
+			go drainStatusChannel(statusCh)
+			return ErrClientDisconnected
+		case <-r.Context().Done():
+			go drainStatusChannel(statusCh)
+			return r.Context().Err()
+		}
+	}
+}
+
+// drainStatusChannel consumes the remaining updates so a sender without a listener does not block forever.
+func drainStatusChannel(statusCh <-chan *FileProcess) {
+	for range statusCh {
+	}
+}
@@ -0,0 +1,313 @@
+package filemanager
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrStorageClosed = errors.New("file already closed")
+)
+
+// Storage is the file system uploads and output files are written to and read from. LocalStorage, the default,
+// uses the local disk; MemoryStorage keeps files in memory, e.g. for unit tests.
+// Versioning, the trash, metadata sidecars and orphaned upload sweeps always work on the local disk.
+type Storage interface {
+	// Create creates a new file for streaming writes, failing with ErrFileExists if it already exists.
+	// The file is complete once the writer is closed.
+	Create(path string) (io.WriteCloser, error)
+	// WriteFile writes the whole file, atomically replacing an existing one unless noOverwrite is set.
+	WriteFile(path string, data []byte, perm os.FileMode, noOverwrite bool) error
+	ReadFile(path string) ([]byte, error)
+	// Remove deletes the file, returning an error satisfying errors.Is(err, fs.ErrNotExist) if it does not exist.
+	Remove(path string) error
+	Stat(path string) (fs.FileInfo, error)
+}
+
+// SetStorage replaces the storage used for uploads and output files.
+func (fm *FileManager) SetStorage(storage Storage) {
+	fm.mu.Lock()
+	defer fm.mu.Unlock()
+	fm.storage = storage
+}
+
+// GetStorage returns the storage used for uploads and output files.
+func (fm *FileManager) GetStorage() Storage {
+	if fm.parent != nil {
+		return fm.parent.GetStorage()
+	}
+	perms := fm.getFilePermissions()
+	fm.mu.RLock()
+	defer fm.mu.RUnlock()
+	storage := fm.storage
+	if storage == nil {
+		storage = LocalStorage{}
+	}
+	if local, ok := storage.(LocalStorage); ok && local.Permissions == (FilePermissions{}) {
+		storage = LocalStorage{Permissions: perms}
+	}
+	if len(fm.storages) > 0 {
+		return &routedStorage{primary: storage, storages: fm.storages, bases: []string{fm.publicLocalBasePath, fm.privateLocalBasePath, fm.localTempPath}}
+	}
+	return storage
+}
+
+// usesLocalStorage reports whether the file at the local path is stored on the local disk by LocalStorage.
+func (fm *FileManager) usesLocalStorage(localFilePath string) bool {
+	_, ok := fm.storageFor(localFilePath).(LocalStorage)
+	return ok
+}
+
+func (fm *FileManager) saveToStorage(file *ManagedFile, noOverwrite bool) error {
+	err := fm.GetStorage().WriteFile(file.LocalFilePath, file.Content, fm.getFilePermissions().fileModeOr(0644), noOverwrite)
+	if err != nil {
+		return err
+	}
+	file.FileSize = int64(len(file.Content))
+	file.MimeType = fm.DetectMimeType(file.FileName, file.Content)
+	return nil
+}
+
+// LocalStorage stores files on the local disk, creating missing directories.
+type LocalStorage struct {
+	// Permissions are the modes of created directories and of files created for streaming writes (0600 by
+	// default). A LocalStorage without any uses the permissions of its FileManager, see SetFilePermissions.
+	Permissions FilePermissions
+}
+
+func (s LocalStorage) Create(path string) (io.WriteCloser, error) {
+	err := mkdirAllMode(filepath.Dir(path), s.Permissions.dirMode())
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, s.Permissions.fileModeOr(0600))
+	if os.IsExist(err) {
+		return nil, ErrFileExists
+	}
+	return file, err
+}
+
+func (s LocalStorage) WriteFile(path string, data []byte, perm os.FileMode, noOverwrite bool) error {
+	return writeFileAtomic(path, data, perm, s.Permissions.dirMode(), noOverwrite)
+}
+
+func (LocalStorage) ReadFile(path string) ([]byte, error) {
+	return os.ReadFile(path)
+}
+
+func (LocalStorage) Remove(path string) error {
+	return os.Remove(path)
+}
+
+func (LocalStorage) Stat(path string) (fs.FileInfo, error) {
+	return os.Stat(path)
+}
+
+func (LocalStorage) ReadDir(path string) ([]fs.DirEntry, error) {
+	return os.ReadDir(path)
+}
+
+// MemoryStorage keeps files in memory, keyed by their cleaned path. It is safe for concurrent use.
+type MemoryStorage struct {
+	files map[string]memoryFile
+	mu    sync.RWMutex
+}
+
+type memoryFile struct {
+	data    []byte
+	mode    os.FileMode
+	modTime time.Time
+	headers HTTPHeaders
+}
+
+func NewMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{files: make(map[string]memoryFile)}
+}
+
+func (s *MemoryStorage) Create(path string) (io.WriteCloser, error) {
+	path = filepath.Clean(path)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.files[path]; ok {
+		return nil, ErrFileExists
+	}
+	s.files[path] = memoryFile{mode: 0600, modTime: time.Now()}
+	return &memoryFileWriter{storage: s, path: path}, nil
+}
+
+func (s *MemoryStorage) WriteFile(path string, data []byte, perm os.FileMode, noOverwrite bool) error {
+	path = filepath.Clean(path)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.files[path]; ok && noOverwrite {
+		return ErrFileExists
+	}
+	s.files[path] = memoryFile{data: bytes.Clone(data), mode: perm, modTime: time.Now()}
+	return nil
+}
+
+func (s *MemoryStorage) ReadFile(path string) ([]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	file, ok := s.files[filepath.Clean(path)]
+	if !ok {
+		return nil, &fs.PathError{Op: "read", Path: path, Err: fs.ErrNotExist}
+	}
+	return bytes.Clone(file.data), nil
+}
+
+func (s *MemoryStorage) Remove(path string) error {
+	path = filepath.Clean(path)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.files[path]; !ok {
+		return &fs.PathError{Op: "remove", Path: path, Err: fs.ErrNotExist}
+	}
+	delete(s.files, path)
+	return nil
+}
+
+func (s *MemoryStorage) Stat(path string) (fs.FileInfo, error) {
+	path = filepath.Clean(path)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	file, ok := s.files[path]
+	if ok {
+		return memoryFileInfo{name: filepath.Base(path), file: file}, nil
+	}
+	// directories exist implicitly as long as they contain files
+	dir := storageDirInfo{name: filepath.Base(path)}
+	prefix := strings.TrimSuffix(path, string(filepath.Separator)) + string(filepath.Separator)
+	for filePath, file := range s.files {
+		if strings.HasPrefix(filePath, prefix) {
+			if file.modTime.After(dir.modTime) {
+				dir.modTime = file.modTime
+			}
+		}
+	}
+	if dir.modTime.IsZero() {
+		return nil, &fs.PathError{Op: "stat", Path: path, Err: fs.ErrNotExist}
+	}
+	return dir, nil
+}
+
+// ReadDir lists the files and implicit directories directly below path.
+func (s *MemoryStorage) ReadDir(path string) ([]fs.DirEntry, error) {
+	path = filepath.Clean(path)
+	prefix := strings.TrimSuffix(path, string(filepath.Separator)) + string(filepath.Separator)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if _, ok := s.files[path]; ok {
+		return nil, &fs.PathError{Op: "readdir", Path: path, Err: errors.New("not a directory")}
+	}
+	entries := make(map[string]fs.FileInfo)
+	for filePath, file := range s.files {
+		rest, ok := strings.CutPrefix(filePath, prefix)
+		if !ok {
+			continue
+		}
+		name, _, isDir := strings.Cut(rest, string(filepath.Separator))
+		if !isDir {
+			entries[name] = memoryFileInfo{name: name, file: file}
+			continue
+		}
+		dir, _ := entries[name].(storageDirInfo)
+		if file.modTime.After(dir.modTime) {
+			entries[name] = storageDirInfo{name: name, modTime: file.modTime}
+		}
+	}
+	if len(entries) == 0 {
+		return nil, &fs.PathError{Op: "readdir", Path: path, Err: fs.ErrNotExist}
+	}
+	dirEntries := make([]fs.DirEntry, 0, len(entries))
+	for _, info := range entries {
+		dirEntries = append(dirEntries, fs.FileInfoToDirEntry(info))
+	}
+	sort.Slice(dirEntries, func(i, j int) bool { return dirEntries[i].Name() < dirEntries[j].Name() })
+	return dirEntries, nil
+}
+
+// SetHTTPHeaders keeps the headers with the file, like object metadata. They are dropped when the file is replaced.
+func (s *MemoryStorage) SetHTTPHeaders(path string, headers HTTPHeaders) error {
+	path = filepath.Clean(path)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	file, ok := s.files[path]
+	if !ok {
+		return &fs.PathError{Op: "setheaders", Path: path, Err: fs.ErrNotExist}
+	}
+	file.headers = headers
+	s.files[path] = file
+	return nil
+}
+
+func (s *MemoryStorage) GetHTTPHeaders(path string) (HTTPHeaders, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	file, ok := s.files[filepath.Clean(path)]
+	if !ok {
+		return HTTPHeaders{}, &fs.PathError{Op: "getheaders", Path: path, Err: fs.ErrNotExist}
+	}
+	return file.headers, nil
+}
+
+// Paths returns the paths of all stored files, sorted.
+func (s *MemoryStorage) Paths() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	paths := make([]string, 0, len(s.files))
+	for path := range s.files {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+type memoryFileWriter struct {
+	storage *MemoryStorage
+	path    string
+	buf     bytes.Buffer
+	closed  bool
+}
+
+func (w *memoryFileWriter) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, ErrStorageClosed
+	}
+	return w.buf.Write(p)
+}
+
+func (w *memoryFileWriter) Close() error {
+	if w.closed {
+		return ErrStorageClosed
+	}
+	w.closed = true
+	w.storage.mu.Lock()
+	defer w.storage.mu.Unlock()
+	if _, ok := w.storage.files[w.path]; !ok {
+		// removed while being written
+		return nil
+	}
+	w.storage.files[w.path] = memoryFile{data: w.buf.Bytes(), mode: 0600, modTime: time.Now()}
+	return nil
+}
+
+type memoryFileInfo struct {
+	name string
+	file memoryFile
+}
+
+func (info memoryFileInfo) Name() string       { return info.name }
+func (info memoryFileInfo) Size() int64        { return int64(len(info.file.data)) }
+func (info memoryFileInfo) Mode() fs.FileMode  { return info.file.mode }
+func (info memoryFileInfo) ModTime() time.Time { return info.file.modTime }
+func (info memoryFileInfo) IsDir() bool        { return false }
+func (info memoryFileInfo) Sys() any           { return nil }
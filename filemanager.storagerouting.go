@@ -0,0 +1,260 @@
+package filemanager
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+var (
+	ErrInvalidStorageName = errors.New("invalid storage name")
+	ErrStorageNotFound    = errors.New("storage not found")
+)
+
+// StorageRoute sends files matching all of its conditions to another storage type or named storage. Empty
+// conditions match every file.
+type StorageRoute struct {
+	MimeTypes   []string `yaml:"mime_types"` // matched like accepted_mime_types of recipes, e.g. "video/" or "image/png"
+	MinFileSize int64    `yaml:"min_file_size"`
+	MaxFileSize int64    `yaml:"max_file_size"` // 0 means no limit
+	// StorageTypes restrict the route to files headed for these storage types, all by default. Use it to keep a
+	// route from moving private outputs to the public path.
+	StorageTypes []FileStorageType `yaml:"storage_types"`
+	// StorageType replaces the storage type of matching outputs, empty keeps the one of the recipe.
+	StorageType FileStorageType `yaml:"storage_type"`
+	// Storage is the name of a storage added with AddStorage the files are written to, empty for the Storage of the
+	// FileManager.
+	Storage string `yaml:"storage"`
+}
+
+// StorageRouting decides where uploads and outputs are stored, e.g. videos in an object storage bucket and small
+// images in the local public path. Routes are checked in order, the first match wins; files no route matches are
+// stored as the recipe says.
+type StorageRouting struct {
+	Routes []StorageRoute `yaml:"routes"`
+}
+
+// AddStorage adds a named storage for the storage routing. Its files are kept in a directory named like the
+// storage in the public, private and temp paths (of tenant views as well), so every local file path names the
+// storage holding it and files are read, served and deleted through the FileManager as usual. Storage names must
+// not be used as directory names there otherwise. Adding an existing name replaces its storage.
+func (fm *FileManager) AddStorage(name string, storage Storage) error {
+	// storage names become path segments and URL paths, like tenant IDs
+	if !tenantIDPattern.MatchString(name) {
+		return fmt.Errorf("%w: %q", ErrInvalidStorageName, name)
+	}
+	root := fm.root()
+	root.mu.Lock()
+	defer root.mu.Unlock()
+	storages := make(map[string]Storage, len(root.storages)+1)
+	for existing, s := range root.storages {
+		storages[existing] = s
+	}
+	storages[name] = storage
+	root.storages = storages
+	return nil
+}
+
+// SetStorageRouting configures the routing applied to uploads and outputs. The named storages of the routes must be
+// added with AddStorage first.
+func (fm *FileManager) SetStorageRouting(routing StorageRouting) error {
+	root := fm.root()
+	root.mu.Lock()
+	defer root.mu.Unlock()
+	for i, route := range routing.Routes {
+		for _, storageType := range append([]FileStorageType{route.StorageType}, route.StorageTypes...) {
+			if storageType != "" && !validStorageType(storageType) {
+				return fmt.Errorf("%w: routes[%d]: %s", ErrInvalidStorageType, i, storageType)
+			}
+		}
+		if _, ok := root.storages[route.Storage]; route.Storage != "" && !ok {
+			return fmt.Errorf("%w: routes[%d]: %s", ErrStorageNotFound, i, route.Storage)
+		}
+	}
+	root.storageRouting = &routing
+	return nil
+}
+
+// LoadStorageRouting reads the routing from a YAML file, see SetStorageRouting.
+func (fm *FileManager) LoadStorageRouting(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var routing StorageRouting
+	err = yaml.Unmarshal(data, &routing)
+	if err != nil {
+		return fmt.Errorf("failed to parse storage routing(%s): %v", path, err)
+	}
+	return fm.SetStorageRouting(routing)
+}
+
+// ResolveStorageForFile returns the storage type and the name of the storage (empty for the Storage of the
+// FileManager) the routing selects for a file headed for the storage type. Files no route matches keep it.
+func (fm *FileManager) ResolveStorageForFile(file *ManagedFile, storageType FileStorageType) (FileStorageType, string) {
+	root := fm.root()
+	root.mu.RLock()
+	routing := root.storageRouting
+	root.mu.RUnlock()
+	if routing == nil || !validStorageType(storageType) {
+		return storageType, ""
+	}
+	for _, route := range routing.Routes {
+		if !route.matches(file, storageType) {
+			continue
+		}
+		if route.StorageType != "" {
+			storageType = route.StorageType
+		}
+		return storageType, route.Storage
+	}
+	return storageType, ""
+}
+
+func (route StorageRoute) matches(file *ManagedFile, storageType FileStorageType) bool {
+	if len(route.StorageTypes) > 0 && !containsStorageType(route.StorageTypes, storageType) {
+		return false
+	}
+	if len(route.MimeTypes) > 0 && !isValidMimeType(file.MimeType, route.MimeTypes, false) {
+		return false
+	}
+	fileSize := file.FileSize
+	if fileSize == 0 {
+		fileSize = int64(len(file.Content))
+	}
+	return fileSize >= route.MinFileSize && (route.MaxFileSize <= 0 || fileSize <= route.MaxFileSize)
+}
+
+func validStorageType(storageType FileStorageType) bool {
+	return storageType == FileStorageTypePublic || storageType == FileStorageTypePrivate || storageType == FileStorageTypeTemp
+}
+
+func containsStorageType(storageTypes []FileStorageType, storageType FileStorageType) bool {
+	for _, candidate := range storageTypes {
+		if candidate == storageType {
+			return true
+		}
+	}
+	return false
+}
+
+// routedOutputPath returns the local path and storage type of an output after the storage routing, false for an
+// invalid storage type.
+func (fm *FileManager) routedOutputPath(file *ManagedFile, storageType FileStorageType, fullFilePath string) (string, FileStorageType, bool) {
+	if !validStorageType(storageType) {
+		return "", storageType, false
+	}
+	storageType, storageName := fm.ResolveStorageForFile(file, storageType)
+	localFilePath, _ := fm.outputLocalFilePath(storageType, filepath.Join(storageName, fullFilePath))
+	return localFilePath, storageType, true
+}
+
+// routeUpload moves the temp file of an upload to the named storage its route selects. Uploads stay temp files, the
+// storage type of a route only applies to outputs.
+func (fm *FileManager) routeUpload(file *ManagedFile) error {
+	_, storageName := fm.ResolveStorageForFile(file, FileStorageTypeTemp)
+	if storageName == "" {
+		return nil
+	}
+	storage := fm.GetStorage()
+	target := fm.GetLocalTemporaryFilePath(filepath.Join(storageName, filepath.Base(file.LocalFilePath)))
+	err := storage.WriteFile(target, file.Content, 0600, true)
+	if err != nil {
+		return &StorageError{Op: "write", Path: target, Err: err}
+	}
+	err = storage.Remove(file.LocalFilePath)
+	if err != nil {
+		fm.LogTo("INFO", fmt.Sprintf("[FileManager.HandleFileUpload] Removing temp file(%s) moved to storage(%s) failed: %v\n", file.LocalFilePath, storageName, err))
+	}
+	file.LocalFilePath = target
+	file.FileName = filepath.Base(target)
+	return nil
+}
+
+// storageFor returns the storage holding the local path: a named storage added with AddStorage or the Storage of
+// the FileManager. Optional interfaces like OpenStorage are checked on it rather than on GetStorage.
+func (fm *FileManager) storageFor(localFilePath string) Storage {
+	storage := fm.GetStorage()
+	if routed, ok := storage.(*routedStorage); ok {
+		return routed.storageFor(localFilePath)
+	}
+	return storage
+}
+
+// routedStorage is the Storage of a FileManager with named storages, passing every call on to the storage holding
+// the path.
+type routedStorage struct {
+	primary  Storage
+	storages map[string]Storage // replaced as a whole by AddStorage, never mutated
+	bases    []string           // public, private and temp path of the root FileManager
+}
+
+func (s *routedStorage) storageFor(path string) Storage {
+	for _, base := range s.bases {
+		relative, err := filepath.Rel(base, path)
+		if err != nil || relative == "." || strings.HasPrefix(relative, "..") {
+			continue
+		}
+		segments := strings.SplitN(filepath.ToSlash(relative), "/", 3)
+		if storage, ok := s.storages[segments[0]]; ok {
+			return storage
+		}
+		// tenant views keep their files one directory deeper
+		if len(segments) > 1 && tenantIDPattern.MatchString(segments[0]) {
+			if storage, ok := s.storages[segments[1]]; ok {
+				return storage
+			}
+		}
+	}
+	return s.primary
+}
+
+func (s *routedStorage) Create(path string) (io.WriteCloser, error) {
+	return s.storageFor(path).Create(path)
+}
+
+func (s *routedStorage) WriteFile(path string, data []byte, perm os.FileMode, noOverwrite bool) error {
+	return s.storageFor(path).WriteFile(path, data, perm, noOverwrite)
+}
+
+func (s *routedStorage) ReadFile(path string) ([]byte, error) {
+	return s.storageFor(path).ReadFile(path)
+}
+
+func (s *routedStorage) Remove(path string) error {
+	return s.storageFor(path).Remove(path)
+}
+
+func (s *routedStorage) Stat(path string) (fs.FileInfo, error) {
+	return s.storageFor(path).Stat(path)
+}
+
+// Open streams files of storages implementing OpenStorage and reads the others into memory.
+func (s *routedStorage) Open(path string) (io.ReadSeekCloser, error) {
+	storage := s.storageFor(path)
+	if openStorage, ok := storage.(OpenStorage); ok {
+		return openStorage.Open(path)
+	}
+	data, err := storage.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return nopReadSeekCloser{bytes.NewReader(data)}, nil
+}
+
+// ReadDir lists directories of storages implementing DirStorage. The directories of the named storages are listed
+// by the storage holding their parent only if it has them as well.
+func (s *routedStorage) ReadDir(path string) ([]fs.DirEntry, error) {
+	dirStorage, ok := s.storageFor(path).(DirStorage)
+	if !ok {
+		return nil, &fs.PathError{Op: "readdir", Path: path, Err: errors.ErrUnsupported}
+	}
+	return dirStorage.ReadDir(path)
+}
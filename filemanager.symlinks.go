@@ -0,0 +1,113 @@
+package filemanager
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var (
+	ErrPathEscapesBase = errors.New("path escapes its base path through a symlink")
+)
+
+// AllowSymlinkTargets lets symlinks below the base paths point into the directories, e.g. a volume mounted
+// elsewhere and linked into the public path. Other links leaving the base path they are in are refused, see
+// checkContainedPath. Tenant views share the allowed targets of their FileManager.
+func (fm *FileManager) AllowSymlinkTargets(dirs ...string) {
+	root := fm.root()
+	root.mu.Lock()
+	defer root.mu.Unlock()
+	root.symlinkTargets = append(root.symlinkTargets, dirs...)
+}
+
+func (fm *FileManager) getSymlinkTargets() []string {
+	root := fm.root()
+	root.mu.RLock()
+	defer root.mu.RUnlock()
+	return append([]string(nil), root.symlinkTargets...)
+}
+
+// checkContainedPath fails with ErrPathEscapesBase if the local path is below a base path (public, private or
+// temp) but resolves, following symlinks (and junctions on Windows) in any of its components, to a path outside of
+// that base path and outside of the allowed symlink targets. A public file linking to a private one is refused
+// as well. Paths not below a base path are not checked. Serving, reading, saving, moving and deleting files check
+// their paths, so links planted in the storage cannot expose or remove files elsewhere.
+func (fm *FileManager) checkContainedPath(localFilePath string) error {
+	path, err := filepath.Abs(localFilePath)
+	if err != nil {
+		return err
+	}
+	base := ""
+	for _, candidate := range []string{fm.publicLocalBasePath, fm.privateLocalBasePath, fm.localTempPath, fm.fastTempPath()} {
+		if candidate == "" {
+			continue
+		}
+		candidate, err = filepath.Abs(candidate)
+		if err == nil && isWithinDir(candidate, path) && len(candidate) > len(base) {
+			base = candidate
+		}
+	}
+	if base == "" {
+		return nil
+	}
+	resolved, err := resolvePath(path)
+	if err != nil {
+		return fmt.Errorf("%w: %s: %v", ErrPathEscapesBase, localFilePath, err)
+	}
+	for _, dir := range append([]string{base}, fm.getSymlinkTargets()...) {
+		resolvedDir, err := resolvePath(dir)
+		if err == nil && isWithinDir(resolvedDir, resolved) {
+			return nil
+		}
+	}
+	fm.LogTo("INFO", fmt.Sprintf("[FileManager.checkContainedPath] Refused path(%s) resolving to %s outside of %s\n", localFilePath, resolved, base))
+	return fmt.Errorf("%w: %s resolves to %s", ErrPathEscapesBase, localFilePath, resolved)
+}
+
+// resolvePath returns the absolute path with all symlinks resolved. Missing trailing components are kept as they
+// are below their deepest existing parent; a dangling link is resolved to the path it points to.
+func resolvePath(path string) (string, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	resolved, err := filepath.EvalSymlinks(path)
+	if err == nil {
+		return resolved, nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return "", err
+	}
+	parent := filepath.Dir(path)
+	if parent == path {
+		return path, nil
+	}
+	resolvedParent, err := resolvePath(parent)
+	if err != nil {
+		return "", err
+	}
+	info, err := os.Lstat(path)
+	if err != nil || info.Mode()&fs.ModeSymlink == 0 {
+		return filepath.Join(resolvedParent, filepath.Base(path)), nil
+	}
+	target, err := os.Readlink(path)
+	if err != nil {
+		return "", err
+	}
+	if !filepath.IsAbs(target) {
+		target = filepath.Join(resolvedParent, target)
+	}
+	return resolvePath(target)
+}
+
+// isWithinDir reports whether the path is the directory or below it. Both paths must be absolute and clean.
+func isWithinDir(dir string, path string) bool {
+	relative, err := filepath.Rel(dir, path)
+	if err != nil {
+		return false
+	}
+	return relative == "." || (relative != ".." && !strings.HasPrefix(relative, ".."+string(filepath.Separator)))
+}
@@ -0,0 +1,65 @@
+package filemanager_test
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+
+	filemanager "github.com/itsatony/go-filemanager"
+	"github.com/itsatony/go-filemanager/filemanagertest"
+)
+
+func TestSymlinksLeavingThePublicPath(t *testing.T) {
+	tfm := filemanagertest.NewTestFileManager(t)
+	tfm.SetStorage(filemanager.LocalStorage{})
+	outside := t.TempDir()
+	allowed := t.TempDir()
+	tfm.AllowSymlinkTargets(allowed)
+	for dir, name := range map[string]string{outside: "secret.txt", allowed: "mounted.txt", tfm.PrivatePath: "private.txt"} {
+		err := os.MkdirAll(dir, 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.WriteFile(filepath.Join(dir, name), []byte(name), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := os.MkdirAll(tfm.PublicPath, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		link    string
+		target  string
+		read    string // the path read below the public path
+		content string // expected content, "" if the link is refused
+	}{
+		{link: "escaping", target: filepath.Join(outside, "secret.txt"), read: "escaping"},
+		{link: "escaping_dir", target: outside, read: "escaping_dir/secret.txt"},
+		{link: "dangling", target: filepath.Join(outside, "missing.txt"), read: "dangling"},
+		{link: "private", target: filepath.Join(tfm.PrivatePath, "private.txt"), read: "private"},
+		{link: "allowed", target: filepath.Join(allowed, "mounted.txt"), read: "allowed", content: "mounted.txt"},
+	}
+	for _, test := range tests {
+		t.Run(test.link, func(t *testing.T) {
+			err := os.Symlink(test.target, filepath.Join(tfm.PublicPath, test.link))
+			if err != nil {
+				t.Skipf("symlinks not supported: %v", err)
+			}
+			content, err := fs.ReadFile(tfm.FS(filemanager.FileStorageTypePublic), test.read)
+			if test.content == "" {
+				if !errors.Is(err, filemanager.ErrPathEscapesBase) {
+					t.Fatalf("ReadFile(%s) = %q, %v, want ErrPathEscapesBase", test.read, content, err)
+				}
+				return
+			}
+			if err != nil || string(content) != test.content {
+				t.Fatalf("ReadFile(%s) = %q, %v, want %q", test.read, content, err, test.content)
+			}
+		})
+	}
+}
@@ -0,0 +1,263 @@
+package filemanager
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+var (
+	ErrInvalidTenantID  = errors.New("invalid tenant id")
+	ErrQuotaExceeded    = errors.New("tenant storage quota exceeded")
+	ErrRecipeNotAllowed = errors.New("recipe not allowed for tenant")
+	ErrTenantPathDenied = errors.New("path outside of the tenant")
+)
+
+// tenant IDs become path segments and URL paths, so they are restricted to a safe alphabet
+var tenantIDPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_-]{0,63}$`)
+
+// TenantOptions limit what a tenant view may do.
+type TenantOptions struct {
+	// QuotaBytes limits the total size of the tenant's public and private files, 0 means unlimited. SaveFile fails
+	// with ErrQuotaExceeded for files that would exceed it.
+	QuotaBytes int64
+	// AllowedRecipes restricts the recipes the tenant may use, all recipes if empty.
+	AllowedRecipes []string
+}
+
+type tenantScope struct {
+	id         string
+	mu         sync.Mutex
+	options    TenantOptions
+	usage      int64
+	usageKnown bool
+}
+
+// root returns the FileManager a tenant view was created from, or the FileManager itself.
+func (fm *FileManager) root() *FileManager {
+	if fm.parent != nil {
+		return fm.parent
+	}
+	return fm
+}
+
+// ConfigureTenant sets the quota and recipe allowlist of a tenant, also for views already returned by ForTenant.
+func (fm *FileManager) ConfigureTenant(tenantID string, opts TenantOptions) error {
+	if !tenantIDPattern.MatchString(tenantID) {
+		return fmt.Errorf("%w: %q", ErrInvalidTenantID, tenantID)
+	}
+	root := fm.root()
+	root.tenantsMu.Lock()
+	defer root.tenantsMu.Unlock()
+	if root.tenantOptions == nil {
+		root.tenantOptions = make(map[string]TenantOptions)
+	}
+	opts.AllowedRecipes = append([]string(nil), opts.AllowedRecipes...)
+	root.tenantOptions[tenantID] = opts
+	if view, ok := root.tenants[tenantID]; ok {
+		view.tenant.mu.Lock()
+		view.tenant.options = opts
+		view.tenant.mu.Unlock()
+	}
+	return nil
+}
+
+// ForTenant returns a view of the FileManager scoped to the tenant: its public, private and temp paths are
+// <base path>/<tenantID> and its base URL is <base URL>/<tenantID>/, so files, URLs, processes and duplicate
+// detection never cross tenants. Plugins, recipes, storage and all other settings are shared with, and must be
+// configured on, the FileManager the view is created from. Repeated calls return the same view.
+func (fm *FileManager) ForTenant(tenantID string) (*FileManager, error) {
+	if !tenantIDPattern.MatchString(tenantID) {
+		return nil, fmt.Errorf("%w: %q", ErrInvalidTenantID, tenantID)
+	}
+	root := fm.root()
+	root.tenantsMu.Lock()
+	defer root.tenantsMu.Unlock()
+	if view, ok := root.tenants[tenantID]; ok {
+		return view, nil
+	}
+	baseUrl, err := joinURL(root.baseUrl, tenantID+"/")
+	if err != nil {
+		return nil, err
+	}
+	root.mu.RLock()
+	logger := root.logger
+	root.mu.RUnlock()
+	view := NewFileManager(
+		path.Join(root.publicLocalBasePath, tenantID),
+		path.Join(root.privateLocalBasePath, tenantID),
+		baseUrl,
+		path.Join(root.localTempPath, tenantID),
+		logger,
+	)
+	view.processRetention = root.processRetention
+	view.parent = root
+	view.tenant = &tenantScope{id: tenantID, options: root.tenantOptions[tenantID]}
+	if root.tenants == nil {
+		root.tenants = make(map[string]*FileManager)
+	}
+	root.tenants[tenantID] = view
+	return view, nil
+}
+
+// TenantID returns the tenant of a view returned by ForTenant, "" for other FileManagers.
+func (fm *FileManager) TenantID() string {
+	if fm.tenant == nil {
+		return ""
+	}
+	return fm.tenant.id
+}
+
+// TenantUsage recalculates the total size of the tenant's public and private files. It needs a Storage
+// implementing DirStorage.
+func (fm *FileManager) TenantUsage() (int64, error) {
+	if fm.tenant == nil {
+		return 0, fmt.Errorf("%w: not a tenant view", ErrInvalidTenantID)
+	}
+	usage, err := fm.calculateUsage()
+	if err != nil {
+		return 0, err
+	}
+	fm.tenant.mu.Lock()
+	defer fm.tenant.mu.Unlock()
+	fm.tenant.usage = usage
+	fm.tenant.usageKnown = true
+	return usage, nil
+}
+
+func (fm *FileManager) calculateUsage() (int64, error) {
+	storage, ok := fm.GetStorage().(DirStorage)
+	if !ok {
+		return 0, ErrReplicationNotDirectory
+	}
+	var usage int64
+	for _, base := range []string{fm.publicLocalBasePath, fm.privateLocalBasePath} {
+		paths, err := listStorageFiles(storage, base)
+		if err != nil {
+			return 0, err
+		}
+		for _, localFilePath := range paths {
+			info, err := storage.Stat(localFilePath)
+			if err != nil {
+				continue
+			}
+			usage += info.Size()
+		}
+	}
+	return usage, nil
+}
+
+// checkRecipeAllowed returns ErrRecipeNotAllowed if a tenant view may not use the recipe.
+func (fm *FileManager) checkRecipeAllowed(recipeName string) error {
+	if fm.tenant == nil {
+		return nil
+	}
+	fm.tenant.mu.Lock()
+	defer fm.tenant.mu.Unlock()
+	if len(fm.tenant.options.AllowedRecipes) == 0 {
+		return nil
+	}
+	for _, allowed := range fm.tenant.options.AllowedRecipes {
+		if allowed == recipeName {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %s(%s)", ErrRecipeNotAllowed, fm.tenant.id, recipeName)
+}
+
+// reserveQuota accounts for a file about to be saved (replacing the existing file at its path) and fails with
+// ErrQuotaExceeded if it does not fit the tenant's quota. Temp files are not counted.
+func (fm *FileManager) reserveQuota(localFilePath string, size int64) error {
+	if fm.tenant == nil || !fm.isReplicatedPath(localFilePath) {
+		return nil
+	}
+	delta := size
+	if info, err := fm.GetStorage().Stat(localFilePath); err == nil {
+		delta -= info.Size()
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	fm.tenant.mu.Lock()
+	known := fm.tenant.usageKnown
+	fm.tenant.mu.Unlock()
+	if !known {
+		// storages without DirStorage start counting at zero
+		_, err := fm.TenantUsage()
+		if err != nil && !errors.Is(err, ErrReplicationNotDirectory) {
+			return err
+		}
+	}
+	fm.tenant.mu.Lock()
+	defer fm.tenant.mu.Unlock()
+	quota := fm.tenant.options.QuotaBytes
+	if quota > 0 && delta > 0 && fm.tenant.usage+delta > quota {
+		return fmt.Errorf("%w: %s uses %d of %d bytes, file(%s) needs %d", ErrQuotaExceeded, fm.tenant.id, fm.tenant.usage, quota, localFilePath, delta)
+	}
+	fm.tenant.usage += delta
+	fm.tenant.usageKnown = true
+	return nil
+}
+
+// releaseQuota accounts for a deleted file.
+func (fm *FileManager) releaseQuota(localFilePath string, size int64) {
+	if fm.tenant == nil || !fm.isReplicatedPath(localFilePath) {
+		return
+	}
+	fm.tenant.mu.Lock()
+	defer fm.tenant.mu.Unlock()
+	fm.tenant.usage -= size
+	if fm.tenant.usage < 0 {
+		fm.tenant.usage = 0
+	}
+}
+
+// invalidateUsage makes the next save recalculate the tenant's usage, e.g. after files were restored.
+func (fm *FileManager) invalidateUsage() {
+	if fm.tenant == nil {
+		return
+	}
+	fm.tenant.mu.Lock()
+	defer fm.tenant.mu.Unlock()
+	fm.tenant.usageKnown = false
+}
+
+// ownsPath reports whether a tenant view may see the file, i.e. it is below one of the view's paths. Always true
+// outside of tenant views.
+func (fm *FileManager) ownsPath(localFilePath string) bool {
+	if fm.tenant == nil {
+		return true
+	}
+	path, err := filepath.Abs(localFilePath)
+	if err != nil {
+		return false
+	}
+	for _, base := range []string{fm.publicLocalBasePath, fm.privateLocalBasePath, fm.localTempPath, fm.fastTempPath()} {
+		if base == "" {
+			continue
+		}
+		base, err = filepath.Abs(base)
+		if err != nil {
+			continue
+		}
+		relative, err := filepath.Rel(base, path)
+		if err == nil && relative != "." && relative != ".." && !strings.HasPrefix(relative, ".."+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkOwnsPath fails with ErrTenantPathDenied if a tenant view is handed the path of a file it does not own, like
+// one of another tenant. The path taking methods of views check their paths, so tenants cannot read, write, move
+// or delete each other's files.
+func (fm *FileManager) checkOwnsPath(localFilePath string) error {
+	if fm.ownsPath(localFilePath) {
+		return nil
+	}
+	return fmt.Errorf("%w: %s is not a file of tenant %s", ErrTenantPathDenied, localFilePath, fm.tenant.id)
+}
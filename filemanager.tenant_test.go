@@ -0,0 +1,77 @@
+package filemanager_test
+
+import (
+	"errors"
+	"testing"
+
+	filemanager "github.com/itsatony/go-filemanager"
+	"github.com/itsatony/go-filemanager/filemanagertest"
+)
+
+func TestTenantViewsCannotAccessOtherTenantsFiles(t *testing.T) {
+	tfm := filemanagertest.NewTestFileManager(t)
+	tenantA, err := tfm.ForTenant("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tenantB, err := tfm.ForTenant("b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret := &filemanager.ManagedFile{
+		FileName:      "secret.txt",
+		LocalFilePath: tenantB.GetLocalPathForFile(filemanager.FileStorageTypePrivate, "secret.txt"),
+		Content:       []byte("secret"),
+		MimeType:      "text/plain",
+	}
+	err = tenantB.SaveFile(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	foreign := &filemanager.ManagedFile{FileName: "secret.txt", LocalFilePath: secret.LocalFilePath}
+	ownPath := tenantA.GetLocalPathForFile(filemanager.FileStorageTypePrivate, "stolen.txt")
+
+	tests := []struct {
+		name string
+		call func() error
+	}{
+		{name: "ReadFileRange", call: func() error {
+			_, err := tenantA.ReadFileRange(foreign, 0, 6)
+			return err
+		}},
+		{name: "Open", call: func() error {
+			_, err := foreign.Open(tenantA)
+			return err
+		}},
+		{name: "LoadManagedFile", call: func() error {
+			_, err := tenantA.LoadManagedFile(secret.LocalFilePath)
+			return err
+		}},
+		{name: "SaveFile", call: func() error {
+			return tenantA.SaveFile(&filemanager.ManagedFile{FileName: "secret.txt", LocalFilePath: secret.LocalFilePath, Content: []byte("overwritten")})
+		}},
+		{name: "MoveFile", call: func() error {
+			return tenantA.MoveFile(secret.LocalFilePath, ownPath)
+		}},
+		{name: "ListVersions", call: func() error {
+			_, err := tenantA.ListVersions(secret.LocalFilePath)
+			return err
+		}},
+		{name: "DeleteFile", call: func() error {
+			return tenantA.DeleteFile(foreign)
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.call()
+			if !errors.Is(err, filemanager.ErrTenantPathDenied) {
+				t.Fatalf("%s() = %v, want ErrTenantPathDenied", test.name, err)
+			}
+		})
+	}
+
+	content, err := tenantB.ReadFileRange(foreign, 0, 6)
+	if err != nil || string(content) != "secret" {
+		t.Fatalf("tenant b ReadFileRange() = %q, %v, want its unchanged file", content, err)
+	}
+}
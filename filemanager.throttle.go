@@ -0,0 +1,218 @@
+package filemanager
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const DEFAULT_THROTTLE_BURST = 64 * 1024
+
+// RateLimiter is a token bucket limiting transfers to a number of bytes per second. A limiter can be shared by
+// many transfers to cap their combined bandwidth.
+type RateLimiter struct {
+	bytesPerSecond float64
+	burst          int
+	mu             sync.Mutex
+	tokens         float64
+	last           time.Time
+}
+
+// NewRateLimiter allows bytesPerSecond on average and bursts of up to burst bytes (defaults to 64 KiB, at most
+// bytesPerSecond).
+func NewRateLimiter(bytesPerSecond int64, burst int) *RateLimiter {
+	if burst <= 0 {
+		burst = DEFAULT_THROTTLE_BURST
+		if int64(burst) > bytesPerSecond {
+			burst = int(bytesPerSecond)
+		}
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	return &RateLimiter{bytesPerSecond: float64(bytesPerSecond), burst: burst, tokens: float64(burst), last: time.Now()}
+}
+
+// Burst returns the largest number of bytes WaitN hands out at once.
+func (l *RateLimiter) Burst() int {
+	return l.burst
+}
+
+// WaitN blocks until n bytes may be transferred or the context is done. n larger than the burst is waited for in
+// burst-sized steps.
+func (l *RateLimiter) WaitN(ctx context.Context, n int) error {
+	for n > 0 {
+		step := min(n, l.burst)
+		err := l.wait(ctx, step)
+		if err != nil {
+			return err
+		}
+		n -= step
+	}
+	return nil
+}
+
+func (l *RateLimiter) wait(ctx context.Context, n int) error {
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.bytesPerSecond
+	if l.tokens > float64(l.burst) {
+		l.tokens = float64(l.burst)
+	}
+	l.last = now
+	// reserve the tokens right away, so concurrent transfers queue up instead of racing for the same tokens
+	l.tokens -= float64(n)
+	missing := -l.tokens
+	l.mu.Unlock()
+	if missing <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(time.Duration(missing / l.bytesPerSecond * float64(time.Second)))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		l.mu.Lock()
+		l.tokens += float64(n)
+		l.mu.Unlock()
+		return ctx.Err()
+	}
+}
+
+// ThrottleOptions limit the bandwidth of a single transfer. The FileManager-wide limit set with
+// SetDownloadRateLimit applies in addition.
+type ThrottleOptions struct {
+	BytesPerSecond int64 // 0 means no per-transfer limit
+	Burst          int
+	// Limiter is an additional shared limiter, e.g. one per tenant.
+	Limiter *RateLimiter
+}
+
+func (opts ThrottleOptions) limiters(shared *RateLimiter) []*RateLimiter {
+	var limiters []*RateLimiter
+	if shared != nil {
+		limiters = append(limiters, shared)
+	}
+	if opts.Limiter != nil {
+		limiters = append(limiters, opts.Limiter)
+	}
+	if opts.BytesPerSecond > 0 {
+		limiters = append(limiters, NewRateLimiter(opts.BytesPerSecond, opts.Burst))
+	}
+	return limiters
+}
+
+// SetDownloadRateLimit caps the combined bandwidth of all downloads (DownloadFile, EnsureFileIsLocal) and
+// throttled handlers of the FileManager. bytesPerSecond <= 0 removes the limit.
+func (fm *FileManager) SetDownloadRateLimit(bytesPerSecond int64, burst int) {
+	var limiter *RateLimiter
+	if bytesPerSecond > 0 {
+		limiter = NewRateLimiter(bytesPerSecond, burst)
+	}
+	fm.mu.Lock()
+	defer fm.mu.Unlock()
+	fm.downloadLimiter = limiter
+}
+
+func (fm *FileManager) getDownloadLimiter() *RateLimiter {
+	if fm.parent != nil {
+		return fm.parent.getDownloadLimiter()
+	}
+	fm.mu.RLock()
+	defer fm.mu.RUnlock()
+	return fm.downloadLimiter
+}
+
+// DownloadFile downloads the url to localFilePath within the FileManager's download rate limit and the limit of
+// opts.
+func (fm *FileManager) DownloadFile(url string, localFilePath string, opts ThrottleOptions) error {
+	return downloadFile(context.Background(), url, localFilePath, opts.limiters(fm.getDownloadLimiter()))
+}
+
+// ThrottleHandler limits the bandwidth of responses written by next, e.g. a download proxy or an http.FileServer,
+// to the FileManager's download rate limit and the limit of opts per request.
+func (fm *FileManager) ThrottleHandler(next http.Handler, opts ThrottleOptions) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		limiters := opts.limiters(fm.getDownloadLimiter())
+		if len(limiters) > 0 {
+			w = &throttledResponseWriter{ResponseWriter: w, ctx: r.Context(), limiters: limiters}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// NewThrottledReader returns a reader that waits for all limiters before handing out data.
+func NewThrottledReader(ctx context.Context, r io.Reader, limiters ...*RateLimiter) io.Reader {
+	if len(limiters) == 0 {
+		return r
+	}
+	return &throttledReader{r: r, ctx: ctx, limiters: limiters}
+}
+
+type throttledReader struct {
+	r        io.Reader
+	ctx      context.Context
+	limiters []*RateLimiter
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	p = p[:min(len(p), minBurst(t.limiters))]
+	n, err := t.r.Read(p)
+	if n > 0 {
+		waitErr := waitAll(t.ctx, t.limiters, n)
+		if waitErr != nil {
+			return n, waitErr
+		}
+	}
+	return n, err
+}
+
+type throttledResponseWriter struct {
+	http.ResponseWriter
+	ctx      context.Context
+	limiters []*RateLimiter
+}
+
+func (t *throttledResponseWriter) Write(p []byte) (int, error) {
+	written := 0
+	step := minBurst(t.limiters)
+	for written < len(p) {
+		n := min(len(p)-written, step)
+		err := waitAll(t.ctx, t.limiters, n)
+		if err != nil {
+			return written, err
+		}
+		n, err = t.ResponseWriter.Write(p[written : written+n])
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// Unwrap gives http.ResponseController access to Flush and deadlines of the wrapped writer.
+func (t *throttledResponseWriter) Unwrap() http.ResponseWriter {
+	return t.ResponseWriter
+}
+
+func waitAll(ctx context.Context, limiters []*RateLimiter, n int) error {
+	for _, limiter := range limiters {
+		err := limiter.WaitN(ctx, n)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func minBurst(limiters []*RateLimiter) int {
+	burst := limiters[0].Burst()
+	for _, limiter := range limiters[1:] {
+		burst = min(burst, limiter.Burst())
+	}
+	return burst
+}
@@ -0,0 +1,321 @@
+package filemanager
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"mime"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+var (
+	ErrTrashDisabled     = errors.New("trash is not enabled")
+	ErrNotInTrash        = errors.New("file not found in trash")
+	ErrRestoreTargetUsed = errors.New("restore target already exists")
+)
+
+const TRASH_ID_PREFIX = "TR"
+const TRASH_ID_LENGTH = 16
+const TRASH_DIR_NAME = ".trash"
+const DEFAULT_TRASH_RETENTION = 30 * 24 * time.Hour
+const trashEntrySuffix = ".trash.json"
+
+// TrashOptions configures soft-deletes. Path defaults to a .trash directory in the private base path.
+type TrashOptions struct {
+	Path      string        `yaml:"path"`
+	Retention time.Duration `yaml:"retention"`
+}
+
+// TrashEntry describes a soft-deleted file.
+type TrashEntry struct {
+	ID            string         `json:"id"`
+	OriginalPath  string         `json:"originalPath"`
+	TrashFilePath string         `json:"trashFilePath"`
+	FileName      string         `json:"fileName"`
+	MimeType      string         `json:"mimetype"`
+	URL           string         `json:"url"`
+	FileSize      int64          `json:"fileSize"`
+	MetaData      map[string]any `json:"metaData"`
+	HTTPHeaders   *HTTPHeaders   `json:"httpHeaders,omitempty"`
+	PreCompress   []string       `json:"preCompress,omitempty"` // encodings of the removed compressed variants
+	DeletedAt     time.Time      `json:"deletedAt"`
+}
+
+// EnableTrash turns DeleteFile into a soft-delete that moves files into the trash until the retention period expires.
+func (fm *FileManager) EnableTrash(options TrashOptions) error {
+	if options.Path == "" {
+		options.Path = filepath.Join(fm.privateLocalBasePath, TRASH_DIR_NAME)
+	}
+	if options.Retention <= 0 {
+		options.Retention = DEFAULT_TRASH_RETENTION
+	}
+	err := mkdirAllMode(options.Path, fm.getFilePermissions().dirMode())
+	if err != nil {
+		return err
+	}
+	fm.mu.Lock()
+	defer fm.mu.Unlock()
+	fm.trash = &options
+	return nil
+}
+
+func (fm *FileManager) getTrashOptions() *TrashOptions {
+	if fm.parent != nil {
+		return fm.parent.getTrashOptions()
+	}
+	fm.mu.RLock()
+	defer fm.mu.RUnlock()
+	return fm.trash
+}
+
+// DeleteFile deletes the local file of a ManagedFile from the Storage. With the trash enabled the file is moved into
+// the trash on the local disk instead and can be restored with RestoreFromTrash until the retention period expires.
+func (fm *FileManager) DeleteFile(file *ManagedFile) error {
+	err := fm.checkOwnsPath(file.LocalFilePath)
+	if err != nil {
+		return err
+	}
+	storage := fm.storageFor(file.LocalFilePath)
+	info, err := storage.Stat(file.LocalFilePath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return ErrLocalFileNotFound
+	}
+	if err != nil {
+		return err
+	}
+	err = fm.checkContainedPath(file.LocalFilePath)
+	if err != nil {
+		return err
+	}
+	err = fm.checkNotOnHold(file.LocalFilePath)
+	if err != nil {
+		return err
+	}
+	fm.imageHashes.remove(file.LocalFilePath)
+	size := info.Size()
+	if index := fm.getSearchIndex(); index != nil {
+		err := index.DeleteDocument(file.LocalFilePath)
+		if err != nil {
+			return err
+		}
+	}
+	options := fm.getTrashOptions()
+	if options == nil {
+		err := storage.Remove(file.LocalFilePath)
+		if err != nil {
+			return err
+		}
+		if store := fm.getMetadataStore(); store != nil {
+			err = store.DeleteRecord(file.LocalFilePath)
+			if err != nil {
+				return err
+			}
+		}
+		fm.removeHTTPHeaders(file.LocalFilePath)
+		fm.removePreCompressed(file.LocalFilePath)
+		fm.releaseQuota(file.LocalFilePath, size)
+		fm.replicate(file.LocalFilePath, true)
+		fm.LogTo("DEBUG", fmt.Sprintf("[FileManager.DeleteFile] Deleted file(%s)\n", file.LocalFilePath))
+		return nil
+	}
+
+	id := NID(TRASH_ID_PREFIX, TRASH_ID_LENGTH)
+	entry := TrashEntry{
+		ID:            id,
+		OriginalPath:  file.LocalFilePath,
+		TrashFilePath: filepath.Join(options.Path, id+filepath.Ext(file.LocalFilePath)),
+		FileName:      file.FileName,
+		MimeType:      file.MimeType,
+		URL:           file.URL,
+		FileSize:      size,
+		MetaData:      file.MetaData,
+		DeletedAt:     time.Now(),
+	}
+	if headers, err := fm.GetHTTPHeaders(file.LocalFilePath); err == nil && headers != (HTTPHeaders{}) {
+		entry.HTTPHeaders = &headers
+	}
+	entry.PreCompress = fm.preCompressedEncodings(file.LocalFilePath)
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	err = os.WriteFile(filepath.Join(options.Path, id+trashEntrySuffix), data, fm.getFilePermissions().fileModeOr(0644))
+	if err != nil {
+		return err
+	}
+	err = fm.moveToTrash(storage, file.LocalFilePath, entry.TrashFilePath)
+	if err != nil {
+		os.Remove(filepath.Join(options.Path, id+trashEntrySuffix))
+		return err
+	}
+	fm.removeHTTPHeaders(file.LocalFilePath)
+	fm.removePreCompressed(file.LocalFilePath)
+	fm.releaseQuota(file.LocalFilePath, size)
+	fm.replicate(file.LocalFilePath, true)
+	fm.LogTo("DEBUG", fmt.Sprintf("[FileManager.DeleteFile] Moved file(%s) to trash(%s)\n", file.LocalFilePath, id))
+	return nil
+}
+
+// ListTrash returns all entries in the trash, most recently deleted first. Tenant views only list their own files.
+func (fm *FileManager) ListTrash() ([]TrashEntry, error) {
+	options := fm.getTrashOptions()
+	if options == nil {
+		return nil, ErrTrashDisabled
+	}
+	dirEntries, err := os.ReadDir(options.Path)
+	if err != nil {
+		return nil, err
+	}
+	entries := []TrashEntry{}
+	for _, dirEntry := range dirEntries {
+		if dirEntry.IsDir() || !strings.HasSuffix(dirEntry.Name(), trashEntrySuffix) {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(options.Path, dirEntry.Name()))
+		if err != nil {
+			continue
+		}
+		var entry TrashEntry
+		err = json.Unmarshal(data, &entry)
+		if err != nil || !fm.ownsPath(entry.OriginalPath) {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].DeletedAt.After(entries[j].DeletedAt)
+	})
+	return entries, nil
+}
+
+// RestoreFromTrash moves the most recently deleted file with the ManagedFile's local path back to its original location.
+func (fm *FileManager) RestoreFromTrash(file *ManagedFile) (*ManagedFile, error) {
+	options := fm.getTrashOptions()
+	if options == nil {
+		return nil, ErrTrashDisabled
+	}
+	err := fm.checkOwnsPath(file.LocalFilePath)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := fm.ListTrash()
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if entry.OriginalPath != file.LocalFilePath {
+			continue
+		}
+		storage := fm.storageFor(entry.OriginalPath)
+		if _, err := storage.Stat(entry.OriginalPath); err == nil {
+			return nil, ErrRestoreTargetUsed
+		}
+		err = fm.moveFromTrash(storage, entry.TrashFilePath, entry.OriginalPath)
+		if err != nil {
+			return nil, err
+		}
+		os.Remove(filepath.Join(options.Path, entry.ID+trashEntrySuffix))
+		fm.replicate(entry.OriginalPath, false)
+		fm.invalidateUsage()
+		if entry.HTTPHeaders != nil {
+			err = fm.SetHTTPHeaders(entry.OriginalPath, *entry.HTTPHeaders)
+			if err != nil {
+				fm.LogTo("INFO", fmt.Sprintf("[FileManager.RestoreFromTrash] Restoring http headers of file(%s) failed: %v\n", entry.OriginalPath, err))
+			}
+		}
+		if len(entry.PreCompress) > 0 {
+			mimeType := entry.MimeType
+			if mimeType == "" {
+				mimeType = mime.TypeByExtension(filepath.Ext(entry.OriginalPath))
+			}
+			_, err = fm.PreCompressFile(&ManagedFile{LocalFilePath: entry.OriginalPath, MimeType: mimeType}, entry.PreCompress)
+			if err != nil {
+				fm.LogTo("INFO", fmt.Sprintf("[FileManager.RestoreFromTrash] Restoring compressed variants of file(%s) failed: %v\n", entry.OriginalPath, err))
+			}
+		}
+		fm.LogTo("DEBUG", fmt.Sprintf("[FileManager.RestoreFromTrash] Restored file(%s) from trash(%s)\n", entry.OriginalPath, entry.ID))
+		return &ManagedFile{
+			FileName:      entry.FileName,
+			MimeType:      entry.MimeType,
+			URL:           entry.URL,
+			LocalFilePath: entry.OriginalPath,
+			FileSize:      entry.FileSize,
+			MetaData:      entry.MetaData,
+			HTTPHeaders:   entry.HTTPHeaders,
+		}, nil
+	}
+	return nil, ErrNotInTrash
+}
+
+// PurgeTrash permanently deletes trash entries older than the retention period and returns how many were removed.
+func (fm *FileManager) PurgeTrash() (int, error) {
+	options := fm.getTrashOptions()
+	if options == nil {
+		return 0, nil
+	}
+	entries, err := fm.ListTrash()
+	if err != nil {
+		return 0, err
+	}
+	purged := 0
+	for _, entry := range entries {
+		if time.Since(entry.DeletedAt) <= options.Retention {
+			continue
+		}
+		err = os.Remove(entry.TrashFilePath)
+		if err != nil && !os.IsNotExist(err) {
+			fm.LogTo("INFO", fmt.Sprintf("[FileManager.PurgeTrash] Failed to purge trash(%s): %v\n", entry.ID, err))
+			continue
+		}
+		os.Remove(filepath.Join(options.Path, entry.ID+trashEntrySuffix))
+		if store := fm.getMetadataStore(); store != nil {
+			if _, err := fm.storageFor(entry.OriginalPath).Stat(entry.OriginalPath); errors.Is(err, fs.ErrNotExist) {
+				store.DeleteRecord(entry.OriginalPath)
+			}
+		}
+		purged++
+	}
+	return purged, nil
+}
+
+// moveToTrash moves a file of the storage into the trash on the local disk, copying it out of other storages.
+func (fm *FileManager) moveToTrash(storage Storage, localFilePath string, trashFilePath string) error {
+	if _, ok := storage.(LocalStorage); ok {
+		return fm.moveFile(localFilePath, trashFilePath)
+	}
+	data, err := storage.ReadFile(localFilePath)
+	if err != nil {
+		return err
+	}
+	perms := fm.getFilePermissions()
+	err = writeFileAtomic(trashFilePath, data, perms.fileModeOr(0600), perms.dirMode(), true)
+	if err != nil {
+		return err
+	}
+	err = storage.Remove(localFilePath)
+	if err != nil {
+		os.Remove(trashFilePath)
+	}
+	return err
+}
+
+// moveFromTrash moves a file in the trash back into the storage.
+func (fm *FileManager) moveFromTrash(storage Storage, trashFilePath string, localFilePath string) error {
+	if _, ok := storage.(LocalStorage); ok {
+		return fm.moveFile(trashFilePath, localFilePath)
+	}
+	data, err := os.ReadFile(trashFilePath)
+	if err != nil {
+		return err
+	}
+	err = storage.WriteFile(localFilePath, data, fm.getFilePermissions().fileModeOr(0644), true)
+	if err != nil {
+		return err
+	}
+	return os.Remove(trashFilePath)
+}
@@ -0,0 +1,70 @@
+package filemanager_test
+
+import (
+	"errors"
+	"io/fs"
+	"testing"
+
+	filemanager "github.com/itsatony/go-filemanager"
+	"github.com/itsatony/go-filemanager/filemanagertest"
+)
+
+func saveTestFile(t *testing.T, tfm *filemanagertest.TestFileManager, name string, content string) *filemanager.ManagedFile {
+	t.Helper()
+	file := &filemanager.ManagedFile{
+		FileName:      name,
+		LocalFilePath: tfm.GetLocalPathForFile(filemanager.FileStorageTypePrivate, name),
+		Content:       []byte(content),
+	}
+	err := tfm.SaveFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestDeleteFileFromMemoryStorage(t *testing.T) {
+	tfm := filemanagertest.NewTestFileManager(t)
+	file := saveTestFile(t, tfm, "hello.txt", "hello")
+
+	err := tfm.DeleteFile(file)
+	if err != nil {
+		t.Fatalf("DeleteFile() = %v", err)
+	}
+	if _, err := tfm.Storage.Stat(file.LocalFilePath); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("Stat() after DeleteFile() = %v, want fs.ErrNotExist", err)
+	}
+	err = tfm.DeleteFile(file)
+	if !errors.Is(err, filemanager.ErrLocalFileNotFound) {
+		t.Fatalf("second DeleteFile() = %v, want ErrLocalFileNotFound", err)
+	}
+}
+
+func TestTrashWithMemoryStorage(t *testing.T) {
+	tfm := filemanagertest.NewTestFileManager(t)
+	err := tfm.EnableTrash(filemanager.TrashOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := saveTestFile(t, tfm, "hello.txt", "hello")
+
+	err = tfm.DeleteFile(file)
+	if err != nil {
+		t.Fatalf("DeleteFile() = %v", err)
+	}
+	if _, err := tfm.Storage.Stat(file.LocalFilePath); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("Stat() after DeleteFile() = %v, want fs.ErrNotExist", err)
+	}
+	entries, err := tfm.ListTrash()
+	if err != nil || len(entries) != 1 || entries[0].FileSize != 5 {
+		t.Fatalf("ListTrash() = %+v, %v, want the deleted file", entries, err)
+	}
+
+	_, err = tfm.RestoreFromTrash(file)
+	if err != nil {
+		t.Fatalf("RestoreFromTrash() = %v", err)
+	}
+	if content := tfm.ReadFile(file.LocalFilePath); string(content) != "hello" {
+		t.Fatalf("restored content = %q, want %q", content, "hello")
+	}
+}
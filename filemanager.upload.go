@@ -2,16 +2,58 @@
 package filemanager
 
 import (
+	"bytes"
+	"context"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
+	"unicode"
 )
 
 func (fm *FileManager) HandleFileUpload(r io.Reader, fileProcess *FileProcess, statusCh chan<- *FileProcess) (*ManagedFile, error) {
-	// todo: make incoming filename safe!
-	tempFile, err := os.CreateTemp(fm.localTempPath, "upload-*_."+filepath.Ext(fileProcess.IncomingFileName))
+	return fm.handleFileUpload(context.Background(), r, fileProcess, statusCh)
+}
+
+func (fm *FileManager) handleFileUpload(ctx context.Context, r io.Reader, fileProcess *FileProcess, statusCh chan<- *FileProcess) (*ManagedFile, error) {
+	fileProcess.IncomingFileName = safeIncomingFileName(fileProcess.IncomingFileName)
+	fm.RegisterProcess(fileProcess)
+	err := fm.claimUploadSession(fileProcess)
+	if err != nil {
+		fm.failUploadSession(fileProcess, statusCh, err)
+		return nil, err
+	}
+	storage := fm.GetStorage()
+	progressReader := &ProgressReader{
+		Reader:      r,
+		Size:        0,
+		Uploaded:    0,
+		StatusCh:    statusCh,
+		FileProcess: fileProcess,
+	}
+	if fileProcess.session != nil {
+		progressReader.Size = fileProcess.session.Options.ExpectedSize
+	}
+
+	// in scan-before-store mode, uploads are only written once they are known to be clean
+	upload := fm.uploadTimeoutReader(ctx, sessionUploadReader(progressReader, fileProcess), r, fileProcess, statusCh)
+	var scanResult *VirusScanResult
+	if scan := fm.getUploadScan(); scan != nil {
+		content, result, err := fm.scanIncomingUpload(upload, scan, fileProcess, statusCh)
+		if err != nil {
+			if isUploadAbort(err) {
+				fm.runUploadAbortHook(UploadAbortEvent{FileProcess: fileProcess, Err: err})
+			}
+			return nil, err
+		}
+		upload = bytes.NewReader(content)
+		scanResult = result
+	}
+
+	// small uploads go to the fast temp path if it is enabled
+	tempFile, err := fm.createUploadFile(UPLOAD_TEMP_FILE_PREFIX+NID("", 16)+"_."+filepath.Ext(fileProcess.IncomingFileName), fileProcess)
 	if err != nil {
 		status := ProcessingStatus{
 			ProcessID:         fileProcess.ID,
@@ -22,90 +64,144 @@ func (fm *FileManager) HandleFileUpload(r io.Reader, fileProcess *FileProcess, s
 			Done:              true,
 		}
 		fileProcess.AddProcessingUpdate(status)
-		statusCh <- fileProcess
+		fm.publishFinalStatus(statusCh, fileProcess)
 		return nil, err
 	}
-	defer tempFile.Close()
 
-	progressReader := &ProgressReader{
-		Reader:      r,
-		Size:        0,
-		Uploaded:    0,
-		StatusCh:    statusCh,
-		FileProcess: fileProcess,
+	_, err = io.Copy(tempFile, upload)
+	closeErr := tempFile.Close()
+	tempFilePath := tempFile.path
+	if err == nil && closeErr != nil {
+		err = &StorageError{Op: "write", Path: tempFilePath, Err: closeErr}
 	}
-
-	_, err = io.Copy(tempFile, progressReader)
 	if err != nil {
+		storage.Remove(tempFilePath)
+		description := "Failed to save uploaded file"
+		if isUploadAbort(err) {
+			description = uploadAbortDescription(err)
+		}
 		status := ProcessingStatus{
 			ProcessID:         fileProcess.ID,
 			TimeStamp:         int(time.Now().UnixNano() / int64(time.Millisecond)),
 			ProcessorName:     "FileUpload",
-			StatusDescription: "Failed to save uploaded file",
+			StatusDescription: description,
 			Error:             err,
 			Done:              true,
 		}
 		fileProcess.AddProcessingUpdate(status)
 
-		fm.LogTo("DEBUG", fmt.Sprintf("[GO-FILEMANAGER #1] Uploading file ERROR: %s - %d%% \n%v", fileProcess.IncomingFileName, 100, status))
-		statusCh <- fileProcess
+		fm.LogTo("DEBUG", fmt.Sprintf("[GO-FILEMANAGER #1] Uploading file ERROR: %s%s - %d%% \n%v", fileProcess.IncomingFileName, fileProcess.LogLabels(), 100, status))
+		fm.publishFinalStatus(statusCh, fileProcess)
+		if isUploadAbort(err) {
+			fm.runUploadAbortHook(UploadAbortEvent{FileProcess: fileProcess, TempFilePath: tempFilePath, BytesReceived: tempFile.written, Err: err})
+		}
 		return nil, err
 	}
 
-	fpath, _, fname := getFilePathAndName("", tempFile.Name())
+	fpath, _, fname := getFilePathAndName("", tempFilePath)
 
 	managedFile := &ManagedFile{
 		FileName:      fname,
 		LocalFilePath: fpath,
 	}
 
-	managedFile.UpdateMimeType()
-	managedFile.UpdateFilesize()
+	// now, we need to read the file again to get the content, large files are mapped if enabled
+	err = fm.readContent(managedFile)
+	if err != nil {
+		err = &StorageError{Op: "read", Path: managedFile.LocalFilePath, Err: err}
+		status := ProcessingStatus{
+			ProcessID:         fileProcess.ID,
+			TimeStamp:         int(time.Now().UnixNano() / int64(time.Millisecond)),
+			ProcessorName:     "FileUpload",
+			StatusDescription: "Failed to read content of uploaded file",
+			Error:             err,
+			Done:              true,
+		}
+		fileProcess.AddProcessingUpdate(status)
 
-	resultingFile := ProcessingResultFile{
-		FileName:      managedFile.FileName,
-		LocalFilePath: managedFile.LocalFilePath,
-		FileSize:      managedFile.FileSize,
-		MimeType:      managedFile.MimeType,
+		storage.Remove(managedFile.LocalFilePath)
+		fm.LogTo("DEBUG", fmt.Sprintf("[GO-FILEMANAGER #3] Uploading file ERROR: %s%s - %d%% \n%v", fileProcess.IncomingFileName, fileProcess.LogLabels(), 100, status))
+		fm.publishFinalStatus(statusCh, fileProcess)
+		return nil, err
 	}
-
-	status := ProcessingStatus{
-		ProcessID:         fileProcess.ID,
-		TimeStamp:         int(time.Now().UnixNano() / int64(time.Millisecond)),
-		ProcessorName:     "FileUpload",
-		StatusDescription: "File uploaded successfully",
-		Done:              false,
-		ResultingFiles:    []ProcessingResultFile{resultingFile},
+	managedFile.MimeType = fm.DetectMimeType(managedFile.FileName, managedFile.Content)
+	managedFile.FileSize = int64(len(managedFile.Content))
+	if scanResult != nil {
+		managedFile.SetMetaData(METADATA_KEY_VIRUS_SCAN, *scanResult)
 	}
-	if progressReader.FileProcess != nil && progressReader.FileProcess.LatestStatus != nil {
-		status.Percentage = progressReader.FileProcess.LatestStatus.Percentage
-		if status.Percentage == 100 {
-			status.Done = true
+	err = fm.applyUploadSession(managedFile, fileProcess)
+	if err != nil {
+		managedFile.ReleaseContent()
+		storage.Remove(managedFile.LocalFilePath)
+		status := ProcessingStatus{
+			ProcessID:         fileProcess.ID,
+			TimeStamp:         int(time.Now().UnixNano() / int64(time.Millisecond)),
+			ProcessorName:     "FileUpload",
+			StatusDescription: "Upload rejected",
+			Error:             err,
+			Done:              true,
 		}
+		fileProcess.AddProcessingUpdate(status)
+		fm.LogTo("INFO", fmt.Sprintf("[FileManager.HandleFileUpload] Upload rejected: %s%s: %v\n", fileProcess.IncomingFileName, fileProcess.LogLabels(), err))
+		fm.publishFinalStatus(statusCh, fileProcess)
+		return nil, err
 	}
-	fileProcess.AddProcessingUpdate(status)
-	// now, we need to read the file again to get the content
-	managedFile.Content, err = os.ReadFile(managedFile.LocalFilePath)
+
+	err = fm.routeUpload(managedFile)
 	if err != nil {
+		managedFile.ReleaseContent()
+		storage.Remove(managedFile.LocalFilePath)
 		status := ProcessingStatus{
 			ProcessID:         fileProcess.ID,
 			TimeStamp:         int(time.Now().UnixNano() / int64(time.Millisecond)),
 			ProcessorName:     "FileUpload",
-			StatusDescription: "Failed to read content of uploaded file",
+			StatusDescription: "Failed to move uploaded file to its storage",
 			Error:             err,
 			Done:              true,
 		}
 		fileProcess.AddProcessingUpdate(status)
-
-		fm.LogTo("DEBUG", fmt.Sprintf("[GO-FILEMANAGER #3] Uploading file ERROR: %s - %d%% \n%v", fileProcess.IncomingFileName, 100, status))
-		statusCh <- fileProcess
+		fm.LogTo("INFO", fmt.Sprintf("[FileManager.HandleFileUpload] Moving upload %s%s to its storage failed: %v\n", fileProcess.IncomingFileName, fileProcess.LogLabels(), err))
+		fm.publishFinalStatus(statusCh, fileProcess)
 		return nil, err
 	}
-	fm.LogTo("DEBUG", fmt.Sprintf("[GO-FILEMANAGER #2] Uploading file: %s - %d%% \n%v", fileProcess.IncomingFileName, 100, status))
-	statusCh <- fileProcess
+
+	resultingFile := newProcessingResultFile(managedFile, nil)
+
+	// not Done: a successful upload is not the end of the process, ProcessFile adds the terminal status
+	status := ProcessingStatus{
+		ProcessID:         fileProcess.ID,
+		TimeStamp:         int(time.Now().UnixNano() / int64(time.Millisecond)),
+		ProcessorName:     "FileUpload",
+		StatusDescription: "File uploaded successfully",
+		Done:              false,
+		ResultingFiles:    []ProcessingResultFile{resultingFile},
+	}
+	if progressReader.FileProcess != nil && progressReader.FileProcess.LatestStatus != nil {
+		status.Percentage = progressReader.FileProcess.LatestStatus.Percentage
+	}
+	fileProcess.AddProcessingUpdate(status)
+	fm.trackUpload(managedFile.LocalFilePath)
+	fm.LogTo("DEBUG", fmt.Sprintf("[GO-FILEMANAGER #2] Uploading file: %s%s - %d%% \n%v", fileProcess.IncomingFileName, fileProcess.LogLabels(), 100, status))
+	fm.publishFinalStatus(statusCh, fileProcess)
 	return managedFile, nil
 }
 
+// safeIncomingFileName reduces the file name sent by a client to its base name without control and formatting
+// characters, as it ends up in log lines, temp file names, statuses and metadata.
+func safeIncomingFileName(name string) string {
+	name = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) || unicode.Is(unicode.Cf, r) {
+			return -1
+		}
+		return r
+	}, name)
+	name = filepath.Base(strings.ReplaceAll(name, "\\", "/"))
+	if name == "." || name == ".." || name == "/" {
+		return ""
+	}
+	return name
+}
+
 type ProgressReader struct {
 	Reader      io.Reader
 	Size        int64
@@ -140,16 +236,11 @@ func (r *ProgressReader) Read(p []byte) (int, error) {
 			StatusDescription: fmt.Sprintf("Uploading file: %s", r.FileProcess.IncomingFileName),
 			Percentage:        percentage,
 		}
-		if percentage == 100 {
-			status.Done = true
-		} else {
-			r.FileProcess.AddProcessingUpdate(status)
-			r.StatusCh <- r.FileProcess
-		}
-		// select {
-		// case r.StatusCh <- r.FileProcess:
-		// default:
-		// }
+		// r.Done only stops the progress updates, the final status of HandleFileUpload is the one marking the
+		// process Done
+		r.Done = percentage == 100
+		r.FileProcess.AddProcessingUpdate(status)
+		publishStatus(r.StatusCh, r.FileProcess)
 	}
 
 	return n, err
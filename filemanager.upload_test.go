@@ -0,0 +1,40 @@
+package filemanager_test
+
+import (
+	"io"
+	"strings"
+	"testing"
+
+	filemanager "github.com/itsatony/go-filemanager"
+	"github.com/itsatony/go-filemanager/filemanagertest"
+)
+
+func TestHandleFileUploadSanitizesIncomingFileName(t *testing.T) {
+	tfm := filemanagertest.NewTestFileManager(t)
+	fileProcess := filemanager.NewFileProcess("..\\../etc/pass\nwd\u202e.txt", "")
+
+	_, err := uploadWithError(tfm, fileProcess, []byte("hello"))
+	if err != nil {
+		t.Fatalf("HandleFileUpload() = %v", err)
+	}
+	if fileProcess.IncomingFileName != "passwd.txt" {
+		t.Fatalf("IncomingFileName = %q, want %q", fileProcess.IncomingFileName, "passwd.txt")
+	}
+	if !tfm.Logs.Contains("", "passwd.txt") || tfm.Logs.Contains("", "\u202e") {
+		t.Fatalf("log lines %v, want the sanitized file name", tfm.Logs.Entries())
+	}
+}
+
+func TestProgressReaderLeavesDoneToTheFinalStatus(t *testing.T) {
+	fileProcess := filemanager.NewFileProcess("hello.txt", "")
+	reader := &filemanager.ProgressReader{Reader: strings.NewReader("hello"), Size: 5, FileProcess: fileProcess}
+
+	_, err := io.Copy(io.Discard, reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	status := fileProcess.GetLatestProcessingStatus()
+	if status == nil || status.Percentage != 100 || status.Done || fileProcess.Finished() {
+		t.Fatalf("latest status = %+v, want 100%% progress without Done", status)
+	}
+}
@@ -0,0 +1,67 @@
+package filemanager
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// UploadAbortEvent describes an upload HandleFileUploadContext gave up on: its context was cancelled, e.g. because
+// the client disconnected, or it ran into one of the upload timeouts. Its temp file is already removed.
+type UploadAbortEvent struct {
+	FileProcess   *FileProcess
+	TempFilePath  string // empty if the upload was aborted before its temp file was created
+	BytesReceived int64  // written to the temp file before the abort
+	Err           error  // matches ErrProcessCancelled, ErrUploadStalled or ErrUploadDeadlineExceeded
+}
+
+// UploadAbortFunc is called for every aborted upload, e.g. to release a reservation or log the disconnect.
+type UploadAbortFunc func(fm *FileManager, event UploadAbortEvent)
+
+// OnUploadAbort sets the function called for aborted uploads, nil removes it. Tenant views share it with their
+// FileManager.
+func (fm *FileManager) OnUploadAbort(hook UploadAbortFunc) {
+	root := fm.root()
+	root.mu.Lock()
+	defer root.mu.Unlock()
+	root.uploadAbortHook = hook
+}
+
+// HandleFileUploadContext is HandleFileUpload for uploads bound to a context, like that of an HTTP request. If the
+// context ends while the upload is received, the upload is aborted: the read in flight is ended like on an upload
+// timeout (see SetUploadTimeouts), the partial temp file is removed, the process ends with an "Upload cancelled"
+// status whose Error matches ErrProcessCancelled and the context's error, and the OnUploadAbort hook is called.
+func (fm *FileManager) HandleFileUploadContext(ctx context.Context, r io.Reader, fileProcess *FileProcess, statusCh chan<- *FileProcess) (*ManagedFile, error) {
+	return fm.handleFileUpload(ctx, r, fileProcess, statusCh)
+}
+
+// isUploadAbort reports whether the error is that of an aborted upload.
+func isUploadAbort(err error) bool {
+	return errors.Is(err, ErrProcessCancelled) || errors.Is(err, ErrUploadStalled) || errors.Is(err, ErrUploadDeadlineExceeded)
+}
+
+// uploadAbortDescription returns the status description of an aborted upload.
+func uploadAbortDescription(err error) string {
+	if errors.Is(err, ErrProcessCancelled) {
+		return "Upload cancelled"
+	}
+	return "Upload aborted"
+}
+
+// runUploadAbortHook calls the OnUploadAbort hook, if any, recovering from its panics.
+func (fm *FileManager) runUploadAbortHook(event UploadAbortEvent) {
+	root := fm.root()
+	root.mu.RLock()
+	hook := root.uploadAbortHook
+	root.mu.RUnlock()
+	if hook == nil {
+		return
+	}
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			fm.LogTo("INFO", fmt.Sprintf("[FileManager.HandleFileUpload] Upload abort hook%s panicked: %v\n", event.FileProcess.LogLabels(), recovered))
+		}
+	}()
+	hook(fm, event)
+}
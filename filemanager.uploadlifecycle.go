@@ -0,0 +1,196 @@
+package filemanager
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var (
+	ErrNotAnUpload = errors.New("file is not a temporary upload file")
+)
+
+const (
+	UPLOAD_TEMP_FILE_PREFIX         = "upload-"
+	DEFAULT_ORPHANED_UPLOAD_MAX_AGE = 24 * time.Hour
+)
+
+// UploadCleanupOptions configure the lifecycle of the temporary files written by HandleFileUpload.
+type UploadCleanupOptions struct {
+	// AutoDelete removes the temporary upload file once ProcessFile is done with it, whether the recipe
+	// succeeded or failed. Keep it off if you pass the same upload to several ProcessFile calls.
+	AutoDelete bool `yaml:"auto_delete"`
+	// OrphanMaxAge is the age after which upload-* files in the temp path are considered abandoned (left over
+	// from a crash or never processed nor discarded) and removed. Defaults to 24h.
+	OrphanMaxAge time.Duration `yaml:"orphan_max_age"`
+}
+
+// EnableUploadCleanup configures the upload lifecycle and immediately sweeps orphaned upload files, so calling
+// it at startup cleans up after previous runs. RunRetention sweeps again on every run.
+func (fm *FileManager) EnableUploadCleanup(opts UploadCleanupOptions) {
+	if opts.OrphanMaxAge <= 0 {
+		opts.OrphanMaxAge = DEFAULT_ORPHANED_UPLOAD_MAX_AGE
+	}
+	fm.mu.Lock()
+	fm.uploadCleanup = &opts
+	fm.mu.Unlock()
+
+	removed, err := fm.SweepOrphanedUploads(opts.OrphanMaxAge)
+	if err != nil {
+		fm.LogTo("INFO", fmt.Sprintf("[FileManager.EnableUploadCleanup] Sweeping orphaned uploads failed: %v\n", err))
+		return
+	}
+	if removed > 0 {
+		fm.LogTo("DEBUG", fmt.Sprintf("[FileManager.EnableUploadCleanup] Removed %d orphaned upload files\n", removed))
+	}
+}
+
+func (fm *FileManager) getUploadCleanup() *UploadCleanupOptions {
+	if fm.parent != nil {
+		return fm.parent.getUploadCleanup()
+	}
+	fm.mu.RLock()
+	defer fm.mu.RUnlock()
+	return fm.uploadCleanup
+}
+
+// trackUpload marks a temp file as owned by a ManagedFile returned from HandleFileUpload, for the AutoDelete of the
+// upload cleanup. Without cleanup nothing is tracked, as nothing would ever untrack it.
+func (fm *FileManager) trackUpload(localFilePath string) {
+	if fm.getUploadCleanup() == nil {
+		return
+	}
+	fm.uploadsMu.Lock()
+	defer fm.uploadsMu.Unlock()
+	if fm.uploads == nil {
+		fm.uploads = make(map[string]struct{})
+	}
+	fm.uploads[filepath.Clean(localFilePath)] = struct{}{}
+}
+
+func (fm *FileManager) isTrackedUpload(localFilePath string) bool {
+	fm.uploadsMu.Lock()
+	defer fm.uploadsMu.Unlock()
+	_, ok := fm.uploads[filepath.Clean(localFilePath)]
+	return ok
+}
+
+// DiscardUpload deletes the temporary file of an upload returned by HandleFileUpload that is no longer needed,
+// e.g. because the caller decided not to process it. It returns ErrNotAnUpload for any other file.
+func (fm *FileManager) DiscardUpload(file *ManagedFile) error {
+	if !fm.ownsPath(file.LocalFilePath) || !fm.isUploadTempFile(file.LocalFilePath) {
+		return ErrNotAnUpload
+	}
+	fm.uploadsMu.Lock()
+	delete(fm.uploads, filepath.Clean(file.LocalFilePath))
+	fm.uploadsMu.Unlock()
+
+	err := fm.GetStorage().Remove(file.LocalFilePath)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	err = file.ReleaseContent()
+	file.Content = nil
+	return err
+}
+
+// releaseUpload is deferred by ProcessFile and discards the input file if it is a tracked upload and
+// AutoDelete is enabled. Tracked uploads are untracked either way.
+func (fm *FileManager) releaseUpload(file *ManagedFile, fileProcess *FileProcess) {
+	if !fm.isTrackedUpload(file.LocalFilePath) {
+		return
+	}
+	cleanup := fm.getUploadCleanup()
+	if cleanup == nil || !cleanup.AutoDelete {
+		fm.uploadsMu.Lock()
+		delete(fm.uploads, filepath.Clean(file.LocalFilePath))
+		fm.uploadsMu.Unlock()
+		return
+	}
+	err := fm.DiscardUpload(file)
+	if err != nil {
+		fm.LogTo("INFO", fmt.Sprintf("[FileManager.ProcessFile] Removing upload file(%s)%s failed: %v\n", file.LocalFilePath, fileProcess.LogLabels(), err))
+	}
+}
+
+func (fm *FileManager) isUploadTempFile(localFilePath string) bool {
+	if localFilePath == "" || !strings.HasPrefix(filepath.Base(localFilePath), UPLOAD_TEMP_FILE_PREFIX) {
+		return false
+	}
+	dir, err := filepath.Abs(filepath.Dir(localFilePath))
+	if err != nil {
+		return false
+	}
+	for _, tempPath := range fm.uploadTempPaths() {
+		tempPath, err = filepath.Abs(tempPath)
+		if err == nil && dir == tempPath {
+			return true
+		}
+	}
+	return false
+}
+
+// uploadTempPaths returns the directories uploads are kept in: the temp path, the fast temp path and the
+// directories of the named storages in the temp path.
+func (fm *FileManager) uploadTempPaths() []string {
+	paths := []string{fm.localTempPath}
+	if fastTempPath := fm.fastTempPath(); fastTempPath != "" {
+		paths = append(paths, fastTempPath)
+	}
+	root := fm.root()
+	root.mu.RLock()
+	for name := range root.storages {
+		paths = append(paths, filepath.Join(fm.localTempPath, name))
+	}
+	root.mu.RUnlock()
+	return paths
+}
+
+// SweepOrphanedUploads removes upload-* files in the temp path and the fast temp path older than maxAge and returns
+// their number.
+func (fm *FileManager) SweepOrphanedUploads(maxAge time.Duration) (int, error) {
+	cutoff := time.Now().Add(-maxAge)
+	removed := 0
+	for _, tempPath := range fm.uploadTempPaths() {
+		n, err := fm.sweepOrphanedUploadsIn(tempPath, cutoff)
+		removed += n
+		if err != nil {
+			return removed, err
+		}
+	}
+	return removed, nil
+}
+
+func (fm *FileManager) sweepOrphanedUploadsIn(tempPath string, cutoff time.Time) (int, error) {
+	entries, err := os.ReadDir(tempPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	removed := 0
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasPrefix(entry.Name(), UPLOAD_TEMP_FILE_PREFIX) {
+			continue
+		}
+		localFilePath := filepath.Join(tempPath, entry.Name())
+		info, err := entry.Info()
+		if err != nil || info.ModTime().After(cutoff) {
+			continue
+		}
+		fm.uploadsMu.Lock()
+		delete(fm.uploads, localFilePath)
+		fm.uploadsMu.Unlock()
+		err = os.Remove(localFilePath)
+		if err != nil && !os.IsNotExist(err) {
+			return removed, err
+		}
+		removed++
+	}
+	return removed, nil
+}
@@ -0,0 +1,227 @@
+package filemanager
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+var (
+	ErrMultipartUploadNotFound = errors.New("multipart upload not found")
+	ErrMultipartUploadClosed   = errors.New("multipart upload already completed or aborted")
+	ErrInvalidPartNumber       = errors.New("invalid part number")
+	ErrMissingPart             = errors.New("multipart upload is missing a part")
+)
+
+const (
+	MULTIPART_UPLOAD_ID_PREFIX = "MU"
+	MULTIPART_UPLOAD_ID_LENGTH = 16
+	// MULTIPART_MAX_PARTS is the highest part number of a multipart upload.
+	MULTIPART_MAX_PARTS = 10000
+)
+
+// MultipartUpload receives a large upload as numbered parts, which clients send in parallel over several
+// connections. Every part is written to its own temp file as it arrives; Complete assembles them in the order of
+// their numbers and hands the result to HandleFileUpload. Part files are named like the temp files of uploads, so
+// SweepOrphanedUploads removes the parts of abandoned uploads.
+type MultipartUpload struct {
+	ID          string
+	FileProcess *FileProcess
+	fm          *FileManager
+	mu          sync.Mutex
+	parts       map[int]*UploadPart
+	closed      bool
+}
+
+// UploadPart is a received part of a multipart upload.
+type UploadPart struct {
+	Number        int
+	Size          int64
+	localFilePath string
+}
+
+// NewMultipartUpload starts a multipart upload for the process, retrievable with GetMultipartUpload until it is
+// completed or aborted. The process may be the FileProcess of an UploadSession, whose expectations then apply to the
+// assembled upload.
+func (fm *FileManager) NewMultipartUpload(fileProcess *FileProcess) *MultipartUpload {
+	upload := &MultipartUpload{
+		ID:          NID(MULTIPART_UPLOAD_ID_PREFIX, MULTIPART_UPLOAD_ID_LENGTH),
+		FileProcess: fileProcess,
+		fm:          fm,
+		parts:       make(map[int]*UploadPart),
+	}
+	fm.uploadsMu.Lock()
+	defer fm.uploadsMu.Unlock()
+	if fm.multipartUploads == nil {
+		fm.multipartUploads = make(map[string]*MultipartUpload)
+	}
+	fm.multipartUploads[upload.ID] = upload
+	fm.LogTo("DEBUG", fmt.Sprintf("[FileManager.NewMultipartUpload] Started multipart upload(%s) of %s%s\n", upload.ID, fileProcess.IncomingFileName, fileProcess.LogLabels()))
+	return upload
+}
+
+// GetMultipartUpload returns a multipart upload that is neither completed nor aborted by its ID.
+func (fm *FileManager) GetMultipartUpload(uploadID string) (*MultipartUpload, error) {
+	fm.uploadsMu.Lock()
+	defer fm.uploadsMu.Unlock()
+	upload, ok := fm.multipartUploads[uploadID]
+	if !ok {
+		return nil, ErrMultipartUploadNotFound
+	}
+	return upload, nil
+}
+
+// WritePart writes a part to its temp file. Parts are numbered from 1 to MULTIPART_MAX_PARTS and may be written
+// concurrently and in any order; writing a part number again replaces the part.
+func (upload *MultipartUpload) WritePart(partNumber int, r io.Reader) (*UploadPart, error) {
+	if partNumber < 1 || partNumber > MULTIPART_MAX_PARTS {
+		return nil, fmt.Errorf("%w: %d, must be between 1 and %d", ErrInvalidPartNumber, partNumber, MULTIPART_MAX_PARTS)
+	}
+	if upload.isClosed() {
+		return nil, fmt.Errorf("%w: %s", ErrMultipartUploadClosed, upload.ID)
+	}
+	storage := upload.fm.GetStorage()
+	// every write gets its own file, so concurrent writes of the same part number do not interfere
+	partPath := filepath.Join(upload.fm.localTempPath, fmt.Sprintf("%s%s_part%05d_%s", UPLOAD_TEMP_FILE_PREFIX, upload.ID, partNumber, NID("", 8)))
+	partFile, err := storage.Create(partPath)
+	if err != nil {
+		return nil, err
+	}
+	size, err := io.Copy(partFile, r)
+	closeErr := partFile.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		storage.Remove(partPath)
+		return nil, fmt.Errorf("failed to write part(%d) of multipart upload(%s): %w", partNumber, upload.ID, err)
+	}
+	part := &UploadPart{Number: partNumber, Size: size, localFilePath: partPath}
+
+	upload.mu.Lock()
+	if upload.closed {
+		upload.mu.Unlock()
+		storage.Remove(partPath)
+		return nil, fmt.Errorf("%w: %s", ErrMultipartUploadClosed, upload.ID)
+	}
+	replaced := upload.parts[partNumber]
+	upload.parts[partNumber] = part
+	upload.mu.Unlock()
+	if replaced != nil {
+		storage.Remove(replaced.localFilePath)
+	}
+	return part, nil
+}
+
+// Parts returns the received parts ordered by their numbers.
+func (upload *MultipartUpload) Parts() []*UploadPart {
+	upload.mu.Lock()
+	defer upload.mu.Unlock()
+	parts := make([]*UploadPart, 0, len(upload.parts))
+	for _, part := range upload.parts {
+		parts = append(parts, part)
+	}
+	sort.Slice(parts, func(i, j int) bool { return parts[i].Number < parts[j].Number })
+	return parts
+}
+
+// Complete assembles the parts in order and hands the upload to HandleFileUpload, with the same status updates and
+// result. Parts must be numbered without gaps from 1; a missing part fails with ErrMissingPart and keeps the upload
+// open, so the part can still be sent. Part files are removed once they are assembled.
+func (upload *MultipartUpload) Complete(statusCh chan<- *FileProcess) (*ManagedFile, error) {
+	upload.mu.Lock()
+	if upload.closed {
+		upload.mu.Unlock()
+		return nil, fmt.Errorf("%w: %s", ErrMultipartUploadClosed, upload.ID)
+	}
+	parts := make([]*UploadPart, 0, len(upload.parts))
+	for number := 1; number <= len(upload.parts); number++ {
+		part, ok := upload.parts[number]
+		if !ok {
+			upload.mu.Unlock()
+			return nil, fmt.Errorf("%w: part(%d) of multipart upload(%s)", ErrMissingPart, number, upload.ID)
+		}
+		parts = append(parts, part)
+	}
+	if len(parts) == 0 {
+		upload.mu.Unlock()
+		return nil, fmt.Errorf("%w: multipart upload(%s) has no parts", ErrMissingPart, upload.ID)
+	}
+	upload.closed = true
+	upload.mu.Unlock()
+	upload.fm.forgetMultipartUpload(upload.ID)
+	defer upload.removeParts(parts)
+
+	upload.fm.LogTo("DEBUG", fmt.Sprintf("[FileManager.MultipartUpload] Assembling %d parts of multipart upload(%s)%s\n", len(parts), upload.ID, upload.FileProcess.LogLabels()))
+	return upload.fm.HandleFileUpload(&partsReader{storage: upload.fm.GetStorage(), parts: parts}, upload.FileProcess, statusCh)
+}
+
+// Abort discards the multipart upload and its parts.
+func (upload *MultipartUpload) Abort() error {
+	upload.mu.Lock()
+	if upload.closed {
+		upload.mu.Unlock()
+		return fmt.Errorf("%w: %s", ErrMultipartUploadClosed, upload.ID)
+	}
+	upload.closed = true
+	parts := make([]*UploadPart, 0, len(upload.parts))
+	for _, part := range upload.parts {
+		parts = append(parts, part)
+	}
+	upload.mu.Unlock()
+	upload.fm.forgetMultipartUpload(upload.ID)
+	upload.removeParts(parts)
+	upload.fm.LogTo("DEBUG", fmt.Sprintf("[FileManager.MultipartUpload] Aborted multipart upload(%s)%s\n", upload.ID, upload.FileProcess.LogLabels()))
+	return nil
+}
+
+func (upload *MultipartUpload) isClosed() bool {
+	upload.mu.Lock()
+	defer upload.mu.Unlock()
+	return upload.closed
+}
+
+func (upload *MultipartUpload) removeParts(parts []*UploadPart) {
+	storage := upload.fm.GetStorage()
+	for _, part := range parts {
+		err := storage.Remove(part.localFilePath)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			upload.fm.LogTo("INFO", fmt.Sprintf("[FileManager.MultipartUpload] Removing part file(%s) failed: %v\n", part.localFilePath, err))
+		}
+	}
+}
+
+func (fm *FileManager) forgetMultipartUpload(uploadID string) {
+	fm.uploadsMu.Lock()
+	defer fm.uploadsMu.Unlock()
+	delete(fm.multipartUploads, uploadID)
+}
+
+// partsReader reads the parts one after the other, loading one part at a time.
+type partsReader struct {
+	storage Storage
+	parts   []*UploadPart
+	current *bytes.Reader
+}
+
+func (r *partsReader) Read(p []byte) (int, error) {
+	for {
+		if r.current != nil && r.current.Len() > 0 {
+			return r.current.Read(p)
+		}
+		if len(r.parts) == 0 {
+			return 0, io.EOF
+		}
+		content, err := r.storage.ReadFile(r.parts[0].localFilePath)
+		if err != nil {
+			return 0, fmt.Errorf("failed to read part(%d): %w", r.parts[0].Number, err)
+		}
+		r.parts = r.parts[1:]
+		r.current = bytes.NewReader(content)
+	}
+}
@@ -0,0 +1,146 @@
+package filemanager
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+var (
+	ErrUploadTooLarge    = errors.New("upload exceeds the size limit")
+	ErrUploadNotScanned  = errors.New("upload could not be scanned completely")
+	ErrUploadScanMissing = errors.New("upload scan has no scanner")
+)
+
+// StreamScanner is implemented by virus scanners that scan content while it is read, like ClamdScanner with
+// INSTREAM.
+type StreamScanner interface {
+	VirusScanner
+	ScanReader(r io.Reader) (VirusScanResult, error)
+}
+
+// UploadScanOptions configure the scan-before-store mode of HandleFileUpload.
+type UploadScanOptions struct {
+	// Scanner scans every upload. A StreamScanner gets the upload while it is received, other scanners scan it once
+	// it is complete (a CommandScanner writes a temporary copy for that).
+	Scanner VirusScanner
+	// RejectUnscanned rejects uploads the scanner skipped or scanned only partly, e.g. because they exceed its
+	// stream size limit, with ErrUploadNotScanned.
+	RejectUnscanned bool
+	// MaxSize limits the upload held in memory until the scan is done; larger uploads are rejected with
+	// ErrUploadTooLarge. 0 means no limit.
+	MaxSize int64
+}
+
+// EnableUploadScan makes HandleFileUpload scan uploads before they are stored: the upload is kept in memory while
+// it is streamed to the scanner, and only written to the temp path once it is clean. Infected uploads are rejected
+// with a VirusFoundError without ever touching the disk; the scan result of stored uploads is in
+// MetaData["virus_scan"]. Tenant views share the setting of their FileManager.
+func (fm *FileManager) EnableUploadScan(opts UploadScanOptions) error {
+	if opts.Scanner == nil {
+		return ErrUploadScanMissing
+	}
+	root := fm.root()
+	root.mu.Lock()
+	defer root.mu.Unlock()
+	root.uploadScan = &opts
+	return nil
+}
+
+func (fm *FileManager) getUploadScan() *UploadScanOptions {
+	root := fm.root()
+	root.mu.RLock()
+	defer root.mu.RUnlock()
+	return root.uploadScan
+}
+
+// scanIncomingUpload scans the upload with scanUpload, adding the terminal status of rejected uploads.
+func (fm *FileManager) scanIncomingUpload(r io.Reader, scan *UploadScanOptions, fileProcess *FileProcess, statusCh chan<- *FileProcess) ([]byte, *VirusScanResult, error) {
+	content, result, err := scanUpload(r, scan, fileProcess.IncomingFileName)
+	if err != nil {
+		description := "Failed to scan uploaded file"
+		if errors.Is(err, ErrVirusFound) || errors.Is(err, ErrUploadNotScanned) || errors.Is(err, ErrUploadTooLarge) {
+			description = "Upload rejected"
+		}
+		status := ProcessingStatus{
+			ProcessID:         fileProcess.ID,
+			TimeStamp:         int(time.Now().UnixNano() / int64(time.Millisecond)),
+			ProcessorName:     "FileUpload",
+			StatusDescription: description,
+			Error:             err,
+			Done:              true,
+		}
+		fileProcess.AddProcessingUpdate(status)
+		fm.LogTo("INFO", fmt.Sprintf("[FileManager.HandleFileUpload] %s: %s%s: %v\n", description, fileProcess.IncomingFileName, fileProcess.LogLabels(), err))
+		fm.publishFinalStatus(statusCh, fileProcess)
+		return nil, nil, err
+	}
+	return content, &result, nil
+}
+
+// scanUpload reads the upload into memory, streaming it to the scanner at the same time if it is a StreamScanner,
+// and returns the content of a clean upload.
+func scanUpload(r io.Reader, opts *UploadScanOptions, fileName string) ([]byte, VirusScanResult, error) {
+	content := getBuffer()
+	defer putBuffer(content)
+	reader := r
+	limited := &io.LimitedReader{R: r, N: opts.MaxSize + 1}
+	if opts.MaxSize > 0 {
+		reader = limited
+	}
+
+	var result VirusScanResult
+	var scanErr error
+	streamScanner, ok := opts.Scanner.(StreamScanner)
+	if ok {
+		var err error
+		result, scanErr, err = teeScan(reader, streamScanner, content)
+		if err != nil {
+			return nil, VirusScanResult{}, err
+		}
+	} else {
+		_, err := io.Copy(content, reader)
+		if err != nil {
+			return nil, VirusScanResult{}, err
+		}
+	}
+	if opts.MaxSize > 0 && limited.N == 0 {
+		return nil, VirusScanResult{}, &ValidationError{Field: "size", Err: fmt.Errorf("%w: more than %d bytes", ErrUploadTooLarge, opts.MaxSize)}
+	}
+	if !ok {
+		result, scanErr = opts.Scanner.Scan(&ManagedFile{FileName: fileName, Content: content.Bytes()})
+	}
+	if scanErr != nil {
+		return nil, VirusScanResult{}, &ScanError{Scanner: opts.Scanner.Name(), FileName: fileName, Err: scanErr}
+	}
+
+	if result.Scanner == "" {
+		result.Scanner = opts.Scanner.Name()
+	}
+	switch {
+	case result.Infected:
+		return nil, result, &VirusFoundError{FileName: fileName, Scanner: result.Scanner, Signature: result.Signature}
+	case (result.Skipped || result.Truncated) && opts.RejectUnscanned:
+		return nil, result, &ScanError{Scanner: result.Scanner, FileName: fileName, Err: fmt.Errorf("%w: %s", ErrUploadNotScanned, result.Reason)}
+	}
+	return bytes.Clone(content.Bytes()), result, nil
+}
+
+// teeScan reads r into content while streaming it to the scanner. err is the error of reading r, scanErr the one
+// of the scan.
+func teeScan(r io.Reader, scanner StreamScanner, content *bytes.Buffer) (result VirusScanResult, scanErr error, err error) {
+	pipeReader, pipeWriter := io.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		result, scanErr = scanner.ScanReader(pipeReader)
+		// the scanner may stop reading early, e.g. at its size limit, the content has to be read anyway
+		io.Copy(io.Discard, pipeReader)
+	}()
+	_, err = io.Copy(content, io.TeeReader(r, pipeWriter))
+	pipeWriter.CloseWithError(err)
+	<-done
+	return result, scanErr, err
+}
@@ -0,0 +1,95 @@
+package filemanager_test
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"testing"
+
+	filemanager "github.com/itsatony/go-filemanager"
+	"github.com/itsatony/go-filemanager/filemanagertest"
+)
+
+// fakeScanner reports content containing "INFECTED" as infected.
+type fakeScanner struct{}
+
+func (fakeScanner) Name() string {
+	return "fake"
+}
+
+func (fakeScanner) Scan(file *filemanager.ManagedFile) (filemanager.VirusScanResult, error) {
+	if bytes.Contains(file.Content, []byte("INFECTED")) {
+		return filemanager.VirusScanResult{Infected: true, Signature: "Test-Signature"}, nil
+	}
+	return filemanager.VirusScanResult{}, nil
+}
+
+// uploadWithError passes the content through HandleFileUpload and returns its final status and error.
+func uploadWithError(tfm *filemanagertest.TestFileManager, fileProcess *filemanager.FileProcess, content []byte) (*filemanager.ProcessingStatus, error) {
+	statusCh := make(chan *filemanager.FileProcess)
+	go func() {
+		for range statusCh {
+		}
+	}()
+	_, err := tfm.HandleFileUpload(bytes.NewReader(content), fileProcess, statusCh)
+	close(statusCh)
+	return fileProcess.GetLatestProcessingStatus(), err
+}
+
+// assertNothingStored fails the test if an upload left a file in the storage or on disk.
+func assertNothingStored(t *testing.T, tfm *filemanagertest.TestFileManager) {
+	t.Helper()
+	if paths := tfm.Storage.Paths(); len(paths) != 0 {
+		t.Fatalf("storage holds %v, want the rejected upload not stored", paths)
+	}
+	entries, err := os.ReadDir(tfm.TempPath)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Fatalf("temp path holds %d files, want the rejected upload not written", len(entries))
+	}
+}
+
+func TestUploadScanRejectsInfectedUploads(t *testing.T) {
+	tfm := filemanagertest.NewTestFileManager(t)
+	err := tfm.EnableUploadScan(filemanager.UploadScanOptions{Scanner: fakeScanner{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	status, err := uploadWithError(tfm, filemanager.NewFileProcess("virus.txt", ""), []byte("INFECTED content"))
+	var virusErr *filemanager.VirusFoundError
+	if !errors.Is(err, filemanager.ErrVirusFound) || !errors.As(err, &virusErr) || virusErr.Signature != "Test-Signature" {
+		t.Fatalf("HandleFileUpload() = %v, want a VirusFoundError", err)
+	}
+	if status == nil || !status.Done || status.Error == nil {
+		t.Fatalf("final status = %+v, want a Done status with the error", status)
+	}
+	assertNothingStored(t, tfm)
+
+	file := tfm.Upload("clean.txt", []byte("clean content"))
+	result, ok := file.MetaData[filemanager.METADATA_KEY_VIRUS_SCAN].(filemanager.VirusScanResult)
+	if !ok || result.Infected || result.Scanner != "fake" {
+		t.Fatalf("MetaData[virus_scan] = %+v, want the clean result of the fake scanner", file.MetaData[filemanager.METADATA_KEY_VIRUS_SCAN])
+	}
+}
+
+func TestUploadScanRejectsUploadsAboveMaxSize(t *testing.T) {
+	tfm := filemanagertest.NewTestFileManager(t)
+	err := tfm.EnableUploadScan(filemanager.UploadScanOptions{Scanner: fakeScanner{}, MaxSize: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = uploadWithError(tfm, filemanager.NewFileProcess("large.txt", ""), []byte("hello"))
+	if !errors.Is(err, filemanager.ErrUploadTooLarge) {
+		t.Fatalf("HandleFileUpload() = %v, want ErrUploadTooLarge", err)
+	}
+	assertNothingStored(t, tfm)
+
+	file := tfm.Upload("small.txt", []byte("hell"))
+	if file.FileSize != 4 {
+		t.Fatalf("FileSize = %d, want an upload of MaxSize accepted", file.FileSize)
+	}
+}
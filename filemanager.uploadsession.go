@@ -0,0 +1,280 @@
+package filemanager
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"mime"
+	"strings"
+	"time"
+
+	"github.com/gabriel-vasile/mimetype"
+)
+
+var (
+	ErrUploadSessionNotFound = errors.New("upload session not found")
+	ErrUploadSessionUsed     = errors.New("upload session already used")
+	ErrUploadSessionExpired  = errors.New("upload session expired")
+	ErrUploadSizeMismatch    = errors.New("upload size does not match the expected size")
+	ErrMimeTypeMismatch      = errors.New("detected MIME type does not match the declared one")
+	ErrInvalidChecksum       = errors.New("invalid checksum")
+	ErrChecksumMismatch      = errors.New("upload checksum does not match the expected checksum")
+)
+
+const (
+	UPLOAD_SESSION_ID_PREFIX   = "US"
+	UPLOAD_SESSION_ID_LENGTH   = 16
+	DEFAULT_UPLOAD_SESSION_TTL = time.Hour
+
+	METADATA_KEY_UPLOAD_SESSION_ID = "upload_session_id"
+	METADATA_KEY_DECLARED_MIMETYPE = "declared_mimetype"
+)
+
+// UploadSessionOptions describe an upload before its bytes arrive.
+type UploadSessionOptions struct {
+	FileName   string // the incoming file name of the process
+	Owner      string
+	RecipeName string // the recipe of ProcessUploadSession
+	// ExpectedSize fails the upload with ErrUploadSizeMismatch as soon as it gets larger, or at its end if it is
+	// smaller. It also gives the upload progress a total. 0 accepts any size.
+	ExpectedSize int64
+	// SpillThreshold overrides FastTempOptions.SpillThreshold for the upload, -1 writes it to the temp path on disk
+	// right away. Uploads with an ExpectedSize above the threshold skip the fast temp path as well.
+	SpillThreshold int64
+	// Timeouts override the upload timeouts of the FileManager (see SetUploadTimeouts) for the upload.
+	Timeouts *UploadTimeoutOptions
+	// ExpectedSHA256 is the hex encoded SHA-256 of the upload computed by the client. The upload is hashed while it
+	// is received and fails with ErrChecksumMismatch at its end if the hashes differ, catching uploads corrupted on
+	// the way. The verified checksum becomes the Checksum of the file.
+	ExpectedSHA256 string
+	// DeclaredMimeType is stored in the MetaData ("declared_mimetype"). With StrictMimeType the upload fails with
+	// ErrMimeTypeMismatch if the detected type is neither the declared one nor a subtype of it.
+	DeclaredMimeType string
+	StrictMimeType   bool
+	// MetaData is copied into the MetaData of the uploaded file and so into the outputs of the recipe.
+	MetaData       map[string]any
+	Labels         map[string]string
+	CorrelationID  string
+	ProcessOptions ProcessOptions // runtime params and priority of the recipe
+	// TTL is how long the session waits for its upload, DEFAULT_UPLOAD_SESSION_TTL by default.
+	TTL time.Duration
+}
+
+// UploadSession binds the context of an upload (owner, recipe, expected size, declared MIME type, metadata) to its
+// FileProcess before the bytes arrive, e.g. in the request that hands out an upload URL. HandleFileUpload and
+// ProcessUpload apply it to the uploaded file when they get the session's FileProcess. A session takes one upload.
+type UploadSession struct {
+	ID          string
+	Options     UploadSessionOptions
+	FileProcess *FileProcess
+	CreatedAt   time.Time
+	ExpiresAt   time.Time
+	used        bool // guarded by the uploadsMu of the FileManager
+}
+
+// NewUploadSession creates an upload session, retrievable with GetUploadSession until it is used or expires.
+func (fm *FileManager) NewUploadSession(opts UploadSessionOptions) (*UploadSession, error) {
+	if opts.RecipeName != "" {
+		if _, ok := fm.root().recipes.Load().get(opts.RecipeName); !ok {
+			return nil, fmt.Errorf("%w: %s", ErrRecipeNotFound, opts.RecipeName)
+		}
+		err := fm.checkRecipeAllowed(opts.RecipeName)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if opts.ExpectedSize < 0 {
+		return nil, fmt.Errorf("%w: negative expected size", ErrInvalidFileSize)
+	}
+	if opts.ExpectedSHA256 != "" {
+		opts.ExpectedSHA256 = strings.ToLower(opts.ExpectedSHA256)
+		sum, err := hex.DecodeString(opts.ExpectedSHA256)
+		if err != nil || len(sum) != sha256.Size {
+			return nil, &ValidationError{Field: "expected_sha256", Err: fmt.Errorf("%w: %q is not a hex encoded SHA-256", ErrInvalidChecksum, opts.ExpectedSHA256)}
+		}
+	}
+	if opts.TTL <= 0 {
+		opts.TTL = DEFAULT_UPLOAD_SESSION_TTL
+	}
+	fileProcess, err := NewFileProcessWithOptions(opts.FileName, opts.RecipeName, FileProcessOptions{CorrelationID: opts.CorrelationID, Labels: opts.Labels})
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	session := &UploadSession{
+		ID:          NID(UPLOAD_SESSION_ID_PREFIX, UPLOAD_SESSION_ID_LENGTH),
+		Options:     opts,
+		FileProcess: fileProcess,
+		CreatedAt:   now,
+		ExpiresAt:   now.Add(opts.TTL),
+	}
+	fileProcess.session = session
+
+	fm.uploadsMu.Lock()
+	defer fm.uploadsMu.Unlock()
+	if fm.uploadSessions == nil {
+		fm.uploadSessions = make(map[string]*UploadSession)
+	}
+	for id, other := range fm.uploadSessions {
+		if now.After(other.ExpiresAt) {
+			delete(fm.uploadSessions, id)
+		}
+	}
+	fm.uploadSessions[session.ID] = session
+	return session, nil
+}
+
+// GetUploadSession returns an unused upload session by its ID.
+func (fm *FileManager) GetUploadSession(sessionID string) (*UploadSession, error) {
+	fm.uploadsMu.Lock()
+	defer fm.uploadsMu.Unlock()
+	session, ok := fm.uploadSessions[sessionID]
+	if !ok {
+		return nil, ErrUploadSessionNotFound
+	}
+	if time.Now().After(session.ExpiresAt) {
+		delete(fm.uploadSessions, sessionID)
+		return nil, ErrUploadSessionExpired
+	}
+	return session, nil
+}
+
+// ProcessUploadSession receives the upload of a session and runs its recipe with its ProcessOptions, like
+// ProcessUpload. statusCh is closed when done; an unusable session ends the process with its error.
+func (fm *FileManager) ProcessUploadSession(session *UploadSession, r io.Reader, statusCh chan<- *FileProcess) {
+	fm.ProcessUpload(r, session.Options.RecipeName, session.FileProcess, statusCh, session.Options.ProcessOptions)
+}
+
+// claimUploadSession marks the session of the process as used. Processes without a session pass.
+func (fm *FileManager) claimUploadSession(fileProcess *FileProcess) error {
+	session := fileProcess.session
+	if session == nil {
+		return nil
+	}
+	fm.uploadsMu.Lock()
+	defer fm.uploadsMu.Unlock()
+	if session.used {
+		return fmt.Errorf("%w: %s", ErrUploadSessionUsed, session.ID)
+	}
+	if time.Now().After(session.ExpiresAt) {
+		delete(fm.uploadSessions, session.ID)
+		return fmt.Errorf("%w: %s", ErrUploadSessionExpired, session.ID)
+	}
+	session.used = true
+	delete(fm.uploadSessions, session.ID)
+	return nil
+}
+
+// failUploadSession ends the process of an unusable session.
+func (fm *FileManager) failUploadSession(fileProcess *FileProcess, statusCh chan<- *FileProcess, err error) {
+	fileProcess.AddProcessingUpdate(ProcessingStatus{
+		ProcessID:         fileProcess.ID,
+		TimeStamp:         int(time.Now().UnixNano() / int64(time.Millisecond)),
+		ProcessorName:     "FileUpload",
+		StatusDescription: fmt.Sprintf("Upload session rejected: %v", err),
+		Error:             err,
+		Done:              true,
+	})
+	fm.LogTo("INFO", fmt.Sprintf("[FileManager.HandleFileUpload] Upload(%s)%s rejected: %v\n", fileProcess.IncomingFileName, fileProcess.LogLabels(), err))
+	fm.publishFinalStatus(statusCh, fileProcess)
+}
+
+// sessionUploadReader enforces the expectations of the session of the process while the upload is read.
+func sessionUploadReader(r io.Reader, fileProcess *FileProcess) io.Reader {
+	session := fileProcess.session
+	if session == nil || (session.Options.ExpectedSize == 0 && session.Options.ExpectedSHA256 == "") {
+		return r
+	}
+	reader := &sessionReader{reader: r, expectedSize: session.Options.ExpectedSize, expectedSHA256: session.Options.ExpectedSHA256}
+	if reader.expectedSHA256 != "" {
+		reader.hash = sha256.New()
+	}
+	return reader
+}
+
+// sessionReader fails as soon as more than the expected bytes are read, and at the end if there were fewer or the
+// hash of the upload differs from the expected one.
+type sessionReader struct {
+	reader         io.Reader
+	expectedSize   int64
+	expectedSHA256 string
+	size           int64
+	hash           hash.Hash
+}
+
+func (r *sessionReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.size += int64(n)
+	if r.hash != nil {
+		r.hash.Write(p[:n])
+	}
+	if r.expectedSize > 0 && r.size > r.expectedSize {
+		return n, &ValidationError{Field: "size", Err: fmt.Errorf("%w: more than %d bytes", ErrUploadSizeMismatch, r.expectedSize)}
+	}
+	if err != io.EOF {
+		return n, err
+	}
+	if r.expectedSize > 0 && r.size < r.expectedSize {
+		return n, &ValidationError{Field: "size", Err: fmt.Errorf("%w: %d of %d bytes", ErrUploadSizeMismatch, r.size, r.expectedSize)}
+	}
+	if r.hash != nil {
+		checksum := hex.EncodeToString(r.hash.Sum(nil))
+		if checksum != r.expectedSHA256 {
+			return n, &ValidationError{Field: "sha256", Err: fmt.Errorf("%w: got %s, expected %s", ErrChecksumMismatch, checksum, r.expectedSHA256)}
+		}
+	}
+	return n, err
+}
+
+// applyUploadSession gives the uploaded file the owner and metadata of the session of the process and checks the
+// declared MIME type.
+func (fm *FileManager) applyUploadSession(file *ManagedFile, fileProcess *FileProcess) error {
+	session := fileProcess.session
+	if session == nil {
+		return nil
+	}
+	opts := session.Options
+	if opts.DeclaredMimeType != "" {
+		if opts.StrictMimeType && !mimeTypeMatches(file.MimeType, fm.CanonicalMimeType(opts.DeclaredMimeType)) {
+			return &ValidationError{Field: "mime_type", Err: fmt.Errorf("%w: detected %s, declared %s", ErrMimeTypeMismatch, file.MimeType, opts.DeclaredMimeType)}
+		}
+		file.SetMetaData(METADATA_KEY_DECLARED_MIMETYPE, opts.DeclaredMimeType)
+	}
+	if opts.Owner != "" {
+		file.Owner = opts.Owner
+	}
+	if opts.ExpectedSHA256 != "" {
+		// the upload is read through sessionReader, which fails unless the content has this checksum
+		file.Checksum = opts.ExpectedSHA256
+	}
+	for key, value := range opts.MetaData {
+		file.SetMetaData(key, value)
+	}
+	file.SetMetaData(METADATA_KEY_UPLOAD_SESSION_ID, session.ID)
+	return nil
+}
+
+// mimeTypeMatches reports whether the detected MIME type is the declared one or one of its subtypes (a CSV file
+// declared as text/plain).
+func mimeTypeMatches(detected, declared string) bool {
+	declaredType, _, err := mime.ParseMediaType(declared)
+	if err != nil {
+		return false
+	}
+	detectedType, _, err := mime.ParseMediaType(detected)
+	if err != nil {
+		return false
+	}
+	if strings.EqualFold(detectedType, declaredType) {
+		return true
+	}
+	for node := mimetype.Lookup(detectedType); node != nil; node = node.Parent() {
+		if node.Is(declaredType) {
+			return true
+		}
+	}
+	return false
+}
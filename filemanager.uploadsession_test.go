@@ -0,0 +1,25 @@
+package filemanager_test
+
+import (
+	"errors"
+	"testing"
+
+	filemanager "github.com/itsatony/go-filemanager"
+	"github.com/itsatony/go-filemanager/filemanagertest"
+)
+
+func TestUploadSessionRejectsUploadsAboveExpectedSize(t *testing.T) {
+	tfm := filemanagertest.NewTestFileManager(t)
+	session, err := tfm.NewUploadSession(filemanager.UploadSessionOptions{FileName: "hello.txt", ExpectedSize: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	status, err := uploadWithError(tfm, session.FileProcess, []byte("hello"))
+	if !errors.Is(err, filemanager.ErrUploadSizeMismatch) {
+		t.Fatalf("HandleFileUpload() = %v, want ErrUploadSizeMismatch", err)
+	}
+	if status == nil || !status.Done {
+		t.Fatalf("final status = %+v, want a Done status", status)
+	}
+}
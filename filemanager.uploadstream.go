@@ -0,0 +1,186 @@
+package filemanager
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"path/filepath"
+)
+
+// UPLOAD_SNIFF_SIZE is how much of a streamed upload is buffered to detect its MIME type at least, more if the
+// read limit of SetMimeDetection is larger.
+const UPLOAD_SNIFF_SIZE = 3072
+
+// StreamingPlugin is implemented by processing plugins that can consume their input as a stream. As the first
+// step of a recipe run by ProcessUpload, it reads the upload directly instead of it being written to a temporary
+// file and read back.
+type StreamingPlugin interface {
+	ProcessingPlugin
+	// ProcessStream processes the content read from r. file has the name and detected MIME type of the upload and
+	// the step params in its MetaData, but no Content or LocalFilePath. The returned files carry their Content,
+	// like those of Process.
+	ProcessStream(r io.Reader, file *ManagedFile, fileProcess *FileProcess) ([]*ManagedFile, error)
+}
+
+// ProcessUpload receives an upload and runs the recipe on it, like HandleFileUpload followed by
+// ProcessFileWithOptions. It sends status updates to statusCh, which it closes when done. If the first step of the
+// recipe is a StreamingPlugin, the upload is streamed into it, saving the disk round-trip of the temporary file;
+// the recipe's file size limits are enforced while it is read. The upload itself is not stored then, only the
+// outputs of the recipe. Other recipes fall back to HandleFileUpload.
+func (fm *FileManager) ProcessUpload(r io.Reader, recipeName string, fileProcess *FileProcess, statusCh chan<- *FileProcess, opts ProcessOptions) {
+	recipe, ok := fm.root().recipes.Load().get(recipeName)
+	if !ok || !fm.streamsFirstStep(recipe) {
+		file, err := fm.HandleFileUpload(r, fileProcess, statusCh)
+		if err != nil {
+			close(statusCh)
+			return
+		}
+		fm.ProcessFileWithOptions(file, recipeName, fileProcess, statusCh, opts)
+		return
+	}
+
+	fileProcess.IncomingFileName = safeIncomingFileName(fileProcess.IncomingFileName)
+	fm.RegisterProcess(fileProcess)
+	err := fm.claimUploadSession(fileProcess)
+	if err != nil {
+		fm.failUploadSession(fileProcess, statusCh, err)
+		close(statusCh)
+		return
+	}
+	progressReader := &ProgressReader{Reader: r, StatusCh: statusCh, FileProcess: fileProcess}
+	if fileProcess.session != nil {
+		progressReader.Size = fileProcess.session.Options.ExpectedSize
+	}
+	upload := fm.uploadTimeoutReader(context.Background(), sessionUploadReader(progressReader, fileProcess), r, fileProcess, statusCh)
+	var scanResult *VirusScanResult
+	if scan := fm.getUploadScan(); scan != nil {
+		content, result, err := fm.scanIncomingUpload(upload, scan, fileProcess, statusCh)
+		if err != nil {
+			close(statusCh)
+			return
+		}
+		upload = bytes.NewReader(content)
+		scanResult = result
+	}
+	sniffSize := max(UPLOAD_SNIFF_SIZE, fm.mimeReadSize())
+	buffered := bufio.NewReaderSize(upload, sniffSize)
+	header, _ := buffered.Peek(sniffSize)
+	file := &ManagedFile{FileName: filepath.Base(fileProcess.IncomingFileName)}
+	file.MimeType = fm.DetectMimeType(file.FileName, header)
+	if scanResult != nil {
+		file.SetMetaData(METADATA_KEY_VIRUS_SCAN, *scanResult)
+	}
+	err = fm.applyUploadSession(file, fileProcess)
+	if err != nil {
+		fm.failUploadSession(fileProcess, statusCh, err)
+		close(statusCh)
+		return
+	}
+	fm.LogTo("DEBUG", fmt.Sprintf("[FileManager.ProcessUpload] Streaming upload(%s)%s into recipe(%s)\n", file.FileName, fileProcess.LogLabels(), recipeName))
+	opts.upload = &uploadStream{reader: buffered, minSize: recipe.MinFileSize, maxSize: recipe.MaxFileSize}
+	fm.ProcessFileWithOptions(file, recipeName, fileProcess, statusCh, opts)
+}
+
+// streamsFirstStep reports whether the first step of the recipe is a StreamingPlugin.
+func (fm *FileManager) streamsFirstStep(recipe Recipe) bool {
+	for _, step := range recipe.ProcessingSteps {
+		if step.PluginName == "" {
+			continue
+		}
+		plugin, ok := fm.getProcessingPlugin(step.PluginName)
+		if !ok {
+			return false
+		}
+		_, ok = plugin.(StreamingPlugin)
+		return ok
+	}
+	return false
+}
+
+// uploadStream is an upload handed by ProcessUpload to the first step of ProcessFileWithOptions, counting the bytes
+// read to enforce the file size limits of the recipe.
+type uploadStream struct {
+	reader  io.Reader
+	size    int64
+	minSize int64
+	maxSize int64
+}
+
+func (u *uploadStream) Read(p []byte) (int, error) {
+	n, err := u.reader.Read(p)
+	u.size += int64(n)
+	if u.size > u.maxSize {
+		return n, fmt.Errorf("%w: more than %d bytes", ErrInvalidFileSize, u.maxSize)
+	}
+	return n, err
+}
+
+// checkSize reads what the step left of the upload and checks its size.
+func (u *uploadStream) checkSize() error {
+	_, err := io.Copy(io.Discard, u)
+	if err != nil {
+		return err
+	}
+	if u.size < u.minSize {
+		return fmt.Errorf("%w: %d bytes", ErrInvalidFileSize, u.size)
+	}
+	return nil
+}
+
+// readInto reads the whole upload into the content of the file, for steps that cannot stream it.
+func (u *uploadStream) readInto(file *ManagedFile) error {
+	content, err := readAllPooled(u)
+	if err != nil {
+		return err
+	}
+	err = u.checkSize()
+	if err != nil {
+		return err
+	}
+	file.Content = content
+	file.FileSize = int64(len(content))
+	return nil
+}
+
+// uploadStep runs the first step on the upload: streaming plugins read it directly, other plugins (if the recipe
+// changed since ProcessUpload chose to stream) get it read into memory.
+type uploadStep struct {
+	plugin ProcessingPlugin
+	upload *uploadStream
+}
+
+func (s *uploadStep) Process(files []*ManagedFile, fileProcess *FileProcess) ([]*ManagedFile, error) {
+	file := files[0]
+	streaming, ok := s.plugin.(StreamingPlugin)
+	if !ok {
+		err := s.upload.readInto(file)
+		if err != nil {
+			return nil, err
+		}
+		return s.plugin.Process(files, fileProcess)
+	}
+	processedFiles, err := streaming.ProcessStream(s.upload, file, fileProcess)
+	if err != nil {
+		if s.upload.size > s.upload.maxSize {
+			// plugins do not necessarily wrap the read error
+			return nil, fmt.Errorf("%w: more than %d bytes", ErrInvalidFileSize, s.upload.maxSize)
+		}
+		return nil, err
+	}
+	err = s.upload.checkSize()
+	if err != nil {
+		return nil, err
+	}
+	file.FileSize = s.upload.size
+	return processedFiles, nil
+}
+
+// EstimateMemory passes the memory estimate of PluginLimits on to the plugin, the size of the upload is unknown.
+func (s *uploadStep) EstimateMemory(files []*ManagedFile) int64 {
+	if estimator, ok := s.plugin.(MemoryEstimator); ok {
+		return estimator.EstimateMemory(files)
+	}
+	return 0
+}
@@ -0,0 +1,231 @@
+package filemanager
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// UPLOAD_TIMEOUT_READ_SIZE caps the reads of uploads with timeouts, which go through a buffer of their own.
+const UPLOAD_TIMEOUT_READ_SIZE = 64 * 1024
+
+var (
+	ErrUploadStalled          = errors.New("upload stalled")
+	ErrUploadDeadlineExceeded = errors.New("upload deadline exceeded")
+	ErrInvalidUploadTimeouts  = errors.New("invalid upload timeouts")
+)
+
+// UploadTimeoutOptions keep clients that stop sending bytes from holding a temp file and a goroutine open
+// indefinitely. Zero durations disable their check.
+type UploadTimeoutOptions struct {
+	// IdleTimeout aborts an upload with ErrUploadStalled once no bytes arrived for this long.
+	IdleTimeout time.Duration `yaml:"idle_timeout"`
+	// StallAfter is how long an upload may receive nothing before a "stalled" status is sent, half of the
+	// IdleTimeout by default. The upload goes on if bytes arrive again.
+	StallAfter time.Duration `yaml:"stall_after"`
+	// Deadline aborts an upload with ErrUploadDeadlineExceeded once it takes longer than this in total.
+	Deadline time.Duration `yaml:"deadline"`
+}
+
+func (opts UploadTimeoutOptions) validate() error {
+	if opts.IdleTimeout < 0 || opts.StallAfter < 0 || opts.Deadline < 0 {
+		return fmt.Errorf("%w: negative duration", ErrInvalidUploadTimeouts)
+	}
+	if opts.IdleTimeout > 0 && opts.StallAfter > opts.IdleTimeout {
+		return fmt.Errorf("%w: stall after %s exceeds the idle timeout %s", ErrInvalidUploadTimeouts, opts.StallAfter, opts.IdleTimeout)
+	}
+	return nil
+}
+
+func (opts UploadTimeoutOptions) withDefaults() UploadTimeoutOptions {
+	if opts.StallAfter == 0 {
+		opts.StallAfter = opts.IdleTimeout / 2
+	}
+	return opts
+}
+
+// SetUploadTimeouts applies the timeouts to every upload of HandleFileUpload and ProcessUpload;
+// UploadSessionOptions.Timeouts override them per upload. An aborted upload closes its reader if it is an
+// io.Closer, or expires it if it has a SetReadDeadline method (like a net.Conn), to end the blocked read. Readers
+// that can be neither leave that read behind until it returns, the upload and its temp file are gone by then.
+func (fm *FileManager) SetUploadTimeouts(opts UploadTimeoutOptions) error {
+	err := opts.validate()
+	if err != nil {
+		return err
+	}
+	opts = opts.withDefaults()
+	fm.mu.Lock()
+	fm.uploadTimeouts = &opts
+	fm.mu.Unlock()
+	return nil
+}
+
+func (fm *FileManager) getUploadTimeouts(fileProcess *FileProcess) *UploadTimeoutOptions {
+	if session := fileProcess.session; session != nil && session.Options.Timeouts != nil {
+		opts := session.Options.Timeouts.withDefaults()
+		return &opts
+	}
+	if fm.parent != nil {
+		return fm.parent.getUploadTimeouts(fileProcess)
+	}
+	fm.mu.RLock()
+	defer fm.mu.RUnlock()
+	return fm.uploadTimeouts
+}
+
+// uploadTimeoutReader applies the upload timeouts of the process and the end of the context to the reader of an
+// upload. source is the reader the upload came in with, closed or expired on abort.
+func (fm *FileManager) uploadTimeoutReader(ctx context.Context, r io.Reader, source io.Reader, fileProcess *FileProcess, statusCh chan<- *FileProcess) io.Reader {
+	opts := fm.getUploadTimeouts(fileProcess)
+	if opts == nil {
+		opts = &UploadTimeoutOptions{}
+	}
+	if ctx.Done() == nil && opts.IdleTimeout <= 0 && opts.StallAfter <= 0 && opts.Deadline <= 0 {
+		return r
+	}
+	reader := &timeoutReader{
+		fm:          fm,
+		ctx:         ctx,
+		reader:      r,
+		source:      source,
+		opts:        *opts,
+		fileProcess: fileProcess,
+		statusCh:    statusCh,
+		results:     make(chan timeoutReadResult, 1),
+	}
+	if opts.Deadline > 0 {
+		reader.deadline = time.Now().Add(opts.Deadline)
+	}
+	return reader
+}
+
+type timeoutReadResult struct {
+	n   int
+	err error
+}
+
+// timeoutReader reads in a goroutine of its own, so it can give up on a read that does not return in time or once
+// its context ends.
+type timeoutReader struct {
+	fm          *FileManager
+	ctx         context.Context
+	reader      io.Reader
+	source      io.Reader
+	opts        UploadTimeoutOptions
+	deadline    time.Time
+	fileProcess *FileProcess
+	statusCh    chan<- *FileProcess
+	buf         []byte // only used by the read in flight
+	results     chan timeoutReadResult
+	stalled     bool
+	err         error // set once the upload is aborted
+}
+
+func (r *timeoutReader) Read(p []byte) (int, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+	if r.ctx.Err() != nil {
+		r.abort(r.cancelled())
+		return 0, r.err
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	size := min(len(p), UPLOAD_TIMEOUT_READ_SIZE)
+	if cap(r.buf) < size {
+		r.buf = make([]byte, size)
+	}
+	buf := r.buf[:size]
+	go func() {
+		n, err := r.reader.Read(buf)
+		r.results <- timeoutReadResult{n: n, err: err}
+	}()
+
+	started := time.Now()
+	for {
+		wait, abort := r.nextCheck(started)
+		timer := time.NewTimer(wait)
+		select {
+		case result := <-r.results:
+			timer.Stop()
+			if result.n > 0 {
+				r.stalled = false
+			}
+			return copy(p, buf[:result.n]), result.err
+		case <-r.ctx.Done():
+			timer.Stop()
+			r.abort(r.cancelled())
+			return 0, r.err
+		case <-timer.C:
+		}
+		if abort != nil {
+			r.abort(abort)
+			return 0, r.err
+		}
+		if !r.stalled {
+			r.stalled = true
+			r.reportStall(r.opts.StallAfter)
+		}
+	}
+}
+
+// nextCheck returns how long to wait for the read, and the error to abort with after it; nil means a stall check.
+func (r *timeoutReader) nextCheck(started time.Time) (time.Duration, error) {
+	wait, abort := time.Duration(-1), error(nil)
+	if !r.stalled && r.opts.StallAfter > 0 {
+		wait = time.Until(started.Add(r.opts.StallAfter))
+	}
+	if r.opts.IdleTimeout > 0 {
+		idle := time.Until(started.Add(r.opts.IdleTimeout))
+		if wait < 0 || idle <= wait {
+			wait, abort = idle, fmt.Errorf("%w: no bytes received for %s", ErrUploadStalled, r.opts.IdleTimeout)
+		}
+	}
+	if !r.deadline.IsZero() {
+		remaining := time.Until(r.deadline)
+		if wait < 0 || remaining <= wait {
+			wait, abort = remaining, fmt.Errorf("%w: not received within %s", ErrUploadDeadlineExceeded, r.opts.Deadline)
+		}
+	}
+	if wait < 0 && abort == nil {
+		// stalled already, without a timeout; wait for the read
+		wait = time.Duration(1<<63 - 1)
+	}
+	return max(wait, 0), abort
+}
+
+// cancelled returns the error of an upload whose context ended.
+func (r *timeoutReader) cancelled() error {
+	return fmt.Errorf("%w: upload of process(%s): %w", ErrProcessCancelled, r.fileProcess.ID, context.Cause(r.ctx))
+}
+
+// reportStall sends the "stalled" status of the upload.
+func (r *timeoutReader) reportStall(idle time.Duration) {
+	status := ProcessingStatus{
+		ProcessID:         r.fileProcess.ID,
+		TimeStamp:         int(time.Now().UnixNano() / int64(time.Millisecond)),
+		ProcessorName:     "FileUpload",
+		StatusDescription: fmt.Sprintf("Upload stalled: no bytes received for %s", idle),
+	}
+	r.fileProcess.AddProcessingUpdate(status)
+	publishStatus(r.statusCh, r.fileProcess)
+	r.fm.LogTo("INFO", fmt.Sprintf("[FileManager.HandleFileUpload] Upload %s%s stalled for %s\n", r.fileProcess.IncomingFileName, r.fileProcess.LogLabels(), idle))
+}
+
+// abort fails the upload and ends the read in flight if the source allows it.
+func (r *timeoutReader) abort(err error) {
+	r.err = err
+	r.fm.LogTo("INFO", fmt.Sprintf("[FileManager.HandleFileUpload] Aborting upload %s%s: %v\n", r.fileProcess.IncomingFileName, r.fileProcess.LogLabels(), err))
+	if conn, ok := r.source.(interface{ SetReadDeadline(time.Time) error }); ok {
+		if conn.SetReadDeadline(time.Now()) == nil {
+			return
+		}
+	}
+	if closer, ok := r.source.(io.Closer); ok {
+		// some readers, like HTTP request bodies, only close once the blocked read returns
+		go closer.Close()
+	}
+}
@@ -0,0 +1,325 @@
+package filemanager
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrVersionNotFound     = errors.New("file version not found")
+	ErrVersioningDisabled  = errors.New("versioning is not enabled")
+	ErrInvalidVersionEntry = errors.New("invalid version entry")
+)
+
+// VERSIONS_DIR_NAME is the hidden directory next to a versioned file that holds its previous versions.
+const VERSIONS_DIR_NAME = ".versions"
+
+// VersioningOptions configures how many previous versions of an overwritten file are kept.
+// A zero value for either limit disables that limit.
+type VersioningOptions struct {
+	MaxVersions int           `yaml:"max_versions"`
+	MaxAge      time.Duration `yaml:"max_age"`
+}
+
+// FileVersion describes a previous version of a file.
+type FileVersion struct {
+	Number        int
+	LocalFilePath string
+	FileSize      int64
+	CreatedAt     time.Time
+}
+
+// EnableVersioning makes SaveFile keep previous versions of overwritten files.
+func (fm *FileManager) EnableVersioning(options VersioningOptions) {
+	fm.mu.Lock()
+	defer fm.mu.Unlock()
+	fm.versioning = &options
+}
+
+func (fm *FileManager) getVersioningOptions() *VersioningOptions {
+	if fm.parent != nil {
+		return fm.parent.getVersioningOptions()
+	}
+	fm.mu.RLock()
+	defer fm.mu.RUnlock()
+	return fm.versioning
+}
+
+// SaveFile saves a ManagedFile to its LocalFilePath in the configured Storage, along with its HTTPHeaders. With
+// versioning enabled, an existing file at that path is kept as a previous version first (local storage only).
+// Compressed variants of a replaced file are removed, as they no longer match its content. Tenant views fail with
+// ErrQuotaExceeded if the file does not fit the tenant's quota.
+func (fm *FileManager) SaveFile(file *ManagedFile) error {
+	return fm.saveManagedFile(file, false)
+}
+
+// saveManagedFile is SaveFile, failing with ErrFileExists instead of replacing an existing file with noOverwrite.
+func (fm *FileManager) saveManagedFile(file *ManagedFile, noOverwrite bool) error {
+	err := fm.checkOwnsPath(file.LocalFilePath)
+	if err != nil {
+		return err
+	}
+	err = fm.checkContainedPath(file.LocalFilePath)
+	if err != nil {
+		return err
+	}
+	err = fm.checkNotOnHold(file.LocalFilePath)
+	if err != nil {
+		return err
+	}
+	err = fm.reserveQuota(file.LocalFilePath, int64(len(file.Content)))
+	if err != nil {
+		return err
+	}
+	err = fm.saveFile(file, noOverwrite)
+	if err != nil {
+		fm.invalidateUsage()
+		return err
+	}
+	fm.removePreCompressed(file.LocalFilePath)
+	fm.replicate(file.LocalFilePath, false)
+	if file.HTTPHeaders != nil {
+		return fm.SetHTTPHeaders(file.LocalFilePath, *file.HTTPHeaders)
+	}
+	return nil
+}
+
+func (fm *FileManager) saveFile(file *ManagedFile, noOverwrite bool) error {
+	if !fm.usesLocalStorage(file.LocalFilePath) {
+		return fm.saveToStorage(file, noOverwrite)
+	}
+	perms := fm.getFilePermissions()
+	saveOptions := SaveOptions{NoOverwrite: noOverwrite, FileMode: perms.fileModeOr(0644), DirMode: perms.dirMode()}
+	options := fm.getVersioningOptions()
+	if options == nil || noOverwrite || !FileExists(file.LocalFilePath) {
+		return file.SaveWithOptions(saveOptions)
+	}
+	versionPath, err := fm.archiveVersion(file.LocalFilePath)
+	if err != nil {
+		return err
+	}
+	err = file.SaveWithOptions(saveOptions)
+	if err != nil {
+		// the file was not replaced, so it is no previous version
+		fm.dropVersion(versionPath)
+		return err
+	}
+	fm.pruneVersions(file.LocalFilePath, *options)
+	return nil
+}
+
+// ListVersions returns the kept previous versions of the file at the local path, oldest first.
+func (fm *FileManager) ListVersions(localFilePath string) ([]FileVersion, error) {
+	err := fm.checkOwnsPath(localFilePath)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(versionsDir(localFilePath))
+	if os.IsNotExist(err) {
+		return []FileVersion{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	versions := make([]FileVersion, 0, len(entries))
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		version, err := parseVersionEntry(versionsDir(localFilePath), entry)
+		if err != nil {
+			continue
+		}
+		versions = append(versions, version)
+	}
+	sort.Slice(versions, func(i, j int) bool {
+		return versions[i].Number < versions[j].Number
+	})
+	return versions, nil
+}
+
+// GetVersion loads version n of the file at the local path.
+func (fm *FileManager) GetVersion(localFilePath string, n int) (*ManagedFile, error) {
+	version, err := fm.findVersion(localFilePath, n)
+	if err != nil {
+		return nil, err
+	}
+	content, err := os.ReadFile(version.LocalFilePath)
+	if err != nil {
+		return nil, err
+	}
+	versionFile := &ManagedFile{
+		FileName:      filepath.Base(localFilePath),
+		LocalFilePath: version.LocalFilePath,
+		FileSize:      version.FileSize,
+		Content:       content,
+		MetaData: map[string]any{
+			"version":            version.Number,
+			"version_created_at": version.CreatedAt,
+		},
+	}
+	versionFile.UpdateMimeType()
+	return versionFile, nil
+}
+
+// RestoreVersion replaces the file at the local path with version n. The replaced content is kept as a new version.
+func (fm *FileManager) RestoreVersion(localFilePath string, n int) error {
+	options := fm.getVersioningOptions()
+	if options == nil {
+		return ErrVersioningDisabled
+	}
+	err := fm.checkOwnsPath(localFilePath)
+	if err != nil {
+		return err
+	}
+	err = fm.checkContainedPath(localFilePath)
+	if err != nil {
+		return err
+	}
+	err = fm.checkNotOnHold(localFilePath)
+	if err != nil {
+		return err
+	}
+	version, err := fm.findVersion(localFilePath, n)
+	if err != nil {
+		return err
+	}
+	content, err := os.ReadFile(version.LocalFilePath)
+	if err != nil {
+		return err
+	}
+	versionPath := ""
+	if FileExists(localFilePath) {
+		versionPath, err = fm.archiveVersion(localFilePath)
+		if err != nil {
+			return err
+		}
+	}
+	// written atomically, the archived version may share the file's inode
+	perms := fm.getFilePermissions()
+	err = writeFileAtomic(localFilePath, content, perms.fileModeOr(0644), perms.dirMode(), false)
+	if err != nil {
+		if versionPath != "" {
+			fm.dropVersion(versionPath)
+		}
+		return err
+	}
+	fm.pruneVersions(localFilePath, *options)
+	fm.replicate(localFilePath, false)
+	return nil
+}
+
+func (fm *FileManager) findVersion(localFilePath string, n int) (FileVersion, error) {
+	versions, err := fm.ListVersions(localFilePath)
+	if err != nil {
+		return FileVersion{}, err
+	}
+	for _, version := range versions {
+		if version.Number == n {
+			return version, nil
+		}
+	}
+	return FileVersion{}, ErrVersionNotFound
+}
+
+// archiveVersion keeps the current file in the versions directory and returns the path of the new version. The
+// file stays in place until it is replaced, which has to happen atomically (by renaming a new file over it): the
+// version is a hard link to the file where the file system allows it, and a copy otherwise.
+func (fm *FileManager) archiveVersion(localFilePath string) (string, error) {
+	versions, err := fm.ListVersions(localFilePath)
+	if err != nil {
+		return "", err
+	}
+	number := 1
+	if len(versions) > 0 {
+		number = versions[len(versions)-1].Number + 1
+	}
+
+	versionPath := filepath.Join(versionsDir(localFilePath), fmt.Sprintf("v%d_%d%s", number, time.Now().UnixNano(), filepath.Ext(localFilePath)))
+	err = fm.checkContainedPath(versionPath)
+	if err != nil {
+		return "", err
+	}
+	perms := fm.getFilePermissions()
+	err = mkdirAllMode(filepath.Dir(versionPath), perms.dirMode())
+	if err != nil {
+		return "", err
+	}
+	err = os.Link(localFilePath, versionPath)
+	if err != nil {
+		err = copyFile(localFilePath, versionPath, perms.dirMode())
+		if err == nil && perms.fileMode() != 0 {
+			err = os.Chmod(versionPath, perms.fileMode())
+		}
+		if err != nil {
+			os.Remove(versionPath)
+			return "", err
+		}
+	}
+	fm.LogTo("DEBUG", fmt.Sprintf("[FileManager.Versioning] Archived file(%s) as version(%d)\n", localFilePath, number))
+	return versionPath, nil
+}
+
+// dropVersion removes a version archived for a replacement that failed.
+func (fm *FileManager) dropVersion(versionPath string) {
+	err := os.Remove(versionPath)
+	if err != nil {
+		fm.LogTo("INFO", fmt.Sprintf("[FileManager.Versioning] Failed to remove version(%s) of a failed save: %v\n", versionPath, err))
+	}
+}
+
+func (fm *FileManager) pruneVersions(localFilePath string, options VersioningOptions) {
+	versions, err := fm.ListVersions(localFilePath)
+	if err != nil {
+		return
+	}
+	for i, version := range versions {
+		tooMany := options.MaxVersions > 0 && len(versions)-i > options.MaxVersions
+		tooOld := options.MaxAge > 0 && time.Since(version.CreatedAt) > options.MaxAge
+		if !tooMany && !tooOld {
+			continue
+		}
+		err = os.Remove(version.LocalFilePath)
+		if err != nil {
+			fm.LogTo("INFO", fmt.Sprintf("[FileManager.Versioning] Failed to prune version(%d) of file(%s): %v\n", version.Number, localFilePath, err))
+		}
+	}
+}
+
+func versionsDir(localFilePath string) string {
+	return filepath.Join(filepath.Dir(localFilePath), VERSIONS_DIR_NAME, filepath.Base(localFilePath))
+}
+
+// parseVersionEntry parses entries named v<number>_<unix-nano><ext>.
+func parseVersionEntry(dir string, entry os.DirEntry) (FileVersion, error) {
+	name := strings.TrimSuffix(entry.Name(), filepath.Ext(entry.Name()))
+	numberPart, createdPart, ok := strings.Cut(strings.TrimPrefix(name, "v"), "_")
+	if !ok || !strings.HasPrefix(name, "v") {
+		return FileVersion{}, ErrInvalidVersionEntry
+	}
+	number, err := strconv.Atoi(numberPart)
+	if err != nil {
+		return FileVersion{}, ErrInvalidVersionEntry
+	}
+	createdNanos, err := strconv.ParseInt(createdPart, 10, 64)
+	if err != nil {
+		return FileVersion{}, ErrInvalidVersionEntry
+	}
+	info, err := entry.Info()
+	if err != nil {
+		return FileVersion{}, err
+	}
+	return FileVersion{
+		Number:        number,
+		LocalFilePath: filepath.Join(dir, entry.Name()),
+		FileSize:      info.Size(),
+		CreatedAt:     time.Unix(0, createdNanos),
+	}, nil
+}
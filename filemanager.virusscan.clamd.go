@@ -0,0 +1,296 @@
+package filemanager
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrClamdResponse    = errors.New("unexpected clamd response")
+	ErrScanSizeExceeded = errors.New("file exceeds the scan size limit")
+	ErrNothingToScan    = errors.New("file has neither content nor a local file to scan")
+)
+
+const (
+	DEFAULT_CLAMD_TIMEOUT    = 2 * time.Minute
+	DEFAULT_CLAMD_CHUNK_SIZE = 64 * 1024
+	// DEFAULT_CLAMD_STREAM_MAX_LENGTH matches the StreamMaxLength default of clamd.conf.
+	DEFAULT_CLAMD_STREAM_MAX_LENGTH = 25 * 1024 * 1024
+)
+
+// ClamdOversizeAction decides what happens with files larger than the StreamMaxLength of a ClamdScanner.
+type ClamdOversizeAction string
+
+const (
+	ClamdOversizeError    ClamdOversizeAction = "error"    // fail the scan with ErrScanSizeExceeded (default)
+	ClamdOversizeSkip     ClamdOversizeAction = "skip"     // do not scan, the result is Skipped
+	ClamdOversizeTruncate ClamdOversizeAction = "truncate" // scan the first StreamMaxLength bytes, the result is Truncated
+	ClamdOversizeInfected ClamdOversizeAction = "infected" // treat the file as infected
+)
+
+// ClamdScanner scans files with a clamd daemon over TCP or a unix socket. Content is streamed with INSTREAM in
+// chunks; files not loaded into memory are streamed from their LocalFilePath. If clamd shares the file system,
+// ScanPaths lets it read local files itself (SCAN or CONTSCAN), which avoids the stream size limit.
+type ClamdScanner struct {
+	Network string // "tcp" or "unix"
+	Address string // host:port or socket path
+	Timeout time.Duration
+	// ChunkSize of INSTREAM chunks, defaults to 64 KiB.
+	ChunkSize int
+	// StreamMaxLength must not exceed StreamMaxLength of clamd.conf, defaults to 25 MiB. Larger files are handled
+	// according to OversizeAction, as are files clamd rejects with "INSTREAM size limit exceeded".
+	StreamMaxLength int64
+	OversizeAction  ClamdOversizeAction
+	// ScanPaths scans files by path if their LocalFilePath holds the current content (same size, or no content
+	// loaded). Streaming is used as fallback if clamd cannot access the file.
+	ScanPaths bool
+	// PathCommand is "SCAN" (default, stops at the first virus) or "CONTSCAN".
+	PathCommand string
+	// LocalPathPrefix is replaced with ClamdPathPrefix in scanned paths, for clamd running in a container that
+	// mounts the files elsewhere.
+	LocalPathPrefix string
+	ClamdPathPrefix string
+	// MaxConnections limits the concurrent connections to clamd (default 4); further scans wait for a free one.
+	// Connections are kept open as IDSESSION sessions for IdleTimeout (default 20s, keep it below clamd's
+	// IdleTimeout) and reused.
+	MaxConnections int
+	IdleTimeout    time.Duration
+	// OnHealthChange is called by the health check started with StartHealthCheck when clamd becomes unavailable
+	// (err != nil) or available again.
+	OnHealthChange func(available bool, err error)
+
+	poolOnce sync.Once
+	pool     *clamdPool
+	health   clamdHealth
+}
+
+// NewClamdTCPScanner returns a scanner for clamd listening on host:port (a tcp:// prefix is accepted).
+func NewClamdTCPScanner(address string) *ClamdScanner {
+	return &ClamdScanner{Network: "tcp", Address: strings.TrimPrefix(address, "tcp://")}
+}
+
+// NewClamdUnixScanner returns a scanner for clamd listening on the unix socket (a unix:// prefix is accepted).
+func NewClamdUnixScanner(socketPath string) *ClamdScanner {
+	return &ClamdScanner{Network: "unix", Address: strings.TrimPrefix(socketPath, "unix://")}
+}
+
+// newClamdScannerFromAddress accepts tcp://host:port, unix:///path or a plain socket path.
+func newClamdScannerFromAddress(address string) *ClamdScanner {
+	if strings.HasPrefix(address, "tcp://") {
+		return NewClamdTCPScanner(address)
+	}
+	return NewClamdUnixScanner(address)
+}
+
+func (s *ClamdScanner) Name() string {
+	return "clamd"
+}
+
+// Ping checks that clamd is reachable and responding.
+func (s *ClamdScanner) Ping() error {
+	response, err := s.command("PING", nil)
+	if err != nil {
+		return err
+	}
+	if response != "PONG" {
+		return fmt.Errorf("%w: %q", ErrClamdResponse, response)
+	}
+	return nil
+}
+
+func (s *ClamdScanner) Scan(file *ManagedFile) (VirusScanResult, error) {
+	if s.ScanPaths && s.canScanPath(file) {
+		result, err := s.ScanPath(file.LocalFilePath)
+		if err == nil {
+			return result, nil
+		}
+		// e.g. clamd has no access to the file, fall back to streaming
+	}
+	if len(file.Content) > 0 {
+		return s.scanStream(bytes.NewReader(file.Content), int64(len(file.Content)))
+	}
+	if file.LocalFilePath == "" {
+		return VirusScanResult{}, ErrNothingToScan
+	}
+	f, err := os.Open(file.LocalFilePath)
+	if err != nil {
+		return VirusScanResult{}, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return VirusScanResult{}, err
+	}
+	return s.scanStream(f, info.Size())
+}
+
+// ScanReader streams the content to clamd with INSTREAM. Content beyond StreamMaxLength is handled according to
+// OversizeAction.
+func (s *ClamdScanner) ScanReader(r io.Reader) (VirusScanResult, error) {
+	return s.scanStream(r, -1)
+}
+
+// ScanPath lets clamd scan a file it can access itself, using PathCommand.
+func (s *ClamdScanner) ScanPath(localFilePath string) (VirusScanResult, error) {
+	path, err := filepath.Abs(localFilePath)
+	if err != nil {
+		return VirusScanResult{}, err
+	}
+	if s.LocalPathPrefix != "" && strings.HasPrefix(path, s.LocalPathPrefix) {
+		path = s.ClamdPathPrefix + strings.TrimPrefix(path, s.LocalPathPrefix)
+	}
+	command := strings.ToUpper(s.PathCommand)
+	if command == "" {
+		command = "SCAN"
+	}
+	response, err := s.command(command+" "+path, nil)
+	if err != nil {
+		return VirusScanResult{}, err
+	}
+	return parseClamdResult(s.Name(), response)
+}
+
+func (s *ClamdScanner) canScanPath(file *ManagedFile) bool {
+	if file.LocalFilePath == "" {
+		return false
+	}
+	info, err := os.Stat(file.LocalFilePath)
+	if err != nil || !info.Mode().IsRegular() {
+		return false
+	}
+	return len(file.Content) == 0 || info.Size() == int64(len(file.Content))
+}
+
+// scanStream streams up to StreamMaxLength bytes of r; size is the content length or -1 if unknown.
+func (s *ClamdScanner) scanStream(r io.Reader, size int64) (VirusScanResult, error) {
+	maxLength := s.StreamMaxLength
+	if maxLength <= 0 {
+		maxLength = DEFAULT_CLAMD_STREAM_MAX_LENGTH
+	}
+	chunkSize := s.ChunkSize
+	if chunkSize <= 0 {
+		chunkSize = DEFAULT_CLAMD_CHUNK_SIZE
+	}
+	if int64(chunkSize) > maxLength {
+		chunkSize = int(maxLength)
+	}
+
+	if size > maxLength && s.OversizeAction != ClamdOversizeTruncate {
+		return s.oversizeResult(size, maxLength)
+	}
+	limited := &io.LimitedReader{R: r, N: maxLength}
+	response, err := s.command("INSTREAM", func(w io.Writer) error {
+		return writeClamdChunks(w, limited, chunkSize)
+	})
+	if err != nil {
+		return VirusScanResult{}, err
+	}
+	if strings.Contains(response, "size limit exceeded") {
+		// clamd is configured with a lower StreamMaxLength than this scanner
+		return s.oversizeResult(size, -1)
+	}
+	result, err := parseClamdResult(s.Name(), response)
+	if err != nil || result.Infected {
+		return result, err
+	}
+	if size > maxLength || (size < 0 && limited.N == 0 && hasMoreData(r)) {
+		if s.OversizeAction != ClamdOversizeTruncate {
+			return s.oversizeResult(size, maxLength)
+		}
+		result.Truncated = true
+		result.Reason = fmt.Sprintf("only the first %d bytes were scanned", maxLength)
+	}
+	return result, nil
+}
+
+// oversizeResult applies the OversizeAction; maxLength is -1 if clamd rejected the stream.
+func (s *ClamdScanner) oversizeResult(size int64, maxLength int64) (VirusScanResult, error) {
+	result := VirusScanResult{Scanner: s.Name()}
+	var reason string
+	switch {
+	case maxLength < 0:
+		reason = "clamd rejected the stream, StreamMaxLength of clamd is lower than the scanner's"
+	case size < 0:
+		reason = fmt.Sprintf("file exceeds the stream limit of %d bytes", maxLength)
+	default:
+		reason = fmt.Sprintf("file size %d exceeds the stream limit of %d bytes", size, maxLength)
+	}
+	switch s.OversizeAction {
+	case ClamdOversizeSkip:
+		result.Skipped = true
+		result.Reason = reason
+		return result, nil
+	case ClamdOversizeInfected:
+		result.Infected = true
+		result.Signature = "Heuristics.Limits.Exceeded"
+		result.Reason = reason
+		return result, nil
+	}
+	// with ClamdOversizeTruncate, clamd rejected even the truncated stream
+	return result, fmt.Errorf("%w: %s", ErrScanSizeExceeded, reason)
+}
+
+func hasMoreData(r io.Reader) bool {
+	var b [1]byte
+	n, _ := r.Read(b[:])
+	return n > 0
+}
+
+// writeClamdChunks sends the content as INSTREAM chunks (4 byte big-endian length + data) and the terminating
+// zero-length chunk.
+func writeClamdChunks(w io.Writer, r io.Reader, chunkSize int) error {
+	buf := make([]byte, 4+chunkSize)
+	for {
+		n, err := io.ReadFull(r, buf[4:])
+		if n > 0 {
+			binary.BigEndian.PutUint32(buf[:4], uint32(n))
+			_, writeErr := w.Write(buf[:4+n])
+			if writeErr != nil {
+				return writeErr
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	_, err := w.Write([]byte{0, 0, 0, 0})
+	return err
+}
+
+// parseClamdResult parses responses like "stream: OK", "stream: Eicar-Signature FOUND" and "... ERROR".
+func parseClamdResult(scanner string, response string) (VirusScanResult, error) {
+	result := VirusScanResult{Scanner: scanner}
+	// drop the "<path>: " prefix, paths can contain ": " themselves, the status never does
+	_, verdict, ok := cutLast(response, ": ")
+	if !ok {
+		verdict = response
+	}
+	switch {
+	case verdict == "OK":
+		return result, nil
+	case strings.HasSuffix(verdict, " FOUND"):
+		result.Infected = true
+		result.Signature = strings.TrimSuffix(verdict, " FOUND")
+		return result, nil
+	}
+	return result, fmt.Errorf("%w: %s", ErrClamdResponse, response)
+}
+
+func cutLast(s string, sep string) (before string, after string, found bool) {
+	i := strings.LastIndex(s, sep)
+	if i < 0 {
+		return s, "", false
+	}
+	return s[:i], s[i+len(sep):], true
+}
@@ -0,0 +1,258 @@
+package filemanager
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DEFAULT_CLAMD_MAX_CONNECTIONS = 4
+	DEFAULT_CLAMD_IDLE_TIMEOUT    = 20 * time.Second
+)
+
+// clamdSession is a connection in IDSESSION mode: commands are answered with "<id>: <response>".
+type clamdSession struct {
+	conn     net.Conn
+	reader   *bufio.Reader
+	lastID   int
+	lastUsed time.Time
+}
+
+// clamdPool limits the number of concurrent connections and keeps idle sessions for reuse.
+type clamdPool struct {
+	slots chan struct{}
+	mu    sync.Mutex
+	idle  []*clamdSession
+}
+
+type clamdHealth struct {
+	mu        sync.Mutex
+	checked   bool
+	available bool
+	err       error
+}
+
+func (s *ClamdScanner) getPool() *clamdPool {
+	s.poolOnce.Do(func() {
+		maxConnections := s.MaxConnections
+		if maxConnections <= 0 {
+			maxConnections = DEFAULT_CLAMD_MAX_CONNECTIONS
+		}
+		s.pool = &clamdPool{slots: make(chan struct{}, maxConnections)}
+	})
+	return s.pool
+}
+
+func (s *ClamdScanner) timeout() time.Duration {
+	if s.Timeout > 0 {
+		return s.Timeout
+	}
+	return DEFAULT_CLAMD_TIMEOUT
+}
+
+func (s *ClamdScanner) idleTimeout() time.Duration {
+	if s.IdleTimeout > 0 {
+		return s.IdleTimeout
+	}
+	return DEFAULT_CLAMD_IDLE_TIMEOUT
+}
+
+// command runs a command on a pooled session, lets body write its payload and returns the response. A reused
+// session that turns out to be dead (e.g. clamd restarted) is replaced by a new connection, as long as the body
+// has not been written yet. Connection failures are reported as ErrScannerUnavailable.
+func (s *ClamdScanner) command(command string, body func(w io.Writer) error) (string, error) {
+	pool := s.getPool()
+	timeout := s.timeout()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case pool.slots <- struct{}{}:
+	case <-timer.C:
+		return "", fmt.Errorf("%w: clamd(%s) all %d connections busy for %v", ErrScannerUnavailable, s.Address, cap(pool.slots), timeout)
+	}
+	defer func() { <-pool.slots }()
+
+	for {
+		session, reused := pool.takeIdle(s.idleTimeout())
+		if session == nil {
+			var err error
+			session, err = s.openSession(timeout)
+			if err != nil {
+				return "", fmt.Errorf("%w: failed to connect to clamd(%s): %v", ErrScannerUnavailable, s.Address, err)
+			}
+		}
+		response, bodyStarted, err := session.do(command, body, timeout)
+		if err != nil {
+			session.close()
+			if reused && !bodyStarted {
+				continue
+			}
+			return "", fmt.Errorf("%w: clamd(%s) %s failed: %v", ErrScannerUnavailable, s.Address, command, err)
+		}
+		if strings.HasSuffix(response, "ERROR") {
+			// clamd ends the session after errors like "INSTREAM size limit exceeded"
+			session.close()
+		} else {
+			pool.putIdle(session)
+		}
+		return response, nil
+	}
+}
+
+func (s *ClamdScanner) openSession(timeout time.Duration) (*clamdSession, error) {
+	conn, err := net.DialTimeout(s.Network, s.Address, timeout)
+	if err != nil {
+		return nil, err
+	}
+	session := &clamdSession{conn: conn, reader: bufio.NewReader(conn), lastUsed: time.Now()}
+	err = conn.SetWriteDeadline(time.Now().Add(timeout))
+	if err == nil {
+		_, err = conn.Write([]byte("zIDSESSION\x00"))
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return session, nil
+}
+
+// do sends the command and reads its response. bodyStarted reports whether body was called, after which the
+// command cannot be repeated.
+func (session *clamdSession) do(command string, body func(w io.Writer) error, timeout time.Duration) (response string, bodyStarted bool, err error) {
+	err = session.conn.SetDeadline(time.Now().Add(timeout))
+	if err != nil {
+		return "", false, err
+	}
+	_, err = session.conn.Write([]byte("z" + command + "\x00"))
+	if err != nil {
+		return "", false, err
+	}
+	session.lastID++
+	if body != nil {
+		bodyStarted = true
+		err = body(session.conn)
+	}
+	// clamd may stop reading early (e.g. "INSTREAM size limit exceeded"), so try to read its answer anyway
+	line, readErr := session.reader.ReadString(0)
+	line = strings.TrimSpace(strings.TrimRight(line, "\x00"))
+	if line == "" {
+		if err == nil {
+			err = readErr
+		}
+		if err == nil {
+			err = io.ErrUnexpectedEOF
+		}
+		return "", bodyStarted, err
+	}
+	session.lastUsed = time.Now()
+	if id, rest, ok := strings.Cut(line, ": "); ok && id == strconv.Itoa(session.lastID) {
+		line = rest
+	}
+	return line, bodyStarted, nil
+}
+
+// alive checks without blocking that clamd has not closed the idle session.
+func (session *clamdSession) alive() bool {
+	err := session.conn.SetReadDeadline(time.Now().Add(time.Millisecond))
+	if err != nil {
+		return false
+	}
+	_, err = session.reader.Peek(1)
+	var netErr net.Error
+	// a timeout means no data and no EOF, anything clamd sends unasked means the session is unusable
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+func (session *clamdSession) close() {
+	session.conn.SetWriteDeadline(time.Now().Add(time.Second))
+	session.conn.Write([]byte("zEND\x00"))
+	session.conn.Close()
+}
+
+// takeIdle returns the most recently used idle session that is still alive, closing expired and dead ones.
+func (pool *clamdPool) takeIdle(idleTimeout time.Duration) (*clamdSession, bool) {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	for len(pool.idle) > 0 {
+		session := pool.idle[len(pool.idle)-1]
+		pool.idle = pool.idle[:len(pool.idle)-1]
+		if time.Since(session.lastUsed) < idleTimeout && session.alive() {
+			return session, true
+		}
+		session.close()
+	}
+	return nil, false
+}
+
+func (pool *clamdPool) putIdle(session *clamdSession) {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	pool.idle = append(pool.idle, session)
+}
+
+func (pool *clamdPool) closeIdle() {
+	pool.mu.Lock()
+	idle := pool.idle
+	pool.idle = nil
+	pool.mu.Unlock()
+	for _, session := range idle {
+		session.close()
+	}
+}
+
+// Close ends all idle sessions. The scanner stays usable and opens new connections when needed.
+func (s *ClamdScanner) Close() {
+	s.getPool().closeIdle()
+}
+
+// StartHealthCheck pings clamd every interval until the context is done. While clamd is unavailable, idle
+// sessions are dropped and Available reports the error; scans keep trying to connect, so the scanner recovers
+// by itself once clamd is back.
+func (s *ClamdScanner) StartHealthCheck(ctx context.Context, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			s.checkHealth()
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// Available returns the result of the last health check; it is true if no check ran yet.
+func (s *ClamdScanner) Available() (bool, error) {
+	s.health.mu.Lock()
+	defer s.health.mu.Unlock()
+	if !s.health.checked {
+		return true, nil
+	}
+	return s.health.available, s.health.err
+}
+
+func (s *ClamdScanner) checkHealth() {
+	err := s.Ping()
+	if err != nil {
+		s.getPool().closeIdle()
+	}
+	s.health.mu.Lock()
+	changed := !s.health.checked && err != nil || s.health.checked && s.health.available != (err == nil)
+	s.health.checked = true
+	s.health.available = err == nil
+	s.health.err = err
+	s.health.mu.Unlock()
+	if changed && s.OnHealthChange != nil {
+		s.OnHealthChange(err == nil, err)
+	}
+}
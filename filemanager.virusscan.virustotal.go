@@ -0,0 +1,238 @@
+package filemanager
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+var (
+	ErrVirusTotalTimeout = errors.New("virustotal analysis did not complete in time")
+)
+
+const (
+	DEFAULT_VIRUSTOTAL_ENDPOINT      = "https://www.virustotal.com/api/v3"
+	DEFAULT_VIRUSTOTAL_POLL_INTERVAL = 15 * time.Second
+	DEFAULT_VIRUSTOTAL_TIMEOUT       = 10 * time.Minute
+	// VIRUSTOTAL_DIRECT_UPLOAD_LIMIT is the largest file posted to /files, larger ones need an upload URL.
+	VIRUSTOTAL_DIRECT_UPLOAD_LIMIT = 32 * 1024 * 1024
+)
+
+// VirusTotalScanner looks files up by their SHA-256 on VirusTotal and uploads unknown files for analysis.
+// Note that uploaded files are shared with VirusTotal's partners, do not use it for confidential content.
+type VirusTotalScanner struct {
+	APIKey       string
+	Endpoint     string // defaults to DEFAULT_VIRUSTOTAL_ENDPOINT
+	Client       *http.Client
+	PollInterval time.Duration
+	Timeout      time.Duration // for the analysis of uploaded files
+	// MinDetections is the number of engines that must flag the file as malicious, defaults to 1.
+	MinDetections int
+}
+
+type virusTotalAnalysis struct {
+	Stats   map[string]int `json:"stats"`
+	Status  string         `json:"status"`
+	Results map[string]struct {
+		Category string `json:"category"`
+		Result   string `json:"result"`
+	} `json:"results"`
+}
+
+func (s *VirusTotalScanner) Name() string {
+	return "virustotal"
+}
+
+func (s *VirusTotalScanner) Scan(file *ManagedFile) (VirusScanResult, error) {
+	sum := sha256.Sum256(file.Content)
+	report, found, err := s.lookup(hex.EncodeToString(sum[:]))
+	if err != nil {
+		return VirusScanResult{}, err
+	}
+	if !found {
+		report, err = s.analyze(file)
+		if err != nil {
+			return VirusScanResult{}, err
+		}
+	}
+	return s.result(report), nil
+}
+
+// lookup returns the last analysis of a known file.
+func (s *VirusTotalScanner) lookup(hash string) (virusTotalAnalysis, bool, error) {
+	var response struct {
+		Data struct {
+			Attributes struct {
+				Stats   map[string]int `json:"last_analysis_stats"`
+				Results map[string]struct {
+					Category string `json:"category"`
+					Result   string `json:"result"`
+				} `json:"last_analysis_results"`
+			} `json:"attributes"`
+		} `json:"data"`
+	}
+	req, err := s.newRequest(http.MethodGet, s.endpoint()+"/files/"+hash, nil)
+	if err != nil {
+		return virusTotalAnalysis{}, false, err
+	}
+	httpResponse, err := httpClientOrDefault(s.Client).Do(req)
+	if err != nil {
+		return virusTotalAnalysis{}, false, fmt.Errorf("%w: virustotal: %v", ErrScannerUnavailable, err)
+	}
+	defer httpResponse.Body.Close()
+	if httpResponse.StatusCode == http.StatusNotFound {
+		return virusTotalAnalysis{}, false, nil
+	}
+	if httpResponse.StatusCode < 200 || httpResponse.StatusCode > 299 {
+		body, _ := io.ReadAll(io.LimitReader(httpResponse.Body, 1024))
+		err = fmt.Errorf("virustotal file lookup failed with status %d: %s", httpResponse.StatusCode, strings.TrimSpace(string(body)))
+		if httpResponse.StatusCode == http.StatusTooManyRequests || httpResponse.StatusCode >= 500 {
+			err = fmt.Errorf("%w: %v", ErrScannerUnavailable, err)
+		}
+		return virusTotalAnalysis{}, false, err
+	}
+	err = json.NewDecoder(httpResponse.Body).Decode(&response)
+	if err != nil {
+		return virusTotalAnalysis{}, false, err
+	}
+	attributes := response.Data.Attributes
+	return virusTotalAnalysis{Stats: attributes.Stats, Status: "completed", Results: attributes.Results}, true, nil
+}
+
+// analyze uploads the file and polls the analysis until it is completed.
+func (s *VirusTotalScanner) analyze(file *ManagedFile) (virusTotalAnalysis, error) {
+	uploadURL := s.endpoint() + "/files"
+	if len(file.Content) > VIRUSTOTAL_DIRECT_UPLOAD_LIMIT {
+		var response struct {
+			Data string `json:"data"`
+		}
+		req, err := s.newRequest(http.MethodGet, s.endpoint()+"/files/upload_url", nil)
+		if err != nil {
+			return virusTotalAnalysis{}, err
+		}
+		err = doJSONRequest(s.Client, req, &response)
+		if err != nil {
+			return virusTotalAnalysis{}, err
+		}
+		uploadURL = response.Data
+	}
+
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	part, err := writer.CreateFormFile("file", file.FileName)
+	if err == nil {
+		_, err = part.Write(file.Content)
+	}
+	if err == nil {
+		err = writer.Close()
+	}
+	if err != nil {
+		return virusTotalAnalysis{}, err
+	}
+	req, err := s.newRequest(http.MethodPost, uploadURL, &body)
+	if err != nil {
+		return virusTotalAnalysis{}, err
+	}
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	var uploadResponse struct {
+		Data struct {
+			ID string `json:"id"`
+		} `json:"data"`
+	}
+	err = doJSONRequest(s.Client, req, &uploadResponse)
+	if err != nil {
+		return virusTotalAnalysis{}, err
+	}
+
+	pollInterval := s.PollInterval
+	if pollInterval <= 0 {
+		pollInterval = DEFAULT_VIRUSTOTAL_POLL_INTERVAL
+	}
+	timeout := s.Timeout
+	if timeout <= 0 {
+		timeout = DEFAULT_VIRUSTOTAL_TIMEOUT
+	}
+	deadline := time.Now().Add(timeout)
+	for {
+		var response struct {
+			Data struct {
+				Attributes virusTotalAnalysis `json:"attributes"`
+			} `json:"data"`
+		}
+		req, err := s.newRequest(http.MethodGet, s.endpoint()+"/analyses/"+uploadResponse.Data.ID, nil)
+		if err != nil {
+			return virusTotalAnalysis{}, err
+		}
+		err = doJSONRequest(s.Client, req, &response)
+		if err != nil {
+			return virusTotalAnalysis{}, err
+		}
+		if response.Data.Attributes.Status == "completed" {
+			return response.Data.Attributes, nil
+		}
+		if time.Now().Add(pollInterval).After(deadline) {
+			return virusTotalAnalysis{}, fmt.Errorf("%w: analysis(%s) status(%s)", ErrVirusTotalTimeout, uploadResponse.Data.ID, response.Data.Attributes.Status)
+		}
+		time.Sleep(pollInterval)
+	}
+}
+
+func (s *VirusTotalScanner) result(analysis virusTotalAnalysis) VirusScanResult {
+	minDetections := s.MinDetections
+	if minDetections <= 0 {
+		minDetections = 1
+	}
+	result := VirusScanResult{Scanner: s.Name()}
+	if analysis.Stats["malicious"] < minDetections {
+		return result
+	}
+	result.Infected = true
+	// report the most common signature name among the engines
+	counts := make(map[string]int)
+	for _, engine := range analysis.Results {
+		if engine.Category == "malicious" && engine.Result != "" {
+			counts[engine.Result]++
+		}
+	}
+	signatures := make([]string, 0, len(counts))
+	for signature := range counts {
+		signatures = append(signatures, signature)
+	}
+	sort.Slice(signatures, func(i, j int) bool {
+		if counts[signatures[i]] != counts[signatures[j]] {
+			return counts[signatures[i]] > counts[signatures[j]]
+		}
+		return signatures[i] < signatures[j]
+	})
+	if len(signatures) > 0 {
+		result.Signature = signatures[0]
+	}
+	result.Signature = strings.TrimSpace(fmt.Sprintf("%s (%d engines)", result.Signature, analysis.Stats["malicious"]))
+	return result
+}
+
+func (s *VirusTotalScanner) newRequest(method string, url string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("x-apikey", s.APIKey)
+	req.Header.Set("Accept", "application/json")
+	return req, nil
+}
+
+func (s *VirusTotalScanner) endpoint() string {
+	if s.Endpoint != "" {
+		return strings.TrimSuffix(s.Endpoint, "/")
+	}
+	return DEFAULT_VIRUSTOTAL_ENDPOINT
+}
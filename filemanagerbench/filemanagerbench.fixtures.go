@@ -0,0 +1,98 @@
+package filemanagerbench
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"math"
+	"math/rand"
+	"strings"
+)
+
+const (
+	DEFAULT_IMAGE_FIXTURE_SIZE  = 10 * 1024 * 1024
+	DEFAULT_PDF_FIXTURE_PAGES   = 100
+	DEFAULT_STREAM_FIXTURE_SIZE = 1024 * 1024 * 1024
+	// FIXTURE_SEED makes fixtures identical across runs, so results stay comparable with a baseline.
+	FIXTURE_SEED = 1
+)
+
+// ImageFixture returns a PNG of random pixels of about size bytes. Noise does not compress, so the file size is
+// close to the decoded size of the image, as with large photos.
+func ImageFixture(size int) []byte {
+	// PNG stores opaque images with 3 bytes per pixel
+	side := int(math.Sqrt(float64(size) / 3))
+	if side < 1 {
+		side = 1
+	}
+	img := image.NewNRGBA(image.Rect(0, 0, side, side))
+	random := rand.New(rand.NewSource(FIXTURE_SEED))
+	random.Read(img.Pix)
+	for i := 3; i < len(img.Pix); i += 4 {
+		img.Pix[i] = 0xff
+	}
+	var buf bytes.Buffer
+	encoder := png.Encoder{CompressionLevel: png.BestSpeed}
+	err := encoder.Encode(&buf, img)
+	if err != nil {
+		// encoding into memory cannot fail
+		panic(err)
+	}
+	return buf.Bytes()
+}
+
+// PDFFixture returns a PDF of the given number of text pages, written without a PDF library so generating it
+// does not influence the results.
+func PDFFixture(pages int) []byte {
+	if pages < 1 {
+		pages = 1
+	}
+	var buf bytes.Buffer
+	var offsets []int
+	object := func(body string) {
+		offsets = append(offsets, buf.Len())
+		fmt.Fprintf(&buf, "%d 0 obj\n%s\nendobj\n", len(offsets), body)
+	}
+
+	buf.WriteString("%PDF-1.4\n")
+	kids := make([]string, pages)
+	for i := range kids {
+		// objects 1-3 are the catalog, the page tree and the font, then a page and its content per page
+		kids[i] = fmt.Sprintf("%d 0 R", 4+2*i)
+	}
+	object("<< /Type /Catalog /Pages 2 0 R >>")
+	object(fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), pages))
+	object("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica >>")
+	for i := 0; i < pages; i++ {
+		object(fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 612 792] /Resources << /Font << /F1 3 0 R >> >> /Contents %d 0 R >>", 5+2*i))
+		content := pdfPageContent(i + 1)
+		object(fmt.Sprintf("<< /Length %d >>\nstream\n%s\nendstream", len(content), content))
+	}
+
+	xref := buf.Len()
+	fmt.Fprintf(&buf, "xref\n0 %d\n0000000000 65535 f \n", len(offsets)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(&buf, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(&buf, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(offsets)+1, xref)
+	return buf.Bytes()
+}
+
+func pdfPageContent(page int) string {
+	var content strings.Builder
+	content.WriteString("BT /F1 11 Tf 14 TL 72 720 Td\n")
+	fmt.Fprintf(&content, "(Page %d) Tj T*\n", page)
+	for line := 0; line < 45; line++ {
+		fmt.Fprintf(&content, "(%d.%d The quick brown fox jumps over the lazy dog, again and again and again.) Tj T*\n", page, line+1)
+	}
+	content.WriteString("ET")
+	return content.String()
+}
+
+// StreamFixture returns a reader of size pseudo-random bytes, generated while reading, so even gigabyte streams
+// use no memory of their own.
+func StreamFixture(size int64) io.Reader {
+	return io.LimitReader(rand.New(rand.NewSource(FIXTURE_SEED)), size)
+}
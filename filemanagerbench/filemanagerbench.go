@@ -0,0 +1,235 @@
+// Package filemanagerbench measures the throughput, latency and allocations of the filemanager package on
+// representative fixtures, and checks them against a baseline to catch performance regressions.
+//
+// Wire it into a _test.go file of your application or CI:
+//
+//	func BenchmarkFileManager(b *testing.B) {
+//		filemanagerbench.RunBenchmarks(b, filemanagerbench.DefaultCases(filemanagerbench.Options{}))
+//	}
+package filemanagerbench
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+
+	"github.com/gabriel-vasile/mimetype"
+	filemanager "github.com/itsatony/go-filemanager"
+)
+
+// Options configure the fixtures of DefaultCases. Zero values use the defaults.
+type Options struct {
+	// ImageSize is the size of the image fixture in bytes, defaults to DEFAULT_IMAGE_FIXTURE_SIZE.
+	ImageSize int
+	// PDFPages is the page count of the PDF fixture, defaults to DEFAULT_PDF_FIXTURE_PAGES.
+	PDFPages int
+	// StreamSize is the size of the stream uploaded by the large upload case, defaults to
+	// DEFAULT_STREAM_FIXTURE_SIZE.
+	StreamSize int64
+	// Short uses fixtures of a tenth of the size, for quick regression checks in CI.
+	Short bool
+	// Skip leaves out the named cases, e.g. "upload/stream" on machines short of memory or
+	// "recipe/pdf_text_extractor" without a UniPDF license.
+	Skip []string
+}
+
+func (o Options) withDefaults() Options {
+	if o.ImageSize <= 0 {
+		o.ImageSize = DEFAULT_IMAGE_FIXTURE_SIZE
+	}
+	if o.PDFPages <= 0 {
+		o.PDFPages = DEFAULT_PDF_FIXTURE_PAGES
+	}
+	if o.StreamSize <= 0 {
+		o.StreamSize = DEFAULT_STREAM_FIXTURE_SIZE
+	}
+	if o.Short {
+		o.ImageSize /= 10
+		o.PDFPages = (o.PDFPages + 9) / 10
+		o.StreamSize /= 10
+	}
+	return o
+}
+
+// Case is a single benchmark.
+type Case struct {
+	Name string
+	Run  func(b *testing.B)
+}
+
+// DefaultCases returns the benchmarks of the upload path and of every bundled plugin that works without external
+// tools or services:
+//
+//   - upload/image and upload/stream: HandleFileUpload of the image fixture and of the large stream
+//   - recipe/store: a recipe without steps, the cost of storing outputs
+//   - recipe/<plugin>: a recipe with a single step of the plugin on the image or PDF fixture
+//
+// Like the plugin itself, recipe/pdf_text_extractor needs a UniPDF license.
+func DefaultCases(opts Options) []Case {
+	opts = opts.withDefaults()
+	image := lazyFixture(func() []byte { return ImageFixture(opts.ImageSize) })
+	pdf := lazyFixture(func() []byte { return PDFFixture(opts.PDFPages) })
+	cases := []Case{
+		UploadCase("upload/image", image),
+		UploadStreamCase("upload/stream", opts.StreamSize),
+		RecipeCase("recipe/store", nil, "", nil, "fixture.png", image),
+		RecipeCase("recipe/image_manipulation", &filemanager.ImageManipulationPlugin{}, "image_manipulation", map[string]any{"format": "jpg", "width": 1200}, "fixture.png", image),
+		RecipeCase("recipe/perceptual_hash", &filemanager.PerceptualHashPlugin{}, "perceptual_hash", nil, "fixture.png", image),
+		RecipeCase("recipe/placeholder", &filemanager.PlaceholderPlugin{}, "placeholder", nil, "fixture.png", image),
+		RecipeCase("recipe/pdf_text_extractor", &filemanager.PDFTextExtractorPlugin{}, "pdf_text_extractor", map[string]any{"output_format": "txt"}, "fixture.pdf", pdf),
+	}
+	return slices.DeleteFunc(cases, func(benchCase Case) bool { return slices.Contains(opts.Skip, benchCase.Name) })
+}
+
+// lazyFixture generates the fixture on first use, so only the cases that run pay for it.
+func lazyFixture(generate func() []byte) func() []byte {
+	var once sync.Once
+	var fixture []byte
+	return func() []byte {
+		once.Do(func() { fixture = generate() })
+		return fixture
+	}
+}
+
+// UploadCase benchmarks HandleFileUpload of the fixture, reporting throughput per uploaded byte.
+func UploadCase(name string, fixture func() []byte) Case {
+	return Case{Name: name, Run: func(b *testing.B) {
+		content := fixture()
+		runUploads(b, int64(len(content)), func() io.Reader { return bytes.NewReader(content) })
+	}}
+}
+
+// UploadStreamCase benchmarks HandleFileUpload of a generated stream of the size, see StreamFixture.
+func UploadStreamCase(name string, size int64) Case {
+	return Case{Name: name, Run: func(b *testing.B) {
+		runUploads(b, size, func() io.Reader { return StreamFixture(size) })
+	}}
+}
+
+func runUploads(b *testing.B, size int64, newReader func() io.Reader) {
+	fm, cleanup := newBenchFileManager(b)
+	defer cleanup()
+	b.SetBytes(size)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		fileProcess := filemanager.NewFileProcess("fixture", "")
+		file, err := fm.HandleFileUpload(newReader(), fileProcess, nil)
+		if err != nil {
+			b.Fatalf("uploading fixture: %v", err)
+		}
+		b.StopTimer()
+		fm.DiscardUpload(file)
+		b.StartTimer()
+	}
+}
+
+// RecipeCase benchmarks ProcessFileSync of a recipe with a single step of the plugin (none if it is nil) on the
+// fixture, storing the output in private storage. It reports the latency per processed file.
+func RecipeCase(name string, plugin filemanager.ProcessingPlugin, pluginName string, params map[string]any, fileName string, fixture func() []byte) Case {
+	return Case{Name: name, Run: func(b *testing.B) {
+		content := fixture()
+		mimeType := mimetype.Detect(content).String()
+		fm, cleanup := newBenchFileManager(b)
+		defer cleanup()
+		recipe := filemanager.Recipe{
+			Name:              "bench",
+			AcceptedMimeTypes: []string{mimeType},
+			MaxFileSize:       1 << 62,
+			OutputFormats:     []filemanager.OutputFormat{{TargetFileNames: []string{"bench/output"}, StorageType: filemanager.FileStorageTypePrivate}},
+		}
+		if plugin != nil {
+			fm.AddProcessingPlugin(pluginName, plugin)
+			recipe.ProcessingSteps = []filemanager.ProcessingStep{{PluginName: pluginName, Params: params}}
+		}
+		err := fm.AddRecipe(recipe)
+		if err != nil {
+			b.Fatalf("adding recipe: %v", err)
+		}
+
+		b.SetBytes(int64(len(content)))
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			// plugins replace the content and metadata of their input, every run starts from the fixture
+			file := &filemanager.ManagedFile{FileName: fileName, MimeType: mimeType, Content: content, FileSize: int64(len(content))}
+			_, err := fm.ProcessFileSync(file, recipe.Name, nil, filemanager.ProcessOptions{})
+			if err != nil {
+				b.Fatalf("processing fixture(%s): %v", fileName, err)
+			}
+		}
+	}}
+}
+
+// newBenchFileManager returns a FileManager on the local disk below a new temporary directory, as the copy-heavy
+// paths are the subject of the benchmarks. Its log is discarded.
+func newBenchFileManager(b *testing.B) (*filemanager.FileManager, func()) {
+	dir, err := os.MkdirTemp("", "filemanagerbench-")
+	if err != nil {
+		b.Fatalf("creating temp dir: %v", err)
+	}
+	fm := filemanager.NewFileManager(
+		filepath.Join(dir, "public"),
+		filepath.Join(dir, "private"),
+		"http://files.bench",
+		filepath.Join(dir, "temp"),
+		func(logLevel string, logContent string) {},
+	)
+	for _, path := range []string{"public", "private", "temp"} {
+		err = os.MkdirAll(filepath.Join(dir, path), os.ModePerm)
+		if err != nil {
+			b.Fatalf("creating %s dir: %v", path, err)
+		}
+	}
+	return fm, func() { os.RemoveAll(dir) }
+}
+
+// RunBenchmarks runs every case as a sub-benchmark of b, for go test -bench.
+func RunBenchmarks(b *testing.B, cases []Case) {
+	for _, benchCase := range cases {
+		b.Run(benchCase.Name, benchCase.Run)
+	}
+}
+
+// Run runs the cases outside of go test -bench and returns their results, e.g. to check them with CheckBaseline.
+func Run(cases []Case) Report {
+	report := Report{}
+	for _, benchCase := range cases {
+		result := testing.Benchmark(benchCase.Run)
+		if result.N == 0 {
+			// testing.Benchmark reports failed benchmarks with no iterations
+			report.Failed = append(report.Failed, benchCase.Name)
+			continue
+		}
+		report.Results = append(report.Results, newResult(benchCase.Name, result))
+	}
+	return report
+}
+
+func newResult(name string, result testing.BenchmarkResult) Result {
+	r := Result{
+		Name:        name,
+		Iterations:  result.N,
+		NsPerOp:     result.NsPerOp(),
+		AllocsPerOp: result.AllocsPerOp(),
+		BytesPerOp:  result.AllocedBytesPerOp(),
+	}
+	if result.Bytes > 0 && result.T > 0 {
+		r.MBPerSec = float64(result.Bytes) * float64(result.N) / 1e6 / result.T.Seconds()
+	}
+	return r
+}
+
+// String formats the result like go test -bench.
+func (r Result) String() string {
+	line := fmt.Sprintf("%-40s %8d %14d ns/op", r.Name, r.Iterations, r.NsPerOp)
+	if r.MBPerSec > 0 {
+		line += fmt.Sprintf(" %10.2f MB/s", r.MBPerSec)
+	}
+	return line + fmt.Sprintf(" %12d B/op %10d allocs/op", r.BytesPerOp, r.AllocsPerOp)
+}
@@ -0,0 +1,143 @@
+package filemanagerbench
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// UPDATE_BASELINE_ENV is the environment variable that makes CheckBaseline (re)write the baseline instead of
+// comparing against it: FILEMANAGER_UPDATE_BASELINE=1 go test ./...
+const UPDATE_BASELINE_ENV = "FILEMANAGER_UPDATE_BASELINE"
+
+// Result is the outcome of a benchmark case.
+type Result struct {
+	Name        string  `json:"name"`
+	Iterations  int     `json:"iterations"`
+	NsPerOp     int64   `json:"nsPerOp"`
+	MBPerSec    float64 `json:"mbPerSec,omitempty"`
+	AllocsPerOp int64   `json:"allocsPerOp"`
+	BytesPerOp  int64   `json:"bytesPerOp"`
+}
+
+// Report holds the results of a Run, stored as JSON as the baseline of later runs.
+type Report struct {
+	Results []Result `json:"results"`
+	Failed  []string `json:"failed,omitempty"` // cases that failed and have no result
+}
+
+// Result returns the result of the named case.
+func (r Report) Result(name string) (Result, bool) {
+	for _, result := range r.Results {
+		if result.Name == name {
+			return result, true
+		}
+	}
+	return Result{}, false
+}
+
+// LoadReport reads a report written by SaveReport.
+func LoadReport(path string) (Report, error) {
+	var report Report
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return report, err
+	}
+	err = json.Unmarshal(content, &report)
+	return report, err
+}
+
+// SaveReport writes the report as indented JSON.
+func SaveReport(path string, report Report) error {
+	content, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(path), os.ModePerm)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(content, '\n'), 0644)
+}
+
+// Tolerance is the accepted relative increase of a metric over the baseline, e.g. 0.2 for 20%. A zero value
+// disables the check of the metric.
+type Tolerance struct {
+	Time   float64 // ns/op, noisy across machines, keep it generous or compare on the same runner
+	Allocs float64 // allocs/op, stable across machines
+	Bytes  float64 // allocated B/op
+}
+
+// DefaultTolerance catches algorithmic regressions and extra copies of the content without failing on noise.
+var DefaultTolerance = Tolerance{Time: 0.5, Allocs: 0.1, Bytes: 0.25}
+
+// Regression is a metric of a case exceeding its tolerance.
+type Regression struct {
+	Name     string
+	Metric   string // "ns/op", "allocs/op" or "B/op"
+	Baseline float64
+	Current  float64
+}
+
+func (r Regression) String() string {
+	return fmt.Sprintf("%s: %s regressed from %.0f to %.0f (%+.1f%%)", r.Name, r.Metric, r.Baseline, r.Current, (r.Current/r.Baseline-1)*100)
+}
+
+// Compare returns the regressions of the report against the baseline. Cases missing in either are skipped.
+func Compare(report Report, baseline Report, tolerance Tolerance) []Regression {
+	var regressions []Regression
+	for _, current := range report.Results {
+		base, ok := baseline.Result(current.Name)
+		if !ok {
+			continue
+		}
+		metrics := []struct {
+			metric    string
+			baseline  int64
+			current   int64
+			tolerance float64
+		}{
+			{"ns/op", base.NsPerOp, current.NsPerOp, tolerance.Time},
+			{"allocs/op", base.AllocsPerOp, current.AllocsPerOp, tolerance.Allocs},
+			{"B/op", base.BytesPerOp, current.BytesPerOp, tolerance.Bytes},
+		}
+		for _, m := range metrics {
+			if m.tolerance <= 0 || m.baseline <= 0 {
+				continue
+			}
+			if float64(m.current) > float64(m.baseline)*(1+m.tolerance) {
+				regressions = append(regressions, Regression{Name: current.Name, Metric: m.metric, Baseline: float64(m.baseline), Current: float64(m.current)})
+			}
+		}
+	}
+	return regressions
+}
+
+// CheckBaseline fails the test for failed cases and for every regression of the report against the baseline at
+// path. A missing baseline fails the test unless baselines are being updated (FILEMANAGER_UPDATE_BASELINE=1), which
+// writes the report as the new baseline.
+func CheckBaseline(t testing.TB, report Report, path string, tolerance Tolerance) {
+	t.Helper()
+	for _, name := range report.Failed {
+		t.Errorf("benchmark(%s) failed", name)
+	}
+	if os.Getenv(UPDATE_BASELINE_ENV) != "" {
+		err := SaveReport(path, report)
+		if err != nil {
+			t.Fatalf("writing baseline(%s): %v", path, err)
+		}
+		return
+	}
+	baseline, err := LoadReport(path)
+	if err != nil {
+		t.Fatalf("reading baseline(%s): %v, run with %s=1 to create it", path, err, UPDATE_BASELINE_ENV)
+	}
+	for _, result := range report.Results {
+		t.Log(result)
+	}
+	for _, regression := range Compare(report, baseline, tolerance) {
+		t.Error(regression)
+	}
+}
@@ -0,0 +1,127 @@
+package filemanagertest
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	filemanager "github.com/itsatony/go-filemanager"
+)
+
+// TEST_BASE_URL is the fake public base URL of FileManagers created by NewTestFileManager.
+const TEST_BASE_URL = "http://files.test"
+
+// LogEntry is a log call recorded by a LogRecorder.
+type LogEntry struct {
+	Level   string
+	Content string
+}
+
+// LogRecorder is a LogAdapter that keeps every log call for assertions. It is safe for concurrent use.
+type LogRecorder struct {
+	entries []LogEntry
+	mu      sync.Mutex
+}
+
+// Log records the call, pass it as the LogAdapter of a FileManager.
+func (r *LogRecorder) Log(logLevel string, logContent string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.entries = append(r.entries, LogEntry{Level: logLevel, Content: logContent})
+}
+
+// Entries returns a copy of the recorded log calls, oldest first.
+func (r *LogRecorder) Entries() []LogEntry {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]LogEntry(nil), r.entries...)
+}
+
+// Contains reports whether a log call of the level (any level if empty) contains the substring.
+func (r *LogRecorder) Contains(logLevel string, substring string) bool {
+	for _, entry := range r.Entries() {
+		if (logLevel == "" || entry.Level == logLevel) && strings.Contains(entry.Content, substring) {
+			return true
+		}
+	}
+	return false
+}
+
+// Reset drops all recorded log calls.
+func (r *LogRecorder) Reset() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.entries = nil
+}
+
+// TestFileManager is a FileManager for unit tests: files are kept in a MemoryStorage, public URLs use
+// TEST_BASE_URL and logs are recorded.
+type TestFileManager struct {
+	*filemanager.FileManager
+	t       testing.TB
+	Storage *filemanager.MemoryStorage
+	Logs    *LogRecorder
+	// PublicPath, PrivatePath and TempPath are directories below t.TempDir(), so even the features that always use
+	// the local disk (versioning, trash, metadata sidecars) stay inside the test's sandbox.
+	PublicPath  string
+	PrivatePath string
+	TempPath    string
+}
+
+// NewTestFileManager returns a FileManager backed by an in-memory storage, with paths below t.TempDir(), fake
+// public URLs and a recording logger. Register plugins and recipes as usual.
+func NewTestFileManager(t testing.TB) *TestFileManager {
+	t.Helper()
+	dir := t.TempDir()
+	tfm := &TestFileManager{
+		t:           t,
+		Storage:     filemanager.NewMemoryStorage(),
+		Logs:        &LogRecorder{},
+		PublicPath:  filepath.Join(dir, "public"),
+		PrivatePath: filepath.Join(dir, "private"),
+		TempPath:    filepath.Join(dir, "temp"),
+	}
+	tfm.FileManager = filemanager.NewFileManager(tfm.PublicPath, tfm.PrivatePath, TEST_BASE_URL, tfm.TempPath, tfm.Logs.Log)
+	tfm.SetStorage(tfm.Storage)
+	return tfm
+}
+
+// Upload passes the content through HandleFileUpload and returns the uploaded file, failing the test on errors.
+func (tfm *TestFileManager) Upload(fileName string, content []byte) *filemanager.ManagedFile {
+	tfm.t.Helper()
+	fileProcess := filemanager.NewFileProcess(fileName, "")
+	statusCh := make(chan *filemanager.FileProcess)
+	go func() {
+		for range statusCh {
+		}
+	}()
+	file, err := tfm.HandleFileUpload(bytes.NewReader(content), fileProcess, statusCh)
+	close(statusCh)
+	if err != nil {
+		tfm.t.Fatalf("uploading file(%s): %v", fileName, err)
+	}
+	return file
+}
+
+// Process runs the recipe on the file and returns the final status once processing is done.
+func (tfm *TestFileManager) Process(file *filemanager.ManagedFile, recipeName string, params map[string]any) *filemanager.ProcessingStatus {
+	tfm.t.Helper()
+	fileProcess := filemanager.NewFileProcess(file.FileName, recipeName)
+	statusCh := make(chan *filemanager.FileProcess)
+	go tfm.ProcessFileWithOptions(file, recipeName, fileProcess, statusCh, filemanager.ProcessOptions{Params: params})
+	for range statusCh {
+	}
+	return fileProcess.GetLatestProcessingStatus()
+}
+
+// ReadFile returns the content of a stored file, failing the test if it does not exist.
+func (tfm *TestFileManager) ReadFile(localFilePath string) []byte {
+	tfm.t.Helper()
+	content, err := tfm.Storage.ReadFile(localFilePath)
+	if err != nil {
+		tfm.t.Fatalf("reading file(%s): %v", localFilePath, err)
+	}
+	return content
+}
@@ -0,0 +1,273 @@
+// Package filemanagertest provides helpers to test applications and recipes built on the filemanager package.
+package filemanagertest
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+
+	"github.com/disintegration/imaging"
+	filemanager "github.com/itsatony/go-filemanager"
+	"github.com/unidoc/unipdf/v3/extractor"
+	"github.com/unidoc/unipdf/v3/model"
+)
+
+// UPDATE_GOLDEN_ENV is the environment variable that makes RunRecipeAgainstFixture (re)write golden files
+// instead of comparing against them: FILEMANAGER_UPDATE_GOLDEN=1 go test ./...
+const UPDATE_GOLDEN_ENV = "FILEMANAGER_UPDATE_GOLDEN"
+
+// PROCESS_ID_PLACEHOLDER replaces the process ID in output paths, so golden file names are stable across runs.
+const PROCESS_ID_PLACEHOLDER = "PROCESS_ID"
+
+// FixtureOptions configure RunRecipeAgainstFixture.
+type FixtureOptions struct {
+	// Plugins are registered under their names, defaults to DefaultPlugins().
+	Plugins map[string]filemanager.ProcessingPlugin
+	// Params are passed as runtime parameters to the recipe.
+	Params map[string]any
+	// MetaData is set on the input file before processing.
+	MetaData map[string]any
+	// GoldenDir holds the expected outputs, defaults to testdata/golden/<recipe name>.
+	GoldenDir string
+	// Update writes the outputs as new golden files, also enabled by FILEMANAGER_UPDATE_GOLDEN=1.
+	Update bool
+	// ImageTolerance is the accepted mean absolute difference per color channel (0-255) between an output image
+	// and its golden image of the same size, to allow for encoder differences. 0 requires identical pixels.
+	ImageTolerance float64
+	// PDFTextOnly compares PDFs by page count and extracted text instead of bytes, ignoring fonts, compression
+	// and metadata such as creation dates.
+	PDFTextOnly bool
+}
+
+// FixtureResult is the outcome of a recipe run in the sandbox.
+type FixtureResult struct {
+	Status     *filemanager.ProcessingStatus
+	SandboxDir string
+	// Outputs are the paths of the output files relative to the sandbox, with the process ID replaced by
+	// PROCESS_ID_PLACEHOLDER, as used for the golden files.
+	Outputs []string
+}
+
+// DefaultPlugins returns the bundled plugins that work without external services, under the names used in the README.
+func DefaultPlugins() map[string]filemanager.ProcessingPlugin {
+	return map[string]filemanager.ProcessingPlugin{
+		"image_manipulation":      &filemanager.ImageManipulationPlugin{},
+		"pdf_manipulation":        &filemanager.PDFManipulationPlugin{},
+		"pdf_text_extractor":      &filemanager.PDFTextExtractorPlugin{},
+		"format_converter":        &filemanager.FormatConverterPlugin{},
+		"exif_metadata_extractor": &filemanager.ExifMetadataExtractorPlugin{},
+		"perceptual_hash":         &filemanager.PerceptualHashPlugin{},
+		"text_analysis":           &filemanager.TextAnalysisPlugin{},
+		"redaction":               &filemanager.RedactionPlugin{},
+	}
+}
+
+// RunRecipeAgainstFixture runs the recipe on the input file in a temporary sandbox and compares every output file
+// with its golden file (GoldenDir/<storage type>/<path>). Text outputs must match exactly, images within
+// ImageTolerance and PDFs byte by byte or, with PDFTextOnly, by text. Missing golden files fail the test unless
+// golden files are being updated.
+func RunRecipeAgainstFixture(t testing.TB, recipe filemanager.Recipe, inputPath string, opts FixtureOptions) FixtureResult {
+	t.Helper()
+	sandbox := t.TempDir()
+	fm := filemanager.NewFileManager(
+		filepath.Join(sandbox, "public"),
+		filepath.Join(sandbox, "private"),
+		TEST_BASE_URL,
+		filepath.Join(sandbox, "temp"),
+		func(logLevel string, logContent string) {
+			t.Logf("[%s] %s", logLevel, strings.TrimSpace(logContent))
+		},
+	)
+	plugins := opts.Plugins
+	if plugins == nil {
+		plugins = DefaultPlugins()
+	}
+	for name, plugin := range plugins {
+		fm.AddProcessingPlugin(name, plugin)
+	}
+	err := fm.AddRecipe(recipe)
+	if err != nil {
+		t.Fatalf("adding recipe: %v", err)
+	}
+
+	input, err := newFixtureInput(inputPath, filepath.Join(sandbox, "temp"))
+	if err != nil {
+		t.Fatalf("reading fixture(%s): %v", inputPath, err)
+	}
+	for key, value := range opts.MetaData {
+		input.SetMetaData(key, value)
+	}
+
+	fileProcess := filemanager.NewFileProcess(input.FileName, recipe.Name)
+	statusCh := make(chan *filemanager.FileProcess)
+	go fm.ProcessFileWithOptions(input, recipe.Name, fileProcess, statusCh, filemanager.ProcessOptions{Params: opts.Params})
+	for range statusCh {
+	}
+
+	status := fileProcess.GetLatestProcessingStatus()
+	result := FixtureResult{Status: status, SandboxDir: sandbox}
+	if status == nil || status.Error != nil || !status.Done {
+		t.Fatalf("recipe(%s) failed on fixture(%s): %+v", recipe.Name, inputPath, status)
+	}
+
+	goldenDir := opts.GoldenDir
+	if goldenDir == "" {
+		goldenDir = filepath.Join("testdata", "golden", recipe.Name)
+	}
+	update := opts.Update || os.Getenv(UPDATE_GOLDEN_ENV) != ""
+	for _, resultingFile := range status.ResultingFiles {
+		relativePath, err := filepath.Rel(sandbox, resultingFile.LocalFilePath)
+		if err != nil {
+			t.Fatalf("output(%s) outside of the sandbox: %v", resultingFile.LocalFilePath, err)
+		}
+		relativePath = strings.ReplaceAll(relativePath, fileProcess.ID, PROCESS_ID_PLACEHOLDER)
+		result.Outputs = append(result.Outputs, relativePath)
+		goldenPath := filepath.Join(goldenDir, relativePath)
+
+		actual, err := os.ReadFile(resultingFile.LocalFilePath)
+		if err != nil {
+			t.Fatalf("reading output(%s): %v", resultingFile.LocalFilePath, err)
+		}
+		if update {
+			err = os.MkdirAll(filepath.Dir(goldenPath), os.ModePerm)
+			if err == nil {
+				err = os.WriteFile(goldenPath, actual, 0644)
+			}
+			if err != nil {
+				t.Fatalf("writing golden file(%s): %v", goldenPath, err)
+			}
+			continue
+		}
+		expected, err := os.ReadFile(goldenPath)
+		if err != nil {
+			t.Errorf("missing golden file(%s) for output(%s), run with %s=1 to create it", goldenPath, relativePath, UPDATE_GOLDEN_ENV)
+			continue
+		}
+		err = compareOutput(resultingFile.MimeType, actual, expected, opts)
+		if err != nil {
+			t.Errorf("output(%s) differs from golden file(%s): %v", relativePath, goldenPath, err)
+		}
+	}
+	return result
+}
+
+func newFixtureInput(inputPath string, tempDir string) (*filemanager.ManagedFile, error) {
+	content, err := os.ReadFile(inputPath)
+	if err != nil {
+		return nil, err
+	}
+	mimeType, err := filemanager.GuessMimeType(inputPath)
+	if err != nil {
+		return nil, err
+	}
+	input := &filemanager.ManagedFile{
+		FileName:      filepath.Base(inputPath),
+		LocalFilePath: filepath.Join(tempDir, filepath.Base(inputPath)),
+		MimeType:      mimeType,
+		Content:       content,
+		FileSize:      int64(len(content)),
+		MetaData:      make(map[string]any),
+	}
+	err = os.MkdirAll(tempDir, os.ModePerm)
+	if err != nil {
+		return nil, err
+	}
+	return input, os.WriteFile(input.LocalFilePath, content, 0644)
+}
+
+func compareOutput(mimeType string, actual []byte, expected []byte, opts FixtureOptions) error {
+	switch {
+	case strings.HasPrefix(mimeType, "image/") && opts.ImageTolerance > 0:
+		return compareImages(actual, expected, opts.ImageTolerance)
+	case mimeType == "application/pdf" && opts.PDFTextOnly:
+		return comparePDFText(actual, expected)
+	}
+	if !bytes.Equal(actual, expected) {
+		return fmt.Errorf("content differs (%d bytes, golden %d bytes)", len(actual), len(expected))
+	}
+	return nil
+}
+
+func compareImages(actual []byte, expected []byte, tolerance float64) error {
+	actualImage, _, err := image.Decode(bytes.NewReader(actual))
+	if err != nil {
+		return fmt.Errorf("decoding output: %v", err)
+	}
+	expectedImage, _, err := image.Decode(bytes.NewReader(expected))
+	if err != nil {
+		return fmt.Errorf("decoding golden file: %v", err)
+	}
+	if actualImage.Bounds().Size() != expectedImage.Bounds().Size() {
+		return fmt.Errorf("size %v, golden %v", actualImage.Bounds().Size(), expectedImage.Bounds().Size())
+	}
+	a, b := imaging.Clone(actualImage), imaging.Clone(expectedImage)
+	total := 0.0
+	for i := range a.Pix {
+		diff := float64(a.Pix[i]) - float64(b.Pix[i])
+		if diff < 0 {
+			diff = -diff
+		}
+		total += diff
+	}
+	meanDifference := total / float64(len(a.Pix))
+	if meanDifference > tolerance {
+		return fmt.Errorf("mean channel difference %.2f exceeds tolerance %.2f", meanDifference, tolerance)
+	}
+	return nil
+}
+
+func comparePDFText(actual []byte, expected []byte) error {
+	actualPages, err := pdfPageTexts(actual)
+	if err != nil {
+		return fmt.Errorf("reading output: %v", err)
+	}
+	expectedPages, err := pdfPageTexts(expected)
+	if err != nil {
+		return fmt.Errorf("reading golden file: %v", err)
+	}
+	if len(actualPages) != len(expectedPages) {
+		return fmt.Errorf("%d pages, golden %d pages", len(actualPages), len(expectedPages))
+	}
+	for i := range actualPages {
+		if strings.Join(strings.Fields(actualPages[i]), " ") != strings.Join(strings.Fields(expectedPages[i]), " ") {
+			return fmt.Errorf("text of page %d differs", i+1)
+		}
+	}
+	return nil
+}
+
+func pdfPageTexts(content []byte) ([]string, error) {
+	reader, err := model.NewPdfReader(bytes.NewReader(content))
+	if err != nil {
+		return nil, err
+	}
+	numPages, err := reader.GetNumPages()
+	if err != nil {
+		return nil, err
+	}
+	texts := make([]string, 0, numPages)
+	for i := 1; i <= numPages; i++ {
+		page, err := reader.GetPage(i)
+		if err != nil {
+			return nil, err
+		}
+		ex, err := extractor.New(page)
+		if err != nil {
+			return nil, err
+		}
+		text, err := ex.ExtractText()
+		if err != nil {
+			return nil, err
+		}
+		texts = append(texts, text)
+	}
+	return texts, nil
+}